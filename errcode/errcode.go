@@ -0,0 +1,72 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package errcode
+
+import "fmt"
+
+// Code is the numeric code set by the server, along with the error string,
+// in the ErrorCode field of the ConnectResponse, PubAck, SubscriptionResponse
+// and CloseResponse protocols. Clients should rely on the code, not on the
+// string, to decide how to handle an error.
+type Code int32
+
+// Codes of the errors returned to clients. Codes are part of the protocol:
+// they can be added, but never changed or reused.
+const (
+	// OK is the code of responses without error.
+	OK Code = 0
+	// Unknown is the code of errors that don't have a more specific one,
+	// such as store failures, and of errors from servers not setting codes.
+	Unknown Code = 1
+	// InvalidRequest is returned for malformed requests, or requests with
+	// invalid fields such as a subject or start position.
+	InvalidRequest Code = 2
+	// LimitExceeded is returned when a store limit, such as the maximum
+	// number of channels or subscriptions per channel, is reached.
+	LimitExceeded Code = 3
+	// ServerBusy is returned when the server is recovering, overloaded or
+	// rate limiting the client. The request can be sent again later.
+	ServerBusy Code = 4
+	// ServerUnavailable is returned when this server can't handle the
+	// request, because it is shutting down or does not satisfy the channel
+	// placement constraints. The request can be sent to another server.
+	ServerUnavailable Code = 5
+	// UnknownClient is returned when the client ID is not registered.
+	UnknownClient Code = 6
+	// DuplicateClientID is returned when the client ID is already registered
+	// by a client that is still running.
+	DuplicateClientID Code = 7
+	// DuplicateDurable is returned when the durable subscription is already
+	// active.
+	DuplicateDurable Code = 8
+	// NotAuthorized is returned when the server's authorizer does not allow
+	// the client to connect, publish or subscribe.
+	NotAuthorized Code = 9
+)
+
+var codeNames = map[Code]string{
+	OK:                "OK",
+	Unknown:           "Unknown",
+	InvalidRequest:    "InvalidRequest",
+	LimitExceeded:     "LimitExceeded",
+	ServerBusy:        "ServerBusy",
+	ServerUnavailable: "ServerUnavailable",
+	UnknownClient:     "UnknownClient",
+	DuplicateClientID: "DuplicateClientID",
+	DuplicateDurable:  "DuplicateDurable",
+	NotAuthorized:     "NotAuthorized",
+}
+
+// String returns the name of the code.
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Code(%d)", int32(c))
+}
+
+// Retryable returns true if a request that failed with this code may
+// succeed if sent again later, without change.
+func (c Code) Retryable() bool {
+	return c == ServerBusy || c == ServerUnavailable
+}
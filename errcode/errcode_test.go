@@ -0,0 +1,27 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package errcode
+
+import "testing"
+
+func TestCodeString(t *testing.T) {
+	if s := LimitExceeded.String(); s != "LimitExceeded" {
+		t.Fatalf("Unexpected name: %v", s)
+	}
+	if s := Code(1000).String(); s != "Code(1000)" {
+		t.Fatalf("Unexpected name: %v", s)
+	}
+}
+
+func TestCodeRetryable(t *testing.T) {
+	for _, c := range []Code{ServerBusy, ServerUnavailable} {
+		if !c.Retryable() {
+			t.Fatalf("%v should be retryable", c)
+		}
+	}
+	for _, c := range []Code{OK, Unknown, InvalidRequest, LimitExceeded, UnknownClient, DuplicateClientID, DuplicateDurable, NotAuthorized} {
+		if c.Retryable() {
+			t.Fatalf("%v should not be retryable", c)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	stand "github.com/nats-io/nats-streaming-server/server"
+)
+
+// handleHandoffSignal hands the listening socket off to a new process on
+// SIGUSR2, then exits.
+func handleHandoffSignal(s *stand.StanServer) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2)
+	go func() {
+		for range c {
+			err := s.Handoff()
+			if err == stand.ErrHandoffNotSupported {
+				// The server is still running.
+				stand.Errorf("STAN: %v", err)
+				continue
+			}
+			if err != nil {
+				stand.Errorf("STAN: Handoff failed: %v", err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+	}()
+}
@@ -0,0 +1,10 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package main
+
+import (
+	stand "github.com/nats-io/nats-streaming-server/server"
+)
+
+// handleHandoffSignal does nothing, sockets can't be handed off on Windows.
+func handleHandoffSignal(s *stand.StanServer) {}
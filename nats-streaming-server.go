@@ -3,17 +3,24 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
 	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
 
 	"fmt"
 
 	natsd "github.com/nats-io/gnatsd/server"
 	stand "github.com/nats-io/nats-streaming-server/server"
 	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
+
+	// Database drivers of the SQL store.
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
 )
 
 var usageStr = `
@@ -21,13 +28,86 @@ Usage: nats-streaming-server [options]
 
 Streaming Server Options:
     -cid, --cluster_id  <cluster ID> Cluster ID (default: test-cluster)
-    -st,  --store <type>             Store type: MEMORY|FILE (default: MEMORY)
-          --dir <directory>          For FILE store type, this is the root directory
+    -st,  --store <type>             Store type: MEMORY|FILE|SQL|HYBRID|KV (default: MEMORY)
+          --dir <directory>          For FILE, HYBRID and KV store types, this is the root directory
+          --encrypt                  For FILE store type, encrypt the files (key in STAN_ENCRYPTION_KEY)
+          --file_compression <algo>  For FILE store type, compress message payloads (gzip|snappy)
+          --file_flush_interval <dur> For FILE store type, defer the writes of messages by up to this interval
+          --file_flush_bytes <number> For FILE store type, write messages once this many bytes are buffered
+          --file_ack_flush_interval <dur> For FILE store type, write the acks of subscriptions in batches at this interval
+          --file_slice_max_msgs <number> For FILE store type, max number of messages per message file
+          --file_slice_max_bytes <number> For FILE store type, max size of the payloads per message file
+          --file_crc <bool>          For FILE store type, verify the CRC-32 checksum of records on recovery (default: true)
+          --file_truncate_bad_tail   For FILE store type, truncate an incomplete or corrupted last record on recovery
+          --file_recover_channels <list> For FILE store type, only recover the channels matching these comma separated subjects
+          --sql_driver <driver>      For SQL store type, the database driver (postgres|mysql)
+          --sql_source <dsn>         For SQL store type, the data source name
+          --hybrid_max_mem_bytes <number> For HYBRID store type, payload bytes kept in memory per channel before spilling to disk
+          --hybrid_cache_bytes <number> For HYBRID store type, size of the cache of messages read back from disk (0: no cache)
+          --hybrid_read_ahead <number> For HYBRID store type, messages read at once from disk, into the cache, on sequential replays (0: none)
+          --memory_budget <number>   For MEMORY store type, payload bytes of the messages of all channels (0: no limit)
+          --memory_eviction <policy> For MEMORY store type, channels old messages are evicted from beyond the budget (proportional|lru)
     -mc,  --max_channels <number>    Max number of channels (aka subjects, topics, etc...)
     -msu, --max_subs <number>        Max number of subscriptions per channel
     -mm,  --max_msgs <number>        Max number of messages per channel
     -mb,  --max_bytes <number>       Max messages total size per channel
+          --max_inactivity <dur>     Time without subscriptions and new messages after which a channel is deleted (0: no limit)
+          --hb_interval <dur>        Interval at which the server sends heartbeats to clients (default: 30s)
+          --hb_timeout <dur>         How long the server waits for a heartbeat response (default: 10s)
+          --hb_fail_count <number>   Number of failed heartbeats before the server closes a client connection (default: 10)
+          --hb_max_interval <dur>    Longest heartbeat interval a client can request when connecting (0: clients can't change it)
     -ns,  --nats_server <url>        Connect to this external NATS Server (embedded otherwise)
+          --nats_user <user>         User of the connection to the NATS Server
+          --nats_pass <password>     Password of the connection to the NATS Server
+          --nats_token <token>       Authorization token of the connection to the NATS Server
+    -sc,  --stan_config <file>       Streaming server configuration file
+          --adaptive_max_inflight    Adjust subscriptions delivery window, up to their MaxInflight, based on acks latency
+          --canary_interval <dur>    Interval at which probes are published to check the delivery pipeline (0: disabled)
+          --delivery_workers <number> Go routines sending the new messages of a channel to its subscriptions in parallel (0: none)
+          --delivery_watchdog <dur>  Time without deliveries to a subscription with pending messages after which it is logged as stalled (0: disabled)
+          --watchdog_heal            Restart the deliveries the watchdog finds stalled
+          --clamp_start_position     Start subscriptions at the first or last message if their start sequence or time is out of range
+          --slow_consumer_wait <dur> Time a subscription can stay at its MaxInflight before being reported as a slow consumer (0: disabled)
+          --slow_consumer_action <string> What to do with slow consumers: notify, close_sub or close_client (default: notify)
+          --store_full_events        Publish the subscriptions that lost messages not acknowledged, discarded by the channel limits
+          --store_full_interval <dur> Minimum time between two checks of the subscriptions that lost messages of a full channel
+          --durable_grace_period <dur> Time during which an unsubscribed durable can be restored (0: deleted immediately)
+          --max_ordering_groups <int>  Max number of ordering groups messages can be published in (0: disabled)
+          --info_listen <host:port>  Serve the bootstrap info for clients over HTTP on this address
+          --max_redeliveries <number> Redeliveries of a message after which it is moved to the dead-letter channel, unless set by the subscription (0: no limit)
+          --dlq_prefix <prefix>      Prefix of the dead-letter channels (default: _STAN.DLQ)
+          --ft_group <name>          Name of the fault tolerance group, whose servers share the FILE store directory
+          --ft_failover_window <dur> Time without heartbeats from the active server before a standby takes over (default: 5s)
+          --archive_reader           Serve only replays from the store, opened read-only, under a new cluster ID
+          --drain_timeout <dur>      Time to drain publishes and acks before shutting down on a signal (0: immediate)
+          --handoff                  Accept NATS clients on a socket handed off to a new process on SIGUSR2
+          --handoff_window <dur>     Time over which NATS clients are disconnected after a handoff on SIGUSR2 (default: 10s)
+          --sub_rate <number>        Subscription requests accepted per second by the server (0: no limit)
+          --sub_burst <number>       Subscription requests accepted in a burst by the server (default: the rate)
+          --client_sub_rate <number> Subscription requests accepted per second from each client (0: no limit)
+          --client_sub_burst <number> Subscription requests accepted in a burst from each client (default: the rate)
+          --max_pub_acks_inflight <number> Messages from each client being stored and not acknowledged yet (0: no limit)
+          --client_pub_rate <number> Messages accepted per second from each client (0: no limit)
+          --client_pub_burst <number> Messages accepted in a burst from each client (default: the rate)
+          --client_pub_bytes_rate <number> Payload bytes accepted per second from each client (0: no limit)
+          --client_pub_bytes_burst <number> Payload bytes accepted in a burst from each client (default: the rate)
+          --max_clients_per_conn <number> Clients registered through a same NATS connection or user (0: no limit)
+          --max_channels_per_conn <number> Channels used by the clients of a same NATS connection or user (0: no limit)
+          --max_clients <number>     Clients registered with the server (0: no limit)
+          --max_subs_per_client <number> Subscriptions of each client (0: no limit)
+          --backlog_hint_interval <number> Append a backlog hint to every nth message sent to a subscription (0: disabled)
+          --record_pub_latency       Record the latency of the stages of publishes
+          --record_ack_latency       Record the ack latency of durables
+          --client_events            Publish the connections and disconnections of clients
+          --slow_request_time <dur>  Processing time of protocol requests above which they are logged as slow (0: disabled)
+          --slow_log_file <file>     File the slow requests are logged to (default: the server's log)
+          --ack_timer_slack <dur>    Redeliver messages expiring within this duration of an expired one with it (0: disabled)
+          --freeze_on_takeover       Halt deliveries to a client while checking if a connection with its ID replaces it
+          --dedup_window <dur>       Acknowledge without storing messages published again with the same GUID within this duration (0: disabled)
+          --max_inflight_per_sub <number> Max MaxInflight of subscriptions, larger requested values are capped (0: no limit)
+          --sniff_content_types      Detect the content type of stored messages and count them per channel
+          --queue_policy <string>    Delivery policy of queue groups: least_pending, round_robin or random (default: least_pending)
+          --exclusive_channels <list> Channels, comma separated and possibly with wildcards, delivering to a single subscription at a time
 
 Streaming Server TLS Options:
     -secure                          Use a TLS connection to the NATS server without
@@ -40,6 +120,7 @@ Streaming Server Logging Options:
     -SD, --stan_debug                Enable STAN debugging output
     -SV, --stan_trace                Trace the raw STAN protocol
     -SDV                             Debug and trace STAN
+          --log_json                 Write the logs as JSON objects, one per line
     (See additional NATS logging options below)
 
 Embedded NATS Server Options:
@@ -94,29 +175,65 @@ func main() {
 	// override the NoSigs for NATS since we have our own signal handler below
 	nOpts.NoSigs = true
 	stand.ConfigureLogger(sOpts, nOpts)
+	if sOpts.ValidateOnly {
+		validateAndExit(sOpts, nOpts)
+	}
 	s := stand.RunServerWithOpts(sOpts, nOpts)
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		s.Shutdown()
+		if sOpts.DrainTimeout > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), sOpts.DrainTimeout)
+			s.Stop(ctx)
+			cancel()
+		} else {
+			s.Shutdown()
+		}
+		os.Exit(0)
+	}()
+	handleHandoffSignal(s)
+	// Exit once demoted by a failover drill, to be restarted as a standby.
+	go func() {
+		<-s.Demoted()
 		os.Exit(0)
 	}()
 
 	runtime.Goexit()
 }
 
+// validateAndExit prints the result of the validation of the options
+// and exits with a non zero status if any of the checks failed.
+func validateAndExit(sOpts *stand.Options, nOpts *natsd.Options) {
+	report := stand.Validate(sOpts, nOpts)
+	fmt.Print(report)
+	if !report.OK() {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
 func parseFlags() (*stand.Options, *natsd.Options) {
 
 	// STAN options
 	var stanDebugAndTrace bool
+	var stanConfigFile string
+	var natsPassword, natsToken string
 
 	stanOpts := stand.GetDefaultOptions()
 	flag.StringVar(&stanOpts.ID, "cluster_id", stand.DefaultClusterID, "Cluster ID.")
 	flag.StringVar(&stanOpts.ID, "cid", stand.DefaultClusterID, "Cluster ID.")
-	flag.StringVar(&stanOpts.StoreType, "store", stores.TypeMemory, fmt.Sprintf("Store type: (%s|%s)", stores.TypeMemory, stores.TypeFile))
-	flag.StringVar(&stanOpts.StoreType, "st", stores.TypeMemory, fmt.Sprintf("Store type: (%s|%s)", stores.TypeMemory, stores.TypeFile))
+	flag.StringVar(&stanOpts.StoreType, "store", stores.TypeMemory, fmt.Sprintf("Store type: (%s|%s|%s|%s|%s)", stores.TypeMemory, stores.TypeFile, stores.TypeSQL, stores.TypeHybrid, stores.TypeKV))
+	flag.StringVar(&stanOpts.StoreType, "st", stores.TypeMemory, fmt.Sprintf("Store type: (%s|%s|%s|%s|%s)", stores.TypeMemory, stores.TypeFile, stores.TypeSQL, stores.TypeHybrid, stores.TypeKV))
 	flag.StringVar(&stanOpts.FilestoreDir, "dir", "", "Root directory")
+	flag.BoolVar(&stanOpts.Encrypt, "encrypt", false, "Encrypt the FILE store, with the key from the STAN_ENCRYPTION_KEY environment variable")
+	flag.StringVar(&stanOpts.SQLDriver, "sql_driver", "", "SQL database driver")
+	flag.StringVar(&stanOpts.SQLSource, "sql_source", "", "SQL data source name")
+	flag.Uint64Var(&stanOpts.HybridMaxMemBytes, "hybrid_max_mem_bytes", 0, "Payload bytes kept in memory per channel by HYBRID stores")
+	flag.Uint64Var(&stanOpts.HybridCacheBytes, "hybrid_cache_bytes", 0, "Size of the cache of messages read back from disk by HYBRID stores")
+	flag.IntVar(&stanOpts.HybridReadAhead, "hybrid_read_ahead", 0, "Messages read at once from disk on sequential replays by HYBRID stores")
+	flag.Uint64Var(&stanOpts.MemoryBudget, "memory_budget", 0, "Payload bytes of the messages of all channels of MEMORY stores")
+	flag.StringVar(&stanOpts.MemoryEviction, "memory_eviction", stores.EvictProportional, "Channels old messages are evicted from beyond the MEMORY store budget (proportional|lru)")
 	flag.IntVar(&stanOpts.MaxChannels, "max_channels", stand.DefaultChannelLimit, "Max number of channels")
 	flag.IntVar(&stanOpts.MaxChannels, "mc", stand.DefaultChannelLimit, "Max number of channels")
 	flag.IntVar(&stanOpts.MaxSubscriptions, "max_subs", stand.DefaultSubStoreLimit, "Max number of subscriptions per channel")
@@ -125,17 +242,77 @@ func parseFlags() (*stand.Options, *natsd.Options) {
 	flag.IntVar(&stanOpts.MaxMsgs, "mm", stand.DefaultMsgStoreLimit, "Max number of messages per channel")
 	flag.Uint64Var(&stanOpts.MaxBytes, "max_bytes", stand.DefaultMsgSizeStoreLimit, "Max messages total size per channel")
 	flag.Uint64Var(&stanOpts.MaxBytes, "mb", stand.DefaultMsgSizeStoreLimit, "Max messages total size per channel")
+	flag.DurationVar(&stanOpts.MaxInactivity, "max_inactivity", 0, "Time without subscriptions and new messages after which a channel is deleted (0: no limit)")
+	flag.DurationVar(&stanOpts.ClientHBInterval, "hb_interval", stand.DefaultHeartBeatInterval, "Interval at which the server sends heartbeats to clients")
+	flag.DurationVar(&stanOpts.ClientHBTimeout, "hb_timeout", stand.DefaultClientHBTimeout, "How long the server waits for a heartbeat response")
+	flag.IntVar(&stanOpts.ClientHBFailCount, "hb_fail_count", stand.DefaultMaxFailedHeartBeats, "Number of failed heartbeats before the server closes a client connection")
+	flag.DurationVar(&stanOpts.ClientHBMaxInterval, "hb_max_interval", 0, "Longest heartbeat interval a client can request when connecting (0: clients can't change it)")
 	flag.BoolVar(&stanOpts.Debug, "SD", false, "Enable STAN Debug logging.")
 	flag.BoolVar(&stanOpts.Debug, "stan_debug", false, "Enable STAN Debug logging.")
 	flag.BoolVar(&stanOpts.Trace, "SV", false, "Enable STAN Trace logging.")
 	flag.BoolVar(&stanOpts.Trace, "stan_trace", false, "Enable STAN Trace logging.")
 	flag.BoolVar(&stanDebugAndTrace, "SDV", false, "Enable STAN Debug and Trace logging.")
+	flag.BoolVar(&stanOpts.LogJSON, "log_json", false, "Write the logs as JSON objects, one per line.")
 	flag.BoolVar(&stanOpts.Secure, "secure", false, "Enables TLS secure connection that skips server verification.")
 	flag.StringVar(&stanOpts.ClientCert, "tls_client_cert", "", "Path to a client certificate file")
 	flag.StringVar(&stanOpts.ClientKey, "tls_client_key", "", "Path to a client key file")
 	flag.StringVar(&stanOpts.ClientCA, "tls_client_cacert", "", "Path to a client CA file")
 	flag.StringVar(&stanOpts.NATSServerURL, "nats_server", "", "URL of the NATS Server to connect to (embedded by default)")
 	flag.StringVar(&stanOpts.NATSServerURL, "ns", "", "URL of the NATS Server to connect to (embedded by default)")
+	flag.StringVar(&stanOpts.Username, "nats_user", "", "User of the connection to the NATS Server")
+	flag.StringVar(&natsPassword, "nats_pass", "", "Password of the connection to the NATS Server")
+	flag.StringVar(&natsToken, "nats_token", "", "Authorization token of the connection to the NATS Server")
+	flag.StringVar(&stanConfigFile, "sc", "", "Streaming server configuration file.")
+	flag.StringVar(&stanConfigFile, "stan_config", "", "Streaming server configuration file.")
+	flag.BoolVar(&stanOpts.AdaptiveMaxInFlight, "adaptive_max_inflight", false, "Adjust subscriptions delivery window, up to their MaxInflight, based on acks latency")
+	flag.DurationVar(&stanOpts.CanaryInterval, "canary_interval", 0, "Interval at which probes are published to check the delivery pipeline (0: disabled)")
+	flag.DurationVar(&stanOpts.DeliveryWatchdog, "delivery_watchdog", 0, "Time without deliveries to a subscription with pending messages after which it is logged as stalled (0: disabled)")
+	flag.BoolVar(&stanOpts.WatchdogHeal, "watchdog_heal", false, "Restart the deliveries the watchdog finds stalled")
+	flag.BoolVar(&stanOpts.ClampStartPosition, "clamp_start_position", false, "Start subscriptions at the first or last message if their start sequence or time is out of range")
+	flag.DurationVar(&stanOpts.SlowConsumerWait, "slow_consumer_wait", 0, "Time a subscription can stay at its MaxInflight before being reported as a slow consumer (0: disabled)")
+	flag.StringVar(&stanOpts.SlowConsumerAction, "slow_consumer_action", "", "What to do with slow consumers: notify, close_sub or close_client (default: notify)")
+	flag.BoolVar(&stanOpts.StoreFullEvents, "store_full_events", false, "Publish the subscriptions that lost messages not acknowledged, discarded by the channel limits")
+	flag.DurationVar(&stanOpts.StoreFullInterval, "store_full_interval", stand.DefaultStoreFullInterval, "Minimum time between two checks of the subscriptions that lost messages of a full channel")
+	flag.DurationVar(&stanOpts.DurableGracePeriod, "durable_grace_period", 0, "Time during which an unsubscribed durable can be restored (0: deleted immediately)")
+	flag.IntVar(&stanOpts.MaxOrderingGroups, "max_ordering_groups", 0, "Max number of ordering groups messages can be published in (0: disabled)")
+	flag.StringVar(&stanOpts.InfoListen, "info_listen", "", "Serve the bootstrap info for clients over HTTP on this address")
+	flag.IntVar(&stanOpts.MaxRedeliveries, "max_redeliveries", 0, "Redeliveries of a message after which it is moved to the dead-letter channel, unless set by the subscription (0: no limit)")
+	flag.StringVar(&stanOpts.DeadLetterPrefix, "dlq_prefix", stand.DefaultDLQPrefix, "Prefix of the dead-letter channels")
+	flag.StringVar(&stanOpts.FTGroupName, "ft_group", "", "Name of the fault tolerance group, whose servers share the FILE store directory")
+	flag.DurationVar(&stanOpts.FTFailoverWindow, "ft_failover_window", stand.DefaultFTFailoverWindow, "Time without heartbeats from the active server before a standby server takes over")
+	flag.BoolVar(&stanOpts.ArchiveReader, "archive_reader", false, "Serve only replays from the store, opened read-only, under a new cluster ID")
+	flag.DurationVar(&stanOpts.DrainTimeout, "drain_timeout", 0, "Time to drain publishes and acks before shutting down on a signal (0: immediate)")
+	flag.BoolVar(&stanOpts.Handoff, "handoff", false, "Accept NATS clients on a socket handed off to a new process on SIGUSR2")
+	flag.DurationVar(&stanOpts.HandoffWindow, "handoff_window", stand.DefaultHandoffWindow, "Time over which NATS clients are disconnected after a handoff")
+	flag.Float64Var(&stanOpts.SubRate, "sub_rate", 0, "Subscription requests accepted per second by the server (0: no limit)")
+	flag.IntVar(&stanOpts.SubBurst, "sub_burst", 0, "Subscription requests accepted in a burst by the server (default: the rate)")
+	flag.Float64Var(&stanOpts.ClientSubRate, "client_sub_rate", 0, "Subscription requests accepted per second from each client (0: no limit)")
+	flag.IntVar(&stanOpts.ClientSubBurst, "client_sub_burst", 0, "Subscription requests accepted in a burst from each client (default: the rate)")
+	flag.IntVar(&stanOpts.MaxPubAcksInFlight, "max_pub_acks_inflight", 0, "Messages from each client being stored and not acknowledged yet (0: no limit)")
+	flag.Float64Var(&stanOpts.ClientPubRate, "client_pub_rate", 0, "Messages accepted per second from each client (0: no limit)")
+	flag.IntVar(&stanOpts.ClientPubBurst, "client_pub_burst", 0, "Messages accepted in a burst from each client (default: the rate)")
+	flag.Float64Var(&stanOpts.ClientPubBytesRate, "client_pub_bytes_rate", 0, "Payload bytes accepted per second from each client (0: no limit)")
+	flag.IntVar(&stanOpts.ClientPubBytesBurst, "client_pub_bytes_burst", 0, "Payload bytes accepted in a burst from each client (default: the rate)")
+	flag.IntVar(&stanOpts.MaxClientsPerConn, "max_clients_per_conn", 0, "Clients registered through a same NATS connection or user (0: no limit)")
+	flag.IntVar(&stanOpts.MaxChannelsPerConn, "max_channels_per_conn", 0, "Channels used by the clients of a same NATS connection or user (0: no limit)")
+	flag.IntVar(&stanOpts.MaxClients, "max_clients", 0, "Clients registered with the server (0: no limit)")
+	flag.IntVar(&stanOpts.MaxSubsPerClient, "max_subs_per_client", 0, "Subscriptions of each client (0: no limit)")
+	flag.IntVar(&stanOpts.BacklogHintInterval, "backlog_hint_interval", 0, "Append a backlog hint to every nth message sent to a subscription (0: disabled)")
+	flag.BoolVar(&stanOpts.RecordPubLatency, "record_pub_latency", false, "Record the latency of the stages of publishes")
+	flag.BoolVar(&stanOpts.RecordAckLatency, "record_ack_latency", false, "Record the ack latency of durables")
+	flag.BoolVar(&stanOpts.ClientEvents, "client_events", false, "Publish the connections and disconnections of clients")
+	flag.DurationVar(&stanOpts.SlowRequestTime, "slow_request_time", 0, "Processing time of protocol requests above which they are logged as slow (0: disabled)")
+	flag.StringVar(&stanOpts.SlowLogFile, "slow_log_file", "", "File the slow requests are logged to (default: the server's log)")
+	flag.DurationVar(&stanOpts.AckTimerSlack, "ack_timer_slack", 0, "Redeliver messages expiring within this duration of an expired one with it (0: disabled)")
+	flag.BoolVar(&stanOpts.FreezeOnTakeover, "freeze_on_takeover", false, "Halt deliveries to a client while checking if a connection with its ID replaces it")
+	flag.DurationVar(&stanOpts.DedupWindow, "dedup_window", 0, "Acknowledge without storing messages published again with the same GUID within this duration (0: disabled)")
+	flag.IntVar(&stanOpts.MaxInflightPerSub, "max_inflight_per_sub", 0, "Max MaxInflight of subscriptions, larger requested values are capped (0: no limit)")
+	flag.BoolVar(&stanOpts.SniffContentTypes, "sniff_content_types", false, "Detect the content type of stored messages and count them per channel")
+	flag.StringVar(&stanOpts.QueuePolicy, "queue_policy", "", "Delivery policy of queue groups: least_pending, round_robin or random (default: least_pending)")
+	flag.Var(stringList{&stanOpts.ExclusiveChannels}, "exclusive_channels", "Channels, comma separated and possibly with wildcards, delivering to a single subscription at a time")
+	flag.BoolVar(&stanOpts.ValidateOnly, "dry-run", false, "Validate configuration, store and NATS connectivity, then exit")
+	flag.IntVar(&stanOpts.DeliveryBurst, "delivery_burst", stand.DefaultDeliveryBurst, "Max new messages sent to a subscription before moving to the next one (0: no limit)")
+	flag.IntVar(&stanOpts.DeliveryWorkers, "delivery_workers", 0, "Go routines sending the new messages of a channel to its subscriptions in parallel (0: none)")
 	flag.BoolVar(&stanOpts.FileStoreOpts.CompactEnabled, "file_compact_enabled", stores.DefaultFileStoreOptions.CompactEnabled, "Enable file compaction")
 	flag.IntVar(&stanOpts.FileStoreOpts.CompactFragmentation, "file_compact_frag", stores.DefaultFileStoreOptions.CompactFragmentation, "File fragmentation threshold for compaction")
 	flag.IntVar(&stanOpts.FileStoreOpts.CompactInterval, "file_compact_interval", stores.DefaultFileStoreOptions.CompactInterval, "Minimum interval (in seconds) between file compactions")
@@ -144,6 +321,14 @@ func parseFlags() (*stand.Options, *natsd.Options) {
 	flag.BoolVar(&stanOpts.FileStoreOpts.DoCRC, "file_crc", stores.DefaultFileStoreOptions.DoCRC, "Enable file CRC-32 checksum")
 	flag.Int64Var(&stanOpts.FileStoreOpts.CRCPolynomial, "file_crc_poly", stores.DefaultFileStoreOptions.CRCPolynomial, "Polynomial used to make the table used for CRC-32 checksum")
 	flag.BoolVar(&stanOpts.FileStoreOpts.DoSync, "file_sync", stores.DefaultFileStoreOptions.DoSync, "Enable File.Sync on Flush")
+	flag.StringVar(&stanOpts.FileStoreOpts.Compression, "file_compression", stores.DefaultFileStoreOptions.Compression, "Compression of message payloads (gzip|snappy)")
+	flag.DurationVar(&stanOpts.FileStoreOpts.FlushInterval, "file_flush_interval", stores.DefaultFileStoreOptions.FlushInterval, "Defer the writes of messages by up to this interval (0: write on every flush)")
+	flag.IntVar(&stanOpts.FileStoreOpts.FlushBytes, "file_flush_bytes", stores.DefaultFileStoreOptions.FlushBytes, "Write messages once this many bytes are buffered (0: write on every flush)")
+	flag.DurationVar(&stanOpts.FileStoreOpts.AckFlushInterval, "file_ack_flush_interval", stores.DefaultFileStoreOptions.AckFlushInterval, "Write the acks of subscriptions in batches at this interval (0: write each ack)")
+	flag.IntVar(&stanOpts.FileStoreOpts.SliceMaxMsgs, "file_slice_max_msgs", stores.DefaultFileStoreOptions.SliceMaxMsgs, "Max number of messages per message file (0: derived from the channel limits)")
+	flag.Int64Var(&stanOpts.FileStoreOpts.SliceMaxBytes, "file_slice_max_bytes", stores.DefaultFileStoreOptions.SliceMaxBytes, "Max size of the payloads per message file (0: derived from the channel limits)")
+	flag.BoolVar(&stanOpts.FileStoreOpts.TruncateBadTail, "file_truncate_bad_tail", stores.DefaultFileStoreOptions.TruncateBadTail, "Truncate an incomplete or corrupted last record of a file on recovery")
+	flag.Var(stringList{&stanOpts.FileStoreOpts.RecoverChannels}, "file_recover_channels", "Only recover the channels matching these comma separated subjects, possibly with wildcards")
 	flag.IntVar(&stanOpts.IOBatchSize, "io_batch_size", stand.DefaultIOBatchSize, "# of message to batch in flushing io")
 	flag.Int64Var(&stanOpts.IOSleepTime, "io_sleep_time", stand.DefaultIOSleepTime, "duration the server waits for more messages (in micro-seconds, 0 to disable)")
 	// NATS options
@@ -242,6 +427,17 @@ func parseFlags() (*stand.Options, *natsd.Options) {
 	//
 	// STAN server special option handling
 	//
+	// Parse config if given
+	if stanConfigFile != "" {
+		processStanConfigFile(stanConfigFile, stanOpts)
+	}
+	// The credentials of the NATS connection are kept as secrets.
+	if natsPassword != "" {
+		stanOpts.Password = util.NewSecret(natsPassword)
+	}
+	if natsToken != "" {
+		stanOpts.Token = util.NewSecret(natsToken)
+	}
 	// Ensure some options are set based on selected store type
 	checkStoreOpts(stanOpts)
 
@@ -253,14 +449,62 @@ func parseFlags() (*stand.Options, *natsd.Options) {
 	return stanOpts, &natsOpts
 }
 
+// processStanConfigFile replaces the streaming options with the ones from
+// the configuration file, and then applies the command line parameters,
+// which take precedence over the content of the file.
+func processStanConfigFile(configFile string, opts *stand.Options) {
+	fileOpts, err := stand.ProcessConfigFile(configFile)
+	if err != nil {
+		natsd.PrintAndDie(err.Error())
+	}
+	// Capture the flags that have been set before overwriting the options.
+	setFlags := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = f.Value.String()
+	})
+	*opts = *fileOpts
+	for name, value := range setFlags {
+		if err := flag.Set(name, value); err != nil {
+			natsd.PrintAndDie(err.Error())
+		}
+	}
+}
+
+// stringList is a flag setting a list of strings from a comma separated
+// value.
+type stringList struct {
+	list *[]string
+}
+
+func (l stringList) String() string {
+	if l.list == nil {
+		return ""
+	}
+	return strings.Join(*l.list, ",")
+}
+
+func (l stringList) Set(value string) error {
+	*l.list = nil
+	if value != "" {
+		*l.list = strings.Split(value, ",")
+	}
+	return nil
+}
+
 func checkStoreOpts(opts *stand.Options) {
 	// Convert the user input to upper case
 	storeType := strings.ToUpper(opts.StoreType)
 
-	// If FILE, check some parameters
-	if storeType == stores.TypeFile {
+	// If FILE, HYBRID or KV, check some parameters
+	if storeType == stores.TypeFile || storeType == stores.TypeHybrid || storeType == stores.TypeKV {
 		if opts.FilestoreDir == "" {
-			fmt.Printf("\nFor %v stores, option \"-dir\" must be specified\n", stores.TypeFile)
+			fmt.Printf("\nFor %v stores, option \"-dir\" must be specified\n", storeType)
+			flag.Usage()
+			os.Exit(0)
+		}
+	} else if storeType == stores.TypeSQL {
+		if opts.SQLDriver == "" || opts.SQLSource == "" {
+			fmt.Printf("\nFor %v stores, options \"-sql_driver\" and \"-sql_source\" must be specified\n", stores.TypeSQL)
 			flag.Usage()
 			os.Exit(0)
 		}
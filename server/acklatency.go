@@ -0,0 +1,88 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// ackLatency records, with Options.RecordAckLatency, the time between the
+// first delivery of messages to a durable and their acknowledgment. It is
+// kept by the durable's subState, so it survives the resubscriptions of the
+// durable, but not server restarts.
+type ackLatency struct {
+	sent map[uint64]int64 // time at which the pending messages were first sent
+	hist LatencyHistogram
+}
+
+// recordAckSent records the time at which the message is sent to the
+// durable. Redelivered messages are not measured: their first delivery is
+// forgotten, so that their ack is ignored.
+// Sub lock held on entry.
+func (s *StanServer) recordAckSent(sub *subState, m *spb.MsgProto) {
+	if !s.opts.RecordAckLatency || sub.DurableName == "" {
+		return
+	}
+	if sub.ackLatency == nil {
+		sub.ackLatency = &ackLatency{sent: make(map[uint64]int64)}
+	}
+	if m.Redelivered {
+		delete(sub.ackLatency.sent, m.Sequence)
+		return
+	}
+	sub.ackLatency.sent[m.Sequence] = s.clock.Now().UnixNano()
+}
+
+// onAck counts the latency of the ack of the given sequence, if its
+// delivery was recorded.
+func (al *ackLatency) onAck(sequence uint64, now int64) {
+	sent, ok := al.sent[sequence]
+	if !ok {
+		return
+	}
+	delete(al.sent, sequence)
+	al.hist.add(time.Duration(now - sent))
+}
+
+// ackLatencyHistogram returns a copy of the ack latency histogram of the
+// subscription, nil if none was recorded.
+// Sub lock held on entry.
+func (sub *subState) ackLatencyHistogram() *LatencyHistogram {
+	if sub.ackLatency == nil {
+		return nil
+	}
+	h := sub.ackLatency.hist
+	return &h
+}
+
+// setAckLatencyHint adds the median and 99th percentile of the ack latency
+// of the durable to its backlog hint.
+// Sub lock held on entry.
+func setAckLatencyHint(sub *subState, hint *spb.BacklogHint) {
+	if sub.ackLatency == nil || sub.ackLatency.hist.Count == 0 {
+		return
+	}
+	hint.AckLatencyP50 = uint64(sub.ackLatency.hist.Quantile(0.5))
+	hint.AckLatencyP99 = uint64(sub.ackLatency.hist.Quantile(0.99))
+}
+
+// DurableAckLatency returns the histogram of the time between the first
+// delivery of messages to the durable and their acknowledgment, and false
+// if Options.RecordAckLatency is not set or if the durable does not exist.
+func (s *StanServer) DurableAckLatency(channel, clientID, durableName string) (LatencyHistogram, bool) {
+	if !s.opts.RecordAckLatency {
+		return LatencyHistogram{}, false
+	}
+	sub := s.lookupDurable(channel, clientID, durableName)
+	if sub == nil {
+		return LatencyHistogram{}, false
+	}
+	sub.RLock()
+	defer sub.RUnlock()
+	if sub.ackLatency == nil {
+		return LatencyHistogram{}, true
+	}
+	return sub.ackLatency.hist, true
+}
@@ -0,0 +1,150 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+func TestAckLatencyRedeliveries(t *testing.T) {
+	clock := util.NewManualClock(time.Now())
+	s := &StanServer{opts: &Options{RecordAckLatency: true}, clock: clock}
+
+	plain := &subState{}
+	s.recordAckSent(plain, &spb.MsgProto{Sequence: 1})
+	if plain.ackLatency != nil {
+		t.Fatal("Ack latency of non durables should not be recorded")
+	}
+
+	sub := &subState{SubState: spb.SubState{DurableName: "dur"}}
+	s.recordAckSent(sub, &spb.MsgProto{Sequence: 1})
+	s.recordAckSent(sub, &spb.MsgProto{Sequence: 2})
+	clock.Advance(3 * time.Millisecond)
+	// The redelivered message is not measured.
+	s.recordAckSent(sub, &spb.MsgProto{Sequence: 2, Redelivered: true})
+	clock.Advance(time.Millisecond)
+	for _, seq := range []uint64{1, 2, 3} {
+		sub.ackLatency.onAck(seq, clock.Now().UnixNano())
+	}
+	if h := sub.ackLatencyHistogram(); h.Count != 1 || h.Max != 4*time.Millisecond {
+		t.Fatalf("Unexpected histogram: %+v", h)
+	}
+	if len(sub.ackLatency.sent) != 0 {
+		t.Fatalf("Unexpected pending deliveries: %v", sub.ackLatency.sent)
+	}
+}
+
+func TestDurableAckLatency(t *testing.T) {
+	clock := util.NewManualClock(time.Now())
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.Clock = clock
+	opts.RecordAckLatency = true
+	opts.BacklogHintInterval = 1
+	opts.AdminUsers = []*AdminUser{{Name: "read", Token: util.NewSecret(adminReadToken), Role: RoleReadOnly}}
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	publish := func() {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			stackFatalf(t, "Unexpected error on publish: %v", err)
+		}
+	}
+	publish()
+
+	// Subscribe with the protocol to control the acks and get the hints.
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+	raw := make(chan *nats.Msg, 10)
+	inbox := nats.NewInbox()
+	if _, err := nc.ChanSubscribe(inbox, raw); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	req := &spb.SubscriptionRequest{
+		ClientID:      clientName,
+		Subject:       "foo",
+		Inbox:         inbox,
+		MaxInFlight:   10,
+		AckWaitInSecs: 30,
+		DurableName:   "dur",
+		StartPosition: spb.StartPosition_First,
+	}
+	b, _ := req.Marshal()
+	reply, err := nc.Request(s.info.Subscribe, b, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error on subscription request: %v", err)
+	}
+	resp := &spb.SubscriptionResponse{}
+	resp.Unmarshal(reply.Data)
+	if resp.Error != "" {
+		t.Fatalf("Unexpected error on subscription request: %v", resp.Error)
+	}
+	next := func() (*spb.MsgProto, spb.BacklogHint) {
+		msg := &spb.MsgProto{}
+		hint := spb.BacklogHint{}
+		select {
+		case m := <-raw:
+			if err := msg.Unmarshal(m.Data); err != nil {
+				stackFatalf(t, "Unexpected error on unmarshal: %v", err)
+			}
+			if err := hint.Unmarshal(m.Data); err != nil {
+				stackFatalf(t, "Unexpected error on unmarshal: %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			stackFatalf(t, "Did not get our message")
+		}
+		return msg, hint
+	}
+
+	msg, hint := next()
+	if hint.AckLatencyP50 != 0 || hint.AckLatencyP99 != 0 {
+		t.Fatalf("Unexpected hint: %v", hint)
+	}
+	clock.Advance(10 * time.Millisecond)
+	ack, _ := (&pb.Ack{Subject: "foo", Sequence: msg.Sequence}).Marshal()
+	if err := nc.Publish(resp.AckInbox, ack); err != nil {
+		t.Fatalf("Unexpected error on ack: %v", err)
+	}
+	waitForCount(t, 1, func() (string, int) {
+		h, _ := s.DurableAckLatency("foo", clientName, "dur")
+		return "acks", int(h.Count)
+	})
+	if h, ok := s.DurableAckLatency("foo", clientName, "dur"); !ok || h.Max != 10*time.Millisecond {
+		t.Fatalf("Unexpected histogram: %+v", h)
+	}
+	if _, ok := s.DurableAckLatency("foo", clientName, "other"); ok {
+		t.Fatal("Expected no histogram for unknown durable")
+	}
+
+	// The next hints carry the latency.
+	publish()
+	if _, hint := next(); hint.AckLatencyP50 != uint64(10*time.Millisecond) || hint.AckLatencyP99 != uint64(10*time.Millisecond) {
+		t.Fatalf("Unexpected hint: %v", hint)
+	}
+
+	// And so does the state of the subscription.
+	areq := &spb.AdminRequest{Token: adminReadToken, Operation: AdminOpSubscriptions, Channel: "foo"}
+	aresp := sendAdminRequest(t, nc, areq)
+	if aresp.Error != "" {
+		t.Fatalf("Unexpected error: %v", aresp.Error)
+	}
+	var states []*SubscriptionState
+	if err := json.Unmarshal(aresp.Data, &states); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(states) != 1 || states[0].AckLatency == nil || states[0].AckLatency.Count != 1 {
+		t.Fatalf("Unexpected states: %+v", states)
+	}
+}
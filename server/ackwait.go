@@ -0,0 +1,62 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"time"
+)
+
+// setSubAckWait changes the AckWait of the subscription, in whole seconds,
+// and persists the new value. Any redelivery backoff is reset. If messages
+// are pending, the ack timer is rescheduled to fire when the oldest one
+// expires with the new AckWait, right away if it already has.
+func (s *StanServer) setSubAckWait(sub *subState, ackWait time.Duration) error {
+	if sub == nil {
+		return ErrInvalidSub
+	}
+	if ackWait < time.Second {
+		return ErrInvalidAckWait
+	}
+	ackWait = ackWait / time.Second * time.Second
+	sub.Lock()
+	defer sub.Unlock()
+	sub.AckWaitInSecs = int32(ackWait / time.Second)
+	sub.ackWait = ackWait
+	sub.baseAckWait = 0
+	// Subscriptions not written to the store yet will be with the new value.
+	if sub.lazy == nil {
+		if err := sub.store.UpdateSub(&sub.SubState); err != nil {
+			return err
+		}
+	}
+	s.log.Debugf("STAN: [Client:%s] Subscription on %s AckWait=%v", sub.ClientID, sub.subject, ackWait)
+	if sub.ackTimer == nil || len(sub.acksPending) == 0 {
+		return nil
+	}
+	oldest := int64(0)
+	for _, m := range sub.acksPending {
+		if oldest == 0 || m.Timestamp < oldest {
+			oldest = m.Timestamp
+		}
+	}
+	fireIn := time.Duration(oldest + int64(ackWait) - s.clock.Now().UnixNano())
+	if fireIn < 0 {
+		fireIn = 0
+	}
+	// The floor was computed with the previous AckWait.
+	sub.ackTimeFloor = 0
+	sub.ackTimer.Reset(fireIn)
+	return nil
+}
+
+// SetAckWait changes the AckWait of the subscription with the given ack
+// inbox on the channel.
+func (s *StanServer) SetAckWait(channel, ackInbox string, ackWait time.Duration) error {
+	return s.setSubAckWait(s.lookupSubByAckInbox(channel, ackInbox), ackWait)
+}
+
+// SetDurableAckWait changes the AckWait of the durable, whether its client
+// is connected or not.
+func (s *StanServer) SetDurableAckWait(channel, clientID, durableName string, ackWait time.Duration) error {
+	return s.setSubAckWait(s.lookupDurable(channel, clientID, durableName), ackWait)
+}
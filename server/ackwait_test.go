@@ -0,0 +1,113 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestDurableResubscribeAckWait(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+
+	checkAckWait := func(expected int32) {
+		states, _ := s.SubscriptionsState("foo", "")
+		if len(states) != 1 || states[0].AckWaitInSecs != expected {
+			stackFatalf(t, "Expected AckWait %v, got %+v", expected, states)
+		}
+	}
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}, stan.DurableName("dur"), stan.AckWait(30*time.Second)); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	checkAckWait(30)
+	sc.Close()
+
+	// The new AckWait replaces the remembered one.
+	sc = NewDefaultConnection(t)
+	defer sc.Close()
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}, stan.DurableName("dur"), stan.AckWait(5*time.Second)); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	checkAckWait(5)
+}
+
+func TestAdminSetAckWait(t *testing.T) {
+	s := runServerWithAdminUsers()
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	// The message is never acknowledged.
+	ch := make(chan *stan.Msg, 10)
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) { ch <- m }, stan.DeliverAllAvailable(),
+		stan.AckWait(time.Minute), stan.SetManualAckMode()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	checkReceived(t, ch, 1)
+	states, _ := s.SubscriptionsState("foo", "")
+	if len(states) != 1 {
+		t.Fatalf("Expected 1 subscription, got %v", len(states))
+	}
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+	req := &spb.AdminRequest{Token: adminOperatorToken, Operation: AdminOpSetAckWait,
+		Channel: "foo", AckInbox: states[0].AckInbox, AckWaitInSecs: 1}
+	if resp := sendAdminRequest(t, nc, req); resp.Error != "" {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+	// The redelivery is rescheduled with the new AckWait.
+	select {
+	case m := <-ch:
+		if !m.Redelivered {
+			t.Fatalf("Expected message to be redelivered")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Message should have been redelivered")
+	}
+	if states, _ := s.SubscriptionsState("foo", ""); states[0].AckWaitInSecs != 1 {
+		t.Fatalf("Expected AckWait 1, got %v", states[0].AckWaitInSecs)
+	}
+
+	req.AckWaitInSecs = 0
+	if resp := sendAdminRequest(t, nc, req); resp.Error != ErrInvalidAckWait.Error() {
+		t.Fatalf("Expected error %q, got %q", ErrInvalidAckWait, resp.Error)
+	}
+	req.AckWaitInSecs, req.AckInbox = 1, "unknown"
+	if resp := sendAdminRequest(t, nc, req); resp.Error != ErrInvalidSub.Error() {
+		t.Fatalf("Expected error %q, got %q", ErrInvalidSub, resp.Error)
+	}
+	req.Token = adminReadToken
+	if resp := sendAdminRequest(t, nc, req); resp.Error != ErrAdminForbidden.Error() {
+		t.Fatalf("Expected error %q, got %q", ErrAdminForbidden, resp.Error)
+	}
+
+	// The durable of a closed client.
+	if _, err := sc.Subscribe("bar", func(_ *stan.Msg) {}, stan.DurableName("dur")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	sc.Close()
+	if err := s.SetDurableAckWait("bar", clientName, "dur", 10*time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sub := s.lookupDurable("bar", clientName, "dur")
+	sub.RLock()
+	ackWait, ackWaitInSecs := sub.ackWait, sub.AckWaitInSecs
+	sub.RUnlock()
+	if ackWait != 10*time.Second || ackWaitInSecs != 10 {
+		t.Fatalf("Unexpected AckWait: %v %v", ackWait, ackWaitInSecs)
+	}
+}
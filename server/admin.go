@@ -0,0 +1,324 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+// DefaultAdminPrefix is the prefix of the subject on which the server
+// receives admin requests. The cluster ID is appended to it.
+const DefaultAdminPrefix = "_STAN.admin"
+
+// AdminRole is the level of access granted to an admin user. Each role
+// includes the permissions of the roles below it.
+type AdminRole int
+
+const (
+	// RoleReadOnly allows querying the server's state.
+	RoleReadOnly AdminRole = iota
+	// RoleOperator also allows actions that don't lose data, such as
+	// closing a client connection.
+	RoleOperator
+	// RoleDestructive also allows actions that delete data, such as
+	// purging or deleting a channel.
+	RoleDestructive
+)
+
+// String returns the name of the role, as used in the configuration file.
+func (r AdminRole) String() string {
+	switch r {
+	case RoleReadOnly:
+		return "read"
+	case RoleOperator:
+		return "operator"
+	case RoleDestructive:
+		return "destructive"
+	}
+	return fmt.Sprintf("unknown role (%d)", int(r))
+}
+
+// ParseAdminRole returns the role with the given name.
+func ParseAdminRole(name string) (AdminRole, error) {
+	switch strings.ToLower(name) {
+	case "read", "readonly", "read_only":
+		return RoleReadOnly, nil
+	case "operator":
+		return RoleOperator, nil
+	case "destructive", "admin":
+		return RoleDestructive, nil
+	}
+	return RoleReadOnly, fmt.Errorf("unknown admin role %q", name)
+}
+
+// AdminUser is a user allowed to send admin requests. Requests are
+// authenticated with the user's token and authorized based on its role.
+type AdminUser struct {
+	Name  string
+	Token *util.Secret
+	Role  AdminRole
+}
+
+// Admin operations
+const (
+	AdminOpServerInfo       = "server_info"
+	AdminOpPurgeChannel     = "purge_channel"
+	AdminOpDeleteChannel    = "delete_channel"
+	AdminOpDisconnectClient = "disconnect_client"
+	AdminOpRestoreDurable   = "restore_durable"
+	AdminOpSubscriptions    = "subscriptions"
+	AdminOpSetMaxInflight   = "set_max_inflight"
+	AdminOpSetAckWait       = "set_ack_wait"
+	AdminOpChannelLimits    = "channel_limits"
+	AdminOpFailoverDrill    = "failover_drill"
+	AdminOpFailoverReport   = "failover_drill_report"
+	AdminOpChannels         = "channels"
+	AdminOpGetMsg           = "get_msg"
+	AdminOpSeqToTime        = "seq_to_time"
+	AdminOpTimeToSeq        = "time_to_seq"
+	AdminOpClients          = "clients"
+	AdminOpRemoveClient     = "remove_client"
+)
+
+// Errors returned to admin requests
+var (
+	ErrInvalidAdminReq = errors.New("stan: invalid admin request")
+	ErrAdminAuth       = errors.New("stan: admin authentication failed")
+	ErrAdminUnknownOp  = errors.New("stan: unknown admin operation")
+	ErrAdminForbidden  = errors.New("stan: admin operation not permitted for this role")
+)
+
+// adminOp is an admin operation with the minimum role required to run it.
+type adminOp struct {
+	role    AdminRole
+	handler func(s *StanServer, req *spb.AdminRequest) (interface{}, error)
+}
+
+// adminOps lists the supported admin operations, keyed by name.
+var adminOps = map[string]adminOp{
+	AdminOpServerInfo:       {RoleReadOnly, (*StanServer).adminServerInfo},
+	AdminOpPurgeChannel:     {RoleDestructive, (*StanServer).adminPurgeChannel},
+	AdminOpDeleteChannel:    {RoleDestructive, (*StanServer).adminDeleteChannel},
+	AdminOpDisconnectClient: {RoleOperator, (*StanServer).adminDisconnectClient},
+	AdminOpRestoreDurable:   {RoleOperator, (*StanServer).adminRestoreDurable},
+	AdminOpSubscriptions:    {RoleReadOnly, (*StanServer).adminSubscriptions},
+	AdminOpSetMaxInflight:   {RoleOperator, (*StanServer).adminSetMaxInflight},
+	AdminOpSetAckWait:       {RoleOperator, (*StanServer).adminSetAckWait},
+	AdminOpChannelLimits:    {RoleReadOnly, (*StanServer).adminChannelLimits},
+	AdminOpFailoverDrill:    {RoleDestructive, (*StanServer).adminFailoverDrill},
+	AdminOpFailoverReport:   {RoleReadOnly, (*StanServer).adminFailoverReport},
+	AdminOpChannels:         {RoleReadOnly, (*StanServer).adminChannels},
+	AdminOpGetMsg:           {RoleReadOnly, (*StanServer).adminGetMsg},
+	AdminOpSeqToTime:        {RoleReadOnly, (*StanServer).adminSeqToTime},
+	AdminOpTimeToSeq:        {RoleReadOnly, (*StanServer).adminTimeToSeq},
+	AdminOpClients:          {RoleReadOnly, (*StanServer).adminClients},
+	AdminOpRemoveClient:     {RoleDestructive, (*StanServer).adminRemoveClient},
+}
+
+// AdminServerInfo is the result of the AdminOpServerInfo operation.
+type AdminServerInfo struct {
+	ClusterID string `json:"cluster_id"`
+	Clients   int    `json:"clients"`
+	Msgs      int    `json:"msgs"`
+	Bytes     uint64 `json:"bytes"`
+	LazySubs  int    `json:"lazy_subs"`
+}
+
+// AdminRemovedClient is the result of the AdminOpRemoveClient operation.
+type AdminRemovedClient struct {
+	DurablesRemoved int `json:"durables_removed"`
+}
+
+func (s *StanServer) adminSubject() string {
+	return fmt.Sprintf("%s.%s", DefaultAdminPrefix, s.info.ClusterID)
+}
+
+// authorizeAdmin returns the admin user identified by the token if the
+// user's role allows the operation, an error otherwise.
+func (s *StanServer) authorizeAdmin(token, operation string) (*AdminUser, error) {
+	op, ok := adminOps[operation]
+	if !ok {
+		return nil, ErrAdminUnknownOp
+	}
+	var user *AdminUser
+	// Go through all users so that the time taken does not depend
+	// on which user, if any, matches.
+	for _, u := range s.opts.AdminUsers {
+		if u.Token.Equal(token) && user == nil {
+			user = u
+		}
+	}
+	if user == nil {
+		return nil, ErrAdminAuth
+	}
+	if user.Role < op.role {
+		return user, ErrAdminForbidden
+	}
+	return user, nil
+}
+
+// processAdminRequest authenticates, authorizes and runs an admin request.
+func (s *StanServer) processAdminRequest(m *nats.Msg) {
+	req := &spb.AdminRequest{}
+	if err := req.Unmarshal(m.Data); err != nil {
+		s.log.Errorf("STAN: Invalid admin request: %v", err)
+		s.sendAdminResponse(m.Reply, nil, ErrInvalidAdminReq)
+		return
+	}
+	user, err := s.authorizeAdmin(req.Token, req.Operation)
+	if err != nil {
+		name := ""
+		if user != nil {
+			name = user.Name
+		}
+		s.log.Noticef("STAN: Admin request %q rejected (user=%q): %v", req.Operation, name, err)
+		s.sendAdminResponse(m.Reply, nil, err)
+		return
+	}
+	s.log.Debugf("STAN: Admin request %q from user %q", req.Operation, user.Name)
+	result, err := adminOps[req.Operation].handler(s, req)
+	s.sendAdminResponse(m.Reply, result, err)
+	// A failover drill shuts the server down once the requestor knows
+	// the state handed over.
+	if req.Operation == AdminOpFailoverDrill && err == nil {
+		s.nc.Flush()
+		go s.demoteForDrill()
+	}
+}
+
+// sendAdminResponse sends the JSON encoded result, or the error, to
+// the requestor.
+func (s *StanServer) sendAdminResponse(reply string, result interface{}, err error) {
+	resp := &spb.AdminResponse{}
+	if err == nil && result != nil {
+		resp.Data, err = json.Marshal(result)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	if b, err := resp.Marshal(); err == nil {
+		s.nc.Publish(reply, b)
+	}
+}
+
+func (s *StanServer) adminServerInfo(req *spb.AdminRequest) (interface{}, error) {
+	msgs, bytes, err := s.store.MsgsState(stores.AllChannels)
+	if err != nil {
+		return nil, err
+	}
+	return &AdminServerInfo{
+		ClusterID: s.info.ClusterID,
+		Clients:   s.store.GetClientsCount(),
+		Msgs:      msgs,
+		Bytes:     bytes,
+		LazySubs:  s.LazySubsCount(),
+	}, nil
+}
+
+func (s *StanServer) adminPurgeChannel(req *spb.AdminRequest) (interface{}, error) {
+	return nil, s.PurgeChannel(req.Channel)
+}
+
+func (s *StanServer) adminDeleteChannel(req *spb.AdminRequest) (interface{}, error) {
+	return nil, s.DeleteChannel(req.Channel, req.Force)
+}
+
+func (s *StanServer) adminDisconnectClient(req *spb.AdminRequest) (interface{}, error) {
+	reason := req.Reason
+	if reason == "" {
+		reason = "disconnected by an administrator"
+	}
+	return nil, s.DisconnectClient(req.ClientID, reason)
+}
+
+func (s *StanServer) adminRemoveClient(req *spb.AdminRequest) (interface{}, error) {
+	reason := req.Reason
+	if reason == "" {
+		reason = "removed by an administrator"
+	}
+	removed, err := s.RemoveClient(req.ClientID, reason)
+	if err != nil {
+		return nil, err
+	}
+	return &AdminRemovedClient{DurablesRemoved: removed}, nil
+}
+
+func (s *StanServer) adminRestoreDurable(req *spb.AdminRequest) (interface{}, error) {
+	return nil, s.RestoreDurable(req.ClientID, req.Channel, req.DurableName)
+}
+
+func (s *StanServer) adminSubscriptions(req *spb.AdminRequest) (interface{}, error) {
+	return s.SubscriptionsState(req.Channel, req.ClientID)
+}
+
+func (s *StanServer) adminSetMaxInflight(req *spb.AdminRequest) (interface{}, error) {
+	if req.AckInbox != "" {
+		return nil, s.SetMaxInFlight(req.Channel, req.AckInbox, req.MaxInFlight)
+	}
+	return nil, s.SetDurableMaxInFlight(req.Channel, req.ClientID, req.DurableName, req.MaxInFlight)
+}
+
+func (s *StanServer) adminSetAckWait(req *spb.AdminRequest) (interface{}, error) {
+	ackWait := time.Duration(req.AckWaitInSecs) * time.Second
+	if req.AckInbox != "" {
+		return nil, s.SetAckWait(req.Channel, req.AckInbox, ackWait)
+	}
+	return nil, s.SetDurableAckWait(req.Channel, req.ClientID, req.DurableName, ackWait)
+}
+
+func (s *StanServer) adminChannelLimits(req *spb.AdminRequest) (interface{}, error) {
+	if req.Channel == "" {
+		return nil, ErrInvalidAdminReq
+	}
+	return s.EffectiveLimits(req.Channel), nil
+}
+
+func (s *StanServer) adminFailoverDrill(req *spb.AdminRequest) (interface{}, error) {
+	return s.startFailoverDrill()
+}
+
+func (s *StanServer) adminFailoverReport(req *spb.AdminRequest) (interface{}, error) {
+	report := s.FailoverDrillReport()
+	if report == nil {
+		return nil, ErrNoFailoverDrillReport
+	}
+	return report, nil
+}
+
+func (s *StanServer) adminChannels(req *spb.AdminRequest) (interface{}, error) {
+	return s.ChannelsCatalog()
+}
+
+func (s *StanServer) adminGetMsg(req *spb.AdminRequest) (interface{}, error) {
+	if req.Channel == "" || req.Sequence == 0 {
+		return nil, ErrInvalidAdminReq
+	}
+	return s.GetMsg(req.Channel, req.Sequence)
+}
+
+func (s *StanServer) adminSeqToTime(req *spb.AdminRequest) (interface{}, error) {
+	if req.Channel == "" || req.Sequence == 0 {
+		return nil, ErrInvalidAdminReq
+	}
+	return s.SequenceTime(req.Channel, req.Sequence)
+}
+
+func (s *StanServer) adminTimeToSeq(req *spb.AdminRequest) (interface{}, error) {
+	if req.Channel == "" || req.Timestamp == 0 {
+		return nil, ErrInvalidAdminReq
+	}
+	return s.SequenceAtTime(req.Channel, req.Timestamp)
+}
+
+func (s *StanServer) adminClients(req *spb.AdminRequest) (interface{}, error) {
+	return s.ClientsState(), nil
+}
@@ -0,0 +1,218 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+const (
+	adminReadToken        = "read-token"
+	adminOperatorToken    = "operator-token"
+	adminDestructiveToken = "destructive-token"
+)
+
+// runServerWithAdminUsers starts a server with an admin user for each role.
+func runServerWithAdminUsers() *StanServer {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.AdminUsers = []*AdminUser{
+		{Name: "read", Token: util.NewSecret(adminReadToken), Role: RoleReadOnly},
+		{Name: "operator", Token: util.NewSecret(adminOperatorToken), Role: RoleOperator},
+		{Name: "destructive", Token: util.NewSecret(adminDestructiveToken), Role: RoleDestructive},
+	}
+	return runServerWithOpts(opts)
+}
+
+func sendAdminRequest(t *testing.T, nc *nats.Conn, req *spb.AdminRequest) *spb.AdminResponse {
+	b, _ := req.Marshal()
+	reply, err := nc.Request(fmt.Sprintf("%s.%s", DefaultAdminPrefix, clusterName), b, 2*time.Second)
+	if err != nil {
+		stackFatalf(t, "Error on admin request: %v", err)
+	}
+	resp := &spb.AdminResponse{}
+	if err := resp.Unmarshal(reply.Data); err != nil {
+		stackFatalf(t, "Error unmarshaling admin response: %v", err)
+	}
+	return resp
+}
+
+func TestAdminRequestsDisabledByDefault(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	b, _ := (&spb.AdminRequest{Operation: AdminOpServerInfo}).Marshal()
+	if _, err := nc.Request(fmt.Sprintf("%s.%s", DefaultAdminPrefix, clusterName), b, 250*time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Expected timeout, got %v", err)
+	}
+}
+
+func TestAdminRequestAuthorization(t *testing.T) {
+	s := runServerWithAdminUsers()
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	// Invalid request
+	reply, err := nc.Request(fmt.Sprintf("%s.%s", DefaultAdminPrefix, clusterName), []byte("junk"), 2*time.Second)
+	if err != nil {
+		t.Fatalf("Error on admin request: %v", err)
+	}
+	resp := &spb.AdminResponse{}
+	resp.Unmarshal(reply.Data)
+	if resp.Error != ErrInvalidAdminReq.Error() {
+		t.Fatalf("Expected error %q, got %q", ErrInvalidAdminReq, resp.Error)
+	}
+	// Unknown or no token
+	for _, token := range []string{"", "bad-token"} {
+		resp = sendAdminRequest(t, nc, &spb.AdminRequest{Token: token, Operation: AdminOpServerInfo})
+		if resp.Error != ErrAdminAuth.Error() || resp.Data != nil {
+			t.Fatalf("Expected error %q, got %q", ErrAdminAuth, resp.Error)
+		}
+	}
+	// Unknown operation
+	resp = sendAdminRequest(t, nc, &spb.AdminRequest{Token: adminDestructiveToken, Operation: "unknown"})
+	if resp.Error != ErrAdminUnknownOp.Error() {
+		t.Fatalf("Expected error %q, got %q", ErrAdminUnknownOp, resp.Error)
+	}
+	// All roles can get the server info
+	for _, token := range []string{adminReadToken, adminOperatorToken, adminDestructiveToken} {
+		resp = sendAdminRequest(t, nc, &spb.AdminRequest{Token: token, Operation: AdminOpServerInfo})
+		if resp.Error != "" {
+			t.Fatalf("Unexpected error: %v", resp.Error)
+		}
+		info := &AdminServerInfo{}
+		if err := json.Unmarshal(resp.Data, info); err != nil {
+			t.Fatalf("Error decoding server info: %v", err)
+		}
+		if info.ClusterID != clusterName {
+			t.Fatalf("Unexpected server info: %v", info)
+		}
+	}
+}
+
+func TestAdminRoles(t *testing.T) {
+	s := runServerWithAdminUsers()
+	defer s.Shutdown()
+
+	// Register temporary operations to check that roles are enforced.
+	noop := func(s *StanServer, req *spb.AdminRequest) (interface{}, error) { return nil, nil }
+	adminOps["test_operator"] = adminOp{RoleOperator, noop}
+	adminOps["test_destructive"] = adminOp{RoleDestructive, noop}
+	defer delete(adminOps, "test_operator")
+	defer delete(adminOps, "test_destructive")
+
+	checks := []struct {
+		token   string
+		op      string
+		allowed bool
+	}{
+		{adminReadToken, "test_operator", false},
+		{adminReadToken, "test_destructive", false},
+		{adminOperatorToken, "test_operator", true},
+		{adminOperatorToken, "test_destructive", false},
+		{adminDestructiveToken, "test_operator", true},
+		{adminDestructiveToken, "test_destructive", true},
+	}
+	for _, c := range checks {
+		_, err := s.authorizeAdmin(c.token, c.op)
+		if c.allowed && err != nil {
+			t.Fatalf("Token %q should be allowed to run %q, got %v", c.token, c.op, err)
+		} else if !c.allowed && err != ErrAdminForbidden {
+			t.Fatalf("Token %q should not be allowed to run %q, got %v", c.token, c.op, err)
+		}
+	}
+}
+
+func TestAdminSeqTime(t *testing.T) {
+	s := runServerWithAdminUsers()
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	for i := 0; i < 3; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	seqTime := func(req *spb.AdminRequest) *SeqTime {
+		req.Token = adminReadToken
+		req.Channel = "foo"
+		resp := sendAdminRequest(t, nc, req)
+		if resp.Error != "" {
+			stackFatalf(t, "Unexpected error: %v", resp.Error)
+		}
+		st := &SeqTime{}
+		if err := json.Unmarshal(resp.Data, st); err != nil {
+			stackFatalf(t, "Unexpected error: %v", err)
+		}
+		if st.Channel != "foo" || st.FirstSeq != 1 || st.LastSeq != 3 {
+			stackFatalf(t, "Unexpected result: %+v", st)
+		}
+		return st
+	}
+	st := seqTime(&spb.AdminRequest{Operation: AdminOpSeqToTime, Sequence: 2})
+	m, _ := s.GetMsg("foo", 2)
+	if st.Sequence != 2 || st.Timestamp != m.Timestamp {
+		t.Fatalf("Unexpected result: %+v", st)
+	}
+	for _, c := range []struct {
+		timestamp int64
+		seq       uint64
+	}{
+		{1, 1},
+		{m.Timestamp, 2},
+		{m.Timestamp + 1, 3},
+		{time.Now().Add(time.Hour).UnixNano(), 4},
+	} {
+		st := seqTime(&spb.AdminRequest{Operation: AdminOpTimeToSeq, Timestamp: c.timestamp})
+		if st.Sequence != c.seq {
+			t.Fatalf("Expected sequence %v for time %v, got %+v", c.seq, c.timestamp, st)
+		}
+		if m, _ := s.GetMsg("foo", c.seq); (m == nil && st.Timestamp != 0) || (m != nil && st.Timestamp != m.Timestamp) {
+			t.Fatalf("Unexpected timestamp for sequence %v: %+v", c.seq, st)
+		}
+	}
+
+	for _, req := range []*spb.AdminRequest{
+		{Operation: AdminOpSeqToTime, Channel: "foo"},
+		{Operation: AdminOpTimeToSeq, Channel: "foo"},
+	} {
+		req.Token = adminReadToken
+		if resp := sendAdminRequest(t, nc, req); resp.Error != ErrInvalidAdminReq.Error() {
+			t.Fatalf("Expected error %v, got %v", ErrInvalidAdminReq, resp.Error)
+		}
+	}
+	resp := sendAdminRequest(t, nc, &spb.AdminRequest{Token: adminReadToken, Operation: AdminOpSeqToTime, Channel: "foo", Sequence: 4})
+	if resp.Error != ErrMsgNotFound.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrMsgNotFound, resp.Error)
+	}
+	resp = sendAdminRequest(t, nc, &spb.AdminRequest{Token: adminReadToken, Operation: AdminOpTimeToSeq, Channel: "bar", Timestamp: 1})
+	if resp.Error != ErrUnknownChannel.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrUnknownChannel, resp.Error)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+// Errors returned to the clients of an archive reader
+var (
+	ErrArchiveReadOnly   = errors.New("stan: archive reader does not accept publishes")
+	ErrArchiveReplayOnly = errors.New("stan: archive reader only serves replay subscriptions")
+)
+
+// validateArchiveReader checks that the archive reader mode is used with a
+// store that can be archived.
+func validateArchiveReader(opts *Options) error {
+	if !opts.ArchiveReader {
+		return nil
+	}
+	if strings.EqualFold(opts.StoreType, stores.TypeMemory) {
+		return fmt.Errorf("archive reader requires a %v or %v store", stores.TypeFile, stores.TypeSQL)
+	}
+	if opts.FTGroupName != "" {
+		return fmt.Errorf("archive reader can't be part of a fault tolerance group")
+	}
+	return nil
+}
+
+// openArchive wraps the store so that the archive is never modified, and
+// checks that the recovered state is the one of an archive served under a
+// distinct cluster ID, so that the clients of the archived server never
+// reach the archive reader. The recovered clients and subscriptions are
+// dropped. Panics on error, as start does.
+func (s *StanServer) openArchive(limits *stores.ChannelLimits, state *stores.RecoveredState) {
+	if state == nil {
+		panic(fmt.Errorf("no archive to read from the %v store", s.store.Name()))
+	}
+	if state.Info.ClusterID == s.opts.ID {
+		panic(fmt.Errorf("archive reader cluster ID must differ from the archived one (%q)", s.opts.ID))
+	}
+	s.store = stores.NewReadOnlyStore(s.store, limits)
+	state.Clients = nil
+	for channel := range state.Subs {
+		state.Subs[channel] = nil
+	}
+	s.log.Noticef("STAN: Reading the archive of cluster %q", state.Info.ClusterID)
+}
+
+// isArchiveReplay returns true if the subscription request replays stored
+// messages, the only ones served by an archive reader. Durables are not
+// served since their state would not survive a restart.
+func isArchiveReplay(sr *spb.SubscriptionRequest) bool {
+	return sr.StartPosition != spb.StartPosition_NewOnly && sr.DurableName == ""
+}
+
+// sendArchiveReadOnlyErr rejects a publish received by an archive reader.
+func (s *StanServer) sendArchiveReadOnlyErr(m *nats.Msg) {
+	pm := &spb.PubMsg{}
+	pm.Unmarshal(m.Data)
+	s.sendPublishErr(m.Reply, pm.Guid, ErrArchiveReadOnly)
+}
@@ -0,0 +1,151 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+func TestArchiveReader(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.StoreType = stores.TypeFile
+	opts.FilestoreDir = defaultDataStore
+	opts.AdminUsers = []*AdminUser{{Name: "read", Token: util.NewSecret(adminReadToken), Role: RoleReadOnly}}
+	s := runServerWithOpts(opts)
+	defer shutdownRestartedServerOnTestExit(&s)
+
+	sc := NewDefaultConnection(t)
+	for _, data := range []string{"a", "b", "c"} {
+		if err := sc.Publish("foo", []byte(data)); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	// This durable is not recovered by the archive reader.
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}, stan.DurableName("dur")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+
+	// The production server serves the catalog too.
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	resp := sendAdminRequest(t, nc, &spb.AdminRequest{Token: adminReadToken, Operation: AdminOpChannels})
+	var catalog []*ChannelInfo
+	if err := json.Unmarshal(resp.Data, &catalog); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(catalog) != 1 || catalog[0].Name != "foo" || catalog[0].Msgs != 3 ||
+		catalog[0].FirstSeq != 1 || catalog[0].LastSeq != 3 || catalog[0].Subscriptions != 1 {
+		t.Fatalf("Unexpected catalog: %+v", catalog)
+	}
+	resp = sendAdminRequest(t, nc, &spb.AdminRequest{Token: adminReadToken, Operation: AdminOpGetMsg, Channel: "foo", Sequence: 2})
+	msg := &spb.MsgProto{}
+	if err := json.Unmarshal(resp.Data, msg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if msg.Sequence != 2 || string(msg.Data) != "b" {
+		t.Fatalf("Unexpected message: %v", msg)
+	}
+	resp = sendAdminRequest(t, nc, &spb.AdminRequest{Token: adminReadToken, Operation: AdminOpGetMsg, Channel: "foo", Sequence: 4})
+	if resp.Error != ErrMsgNotFound.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrMsgNotFound, resp.Error)
+	}
+	nc.Close()
+	sc.Close()
+	s.Shutdown()
+
+	// The archive must be served under another cluster ID.
+	opts.ArchiveReader = true
+	if _, err := validateStore(opts); err == nil {
+		t.Fatal("Expected error reading the archive under the same cluster ID")
+	}
+	opts.ID = "archive"
+	if _, err := validateStore(opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	s = runServerWithOpts(opts)
+
+	sc, err = stan.Connect("archive", clientName)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer sc.Close()
+	if err := sc.Publish("foo", []byte("d")); err == nil || err.Error() != ErrArchiveReadOnly.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrArchiveReadOnly, err)
+	}
+	// New only and durable subscriptions are rejected.
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}); err == nil || err.Error() != ErrArchiveReplayOnly.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrArchiveReplayOnly, err)
+	}
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}, stan.DurableName("dur"), stan.DeliverAllAvailable()); err == nil || err.Error() != ErrArchiveReplayOnly.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrArchiveReplayOnly, err)
+	}
+	if _, err := sc.Subscribe("bar", func(_ *stan.Msg) {}, stan.DeliverAllAvailable()); err == nil || err.Error() != ErrUnknownChannel.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrUnknownChannel, err)
+	}
+
+	// Stored messages are replayed.
+	ch := make(chan bool)
+	var received []string
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) {
+		received = append(received, string(m.Data))
+		if len(received) == 3 {
+			ch <- true
+		}
+	}, stan.DeliverAllAvailable()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := Wait(ch); err != nil {
+		t.Fatal("Did not get our messages")
+	}
+	if received[0] != "a" || received[2] != "c" {
+		t.Fatalf("Unexpected messages: %v", received)
+	}
+	if _, err := s.GetMsg("foo", 1); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if catalog, err := s.ChannelsCatalog(); err != nil || len(catalog) != 1 || catalog[0].Subscriptions != 1 {
+		t.Fatalf("Unexpected catalog: %+v, %v", catalog, err)
+	}
+
+	// The archive was not modified.
+	s.Shutdown()
+	opts.ID = clusterName
+	opts.ArchiveReader = false
+	s = runServerWithOpts(opts)
+	if catalog, err := s.ChannelsCatalog(); err != nil || len(catalog) != 1 || catalog[0].Msgs != 3 || catalog[0].Subscriptions != 0 {
+		t.Fatalf("Unexpected catalog: %+v, %v", catalog, err)
+	}
+	if _, err := s.SubscriptionsState("foo", ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestArchiveReaderRequiresStore(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ArchiveReader = true
+	if err := validateArchiveReader(opts); err == nil {
+		t.Fatal("Expected error with a memory store")
+	}
+	opts.StoreType = stores.TypeFile
+	opts.FTGroupName = "group"
+	if err := validateArchiveReader(opts); err == nil {
+		t.Fatal("Expected error in a fault tolerance group")
+	}
+	opts.FTGroupName = ""
+	if err := validateArchiveReader(opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"errors"
+)
+
+// ErrNotAuthorized is returned to clients whose request is rejected by the
+// Authorizer. The error returned by the Authorizer is only logged.
+var ErrNotAuthorized = errors.New("stan: not authorized")
+
+// Operations passed to the Authorizer.
+const (
+	OpConnect   = "connect"
+	OpPublish   = "publish"
+	OpSubscribe = "subscribe"
+)
+
+// Authorizer decides whether a client may perform an operation. It is called
+// from the NATS callbacks of the server, and must therefore be fast and safe
+// for concurrent use.
+type Authorizer interface {
+	// Authorize returns an error if the client is not allowed to perform the
+	// operation (OpConnect, OpPublish or OpSubscribe) on the channel. The
+	// channel is empty for OpConnect, and is the subject with wildcards of
+	// a wildcard subscription.
+	Authorize(clientID, channel, operation string) error
+}
+
+// AuthorizerFunc is a function used as an Authorizer.
+type AuthorizerFunc func(clientID, channel, operation string) error
+
+// Authorize calls f.
+func (f AuthorizerFunc) Authorize(clientID, channel, operation string) error {
+	return f(clientID, channel, operation)
+}
+
+// authorize returns ErrNotAuthorized if an Authorizer is set and rejects the
+// operation. The internal clients of the server, such as the canary, are
+// always allowed.
+func (s *StanServer) authorize(clientID, channel, operation string) error {
+	a := s.opts.Authorizer
+	if a == nil || s.isInternalClient(clientID, operation) {
+		return nil
+	}
+	if err := a.Authorize(clientID, channel, operation); err != nil {
+		s.log.Debugf("STAN: [Client:%s] Not authorized to %s on %q: %v", clientID, operation, channel, err)
+		return ErrNotAuthorized
+	}
+	return nil
+}
+
+// isInternalClient returns true if the client was created by the server.
+// Internal clients are flagged once registered, so they are looked up among
+// the pending internal connects for OpConnect.
+func (s *StanServer) isInternalClient(clientID, operation string) bool {
+	if operation == OpConnect {
+		s.RLock()
+		_, internal := s.internalConnects[clientID]
+		s.RUnlock()
+		return internal
+	}
+	c := s.clients.Lookup(clientID)
+	if c == nil {
+		return false
+	}
+	c.RLock()
+	defer c.RUnlock()
+	return c.internal
+}
@@ -0,0 +1,83 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+)
+
+func TestAuthorizer(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.CanaryInterval = time.Hour
+	opts.Authorizer = AuthorizerFunc(func(clientID, channel, operation string) error {
+		mu.Lock()
+		calls = append(calls, clientID+" "+operation+" "+channel)
+		mu.Unlock()
+		switch {
+		case clientID == "intruder":
+			return errors.New("unknown client")
+		case operation == OpPublish && channel == "secret":
+			return errors.New("read only channel")
+		case operation == OpSubscribe && channel == "private":
+			return errors.New("no access")
+		}
+		return nil
+	})
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	if sc, err := stan.Connect(clusterName, "intruder"); err == nil || err.Error() != ErrNotAuthorized.Error() {
+		if sc != nil {
+			sc.Close()
+		}
+		t.Fatalf("Expected error %v, got %v", ErrNotAuthorized, err)
+	}
+	if s.clients.Lookup("intruder") != nil {
+		t.Fatal("Rejected client should not be registered")
+	}
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	if err := sc.Publish("secret", []byte("hello")); err == nil || err.Error() != ErrNotAuthorized.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrNotAuthorized, err)
+	}
+	if _, err := sc.Subscribe("private", func(_ *stan.Msg) {}); err == nil || err.Error() != ErrNotAuthorized.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrNotAuthorized, err)
+	}
+	if _, err := sc.Subscribe("secret", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{
+		"intruder connect ",
+		clientName + " connect ",
+		clientName + " publish foo",
+		clientName + " publish secret",
+		clientName + " subscribe private",
+		clientName + " subscribe secret",
+	}
+	// The internal clients of the server, such as the canary, are not
+	// passed to the Authorizer.
+	if len(calls) != len(expected) {
+		t.Fatalf("Expected calls %q, got %q", expected, calls)
+	}
+	for i := range expected {
+		if calls[i] != expected[i] {
+			t.Fatalf("Expected calls %q, got %q", expected, calls)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// backlogHint returns the hint to append to the message sent to the
+// subscription, or nil if none should be appended. With
+// Options.BacklogHintInterval set, a hint is appended to every
+// BacklogHintInterval-th message sent to the subscription.
+//
+// The number of pending messages is derived from the channel's last
+// sequence and the subscription's position, and their size from the
+// average size of the messages stored in the channel, so that no per
+// subscription accounting is needed. The hints sent to durables recording
+// their ack latency also carry its median and 99th percentile.
+// Sub lock held on entry.
+func (s *StanServer) backlogHint(sub *subState, m *spb.MsgProto) *spb.BacklogHint {
+	interval := s.opts.BacklogHintInterval
+	if interval <= 0 {
+		return nil
+	}
+	sub.hintCount++
+	if sub.hintCount < interval {
+		return nil
+	}
+	sub.hintCount = 0
+	cs := s.store.LookupChannel(m.Subject)
+	if cs == nil {
+		return nil
+	}
+	sent := sub.LastSent
+	if m.Sequence > sent {
+		sent = m.Sequence
+	}
+	hint := &spb.BacklogHint{}
+	setAckLatencyHint(sub, hint)
+	if _, last := cs.Msgs.FirstAndLastSequence(); last > sent {
+		hint.PendingMsgs = last - sent
+	}
+	if hint.PendingMsgs == 0 {
+		return hint
+	}
+	if n, bytes, err := cs.Msgs.State(); err == nil && n > 0 {
+		hint.PendingBytes = uint64(float64(bytes) / float64(n) * float64(hint.PendingMsgs))
+	}
+	return hint
+}
+
+// appendBacklogHint appends the hint, if any, to the marshaled message.
+func appendBacklogHint(b []byte, hint *spb.BacklogHint) []byte {
+	if hint == nil {
+		return b
+	}
+	hb, err := hint.Marshal()
+	if err != nil {
+		return b
+	}
+	return append(b, hb...)
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestBacklogHints(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.BacklogHintInterval = 2
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	for i := 0; i < 5; i++ {
+		if err := sc.Publish("foo", make([]byte, 10)); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+
+	// Subscribe with the protocol to get the raw messages.
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+	raw := make(chan *nats.Msg, 10)
+	inbox := nats.NewInbox()
+	if _, err := nc.ChanSubscribe(inbox, raw); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	req := &spb.SubscriptionRequest{
+		ClientID:      clientName,
+		Subject:       "foo",
+		Inbox:         inbox,
+		MaxInFlight:   10,
+		AckWaitInSecs: 30,
+		StartPosition: spb.StartPosition_First,
+	}
+	b, _ := req.Marshal()
+	reply, err := nc.Request(s.info.Subscribe, b, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error on subscription request: %v", err)
+	}
+	resp := &spb.SubscriptionResponse{}
+	resp.Unmarshal(reply.Data)
+	if resp.Error != "" {
+		t.Fatalf("Unexpected error on subscription request: %v", resp.Error)
+	}
+
+	// Every other message has a hint, and clients not aware of it can
+	// still decode the message.
+	expected := map[uint64]spb.BacklogHint{
+		2: {PendingMsgs: 3, PendingBytes: 30},
+		4: {PendingMsgs: 1, PendingBytes: 10},
+	}
+	for i := uint64(1); i <= 5; i++ {
+		select {
+		case m := <-raw:
+			msg := &spb.MsgProto{}
+			if err := msg.Unmarshal(m.Data); err != nil {
+				t.Fatalf("Unexpected error on unmarshal: %v", err)
+			}
+			if msg.Sequence != i || len(msg.Data) != 10 {
+				t.Fatalf("Unexpected message: %v", msg)
+			}
+			hint := spb.BacklogHint{}
+			if err := hint.Unmarshal(m.Data); err != nil {
+				t.Fatalf("Unexpected error on unmarshal: %v", err)
+			}
+			if hint != expected[i] {
+				t.Fatalf("Unexpected hint for message %v: %v", i, hint)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Did not get our message")
+		}
+	}
+}
@@ -27,7 +27,7 @@ func benchRunServer(b *testing.B) *StanServer {
 	if storeType == stores.TypeFile {
 		opts.FilestoreDir = defaultDataStore
 	}
-	s := RunServerWithOpts(opts, nil)
+	s := runServerWithOpts(opts)
 	return s
 }
 
@@ -0,0 +1,198 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/nats-io/gnatsd/server"
+	"github.com/nats-io/nats"
+)
+
+const (
+	// DefaultInfoPrefix is the prefix of the subject on which the server
+	// answers requests for its bootstrap info. The cluster ID is appended
+	// to it.
+	DefaultInfoPrefix = "_STAN.info"
+
+	// InfoPath is the HTTP path of the bootstrap info, served on
+	// Options.InfoListen.
+	InfoPath = "/info"
+
+	// ServerInfoPath is the HTTP path of the server info, served on
+	// Options.InfoListen.
+	ServerInfoPath = "/serverz"
+)
+
+// Capabilities of the server, listed in BootstrapInfo.
+const (
+	CapSubClose       = "sub_close"
+	CapFlush          = "flush"
+	CapClaim          = "claim"
+	CapPause          = "pause"
+	CapSubBatch       = "sub_batch"
+	CapErrorCodes     = "error_codes"
+	CapAdmin          = "admin"
+	CapBacklogHints   = "backlog_hints"
+	CapDeadLetter     = "dead_letter"
+	CapRestoreDurable = "restore_durable"
+	CapOrderingGroups = "ordering_groups"
+	CapPing           = "ping"
+)
+
+// BootstrapInfo describes the cluster to clients, so that their
+// configuration can be bootstrapped from a single address. It is sent as
+// JSON to requests on the info subject, and over HTTP on Options.InfoListen.
+type BootstrapInfo struct {
+	ClusterID          string   `json:"cluster_id"`
+	Version            string   `json:"version"`
+	DiscoverSubject    string   `json:"discover_subject"`
+	ClientURL          string   `json:"client_url"`
+	MonitoringURL      string   `json:"monitoring_url,omitempty"`
+	Capabilities       []string `json:"capabilities"`
+	MaxPayload         int64    `json:"max_payload"`
+	MaxPubAcksInFlight int      `json:"max_pub_acks_inflight,omitempty"`
+	MaxChannels        int      `json:"max_channels"`
+	MaxMsgs            int      `json:"max_msgs"`
+	MaxBytes           uint64   `json:"max_bytes"`
+	MaxSubscriptions   int      `json:"max_subscriptions"`
+	MaxRedeliveries    int      `json:"max_redeliveries,omitempty"`
+	HBInterval         string   `json:"hb_interval"`
+	HBMaxInterval      string   `json:"hb_max_interval,omitempty"` // Longest interval clients can request, if allowed
+}
+
+// infoSubject returns the subject the server answers info requests on.
+func (s *StanServer) infoSubject() string {
+	return fmt.Sprintf("%s.%s", DefaultInfoPrefix, s.info.ClusterID)
+}
+
+// BootstrapInfo returns the description of the cluster sent to clients.
+func (s *StanServer) BootstrapInfo() *BootstrapInfo {
+	opts := s.opts
+	limits := getChannelLimits(opts)
+	info := &BootstrapInfo{
+		ClusterID:          s.info.ClusterID,
+		Version:            VERSION,
+		DiscoverSubject:    s.info.Discovery,
+		ClientURL:          s.ClientURL(),
+		MonitoringURL:      s.monitoringURL,
+		Capabilities:       s.capabilities(),
+		MaxPayload:         s.nc.MaxPayload(),
+		MaxPubAcksInFlight: opts.MaxPubAcksInFlight,
+		MaxChannels:        limits.MaxChannels,
+		MaxMsgs:            limits.MaxNumMsgs,
+		MaxBytes:           limits.MaxMsgBytes,
+		MaxSubscriptions:   limits.MaxSubs,
+		MaxRedeliveries:    opts.MaxRedeliveries,
+		HBInterval:         s.hbInterval.String(),
+	}
+	if opts.ClientHBMaxInterval > 0 {
+		info.HBMaxInterval = opts.ClientHBMaxInterval.String()
+	}
+	return info
+}
+
+// capabilities returns the capabilities of the server, some of them
+// depending on its options.
+func (s *StanServer) capabilities() []string {
+	opts := s.opts
+	caps := []string{CapSubClose, CapFlush, CapClaim, CapPause, CapSubBatch, CapErrorCodes, CapPing}
+	if len(opts.AdminUsers) > 0 {
+		caps = append(caps, CapAdmin)
+	}
+	if opts.BacklogHintInterval > 0 {
+		caps = append(caps, CapBacklogHints)
+	}
+	if opts.MaxRedeliveries > 0 {
+		caps = append(caps, CapDeadLetter)
+	}
+	if opts.DurableGracePeriod > 0 {
+		caps = append(caps, CapRestoreDurable)
+	}
+	if opts.MaxOrderingGroups > 0 {
+		caps = append(caps, CapOrderingGroups)
+	}
+	return caps
+}
+
+// processInfoRequest answers a request for the bootstrap info.
+func (s *StanServer) processInfoRequest(m *nats.Msg) {
+	if m.Reply == "" {
+		return
+	}
+	b, err := json.Marshal(s.BootstrapInfo())
+	if err != nil {
+		s.log.Errorf("STAN: Unable to marshal bootstrap info: %v", err)
+		return
+	}
+	s.nc.Publish(m.Reply, b)
+}
+
+// startInfoListener serves the bootstrap info over HTTP on
+// Options.InfoListen, if set.
+func (s *StanServer) startInfoListener() error {
+	if s.opts.InfoListen == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", s.opts.InfoListen)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(InfoPath, func(w http.ResponseWriter, r *http.Request) {
+		serveJSON(w, s.BootstrapInfo())
+	})
+	mux.HandleFunc(ServerInfoPath, func(w http.ResponseWriter, r *http.Request) {
+		serveJSON(w, s.Info())
+	})
+	mux.HandleFunc(TagUsagePath, func(w http.ResponseWriter, r *http.Request) {
+		serveJSON(w, s.TagUsage())
+	})
+	mux.HandleFunc(StoreCachePath, func(w http.ResponseWriter, r *http.Request) {
+		stats, ok := s.StoreCacheStats()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		serveJSON(w, stats)
+	})
+	s.infoListener = l
+	go http.Serve(l, mux)
+	s.log.Noticef("STAN: Serving bootstrap info on http://%s%s", l.Addr(), InfoPath)
+	return nil
+}
+
+// serveJSON writes v as indented JSON to w.
+func serveJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// getMonitoringURL returns the URL of the monitoring endpoints of the
+// embedded NATS Server, or an empty string if it is not embedded or does
+// not enable them.
+func getMonitoringURL(ns *server.Server, nOpts *server.Options) string {
+	if ns == nil || nOpts == nil {
+		return ""
+	}
+	scheme, port := "http", nOpts.HTTPPort
+	if port <= 0 {
+		scheme, port = "https", nOpts.HTTPSPort
+	}
+	if port <= 0 {
+		return ""
+	}
+	host := nOpts.HTTPHost
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host, _, _ = net.SplitHostPort(ns.GetListenEndpoint())
+	}
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, fmt.Sprintf("%d", port)))
+}
@@ -0,0 +1,98 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+)
+
+func checkCapabilities(t *testing.T, info *BootstrapInfo, expected ...string) {
+	if len(info.Capabilities) != len(expected) {
+		stackFatalf(t, "Expected capabilities %v, got %v", expected, info.Capabilities)
+	}
+	for i, c := range expected {
+		if info.Capabilities[i] != c {
+			stackFatalf(t, "Expected capabilities %v, got %v", expected, info.Capabilities)
+		}
+	}
+}
+
+func TestBootstrapInfoRequest(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.MaxMsgs = 100
+	opts.MaxOrderingGroups = 10
+	nOpts := DefaultNatsServerOptions
+	nOpts.HTTPPort = 8333
+	s := RunServerWithOpts(opts, &nOpts)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	reply, err := nc.Request(DefaultInfoPrefix+"."+clusterName, nil, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error on request: %v", err)
+	}
+	info := &BootstrapInfo{}
+	if err := json.Unmarshal(reply.Data, info); err != nil {
+		t.Fatalf("Unexpected error on unmarshal: %v", err)
+	}
+	if info.ClusterID != clusterName || info.Version != VERSION {
+		t.Fatalf("Unexpected cluster ID or version: %v %v", info.ClusterID, info.Version)
+	}
+	if info.DiscoverSubject != DefaultDiscoverPrefix+"."+clusterName || info.ClientURL != s.ClientURL() {
+		t.Fatalf("Unexpected discover subject or client URL: %v %v", info.DiscoverSubject, info.ClientURL)
+	}
+	if !strings.HasPrefix(info.MonitoringURL, "http://") || !strings.HasSuffix(info.MonitoringURL, ":8333") {
+		t.Fatalf("Unexpected monitoring URL: %v", info.MonitoringURL)
+	}
+	if info.MaxPayload != nc.MaxPayload() || info.MaxMsgs != 100 || info.MaxChannels != DefaultChannelLimit {
+		t.Fatalf("Unexpected limits: %+v", info)
+	}
+	checkCapabilities(t, info, CapSubClose, CapFlush, CapClaim, CapPause, CapSubBatch, CapErrorCodes, CapPing, CapOrderingGroups)
+}
+
+func TestBootstrapInfoHTTP(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.InfoListen = "127.0.0.1:0"
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	// Connections are not reused, so that the closed listener is noticed.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get(fmt.Sprintf("http://%s%s", s.infoListener.Addr(), InfoPath))
+	if err != nil {
+		t.Fatalf("Unexpected error on get: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Unexpected content type: %v", ct)
+	}
+	info := &BootstrapInfo{}
+	if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+		t.Fatalf("Unexpected error on decode: %v", err)
+	}
+	if info.ClusterID != clusterName || info.MonitoringURL != "" {
+		t.Fatalf("Unexpected info: %+v", info)
+	}
+	checkCapabilities(t, info, CapSubClose, CapFlush, CapClaim, CapPause, CapSubBatch, CapErrorCodes, CapPing)
+
+	// The listener is closed on shutdown.
+	addr := s.infoListener.Addr().String()
+	s.Shutdown()
+	if _, err := client.Get(fmt.Sprintf("http://%s%s", addr, InfoPath)); err == nil {
+		t.Fatal("Expected the listener to be closed")
+	}
+}
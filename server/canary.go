@@ -0,0 +1,219 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+const (
+	// DefaultCanaryChannel is the channel used by the canary.
+	DefaultCanaryChannel = "_STAN.canary"
+
+	// canaryClientID is the client ID used by the canary's connection.
+	canaryClientID = "_STAN-canary"
+
+	// canaryDurable is the name of the durable receiving the probes.
+	canaryDurable = "canary"
+
+	// A probe not received after this many intervals is considered lost.
+	canaryLossIntervals = 10
+
+	// Max in-flight and ack wait of the canary's subscription.
+	canaryMaxInflight = 1024
+	canaryAckWait     = 30 * time.Second
+)
+
+// CanaryStats are the counters of the canary.
+type CanaryStats struct {
+	Sent       uint64 // Probes published
+	Received   uint64 // Probes received
+	Lost       uint64 // Probes not received in time
+	Duplicated uint64 // Probes received more than once
+	Reordered  uint64 // Probes received after a probe published later
+	PubErrors  uint64 // Probes that could not be published
+}
+
+// canary periodically publishes sequenced probes to a reserved channel and
+// consumes them through a durable subscription, reporting probes that are
+// lost, duplicated or reordered. This checks end-to-end the whole store and
+// delivery pipeline.
+type canary struct {
+	sync.Mutex
+	s        *StanServer
+	interval time.Duration
+	runID    string
+	client   *internalClient
+	ackInbox string
+	next     uint64               // sequence of the next probe to publish
+	highest  uint64               // highest sequence received
+	pending  map[uint64]time.Time // probes published but not yet received
+	received map[uint64]struct{}  // probes received, until they can't be duplicated anymore
+	stats    CanaryStats
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+// startCanary connects the canary to this server and starts publishing
+// probes at the configured interval.
+func (s *StanServer) startCanary() error {
+	c := &canary{
+		s:        s,
+		interval: s.opts.CanaryInterval,
+		runID:    s.serverID,
+		next:     1,
+		pending:  make(map[uint64]time.Time),
+		received: make(map[uint64]struct{}),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := c.connect(); err != nil {
+		return fmt.Errorf("unable to start canary: %v", err)
+	}
+	s.Lock()
+	s.canary = c
+	s.Unlock()
+	go c.run()
+	return nil
+}
+
+// connect registers the canary as a client of this server and creates the
+// durable subscription receiving the probes. Probes from previous runs are
+// simply ignored.
+func (c *canary) connect() error {
+	client, err := c.s.newInternalClient(canaryClientID)
+	if err != nil {
+		return err
+	}
+	ackInbox, err := client.subscribe(DefaultCanaryChannel, canaryDurable, canaryMaxInflight, canaryAckWait, c.processMsg)
+	if err != nil {
+		client.close()
+		return err
+	}
+	c.client = client
+	c.ackInbox = ackInbox
+	return nil
+}
+
+// CanaryStats returns the canary counters, and false if the canary
+// is not running.
+func (s *StanServer) CanaryStats() (CanaryStats, bool) {
+	s.RLock()
+	c := s.canary
+	s.RUnlock()
+	if c == nil {
+		return CanaryStats{}, false
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.stats, true
+}
+
+// run publishes a probe and checks for lost probes at every interval,
+// until the canary is stopped.
+func (c *canary) run() {
+	defer close(c.done)
+	t := time.NewTicker(c.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.quit:
+			return
+		case <-t.C:
+			c.publishProbe()
+			c.checkLostProbes(time.Now())
+		}
+	}
+}
+
+// stop stops publishing probes and closes the canary's connection.
+func (c *canary) stop() {
+	close(c.quit)
+	<-c.done
+	c.client.close()
+}
+
+func (c *canary) publishProbe() {
+	c.Lock()
+	seq := c.next
+	c.next++
+	c.pending[seq] = time.Now()
+	c.Unlock()
+	if err := c.client.publish(DefaultCanaryChannel, []byte(fmt.Sprintf("%s.%d", c.runID, seq))); err != nil {
+		c.s.log.Errorf("STAN: Canary unable to publish probe %v: %v", seq, err)
+		c.Lock()
+		delete(c.pending, seq)
+		c.stats.PubErrors++
+		c.Unlock()
+		return
+	}
+	c.Lock()
+	c.stats.Sent++
+	c.Unlock()
+}
+
+// processMsg acks a message received on the canary's subscription and
+// checks the probe it contains.
+func (c *canary) processMsg(m *spb.MsgProto) {
+	c.client.ack(c.ackInbox, m)
+	c.processProbe(m.Data)
+}
+
+// processProbe checks a received probe against the ones published.
+func (c *canary) processProbe(data []byte) {
+	probe := string(data)
+	sep := strings.LastIndex(probe, ".")
+	if sep == -1 || probe[:sep] != c.runID {
+		// Probe from a previous run
+		return
+	}
+	seq, err := strconv.ParseUint(probe[sep+1:], 10, 64)
+	if err != nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.pending[seq]; ok {
+		delete(c.pending, seq)
+		c.received[seq] = struct{}{}
+		c.stats.Received++
+		if seq < c.highest {
+			c.stats.Reordered++
+			c.s.log.Errorf("STAN: Canary received probe %v after probe %v", seq, c.highest)
+		} else {
+			c.highest = seq
+		}
+	} else if _, ok := c.received[seq]; ok {
+		c.stats.Duplicated++
+		c.s.log.Errorf("STAN: Canary received probe %v more than once", seq)
+	}
+	// Otherwise, the probe was already reported as lost.
+}
+
+// checkLostProbes reports probes not received in time, and forgets about
+// old received probes.
+func (c *canary) checkLostProbes(now time.Time) {
+	timeout := time.Duration(canaryLossIntervals) * c.interval
+	c.Lock()
+	defer c.Unlock()
+	for seq, sent := range c.pending {
+		if now.Sub(sent) >= timeout {
+			delete(c.pending, seq)
+			c.stats.Lost++
+			c.s.log.Errorf("STAN: Canary did not receive probe %v within %v", seq, timeout)
+		}
+	}
+	// A duplicate can't be detected once the probe is forgotten, but
+	// probes can't be kept forever.
+	for seq := range c.received {
+		if c.next > seq+2*canaryLossIntervals {
+			delete(c.received, seq)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCanary(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.CanaryInterval = 20 * time.Millisecond
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	if s.store.LookupChannel(DefaultCanaryChannel) == nil {
+		t.Fatal("Canary channel should have been created")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats, ok := s.CanaryStats()
+		if !ok {
+			t.Fatal("Canary should be running")
+		}
+		if stats.Lost != 0 || stats.Duplicated != 0 || stats.Reordered != 0 || stats.PubErrors != 0 {
+			t.Fatalf("Unexpected canary stats: %+v", stats)
+		}
+		if stats.Received >= 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Canary did not receive probes: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The canary must not prevent the server from shutting down
+	s.Shutdown()
+}
+
+func TestCanaryDisabledByDefault(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	if _, ok := s.CanaryStats(); ok {
+		t.Fatal("Canary should not be running")
+	}
+}
+
+func TestCanaryDetection(t *testing.T) {
+	c := &canary{
+		s:        &StanServer{log: stanLog},
+		runID:    "run",
+		interval: time.Second,
+		next:     1,
+		pending:  make(map[uint64]time.Time),
+		received: make(map[uint64]struct{}),
+	}
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		c.pending[c.next] = now
+		c.next++
+	}
+	probe := func(runID string, seq uint64) {
+		c.processProbe([]byte(fmt.Sprintf("%s.%d", runID, seq)))
+	}
+	probe("run", 1)
+	probe("run", 3)
+	// Reordered
+	probe("run", 2)
+	// Duplicated
+	probe("run", 3)
+	// Ignored: other run and unknown probe
+	probe("otherrun", 4)
+	probe("run", 10)
+	// Probe 4 is lost
+	c.checkLostProbes(now.Add(canaryLossIntervals * c.interval))
+	// Once reported lost, receiving it is not counted
+	probe("run", 4)
+
+	expected := CanaryStats{Received: 3, Lost: 1, Duplicated: 1, Reordered: 1}
+	if c.stats != expected {
+		t.Fatalf("Expected stats %+v, got %+v", expected, c.stats)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// ErrMsgNotFound is returned when the requested message is not stored,
+// for instance because it has expired or was removed by limits.
+var ErrMsgNotFound = errors.New("stan: message not found")
+
+// ChannelInfo describes a channel of the catalog returned by
+// StanServer.ChannelsCatalog and the AdminOpChannels operation.
+type ChannelInfo struct {
+	Name          string `json:"name"`
+	Msgs          int    `json:"msgs"`
+	Bytes         uint64 `json:"bytes"`
+	FirstSeq      uint64 `json:"first_seq"`
+	LastSeq       uint64 `json:"last_seq"`
+	FirstTime     int64  `json:"first_time,omitempty"` // Timestamp of the first message, in nanoseconds
+	LastTime      int64  `json:"last_time,omitempty"`  // Timestamp of the last message, in nanoseconds
+	Subscriptions int    `json:"subscriptions"`        // Online subscriptions, queue members included
+}
+
+// ChannelsCatalog returns the channels of the server sorted by name.
+func (s *StanServer) ChannelsCatalog() ([]*ChannelInfo, error) {
+	channels := s.store.GetChannels()
+	catalog := make([]*ChannelInfo, 0, len(channels))
+	for name, cs := range channels {
+		msgs, bytes, err := cs.Msgs.State()
+		if err != nil {
+			return nil, err
+		}
+		info := &ChannelInfo{Name: name, Msgs: msgs, Bytes: bytes}
+		info.FirstSeq, info.LastSeq = cs.Msgs.FirstAndLastSequence()
+		if m := cs.Msgs.FirstMsg(); m != nil {
+			info.FirstTime = m.Timestamp
+		}
+		if m := cs.Msgs.LastMsg(); m != nil {
+			info.LastTime = m.Timestamp
+		}
+		if ss, ok := cs.UserData.(*subStore); ok {
+			info.Subscriptions = ss.onlineSubsCount()
+		}
+		catalog = append(catalog, info)
+	}
+	sort.Sort(channelsByName(catalog))
+	return catalog, nil
+}
+
+// onlineSubsCount returns the number of subscriptions of the channel,
+// queue members included, offline durables excluded.
+func (ss *subStore) onlineSubsCount() int {
+	ss.RLock()
+	defer ss.RUnlock()
+	n := 0
+	count := func(subs []*subState) {
+		for _, sub := range subs {
+			sub.RLock()
+			if sub.ClientID != "" {
+				n++
+			}
+			sub.RUnlock()
+		}
+	}
+	count(ss.psubs)
+	for _, qs := range ss.qsubs {
+		qs.RLock()
+		count(qs.subs)
+		qs.RUnlock()
+	}
+	return n
+}
+
+type channelsByName []*ChannelInfo
+
+func (c channelsByName) Len() int           { return len(c) }
+func (c channelsByName) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c channelsByName) Less(i, j int) bool { return c[i].Name < c[j].Name }
+
+// GetMsg returns the message stored in the channel with the given sequence.
+// ErrUnknownChannel is returned if the channel does not exist, and
+// ErrMsgNotFound if the message is not stored.
+func (s *StanServer) GetMsg(channel string, seq uint64) (*spb.MsgProto, error) {
+	cs := s.store.LookupChannel(channel)
+	if cs == nil {
+		return nil, ErrUnknownChannel
+	}
+	m := cs.Msgs.Lookup(seq)
+	if m == nil {
+		return nil, ErrMsgNotFound
+	}
+	return m, nil
+}
+
+// SeqTime maps a sequence of a channel to the timestamp of its message. It
+// is returned by StanServer.SequenceTime, StanServer.SequenceAtTime and the
+// AdminOpSeqToTime and AdminOpTimeToSeq operations.
+type SeqTime struct {
+	Channel   string `json:"channel"`
+	Sequence  uint64 `json:"sequence"`
+	Timestamp int64  `json:"timestamp,omitempty"` // Timestamp of the message, in nanoseconds, 0 if none
+	FirstSeq  uint64 `json:"first_seq"`
+	LastSeq   uint64 `json:"last_seq"`
+}
+
+// SequenceTime returns the timestamp of the message stored in the channel
+// with the given sequence.
+// ErrUnknownChannel is returned if the channel does not exist, and
+// ErrMsgNotFound if the message is not stored.
+func (s *StanServer) SequenceTime(channel string, seq uint64) (*SeqTime, error) {
+	cs := s.store.LookupChannel(channel)
+	if cs == nil {
+		return nil, ErrUnknownChannel
+	}
+	m := cs.Msgs.Lookup(seq)
+	if m == nil {
+		return nil, ErrMsgNotFound
+	}
+	st := &SeqTime{Channel: channel, Sequence: seq, Timestamp: m.Timestamp}
+	st.FirstSeq, st.LastSeq = cs.Msgs.FirstAndLastSequence()
+	return st, nil
+}
+
+// SequenceAtTime returns the sequence of the first message stored in the
+// channel at or after the given time, in nanoseconds, which is where a
+// subscription starting at that time begins. If all the messages are older,
+// the sequence is the one of the next message, and there is no timestamp.
+// ErrUnknownChannel is returned if the channel does not exist.
+func (s *StanServer) SequenceAtTime(channel string, timestamp int64) (*SeqTime, error) {
+	cs := s.store.LookupChannel(channel)
+	if cs == nil {
+		return nil, ErrUnknownChannel
+	}
+	st := &SeqTime{Channel: channel}
+	st.FirstSeq, st.LastSeq = cs.Msgs.FirstAndLastSequence()
+	if st.FirstSeq == 0 {
+		st.Sequence = st.LastSeq + 1
+		return st, nil
+	}
+	st.Sequence = cs.Msgs.GetSequenceFromTimestamp(timestamp)
+	if st.Sequence < st.FirstSeq {
+		st.Sequence = st.FirstSeq
+	}
+	// The message may have been removed by limits in the meantime.
+	if m := cs.Msgs.Lookup(st.Sequence); m != nil {
+		st.Timestamp = m.Timestamp
+	} else if st.Sequence <= st.LastSeq {
+		return nil, ErrMsgNotFound
+	}
+	return st, nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+// ChannelDefaults are the settings of the subscriptions on the matching
+// channels that don't set them in their request, and the redelivery policy
+// of these subscriptions.
+//
+// With a RedeliveryBackoff greater than 1, the AckWait of a subscription is
+// multiplied by RedeliveryBackoff after each redelivery, up to MaxAckWait,
+// so that consumers that keep failing are not flooded with redeliveries.
+// It goes back to its initial value when the subscription acks a message.
+type ChannelDefaults struct {
+	Channels          string        // Channels the defaults apply to (a subject, possibly with wildcards)
+	AckWait           time.Duration // AckWait of subscriptions not setting one, in whole seconds (0 to require it)
+	MaxInFlight       int           // MaxInFlight of subscriptions not setting one (0 to require it)
+	RedeliveryBackoff float64       // Factor applied to the AckWait after each redelivery (0 or 1 for none)
+	MaxAckWait        time.Duration // AckWait reached with the redelivery backoff
+}
+
+// channelDefaultsFor returns the first defaults matching the channel, or nil.
+func channelDefaultsFor(defaults []*ChannelDefaults, channel string) *ChannelDefaults {
+	for _, d := range defaults {
+		if util.SubjectMatches(d.Channels, channel) {
+			return d
+		}
+	}
+	return nil
+}
+
+// apply sets the fields of the subscription request that are not set.
+func (d *ChannelDefaults) apply(sr *spb.SubscriptionRequest) {
+	if sr.AckWaitInSecs == 0 && d.AckWait > 0 {
+		sr.AckWaitInSecs = int32(d.AckWait / time.Second)
+	}
+	if sr.MaxInFlight == 0 && d.MaxInFlight > 0 {
+		sr.MaxInFlight = int32(d.MaxInFlight)
+	}
+}
+
+// backoff increases the AckWait of the subscription after a redelivery.
+// Sub lock should be held before calling.
+func (d *ChannelDefaults) backoff(sub *subState) {
+	if d.RedeliveryBackoff <= 1 {
+		return
+	}
+	if sub.baseAckWait == 0 {
+		sub.baseAckWait = sub.ackWait
+	}
+	ackWait := time.Duration(float64(sub.ackWait) * d.RedeliveryBackoff)
+	if ackWait > d.MaxAckWait {
+		ackWait = d.MaxAckWait
+	}
+	if ackWait > sub.ackWait {
+		sub.ackWait = ackWait
+	}
+}
+
+// validateChannelDefaults checks the channel defaults for inconsistencies.
+func validateChannelDefaults(defaults []*ChannelDefaults) error {
+	for _, d := range defaults {
+		if !util.IsValidSubjectPattern(d.Channels) {
+			return fmt.Errorf("invalid channel defaults channels %q", d.Channels)
+		}
+		if d.AckWait != 0 && d.AckWait < time.Second {
+			return fmt.Errorf("ack wait of channel defaults %q must be at least 1s", d.Channels)
+		}
+		if d.MaxInFlight < 0 {
+			return fmt.Errorf("max inflight of channel defaults %q can't be negative", d.Channels)
+		}
+		if d.RedeliveryBackoff < 0 {
+			return fmt.Errorf("redelivery backoff of channel defaults %q can't be negative", d.Channels)
+		}
+		if d.RedeliveryBackoff > 1 && d.MaxAckWait <= 0 {
+			return fmt.Errorf("channel defaults %q with a redelivery backoff must have a positive max ack wait", d.Channels)
+		}
+		if d.MaxAckWait < 0 {
+			return fmt.Errorf("max ack wait of channel defaults %q can't be negative", d.Channels)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestValidateChannelDefaults(t *testing.T) {
+	if err := validateChannelDefaults(nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cases := []struct {
+		defaults ChannelDefaults
+		errTxt   string
+	}{
+		{ChannelDefaults{Channels: "foo.>.bar"}, "invalid channel defaults channels"},
+		{ChannelDefaults{Channels: "foo", AckWait: time.Millisecond}, "at least 1s"},
+		{ChannelDefaults{Channels: "foo", MaxInFlight: -1}, "max inflight"},
+		{ChannelDefaults{Channels: "foo", RedeliveryBackoff: -1}, "redelivery backoff"},
+		{ChannelDefaults{Channels: "foo", RedeliveryBackoff: 2}, "positive max ack wait"},
+		{ChannelDefaults{Channels: "foo", MaxAckWait: -time.Second}, "max ack wait"},
+	}
+	for _, c := range cases {
+		if err := validateChannelDefaults([]*ChannelDefaults{&c.defaults}); err == nil || !strings.Contains(err.Error(), c.errTxt) {
+			t.Fatalf("Expected error containing %q for %v, got %v", c.errTxt, c.defaults, err)
+		}
+	}
+}
+
+func TestChannelDefaultsFor(t *testing.T) {
+	orders := &ChannelDefaults{Channels: "orders.>", AckWait: time.Minute}
+	all := &ChannelDefaults{Channels: ">", AckWait: time.Second}
+	defaults := []*ChannelDefaults{orders, all}
+	if d := channelDefaultsFor(defaults, "orders.eu"); d != orders {
+		t.Fatalf("Expected orders defaults, got %v", d)
+	}
+	if d := channelDefaultsFor(defaults, "events"); d != all {
+		t.Fatalf("Expected catch-all defaults, got %v", d)
+	}
+	if d := channelDefaultsFor(defaults[:1], "events"); d != nil {
+		t.Fatalf("Expected no defaults, got %v", d)
+	}
+}
+
+func TestChannelDefaultsBackoff(t *testing.T) {
+	d := &ChannelDefaults{Channels: "foo", RedeliveryBackoff: 2, MaxAckWait: 5 * time.Second}
+	sub := &subState{ackWait: time.Second}
+	for _, expected := range []time.Duration{2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		d.backoff(sub)
+		if sub.ackWait != expected || sub.baseAckWait != time.Second {
+			t.Fatalf("Expected ackWait %v and base 1s, got %v and %v", expected, sub.ackWait, sub.baseAckWait)
+		}
+	}
+	// No backoff without a factor greater than 1.
+	d = &ChannelDefaults{Channels: "foo", RedeliveryBackoff: 1, MaxAckWait: 5 * time.Second}
+	sub = &subState{ackWait: time.Second}
+	d.backoff(sub)
+	if sub.ackWait != time.Second || sub.baseAckWait != 0 {
+		t.Fatalf("Unexpected backoff: %v and %v", sub.ackWait, sub.baseAckWait)
+	}
+}
+
+func TestChannelDefaults(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.ChannelDefaults = []*ChannelDefaults{
+		{Channels: "foo", AckWait: time.Second, MaxInFlight: 2, RedeliveryBackoff: 3, MaxAckWait: time.Minute},
+	}
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+	raw := make(chan *nats.Msg, 10)
+	inbox := nats.NewInbox()
+	if _, err := nc.ChanSubscribe(inbox, raw); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	subscribe := func(subject string) *spb.SubscriptionResponse {
+		req := &spb.SubscriptionRequest{
+			ClientID:      clientName,
+			Subject:       subject,
+			Inbox:         inbox,
+			StartPosition: spb.StartPosition_First,
+		}
+		b, _ := req.Marshal()
+		reply, err := nc.Request(s.info.Subscribe, b, 2*time.Second)
+		if err != nil {
+			stackFatalf(t, "Unexpected error on subscription request: %v", err)
+		}
+		resp := &spb.SubscriptionResponse{}
+		resp.Unmarshal(reply.Data)
+		return resp
+	}
+
+	// No defaults for this channel, the AckWait is required.
+	if resp := subscribe("bar"); resp.Error != ErrInvalidAckWait.Error() {
+		t.Fatalf("Expected error %v, got %q", ErrInvalidAckWait, resp.Error)
+	}
+
+	resp := subscribe("foo")
+	if resp.Error != "" {
+		t.Fatalf("Unexpected error on subscription request: %v", resp.Error)
+	}
+	subs := s.clients.GetSubs(clientName)
+	if len(subs) != 1 {
+		t.Fatalf("Expected 1 subscription, got %v", len(subs))
+	}
+	sub := subs[0]
+	sub.RLock()
+	ackWait, maxInFlight := sub.ackWait, sub.MaxInFlight
+	sub.RUnlock()
+	if ackWait != time.Second || maxInFlight != 2 {
+		t.Fatalf("Expected defaults to be applied, got ackWait=%v maxInFlight=%v", ackWait, maxInFlight)
+	}
+
+	// Get the message and its redelivery, which backs off.
+	var msg *spb.MsgProto
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-raw:
+			msg = &spb.MsgProto{}
+			if err := msg.Unmarshal(m.Data); err != nil {
+				t.Fatalf("Unexpected error on unmarshal: %v", err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("Did not get our message")
+		}
+	}
+	if !msg.Redelivered {
+		t.Fatal("Expected message to be redelivered")
+	}
+	waitFor := func(expected time.Duration) {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			sub.RLock()
+			ackWait := sub.ackWait
+			sub.RUnlock()
+			if ackWait == expected {
+				return
+			}
+			if time.Now().After(deadline) {
+				stackFatalf(t, "Expected ackWait %v, got %v", expected, ackWait)
+			}
+			time.Sleep(15 * time.Millisecond)
+		}
+	}
+	waitFor(3 * time.Second)
+
+	// The ack ends the backoff.
+	b, _ := (&pb.Ack{Subject: "foo", Sequence: msg.Sequence}).Marshal()
+	if err := nc.Publish(resp.AckInbox, b); err != nil {
+		t.Fatalf("Unexpected error on ack: %v", err)
+	}
+	waitFor(time.Second)
+}
@@ -4,6 +4,7 @@ package server
 
 import (
 	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
 	"sync"
 	"time"
 )
@@ -16,11 +17,19 @@ type clientStore struct {
 // client has information needed by the server. A client is also
 // stored in a stores.Client object (which contains ID and HbInbox).
 type client struct {
+	lastActivity int64 // time of the last connect, ping or heartbeat response of the client (updated atomically)
+	pubsInFlight int32 // messages published, not acknowledged yet (updated atomically)
 	sync.RWMutex
 	unregistered bool
-	hbt          *time.Timer
+	hbt          util.Timer
 	fhb          int
+	hbInterval   time.Duration // interval of the heartbeats, requested by the client (0 for the server's)
 	subs         []*subState
+	subRate      *tokenBucket // created on the first subscription request if limited
+	pubRate      *tokenBucket // created on the first publish if limited
+	pubBytesRate *tokenBucket // created on the first publish if limited
+	internal     bool         // client created by the server itself, not rate limited
+	connKey      string       // NATS connection (or user) of the client, if connection limits are enforced
 }
 
 // Register a client if new, otherwise returns the client already registered
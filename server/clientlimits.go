@@ -0,0 +1,50 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"errors"
+)
+
+// Errors returned when the server wide client limits are reached.
+var (
+	ErrTooManyClients    = errors.New("stan: too many clients")
+	ErrTooManyClientSubs = errors.New("stan: too many subscriptions for this client")
+)
+
+// checkMaxClients returns ErrTooManyClients if the server already has
+// Options.MaxClients clients registered. A client reconnecting with the ID
+// of a registered client replaces it, so it is not rejected. Internal
+// clients are counted, but not limited.
+func (s *StanServer) checkMaxClients(clientID string) error {
+	max := s.opts.MaxClients
+	if max <= 0 || s.isInternalClient(clientID, OpConnect) || s.clients.IsValid(clientID) {
+		return nil
+	}
+	if s.store.GetClientsCount() >= max {
+		return ErrTooManyClients
+	}
+	return nil
+}
+
+// checkMaxSubsPerClient returns ErrTooManyClientSubs if the client already
+// has Options.MaxSubsPerClient subscriptions. Internal clients are not
+// limited.
+func (s *StanServer) checkMaxSubsPerClient(clientID string) error {
+	max := s.opts.MaxSubsPerClient
+	if max <= 0 {
+		return nil
+	}
+	c := s.clients.Lookup(clientID)
+	if c == nil {
+		return nil
+	}
+	c.RLock()
+	count := len(c.subs)
+	internal := c.internal
+	c.RUnlock()
+	if !internal && count >= max {
+		return ErrTooManyClientSubs
+	}
+	return nil
+}
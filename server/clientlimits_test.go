@@ -0,0 +1,82 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats-streaming-server/errcode"
+)
+
+func TestMaxClients(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.MaxClients = 2
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc1 := NewDefaultConnection(t)
+	defer sc1.Close()
+	sc2, err := stan.Connect(clusterName, "me2")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	_, err = stan.Connect(clusterName, "me3")
+	checkConnLimitErr(t, err, ErrTooManyClients)
+	if code := errorCode(err); code != errcode.LimitExceeded {
+		t.Fatalf("Unexpected error code: %v", code)
+	}
+
+	// Closing a client frees its slot.
+	if err := sc2.Close(); err != nil {
+		t.Fatalf("Unexpected error on close: %v", err)
+	}
+	sc3, err := stan.Connect(clusterName, "me3")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	sc3.Close()
+	if info := s.Info(); info.Limits.MaxClients != 2 {
+		t.Fatalf("Unexpected limits: %+v", info.Limits)
+	}
+}
+
+func TestMaxSubsPerClient(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.MaxSubsPerClient = 2
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	sub, err := sc.Subscribe("bar", func(_ *stan.Msg) {}, stan.DurableName("dur"))
+	if err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	_, err = sc.QueueSubscribe("baz", "group", func(_ *stan.Msg) {})
+	checkConnLimitErr(t, err, ErrTooManyClientSubs)
+
+	// Other clients are not affected.
+	sc2, err := stan.Connect(clusterName, "me2")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer sc2.Close()
+	if _, err := sc2.Subscribe("foo", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+
+	// Removing a subscription frees its slot.
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatalf("Unexpected error on unsubscribe: %v", err)
+	}
+	if _, err := sc.QueueSubscribe("baz", "group", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+}
@@ -0,0 +1,794 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/nats-io/gnatsd/conf"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+// ProcessConfigFile parses the configuration file and returns the
+// streaming server options. The file uses the same format as the NATS
+// Server configuration file. Streaming options are read from a top level
+// `streaming` block, all other content is ignored, so that the same file
+// can be used to configure the embedded NATS Server:
+//
+//	streaming {
+//	  cluster_id: "my-cluster"
+//	  store: "file"
+//	  dir: "/data/stan"
+//	  max_channels: 100
+//	  hb_interval: "30s"
+//	}
+//
+// Options that are not present in the file have their default value.
+func ProcessConfigFile(configFile string) (*Options, error) {
+	opts := GetDefaultOptions()
+
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("error opening config file: %v", err)
+	}
+	m, err := conf.Parse(string(data))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range m {
+		if strings.ToLower(k) != "streaming" {
+			continue
+		}
+		sm, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected %q to be a map, got %T", k, v)
+		}
+		if err := parseStreamingOptions(sm, opts); err != nil {
+			return nil, err
+		}
+	}
+	return opts, nil
+}
+
+// parseStreamingOptions updates the options with the content of the
+// `streaming` block.
+func parseStreamingOptions(m map[string]interface{}, opts *Options) error {
+	var (
+		str string
+		err error
+	)
+	for k, v := range m {
+		switch strings.ToLower(k) {
+		case "id", "cid", "cluster_id":
+			opts.ID, err = confString(k, v)
+		case "discover_prefix":
+			opts.DiscoverPrefix, err = confString(k, v)
+		case "store", "store_type":
+			opts.StoreType, err = confString(k, v)
+			opts.StoreType = strings.ToUpper(opts.StoreType)
+		case "dir", "datastore":
+			opts.FilestoreDir, err = confString(k, v)
+		case "file_compression":
+			opts.FileStoreOpts.Compression, err = confString(k, v)
+			opts.FileStoreOpts.Compression = strings.ToLower(opts.FileStoreOpts.Compression)
+		case "file_flush_interval":
+			opts.FileStoreOpts.FlushInterval, err = confDuration(k, v)
+		case "file_flush_bytes":
+			opts.FileStoreOpts.FlushBytes, err = confInt(k, v)
+		case "file_ack_flush_interval":
+			opts.FileStoreOpts.AckFlushInterval, err = confDuration(k, v)
+		case "file_crc":
+			opts.FileStoreOpts.DoCRC, err = confBool(k, v)
+		case "file_truncate_bad_tail":
+			opts.FileStoreOpts.TruncateBadTail, err = confBool(k, v)
+		case "file_slice_max_msgs":
+			opts.FileStoreOpts.SliceMaxMsgs, err = confInt(k, v)
+		case "file_recover_channels":
+			opts.FileStoreOpts.RecoverChannels, err = confStringArray(k, v)
+		case "file_slice_max_bytes":
+			var size int
+			if size, err = confInt(k, v); err == nil {
+				opts.FileStoreOpts.SliceMaxBytes = int64(size)
+			}
+		case "encrypt":
+			opts.Encrypt, err = confBool(k, v)
+		case "encryption_key":
+			var key string
+			if key, err = confString(k, v); err == nil {
+				opts.EncryptionKey = util.NewSecret(key)
+			}
+		case "encryption_key_file":
+			var file string
+			if file, err = confString(k, v); err == nil {
+				opts.EncryptionKey, err = util.NewSecretFromFile(file)
+			}
+		case "sql_driver":
+			opts.SQLDriver, err = confString(k, v)
+		case "sql_source":
+			opts.SQLSource, err = confString(k, v)
+		case "hybrid_max_mem_bytes":
+			var n int
+			n, err = confInt(k, v)
+			opts.HybridMaxMemBytes = uint64(n)
+		case "store_params":
+			err = parseStoreParams(k, v, opts)
+		case "hybrid_cache_bytes":
+			var n int
+			n, err = confInt(k, v)
+			opts.HybridCacheBytes = uint64(n)
+		case "hybrid_read_ahead":
+			opts.HybridReadAhead, err = confInt(k, v)
+		case "memory_budget":
+			var n int
+			n, err = confInt(k, v)
+			opts.MemoryBudget = uint64(n)
+		case "memory_eviction":
+			opts.MemoryEviction, err = confString(k, v)
+		case "nats_server", "nats_server_url":
+			opts.NATSServerURL, err = confString(k, v)
+		case "nats_user":
+			opts.Username, err = confString(k, v)
+		case "nats_password", "nats_pass":
+			if str, err = confString(k, v); err == nil {
+				opts.Password = util.NewSecret(str)
+			}
+		case "nats_token":
+			if str, err = confString(k, v); err == nil {
+				opts.Token = util.NewSecret(str)
+			}
+		case "secure":
+			opts.Secure, err = confBool(k, v)
+		case "tls_client_cert":
+			opts.ClientCert, err = confString(k, v)
+		case "tls_client_key":
+			opts.ClientKey, err = confString(k, v)
+		case "tls_client_cacert":
+			opts.ClientCA, err = confString(k, v)
+		case "tls_server_cert":
+			opts.TLSServerCert, err = confString(k, v)
+		case "tls_server_key":
+			opts.TLSServerKey, err = confString(k, v)
+		case "max_channels":
+			opts.MaxChannels, err = confInt(k, v)
+		case "max_subs", "max_subscriptions":
+			opts.MaxSubscriptions, err = confInt(k, v)
+		case "max_inactivity":
+			opts.MaxInactivity, err = confDuration(k, v)
+		case "max_msgs":
+			opts.MaxMsgs, err = confInt(k, v)
+		case "max_bytes":
+			var n int
+			n, err = confInt(k, v)
+			opts.MaxBytes = uint64(n)
+		case "hb_interval":
+			opts.ClientHBInterval, err = confDuration(k, v)
+		case "hb_timeout":
+			opts.ClientHBTimeout, err = confDuration(k, v)
+		case "hb_fail_count":
+			opts.ClientHBFailCount, err = confInt(k, v)
+		case "hb_max_interval":
+			opts.ClientHBMaxInterval, err = confDuration(k, v)
+		case "canary_interval":
+			opts.CanaryInterval, err = confDuration(k, v)
+		case "delivery_workers":
+			opts.DeliveryWorkers, err = confInt(k, v)
+		case "delivery_watchdog":
+			opts.DeliveryWatchdog, err = confDuration(k, v)
+		case "watchdog_heal":
+			opts.WatchdogHeal, err = confBool(k, v)
+		case "clamp_start_position":
+			opts.ClampStartPosition, err = confBool(k, v)
+		case "slow_consumer_wait":
+			opts.SlowConsumerWait, err = confDuration(k, v)
+		case "slow_consumer_action":
+			opts.SlowConsumerAction, err = confString(k, v)
+		case "store_full_events":
+			opts.StoreFullEvents, err = confBool(k, v)
+		case "store_full_interval":
+			opts.StoreFullInterval, err = confDuration(k, v)
+		case "durable_grace_period":
+			opts.DurableGracePeriod, err = confDuration(k, v)
+		case "max_ordering_groups":
+			opts.MaxOrderingGroups, err = confInt(k, v)
+		case "info_listen":
+			opts.InfoListen, err = confString(k, v)
+		case "max_redeliveries":
+			opts.MaxRedeliveries, err = confInt(k, v)
+		case "dlq_prefix", "dead_letter_prefix":
+			opts.DeadLetterPrefix, err = confString(k, v)
+		case "ft_group":
+			opts.FTGroupName, err = confString(k, v)
+		case "ft_failover_window":
+			opts.FTFailoverWindow, err = confDuration(k, v)
+		case "archive_reader":
+			opts.ArchiveReader, err = confBool(k, v)
+		case "sub_rate":
+			opts.SubRate, err = confFloat(k, v)
+		case "sub_burst":
+			opts.SubBurst, err = confInt(k, v)
+		case "client_sub_rate":
+			opts.ClientSubRate, err = confFloat(k, v)
+		case "client_sub_burst":
+			opts.ClientSubBurst, err = confInt(k, v)
+		case "max_pub_acks_inflight":
+			opts.MaxPubAcksInFlight, err = confInt(k, v)
+		case "client_pub_rate":
+			opts.ClientPubRate, err = confFloat(k, v)
+		case "client_pub_burst":
+			opts.ClientPubBurst, err = confInt(k, v)
+		case "client_pub_bytes_rate":
+			opts.ClientPubBytesRate, err = confFloat(k, v)
+		case "client_pub_bytes_burst":
+			opts.ClientPubBytesBurst, err = confInt(k, v)
+		case "max_clients_per_conn":
+			opts.MaxClientsPerConn, err = confInt(k, v)
+		case "max_channels_per_conn":
+			opts.MaxChannelsPerConn, err = confInt(k, v)
+		case "max_clients":
+			opts.MaxClients, err = confInt(k, v)
+		case "max_subs_per_client":
+			opts.MaxSubsPerClient, err = confInt(k, v)
+		case "backlog_hint_interval":
+			opts.BacklogHintInterval, err = confInt(k, v)
+		case "drain_timeout":
+			opts.DrainTimeout, err = confDuration(k, v)
+		case "handoff":
+			opts.Handoff, err = confBool(k, v)
+		case "handoff_window":
+			opts.HandoffWindow, err = confDuration(k, v)
+		case "adaptive_max_inflight":
+			opts.AdaptiveMaxInFlight, err = confBool(k, v)
+		case "tags":
+			opts.Tags, err = confStringArray(k, v)
+		case "channel_placement":
+			err = parseChannelPlacement(k, v, opts)
+		case "record_pub_latency":
+			opts.RecordPubLatency, err = confBool(k, v)
+		case "record_ack_latency":
+			opts.RecordAckLatency, err = confBool(k, v)
+		case "client_events":
+			opts.ClientEvents, err = confBool(k, v)
+		case "slow_request_time":
+			opts.SlowRequestTime, err = confDuration(k, v)
+		case "slow_log_file":
+			opts.SlowLogFile, err = confString(k, v)
+		case "ack_timer_slack":
+			opts.AckTimerSlack, err = confDuration(k, v)
+		case "freeze_on_takeover":
+			opts.FreezeOnTakeover, err = confBool(k, v)
+		case "dedup_window":
+			opts.DedupWindow, err = confDuration(k, v)
+		case "max_inflight_per_sub":
+			opts.MaxInflightPerSub, err = confInt(k, v)
+		case "sniff_content_types":
+			opts.SniffContentTypes, err = confBool(k, v)
+		case "content_policies":
+			err = parseContentPolicies(k, v, opts)
+		case "exclusive_channels":
+			if opts.ExclusiveChannels, err = confStringArray(k, v); err == nil {
+				err = validateExclusiveChannels(opts.ExclusiveChannels)
+			}
+		case "queue_policy":
+			opts.QueuePolicy, err = confString(k, v)
+			opts.QueuePolicy = strings.ToLower(opts.QueuePolicy)
+		case "tenants":
+			err = parseTenants(k, v, opts)
+		case "channel_templates":
+			err = parseLimitsOverrides(k, v, &opts.ChannelTemplates)
+		case "channel_limits":
+			err = parseLimitsOverrides(k, v, &opts.PerChannelLimits)
+		case "sharding":
+			err = parseSharding(k, v, opts)
+		case "channel_defaults":
+			err = parseChannelDefaults(k, v, opts)
+		case "channel_delivery_workers":
+			err = parseChannelDeliveryWorkers(k, v, opts)
+		case "admin":
+			err = parseAdminOptions(k, v, opts)
+		case "webhooks":
+			err = parseWebhooks(k, v, opts)
+		case "shovels":
+			err = parseShovels(k, v, opts)
+		case "debug":
+			opts.Debug, err = confBool(k, v)
+		case "trace":
+			opts.Trace, err = confBool(k, v)
+		case "log_json":
+			opts.LogJSON, err = confBool(k, v)
+		default:
+			return fmt.Errorf("unknown streaming option %q", k)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseAdminOptions parses the `admin` block, which lists the users
+// allowed to send admin requests:
+//
+//	admin {
+//	  users: [
+//	    {user: "monitor", token: "s3cr3t", role: "read"}
+//	    {user: "ops", token_file: "/etc/stan/ops.token", role: "destructive"}
+//	  ]
+//	}
+func parseAdminOptions(name string, v interface{}, opts *Options) error {
+	am, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("expected %q to be a map, got %T", name, v)
+	}
+	for k, v := range am {
+		if strings.ToLower(k) != "users" {
+			return fmt.Errorf("unknown admin option %q", k)
+		}
+		list, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("expected %q to be an array, got %T", k, v)
+		}
+		for _, e := range list {
+			um, ok := e.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("expected admin user to be a map, got %T", e)
+			}
+			user, err := parseAdminUser(um)
+			if err != nil {
+				return err
+			}
+			opts.AdminUsers = append(opts.AdminUsers, user)
+		}
+	}
+	return nil
+}
+
+func parseAdminUser(m map[string]interface{}) (*AdminUser, error) {
+	var (
+		user = &AdminUser{}
+		str  string
+		err  error
+	)
+	for k, v := range m {
+		switch strings.ToLower(k) {
+		case "user", "name":
+			user.Name, err = confString(k, v)
+		case "token":
+			if str, err = confString(k, v); err == nil {
+				user.Token = util.NewSecret(str)
+			}
+		case "token_file":
+			if str, err = confString(k, v); err == nil {
+				user.Token, err = util.NewSecretFromFile(str)
+			}
+		case "role":
+			if str, err = confString(k, v); err == nil {
+				user.Role, err = ParseAdminRole(str)
+			}
+		default:
+			err = fmt.Errorf("unknown admin user option %q", k)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if user.Token == nil || !user.Token.IsSet() {
+		return nil, fmt.Errorf("admin user %q has no token", user.Name)
+	}
+	return user, nil
+}
+
+// parseWebhooks parses the `webhooks` array, whose elements are maps with
+// the name, channel, url, timeout and max_retries keys.
+func parseWebhooks(name string, v interface{}, opts *Options) error {
+	list, ok := v.([]interface{})
+	if !ok {
+		return fmt.Errorf("expected %q to be an array, got %T", name, v)
+	}
+	for _, e := range list {
+		wm, ok := e.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expected webhook to be a map, got %T", e)
+		}
+		hook := &Webhook{}
+		for k, v := range wm {
+			var err error
+			switch strings.ToLower(k) {
+			case "name":
+				hook.Name, err = confString(k, v)
+			case "channel":
+				hook.Channel, err = confString(k, v)
+			case "url":
+				hook.URL, err = confString(k, v)
+			case "timeout":
+				hook.Timeout, err = confDuration(k, v)
+			case "max_retries":
+				hook.MaxRetries, err = confInt(k, v)
+			default:
+				err = fmt.Errorf("unknown webhook option %q", k)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		opts.Webhooks = append(opts.Webhooks, hook)
+	}
+	return validateWebhooks(opts.Webhooks)
+}
+
+// parseShovels parses the `shovels` array, whose elements are maps with
+// the fields of a Shovel.
+func parseShovels(name string, v interface{}, opts *Options) error {
+	list, ok := v.([]interface{})
+	if !ok {
+		return fmt.Errorf("expected %q to be an array, got %T", name, v)
+	}
+	for _, e := range list {
+		sm, ok := e.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expected shovel to be a map, got %T", e)
+		}
+		sh := &Shovel{}
+		for k, v := range sm {
+			var err error
+			switch strings.ToLower(k) {
+			case "name":
+				sh.Name, err = confString(k, v)
+			case "direction":
+				sh.Direction, err = confString(k, v)
+			case "channel":
+				sh.Channel, err = confString(k, v)
+			case "url":
+				sh.URL, err = confString(k, v)
+			case "queue":
+				sh.Queue, err = confString(k, v)
+			case "max_retries":
+				sh.MaxRetries, err = confInt(k, v)
+			default:
+				err = fmt.Errorf("unknown shovel option %q", k)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		opts.Shovels = append(opts.Shovels, sh)
+	}
+	return validateShovels(opts.Shovels)
+}
+
+// parseStoreParams parses the `store_params` block, with the parameters of
+// a registered store type:
+//
+//	store_params {
+//	  bucket: "streaming"
+//	}
+func parseStoreParams(name string, v interface{}, opts *Options) error {
+	pm, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("expected %q to be a map, got %T", name, v)
+	}
+	opts.StoreParams = make(map[string]string, len(pm))
+	for k, pv := range pm {
+		value, err := confString(k, pv)
+		if err != nil {
+			return err
+		}
+		opts.StoreParams[k] = value
+	}
+	return nil
+}
+
+// parseChannelPlacement parses the `channel_placement` block, which maps
+// channel patterns to the tags a server must have to own those channels:
+//
+//	channel_placement {
+//	  "eu.>": ["eu"]
+//	}
+func parseChannelPlacement(name string, v interface{}, opts *Options) error {
+	pm, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("expected %q to be a map, got %T", name, v)
+	}
+	opts.ChannelPlacement = make(map[string][]string, len(pm))
+	for pattern, tags := range pm {
+		list, err := confStringArray(pattern, tags)
+		if err != nil {
+			return err
+		}
+		opts.ChannelPlacement[pattern] = list
+	}
+	return validatePlacement(opts.ChannelPlacement)
+}
+
+// parseSharding parses the `sharding` array, whose elements are maps with
+// the fields of a ShardingPolicy.
+func parseSharding(name string, v interface{}, opts *Options) error {
+	list, ok := v.([]interface{})
+	if !ok {
+		return fmt.Errorf("expected %q to be an array, got %T", name, v)
+	}
+	for _, e := range list {
+		pm, ok := e.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expected sharding policy to be a map, got %T", e)
+		}
+		p := &ShardingPolicy{}
+		for k, v := range pm {
+			var err error
+			switch strings.ToLower(k) {
+			case "channels":
+				p.Channels, err = confString(k, v)
+			case "period":
+				p.Period, err = confString(k, v)
+			default:
+				err = fmt.Errorf("unknown sharding option %q", k)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		opts.Sharding = append(opts.Sharding, p)
+	}
+	return nil
+}
+
+// parseChannelDeliveryWorkers parses the `channel_delivery_workers` array,
+// whose elements are maps with the fields of a ChannelWorkers.
+func parseChannelDeliveryWorkers(name string, v interface{}, opts *Options) error {
+	list, ok := v.([]interface{})
+	if !ok {
+		return fmt.Errorf("expected %q to be an array, got %T", name, v)
+	}
+	for _, e := range list {
+		wm, ok := e.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expected channel delivery workers to be a map, got %T", e)
+		}
+		cw := &ChannelWorkers{}
+		for k, v := range wm {
+			var err error
+			switch strings.ToLower(k) {
+			case "channels":
+				cw.Channels, err = confString(k, v)
+			case "workers":
+				cw.Workers, err = confInt(k, v)
+			default:
+				err = fmt.Errorf("unknown channel delivery workers option %q", k)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		opts.ChannelWorkers = append(opts.ChannelWorkers, cw)
+	}
+	return nil
+}
+
+// parseChannelDefaults parses the `channel_defaults` array, whose elements
+// are maps with the fields of a ChannelDefaults.
+func parseChannelDefaults(name string, v interface{}, opts *Options) error {
+	list, ok := v.([]interface{})
+	if !ok {
+		return fmt.Errorf("expected %q to be an array, got %T", name, v)
+	}
+	for _, e := range list {
+		dm, ok := e.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expected channel defaults to be a map, got %T", e)
+		}
+		d := &ChannelDefaults{}
+		for k, v := range dm {
+			var err error
+			switch strings.ToLower(k) {
+			case "channels":
+				d.Channels, err = confString(k, v)
+			case "ack_wait":
+				d.AckWait, err = confDuration(k, v)
+			case "max_inflight":
+				d.MaxInFlight, err = confInt(k, v)
+			case "redelivery_backoff":
+				d.RedeliveryBackoff, err = confFloat(k, v)
+			case "max_ack_wait":
+				d.MaxAckWait, err = confDuration(k, v)
+			default:
+				err = fmt.Errorf("unknown channel defaults option %q", k)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		opts.ChannelDefaults = append(opts.ChannelDefaults, d)
+	}
+	return validateChannelDefaults(opts.ChannelDefaults)
+}
+
+// parseContentPolicies parses the `content_policies` array, whose elements
+// are maps with the fields of a ContentPolicy.
+func parseContentPolicies(name string, v interface{}, opts *Options) error {
+	list, ok := v.([]interface{})
+	if !ok {
+		return fmt.Errorf("expected %q to be an array, got %T", name, v)
+	}
+	for _, e := range list {
+		pm, ok := e.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expected content policy to be a map, got %T", e)
+		}
+		p := &ContentPolicy{}
+		for k, v := range pm {
+			var err error
+			switch strings.ToLower(k) {
+			case "channels":
+				p.Channels, err = confString(k, v)
+			case "allowed":
+				p.Allowed, err = confStringArray(k, v)
+			default:
+				err = fmt.Errorf("unknown content policy option %q", k)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		opts.ContentPolicies = append(opts.ContentPolicies, p)
+	}
+	return validateContentPolicies(opts.ContentPolicies)
+}
+
+// parseTenants parses the `tenants` array, whose elements are maps with
+// the name of the tenant and the fields of a LimitsOverride:
+//
+//	tenants: [
+//	  {name: "acme", channels: "acme.>", max_msgs: 10000, max_inactivity: "24h"}
+//	]
+func parseTenants(name string, v interface{}, opts *Options) error {
+	list, ok := v.([]interface{})
+	if !ok {
+		return fmt.Errorf("expected %q to be an array, got %T", name, v)
+	}
+	for _, e := range list {
+		tm, ok := e.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expected tenant to be a map, got %T", e)
+		}
+		t := &Tenant{}
+		for k, v := range tm {
+			var err error
+			if strings.ToLower(k) == "name" {
+				t.Name, err = confString(k, v)
+			} else {
+				err = parseLimitsOverride(k, v, &t.LimitsOverride)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		opts.Tenants = append(opts.Tenants, t)
+	}
+	return nil
+}
+
+// parseLimitsOverrides parses the `channel_templates` and `channel_limits`
+// arrays, whose elements are maps with the fields of a LimitsOverride.
+func parseLimitsOverrides(name string, v interface{}, overrides *[]*LimitsOverride) error {
+	list, ok := v.([]interface{})
+	if !ok {
+		return fmt.Errorf("expected %q to be an array, got %T", name, v)
+	}
+	for _, e := range list {
+		om, ok := e.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expected limits to be a map, got %T", e)
+		}
+		o := &LimitsOverride{}
+		for k, v := range om {
+			if err := parseLimitsOverride(k, v, o); err != nil {
+				return err
+			}
+		}
+		*overrides = append(*overrides, o)
+	}
+	return nil
+}
+
+// parseLimitsOverride parses a field of a LimitsOverride.
+func parseLimitsOverride(k string, v interface{}, o *LimitsOverride) error {
+	var err error
+	switch strings.ToLower(k) {
+	case "channels", "channel":
+		o.Channels, err = confString(k, v)
+	case "max_msgs":
+		o.MaxMsgs, err = confInt(k, v)
+	case "max_bytes":
+		var n int
+		n, err = confInt(k, v)
+		o.MaxBytes = uint64(n)
+	case "max_subs", "max_subscriptions":
+		o.MaxSubscriptions, err = confInt(k, v)
+	case "max_inactivity":
+		o.MaxInactivity, err = confDuration(k, v)
+	default:
+		err = fmt.Errorf("unknown limits option %q", k)
+	}
+	return err
+}
+
+func confString(name string, v interface{}) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("expected %q to be a string, got %T", name, v)
+	}
+	return s, nil
+}
+
+// confStringArray accepts an array of strings or a single string.
+func confStringArray(name string, v interface{}) ([]string, error) {
+	switch a := v.(type) {
+	case string:
+		return []string{a}, nil
+	case []interface{}:
+		list := make([]string, 0, len(a))
+		for _, e := range a {
+			s, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected %q to contain strings, got %T", name, e)
+			}
+			list = append(list, s)
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("expected %q to be an array of strings, got %T", name, v)
+}
+
+func confBool(name string, v interface{}) (bool, error) {
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected %q to be a boolean, got %T", name, v)
+	}
+	return b, nil
+}
+
+func confInt(name string, v interface{}) (int, error) {
+	i, ok := v.(int64)
+	if !ok {
+		return 0, fmt.Errorf("expected %q to be an integer, got %T", name, v)
+	}
+	if i < 0 {
+		return 0, fmt.Errorf("%q can't be negative", name)
+	}
+	return int(i), nil
+}
+
+// confFloat accepts a floating point number or an integer.
+func confFloat(name string, v interface{}) (float64, error) {
+	var f float64
+	switch n := v.(type) {
+	case float64:
+		f = n
+	case int64:
+		f = float64(n)
+	default:
+		return 0, fmt.Errorf("expected %q to be a number, got %T", name, v)
+	}
+	if f < 0 {
+		return 0, fmt.Errorf("%q can't be negative", name)
+	}
+	return f, nil
+}
+
+// confDuration accepts either a duration string (such as "10s") or
+// an integer, which is then a number of seconds.
+func confDuration(name string, v interface{}) (time.Duration, error) {
+	switch d := v.(type) {
+	case string:
+		dur, err := time.ParseDuration(d)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration for %q: %v", name, err)
+		}
+		return dur, nil
+	case int64:
+		return time.Duration(d) * time.Second, nil
+	}
+	return 0, fmt.Errorf("expected %q to be a duration, got %T", name, v)
+}
@@ -0,0 +1,395 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+func createConfFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "stan_conf_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		os.Remove(f.Name())
+		t.Fatalf("Unable to write temp file: %v", err)
+	}
+	return f.Name()
+}
+
+func TestProcessConfigFile(t *testing.T) {
+	confFile := createConfFile(t, `
+		# NATS Server options are ignored
+		port: 4223
+
+		streaming {
+			cluster_id: "my-cluster"
+			store: "file"
+			dir: "/tmp/stan"
+			file_compression: "Snappy"
+			file_flush_interval: "100ms"
+			file_flush_bytes: 65536
+			file_ack_flush_interval: "200ms"
+			file_slice_max_msgs: 1000
+			file_slice_max_bytes: 1048576
+			file_crc: false
+			file_truncate_bad_tail: true
+			max_channels: 10
+			max_subs: 20
+			max_msgs: 30
+			max_bytes: 40
+			hb_interval: "5s"
+			hb_timeout: 2
+			hb_fail_count: 3
+			debug: true
+			log_json: true
+		}
+	`)
+	defer os.Remove(confFile)
+
+	opts, err := ProcessConfigFile(confFile)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.ID != "my-cluster" {
+		t.Fatalf("Unexpected cluster ID: %v", opts.ID)
+	}
+	if opts.StoreType != stores.TypeFile || opts.FilestoreDir != "/tmp/stan" || opts.FileStoreOpts.Compression != stores.CompressionSnappy {
+		t.Fatalf("Unexpected store options: %v - %v - %v", opts.StoreType, opts.FilestoreDir, opts.FileStoreOpts.Compression)
+	}
+	if opts.FileStoreOpts.FlushInterval != 100*time.Millisecond || opts.FileStoreOpts.FlushBytes != 65536 ||
+		opts.FileStoreOpts.AckFlushInterval != 200*time.Millisecond {
+		t.Fatalf("Unexpected flush options: %v - %v - %v", opts.FileStoreOpts.FlushInterval,
+			opts.FileStoreOpts.FlushBytes, opts.FileStoreOpts.AckFlushInterval)
+	}
+	if opts.FileStoreOpts.DoCRC || !opts.FileStoreOpts.TruncateBadTail {
+		t.Fatalf("Unexpected recovery options: %v - %v", opts.FileStoreOpts.DoCRC, opts.FileStoreOpts.TruncateBadTail)
+	}
+	if opts.FileStoreOpts.SliceMaxMsgs != 1000 || opts.FileStoreOpts.SliceMaxBytes != 1048576 {
+		t.Fatalf("Unexpected slice options: %v - %v", opts.FileStoreOpts.SliceMaxMsgs, opts.FileStoreOpts.SliceMaxBytes)
+	}
+	if opts.MaxChannels != 10 || opts.MaxSubscriptions != 20 || opts.MaxMsgs != 30 || opts.MaxBytes != 40 {
+		t.Fatalf("Unexpected limits: %v", opts)
+	}
+	if opts.ClientHBInterval != 5*time.Second || opts.ClientHBTimeout != 2*time.Second || opts.ClientHBFailCount != 3 {
+		t.Fatalf("Unexpected heartbeat options: %v", opts)
+	}
+	if !opts.Debug || opts.Trace || !opts.LogJSON {
+		t.Fatalf("Unexpected logging options: %v", opts)
+	}
+	// Options not in the file should have default values
+	if opts.DiscoverPrefix != DefaultDiscoverPrefix || opts.IOBatchSize != DefaultIOBatchSize {
+		t.Fatalf("Unexpected default options: %v", opts)
+	}
+}
+
+func TestProcessConfigFileErrors(t *testing.T) {
+	if _, err := ProcessConfigFile("does_not_exist.conf"); err == nil {
+		t.Fatal("Expected error for missing file")
+	}
+	confs := []struct {
+		content string
+		errTxt  string
+	}{
+		{"streaming: 1", "map"},
+		{"streaming { unknown: 1 }", "unknown"},
+		{"streaming { cluster_id: 1 }", "string"},
+		{"streaming { max_msgs: \"a\" }", "integer"},
+		{"streaming { max_msgs: -1 }", "negative"},
+		{"streaming { debug: 1 }", "boolean"},
+		{"streaming { hb_interval: \"abc\" }", "duration"},
+		{"streaming { admin: 1 }", "map"},
+		{"streaming { admin { unknown: 1 } }", "unknown"},
+		{"streaming { admin { users: 1 } }", "array"},
+		{"streaming { admin { users: [ {user: \"a\", role: \"read\"} ] } }", "token"},
+		{"streaming { admin { users: [ {user: \"a\", token: \"b\", role: \"root\"} ] } }", "role"},
+		{"streaming { admin { users: [ {user: \"a\", token_file: \"does_not_exist\"} ] } }", "does_not_exist"},
+		{"streaming { backlog_hint_interval: -1 }", "negative"},
+		{"streaming { channel_defaults: [ {channels: \"orders.>\", redelivery_backoff: 2} ] }", "max ack wait"},
+		{"streaming { client_sub_rate: -1 }", "negative"},
+		{"streaming { max_pub_acks_inflight: -1 }", "negative"},
+		{"streaming { tags: 1 }", "array"},
+		{"streaming { tags: [1] }", "string"},
+		{"streaming { channel_placement: 1 }", "map"},
+		{"streaming { channel_placement { \"foo..bar\": \"eu\" } }", "pattern"},
+		{"streaming { sharding: 1 }", "array"},
+		{"streaming { sharding: [1] }", "map"},
+		{"streaming { sharding: [{channels: \"foo\", unknown: 1}] }", "unknown"},
+		{"streaming { shovels: 1 }", "array"},
+		{"streaming { shovels: [{name: \"a\", direction: \"in\", channel: \"foo\", url: \"shoveltest://x\", queue: \"q\", bad: 1}] }", "unknown"},
+		{"streaming { shovels: [{name: \"a\", direction: \"in\", channel: \"foo\"}] }", "queue"},
+		{"streaming { webhooks: 1 }", "array"},
+		{"streaming { webhooks: [{name: \"a\", channel: \"foo\", url: \"http://localhost\", bad: 1}] }", "unknown"},
+		{"streaming { webhooks: [{name: \"a\", channel: \"foo\"}] }", "URL"},
+		{"streaming { channel_delivery_workers: 1 }", "array"},
+		{"streaming { channel_delivery_workers: [{channels: \"foo\", bad: 1}] }", "unknown"},
+	}
+	for _, c := range confs {
+		confFile := createConfFile(t, c.content)
+		_, err := ProcessConfigFile(confFile)
+		os.Remove(confFile)
+		if err == nil || !strings.Contains(err.Error(), c.errTxt) {
+			t.Fatalf("Expected error containing %q for %q, got %v", c.errTxt, c.content, err)
+		}
+	}
+}
+
+func TestClientHBOptions(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ClientHBInterval = 100 * time.Millisecond
+	opts.ClientHBTimeout = 10 * time.Millisecond
+	opts.ClientHBFailCount = 2
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	s.RLock()
+	defer s.RUnlock()
+	if s.hbInterval != opts.ClientHBInterval || s.hbTimeout != opts.ClientHBTimeout || s.maxFailedHB != opts.ClientHBFailCount {
+		t.Fatalf("Heartbeat options not applied: %v - %v - %v", s.hbInterval, s.hbTimeout, s.maxFailedHB)
+	}
+}
+
+func TestProcessConfigFileOptions(t *testing.T) {
+	tokenFile := createConfFile(t, "  file-token\n")
+	defer os.Remove(tokenFile)
+	fileToken, err := util.NewSecretFromFile(tokenFile)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		// Sets the options expected to differ from the defaults.
+		expected func(o *Options)
+	}{
+		{"nats connection", `
+			streaming {
+				secure: true
+				tls_client_cert: "client-cert.pem"
+				tls_client_key: "client-key.pem"
+				tls_client_cacert: "ca.pem"
+				tls_server_cert: "server-cert.pem"
+				tls_server_key: "server-key.pem"
+				nats_user: "ivan"
+				nats_password: "pwd"
+			}`, func(o *Options) {
+			o.Secure, o.ClientCert, o.ClientKey, o.ClientCA = true, "client-cert.pem", "client-key.pem", "ca.pem"
+			o.TLSServerCert, o.TLSServerKey = "server-cert.pem", "server-key.pem"
+			o.Username, o.Password = "ivan", util.NewSecret("pwd")
+		}},
+		{"hybrid store", `streaming { store: "hybrid", dir: "datastore", hybrid_cache_bytes: 1024, hybrid_read_ahead: 16 }`, func(o *Options) {
+			o.StoreType, o.FilestoreDir, o.HybridCacheBytes, o.HybridReadAhead = stores.TypeHybrid, "datastore", 1024, 16
+		}},
+		{"ack timer slack", `streaming { ack_timer_slack: "250ms" }`, func(o *Options) {
+			o.AckTimerSlack = 250 * time.Millisecond
+		}},
+		{"recover channels", `streaming { store: "file", dir: "datastore", file_recover_channels: ["orders.>", "payments"] }`, func(o *Options) {
+			o.StoreType, o.FilestoreDir = stores.TypeFile, "datastore"
+			o.FileStoreOpts.RecoverChannels = []string{"orders.>", "payments"}
+		}},
+		{"memory budget", `streaming { memory_budget: 1048576, memory_eviction: "lru" }`, func(o *Options) {
+			o.MemoryBudget, o.MemoryEviction = 1048576, stores.EvictLRU
+		}},
+		{"record ack latency", `streaming { record_ack_latency: true }`, func(o *Options) {
+			o.RecordAckLatency = true
+		}},
+		{"admin users", fmt.Sprintf(`
+			streaming {
+				admin {
+					users: [
+						{user: "monitor", token: "abc", role: "read"}
+						{user: "ops", token_file: "%s", role: "destructive"}
+					]
+				}
+			}`, tokenFile), func(o *Options) {
+			o.AdminUsers = []*AdminUser{
+				{Name: "monitor", Token: util.NewSecret("abc"), Role: RoleReadOnly},
+				{Name: "ops", Token: fileToken, Role: RoleDestructive},
+			}
+		}},
+		{"archive reader", `streaming { archive_reader: true }`, func(o *Options) {
+			o.ArchiveReader = true
+		}},
+		{"backlog hint", `streaming { backlog_hint_interval: 100 }`, func(o *Options) {
+			o.BacklogHintInterval = 100
+		}},
+		{"info listen", `streaming { info_listen: "localhost:8223" }`, func(o *Options) {
+			o.InfoListen = "localhost:8223"
+		}},
+		{"channel defaults", `
+			streaming {
+				channel_defaults: [
+					{channels: "orders.>", ack_wait: "2m", max_inflight: 64, redelivery_backoff: 1.5, max_ack_wait: "30m"}
+					{channels: ">", ack_wait: 30, max_inflight: 1024}
+				]
+			}`, func(o *Options) {
+			o.ChannelDefaults = []*ChannelDefaults{
+				{Channels: "orders.>", AckWait: 2 * time.Minute, MaxInFlight: 64, RedeliveryBackoff: 1.5, MaxAckWait: 30 * time.Minute},
+				{Channels: ">", AckWait: 30 * time.Second, MaxInFlight: 1024},
+			}
+		}},
+		{"connection limits", `streaming { max_clients_per_conn: 10, max_channels_per_conn: 100 }`, func(o *Options) {
+			o.MaxClientsPerConn, o.MaxChannelsPerConn = 10, 100
+		}},
+		{"content policies", `
+			streaming {
+				sniff_content_types: true
+				content_policies: [
+					{channels: "orders.>", allowed: ["json"]}
+					{channels: ">", allowed: ["protobuf", "empty"]}
+				]
+			}`, func(o *Options) {
+			o.SniffContentTypes = true
+			o.ContentPolicies = []*ContentPolicy{
+				{Channels: "orders.>", Allowed: []string{ContentJSON}},
+				{Channels: ">", Allowed: []string{ContentProtobuf, ContentEmpty}},
+			}
+		}},
+		{"dead letter", `streaming { max_redeliveries: 5, dlq_prefix: "dead" }`, func(o *Options) {
+			o.MaxRedeliveries, o.DeadLetterPrefix = 5, "dead"
+		}},
+		{"dedup window", `streaming { dedup_window: "2m" }`, func(o *Options) {
+			o.DedupWindow = 2 * time.Minute
+		}},
+		{"delivery workers", `streaming { delivery_workers: 8, channel_delivery_workers: [{channels: "foo.>", workers: 2}] }`, func(o *Options) {
+			o.DeliveryWorkers = 8
+			o.ChannelWorkers = []*ChannelWorkers{{Channels: "foo.>", Workers: 2}}
+		}},
+		{"drain timeout", `streaming { drain_timeout: "10s" }`, func(o *Options) {
+			o.DrainTimeout = 10 * time.Second
+		}},
+		{"encryption", `streaming { encrypt: true, encryption_key: "key" }`, func(o *Options) {
+			o.Encrypt, o.EncryptionKey = true, util.NewSecret("key")
+		}},
+		{"client events", `streaming { client_events: true }`, func(o *Options) {
+			o.ClientEvents = true
+		}},
+		{"fault tolerance", `streaming { ft_group: "ft", ft_failover_window: "2s" }`, func(o *Options) {
+			o.FTGroupName, o.FTFailoverWindow = "ft", 2*time.Second
+		}},
+		{"handoff", `streaming { handoff: true, handoff_window: "2s" }`, func(o *Options) {
+			o.Handoff, o.HandoffWindow = true, 2*time.Second
+		}},
+		{"heartbeat max interval", `streaming { hb_interval: "10s", hb_max_interval: "5m" }`, func(o *Options) {
+			o.ClientHBInterval, o.ClientHBMaxInterval = 10*time.Second, 5*time.Minute
+		}},
+		{"max inactivity", `streaming { max_inactivity: "24h" }`, func(o *Options) {
+			o.MaxInactivity = 24 * time.Hour
+		}},
+		{"channel limits", `
+			streaming {
+				tenants: [
+					{name: "acme", channels: "acme.>", max_msgs: 10, max_inactivity: "24h"}
+				]
+				channel_templates: [
+					{channels: "*.audit", max_subs: 5}
+				]
+				channel_limits: [
+					{channel: "acme.orders", max_bytes: 1024}
+				]
+			}`, func(o *Options) {
+			o.Tenants = []*Tenant{{Name: "acme", LimitsOverride: LimitsOverride{Channels: "acme.>", MaxMsgs: 10, MaxInactivity: 24 * time.Hour}}}
+			o.ChannelTemplates = []*LimitsOverride{{Channels: "*.audit", MaxSubscriptions: 5}}
+			o.PerChannelLimits = []*LimitsOverride{{Channels: "acme.orders", MaxBytes: 1024}}
+		}},
+		{"max inflight per sub", `streaming { max_inflight_per_sub: 100 }`, func(o *Options) {
+			o.MaxInflightPerSub = 100
+		}},
+		{"max ordering groups", `streaming { max_ordering_groups: 10 }`, func(o *Options) {
+			o.MaxOrderingGroups = 10
+		}},
+		{"channel placement", `
+			streaming {
+				tags: ["eu", "ssd"]
+				channel_placement {
+					"eu.>": ["eu"]
+					"fast.*": "ssd"
+				}
+			}`, func(o *Options) {
+			o.Tags = []string{"eu", "ssd"}
+			o.ChannelPlacement = map[string][]string{"eu.>": {"eu"}, "fast.*": {"ssd"}}
+		}},
+		{"record pub latency", `streaming { record_pub_latency: true }`, func(o *Options) {
+			o.RecordPubLatency = true
+		}},
+		{"queue policy", `streaming { queue_policy: "Round_Robin" }`, func(o *Options) {
+			o.QueuePolicy = QueuePolicyRoundRobin
+		}},
+		{"subscription rates", `streaming { sub_rate: 100, sub_burst: 200, client_sub_rate: 0.5, client_sub_burst: 5 }`, func(o *Options) {
+			o.SubRate, o.SubBurst, o.ClientSubRate, o.ClientSubBurst = 100, 200, 0.5, 5
+		}},
+		{"publish limits", `
+			streaming {
+				max_pub_acks_inflight: 1000
+				client_pub_rate: 500.5
+				client_pub_burst: 1000
+				client_pub_bytes_rate: 1048576
+				client_pub_bytes_burst: 2097152
+			}`, func(o *Options) {
+			o.MaxPubAcksInFlight, o.ClientPubRate, o.ClientPubBurst = 1000, 500.5, 1000
+			o.ClientPubBytesRate, o.ClientPubBytesBurst = 1048576, 2097152
+		}},
+		{"sharding", `streaming { sharding: [{channels: "events.>", period: "month"}] }`, func(o *Options) {
+			o.Sharding = []*ShardingPolicy{{Channels: "events.>", Period: ShardMonthly}}
+		}},
+		{"shovels", `
+			streaming {
+				shovels: [
+					{name: "orders", direction: "out", channel: "orders", url: "shoveltest://localhost", queue: "q", max_retries: 3}
+				]
+			}`, func(o *Options) {
+			o.Shovels = []*Shovel{{Name: "orders", Direction: ShovelOut, Channel: "orders", URL: "shoveltest://localhost", Queue: "q", MaxRetries: 3}}
+		}},
+		{"slow consumers", `streaming { slow_consumer_wait: "5s", slow_consumer_action: "close_sub" }`, func(o *Options) {
+			o.SlowConsumerWait, o.SlowConsumerAction = 5*time.Second, SlowConsumerCloseSub
+		}},
+		{"slow log", `streaming { slow_request_time: "100ms", slow_log_file: "/tmp/slow.log" }`, func(o *Options) {
+			o.SlowRequestTime, o.SlowLogFile = 100*time.Millisecond, "/tmp/slow.log"
+		}},
+		{"clamp start position", `streaming { clamp_start_position: true }`, func(o *Options) {
+			o.ClampStartPosition = true
+		}},
+		{"store full", `streaming { store_full_events: true, store_full_interval: "5s" }`, func(o *Options) {
+			o.StoreFullEvents, o.StoreFullInterval = true, 5*time.Second
+		}},
+		{"freeze on takeover", `streaming { freeze_on_takeover: true }`, func(o *Options) {
+			o.FreezeOnTakeover = true
+		}},
+		{"durable grace period", `streaming { durable_grace_period: "10m" }`, func(o *Options) {
+			o.DurableGracePeriod = 10 * time.Minute
+		}},
+		{"webhooks", `
+			streaming {
+				webhooks: [
+					{name: "orders", channel: "orders", url: "https://localhost/orders", timeout: "5s", max_retries: 3}
+				]
+			}`, func(o *Options) {
+			o.Webhooks = []*Webhook{{Name: "orders", Channel: "orders", URL: "https://localhost/orders", Timeout: 5 * time.Second, MaxRetries: 3}}
+		}},
+	}
+	for _, test := range tests {
+		confFile := createConfFile(t, test.content)
+		opts, err := ProcessConfigFile(confFile)
+		os.Remove(confFile)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		expected := GetDefaultOptions()
+		test.expected(expected)
+		if !reflect.DeepEqual(opts, expected) {
+			t.Fatalf("%s: expected options\n%+v\ngot\n%+v", test.name, expected, opts)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/nats-io/gnatsd/server"
+)
+
+// Errors returned when the limits of a NATS connection are reached.
+var (
+	ErrTooManyConnClients  = errors.New("stan: too many clients on this NATS connection")
+	ErrTooManyConnChannels = errors.New("stan: too many channels used by this NATS connection")
+)
+
+// connUsage is what the clients of a NATS connection (or user) use.
+type connUsage struct {
+	clients  int
+	channels map[string]struct{}
+}
+
+// connLimits enforces Options.MaxClientsPerConn and
+// Options.MaxChannelsPerConn. The limits apply to the clients of a same
+// NATS connection, identified by the connection that subscribed to their
+// heartbeat inbox, or to the clients of a same user if the connections
+// authenticated with one.
+type connLimits struct {
+	sync.Mutex
+	maxClients  int
+	maxChannels int
+	conns       map[string]*connUsage
+}
+
+func newConnLimits(maxClients, maxChannels int) *connLimits {
+	if maxClients <= 0 && maxChannels <= 0 {
+		return nil
+	}
+	return &connLimits{
+		maxClients:  maxClients,
+		maxChannels: maxChannels,
+		conns:       make(map[string]*connUsage),
+	}
+}
+
+// connKey returns the key of the NATS connection subscribed to the heartbeat
+// inbox of a connecting client. It is empty if limits are not enforced or
+// for internal clients.
+func (s *StanServer) connKey(clientID, hbInbox string) (string, error) {
+	if s.connLimits == nil || s.isInternalClient(clientID, OpConnect) {
+		return "", nil
+	}
+	// The client subscribes to its heartbeat inbox before sending the connect
+	// request, on the same connection, so the subscription is listed here.
+	connz, err := s.natsConnz()
+	if err != nil {
+		return "", err
+	}
+	for _, ci := range connz.Conns {
+		for _, subject := range ci.Subs {
+			if subject != hbInbox {
+				continue
+			}
+			if ci.AuthorizedUser != "" {
+				return "user:" + ci.AuthorizedUser, nil
+			}
+			return fmt.Sprintf("cid:%d", ci.Cid), nil
+		}
+	}
+	return "", ErrInvalidConnReq
+}
+
+// connzRecorder collects the response of the connz handler of the NATS
+// Server.
+type connzRecorder struct {
+	bytes.Buffer
+	header http.Header
+	code   int
+}
+
+func (r *connzRecorder) Header() http.Header  { return r.header }
+func (r *connzRecorder) WriteHeader(code int) { r.code = code }
+
+// natsConnz returns the client connections of the embedded NATS Server,
+// with their subscriptions and users. They are listed by the handler of the
+// monitoring endpoint, which is why the connection limits require it to be
+// enabled.
+func (s *StanServer) natsConnz() (*server.Connz, error) {
+	ns := s.natsServer
+	url := fmt.Sprintf("%s?subs=1&auth=1&limit=%d", server.ConnzPath, ns.NumClients()+1)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	w := &connzRecorder{header: make(http.Header), code: http.StatusOK}
+	ns.HandleConnz(w, req)
+	if w.code != http.StatusOK {
+		return nil, fmt.Errorf("unable to list the NATS connections: %s", w.String())
+	}
+	connz := &server.Connz{}
+	if err := json.Unmarshal(w.Bytes(), connz); err != nil {
+		return nil, err
+	}
+	return connz, nil
+}
+
+// validateConnLimits checks that the connection limits can be enforced with
+// these NATS Server options.
+func validateConnLimits(sOpts *Options, nOpts *server.Options) error {
+	if sOpts.MaxClientsPerConn <= 0 && sOpts.MaxChannelsPerConn <= 0 {
+		return nil
+	}
+	if sOpts.NATSServerURL == "" && nOpts.HTTPPort == 0 && nOpts.HTTPSPort == 0 {
+		return fmt.Errorf("connection limits require the monitoring port of the embedded NATS Server")
+	}
+	return nil
+}
+
+// checkConnect returns ErrTooManyConnClients if the connection already has
+// the maximum number of clients.
+func (cl *connLimits) checkConnect(key string) error {
+	if cl == nil || key == "" || cl.maxClients <= 0 {
+		return nil
+	}
+	cl.Lock()
+	defer cl.Unlock()
+	if u := cl.conns[key]; u != nil && u.clients >= cl.maxClients {
+		return ErrTooManyConnClients
+	}
+	return nil
+}
+
+// addClient counts a client registered from the connection.
+func (cl *connLimits) addClient(key string) {
+	if cl == nil || key == "" {
+		return
+	}
+	cl.Lock()
+	u := cl.conns[key]
+	if u == nil {
+		u = &connUsage{channels: make(map[string]struct{})}
+		cl.conns[key] = u
+	}
+	u.clients++
+	cl.Unlock()
+}
+
+// removeClient forgets a closed client, and what the connection used once
+// it has no client left.
+func (cl *connLimits) removeClient(key string) {
+	if cl == nil || key == "" {
+		return
+	}
+	cl.Lock()
+	if u := cl.conns[key]; u != nil {
+		u.clients--
+		if u.clients <= 0 {
+			delete(cl.conns, key)
+		}
+	}
+	cl.Unlock()
+}
+
+// useChannel records the use of the channel by a client of the connection,
+// and returns ErrTooManyConnChannels if it is a new channel for the
+// connection, which already used the maximum number of channels.
+func (cl *connLimits) useChannel(key, channel string) error {
+	if cl == nil || key == "" || cl.maxChannels <= 0 {
+		return nil
+	}
+	cl.Lock()
+	defer cl.Unlock()
+	u := cl.conns[key]
+	if u == nil {
+		return nil
+	}
+	if _, ok := u.channels[channel]; ok {
+		return nil
+	}
+	if len(u.channels) >= cl.maxChannels {
+		return ErrTooManyConnChannels
+	}
+	u.channels[channel] = struct{}{}
+	return nil
+}
+
+// checkChannelUse applies the channel limit of the client's connection.
+func (s *StanServer) checkChannelUse(clientID, channel string) error {
+	if s.connLimits == nil || s.connLimits.maxChannels <= 0 {
+		return nil
+	}
+	c := s.clients.Lookup(clientID)
+	if c == nil {
+		return nil
+	}
+	c.RLock()
+	key := c.connKey
+	c.RUnlock()
+	return s.connLimits.useChannel(key, channel)
+}
@@ -0,0 +1,139 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+
+	natsd "github.com/nats-io/gnatsd/server"
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats"
+)
+
+func checkConnLimitErr(t *testing.T, err, expected error) {
+	if err == nil || err.Error() != expected.Error() {
+		stackFatalf(t, "Expected error %v, got %v", expected, err)
+	}
+}
+
+// connLimitsNatsOpts returns the options of an embedded NATS Server with
+// the monitoring port the connection limits require.
+func connLimitsNatsOpts() *natsd.Options {
+	nOpts := DefaultNatsServerOptions
+	nOpts.HTTPPort = 8222
+	return &nOpts
+}
+
+func TestConnLimitsClients(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.MaxClientsPerConn = 2
+	s := RunServerWithOpts(opts, connLimitsNatsOpts())
+	defer s.Shutdown()
+
+	sc1, nc := createConnectionWithNatsOpts(t, "me1")
+	defer nc.Close()
+	defer sc1.Close()
+	sc2, err := stan.Connect(clusterName, "me2", stan.NatsConn(nc))
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	_, err = stan.Connect(clusterName, "me3", stan.NatsConn(nc))
+	checkConnLimitErr(t, err, ErrTooManyConnClients)
+
+	// Other connections are not affected.
+	sc3, nc2 := createConnectionWithNatsOpts(t, "me3")
+	defer nc2.Close()
+	defer sc3.Close()
+
+	// Closing a client frees its slot.
+	if err := sc2.Close(); err != nil {
+		t.Fatalf("Unexpected error on close: %v", err)
+	}
+	sc4, err := stan.Connect(clusterName, "me4", stan.NatsConn(nc))
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	sc4.Close()
+}
+
+func TestConnLimitsChannels(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.MaxChannelsPerConn = 2
+	s := RunServerWithOpts(opts, connLimitsNatsOpts())
+	defer s.Shutdown()
+
+	sc1, nc := createConnectionWithNatsOpts(t, "me1")
+	defer nc.Close()
+	defer sc1.Close()
+	sc2, err := stan.Connect(clusterName, "me2", stan.NatsConn(nc))
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer sc2.Close()
+
+	if err := sc1.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	if _, err := sc2.Subscribe("bar", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	// The channels are shared by the clients of the connection.
+	checkConnLimitErr(t, sc1.Publish("baz", []byte("hello")), ErrTooManyConnChannels)
+	_, err = sc2.Subscribe("baz", func(_ *stan.Msg) {})
+	checkConnLimitErr(t, err, ErrTooManyConnChannels)
+	if err := sc2.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	if _, err := sc1.Subscribe("bar", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+
+	// Other connections are not affected.
+	sc3, nc2 := createConnectionWithNatsOpts(t, "me3")
+	defer nc2.Close()
+	defer sc3.Close()
+	if err := sc3.Publish("baz", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+}
+
+func TestConnLimitsPerUser(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.MaxClientsPerConn = 1
+	nOpts := connLimitsNatsOpts()
+	nOpts.Username = "ivan"
+	nOpts.Password = "pwd"
+	s := RunServerWithOpts(opts, nOpts)
+	defer s.Shutdown()
+
+	sc, nc := createConnectionWithNatsOpts(t, "me1", nats.UserInfo("ivan", "pwd"))
+	defer nc.Close()
+	defer sc.Close()
+
+	// The limit applies to all the connections of the user.
+	nc2, err := nats.Connect(nats.DefaultURL, nats.UserInfo("ivan", "pwd"))
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc2.Close()
+	_, err = stan.Connect(clusterName, "me2", stan.NatsConn(nc2))
+	checkConnLimitErr(t, err, ErrTooManyConnClients)
+}
+
+func TestConnLimitsRequireMonitoring(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.MaxChannelsPerConn = 1
+	if err := validateConnLimits(opts, &DefaultNatsServerOptions); err == nil {
+		t.Fatal("Expected error without the monitoring port")
+	}
+	if err := validateConnLimits(opts, connLimitsNatsOpts()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	opts.MaxChannelsPerConn = 0
+	if err := validateConnLimits(opts, &DefaultNatsServerOptions); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
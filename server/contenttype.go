@@ -0,0 +1,247 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+// Content types detected in the payload of published messages.
+const (
+	ContentEmpty    = "empty"
+	ContentJSON     = "json"
+	ContentText     = "text"
+	ContentProtobuf = "protobuf"
+	ContentBinary   = "binary"
+)
+
+// ErrContentTypeNotAllowed is returned to a publisher whose message payload
+// does not have one of the content types allowed on the channel.
+var ErrContentTypeNotAllowed = errors.New("stan: content type not allowed on this channel")
+
+// ContentPolicy restricts the content types of the messages published on
+// the matching channels.
+type ContentPolicy struct {
+	Channels string   // Channels the policy applies to (a subject, possibly with wildcards)
+	Allowed  []string // Content types accepted on these channels
+}
+
+// ContentTypeCounts are the numbers of messages stored with each content
+// type, returned by StanServer.ContentTypeCounts.
+type ContentTypeCounts struct {
+	Empty    uint64
+	JSON     uint64
+	Text     uint64
+	Protobuf uint64
+	Binary   uint64
+}
+
+// add counts a message of the given content type.
+func (c *ContentTypeCounts) add(contentType string) {
+	switch contentType {
+	case ContentEmpty:
+		c.Empty++
+	case ContentJSON:
+		c.JSON++
+	case ContentText:
+		c.Text++
+	case ContentProtobuf:
+		c.Protobuf++
+	default:
+		c.Binary++
+	}
+}
+
+// contentTypes counts the content types of the messages stored on each
+// channel, when Options.SniffContentTypes is set.
+type contentTypes struct {
+	sync.Mutex
+	channels map[string]*ContentTypeCounts
+}
+
+func (ct *contentTypes) record(channel, contentType string) {
+	ct.Lock()
+	c := ct.channels[channel]
+	if c == nil {
+		c = &ContentTypeCounts{}
+		ct.channels[channel] = c
+	}
+	c.add(contentType)
+	ct.Unlock()
+}
+
+// remove forgets the counts of a deleted channel.
+func (ct *contentTypes) remove(channel string) {
+	ct.Lock()
+	delete(ct.channels, channel)
+	ct.Unlock()
+}
+
+// sniffContentType returns the content type of the payload. This is a
+// heuristic: JSON objects and arrays are recognized first, then UTF-8 text
+// without control characters other than white spaces, then payloads that
+// can be decoded as a sequence of protobuf fields. Anything else is binary.
+func sniffContentType(data []byte) string {
+	if len(data) == 0 {
+		return ContentEmpty
+	}
+	if isJSON(data) {
+		return ContentJSON
+	}
+	if isText(data) {
+		return ContentText
+	}
+	if isProtobuf(data) {
+		return ContentProtobuf
+	}
+	return ContentBinary
+}
+
+func isJSON(data []byte) bool {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return false
+	}
+	var v json.RawMessage
+	return json.Unmarshal(trimmed, &v) == nil
+}
+
+func isText(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, r := range string(data) {
+		if unicode.IsControl(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// isProtobuf returns true if the data is a sequence of well formed protobuf
+// fields, using the varint, 64-bit, length-delimited and 32-bit wire types.
+func isProtobuf(data []byte) bool {
+	for i := 0; i < len(data); {
+		key, n := readVarint(data[i:])
+		if n == 0 || key>>3 == 0 {
+			return false
+		}
+		i += n
+		switch key & 0x7 {
+		case 0:
+			if _, n = readVarint(data[i:]); n == 0 {
+				return false
+			}
+			i += n
+		case 1:
+			i += 8
+		case 2:
+			l, n := readVarint(data[i:])
+			if n == 0 || l > uint64(len(data)-i-n) {
+				return false
+			}
+			i += n + int(l)
+		case 5:
+			i += 4
+		default:
+			return false
+		}
+		if i > len(data) {
+			return false
+		}
+	}
+	return true
+}
+
+// readVarint decodes a varint, and returns 0 bytes read if it is malformed.
+func readVarint(data []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < len(data) && i < 10; i++ {
+		v |= uint64(data[i]&0x7F) << (7 * uint(i))
+		if data[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// contentPolicyFor returns the first policy matching the channel, or nil.
+func contentPolicyFor(policies []*ContentPolicy, channel string) *ContentPolicy {
+	for _, p := range policies {
+		if util.SubjectMatches(p.Channels, channel) {
+			return p
+		}
+	}
+	return nil
+}
+
+// allows returns true if the content type is allowed by the policy.
+func (p *ContentPolicy) allows(contentType string) bool {
+	for _, a := range p.Allowed {
+		if a == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// checkContentType returns the content type of the message if it has to be
+// counted, and an error if it is not allowed on the channel.
+func (s *StanServer) checkContentType(channel string, data []byte) (string, error) {
+	policy := contentPolicyFor(s.opts.ContentPolicies, channel)
+	if policy == nil && s.contentTypes == nil {
+		return "", nil
+	}
+	contentType := sniffContentType(data)
+	if policy != nil && !policy.allows(contentType) {
+		return "", ErrContentTypeNotAllowed
+	}
+	if s.contentTypes == nil {
+		return "", nil
+	}
+	return contentType, nil
+}
+
+// validateContentPolicies checks the content policies for inconsistencies.
+func validateContentPolicies(policies []*ContentPolicy) error {
+	for _, p := range policies {
+		if !util.IsValidSubjectPattern(p.Channels) {
+			return fmt.Errorf("invalid content policy channels %q", p.Channels)
+		}
+		if len(p.Allowed) == 0 {
+			return fmt.Errorf("content policy %q allows no content type", p.Channels)
+		}
+		for _, a := range p.Allowed {
+			switch a {
+			case ContentEmpty, ContentJSON, ContentText, ContentProtobuf, ContentBinary:
+			default:
+				return fmt.Errorf("unknown content type %q in content policy %q", a, p.Channels)
+			}
+		}
+	}
+	return nil
+}
+
+// ContentTypeCounts returns the numbers of messages stored on the channel
+// with each content type, and false if Options.SniffContentTypes is not set
+// or if no message has been stored on the channel.
+func (s *StanServer) ContentTypeCounts(channel string) (ContentTypeCounts, bool) {
+	if s.contentTypes == nil {
+		return ContentTypeCounts{}, false
+	}
+	s.contentTypes.Lock()
+	defer s.contentTypes.Unlock()
+	c := s.contentTypes.channels[channel]
+	if c == nil {
+		return ContentTypeCounts{}, false
+	}
+	return *c, true
+}
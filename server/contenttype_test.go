@@ -0,0 +1,70 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestSniffContentType(t *testing.T) {
+	msg := &spb.MsgProto{Sequence: 1, Subject: "foo", Data: []byte{0, 1, 2}, Timestamp: 1234}
+	pbData, _ := msg.Marshal()
+	checks := []struct {
+		data        []byte
+		contentType string
+	}{
+		{nil, ContentEmpty},
+		{[]byte(`{"a": 1}`), ContentJSON},
+		{[]byte(" [1, 2]\n"), ContentJSON},
+		{[]byte(`{"a": `), ContentText},
+		{[]byte("hello world\n"), ContentText},
+		{[]byte("42"), ContentText},
+		{pbData, ContentProtobuf},
+		{[]byte{0xff, 0xfe, 0x00, 0x01}, ContentBinary},
+	}
+	for _, c := range checks {
+		if ct := sniffContentType(c.data); ct != c.contentType {
+			t.Fatalf("Expected %q to be %v, got %v", c.data, c.contentType, ct)
+		}
+	}
+}
+
+func TestContentTypes(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.SniffContentTypes = true
+	opts.ContentPolicies = []*ContentPolicy{{Channels: "orders.>", Allowed: []string{ContentJSON}}}
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	if _, ok := s.ContentTypeCounts("foo"); ok {
+		t.Fatal("Expected no counts before any message")
+	}
+	for _, data := range []string{`{"a": 1}`, "hello", "world", ""} {
+		if err := sc.Publish("foo", []byte(data)); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	if err := sc.Publish("orders.new", []byte(`{"id": 1}`)); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	if err := sc.Publish("orders.new", []byte("id=1")); err == nil || err.Error() != ErrContentTypeNotAllowed.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrContentTypeNotAllowed, err)
+	}
+
+	if counts, ok := s.ContentTypeCounts("foo"); !ok || counts != (ContentTypeCounts{JSON: 1, Text: 2, Empty: 1}) {
+		t.Fatalf("Unexpected counts: %+v", counts)
+	}
+	// The rejected message is not counted.
+	if counts, ok := s.ContentTypeCounts("orders.new"); !ok || counts != (ContentTypeCounts{JSON: 1}) {
+		t.Fatalf("Unexpected counts: %+v", counts)
+	}
+	if cs := s.store.LookupChannel("orders.new"); cs.Msgs.LastSequence() != 1 {
+		t.Fatalf("Expected 1 message stored, got %v", cs.Msgs.LastSequence())
+	}
+}
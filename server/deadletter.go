@@ -0,0 +1,117 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// Redeliveries of a message are counted per subscription, or per queue group
+// since a message can be redelivered to any member of the group. Counts are
+// not persisted.
+
+// maxRedeliveries returns the redeliveries of a message after which it is
+// moved to the dead-letter channel: the limit requested by the subscription,
+// if any, the server's otherwise. Zero means no limit.
+func (s *StanServer) maxRedeliveries(sub *subState) int {
+	sub.RLock()
+	max := int(sub.MaxRedeliveries)
+	sub.RUnlock()
+	switch {
+	case max == 0:
+		return s.opts.MaxRedeliveries
+	case max < 0:
+		return 0
+	}
+	return max
+}
+
+// redeliveries returns the number of times the message was redelivered to
+// the subscription, or to its queue group.
+func redeliveries(sub *subState, qs *queueState, seq uint64) int {
+	if qs != nil {
+		qs.RLock()
+		defer qs.RUnlock()
+		return qs.rdlvs[seq]
+	}
+	sub.RLock()
+	defer sub.RUnlock()
+	return sub.rdlvs[seq]
+}
+
+// incRedeliveries increments the number of redeliveries of the message.
+func incRedeliveries(sub *subState, qs *queueState, seq uint64) {
+	if qs != nil {
+		qs.Lock()
+		if qs.rdlvs == nil {
+			qs.rdlvs = make(map[uint64]int)
+		}
+		qs.rdlvs[seq]++
+		qs.Unlock()
+		return
+	}
+	sub.Lock()
+	if sub.rdlvs == nil {
+		sub.rdlvs = make(map[uint64]int)
+	}
+	sub.rdlvs[seq]++
+	sub.Unlock()
+}
+
+// clearRedeliveries forgets the redeliveries of an acknowledged message.
+func clearRedeliveries(sub *subState, seq uint64) {
+	sub.Lock()
+	delete(sub.rdlvs, seq)
+	qs := sub.qstate
+	sub.Unlock()
+	if qs != nil {
+		qs.Lock()
+		delete(qs.rdlvs, seq)
+		qs.Unlock()
+	}
+}
+
+// deadLetterChannel returns the name of the dead-letter channel for the
+// given channel.
+func (s *StanServer) deadLetterChannel(channel string) string {
+	prefix := s.opts.DeadLetterPrefix
+	if prefix == "" {
+		prefix = DefaultDLQPrefix
+	}
+	return fmt.Sprintf("%s.%s", prefix, channel)
+}
+
+// deadLetter stores the message in the dead-letter channel, delivers it to
+// the subscribers of that channel, then acks it on behalf of the subscriber.
+// Returns false if the message could not be moved, in which case it keeps
+// being redelivered. The reason is logged.
+func (s *StanServer) deadLetter(sub *subState, m *spb.MsgProto, reason string) bool {
+	cs := s.store.LookupChannel(m.Subject)
+	if cs == nil {
+		return false
+	}
+	dlq := s.deadLetterChannel(m.Subject)
+	dcs, err := s.lookupOrCreateChannel(dlq)
+	if err == nil {
+		_, err = dcs.Msgs.StoreMsg(&spb.MsgProto{Reply: m.Reply, Data: m.Data, Headers: m.Headers})
+	}
+	if err == nil {
+		err = dcs.Msgs.Flush()
+	}
+	if err != nil {
+		s.log.Errorf("STAN: [Client:%s] Unable to move message %s:%v to dead-letter channel %s: %v",
+			sub.ClientID, m.Subject, m.Sequence, dlq, err)
+		return false
+	}
+	s.log.Noticef("STAN: [Client:%s] Message %s:%v %s, moved to %s",
+		sub.ClientID, m.Subject, m.Sequence, reason, dlq)
+	s.processMsg(dcs, 0)
+	if err := dcs.Subs.Flush(); err != nil {
+		s.log.Errorf("STAN: Unable to flush sub store of %s: %v", dlq, err)
+	}
+	s.processAck(cs, sub, m.Sequence)
+	clearRedeliveries(sub, m.Sequence)
+	return true
+}
@@ -0,0 +1,210 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func runServerWithMaxRedeliveries(max int) *StanServer {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.MaxRedeliveries = max
+	return runServerWithOpts(opts)
+}
+
+// setTestAckWait sets an AckWait shorter than what the client library allows.
+func setTestAckWait(subs []*subState, ackWait time.Duration) {
+	for _, sub := range subs {
+		sub.Lock()
+		sub.ackWait = ackWait
+		sub.Unlock()
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	s := runServerWithMaxRedeliveries(2)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	dlq := make(chan *stan.Msg, 10)
+	if _, err := sc.Subscribe(DefaultDLQPrefix+".foo", func(m *stan.Msg) {
+		dlq <- m
+	}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	deliveries := int32(0)
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {
+		atomic.AddInt32(&deliveries, 1)
+	}, stan.SetManualAckMode(), stan.AckWait(time.Second)); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	subs := s.clients.GetSubs(clientName)
+	setTestAckWait(subs, 100*time.Millisecond)
+
+	if err := sc.Publish("foo", []byte("poison")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	select {
+	case m := <-dlq:
+		if string(m.Data) != "poison" {
+			t.Fatalf("Unexpected message in dead-letter channel: %q", m.Data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Message should have been moved to the dead-letter channel")
+	}
+	// Wait a bit to make sure there is no more redelivery.
+	time.Sleep(300 * time.Millisecond)
+	if n := atomic.LoadInt32(&deliveries); n != 3 {
+		t.Fatalf("Expected 1 delivery and 2 redeliveries, got %v deliveries", n)
+	}
+	for _, sub := range subs {
+		sub.RLock()
+		pending, rdlvs := len(sub.acksPending), len(sub.rdlvs)
+		sub.RUnlock()
+		if pending != 0 || rdlvs != 0 {
+			t.Fatalf("Expected no pending message and no redelivery count, got %v and %v", pending, rdlvs)
+		}
+	}
+}
+
+func TestDeadLetterSubscriptionMaxRedeliveries(t *testing.T) {
+	s := runServerWithMaxRedeliveries(5)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	dlq := make(chan *stan.Msg, 10)
+	for _, channel := range []string{"foo", "bar"} {
+		if _, err := sc.Subscribe(DefaultDLQPrefix+"."+channel, func(m *stan.Msg) {
+			dlq <- m
+		}); err != nil {
+			t.Fatalf("Unexpected error on subscribe: %v", err)
+		}
+	}
+	// The subscription on foo overrides the server limit, the one on bar
+	// has no limit.
+	fooMsgs := subscribeRawMsgs(t, nc, s, &spb.SubscriptionRequest{Subject: "foo", MaxRedeliveries: 1})
+	barMsgs := subscribeRawMsgs(t, nc, s, &spb.SubscriptionRequest{Subject: "bar", MaxRedeliveries: -1})
+	for _, sub := range s.clients.GetSubs(clientName) {
+		sub.RLock()
+		subject, max := sub.subject, sub.MaxRedeliveries
+		sub.RUnlock()
+		if (subject == "foo" && max != 1) || (subject == "bar" && max != -1) {
+			t.Fatalf("Unexpected max redeliveries for %q: %v", subject, max)
+		}
+	}
+	setTestAckWait(s.clients.GetSubs(clientName), 100*time.Millisecond)
+
+	for _, channel := range []string{"foo", "bar"} {
+		if err := sc.Publish(channel, []byte("poison")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	select {
+	case m := <-dlq:
+		if m.Subject != DefaultDLQPrefix+".foo" {
+			t.Fatalf("Unexpected message in dead-letter channel %q", m.Subject)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Message should have been moved to the dead-letter channel")
+	}
+	// Past the server limit, the message on bar is still redelivered.
+	time.Sleep(time.Second)
+	select {
+	case m := <-dlq:
+		t.Fatalf("Unexpected message in dead-letter channel %q", m.Subject)
+	default:
+	}
+	if n := len(fooMsgs); n != 2 {
+		t.Fatalf("Expected 1 delivery and 1 redelivery on foo, got %v deliveries", n)
+	}
+	if n := len(barMsgs); n <= 6 {
+		t.Fatalf("Expected more than 6 deliveries on bar, got %v", n)
+	}
+}
+
+func TestDeadLetterQueueGroup(t *testing.T) {
+	s := runServerWithMaxRedeliveries(3)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	dlq := make(chan *stan.Msg, 10)
+	if _, err := sc.Subscribe(DefaultDLQPrefix+".foo", func(m *stan.Msg) {
+		dlq <- m
+	}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	// The count is kept while the message moves between members.
+	deliveries := int32(0)
+	for i := 0; i < 2; i++ {
+		if _, err := sc.QueueSubscribe("foo", "group", func(_ *stan.Msg) {
+			atomic.AddInt32(&deliveries, 1)
+		}, stan.SetManualAckMode(), stan.AckWait(time.Second)); err != nil {
+			t.Fatalf("Unexpected error on subscribe: %v", err)
+		}
+	}
+	setTestAckWait(s.clients.GetSubs(clientName), 100*time.Millisecond)
+
+	if err := sc.Publish("foo", []byte("poison")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	select {
+	case <-dlq:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Message should have been moved to the dead-letter channel")
+	}
+	time.Sleep(300 * time.Millisecond)
+	if n := atomic.LoadInt32(&deliveries); n != 4 {
+		t.Fatalf("Expected 1 delivery and 3 redeliveries, got %v deliveries", n)
+	}
+}
+
+func TestDeadLetterAckedMessage(t *testing.T) {
+	s := runServerWithMaxRedeliveries(1)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	dlq := make(chan *stan.Msg, 10)
+	if _, err := sc.Subscribe(DefaultDLQPrefix+".foo", func(m *stan.Msg) {
+		dlq <- m
+	}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	// Ack only redelivered messages.
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) {
+		if m.Redelivered {
+			m.Ack()
+		}
+	}, stan.SetManualAckMode(), stan.AckWait(time.Second)); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	setTestAckWait(s.clients.GetSubs(clientName), 100*time.Millisecond)
+
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	select {
+	case <-dlq:
+		t.Fatal("Acknowledged message should not be moved to the dead-letter channel")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"time"
+)
+
+// dedupWindow remembers the GUIDs of the messages stored during the last
+// Options.DedupWindow, so that a message published again with the same GUID,
+// for instance by a client retrying after a timeout, is acknowledged without
+// being stored twice. It is only accessed by the IO go routine.
+type dedupWindow struct {
+	window time.Duration
+	guids  map[string]struct{}
+	order  []dedupEntry // by storage time
+}
+
+type dedupEntry struct {
+	guid   string
+	stored int64
+}
+
+// newDedupWindow returns a deduplication window of the given duration, or
+// nil if the duration is 0.
+func newDedupWindow(window time.Duration) *dedupWindow {
+	if window <= 0 {
+		return nil
+	}
+	return &dedupWindow{window: window, guids: make(map[string]struct{})}
+}
+
+// isDuplicate returns true if a message with this GUID was stored within
+// the window.
+func (d *dedupWindow) isDuplicate(guid string, now int64) bool {
+	d.expire(now)
+	_, ok := d.guids[guid]
+	return ok
+}
+
+// add records the GUID of a message stored at the given time.
+func (d *dedupWindow) add(guid string, now int64) {
+	d.guids[guid] = struct{}{}
+	d.order = append(d.order, dedupEntry{guid: guid, stored: now})
+}
+
+// expire forgets the GUIDs stored before the window.
+func (d *dedupWindow) expire(now int64) {
+	limit := now - int64(d.window)
+	i := 0
+	for ; i < len(d.order) && d.order[i].stored <= limit; i++ {
+		delete(d.guids, d.order[i].guid)
+		d.order[i] = dedupEntry{}
+	}
+	if i > 0 {
+		d.order = d.order[i:]
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+func publishWithGUID(t *testing.T, s *StanServer, nc *nats.Conn, channel, guid string) *spb.PubAck {
+	pm := &spb.PubMsg{ClientID: clientName, Guid: guid, Subject: channel, Data: []byte("hello")}
+	b, _ := pm.Marshal()
+	reply, err := nc.Request(s.info.Publish+"."+channel, b, 5*time.Second)
+	if err != nil {
+		stackFatalf(t, "Unexpected error on publish: %v", err)
+	}
+	pa := &spb.PubAck{}
+	if err := pa.Unmarshal(reply.Data); err != nil {
+		stackFatalf(t, "Unexpected error on unmarshal: %v", err)
+	}
+	if pa.Guid != guid || pa.Error != "" {
+		stackFatalf(t, "Unexpected ack: %v", pa)
+	}
+	return pa
+}
+
+func TestDedupWindow(t *testing.T) {
+	clock := util.NewManualClock(time.Now())
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.Clock = clock
+	opts.DedupWindow = time.Minute
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	checkStored := func(expected uint64) {
+		cs := s.store.LookupChannel("foo")
+		if cs == nil || cs.Msgs.LastSequence() != expected {
+			stackFatalf(t, "Expected %v messages stored", expected)
+		}
+	}
+	publishWithGUID(t, s, nc, "foo", "guid1")
+	publishWithGUID(t, s, nc, "foo", "guid2")
+	// The retries are acknowledged but not stored.
+	publishWithGUID(t, s, nc, "foo", "guid1")
+	publishWithGUID(t, s, nc, "foo", "guid2")
+	checkStored(2)
+
+	// Past the window, the GUID is forgotten.
+	clock.Advance(time.Minute)
+	publishWithGUID(t, s, nc, "foo", "guid1")
+	checkStored(3)
+	publishWithGUID(t, s, nc, "foo", "guid1")
+	checkStored(3)
+}
@@ -0,0 +1,49 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+// DeleteChannel deletes the channel, with its messages and the state of its
+// subscriptions, including offline durables. If the channel has active
+// subscriptions, ErrChannelHasSubs is returned, unless force is true, in
+// which case they are removed first. Their clients are not notified, they
+// simply stop receiving messages. A message published afterwards creates
+// the channel again.
+func (s *StanServer) DeleteChannel(name string, force bool) error {
+	cs := s.store.LookupChannel(name)
+	if cs == nil {
+		return ErrUnknownChannel
+	}
+	ss := cs.UserData.(*subStore)
+	// Active subscriptions are the ones with an ack inbox.
+	ss.RLock()
+	subs := make([]*subState, 0, len(ss.acks))
+	for _, sub := range ss.acks {
+		subs = append(subs, sub)
+	}
+	ss.RUnlock()
+	if len(subs) > 0 && !force {
+		return ErrChannelHasSubs
+	}
+	for _, sub := range subs {
+		sub.RLock()
+		clientID := sub.ClientID
+		sub.RUnlock()
+		s.clients.RemoveSub(clientID, sub)
+		ss.Remove(sub, true)
+	}
+	if err := s.store.DeleteChannel(name); err != nil {
+		return err
+	}
+	if ss.deliveryPool != nil {
+		ss.deliveryPool.stop()
+	}
+	if s.pubLatency != nil {
+		s.pubLatency.remove(name)
+	}
+	if s.contentTypes != nil {
+		s.contentTypes.remove(name)
+	}
+	s.storeFull.remove(name)
+	s.log.Noticef("STAN: Deleted channel %q", name)
+	return nil
+}
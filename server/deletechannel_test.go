@@ -0,0 +1,131 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestDeleteChannel(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	msgs := make(chan *stan.Msg, 10)
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) { msgs <- m }); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	checkMsgSeq(t, msgs, 1)
+	checkMsgSeq(t, msgs, 2)
+
+	if err := s.DeleteChannel("foo", false); err != ErrChannelHasSubs {
+		t.Fatalf("Expected error %v, got %v", ErrChannelHasSubs, err)
+	}
+	if err := s.DeleteChannel("foo", true); err != nil {
+		t.Fatalf("Unexpected error on delete: %v", err)
+	}
+	if s.store.LookupChannel("foo") != nil {
+		t.Fatal("Channel should have been deleted")
+	}
+	if subs := s.clients.GetSubs(clientName); len(subs) != 0 {
+		t.Fatalf("Expected no subscription, got %v", len(subs))
+	}
+
+	// A new message creates the channel again, and is not sent to the
+	// removed subscription.
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	cs := s.store.LookupChannel("foo")
+	if cs == nil {
+		t.Fatal("Channel should have been created")
+	}
+	if last := cs.Msgs.LastSequence(); last != 1 {
+		t.Fatalf("Unexpected last sequence: %v", last)
+	}
+	checkNoMsg(t, msgs)
+
+	if err := s.DeleteChannel("bar", false); err != ErrUnknownChannel {
+		t.Fatalf("Expected error %v, got %v", ErrUnknownChannel, err)
+	}
+}
+
+func TestDeleteChannelOfflineDurable(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	msgs := make(chan *stan.Msg, 10)
+	cb := func(m *stan.Msg) { msgs <- m }
+	if _, err := sc.Subscribe("foo", cb, stan.DurableName("dur")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	checkMsgSeq(t, msgs, 1)
+	sc.Close()
+
+	// An offline durable is not an active subscription.
+	if err := s.DeleteChannel("foo", false); err != nil {
+		t.Fatalf("Unexpected error on delete: %v", err)
+	}
+
+	// The durable is created again, starting with the new messages.
+	sc = NewDefaultConnection(t)
+	defer sc.Close()
+	if _, err := sc.Subscribe("foo", cb, stan.DurableName("dur"), stan.DeliverAllAvailable()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	checkMsgSeq(t, msgs, 1)
+	checkNoMsg(t, msgs)
+}
+
+func TestAdminDeleteChannel(t *testing.T) {
+	s := runServerWithAdminUsers()
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	resp := sendAdminRequest(t, nc, &spb.AdminRequest{Token: adminOperatorToken, Operation: AdminOpDeleteChannel, Channel: "foo", Force: true})
+	if resp.Error != ErrAdminForbidden.Error() {
+		t.Fatalf("Expected error %q, got %q", ErrAdminForbidden, resp.Error)
+	}
+	resp = sendAdminRequest(t, nc, &spb.AdminRequest{Token: adminDestructiveToken, Operation: AdminOpDeleteChannel, Channel: "foo"})
+	if resp.Error != ErrChannelHasSubs.Error() {
+		t.Fatalf("Expected error %q, got %q", ErrChannelHasSubs, resp.Error)
+	}
+	resp = sendAdminRequest(t, nc, &spb.AdminRequest{Token: adminDestructiveToken, Operation: AdminOpDeleteChannel, Channel: "foo", Force: true})
+	if resp.Error != "" {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+	if s.store.LookupChannel("foo") != nil {
+		t.Fatal("Channel should have been deleted")
+	}
+}
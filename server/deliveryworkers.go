@@ -0,0 +1,167 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+// ChannelWorkers sets the number of delivery workers of the
+// matching channels, overriding Options.DeliveryWorkers.
+type ChannelWorkers struct {
+	Channels string // Channels the number applies to (a subject, possibly with wildcards)
+	Workers  int    // Go routines sending the new messages of each channel in parallel (0 or 1 for none)
+}
+
+// deliveryWorkersFor returns the number of delivery workers of the channel,
+// given by the first ChannelWorkers matching it, if any.
+func (s *StanServer) deliveryWorkersFor(channel string) int {
+	for _, cw := range s.opts.ChannelWorkers {
+		if util.SubjectMatches(cw.Channels, channel) {
+			return cw.Workers
+		}
+	}
+	return s.opts.DeliveryWorkers
+}
+
+// validateDeliveryWorkers checks the number of delivery workers.
+func validateDeliveryWorkers(opts *Options) error {
+	if opts.DeliveryWorkers < 0 {
+		return fmt.Errorf("delivery workers can't be negative")
+	}
+	for _, cw := range opts.ChannelWorkers {
+		if !util.IsValidSubjectPattern(cw.Channels) {
+			return fmt.Errorf("invalid delivery workers channels %q", cw.Channels)
+		}
+		if cw.Workers < 0 {
+			return fmt.Errorf("delivery workers of %q can't be negative", cw.Channels)
+		}
+	}
+	return nil
+}
+
+// deliveryPool are the go routines sending the new messages of a channel
+// to its plain subscriptions and queue groups in parallel. Each of them is
+// always served by the same worker, so that its messages keep their order.
+// The workers are started on the first delivery, and run until the channel
+// is deleted or the server shuts down.
+type deliveryPool struct {
+	sync.Mutex
+	size    int
+	batches []chan *deliveryBatch
+	stopped bool
+}
+
+// deliveryBatch is the share of a worker in the delivery of new messages.
+type deliveryBatch struct {
+	cs    *stores.ChannelStore
+	psubs []*subState
+	qsubs []*queueState
+	burst int
+	more  *int32
+	wg    *sync.WaitGroup
+}
+
+// newDeliveryPool returns the pool of a channel with the given number
+// of workers, or nil if the messages are sent without workers.
+func newDeliveryPool(size int) *deliveryPool {
+	if size <= 1 {
+		return nil
+	}
+	return &deliveryPool{size: size}
+}
+
+// deliveryWorker sends the messages of the batches it receives until the
+// pool is stopped.
+func (s *StanServer) deliveryWorker(batches chan *deliveryBatch) {
+	for b := range batches {
+		var more bool
+		for _, sub := range b.psubs {
+			if s.sendAvailableMessagesUpTo(b.cs, sub, b.burst) {
+				more = true
+			}
+		}
+		for _, qs := range b.qsubs {
+			if s.sendAvailableMessagesToQueueUpTo(b.cs, qs, b.burst) {
+				more = true
+			}
+		}
+		if more {
+			atomic.StoreInt32(b.more, 1)
+		}
+		b.wg.Done()
+	}
+}
+
+// stop stops the workers once they are done with the pending batches.
+func (p *deliveryPool) stop() {
+	p.Lock()
+	defer p.Unlock()
+	if p.stopped {
+		return
+	}
+	p.stopped = true
+	for _, batches := range p.batches {
+		close(batches)
+	}
+}
+
+// deliverInParallel sends the new messages of the channel to its plain
+// subscriptions and queue groups with the workers of its pool, so that the
+// fan-out of a busy channel uses several cores. Returns true if the burst
+// was reached for any of them, and false for `ok` if the pool is stopped,
+// in which case nothing was sent. subStore lock held on entry.
+func (s *StanServer) deliverInParallel(cs *stores.ChannelStore, ss *subStore, burst int) (more, ok bool) {
+	p := ss.deliveryPool
+	shares := make([]*deliveryBatch, p.size)
+	share := func(w uint32) *deliveryBatch {
+		if shares[w] == nil {
+			shares[w] = &deliveryBatch{cs: cs, burst: burst}
+		}
+		return shares[w]
+	}
+	for _, sub := range ss.psubs {
+		b := share(uint32(sub.ID % uint64(p.size)))
+		b.psubs = append(b.psubs, sub)
+	}
+	for name, qs := range ss.qsubs {
+		h := fnv.New32a()
+		h.Write([]byte(name))
+		b := share(h.Sum32() % uint32(p.size))
+		b.qsubs = append(b.qsubs, qs)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		reached int32
+	)
+	p.Lock()
+	if p.stopped {
+		p.Unlock()
+		return false, false
+	}
+	if p.batches == nil {
+		p.batches = make([]chan *deliveryBatch, p.size)
+		for w := range p.batches {
+			p.batches[w] = make(chan *deliveryBatch, 1)
+			go s.deliveryWorker(p.batches[w])
+		}
+	}
+	for w, b := range shares {
+		if b == nil {
+			continue
+		}
+		b.more, b.wg = &reached, &wg
+		wg.Add(1)
+		p.batches[w] <- b
+	}
+	p.Unlock()
+	wg.Wait()
+	return atomic.LoadInt32(&reached) == 1, true
+}
@@ -0,0 +1,142 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+)
+
+func TestDeliveryWorkers(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.DeliveryWorkers = 4
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	total := 50
+	var (
+		mu       sync.Mutex
+		received = make(map[string][]uint64)
+	)
+	done := make(chan struct{}, 20)
+	cb := func(name string) stan.MsgHandler {
+		return func(m *stan.Msg) {
+			mu.Lock()
+			received[name] = append(received[name], m.Sequence)
+			count := len(received[name])
+			mu.Unlock()
+			if count == total {
+				done <- struct{}{}
+			}
+		}
+	}
+	subs := 10
+	for i := 0; i < subs; i++ {
+		if _, err := sc.Subscribe("foo", cb(fmt.Sprintf("sub%d", i)), stan.MaxInflight(total)); err != nil {
+			t.Fatalf("Unexpected error on subscribe: %v", err)
+		}
+	}
+	// The members of a queue group share the messages of the group.
+	qcb := cb("queue")
+	for i := 0; i < 2; i++ {
+		if _, err := sc.QueueSubscribe("foo", "queue", qcb, stan.MaxInflight(total)); err != nil {
+			t.Fatalf("Unexpected error on subscribe: %v", err)
+		}
+	}
+	for i := 0; i < total; i++ {
+		if _, err := sc.PublishAsync("foo", []byte("hello"), nil); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	for i := 0; i < subs+1; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Did not get all messages")
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for name, seqs := range received {
+		if name == "queue" {
+			continue
+		}
+		// Each subscription gets the messages in order.
+		for i, seq := range seqs {
+			if seq != uint64(i+1) {
+				t.Fatalf("Subscription %v got messages out of order: %v", name, seqs)
+			}
+		}
+	}
+}
+
+func TestChannelWorkers(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.DeliveryWorkers = 4
+	opts.ChannelWorkers = []*ChannelWorkers{{Channels: "bar", Workers: 0}, {Channels: "baz.*", Workers: 2}}
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	for _, channel := range []string{"foo", "bar", "baz.1"} {
+		for i := 0; i < 2; i++ {
+			if _, err := sc.Subscribe(channel, func(_ *stan.Msg) {}); err != nil {
+				t.Fatalf("Unexpected error on subscribe: %v", err)
+			}
+		}
+		if err := sc.Publish(channel, []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	pool := func(channel string) *deliveryPool {
+		return s.store.LookupChannel(channel).UserData.(*subStore).deliveryPool
+	}
+	if pool("bar") != nil {
+		t.Fatal("Expected no workers for bar")
+	}
+	// The workers are started once and kept for the next deliveries.
+	for channel, size := range map[string]int{"foo": 4, "baz.1": 2} {
+		p := pool(channel)
+		p.Lock()
+		workers := len(p.batches)
+		p.Unlock()
+		if workers != size {
+			t.Fatalf("Expected %v workers for %v, got %v", size, channel, workers)
+		}
+	}
+	p := pool("foo")
+	p.Lock()
+	batches := p.batches
+	p.Unlock()
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	p.Lock()
+	same := &p.batches[0] == &batches[0]
+	p.Unlock()
+	if !same {
+		t.Fatal("Expected the workers to be reused")
+	}
+
+	// The workers are stopped with the channel.
+	if err := s.DeleteChannel("foo", true); err != nil {
+		t.Fatalf("Unexpected error on delete: %v", err)
+	}
+	p.Lock()
+	stopped := p.stopped
+	p.Unlock()
+	if !stopped {
+		t.Fatal("Expected the workers to be stopped")
+	}
+}
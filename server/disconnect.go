@@ -0,0 +1,106 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// DisconnectClient closes the connection of the client, as if the client
+// had closed it: its non durable subscriptions are removed, and its durables
+// are kept, offline, so that they can be resumed. The client is notified
+// with a spb.ClientDisconnect message sent to its heartbeat inbox, and its
+// subsequent requests fail since it is no longer registered.
+func (s *StanServer) DisconnectClient(clientID, reason string) error {
+	if !s.closeClient(clientID, ClientCloseAdmin, reason) {
+		return ErrUnknownClient
+	}
+	s.log.Noticef("STAN: [Client:%s] Disconnected: %s", clientID, reason)
+	return nil
+}
+
+// RemoveClient closes the connection of the client, like DisconnectClient,
+// and also deletes its durables, which can't be resumed anymore. This cleans
+// up after a client that is gone for good, so the durables of the client
+// are deleted even if it is no longer connected. The durable queue groups
+// the client was a member of are shared with other clients and are kept.
+// Returns the number of durables deleted, and ErrUnknownClient if the
+// client was neither connected nor had durables.
+func (s *StanServer) RemoveClient(clientID, reason string) (int, error) {
+	if clientID == "" {
+		return 0, ErrUnknownClient
+	}
+	err := s.DisconnectClient(clientID, reason)
+	if err != nil && err != ErrUnknownClient {
+		return 0, err
+	}
+	removed := 0
+	for _, cs := range s.store.GetChannels() {
+		removed += cs.UserData.(*subStore).removeOfflineDurables(clientID)
+	}
+	if err != nil && removed == 0 {
+		return 0, err
+	}
+	s.log.Noticef("STAN: [Client:%s] Removed %v durable(s)", clientID, removed)
+	return removed, nil
+}
+
+// removeOfflineDurables deletes the offline durables of the client from the
+// subStore and the store, and returns how many were deleted.
+func (ss *subStore) removeOfflineDurables(clientID string) int {
+	var removed []*subState
+	ss.Lock()
+	for key, sub := range ss.durables {
+		sub.Lock()
+		// The key of an offline durable still has the client ID. The
+		// client may have resumed the durable since it was disconnected.
+		if sub.ClientID == "" && sub.QGroup == "" &&
+			key == durableKey(&spb.SubscriptionRequest{ClientID: clientID, Subject: sub.subject, DurableName: sub.DurableName}) {
+			sub.clearAckTimer()
+			sub.replay.stop()
+			delete(ss.durables, key)
+			removed = append(removed, sub)
+		}
+		sub.Unlock()
+	}
+	ss.Unlock()
+
+	for _, sub := range removed {
+		sub.Lock()
+		lazy := sub.lazy
+		sub.lazy = nil
+		subid, store := sub.ID, sub.store
+		sub.Unlock()
+		if lazy != nil {
+			// Never written to the store.
+			lazy.remove(sub)
+		} else {
+			store.DeleteSub(subid)
+		}
+	}
+	return len(removed)
+}
+
+// notifyClientClosed sends a spb.ClientDisconnect message to the heartbeat
+// inbox of a client whose connection the server closed, with the reason of
+// the close, so that the client can tell whether to connect again. A client
+// whose heartbeats timed out may well be gone, but it may also have been
+// cut from the server for a while.
+func (s *StanServer) notifyClientClosed(clientID, hbInbox, reason, detail string) {
+	cd := &spb.ClientDisconnect{ClientID: clientID, Reason: detail, Code: reason}
+	switch reason {
+	case ClientCloseHBTimeout:
+		cd.Reconnect = true
+		if cd.Reason == "" {
+			cd.Reason = "heartbeats timed out"
+		}
+	case ClientCloseSlowSub:
+		cd.Reconnect = true
+	case ClientCloseReplaced:
+		if cd.Reason == "" {
+			cd.Reason = "replaced by a connection with the same client ID"
+		}
+	}
+	b, _ := cd.Marshal()
+	s.nc.Publish(hbInbox, b)
+}
@@ -0,0 +1,270 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestDisconnectClient(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}, stan.DurableName("dur")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+	notif := make(chan *nats.Msg, 1)
+	if _, err := nc.ChanSubscribe(s.store.GetClient(clientName).HbInbox, notif); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	nc.Flush()
+
+	if err := s.DisconnectClient(clientName, "misbehaving"); err != nil {
+		t.Fatalf("Unexpected error on disconnect: %v", err)
+	}
+	select {
+	case m := <-notif:
+		cd := &spb.ClientDisconnect{}
+		if err := cd.Unmarshal(m.Data); err != nil {
+			t.Fatalf("Unexpected error on unmarshal: %v", err)
+		}
+		if cd.ClientID != clientName || cd.Reason != "misbehaving" || cd.Code != ClientCloseAdmin || cd.Reconnect {
+			t.Fatalf("Unexpected notification: %v", cd)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Client was not notified")
+	}
+	if s.store.GetClient(clientName) != nil {
+		t.Fatal("Client should have been unregistered")
+	}
+	// The durable is kept, offline.
+	ss := s.store.LookupChannel("foo").UserData.(*subStore)
+	ss.RLock()
+	psubs, durables := len(ss.psubs), len(ss.durables)
+	ss.RUnlock()
+	if psubs != 0 || durables != 1 {
+		t.Fatalf("Expected only the durable to be kept, got %v subs and %v durables", psubs, durables)
+	}
+
+	if err := s.DisconnectClient(clientName, "again"); err != ErrUnknownClient {
+		t.Fatalf("Expected error %v, got %v", ErrUnknownClient, err)
+	}
+}
+
+func TestAdminDisconnectClient(t *testing.T) {
+	s := runServerWithAdminUsers()
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	resp := sendAdminRequest(t, nc, &spb.AdminRequest{Token: adminReadToken, Operation: AdminOpDisconnectClient, ClientID: clientName})
+	if resp.Error != ErrAdminForbidden.Error() {
+		t.Fatalf("Expected error %q, got %q", ErrAdminForbidden, resp.Error)
+	}
+	resp = sendAdminRequest(t, nc, &spb.AdminRequest{Token: adminOperatorToken, Operation: AdminOpDisconnectClient, ClientID: clientName})
+	if resp.Error != "" {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+	if s.store.GetClient(clientName) != nil {
+		t.Fatal("Client should have been unregistered")
+	}
+	resp = sendAdminRequest(t, nc, &spb.AdminRequest{Token: adminOperatorToken, Operation: AdminOpDisconnectClient, ClientID: clientName})
+	if resp.Error != ErrUnknownClient.Error() {
+		t.Fatalf("Expected error %q, got %q", ErrUnknownClient, resp.Error)
+	}
+}
+
+// connectRaw registers the client with a heartbeat inbox that never answers,
+// and returns the messages sent to it.
+func connectRaw(t *testing.T, nc *nats.Conn, clientID string) chan *nats.Msg {
+	hbInbox := nats.NewInbox()
+	notif := make(chan *nats.Msg, 10)
+	if _, err := nc.ChanSubscribe(hbInbox, notif); err != nil {
+		stackFatalf(t, "Unexpected error on subscribe: %v", err)
+	}
+	b, _ := (&spb.ConnectRequest{ClientID: clientID, HeartbeatInbox: hbInbox}).Marshal()
+	reply, err := nc.Request(DefaultDiscoverPrefix+"."+clusterName, b, 2*time.Second)
+	if err != nil {
+		stackFatalf(t, "Unexpected error on connect: %v", err)
+	}
+	cr := &spb.ConnectResponse{}
+	if err := cr.Unmarshal(reply.Data); err != nil || cr.Error != "" {
+		stackFatalf(t, "Unexpected connect response: %v (%v)", cr, err)
+	}
+	return notif
+}
+
+// checkDisconnect waits for the spb.ClientDisconnect message among those
+// sent to the heartbeat inbox, skipping the heartbeats.
+func checkDisconnect(t *testing.T, notif chan *nats.Msg, code string, reconnect bool) {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case m := <-notif:
+			if m.Reply != "" {
+				continue
+			}
+			cd := &spb.ClientDisconnect{}
+			if err := cd.Unmarshal(m.Data); err != nil {
+				stackFatalf(t, "Unexpected error on unmarshal: %v", err)
+			}
+			if cd.ClientID != clientName || cd.Code != code || cd.Reconnect != reconnect || cd.Reason == "" {
+				stackFatalf(t, "Unexpected notification: %v", cd)
+			}
+			return
+		case <-timeout:
+			stackFatalf(t, "Client was not notified")
+		}
+	}
+}
+
+func TestDisconnectReasons(t *testing.T) {
+	// A client that does not answer the heartbeats can connect again.
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.ClientHBInterval = 50 * time.Millisecond
+	opts.ClientHBTimeout = 10 * time.Millisecond
+	opts.ClientHBFailCount = 1
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+	notif := connectRaw(t, nc, clientName)
+	checkDisconnect(t, notif, ClientCloseHBTimeout, true)
+	nc.Close()
+	s.Shutdown()
+
+	// A replaced client should not.
+	s = RunServer(clusterName)
+	defer s.Shutdown()
+	nc, err = nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+	notif = connectRaw(t, nc, clientName)
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	checkDisconnect(t, notif, ClientCloseReplaced, false)
+
+	// A client closing its connection is not notified.
+	notif = make(chan *nats.Msg, 10)
+	if _, err := nc.ChanSubscribe(s.store.GetClient(clientName).HbInbox, notif); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	nc.Flush()
+	sc.Close()
+	select {
+	case m := <-notif:
+		if m.Reply == "" {
+			t.Fatalf("Unexpected notification: %v", m)
+		}
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRemoveClient(t *testing.T) {
+	s := runServerWithAdminUsers()
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	other, err := stan.Connect(clusterName, "other")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer other.Close()
+
+	for _, c := range []stan.Conn{sc, other} {
+		if _, err := c.Subscribe("foo", func(_ *stan.Msg) {}, stan.DurableName("dur")); err != nil {
+			t.Fatalf("Unexpected error on subscribe: %v", err)
+		}
+	}
+	if _, err := sc.Subscribe("bar", func(_ *stan.Msg) {}, stan.DurableName("dur")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if _, err := sc.Subscribe("bar", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	durables := func(channel string) int {
+		ss := s.store.LookupChannel(channel).UserData.(*subStore)
+		ss.RLock()
+		defer ss.RUnlock()
+		return len(ss.durables)
+	}
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	// Removing durables requires the destructive role.
+	resp := sendAdminRequest(t, nc, &spb.AdminRequest{Token: adminOperatorToken, Operation: AdminOpRemoveClient, ClientID: clientName})
+	if resp.Error != ErrAdminForbidden.Error() {
+		t.Fatalf("Expected error %q, got %q", ErrAdminForbidden, resp.Error)
+	}
+	resp = sendAdminRequest(t, nc, &spb.AdminRequest{Token: adminDestructiveToken, Operation: AdminOpRemoveClient, ClientID: clientName})
+	if resp.Error != "" {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+	result := &AdminRemovedClient{}
+	if err := json.Unmarshal(resp.Data, result); err != nil {
+		t.Fatalf("Unexpected error on unmarshal: %v", err)
+	}
+	if result.DurablesRemoved != 2 {
+		t.Fatalf("Expected 2 durables removed, got %v", result.DurablesRemoved)
+	}
+	if s.store.GetClient(clientName) != nil {
+		t.Fatal("Client should have been unregistered")
+	}
+	// The durables of the other client are kept.
+	if n := durables("foo"); n != 1 {
+		t.Fatalf("Expected 1 durable on foo, got %v", n)
+	}
+	if n := durables("bar"); n != 0 {
+		t.Fatalf("Expected no durable on bar, got %v", n)
+	}
+	if _, err := s.RemoveClient(clientName, "again"); err != ErrUnknownClient {
+		t.Fatalf("Expected error %v, got %v", ErrUnknownClient, err)
+	}
+
+	// The durables of a client that is gone are removed too.
+	if err := other.Close(); err != nil {
+		t.Fatalf("Unexpected error on close: %v", err)
+	}
+	if n, err := s.RemoveClient("other", "gone"); err != nil || n != 1 {
+		t.Fatalf("Expected 1 durable removed, got %v (%v)", n, err)
+	}
+	if n := durables("foo"); n != 0 {
+		t.Fatalf("Expected no durable on foo, got %v", n)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// Interval at which Stop checks for outstanding acks.
+const drainCheckInterval = 10 * time.Millisecond
+
+// isDraining returns true once Stop has been called.
+func (s *StanServer) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// Stop gracefully shuts down the server. New publishes are rejected with
+// ErrDraining, then Stop waits for the messages already received to be
+// stored and flushed, and for the subscriptions to acknowledge the messages
+// they have been sent, before calling Shutdown. Subscriptions can still
+// receive and ack messages in the meantime, so that they don't get them
+// again after a restart. If the context is done first, the server is shut
+// down right away and the context's error is returned.
+func (s *StanServer) Stop(ctx context.Context) error {
+	s.RLock()
+	shutdown := s.shutdown
+	s.RUnlock()
+	if shutdown || !atomic.CompareAndSwapInt32(&s.draining, 0, 1) {
+		return nil
+	}
+	s.log.Noticef("STAN: Draining")
+	err := s.drainIOChannel(ctx)
+	if err == nil {
+		err = s.drainAcks(ctx)
+	}
+	if err != nil {
+		s.log.Errorf("STAN: Drain did not complete: %v", err)
+	}
+	s.Shutdown()
+	return err
+}
+
+// drainIOChannel waits for the messages received before the drain started
+// to be stored. A flush request is queued behind them, in the same way as
+// for publishers' flush requests.
+func (s *StanServer) drainIOChannel(ctx context.Context) error {
+	// The IO loop only runs once the server is active.
+	if s.State() == FTStandby {
+		return nil
+	}
+	done := make(chan struct{})
+	inbox := nats.NewInbox()
+	sub, err := s.nc.Subscribe(inbox, func(_ *nats.Msg) { close(done) })
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+	sub.AutoUnsubscribe(1)
+	req, _ := (&spb.FlushRequest{}).Marshal()
+	if err := s.nc.PublishRequest(s.flushMarker, inbox, req); err != nil {
+		return err
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drainAcks waits until no subscription has messages pending acknowledgment.
+func (s *StanServer) drainAcks(ctx context.Context) error {
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for s.hasPendingAcks() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (s *StanServer) hasPendingAcks() bool {
+	s.RLock()
+	store := s.store
+	s.RUnlock()
+	if store == nil {
+		return false
+	}
+	for clientID := range store.GetClients() {
+		for _, sub := range s.clients.GetSubs(clientID) {
+			sub.RLock()
+			pending := len(sub.acksPending)
+			sub.RUnlock()
+			if pending > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sendDrainingErr rejects a publish received while draining.
+func (s *StanServer) sendDrainingErr(m *nats.Msg) {
+	pm := &spb.PubMsg{}
+	pm.Unmarshal(m.Data)
+	s.sendPublishErr(m.Reply, pm.Guid, ErrDraining)
+}
@@ -0,0 +1,125 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+)
+
+func TestStopDrainsAcks(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	msgs := make(chan *stan.Msg, 10)
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) {
+		msgs <- m
+	}, stan.SetManualAckMode(), stan.AckWait(30*time.Second)); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	var m *stan.Msg
+	select {
+	case m = <-msgs:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Did not get our message")
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stopped <- s.Stop(ctx)
+	}()
+	waitForCount(t, 1, func() (string, int) {
+		if s.isDraining() {
+			return "draining", 1
+		}
+		return "draining", 0
+	})
+	// New publishes are rejected.
+	if err := sc.Publish("foo", []byte("rejected")); err == nil || err.Error() != ErrDraining.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrDraining, err)
+	}
+	// The server waits for the pending message to be acked.
+	select {
+	case err := <-stopped:
+		t.Fatalf("Stop should wait for the ack, returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := m.Ack(); err != nil {
+		t.Fatalf("Unexpected error on ack: %v", err)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("Unexpected error on stop: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop should have returned")
+	}
+	s.RLock()
+	shutdown := s.shutdown
+	s.RUnlock()
+	if !shutdown {
+		t.Fatal("Server should be shutdown")
+	}
+}
+
+func TestStopTimeout(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {},
+		stan.SetManualAckMode(), stan.AckWait(30*time.Second)); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := s.Stop(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected error %v, got %v", context.DeadlineExceeded, err)
+	}
+	if dur := time.Since(start); dur > time.Second {
+		t.Fatalf("Stop took too long: %v", dur)
+	}
+	s.RLock()
+	shutdown := s.shutdown
+	s.RUnlock()
+	if !shutdown {
+		t.Fatal("Server should be shutdown")
+	}
+	// Stopping again is a no-op.
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestStopWithoutPendingAcks(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatalf("Unexpected error on stop: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// durableQueueName returns the name of the durable queue group joined by
+// the subscription request. The durable name is part of it, so that the
+// group is distinct from a non durable group of the same name.
+func durableQueueName(sr *spb.SubscriptionRequest) string {
+	return sr.DurableName + ":" + sr.QGroup
+}
+
+// isDurableQueueSub returns true if the subscription is a member of a
+// durable queue group. Lock held on entry.
+func (sub *subState) isDurableQueueSub() bool {
+	return sub.DurableName != "" && sub.QGroup != ""
+}
+
+// setDurableQueueShadow keeps the last member of a durable queue group
+// once it has left, so that the members joining the group later resume
+// where it left off. The shadow has the last sequence sent to the group
+// and the messages it had not acknowledged. Recovered members whose client
+// is gone are merged into the shadow. Assumes qs lock held.
+func (ss *subStore) setDurableQueueShadow(qs *queueState, sub *subState) {
+	if qs.shadow == nil {
+		qs.shadow = sub
+		return
+	}
+	shadow := qs.shadow
+	for seq, m := range sub.acksPending {
+		if err := shadow.store.AddSeqPending(shadow.ID, seq); err != nil {
+			ss.stan.log.Errorf("STAN: Unable to move pending message %v of %s to the durable queue group %s: %v",
+				seq, sub.subject, sub.QGroup, err)
+			continue
+		}
+		shadow.acksPending[seq] = m
+	}
+	if sub.LastSent > shadow.LastSent {
+		shadow.LastSent = sub.LastSent
+	}
+	sub.store.DeleteSub(sub.ID)
+}
+
+// takeDurableQueueShadow returns the shadow of the durable queue group, if
+// all its members had left, and removes it from the group.
+func (ss *subStore) takeDurableQueueShadow(qGroup string) *subState {
+	ss.Lock()
+	defer ss.Unlock()
+	qs := ss.qsubs[qGroup]
+	if qs == nil {
+		return nil
+	}
+	qs.Lock()
+	shadow := qs.shadow
+	qs.shadow = nil
+	qs.Unlock()
+	return shadow
+}
+
+// leaveDurableQueue removes the member from its durable queue group. When
+// the last member leaves, it becomes the shadow of the group and is updated
+// in the store with the last sequence sent to the group, unless unsubscribed
+// (force), in which case the group is deleted. Other members are deleted
+// from the store. Assumes ss lock held.
+func (ss *subStore) leaveDurableQueue(sub *subState, qs *queueState, force bool) {
+	qs.Lock()
+	qs.subs, _ = sub.deleteFromList(qs.subs)
+	last := len(qs.subs) == 0
+	if last && !force {
+		ss.setDurableQueueShadow(qs, sub)
+	}
+	lastSent := qs.lastSent
+	qs.Unlock()
+
+	sub.Lock()
+	qGroup := sub.QGroup
+	if !last || force {
+		sub.Unlock()
+		if last {
+			delete(ss.qsubs, qGroup)
+		}
+		sub.store.DeleteSub(sub.ID)
+		return
+	}
+	sub.LastSent = lastSent
+	state := sub.SubState
+	sub.Unlock()
+	if err := sub.store.UpdateSub(&state); err != nil {
+		ss.stan.log.Errorf("STAN: Unable to update the durable queue group %s on %s: %v",
+			qGroup, sub.subject, err)
+	}
+}
+
+// hasDurableQueueShadows returns true if a durable queue group of the
+// channel has no member left. Assumes ss lock held.
+func (ss *subStore) hasDurableQueueShadows() bool {
+	for _, qs := range ss.qsubs {
+		qs.RLock()
+		shadow := qs.shadow
+		qs.RUnlock()
+		if shadow != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,242 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+// durableQueueMember subscribes to the durable queue group "dur"/"group"
+// on foo, acking only the messages listed, and returns the sequences
+// received on the channel.
+func durableQueueMember(t *testing.T, sc stan.Conn, ack map[uint64]bool, opts ...stan.SubscriptionOption) (stan.Subscription, chan *stan.Msg) {
+	ch := make(chan *stan.Msg, 10)
+	opts = append(opts, stan.DurableName("dur"), stan.SetManualAckMode())
+	sub, err := sc.QueueSubscribe("foo", "group", func(m *stan.Msg) {
+		if ack == nil || ack[m.Sequence] {
+			m.Ack()
+		}
+		ch <- m
+	}, opts...)
+	if err != nil {
+		stackFatalf(t, "Unexpected error on subscribe: %v", err)
+	}
+	return sub, ch
+}
+
+func checkDurableQueueMsgs(t *testing.T, ch chan *stan.Msg, expected ...string) {
+	for _, e := range expected {
+		select {
+		case m := <-ch:
+			if got := fmt.Sprintf("%d:%v", m.Sequence, m.Redelivered); got != e {
+				stackFatalf(t, "Expected message %v, got %v", e, got)
+			}
+		case <-time.After(2 * time.Second):
+			stackFatalf(t, "Did not get message %v", e)
+		}
+	}
+	select {
+	case m := <-ch:
+		stackFatalf(t, "Unexpected message %d:%v", m.Sequence, m.Redelivered)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDurableQueueSurvivesLastMember(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	opts := GetDefaultOptions()
+	opts.StoreType = stores.TypeFile
+	opts.FilestoreDir = defaultDataStore
+	s := runServerWithOpts(opts)
+	defer shutdownRestartedServerOnTestExit(&s)
+
+	publish := func(sc stan.Conn, count int) {
+		for i := 0; i < count; i++ {
+			if err := sc.Publish("foo", []byte("hello")); err != nil {
+				stackFatalf(t, "Unexpected error on publish: %v", err)
+			}
+		}
+	}
+
+	// The first generation acks only the first message, then leaves.
+	sc, err := stan.Connect(clusterName, "gen1")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	_, ch := durableQueueMember(t, sc, map[uint64]bool{1: true}, stan.DeliverAllAvailable())
+	publish(sc, 3)
+	checkDurableQueueMsgs(t, ch, "1:false", "2:false", "3:false")
+	sc.Close()
+
+	// The group is reported as offline.
+	states, err := s.SubscriptionsState("foo", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(states) != 1 || !states[0].Offline || states[0].QueueGroup != "dur:group" ||
+		states[0].LastSent != 3 || states[0].PendingAcks != 2 {
+		t.Fatalf("Unexpected states: %+v", states[0])
+	}
+
+	// Messages published while the group has no member are not lost.
+	sc = NewDefaultConnection(t)
+	publish(sc, 2)
+	sc.Close()
+
+	s.Shutdown()
+	s = runServerWithOpts(opts)
+
+	// The second generation gets the unacknowledged messages redelivered,
+	// then those published in between.
+	sc, err = stan.Connect(clusterName, "gen2")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	_, ch = durableQueueMember(t, sc, nil)
+	checkDurableQueueMsgs(t, ch, "2:true", "3:true", "4:false", "5:false")
+	// A second member leaving does not affect the group.
+	sc2, err := stan.Connect(clusterName, "gen2bis")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	durableQueueMember(t, sc2, nil)
+	sc2.Close()
+	sc.Close()
+
+	s.Shutdown()
+	s = runServerWithOpts(opts)
+
+	// The third generation only gets new messages.
+	sc, err = stan.Connect(clusterName, "gen3")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer sc.Close()
+	sub, ch := durableQueueMember(t, sc, nil, stan.DeliverAllAvailable())
+	checkDurableQueueMsgs(t, ch)
+	publish(sc, 1)
+	checkDurableQueueMsgs(t, ch, "6:false")
+
+	// Unsubscribing the last member deletes the group.
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatalf("Unexpected error on unsubscribe: %v", err)
+	}
+	if states, _ := s.SubscriptionsState("foo", ""); len(states) != 0 {
+		t.Fatalf("Unexpected states: %+v", states)
+	}
+	_, ch = durableQueueMember(t, sc, nil, stan.StartAtSequence(5))
+	checkDurableQueueMsgs(t, ch, "5:false", "6:false")
+}
+
+func TestDurableQueueSubClose(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	var conns []stan.Conn
+	for _, clientID := range []string{"member1", "member2", "member3"} {
+		sc, err := stan.Connect(clusterName, clientID)
+		if err != nil {
+			t.Fatalf("Unexpected error on connect: %v", err)
+		}
+		defer sc.Close()
+		conns = append(conns, sc)
+	}
+	closeMember := func(clientID string) {
+		subs := checkSubs(t, s, clientID, 1)
+		subs[0].RLock()
+		req := &pb.UnsubscribeRequest{ClientID: clientID, Subject: "foo", Inbox: subs[0].AckInbox}
+		subs[0].RUnlock()
+		if resp := sendSubCloseRequest(t, nc, req); resp.Error != "" {
+			stackFatalf(t, "Unexpected error on close of %q: %v", clientID, resp.Error)
+		}
+		checkSubs(t, s, clientID, 0)
+	}
+
+	_, ch1 := durableQueueMember(t, conns[0], nil, stan.DeliverAllAvailable())
+	_, ch2 := durableQueueMember(t, conns[1], map[uint64]bool{1: true})
+
+	// Closing a member leaves the others in the group.
+	closeMember("member1")
+	for i := 0; i < 2; i++ {
+		if err := conns[0].Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	checkDurableQueueMsgs(t, ch2, "1:false", "2:false")
+	checkDurableQueueMsgs(t, ch1)
+	sub := checkSubs(t, s, "member2", 1)[0]
+	waitForCount(t, 1, func() (string, int) {
+		sub.RLock()
+		defer sub.RUnlock()
+		return "ack pending", len(sub.acksPending)
+	})
+
+	// Closing the last member keeps the group, with its position and its
+	// unacknowledged message.
+	closeMember("member2")
+	states, err := s.SubscriptionsState("foo", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(states) != 1 || !states[0].Offline || states[0].LastSent != 2 || states[0].PendingAcks != 1 {
+		t.Fatalf("Unexpected states: %+v", states)
+	}
+	if err := conns[0].Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	_, ch3 := durableQueueMember(t, conns[2], nil, stan.DeliverAllAvailable())
+	checkDurableQueueMsgs(t, ch3, "2:true", "3:false")
+}
+
+func TestDurableQueueDistinctFromQueue(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	var mu sync.Mutex
+	received := make(map[string]int)
+	cb := func(name string) stan.MsgHandler {
+		return func(m *stan.Msg) {
+			mu.Lock()
+			received[name]++
+			mu.Unlock()
+		}
+	}
+	if _, err := sc.QueueSubscribe("foo", "group", cb("queue")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if _, err := sc.QueueSubscribe("foo", "group", cb("durable"), stan.DurableName("dur")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	waitForCount(t, 2, func() (string, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		return "messages", received["queue"] + received["durable"]
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if received["queue"] != 1 || received["durable"] != 1 {
+		t.Fatalf("Each group should get the message: %v", received)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+func getTestEncryptedFileStoreOpts() *Options {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.StoreType = stores.TypeFile
+	opts.FilestoreDir = defaultDataStore
+	opts.Encrypt = true
+	return opts
+}
+
+func TestValidateEncryption(t *testing.T) {
+	os.Unsetenv(EncryptionKeyEnv)
+	opts := getTestEncryptedFileStoreOpts()
+	if err := validateEncryption(opts); err != ErrNoEncryptionKey {
+		t.Fatalf("Expected error %v, got %v", ErrNoEncryptionKey, err)
+	}
+	opts.EncryptionKey = util.NewSecret("key")
+	if err := validateEncryption(opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	opts.StoreType = stores.TypeMemory
+	if err := validateEncryption(opts); err == nil || !strings.Contains(err.Error(), "only supported") {
+		t.Fatalf("Expected error for memory store, got %v", err)
+	}
+	opts.Encrypt = false
+	if err := validateEncryption(opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestEncryptedFileStoreRecovery(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	opts := getTestEncryptedFileStoreOpts()
+	opts.EncryptionKey = util.NewSecret("key")
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	sc.Close()
+	s.Shutdown()
+
+	// Restart with the key from the environment.
+	os.Setenv(EncryptionKeyEnv, "key")
+	defer os.Unsetenv(EncryptionKeyEnv)
+	opts = getTestEncryptedFileStoreOpts()
+	s = runServerWithOpts(opts)
+
+	sc = NewDefaultConnection(t)
+	defer sc.Close()
+	msgs := make(chan *stan.Msg, 1)
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) {
+		msgs <- m
+	}, stan.DeliverAllAvailable()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	select {
+	case m := <-msgs:
+		if string(m.Data) != "hello" {
+			t.Fatalf("Unexpected message: %q", m.Data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Did not get our message")
+	}
+	sc.Close()
+	s.Shutdown()
+
+	// Restarting with the wrong key fails.
+	os.Setenv(EncryptionKeyEnv, "wrong")
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("Expected server to fail to start")
+		}
+	}()
+	s = runServerWithOpts(getTestEncryptedFileStoreOpts())
+}
+
+func TestEncryptionNotSupportedByMemoryStore(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.Encrypt = true
+	opts.EncryptionKey = util.NewSecret("key")
+	defer func() {
+		r := recover()
+		if r == nil || !strings.Contains(r.(string), "only supported") {
+			t.Fatalf("Expected server to fail to start, got %v", r)
+		}
+	}()
+	s := runServerWithOpts(opts)
+	s.Shutdown()
+}
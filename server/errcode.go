@@ -0,0 +1,84 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"strings"
+
+	"github.com/nats-io/nats-streaming-server/errcode"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+// errorCodes maps the messages of the errors returned to clients to
+// their code.
+var errorCodes = map[string]errcode.Code{
+	ErrInvalidSubject.Error():             errcode.InvalidRequest,
+	ErrInvalidSequence.Error():            errcode.InvalidRequest,
+	ErrInvalidTime.Error():                errcode.InvalidRequest,
+	ErrUnknownStartGUID.Error():           errcode.InvalidRequest,
+	ErrInvalidSub.Error():                 errcode.InvalidRequest,
+	ErrInvalidAckWait.Error():             errcode.InvalidRequest,
+	ErrInvalidMaxInFlight.Error():         errcode.InvalidRequest,
+	ErrInvalidReplayRate.Error():          errcode.InvalidRequest,
+	ErrInvalidFilter.Error():              errcode.InvalidRequest,
+	ErrFilteredQueueSub.Error():           errcode.InvalidRequest,
+	ErrInvalidConnReq.Error():             errcode.InvalidRequest,
+	ErrInvalidClientTags.Error():          errcode.InvalidRequest,
+	ErrInvalidPubReq.Error():              errcode.InvalidRequest,
+	ErrInvalidSubReq.Error():              errcode.InvalidRequest,
+	ErrInvalidUnsubReq.Error():            errcode.InvalidRequest,
+	ErrInvalidSubClose.Error():            errcode.InvalidRequest,
+	ErrInvalidCloseReq.Error():            errcode.InvalidRequest,
+	ErrMissingClientID.Error():            errcode.InvalidRequest,
+	ErrInvalidWildcardSub.Error():         errcode.InvalidRequest,
+	ErrOrderingGroupsDisabled.Error():     errcode.InvalidRequest,
+	ErrContentTypeNotAllowed.Error():      errcode.InvalidRequest,
+	ErrInvalidQueuePolicy.Error():         errcode.InvalidRequest,
+	ErrQueuePolicyMismatch.Error():        errcode.InvalidRequest,
+	ErrArchiveReadOnly.Error():            errcode.InvalidRequest,
+	ErrArchiveReplayOnly.Error():          errcode.InvalidRequest,
+	ErrExclusiveQueueSub.Error():          errcode.InvalidRequest,
+	ErrInvalidSubBatchReq.Error():         errcode.InvalidRequest,
+	ErrWildcardSubBatch.Error():           errcode.InvalidRequest,
+	ErrInvalidFlushReq.Error():            errcode.InvalidRequest,
+	ErrInvalidClaimReq.Error():            errcode.InvalidRequest,
+	ErrNotPending.Error():                 errcode.InvalidRequest,
+	ErrInvalidPauseReq.Error():            errcode.InvalidRequest,
+	ErrPauseQueueSub.Error():              errcode.InvalidRequest,
+	ErrInvalidPingReq.Error():             errcode.InvalidRequest,
+	stores.ErrTooManyChannels.Error():     errcode.LimitExceeded,
+	stores.ErrTooManySubs.Error():         errcode.LimitExceeded,
+	ErrTooManyConnClients.Error():         errcode.LimitExceeded,
+	ErrTooManyConnChannels.Error():        errcode.LimitExceeded,
+	ErrTooManyClients.Error():             errcode.LimitExceeded,
+	ErrTooManyClientSubs.Error():          errcode.LimitExceeded,
+	ErrTooManyOrderingGroups.Error():      errcode.LimitExceeded,
+	ErrRecovering.Error():                 errcode.ServerBusy,
+	ErrOverloaded.Error():                 errcode.ServerBusy,
+	ErrSubRateExceeded.Error():            errcode.ServerBusy,
+	ErrPubRateExceeded.Error():            errcode.ServerBusy,
+	ErrTooManyPubsInFlight.Error():        errcode.ServerBusy,
+	ErrDraining.Error():                   errcode.ServerUnavailable,
+	ErrPlacementViolation.Error():         errcode.ServerUnavailable,
+	stores.ErrChannelNotRecovered.Error(): errcode.ServerUnavailable,
+	ErrUnknownClient.Error():              errcode.UnknownClient,
+	ErrInvalidClient.Error():              errcode.DuplicateClientID,
+	ErrDupDurable.Error():                 errcode.DuplicateDurable,
+	ErrNotAuthorized.Error():              errcode.NotAuthorized,
+}
+
+// errorCode returns the code of an error returned to a client. Errors
+// suggesting a retry delay have the code of the error they carry.
+func errorCode(err error) errcode.Code {
+	if err == nil {
+		return errcode.OK
+	}
+	msg := err.Error()
+	if idx := strings.LastIndex(msg, retryAfterSep); idx != -1 {
+		msg = msg[:idx]
+	}
+	if code, ok := errorCodes[msg]; ok {
+		return code
+	}
+	return errcode.Unknown
+}
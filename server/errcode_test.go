@@ -0,0 +1,131 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/errcode"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+func TestErrorCodesInResponses(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.MaxSubscriptions = 1
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	request := func(subj string, data []byte, resp response) {
+		reply, err := nc.Request(subj, data, 5*time.Second)
+		if err != nil {
+			stackFatalf(t, "Unexpected error on request: %v", err)
+		}
+		if err := resp.Unmarshal(reply.Data); err != nil {
+			stackFatalf(t, "Unexpected error on unmarshal: %v", err)
+		}
+	}
+	checkCode := func(code int32, expected errcode.Code) {
+		if errcode.Code(code) != expected {
+			stackFatalf(t, "Expected code %v, got %v", expected, errcode.Code(code))
+		}
+	}
+
+	// Malformed requests
+	connSubj := fmt.Sprintf("%s.%s", s.opts.DiscoverPrefix, clusterName)
+	cr := &spb.ConnectResponse{}
+	request(connSubj, []byte("dummy"), cr)
+	checkCode(cr.ErrorCode, errcode.InvalidRequest)
+	pa := &spb.PubAck{}
+	request(s.info.Publish+".foo", []byte("dummy"), pa)
+	checkCode(pa.ErrorCode, errcode.InvalidRequest)
+	sr := &spb.SubscriptionResponse{}
+	request(s.info.Subscribe, []byte("dummy"), sr)
+	checkCode(sr.ErrorCode, errcode.InvalidRequest)
+	fr := &spb.FlushResponse{}
+	request(s.flushSubject(), []byte("dummy"), fr)
+	checkCode(fr.ErrorCode, errcode.InvalidRequest)
+	clr := &spb.ClaimResponse{}
+	request(s.claimSubject(), []byte("dummy"), clr)
+	checkCode(clr.ErrorCode, errcode.InvalidRequest)
+	pr := &spb.PauseResponse{}
+	request(s.pauseSubject(), []byte("dummy"), pr)
+	checkCode(pr.ErrorCode, errcode.InvalidRequest)
+	sbr := &spb.SubscriptionBatchResponse{}
+	request(s.subBatchSubject(), []byte("dummy"), sbr)
+	checkCode(sbr.ErrorCode, errcode.InvalidRequest)
+	pir := &spb.PingResponse{}
+	request(s.pingSubject(), []byte("dummy"), pir)
+	checkCode(pir.ErrorCode, errcode.InvalidRequest)
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	// Duplicate client ID, the registered client answering heartbeats.
+	b, _ := (&spb.ConnectRequest{ClientID: clientName, HeartbeatInbox: nats.NewInbox()}).Marshal()
+	cr = &spb.ConnectResponse{}
+	request(connSubj, b, cr)
+	if cr.Error != ErrInvalidClient.Error() {
+		t.Fatalf("Expected error %v, got %q", ErrInvalidClient, cr.Error)
+	}
+	checkCode(cr.ErrorCode, errcode.DuplicateClientID)
+
+	// Subscriptions limit
+	subReq := &spb.SubscriptionRequest{
+		ClientID:      clientName,
+		Subject:       "foo",
+		Inbox:         nats.NewInbox(),
+		MaxInFlight:   10,
+		AckWaitInSecs: 30,
+	}
+	b, _ = subReq.Marshal()
+	sr = &spb.SubscriptionResponse{}
+	request(s.info.Subscribe, b, sr)
+	checkCode(sr.ErrorCode, errcode.OK)
+	sr = &spb.SubscriptionResponse{}
+	request(s.info.Subscribe, b, sr)
+	if sr.Error != stores.ErrTooManySubs.Error() {
+		t.Fatalf("Expected error %v, got %q", stores.ErrTooManySubs, sr.Error)
+	}
+	checkCode(sr.ErrorCode, errcode.LimitExceeded)
+
+	// Unknown client
+	b, _ = (&pb.CloseRequest{ClientID: "unknown"}).Marshal()
+	closeResp := &spb.CloseResponse{}
+	request(s.info.Close, b, closeResp)
+	checkCode(closeResp.ErrorCode, errcode.UnknownClient)
+	b, _ = (&spb.PingRequest{ClientID: "unknown"}).Marshal()
+	pir = &spb.PingResponse{}
+	request(s.pingSubject(), b, pir)
+	checkCode(pir.ErrorCode, errcode.UnknownClient)
+}
+
+func TestErrorCode(t *testing.T) {
+	cases := []struct {
+		err  error
+		code errcode.Code
+	}{
+		{nil, errcode.OK},
+		{ErrInvalidSubject, errcode.InvalidRequest},
+		{ErrDraining, errcode.ServerUnavailable},
+		{retryAfterErr(ErrPubRateExceeded, time.Second), errcode.ServerBusy},
+		{errors.New("stan: store failure"), errcode.Unknown},
+	}
+	for _, c := range cases {
+		if code := errorCode(c.err); code != c.code {
+			t.Fatalf("Expected code %v for %v, got %v", c.code, c.err, code)
+		}
+	}
+}
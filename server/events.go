@@ -0,0 +1,62 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// DefaultEventsPrefix is the prefix of the subjects on which the server
+// publishes system events. The cluster ID is appended to it.
+const DefaultEventsPrefix = "_STAN.events"
+
+// Reasons of the closing of a client connection, in ClientEvent.Reason
+const (
+	ClientCloseRequested = "close"             // The client closed its connection
+	ClientCloseHBTimeout = "heartbeat_timeout" // The client did not answer the heartbeats of the server
+	ClientCloseReplaced  = "replaced"          // A connection with the same client ID replaced the client
+	ClientCloseAdmin     = "admin"             // An administrator disconnected the client
+	ClientCloseSlowSub   = "slow_consumer"     // One of the subscriptions of the client was a slow consumer
+)
+
+// ClientEvent is published, as JSON, on the
+// `_STAN.events.<cluster ID>.client.connected` and
+// `_STAN.events.<cluster ID>.client.disconnected` subjects when
+// Options.ClientEvents is set.
+type ClientEvent struct {
+	ClientID string    `json:"client_id"`
+	HbInbox  string    `json:"hb_inbox"`
+	Time     time.Time `json:"time"`
+	Reason   string    `json:"reason,omitempty"` // Why the client was disconnected
+	Detail   string    `json:"detail,omitempty"` // Reason given by the administrator who disconnected the client
+}
+
+// clientEventsSubject returns the subject on which the given client event
+// is published.
+func (s *StanServer) clientEventsSubject(event string) string {
+	return fmt.Sprintf("%s.%s.client.%s", DefaultEventsPrefix, s.info.ClusterID, event)
+}
+
+// publishClientEvent publishes the connection, or the disconnection if
+// reason is not empty, of the client.
+func (s *StanServer) publishClientEvent(clientID, hbInbox, reason, detail string) {
+	if !s.opts.ClientEvents {
+		return
+	}
+	event := "connected"
+	if reason != "" {
+		event = "disconnected"
+	}
+	b, _ := json.Marshal(&ClientEvent{
+		ClientID: clientID,
+		HbInbox:  hbInbox,
+		Time:     s.clock.Now(),
+		Reason:   reason,
+		Detail:   detail,
+	})
+	if err := s.nc.Publish(s.clientEventsSubject(event), b); err != nil {
+		s.log.Errorf("STAN: [Client:%s] Unable to publish %s event: %v", clientID, event, err)
+	}
+}
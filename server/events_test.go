@@ -0,0 +1,135 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats"
+)
+
+// subscribeClientEvents returns the channel receiving the client events
+// published by the server.
+func subscribeClientEvents(t *testing.T, nc *nats.Conn) chan *nats.Msg {
+	ch := make(chan *nats.Msg, 10)
+	if _, err := nc.ChanSubscribe(DefaultEventsPrefix+"."+clusterName+".client.>", ch); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatalf("Unexpected error on flush: %v", err)
+	}
+	return ch
+}
+
+func checkClientEvent(t *testing.T, ch chan *nats.Msg, event, reason, detail string) {
+	select {
+	case m := <-ch:
+		ce := &ClientEvent{}
+		if err := json.Unmarshal(m.Data, ce); err != nil {
+			stackFatalf(t, "Unexpected error: %v", err)
+		}
+		if m.Subject != DefaultEventsPrefix+"."+clusterName+".client."+event ||
+			ce.ClientID != clientName || ce.HbInbox == "" || ce.Time.IsZero() ||
+			ce.Reason != reason || ce.Detail != detail {
+			stackFatalf(t, "Unexpected event on %v: %+v", m.Subject, ce)
+		}
+	case <-time.After(5 * time.Second):
+		stackFatalf(t, "Did not get the %v event", event)
+	}
+}
+
+func TestClientEvents(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.ClientEvents = true
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+	s.dupCIDTimeout = 250 * time.Millisecond
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+	ch := subscribeClientEvents(t, nc)
+
+	sc := NewDefaultConnection(t)
+	checkClientEvent(t, ch, "connected", "", "")
+	sc.Close()
+	checkClientEvent(t, ch, "disconnected", ClientCloseRequested, "")
+
+	sc = NewDefaultConnection(t)
+	checkClientEvent(t, ch, "connected", "", "")
+	if err := s.DisconnectClient(clientName, "maintenance"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkClientEvent(t, ch, "disconnected", ClientCloseAdmin, "maintenance")
+	sc.Close()
+
+	// A client that does not answer is replaced.
+	cnc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	if _, err := stan.Connect(clusterName, clientName, stan.NatsConn(cnc)); err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	checkClientEvent(t, ch, "connected", "", "")
+	cnc.Close()
+	sc = NewDefaultConnection(t)
+	defer sc.Close()
+	checkClientEvent(t, ch, "disconnected", ClientCloseReplaced, "")
+	checkClientEvent(t, ch, "connected", "", "")
+}
+
+func TestClientEventsHBTimeout(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.ClientEvents = true
+	opts.ClientHBInterval = 50 * time.Millisecond
+	opts.ClientHBTimeout = 10 * time.Millisecond
+	opts.ClientHBFailCount = 1
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+	ch := subscribeClientEvents(t, nc)
+
+	cnc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	if _, err := stan.Connect(clusterName, clientName, stan.NatsConn(cnc)); err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	checkClientEvent(t, ch, "connected", "", "")
+	cnc.Close()
+	checkClientEvent(t, ch, "disconnected", ClientCloseHBTimeout, "")
+}
+
+func TestClientEventsDisabledByDefault(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+	ch := subscribeClientEvents(t, nc)
+
+	sc := NewDefaultConnection(t)
+	sc.Close()
+	select {
+	case m := <-ch:
+		t.Fatalf("Unexpected event: %s", m.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
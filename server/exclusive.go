@@ -0,0 +1,104 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+// ErrExclusiveQueueSub is returned to queue subscription requests on
+// exclusive channels.
+var ErrExclusiveQueueSub = errors.New("stan: queue subscriptions are not allowed on exclusive channels")
+
+// isExclusiveChannel returns true if the channel matches one of the
+// patterns of Options.ExclusiveChannels.
+func isExclusiveChannel(patterns []string, channel string) bool {
+	for _, pattern := range patterns {
+		if util.SubjectMatches(pattern, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateExclusiveChannels checks that the patterns of the exclusive
+// channels are valid subjects.
+func validateExclusiveChannels(patterns []string) error {
+	for _, pattern := range patterns {
+		if !util.IsValidSubjectPattern(pattern) {
+			return fmt.Errorf("invalid exclusive channel pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// electExclusiveConsumer makes sure that, on an exclusive channel, a single
+// subscription of a connected client receives messages, the others standing
+// by in the order they subscribed. If none is active, the oldest standby is
+// promoted and returned. When it takes over from a removed consumer
+// (handover), it continues after `lastSent`, so that the messages that were
+// not acknowledged are sent again, in order.
+// Assumes ss lock held.
+func (ss *subStore) electExclusiveConsumer(handover bool, lastSent uint64) *subState {
+	if !ss.exclusive {
+		return nil
+	}
+	var active *subState
+	for _, sub := range ss.psubs {
+		sub.Lock()
+		if sub.ClientID != "" {
+			if active == nil && !sub.standby {
+				active = sub
+			} else {
+				sub.standby = true
+			}
+		}
+		sub.Unlock()
+	}
+	if active != nil {
+		return nil
+	}
+	for _, sub := range ss.psubs {
+		sub.Lock()
+		online := sub.ClientID != ""
+		if online {
+			sub.standby = false
+			if handover {
+				sub.LastSent = lastSent
+			}
+			ss.stan.log.Debugf("STAN: [Client:%s] Subscription promoted to exclusive consumer of %s", sub.ClientID, sub.subject)
+		}
+		sub.Unlock()
+		if online {
+			return sub
+		}
+	}
+	return nil
+}
+
+// exclusiveHandover returns the sequence after which the subscription
+// replacing this exclusive consumer starts: the one before its first message
+// pending acknowledgment, or the last one sent to it.
+// Lock held on entry.
+func (sub *subState) exclusiveHandover() uint64 {
+	lastSent := sub.LastSent
+	for seq := range sub.acksPending {
+		if seq <= lastSent {
+			lastSent = seq - 1
+		}
+	}
+	return lastSent
+}
+
+// startExclusiveConsumer sends the available messages to the standby
+// subscription promoted when the consumer of an exclusive channel is
+// removed, if any.
+func (s *StanServer) startExclusiveConsumer(cs *stores.ChannelStore, promoted *subState) {
+	if promoted != nil {
+		s.sendAvailableMessages(cs, promoted)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/nats-io/go-nats-streaming"
+)
+
+func TestExclusiveChannelFailover(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.ExclusiveChannels = []string{"orders.>"}
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	sc2, err := stan.Connect(clusterName, "standby")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer sc2.Close()
+
+	msgs := make(chan *stan.Msg, 10)
+	// The consumer acknowledges only the first message.
+	sub, err := sc.Subscribe("orders.eu", func(m *stan.Msg) {
+		if m.Sequence == 1 {
+			m.Ack()
+		}
+		msgs <- m
+	}, stan.SetManualAckMode())
+	if err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	standbyMsgs := make(chan *stan.Msg, 10)
+	if _, err := sc2.Subscribe("orders.eu", func(m *stan.Msg) { standbyMsgs <- m },
+		stan.StartWithLastReceived()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	states, _ := s.SubscriptionsState("orders.eu", "standby")
+	if len(states) != 1 || !states[0].Standby {
+		t.Fatalf("Expected a standby subscription, got %+v", states)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := sc.Publish("orders.eu", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	for seq := uint64(1); seq <= 3; seq++ {
+		checkMsgSeq(t, msgs, seq)
+	}
+	checkNoMsg(t, standbyMsgs)
+
+	// The standby takes over from the first unacknowledged message,
+	// regardless of its start position.
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatalf("Unexpected error on unsubscribe: %v", err)
+	}
+	checkMsgSeq(t, standbyMsgs, 2)
+	checkMsgSeq(t, standbyMsgs, 3)
+	if err := sc.Publish("orders.eu", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	checkMsgSeq(t, standbyMsgs, 4)
+
+	// Other channels are not exclusive.
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if _, err := sc2.Subscribe("foo", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if states, _ := s.SubscriptionsState("foo", ""); len(states) != 2 || states[0].Standby || states[1].Standby {
+		t.Fatalf("Unexpected subscriptions: %+v", states)
+	}
+}
+
+func TestExclusiveChannelFailoverOnClose(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.ExclusiveChannels = []string{"foo"}
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	sc2, err := stan.Connect(clusterName, "standby")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer sc2.Close()
+
+	// The consumer never acknowledges its messages.
+	consumerMsgs := make(chan *stan.Msg, 10)
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) { consumerMsgs <- m },
+		stan.SetManualAckMode()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	msgs := make(chan *stan.Msg, 10)
+	if _, err := sc2.Subscribe("foo", func(m *stan.Msg) { msgs <- m }); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	checkMsgSeq(t, consumerMsgs, 1)
+	checkNoMsg(t, msgs)
+
+	// Closing the consumer's connection promotes the standby.
+	sc.Close()
+	checkMsgSeq(t, msgs, 1)
+	if err := sc2.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	checkMsgSeq(t, msgs, 2)
+}
+
+func TestExclusiveChannelRejectsQueueSubs(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.ExclusiveChannels = []string{"foo"}
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	if _, err := sc.QueueSubscribe("foo", "group", func(_ *stan.Msg) {}); err == nil || err.Error() != ErrExclusiveQueueSub.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrExclusiveQueueSub, err)
+	}
+	if _, err := sc.QueueSubscribe("bar", "group", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+}
+
+func TestValidateExclusiveChannels(t *testing.T) {
+	if err := validateExclusiveChannels([]string{"foo", "orders.>", "*.eu"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := validateExclusiveChannels([]string{"foo..bar"}); err == nil {
+		t.Fatal("Expected error for invalid pattern")
+	}
+}
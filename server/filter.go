@@ -0,0 +1,250 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// Errors returned for the filters of subscription requests.
+var (
+	ErrInvalidFilter    = errors.New("stan: invalid filter expression")
+	ErrFilteredQueueSub = errors.New("stan: queue subscriptions can't be filtered")
+)
+
+// Operators of the filter terms.
+const (
+	filterHas      = "has"
+	filterHasNot   = "!"
+	filterEqual    = "=="
+	filterNotEqual = "!="
+	filterContains = "contains"
+	filterPrefix   = "prefix"
+)
+
+// msgFilter selects the messages sent to a subscription, set by the Filter
+// field of the request creating or resuming it. A filter is made of terms
+// on the headers and payload of the messages, combined with `&&` and `||`
+// (which binds less tightly):
+//
+//	header.<key>                 the message has the header
+//	!header.<key>                the message doesn't have the header
+//	header.<key> == "<value>"    the header has this value
+//	header.<key> != "<value>"    the header is missing or has another value
+//	data contains "<value>"      the payload contains the value
+//	data prefix "<value>"        the payload starts with the value
+//
+// Values are double quoted Go strings.
+type msgFilter struct {
+	any [][]filterTerm // a message matches if all the terms of any group match
+}
+
+// filterTerm is a condition on the header `header`, or on the payload if
+// `header` is empty.
+type filterTerm struct {
+	header string
+	op     string
+	value  string
+}
+
+// filterToken is a token of a filter expression: an operator, an
+// identifier, or the unquoted value of a string.
+type filterToken struct {
+	text   string
+	str    bool
+	offset int
+}
+
+// newMsgFilter returns the filter of the subscription request, nil if it
+// has none. The filter was checked by validateSubRequest.
+func newMsgFilter(sr *spb.SubscriptionRequest) *msgFilter {
+	f, _ := parseFilter(sr.Filter)
+	return f
+}
+
+// parseFilter parses a filter expression, returning nil if it is empty.
+func parseFilter(expr string) (*msgFilter, error) {
+	tokens, err := tokenizeFilter(expr)
+	if err != nil || len(tokens) == 0 {
+		return nil, err
+	}
+	f := &msgFilter{}
+	var all []filterTerm
+	for i := 0; ; i++ {
+		t, n, err := parseFilterTerm(tokens[i:])
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, t)
+		i += n
+		if i == len(tokens) {
+			f.any = append(f.any, all)
+			return f, nil
+		}
+		switch tok := tokens[i]; {
+		case tok.str:
+			return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.offset)
+		case tok.text == "||":
+			f.any = append(f.any, all)
+			all = nil
+		case tok.text != "&&":
+			return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.offset)
+		}
+		if i == len(tokens)-1 {
+			return nil, fmt.Errorf("missing term after %q", tokens[i].text)
+		}
+	}
+}
+
+// parseFilterTerm parses the term at the start of the tokens, and returns
+// the number of tokens it is made of.
+func parseFilterTerm(tokens []filterToken) (filterTerm, int, error) {
+	// Returns true if the token at index i is one of the operators or
+	// identifiers `text`.
+	isWord := func(i int, text ...string) bool {
+		if i >= len(tokens) || tokens[i].str {
+			return false
+		}
+		for _, t := range text {
+			if tokens[i].text == t {
+				return true
+			}
+		}
+		return false
+	}
+	isStr := func(i int) bool {
+		return i < len(tokens) && tokens[i].str
+	}
+	header := func(i int) string {
+		if i >= len(tokens) || tokens[i].str || !strings.HasPrefix(tokens[i].text, "header.") {
+			return ""
+		}
+		if key := tokens[i].text[len("header."):]; headerKeyRegEx.MatchString(key) {
+			return key
+		}
+		return ""
+	}
+
+	switch {
+	case isWord(0, filterHasNot) && header(1) != "":
+		return filterTerm{header: header(1), op: filterHasNot}, 2, nil
+	case header(0) != "" && isWord(1, filterEqual, filterNotEqual) && isStr(2):
+		return filterTerm{header: header(0), op: tokens[1].text, value: tokens[2].text}, 3, nil
+	case header(0) != "" && !isWord(1, filterEqual, filterNotEqual):
+		return filterTerm{header: header(0), op: filterHas}, 1, nil
+	case isWord(0, "data") && isWord(1, filterContains, filterPrefix) && isStr(2):
+		return filterTerm{op: tokens[1].text, value: tokens[2].text}, 3, nil
+	}
+	return filterTerm{}, 0, fmt.Errorf("unsupported term %q", tokens[0].text)
+}
+
+// tokenizeFilter splits a filter expression into tokens.
+func tokenizeFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"':
+			end := i + 1
+			for ; end < len(expr) && expr[end] != '"'; end++ {
+				if expr[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(expr) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			value, err := strconv.Unquote(expr[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at offset %d: %v", i, err)
+			}
+			tokens = append(tokens, filterToken{text: value, str: true, offset: i})
+			i = end + 1
+		case strings.HasPrefix(expr[i:], "&&") || strings.HasPrefix(expr[i:], "||") ||
+			strings.HasPrefix(expr[i:], "==") || strings.HasPrefix(expr[i:], "!="):
+			tokens = append(tokens, filterToken{text: expr[i : i+2], offset: i})
+			i += 2
+		case c == '!':
+			tokens = append(tokens, filterToken{text: "!", offset: i})
+			i++
+		case isFilterIdentChar(c):
+			end := i + 1
+			for end < len(expr) && isFilterIdentChar(expr[end]) {
+				end++
+			}
+			tokens = append(tokens, filterToken{text: expr[i:end], offset: i})
+			i = end
+		default:
+			return nil, fmt.Errorf("unexpected %q at offset %d", string(c), i)
+		}
+	}
+	return tokens, nil
+}
+
+// isFilterIdentChar returns true if c can be part of an identifier, which
+// includes the characters allowed in header keys.
+func isFilterIdentChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+		c == '_' || c == '.' || c == '-'
+}
+
+// match returns true if the message passes the filter. A nil filter lets
+// all messages pass.
+func (f *msgFilter) match(m *spb.MsgProto) bool {
+	if f == nil {
+		return true
+	}
+	for _, all := range f.any {
+		matched := true
+		for i := range all {
+			if !all[i].match(m) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns true if the message satisfies the term.
+func (t *filterTerm) match(m *spb.MsgProto) bool {
+	switch t.op {
+	case filterContains:
+		return bytes.Contains(m.Data, []byte(t.value))
+	case filterPrefix:
+		return bytes.HasPrefix(m.Data, []byte(t.value))
+	}
+	v, ok := m.Headers[t.header]
+	switch t.op {
+	case filterHas:
+		return ok
+	case filterHasNot:
+		return !ok
+	case filterEqual:
+		return ok && v == t.value
+	case filterNotEqual:
+		return !ok || v != t.value
+	}
+	return false
+}
+
+// skipFiltered skips the message, which the subscription's filter doesn't
+// let pass. The message is neither sent nor pending, and is skipped again
+// if a durable is recovered from the store before it. Sub lock held on
+// entry.
+func (sub *subState) skipFiltered(m *spb.MsgProto) {
+	if m.Sequence > sub.LastSent {
+		sub.LastSent = m.Sequence
+	}
+}
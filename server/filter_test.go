@@ -0,0 +1,133 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestFilterParse(t *testing.T) {
+	msg := &spb.MsgProto{Data: []byte("order created"), Headers: map[string]string{"type": "order", "region": "eu"}}
+	matches := map[string]bool{
+		``:                            true,
+		`header.type`:                 true,
+		`!header.type`:                false,
+		`header.missing`:              false,
+		`!header.missing`:             true,
+		`header.type == "order"`:      true,
+		`header.type == "payment"`:    false,
+		`header.type != "payment"`:    true,
+		`header.missing != "payment"`: true,
+		`data contains "created"`:     true,
+		`data prefix "created"`:       false,
+		`data prefix "order"`:         true,
+		`header.type == "order" && header.region == "us"`:                      false,
+		`header.region == "us" || header.type == "order"`:                      true,
+		`header.region == "us" || header.type == "order" && data contains "x"`: false,
+		`header.region=="eu"&&data contains "\x6frder"`:                        true,
+	}
+	for expr, expected := range matches {
+		f, err := parseFilter(expr)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %q: %v", expr, err)
+		}
+		if f.match(msg) != expected {
+			t.Fatalf("Expected %q to match: %v", expr, expected)
+		}
+	}
+	for _, expr := range []string{
+		`header`,
+		`header.`,
+		`header.type ==`,
+		`header.type == order`,
+		`header.type == "order`,
+		`data == "x"`,
+		`data contains`,
+		`header.type &&`,
+		`|| header.type`,
+		`header.type "x"`,
+		`header.a b`,
+		`header.type > "x"`,
+	} {
+		if _, err := parseFilter(expr); err == nil {
+			t.Fatalf("Expected error parsing %q", expr)
+		}
+	}
+}
+
+func TestFilteredSubscription(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	for i := 0; i < 6; i++ {
+		headers := map[string]string{"type": "order"}
+		if i%3 == 0 {
+			headers["type"] = "payment"
+		}
+		publishWithHeaders(t, s, nc, "foo", headers)
+	}
+
+	raw := make(chan *nats.Msg, 10)
+	inbox := nats.NewInbox()
+	if _, err := nc.ChanSubscribe(inbox, raw); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	req := &spb.SubscriptionRequest{
+		ClientID:      clientName,
+		Subject:       "foo",
+		Inbox:         inbox,
+		MaxInFlight:   10,
+		AckWaitInSecs: 30,
+		StartPosition: spb.StartPosition_First,
+		Filter:        `header.type == "payment"`,
+	}
+	if resp := subscribeRaw(t, nc, s, req); resp.Error != "" {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+	// The messages keep their sequence.
+	check := func(seq uint64) {
+		select {
+		case m := <-raw:
+			msg := &spb.MsgProto{}
+			if err := msg.Unmarshal(m.Data); err != nil || msg.Sequence != seq {
+				stackFatalf(t, "Expected message %v, got %v (%v)", seq, msg, err)
+			}
+		case <-time.After(2 * time.Second):
+			stackFatalf(t, "Did not get message %v", seq)
+		}
+	}
+	check(1)
+	check(4)
+	publishWithHeaders(t, s, nc, "foo", map[string]string{"type": "order"})
+	publishWithHeaders(t, s, nc, "foo", map[string]string{"type": "payment"})
+	check(8)
+	select {
+	case m := <-raw:
+		t.Fatalf("Unexpected message: %v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Invalid filters and filtered queue subscriptions are rejected.
+	req.Inbox = nats.NewInbox()
+	req.Filter = `header.type ==`
+	if resp := subscribeRaw(t, nc, s, req); resp.Error != ErrInvalidFilter.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidFilter, resp.Error)
+	}
+	req.Filter = `header.type`
+	req.QGroup = "group"
+	if resp := subscribeRaw(t, nc, s, req); resp.Error != ErrFilteredQueueSub.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrFilteredQueueSub, resp.Error)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+const (
+	// Backoff between failed attempts to forward a message.
+	forwardMinBackoff = 100 * time.Millisecond
+	forwardMaxBackoff = 30 * time.Second
+
+	// Messages are forwarded one at a time, in order. The AckWait only
+	// matters if the server can't extend it with a claim.
+	forwardMaxInflight = 1
+	forwardAckWait     = 60 * time.Second
+)
+
+// ForwarderStats are the counters of a forwarder.
+type ForwarderStats struct {
+	Forwarded  uint64 // Messages forwarded
+	Failures   uint64 // Failed attempts to forward a message
+	DeadLetter uint64 // Messages moved to the dead-letter channel
+	Lag        uint64 // Messages of the channel not forwarded yet
+}
+
+// forwarder consumes the messages of a channel through a durable
+// subscription of an internal client and sends them to an external
+// system, such as a webhook. Messages are acked once sent. Failed sends
+// are retried with a backoff, and after maxRetries retries (if not 0),
+// the message is moved to the dead-letter channel.
+type forwarder struct {
+	sync.Mutex
+	name       string // used in logs
+	durable    string
+	s          *StanServer
+	client     *internalClient
+	channel    string
+	send       func(m *spb.MsgProto) error
+	sendWait   time.Duration // max duration of a send, used to claim messages during retries
+	maxRetries int
+	ackInbox   string
+	msgs       chan *spb.MsgProto
+	startSeq   uint64 // last sequence of the channel when the forwarder started
+	lastDone   uint64 // sequence of the last message forwarded, or moved to the dead-letter channel
+	stats      ForwarderStats
+	quit       chan struct{}
+}
+
+// start creates the durable subscription and starts forwarding messages.
+func (f *forwarder) start(wg *sync.WaitGroup) error {
+	// Leave room for redeliveries while a message is retried.
+	f.msgs = make(chan *spb.MsgProto, 16)
+	if cs := f.s.store.LookupChannel(f.channel); cs != nil {
+		f.startSeq = cs.Msgs.LastSequence()
+	}
+	ackInbox, err := f.client.subscribe(f.channel, f.durable, forwardMaxInflight, forwardAckWait, f.enqueue)
+	if err != nil {
+		return err
+	}
+	f.ackInbox = ackInbox
+	wg.Add(1)
+	go f.run(wg)
+	return nil
+}
+
+// enqueue is invoked for each message received on the subscription.
+func (f *forwarder) enqueue(m *spb.MsgProto) {
+	select {
+	case f.msgs <- m:
+	case <-f.quit:
+	}
+}
+
+func (f *forwarder) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case <-f.quit:
+			return
+		case m := <-f.msgs:
+			// A message may have been redelivered while it was retried.
+			if m.Sequence <= f.lastDone {
+				continue
+			}
+			if f.forward(m) {
+				f.Lock()
+				f.lastDone = m.Sequence
+				f.Unlock()
+			}
+		}
+	}
+}
+
+// forward sends the message until it succeeds, or until the max retries
+// is reached, in which case the message is moved to the dead-letter
+// channel. Returns false if the server is shutdown first.
+func (f *forwarder) forward(m *spb.MsgProto) bool {
+	backoff := forwardMinBackoff
+	for attempt := 0; ; attempt++ {
+		err := f.send(m)
+		if err == nil {
+			f.client.ack(f.ackInbox, m)
+			f.Lock()
+			f.stats.Forwarded++
+			f.Unlock()
+			return true
+		}
+		f.Lock()
+		f.stats.Failures++
+		f.Unlock()
+		if f.maxRetries > 0 && attempt >= f.maxRetries {
+			dlq := f.s.deadLetterChannel(m.Subject)
+			if err := f.client.publish(dlq, m.Data); err != nil {
+				f.s.log.Errorf("STAN: %s unable to move message %s:%v to %s: %v", f.name, m.Subject, m.Sequence, dlq, err)
+			} else {
+				f.s.log.Noticef("STAN: %s failed to forward message %s:%v after %v retries, moved to %s",
+					f.name, m.Subject, m.Sequence, attempt, dlq)
+				f.client.ack(f.ackInbox, m)
+				f.Lock()
+				f.stats.DeadLetter++
+				f.Unlock()
+				return true
+			}
+		} else {
+			f.s.log.Errorf("STAN: %s failed to forward message %s:%v, retrying in %v: %v",
+				f.name, m.Subject, m.Sequence, backoff, err)
+		}
+		// Make sure the message is not redelivered while waiting.
+		if err := f.client.claim(f.ackInbox, m, backoff+f.sendWait); err != nil {
+			f.s.log.Debugf("STAN: %s unable to claim message %s:%v: %v", f.name, m.Subject, m.Sequence, err)
+		}
+		select {
+		case <-f.quit:
+			return false
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > forwardMaxBackoff {
+			backoff = forwardMaxBackoff
+		}
+	}
+}
+
+// Stats returns the counters of the forwarder.
+func (f *forwarder) Stats() ForwarderStats {
+	f.Lock()
+	stats := f.stats
+	done := f.lastDone
+	f.Unlock()
+	if done < f.startSeq {
+		done = f.startSeq
+	}
+	if cs := f.s.store.LookupChannel(f.channel); cs != nil {
+		if last := cs.Msgs.LastSequence(); last > done {
+			stats.Lag = last - done
+		}
+	}
+	return stats
+}
@@ -0,0 +1,226 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nats-io/gnatsd/server"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+const (
+	// DefaultFTPrefix is the prefix of the subject on which the active
+	// server of a fault tolerance group sends its heartbeats.
+	DefaultFTPrefix = "_STAN.ft"
+
+	// DefaultFTFailoverWindow is the time a standby server waits without
+	// receiving heartbeats from the active server before taking over.
+	DefaultFTFailoverWindow = 5 * time.Second
+
+	// Number of heartbeats sent by the active server per failover window.
+	ftHBPerWindow = 5
+
+	// Name of the file, in the store directory, locked by the active server.
+	ftLockFileName = "ft.lck"
+)
+
+// ErrFTRequiresFileStore is returned when fault tolerance is configured
+// with a store that can't be shared between servers.
+var ErrFTRequiresFileStore = errors.New("stan: fault tolerance requires a FILE store")
+
+// State is the state of the server.
+type State int8
+
+const (
+	// Standalone is the state of a server not part of a fault tolerance group.
+	Standalone State = iota
+	// FTActive is the state of the server of a fault tolerance group
+	// that owns the store and serves clients.
+	FTActive
+	// FTStandby is the state of a server of a fault tolerance group
+	// waiting for the active server to fail.
+	FTStandby
+)
+
+func (s State) String() string {
+	switch s {
+	case Standalone:
+		return "STANDALONE"
+	case FTActive:
+		return "FT_ACTIVE"
+	case FTStandby:
+		return "FT_STANDBY"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// State returns the state of the server.
+func (s *StanServer) State() State {
+	s.RLock()
+	defer s.RUnlock()
+	return s.state
+}
+
+// validateFT checks the fault tolerance options for inconsistencies.
+func validateFT(opts *Options) error {
+	if opts.FTGroupName == "" {
+		return nil
+	}
+	if opts.FTFailoverWindow < 0 {
+		return fmt.Errorf("fault tolerance failover window can't be negative")
+	}
+	if strings.ContainsAny(opts.FTGroupName, ".*> \t") {
+		return fmt.Errorf("invalid fault tolerance group name %q", opts.FTGroupName)
+	}
+	if !strings.EqualFold(opts.StoreType, stores.TypeFile) {
+		return ErrFTRequiresFileStore
+	}
+	return nil
+}
+
+// ftSubject returns the subject of the heartbeats of the active server.
+func (s *StanServer) ftSubject() string {
+	return fmt.Sprintf("%s.%s.%s", DefaultFTPrefix, s.opts.FTGroupName, s.opts.ID)
+}
+
+// ftFailoverWindow returns the configured window, or the default one.
+func (s *StanServer) ftFailoverWindow() time.Duration {
+	if s.opts.FTFailoverWindow > 0 {
+		return s.opts.FTFailoverWindow
+	}
+	return DefaultFTFailoverWindow
+}
+
+// ftStart subscribes to the heartbeats of the active server and starts
+// the go routine that will activate this server once the active server
+// is gone. The NATS connection must have been created.
+func (s *StanServer) ftStart(nOpts *server.Options) {
+	s.state = FTStandby
+	s.ftQuit = make(chan struct{})
+	s.ftHBCh = make(chan struct{}, 1)
+	if _, err := s.nc.Subscribe(s.ftSubject(), s.processFTHeartbeat); err != nil {
+		panic(fmt.Sprintf("Could not subscribe to subject %s, %v\n", s.ftSubject(), err))
+	}
+	if _, err := s.nc.Subscribe(s.ftDrillSubject(), s.processFTDrill); err != nil {
+		panic(fmt.Sprintf("Could not subscribe to subject %s, %v\n", s.ftDrillSubject(), err))
+	}
+	if err := s.nc.Flush(); err != nil {
+		panic(fmt.Sprintf("Could not flush the subscriptions, %v\n", err))
+	}
+	s.log.Noticef("STAN: Starting in standby mode for fault tolerance group %q", s.opts.FTGroupName)
+	s.ftWG.Add(1)
+	go s.ftStandby(nOpts)
+}
+
+// processFTHeartbeat records the heartbeats of the active server.
+func (s *StanServer) processFTHeartbeat(m *nats.Msg) {
+	if string(m.Data) == s.serverID {
+		return
+	}
+	if s.State() == FTActive {
+		s.log.Errorf("STAN: Received heartbeat from server %q which is also active in fault tolerance group %q",
+			m.Data, s.opts.FTGroupName)
+		return
+	}
+	s.discardFTDrill(string(m.Data))
+	select {
+	case s.ftHBCh <- struct{}{}:
+	default:
+	}
+}
+
+// ftStandby waits for the active server to be gone and for its lock on the
+// store to be released, then activates this server and sends heartbeats
+// until shutdown.
+func (s *StanServer) ftStandby(nOpts *server.Options) {
+	defer s.ftWG.Done()
+	lockFile := filepath.Join(s.opts.FilestoreDir, ftLockFileName)
+	if err := os.MkdirAll(s.opts.FilestoreDir, os.ModeDir+os.ModePerm); err != nil {
+		s.log.Errorf("STAN: Unable to create the store directory: %v", err)
+		go s.Shutdown()
+		return
+	}
+	for {
+		if !s.ftWaitForActiveToStop() {
+			return
+		}
+		lock, err := util.CreateLockFile(lockFile)
+		if err == nil {
+			s.Lock()
+			s.ftLock = lock
+			s.Unlock()
+			break
+		}
+		// The active server may still be running, and only its heartbeats
+		// are missing, so keep waiting.
+		s.log.Debugf("STAN: Unable to lock %q, keep waiting: %v", lockFile, err)
+	}
+	if !s.ftActivate(nOpts) {
+		return
+	}
+	t := time.NewTicker(s.ftFailoverWindow() / ftHBPerWindow)
+	defer t.Stop()
+	for {
+		s.nc.Publish(s.ftSubject(), []byte(s.serverID))
+		select {
+		case <-s.ftQuit:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// ftWaitForActiveToStop returns true when no heartbeat has been received
+// for the failover window, false if the server is shutdown.
+func (s *StanServer) ftWaitForActiveToStop() bool {
+	window := s.ftFailoverWindow()
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.ftQuit:
+			return false
+		case <-s.ftHBCh:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(window)
+		case <-timer.C:
+			return true
+		}
+	}
+}
+
+// ftActivate recovers the store and starts serving clients. Returns
+// false if the server is shutdown instead.
+func (s *StanServer) ftActivate(nOpts *server.Options) (ok bool) {
+	select {
+	case <-s.ftQuit:
+		return false
+	default:
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			s.log.Errorf("STAN: Unable to activate server: %v", r)
+			// Shutdown waits for this go routine to return.
+			go s.Shutdown()
+			ok = false
+		}
+	}()
+	s.log.Noticef("STAN: Server is now active in fault tolerance group %q", s.opts.FTGroupName)
+	s.start(nOpts)
+	s.Lock()
+	s.state = FTActive
+	s.Unlock()
+	s.checkFailoverDrill()
+	return true
+}
@@ -0,0 +1,152 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	natsdTest "github.com/nats-io/gnatsd/test"
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+func getTestFTOptions() *Options {
+	opts := GetDefaultOptions()
+	opts.StoreType = stores.TypeFile
+	opts.FilestoreDir = defaultDataStore
+	opts.NATSServerURL = nats.DefaultURL
+	opts.FTGroupName = "ft"
+	opts.FTFailoverWindow = 250 * time.Millisecond
+	return opts
+}
+
+func waitForState(t *testing.T, s *StanServer, expected State) {
+	timeout := time.Now().Add(5 * time.Second)
+	for time.Now().Before(timeout) {
+		if s.State() == expected {
+			return
+		}
+		time.Sleep(15 * time.Millisecond)
+	}
+	stackFatalf(t, "Expected server to be %v, got %v", expected, s.State())
+}
+
+func TestValidateFT(t *testing.T) {
+	opts := getTestFTOptions()
+	if err := validateFT(opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	opts.FTGroupName = "foo.bar"
+	if err := validateFT(opts); err == nil {
+		t.Fatal("Expected error for invalid group name")
+	}
+	opts.FTGroupName = "ft"
+	opts.FTFailoverWindow = -1
+	if err := validateFT(opts); err == nil {
+		t.Fatal("Expected error for negative failover window")
+	}
+	opts.FTFailoverWindow = 0
+	opts.StoreType = stores.TypeMemory
+	if err := validateFT(opts); err != ErrFTRequiresFileStore {
+		t.Fatalf("Expected error %q, got %v", ErrFTRequiresFileStore, err)
+	}
+}
+
+func TestFTRequiresFileStore(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.FTGroupName = "ft"
+	defer func() {
+		r := recover()
+		if r == nil || !strings.Contains(r.(string), ErrFTRequiresFileStore.Error()) {
+			t.Fatalf("Expected server to fail to start, got %v", r)
+		}
+	}()
+	s := runServerWithOpts(opts)
+	s.Shutdown()
+}
+
+func TestFTStandaloneState(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+	if state := s.State(); state != Standalone {
+		t.Fatalf("Expected server to be %v, got %v", Standalone, state)
+	}
+}
+
+func TestFTFailover(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	// Run a standalone NATS Server shared by both servers
+	ns := natsdTest.RunServer(nil)
+	defer ns.Shutdown()
+
+	s1 := runServerWithOpts(getTestFTOptions())
+	defer s1.Shutdown()
+	if state := s1.State(); state != FTStandby {
+		t.Fatalf("Expected server to start as %v, got %v", FTStandby, state)
+	}
+	// Without an active server, it should become active after the window.
+	waitForState(t, s1, FTActive)
+
+	s2 := runServerWithOpts(getTestFTOptions())
+	defer s2.Shutdown()
+	// Heartbeats of the active server keep the other one in standby.
+	time.Sleep(3 * getTestFTOptions().FTFailoverWindow)
+	if state := s2.State(); state != FTStandby {
+		t.Fatalf("Expected server to be %v, got %v", FTStandby, state)
+	}
+
+	sc := NewDefaultConnection(t)
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	sc.Close()
+
+	// The standby server takes over when the active one is gone,
+	// and recovers the messages from the shared store.
+	s1.Shutdown()
+	waitForState(t, s2, FTActive)
+
+	sc = NewDefaultConnection(t)
+	defer sc.Close()
+	ch := make(chan bool)
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) {
+		if string(m.Data) == "hello" {
+			ch <- true
+		}
+	}, stan.DeliverAllAvailable()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := Wait(ch); err != nil {
+		t.Fatal("Did not get the message recovered by the new active server")
+	}
+}
+
+func TestFTLockPreventsActivation(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	ns := natsdTest.RunServer(nil)
+	defer ns.Shutdown()
+
+	s1 := runServerWithOpts(getTestFTOptions())
+	defer s1.Shutdown()
+	waitForState(t, s1, FTActive)
+
+	// A server of another group does not receive the heartbeats of the
+	// active server, but can't take over since the store is locked.
+	opts := getTestFTOptions()
+	opts.FTGroupName = "other"
+	s2 := runServerWithOpts(opts)
+	defer s2.Shutdown()
+	time.Sleep(3 * opts.FTFailoverWindow)
+	if state := s2.State(); state != FTStandby {
+		t.Fatalf("Expected server to be %v, got %v", FTStandby, state)
+	}
+	s1.Shutdown()
+	waitForState(t, s2, FTActive)
+}
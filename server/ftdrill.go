@@ -0,0 +1,315 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats"
+)
+
+// Errors returned by failover drills
+var (
+	ErrFailoverDrillNotActive = errors.New("stan: failover drill requires the active server of a fault tolerance group")
+	ErrFailoverDrillNoStandby = errors.New("stan: no standby server answered the failover drill")
+	ErrNoFailoverDrillReport  = errors.New("stan: no failover drill report")
+)
+
+// FailoverDrillSnapshot is the state of the clients and subscriptions of
+// the active server when a failover drill demotes it. It is handed over to
+// the standby servers, and checked by the one promoted.
+type FailoverDrillSnapshot struct {
+	ServerID      string              `json:"server_id"` // ID of the demoted server
+	Standby       string              `json:"standby"`   // ID of the first standby server that received the snapshot
+	StartedAt     time.Time           `json:"started_at"`
+	Clients       []string            `json:"clients"`
+	Subscriptions []*FailoverDrillSub `json:"subscriptions"` // Subscriptions with messages pending acknowledgment
+}
+
+// FailoverDrillSub is a subscription with messages pending acknowledgment
+// when a failover drill demotes the active server.
+type FailoverDrillSub struct {
+	ClientID string   `json:"client_id"`
+	Channel  string   `json:"channel"`
+	ID       uint64   `json:"id"`
+	Pending  []uint64 `json:"pending"`
+}
+
+// FailoverDrillReport is the result of a failover drill, established by
+// the promoted server.
+type FailoverDrillReport struct {
+	DemotedServer      string        `json:"demoted_server"`
+	PromotedServer     string        `json:"promoted_server"`
+	StartedAt          time.Time     `json:"started_at"`
+	ActivatedAt        time.Time     `json:"activated_at"`
+	FailoverTime       time.Duration `json:"failover_time"` // From the start of the drill to the activation of the promoted server
+	Clients            int           `json:"clients"`
+	ReconnectedClients int           `json:"reconnected_clients"` // Clients answering the heartbeats of the promoted server
+	MissingClients     []string      `json:"missing_clients,omitempty"`
+	PendingAcks        int           `json:"pending_acks"`
+	LostPendingAcks    int           `json:"lost_pending_acks"` // Messages pending acknowledgment not recovered by the promoted server
+	Done               bool          `json:"done"`              // False while clients are checked
+	Passed             bool          `json:"passed"`            // No client is missing and no pending ack is lost
+}
+
+// failoverDrill is the state of a failover drill on a server of a fault
+// tolerance group.
+type failoverDrill struct {
+	sync.RWMutex
+	demoting bool                   // acks are dropped once the active server is being demoted
+	snapshot *FailoverDrillSnapshot // received by a standby server from the demoted one
+	report   *FailoverDrillReport   // established by the promoted server
+	demoted  chan struct{}          // closed once the server is stopped by a drill
+}
+
+// ftDrillSubject returns the subject on which the active server hands the
+// snapshot of a failover drill over to the standby servers.
+func (s *StanServer) ftDrillSubject() string {
+	return s.ftSubject() + ".drill"
+}
+
+// FailoverDrill rehearses a failover: this server, which must be the active
+// server of a fault tolerance group, hands over the state of its clients
+// and pending acks to the standby servers, then shuts down so that one of
+// them takes over. The server promoted checks that the clients reconnect
+// and that the pending acks are carried over, see FailoverDrillReport.
+func (s *StanServer) FailoverDrill() (*FailoverDrillSnapshot, error) {
+	snapshot, err := s.startFailoverDrill()
+	if err != nil {
+		return nil, err
+	}
+	s.demoteForDrill()
+	return snapshot, nil
+}
+
+// startFailoverDrill stops processing acks, so that the pending acks of the
+// snapshot are those in the store, and hands the snapshot over to the
+// standby servers. Acks are processed again if no standby server answers.
+func (s *StanServer) startFailoverDrill() (*FailoverDrillSnapshot, error) {
+	if s.State() != FTActive {
+		return nil, ErrFailoverDrillNotActive
+	}
+	// Wait for the acks being processed.
+	s.ftDrill.Lock()
+	if s.ftDrill.demoting {
+		s.ftDrill.Unlock()
+		return nil, ErrFailoverDrillNotActive
+	}
+	s.ftDrill.demoting = true
+	s.ftDrill.Unlock()
+
+	snapshot := s.failoverDrillSnapshot()
+	b, _ := json.Marshal(snapshot)
+	reply, err := s.nc.Request(s.ftDrillSubject(), b, s.ftFailoverWindow())
+	if err != nil {
+		s.ftDrill.Lock()
+		s.ftDrill.demoting = false
+		s.ftDrill.Unlock()
+		s.log.Errorf("STAN: Failover drill aborted: %v", ErrFailoverDrillNoStandby)
+		return nil, ErrFailoverDrillNoStandby
+	}
+	snapshot.Standby = string(reply.Data)
+	s.log.Noticef("STAN: Failover drill: demoting server, %v clients and %v subscriptions with pending acks handed over",
+		len(snapshot.Clients), len(snapshot.Subscriptions))
+	return snapshot, nil
+}
+
+// failoverDrillSnapshot returns the clients and the pending acks of their
+// subscriptions.
+func (s *StanServer) failoverDrillSnapshot() *FailoverDrillSnapshot {
+	snapshot := &FailoverDrillSnapshot{
+		ServerID:      s.serverID,
+		StartedAt:     s.clock.Now(),
+		Clients:       []string{},
+		Subscriptions: []*FailoverDrillSub{},
+	}
+	for clientID := range s.store.GetClients() {
+		snapshot.Clients = append(snapshot.Clients, clientID)
+		for _, sub := range s.clients.GetSubs(clientID) {
+			sub.RLock()
+			if len(sub.acksPending) > 0 {
+				ds := &FailoverDrillSub{ClientID: clientID, Channel: sub.subject, ID: sub.ID}
+				for seq := range sub.acksPending {
+					ds.Pending = append(ds.Pending, seq)
+				}
+				sort.Sort(sortedSequences(ds.Pending))
+				snapshot.Subscriptions = append(snapshot.Subscriptions, ds)
+			}
+			sub.RUnlock()
+		}
+	}
+	sort.Strings(snapshot.Clients)
+	return snapshot
+}
+
+type sortedSequences []uint64
+
+func (s sortedSequences) Len() int           { return len(s) }
+func (s sortedSequences) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sortedSequences) Less(i, j int) bool { return s[i] < s[j] }
+
+// demoteForDrill shuts the server down at the end of a failover drill.
+func (s *StanServer) demoteForDrill() {
+	s.Shutdown()
+	close(s.ftDrill.demoted)
+}
+
+// Demoted returns a channel closed once a failover drill has shut the
+// server down, so that the process can exit and be restarted as a standby.
+func (s *StanServer) Demoted() <-chan struct{} {
+	return s.ftDrill.demoted
+}
+
+// processFTDrill records the snapshot of a failover drill sent by the
+// active server.
+func (s *StanServer) processFTDrill(m *nats.Msg) {
+	if s.State() != FTStandby {
+		return
+	}
+	snapshot := &FailoverDrillSnapshot{}
+	if err := json.Unmarshal(m.Data, snapshot); err != nil {
+		s.log.Errorf("STAN: Invalid failover drill snapshot: %v", err)
+		return
+	}
+	s.ftDrill.Lock()
+	s.ftDrill.snapshot = snapshot
+	s.ftDrill.Unlock()
+	s.log.Noticef("STAN: Failover drill: server %q is being demoted", snapshot.ServerID)
+	s.nc.Publish(m.Reply, []byte(s.serverID))
+}
+
+// discardFTDrill forgets the snapshot of a failover drill once another
+// server than the demoted one is active.
+func (s *StanServer) discardFTDrill(activeServerID string) {
+	s.ftDrill.Lock()
+	if s.ftDrill.snapshot != nil && s.ftDrill.snapshot.ServerID != activeServerID {
+		s.ftDrill.snapshot = nil
+	}
+	s.ftDrill.Unlock()
+}
+
+// checkFailoverDrill checks, once this server is promoted, the snapshot
+// of the failover drill that demoted the previous active server, if any.
+// The pending acks are checked right away, before clients ack messages,
+// and the clients are checked in a go routine.
+func (s *StanServer) checkFailoverDrill() {
+	s.ftDrill.Lock()
+	snapshot := s.ftDrill.snapshot
+	s.ftDrill.snapshot = nil
+	s.ftDrill.Unlock()
+	if snapshot == nil {
+		return
+	}
+	now := s.clock.Now()
+	report := &FailoverDrillReport{
+		DemotedServer:  snapshot.ServerID,
+		PromotedServer: s.serverID,
+		StartedAt:      snapshot.StartedAt,
+		ActivatedAt:    now,
+		FailoverTime:   now.Sub(snapshot.StartedAt),
+		Clients:        len(snapshot.Clients),
+	}
+	for _, ds := range snapshot.Subscriptions {
+		report.PendingAcks += len(ds.Pending)
+		report.LostPendingAcks += len(ds.Pending) - s.recoveredPendingAcks(ds)
+	}
+	s.ftDrill.Lock()
+	s.ftDrill.report = report
+	s.ftDrill.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		missing := s.missingDrillClients(snapshot.Clients)
+		s.ftDrill.Lock()
+		report.MissingClients = missing
+		report.ReconnectedClients = report.Clients - len(missing)
+		report.Passed = len(missing) == 0 && report.LostPendingAcks == 0
+		report.Done = true
+		s.ftDrill.Unlock()
+		if report.Passed {
+			s.log.Noticef("STAN: Failover drill passed: %v clients reconnected, %v pending acks carried over in %v",
+				report.ReconnectedClients, report.PendingAcks, report.FailoverTime)
+		} else {
+			s.log.Errorf("STAN: Failover drill failed: %v of %v clients missing, %v of %v pending acks lost",
+				len(missing), report.Clients, report.LostPendingAcks, report.PendingAcks)
+		}
+	}()
+}
+
+// recoveredPendingAcks returns the number of the pending acks of the
+// subscription of the snapshot that are pending in this server.
+func (s *StanServer) recoveredPendingAcks(ds *FailoverDrillSub) int {
+	for _, sub := range s.clients.GetSubs(ds.ClientID) {
+		sub.RLock()
+		n := 0
+		found := sub.ID == ds.ID && sub.subject == ds.Channel
+		if found {
+			for _, seq := range ds.Pending {
+				if sub.acksPending[seq] != nil {
+					n++
+				}
+			}
+		}
+		sub.RUnlock()
+		if found {
+			return n
+		}
+	}
+	return 0
+}
+
+// missingDrillClients returns the clients of the snapshot that are not
+// recovered, or that don't answer heartbeats as many times in a row as
+// would get them closed.
+func (s *StanServer) missingDrillClients(clients []string) []string {
+	s.RLock()
+	hbTimeout := s.hbTimeout
+	maxFailedHB := s.maxFailedHB
+	s.RUnlock()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	missing := []string{}
+	for _, clientID := range clients {
+		sc := s.store.GetClient(clientID)
+		if sc == nil {
+			mu.Lock()
+			missing = append(missing, clientID)
+			mu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func(clientID, hbInbox string) {
+			defer wg.Done()
+			for i := 0; i <= maxFailedHB; i++ {
+				if _, err := s.nc.Request(hbInbox, nil, hbTimeout); err == nil {
+					return
+				}
+			}
+			mu.Lock()
+			missing = append(missing, clientID)
+			mu.Unlock()
+		}(clientID, sc.HbInbox)
+	}
+	wg.Wait()
+	sort.Strings(missing)
+	return missing
+}
+
+// FailoverDrillReport returns the report of the last failover drill that
+// promoted this server, nil if none did. Clients are still being checked
+// while the report is not Done.
+func (s *StanServer) FailoverDrillReport() *FailoverDrillReport {
+	s.ftDrill.RLock()
+	defer s.ftDrill.RUnlock()
+	if s.ftDrill.report == nil {
+		return nil
+	}
+	report := *s.ftDrill.report
+	return &report
+}
@@ -0,0 +1,151 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	natsdTest "github.com/nats-io/gnatsd/test"
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+func getTestFTDrillOptions() *Options {
+	opts := getTestFTOptions()
+	opts.AdminUsers = []*AdminUser{
+		{Name: "read", Token: util.NewSecret(adminReadToken), Role: RoleReadOnly},
+		{Name: "destructive", Token: util.NewSecret(adminDestructiveToken), Role: RoleDestructive},
+	}
+	return opts
+}
+
+func TestFailoverDrill(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	ns := natsdTest.RunServer(nil)
+	defer ns.Shutdown()
+
+	s1 := runServerWithOpts(getTestFTDrillOptions())
+	defer s1.Shutdown()
+	waitForState(t, s1, FTActive)
+	s2 := runServerWithOpts(getTestFTDrillOptions())
+	defer s2.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	// The message is never acknowledged, and stays pending.
+	ch := make(chan bool, 1)
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) { ch <- true },
+		stan.DurableName("dur"), stan.SetManualAckMode()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	if err := Wait(ch); err != nil {
+		t.Fatal("Did not get our message")
+	}
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+	resp := sendAdminRequest(t, nc, &spb.AdminRequest{Token: adminDestructiveToken, Operation: AdminOpFailoverDrill})
+	if resp.Error != "" {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+	snapshot := &FailoverDrillSnapshot{}
+	if err := json.Unmarshal(resp.Data, snapshot); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if snapshot.ServerID != s1.serverID || snapshot.Standby != s2.serverID ||
+		len(snapshot.Clients) != 1 || len(snapshot.Subscriptions) != 1 {
+		t.Fatalf("Unexpected snapshot: %+v", snapshot)
+	}
+	if p := snapshot.Subscriptions[0].Pending; len(p) != 1 || p[0] != 1 {
+		t.Fatalf("Unexpected pending acks: %v", p)
+	}
+
+	select {
+	case <-s1.Demoted():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server was not demoted")
+	}
+	waitForState(t, s2, FTActive)
+	var report *FailoverDrillReport
+	waitForCount(t, 1, func() (string, int) {
+		report = s2.FailoverDrillReport()
+		if report == nil || !report.Done {
+			return "reports", 0
+		}
+		return "reports", 1
+	})
+	if !report.Passed || report.Clients != 1 || report.ReconnectedClients != 1 ||
+		report.PendingAcks != 1 || report.LostPendingAcks != 0 || report.DemotedServer != s1.serverID {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+
+	resp = sendAdminRequest(t, nc, &spb.AdminRequest{Token: adminReadToken, Operation: AdminOpFailoverReport})
+	if resp.Error != "" {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+	report = &FailoverDrillReport{}
+	if err := json.Unmarshal(resp.Data, report); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !report.Passed || report.PromotedServer != s2.serverID {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+}
+
+func TestFailoverDrillAborted(t *testing.T) {
+	s := RunServer(clusterName)
+	if _, err := s.FailoverDrill(); err != ErrFailoverDrillNotActive {
+		t.Fatalf("Expected error %v, got %v", ErrFailoverDrillNotActive, err)
+	}
+	if s.FailoverDrillReport() != nil {
+		t.Fatal("Expected no report")
+	}
+	s.Shutdown()
+
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+	ns := natsdTest.RunServer(nil)
+	defer ns.Shutdown()
+	s = runServerWithOpts(getTestFTOptions())
+	defer s.Shutdown()
+	waitForState(t, s, FTActive)
+
+	// Without a standby server, the drill is aborted and acks are
+	// processed again.
+	if _, err := s.FailoverDrill(); err != ErrFailoverDrillNoStandby {
+		t.Fatalf("Expected error %v, got %v", ErrFailoverDrillNoStandby, err)
+	}
+	if s.State() != FTActive {
+		t.Fatalf("Expected server to stay active, got %v", s.State())
+	}
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	ch := make(chan bool, 1)
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) { ch <- true }); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	if err := Wait(ch); err != nil {
+		t.Fatal("Did not get our message")
+	}
+	sub := s.clients.GetSubs(clientName)[0]
+	waitForCount(t, 0, func() (string, int) {
+		sub.RLock()
+		defer sub.RUnlock()
+		return "pending acks", len(sub.acksPending)
+	})
+}
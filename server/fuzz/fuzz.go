@@ -0,0 +1,507 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+// Package fuzz feeds malformed and adversarial requests to the connect,
+// publish, subscribe, unsubscribe and close subjects of a streaming server,
+// and checks that each one is answered with a well formed response, that
+// malformed requests are rejected, and that the server stays responsive
+// without its memory growing unbounded. A panic of the server crashes the
+// process running the harness.
+package fuzz
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"time"
+
+	natsd "github.com/nats-io/gnatsd/server"
+	natsdTest "github.com/nats-io/gnatsd/test"
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats"
+	stand "github.com/nats-io/nats-streaming-server/server"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nuid"
+)
+
+const (
+	clusterID = "fuzz"
+
+	// Client registered by the harness, used by the valid requests.
+	fuzzClientID = "fuzz"
+
+	// Client checking that the server is responsive.
+	healthClientID = "fuzz-health"
+
+	// Channels of the valid requests.
+	numChannels = 8
+
+	// A misbehaving server typically fails most requests the same way, so
+	// the report keeps the first failures and counts the others.
+	maxViolations = 100
+)
+
+// Config defines a run.
+type Config struct {
+	Requests           int                                      // Number of requests sent
+	Seed               int64                                    // Seed of the random choices (0 to use the current time)
+	NATSPort           int                                      // Port of the NATS Server (natsd.RANDOM_PORT for any free port)
+	ReplyTimeout       time.Duration                            // How long a response is awaited
+	HealthInterval     int                                      // Number of requests between two checks that the server is responsive
+	SettleTime         time.Duration                            // Time given to the server, once the requests are sent, to drop the clients that don't answer heartbeats
+	MaxHeapGrowth      uint64                                   // Growth of the heap, in bytes, above which the memory is deemed unbounded
+	MaxGoroutineGrowth int                                      // Growth of the number of go routines above which they are deemed leaked
+	Logf               func(format string, args ...interface{}) // Progress logger (nil for none)
+}
+
+// DefaultConfig returns the configuration of the nightly runs.
+func DefaultConfig() Config {
+	return Config{
+		Requests:           100000,
+		NATSPort:           natsd.RANDOM_PORT,
+		ReplyTimeout:       2 * time.Second,
+		HealthInterval:     100,
+		SettleTime:         5 * time.Second,
+		MaxHeapGrowth:      64 * 1024 * 1024,
+		MaxGoroutineGrowth: 20,
+	}
+}
+
+// Report counts the requests sent and rejected, and lists the requests the
+// server failed to answer properly, or accepted while malformed, as well as
+// the signs of leaks. The server passed the fuzzing if there is no
+// violation.
+type Report struct {
+	Seed            int64          // Seed of the run
+	Requests        map[string]int // Requests sent, by subject (connect, pub, sub, unsub or close)
+	Rejected        int            // Requests answered with an error
+	HeapGrowth      int64          // Growth of the heap, in bytes, from the end of the warm up to the end of the run
+	GoroutineGrowth int            // Growth of the number of go routines over the same period
+	Violations      []string       // First violations
+}
+
+// target is a subject the requests are sent to.
+type target struct {
+	name        string
+	subject     string
+	valid       func(r *run) []byte            // a valid request
+	adversarial func(r *run) []byte            // a request with adversarial fields
+	parse       func(b []byte) error           // unmarshals a request
+	response    func(b []byte) (string, error) // unmarshals a response, returning its error
+	accepted    func(r *run, req, resp []byte) // called when a valid request is accepted (nil for none)
+}
+
+// run holds the connection the requests are sent on, and the clients and
+// subscriptions created by the valid requests, which the later valid
+// unsubscribe and close requests refer to.
+type run struct {
+	cfg        Config
+	rep        Report
+	rnd        *rand.Rand
+	p          *payloads
+	nc         *nats.Conn
+	targets    []*target
+	closeSubj  string
+	clients    []string // clients registered by valid connect requests
+	ackInboxes []string // ack inboxes of the subscriptions created by valid requests
+	violations int
+}
+
+// Run starts a NATS Server and a streaming server, sends the requests, then
+// checks that the server is still responsive and that its memory is
+// bounded. An error is returned if the run can't be started.
+func Run(cfg Config) (*Report, error) {
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+	rnd := rand.New(rand.NewSource(cfg.Seed))
+	r := &run{
+		cfg: cfg,
+		rep: Report{Seed: cfg.Seed, Requests: make(map[string]int)},
+		rnd: rnd,
+		p:   &payloads{rnd: rnd},
+	}
+	r.logf("Starting run with seed %v", cfg.Seed)
+
+	nOpts := natsdTest.DefaultTestOptions
+	nOpts.Port = cfg.NATSPort
+	ns := natsdTest.RunServer(&nOpts)
+	defer ns.Shutdown()
+	url := fmt.Sprintf("nats://%s", ns.Addr())
+
+	// Limits bound the memory used by the requests that are accepted, and
+	// the clients registered by the requests are dropped quickly since
+	// nobody answers their heartbeats.
+	sOpts := stand.GetDefaultOptions()
+	sOpts.ID = clusterID
+	sOpts.NATSServerURL = url
+	sOpts.MaxChannels = 2 * numChannels
+	sOpts.MaxSubscriptions = 32
+	sOpts.MaxMsgs = 100
+	sOpts.MaxBytes = 1024 * 1024
+	sOpts.ClientHBInterval = 500 * time.Millisecond
+	sOpts.ClientHBTimeout = 250 * time.Millisecond
+	sOpts.ClientHBFailCount = 3
+	ss := stand.RunServerWithOpts(sOpts, nil)
+	defer ss.Shutdown()
+
+	var err error
+	if r.nc, err = nats.Connect(url); err != nil {
+		return nil, err
+	}
+	defer r.nc.Close()
+	health, err := stan.Connect(clusterID, healthClientID, stan.NatsURL(url), stan.PubAckWait(cfg.ReplyTimeout))
+	if err != nil {
+		return nil, err
+	}
+	defer health.Close()
+	if err := r.register(); err != nil {
+		return nil, err
+	}
+
+	warmUp := cfg.Requests / 10
+	var baseline runtime.MemStats
+	baseGoroutines := 0
+	for i := 0; i < cfg.Requests; i++ {
+		if i == warmUp {
+			baseGoroutines = settledStats(&baseline)
+		}
+		r.send(r.targets[r.rnd.Intn(len(r.targets))], mutation(r.rnd.Intn(int(numMutations))))
+		if cfg.HealthInterval > 0 && (i+1)%cfg.HealthInterval == 0 {
+			r.checkHealth(health, i+1)
+		}
+	}
+
+	// Closing the client removes the subscriptions of the valid requests,
+	// so that what remains once the server settled is leaked.
+	if err := r.unregister(); err != nil {
+		r.violation("Unable to close the client of the requests: %v", err)
+	}
+	r.logf("Requests sent, waiting for the server to settle")
+	time.Sleep(cfg.SettleTime)
+	r.checkHealth(health, cfg.Requests)
+	var stats runtime.MemStats
+	goroutines := settledStats(&stats)
+	r.rep.HeapGrowth = int64(stats.HeapAlloc) - int64(baseline.HeapAlloc)
+	r.rep.GoroutineGrowth = goroutines - baseGoroutines
+	if r.rep.HeapGrowth > int64(cfg.MaxHeapGrowth) {
+		r.violation("Heap grew by %v bytes", r.rep.HeapGrowth)
+	}
+	if r.rep.GoroutineGrowth > cfg.MaxGoroutineGrowth {
+		r.violation("Number of go routines grew by %v", r.rep.GoroutineGrowth)
+	}
+	if r.violations > maxViolations {
+		r.rep.Violations = append(r.rep.Violations, fmt.Sprintf("... and %d more violations", r.violations-maxViolations))
+	}
+	return &r.rep, nil
+}
+
+// settledStats collects the garbage, then reads the memory statistics and
+// returns the number of go routines.
+func settledStats(stats *runtime.MemStats) int {
+	runtime.GC()
+	runtime.GC()
+	runtime.ReadMemStats(stats)
+	return runtime.NumGoroutine()
+}
+
+func (r *run) logf(format string, args ...interface{}) {
+	if r.cfg.Logf != nil {
+		r.cfg.Logf(format, args...)
+	}
+}
+
+// violation records a violation.
+func (r *run) violation(format string, args ...interface{}) {
+	r.violations++
+	if r.violations <= maxViolations {
+		r.rep.Violations = append(r.rep.Violations, fmt.Sprintf(format, args...))
+	}
+}
+
+// register connects the client used by the valid requests, answering its
+// heartbeats, and gets the subjects of the requests.
+func (r *run) register() error {
+	hbInbox := nats.NewInbox()
+	if _, err := r.nc.Subscribe(hbInbox, func(m *nats.Msg) {
+		r.nc.Publish(m.Reply, nil)
+	}); err != nil {
+		return err
+	}
+	b, _ := (&spb.ConnectRequest{ClientID: fuzzClientID, HeartbeatInbox: hbInbox}).Marshal()
+	reply, err := r.nc.Request(stand.DefaultDiscoverPrefix+"."+clusterID, b, r.cfg.ReplyTimeout)
+	if err != nil {
+		return err
+	}
+	cr := &spb.ConnectResponse{}
+	if err := cr.Unmarshal(reply.Data); err != nil {
+		return err
+	}
+	if cr.Error != "" {
+		return fmt.Errorf("unable to connect: %v", cr.Error)
+	}
+	r.targets = []*target{
+		connectTarget(stand.DefaultDiscoverPrefix + "." + clusterID),
+		pubTarget(cr.PubPrefix + ".fuzz"),
+		subTarget(cr.SubRequests),
+		unsubTarget(cr.UnsubRequests),
+		closeTarget(cr.CloseRequests),
+	}
+	r.closeSubj = cr.CloseRequests
+	return nil
+}
+
+// unregister closes the client used by the valid requests.
+func (r *run) unregister() error {
+	b, _ := (&pb.CloseRequest{ClientID: fuzzClientID}).Marshal()
+	reply, err := r.nc.Request(r.closeSubj, b, r.cfg.ReplyTimeout)
+	if err != nil {
+		return err
+	}
+	resp := &spb.CloseResponse{}
+	if err := resp.Unmarshal(reply.Data); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%v", resp.Error)
+	}
+	return nil
+}
+
+// send sends a request to the target and checks its response.
+func (r *run) send(t *target, m mutation) {
+	var req []byte
+	switch m {
+	case mutValid:
+		req = t.valid(r)
+	case mutAdversarial:
+		req = t.adversarial(r)
+	default:
+		req = r.p.mutate(m, t.valid(r), nil)
+	}
+	r.rep.Requests[t.name]++
+	malformed := t.parse(req) != nil
+	reply, err := r.nc.Request(t.subject, req, r.cfg.ReplyTimeout)
+	if err != nil {
+		r.violation("No response to %s request (%v mutation, %d bytes): %v", t.name, m, len(req), err)
+		return
+	}
+	respErr, err := t.response(reply.Data)
+	if err != nil {
+		r.violation("Invalid response to %s request (%v mutation): %v", t.name, m, err)
+		return
+	}
+	if respErr != "" {
+		r.rep.Rejected++
+		return
+	}
+	if malformed {
+		r.violation("Malformed %s request accepted (%v mutation): %q", t.name, m, req)
+		return
+	}
+	if m == mutValid && t.accepted != nil {
+		t.accepted(r, req, reply.Data)
+	}
+}
+
+// checkHealth checks that the server still stores messages.
+func (r *run) checkHealth(sc stan.Conn, requests int) {
+	if err := sc.Publish("fuzz.health", []byte("ping")); err != nil {
+		r.violation("Server unresponsive after %d requests: %v", requests, err)
+	}
+}
+
+// channel returns one of the channels of the valid requests.
+func (r *run) channel() string {
+	return fmt.Sprintf("fuzz.%d", r.rnd.Intn(numChannels))
+}
+
+// pick removes and returns a random element of list, or "" if empty.
+func (r *run) pick(list *[]string) string {
+	if len(*list) == 0 {
+		return ""
+	}
+	i := r.rnd.Intn(len(*list))
+	s := (*list)[i]
+	(*list)[i] = (*list)[len(*list)-1]
+	*list = (*list)[:len(*list)-1]
+	return s
+}
+
+func connectTarget(subject string) *target {
+	return &target{
+		name:    "connect",
+		subject: subject,
+		valid: func(r *run) []byte {
+			n := r.rnd.Int63()
+			// Nobody answers the heartbeats, so the client is dropped.
+			b, _ := (&spb.ConnectRequest{
+				ClientID:       fmt.Sprintf("fuzz-%d", n),
+				HeartbeatInbox: fmt.Sprintf("_FUZZ.hb.%d", n),
+			}).Marshal()
+			return b
+		},
+		adversarial: func(r *run) []byte {
+			b, _ := (&spb.ConnectRequest{ClientID: r.p.str(), HeartbeatInbox: r.p.str()}).Marshal()
+			return b
+		},
+		parse: func(b []byte) error {
+			return (&spb.ConnectRequest{}).Unmarshal(b)
+		},
+		response: func(b []byte) (string, error) {
+			resp := &spb.ConnectResponse{}
+			err := resp.Unmarshal(b)
+			return resp.Error, err
+		},
+		accepted: func(r *run, req, resp []byte) {
+			cr := &spb.ConnectRequest{}
+			cr.Unmarshal(req)
+			r.clients = append(r.clients, cr.ClientID)
+		},
+	}
+}
+
+func pubTarget(subject string) *target {
+	return &target{
+		name:    "pub",
+		subject: subject,
+		valid: func(r *run) []byte {
+			b, _ := (&spb.PubMsg{
+				ClientID: fuzzClientID,
+				Guid:     nuid.Next(),
+				Subject:  r.channel(),
+				Data:     r.p.bytes(256),
+			}).Marshal()
+			return b
+		},
+		adversarial: func(r *run) []byte {
+			b, _ := (&spb.PubMsg{
+				ClientID:      r.p.strOr(fuzzClientID),
+				Guid:          r.p.strOr(nuid.Next()),
+				Subject:       r.p.strOr(r.channel()),
+				Reply:         r.p.str(),
+				Data:          r.p.bytes(1024),
+				Sha256:        r.p.bytes(32),
+				OrderingGroup: r.p.str(),
+				Headers:       map[string]string{r.p.str(): r.p.str()},
+			}).Marshal()
+			return b
+		},
+		parse: func(b []byte) error {
+			return (&spb.PubMsg{}).Unmarshal(b)
+		},
+		response: func(b []byte) (string, error) {
+			resp := &spb.PubAck{}
+			err := resp.Unmarshal(b)
+			return resp.Error, err
+		},
+	}
+}
+
+func subTarget(subject string) *target {
+	return &target{
+		name:    "sub",
+		subject: subject,
+		valid: func(r *run) []byte {
+			b, _ := (&spb.SubscriptionRequest{
+				ClientID:      fuzzClientID,
+				Subject:       r.channel(),
+				Inbox:         fmt.Sprintf("_FUZZ.inbox.%d", r.rnd.Int63()),
+				MaxInFlight:   int32(1 + r.rnd.Intn(64)),
+				AckWaitInSecs: 30,
+				StartPosition: spb.StartPosition(r.rnd.Intn(5)),
+			}).Marshal()
+			return b
+		},
+		adversarial: func(r *run) []byte {
+			b, _ := (&spb.SubscriptionRequest{
+				ClientID:       r.p.strOr(fuzzClientID),
+				Subject:        r.p.strOr(r.channel()),
+				QGroup:         r.p.str(),
+				Inbox:          r.p.str(),
+				MaxInFlight:    int32(r.p.int()),
+				AckWaitInSecs:  int32(r.p.int()),
+				DurableName:    r.p.str(),
+				StartPosition:  spb.StartPosition(r.p.int()),
+				StartSequence:  uint64(r.p.int()),
+				StartTimeDelta: r.p.int(),
+				QueuePolicy:    r.p.str(),
+			}).Marshal()
+			return b
+		},
+		parse: func(b []byte) error {
+			return (&spb.SubscriptionRequest{}).Unmarshal(b)
+		},
+		response: func(b []byte) (string, error) {
+			resp := &spb.SubscriptionResponse{}
+			err := resp.Unmarshal(b)
+			return resp.Error, err
+		},
+		accepted: func(r *run, req, resp []byte) {
+			sr := &spb.SubscriptionResponse{}
+			sr.Unmarshal(resp)
+			r.ackInboxes = append(r.ackInboxes, sr.AckInbox)
+		},
+	}
+}
+
+func unsubTarget(subject string) *target {
+	return &target{
+		name:    "unsub",
+		subject: subject,
+		valid: func(r *run) []byte {
+			// The channel is not known, the server looks the subscription
+			// up by its ack inbox.
+			b, _ := (&pb.UnsubscribeRequest{
+				ClientID: fuzzClientID,
+				Subject:  r.channel(),
+				Inbox:    r.pick(&r.ackInboxes),
+			}).Marshal()
+			return b
+		},
+		adversarial: func(r *run) []byte {
+			b, _ := (&pb.UnsubscribeRequest{
+				ClientID:    r.p.strOr(fuzzClientID),
+				Subject:     r.p.str(),
+				Inbox:       r.p.str(),
+				DurableName: r.p.str(),
+			}).Marshal()
+			return b
+		},
+		parse: func(b []byte) error {
+			return (&pb.UnsubscribeRequest{}).Unmarshal(b)
+		},
+		response: func(b []byte) (string, error) {
+			resp := &spb.SubscriptionResponse{}
+			err := resp.Unmarshal(b)
+			return resp.Error, err
+		},
+	}
+}
+
+func closeTarget(subject string) *target {
+	return &target{
+		name:    "close",
+		subject: subject,
+		valid: func(r *run) []byte {
+			clientID := r.pick(&r.clients)
+			if clientID == "" {
+				clientID = fmt.Sprintf("fuzz-%d", r.rnd.Int63())
+			}
+			b, _ := (&pb.CloseRequest{ClientID: clientID}).Marshal()
+			return b
+		},
+		adversarial: func(r *run) []byte {
+			b, _ := (&pb.CloseRequest{ClientID: r.p.str()}).Marshal()
+			return b
+		},
+		parse: func(b []byte) error {
+			return (&pb.CloseRequest{}).Unmarshal(b)
+		},
+		response: func(b []byte) (string, error) {
+			resp := &spb.CloseResponse{}
+			err := resp.Unmarshal(b)
+			return resp.Error, err
+		},
+	}
+}
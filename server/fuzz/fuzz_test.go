@@ -0,0 +1,61 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package fuzz
+
+import (
+	"flag"
+	"testing"
+)
+
+var (
+	fuzzRequests = flag.Int("fuzz.requests", 0, "Number of requests of TestFuzz (0 to skip it)")
+	fuzzSeed     = flag.Int64("fuzz.seed", 0, "Seed of TestFuzz (0 for a random one)")
+)
+
+func checkReport(t *testing.T, rep *Report) {
+	t.Logf("Seed=%v Requests=%v Rejected=%v HeapGrowth=%v GoroutineGrowth=%v",
+		rep.Seed, rep.Requests, rep.Rejected, rep.HeapGrowth, rep.GoroutineGrowth)
+	for _, v := range rep.Violations {
+		t.Errorf("%s", v)
+	}
+}
+
+// TestFuzz is meant for nightly runs, such as:
+//
+//	go test ./server/fuzz -run TestFuzz -fuzz.requests 1000000 -timeout 2h
+func TestFuzz(t *testing.T) {
+	if *fuzzRequests == 0 {
+		t.Skip("Set -fuzz.requests to run")
+	}
+	cfg := DefaultConfig()
+	cfg.Requests = *fuzzRequests
+	cfg.Seed = *fuzzSeed
+	cfg.Logf = t.Logf
+	rep, err := Run(cfg)
+	if err != nil {
+		t.Fatalf("Unable to run: %v", err)
+	}
+	checkReport(t, rep)
+}
+
+func TestShortFuzz(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+	cfg := DefaultConfig()
+	cfg.Requests = 3000
+	cfg.HealthInterval = 50
+	rep, err := Run(cfg)
+	if err != nil {
+		t.Fatalf("Unable to run: %v", err)
+	}
+	if rep.Rejected == 0 || rep.Rejected == cfg.Requests {
+		t.Fatalf("Unexpected report: %+v", rep)
+	}
+	for _, name := range []string{"connect", "pub", "sub", "unsub", "close"} {
+		if rep.Requests[name] == 0 {
+			t.Fatalf("No %s request sent: %+v", name, rep)
+		}
+	}
+	checkReport(t, rep)
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package fuzz
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+)
+
+// Adversarial values of the string fields of the requests.
+var adversarialStrings = []string{
+	"",
+	" ",
+	"\x00",
+	"foo",
+	"foo.*",
+	"foo.>",
+	">",
+	"*",
+	"foo..bar",
+	".foo",
+	"foo.",
+	"foo bar",
+	"héllo ",
+	"\xff\xfe",
+	strings.Repeat("a", 256),
+	strings.Repeat("foo.", 4096),
+	strings.Repeat("x", 64*1024),
+	"_STAN.discover." + clusterID,
+	"_INBOX.>",
+}
+
+// Adversarial values of the integer fields of the requests.
+var adversarialInts = []int64{0, 1, -1, 2, math.MaxInt32, math.MinInt32, math.MaxInt64, math.MinInt64}
+
+// mutation is the kind of change applied to a valid request.
+type mutation int
+
+const (
+	mutValid       mutation = iota // the valid request, unchanged
+	mutRandom                      // random bytes
+	mutTruncate                    // the valid request, truncated
+	mutFlip                        // the valid request with random bits flipped
+	mutAdversarial                 // a request whose fields have adversarial values
+	mutAppend                      // the valid request followed by random bytes
+	numMutations
+)
+
+var mutationNames = [numMutations]string{"valid", "random", "truncate", "flip", "adversarial", "append"}
+
+func (m mutation) String() string {
+	return mutationNames[m]
+}
+
+// payloads generates the payloads of the requests.
+type payloads struct {
+	rnd *rand.Rand
+}
+
+// str returns an adversarial string.
+func (p *payloads) str() string {
+	return adversarialStrings[p.rnd.Intn(len(adversarialStrings))]
+}
+
+// strOr returns valid most of the time, an adversarial string otherwise,
+// so that requests get past the first checks of the server.
+func (p *payloads) strOr(valid string) string {
+	if p.rnd.Intn(3) == 0 {
+		return p.str()
+	}
+	return valid
+}
+
+// int returns an adversarial integer.
+func (p *payloads) int() int64 {
+	return adversarialInts[p.rnd.Intn(len(adversarialInts))]
+}
+
+// bytes returns up to max random bytes.
+func (p *payloads) bytes(max int) []byte {
+	b := make([]byte, p.rnd.Intn(max+1))
+	p.rnd.Read(b)
+	return b
+}
+
+// mutate applies the mutation to the valid request, or returns the
+// adversarial one.
+func (p *payloads) mutate(m mutation, valid, adversarial []byte) []byte {
+	switch m {
+	case mutRandom:
+		return p.bytes(1024)
+	case mutTruncate:
+		if len(valid) == 0 {
+			return valid
+		}
+		return valid[:p.rnd.Intn(len(valid))]
+	case mutFlip:
+		b := append([]byte(nil), valid...)
+		for i := 0; i < 1+p.rnd.Intn(4) && len(b) > 0; i++ {
+			b[p.rnd.Intn(len(b))] ^= byte(1 << uint(p.rnd.Intn(8)))
+		}
+		return b
+	case mutAdversarial:
+		return adversarial
+	case mutAppend:
+		return append(append([]byte(nil), valid...), p.bytes(16)...)
+	}
+	return valid
+}
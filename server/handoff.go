@@ -0,0 +1,286 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/gnatsd/server"
+)
+
+const (
+	// HandoffListenerEnv is the environment variable through which a server
+	// started by Handoff gets the file descriptor of the listening socket.
+	HandoffListenerEnv = "STAN_HANDOFF_LISTENER_FD"
+
+	// DefaultHandoffWindow is the time over which the NATS clients of the
+	// embedded NATS Server are disconnected after a handoff.
+	DefaultHandoffWindow = 10 * time.Second
+)
+
+// ErrHandoffNotSupported is returned by Handoff when the server does not
+// own the socket the NATS clients connect to.
+var ErrHandoffNotSupported = errors.New("stan: handoff requires Options.Handoff and an embedded NATS Server without monitoring or cluster ports")
+
+// natsProxy accepts the NATS clients on the socket that can be handed off,
+// and relays their connections to the embedded NATS Server, which listens
+// on a loopback port. The NATS Server can't be given the listener, nor asked
+// to close its client connections gradually, so the proxy does both.
+type natsProxy struct {
+	sync.Mutex
+	l      *net.TCPListener
+	target string
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+	log    *serverLogger
+}
+
+// newNATSProxy starts accepting connections on the listener and relaying
+// them to the target address.
+func newNATSProxy(l *net.TCPListener, target string, log *serverLogger) *natsProxy {
+	p := &natsProxy{l: l, target: target, conns: make(map[net.Conn]struct{}), log: log}
+	p.wg.Add(1)
+	go p.acceptLoop()
+	return p
+}
+
+// addr returns the address the NATS clients connect to.
+func (p *natsProxy) addr() string {
+	return p.l.Addr().String()
+}
+
+// acceptLoop accepts connections until the listener is closed.
+func (p *natsProxy) acceptLoop() {
+	defer p.wg.Done()
+	delay := 10 * time.Millisecond
+	for {
+		c, err := p.l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(delay)
+				if delay < time.Second {
+					delay *= 2
+				}
+				continue
+			}
+			return
+		}
+		delay = 10 * time.Millisecond
+		p.wg.Add(1)
+		go p.relay(c)
+	}
+}
+
+// relay copies the bytes between the client connection and a connection
+// to the NATS Server, until either side closes.
+func (p *natsProxy) relay(c net.Conn) {
+	defer p.wg.Done()
+	nc, err := net.Dial("tcp", p.target)
+	if err != nil {
+		p.log.Errorf("STAN: Unable to relay a NATS client to %s: %v", p.target, err)
+		c.Close()
+		return
+	}
+	p.Lock()
+	if p.closed {
+		p.Unlock()
+		c.Close()
+		nc.Close()
+		return
+	}
+	p.conns[c] = struct{}{}
+	p.Unlock()
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		io.Copy(nc, c)
+		nc.Close()
+		c.Close()
+	}()
+	io.Copy(c, nc)
+	c.Close()
+	nc.Close()
+
+	p.Lock()
+	delete(p.conns, c)
+	p.Unlock()
+}
+
+// stopAccepting closes the socket in this process only, the process it
+// has been handed off to keeps accepting connections.
+func (p *natsProxy) stopAccepting() {
+	p.l.Close()
+}
+
+// drain closes the client connections one at a time, spread over the
+// given duration, so that the clients don't all reconnect at once.
+func (p *natsProxy) drain(d time.Duration) {
+	p.Lock()
+	conns := make([]net.Conn, 0, len(p.conns))
+	for c := range p.conns {
+		conns = append(conns, c)
+	}
+	p.Unlock()
+	if len(conns) == 0 {
+		return
+	}
+	interval := d / time.Duration(len(conns))
+	for i, c := range conns {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		c.Close()
+	}
+}
+
+// close stops accepting connections, closes the relayed ones, and waits
+// for the relays to return.
+func (p *natsProxy) close() {
+	p.Lock()
+	p.closed = true
+	for c := range p.conns {
+		c.Close()
+	}
+	p.Unlock()
+	p.l.Close()
+	p.wg.Wait()
+}
+
+// createHandoffListener returns the listener for the client connections of
+// the embedded NATS Server: the socket handed off by the previous process,
+// if any, or a new one listening on the options' host and port. Returns
+// nil if the handoff is not enabled, or if the NATS Server has other
+// listeners, which can't be handed off.
+func createHandoffListener(sOpts *Options, opts *server.Options) (*net.TCPListener, error) {
+	if !sOpts.Handoff || opts.HTTPPort != 0 || opts.HTTPSPort != 0 || opts.ClusterPort != 0 {
+		return nil, nil
+	}
+	var l net.Listener
+	var err error
+	if fd := os.Getenv(HandoffListenerEnv); fd != "" {
+		// Don't pass it down to the processes started by this one.
+		os.Unsetenv(HandoffListenerEnv)
+		var n int
+		if n, err = strconv.Atoi(fd); err != nil {
+			return nil, fmt.Errorf("invalid %s: %q", HandoffListenerEnv, fd)
+		}
+		f := os.NewFile(uintptr(n), "nats-listener")
+		l, err = net.FileListener(f)
+		f.Close()
+	} else {
+		host := opts.Host
+		if host == "" {
+			host = server.DEFAULT_HOST
+		}
+		port := opts.Port
+		if port == 0 {
+			port = server.DEFAULT_PORT
+		} else if port == server.RANDOM_PORT {
+			port = 0
+		}
+		l, err = net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	if err != nil {
+		return nil, err
+	}
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		l.Close()
+		return nil, fmt.Errorf("unexpected listener type %T", l)
+	}
+	return tl, nil
+}
+
+// handoffWindow returns the configured window, or the default one.
+func (s *StanServer) handoffWindow() time.Duration {
+	if s.opts.HandoffWindow > 0 {
+		return s.opts.HandoffWindow
+	}
+	return DefaultHandoffWindow
+}
+
+// Handoff restarts the server without closing the socket the NATS clients
+// connect to. This server is stopped, drained first if Options.DrainTimeout
+// is set, which closes the store and, with fault tolerance, lets another
+// server of the group become active. A new process is then started with the
+// same arguments and inherits the listening socket, so that clients never
+// find the port closed. Finally, the NATS clients still connected to this
+// server are disconnected over Options.HandoffWindow, so that they don't
+// all reconnect to the new process at once, and the embedded NATS Server
+// is shutdown. The server must have been started with Options.Handoff.
+func (s *StanServer) Handoff() error {
+	return s.handoff(startHandoffProcess)
+}
+
+// handoff is Handoff with the function starting the new process, given
+// the file of the listening socket.
+func (s *StanServer) handoff(start func(f *os.File) error) error {
+	s.Lock()
+	p := s.natsProxy
+	ns := s.natsServer
+	if p == nil || s.shutdown {
+		s.Unlock()
+		return ErrHandoffNotSupported
+	}
+	// Stopping the server must leave the NATS Server and the proxy running.
+	s.natsServer = nil
+	s.natsProxy = nil
+	s.Unlock()
+
+	// Duplicate the socket before it is closed in this process.
+	f, err := p.l.File()
+	if err != nil {
+		s.Shutdown()
+		p.close()
+		ns.Shutdown()
+		return err
+	}
+	s.log.Noticef("STAN: Handing off the NATS clients listener")
+	s.stopForHandoff()
+	p.stopAccepting()
+	err = start(f)
+	f.Close()
+	if err != nil {
+		s.log.Errorf("STAN: Unable to start the new process: %v", err)
+	} else {
+		p.drain(s.handoffWindow())
+	}
+	p.close()
+	ns.Shutdown()
+	return err
+}
+
+// stopForHandoff stops the server, as on a signal.
+func (s *StanServer) stopForHandoff() {
+	if s.opts.DrainTimeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), s.opts.DrainTimeout)
+		s.Stop(ctx)
+		cancel()
+	} else {
+		s.Shutdown()
+	}
+}
+
+// startHandoffProcess starts the process the listening socket is handed
+// off to.
+func startHandoffProcess(f *os.File) error {
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// The first extra file is descriptor 3 in the new process.
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Env = append(os.Environ(), HandoffListenerEnv+"=3")
+	return cmd.Start()
+}
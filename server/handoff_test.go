@@ -0,0 +1,117 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	natsdTest "github.com/nats-io/gnatsd/test"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+func TestHandoff(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.StoreType = stores.TypeFile
+	opts.FilestoreDir = defaultDataStore
+	opts.Handoff = true
+	opts.HandoffWindow = 100 * time.Millisecond
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	reconnected := make(chan bool, 1)
+	nc, err := nats.Connect(nats.DefaultURL,
+		nats.ReconnectWait(50*time.Millisecond),
+		nats.ReconnectHandler(func(_ *nats.Conn) { reconnected <- true }))
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	sc := NewDefaultConnection(t)
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	sc.Close()
+
+	// Start the new server in this process, as if the socket had been
+	// inherited.
+	var s2 *StanServer
+	err = s.handoff(func(f *os.File) error {
+		fd, err := syscall.Dup(int(f.Fd()))
+		if err != nil {
+			return err
+		}
+		os.Setenv(HandoffListenerEnv, strconv.Itoa(fd))
+		s2 = runServerWithOpts(opts)
+		return nil
+	})
+	if s2 != nil {
+		defer s2.Shutdown()
+	}
+	if err != nil {
+		t.Fatalf("Unexpected error on handoff: %v", err)
+	}
+	if os.Getenv(HandoffListenerEnv) != "" {
+		t.Fatalf("%s should have been cleared", HandoffListenerEnv)
+	}
+
+	// The NATS client moved to the new server.
+	if err := Wait(reconnected); err != nil {
+		t.Fatal("NATS client did not reconnect")
+	}
+	cs := s2.store.LookupChannel("foo")
+	if cs == nil {
+		t.Fatal("Channel should have been recovered")
+	}
+	if n, _, _ := cs.Msgs.State(); n != 1 {
+		t.Fatalf("Expected 1 message, got %v", n)
+	}
+	sc = NewDefaultConnection(t)
+	defer sc.Close()
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+}
+
+func TestHandoffNotSupported(t *testing.T) {
+	ns := natsdTest.RunDefaultServer()
+	defer ns.Shutdown()
+
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.NATSServerURL = nats.DefaultURL
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	if err := s.Handoff(); err != ErrHandoffNotSupported {
+		t.Fatalf("Expected error %v, got %v", ErrHandoffNotSupported, err)
+	}
+	// The server keeps running.
+	sc := NewDefaultConnection(t)
+	sc.Close()
+	s.Shutdown()
+	opts.Handoff = true
+	if err := validateOptions(opts); err == nil {
+		t.Fatal("Expected error with a NATS Server that is not embedded")
+	}
+	ns.Shutdown()
+
+	// The embedded NATS Server is not behind the proxy by default.
+	s = RunServerWithOpts(nil, nil)
+	defer s.Shutdown()
+	if err := s.Handoff(); err != ErrHandoffNotSupported {
+		t.Fatalf("Expected error %v, got %v", ErrHandoffNotSupported, err)
+	}
+}
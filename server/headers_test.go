@@ -0,0 +1,84 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nuid"
+)
+
+func publishWithHeaders(t *testing.T, s *StanServer, nc *nats.Conn, channel string, headers map[string]string) *spb.PubAck {
+	pm := &spb.PubMsg{ClientID: clientName, Guid: nuid.Next(), Subject: channel,
+		Data: []byte("hello"), Headers: headers}
+	b, _ := pm.Marshal()
+	reply, err := nc.Request(s.info.Publish+"."+channel, b, 5*time.Second)
+	if err != nil {
+		stackFatalf(t, "Unexpected error on publish: %v", err)
+	}
+	pa := &spb.PubAck{}
+	if err := pa.Unmarshal(reply.Data); err != nil {
+		stackFatalf(t, "Unexpected error on unmarshal: %v", err)
+	}
+	return pa
+}
+
+func TestPublishHeaders(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.StoreType = stores.TypeFile
+	opts.FilestoreDir = defaultDataStore
+	s := runServerWithOpts(opts)
+	defer shutdownRestartedServerOnTestExit(&s)
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	headers := map[string]string{"trace-id": "abc", "Content-Type": "application/json"}
+	if pa := publishWithHeaders(t, s, nc, "foo", headers); pa.Error != "" {
+		t.Fatalf("Unexpected error on publish: %v", pa.Error)
+	}
+	if pa := publishWithHeaders(t, s, nc, "foo", map[string]string{"bad key": "v"}); pa.Error != ErrInvalidPubReq.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidPubReq, pa.Error)
+	}
+	// A message without headers.
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	checkHeaders := func() {
+		ch := subscribeRawMsgs(t, nc, s, &spb.SubscriptionRequest{Subject: "foo", StartPosition: spb.StartPosition_First})
+		for _, expected := range []map[string]string{headers, nil} {
+			select {
+			case m := <-ch:
+				if len(m.Headers) != len(expected) {
+					stackFatalf(t, "Expected headers %v, got %v", expected, m.Headers)
+				}
+				for k, v := range expected {
+					if m.Headers[k] != v {
+						stackFatalf(t, "Expected headers %v, got %v", expected, m.Headers)
+					}
+				}
+			case <-time.After(2 * time.Second):
+				stackFatalf(t, "Did not receive the message")
+			}
+		}
+	}
+	checkHeaders()
+
+	// The headers are stored with the message.
+	s.Shutdown()
+	s = runServerWithOpts(opts)
+	checkHeaders()
+}
@@ -0,0 +1,24 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import "time"
+
+// clientHBInterval returns the interval of the heartbeats sent to a client
+// that requested the given interval in its connect request. Clients, such
+// as constrained devices, can only ask for a longer interval than the
+// server's, up to Options.ClientHBMaxInterval, larger values being capped.
+// Other requests get the server's interval.
+func (s *StanServer) clientHBInterval(requested time.Duration) time.Duration {
+	s.RLock()
+	hbInterval := s.hbInterval
+	s.RUnlock()
+	max := s.opts.ClientHBMaxInterval
+	if requested <= hbInterval || max <= hbInterval {
+		return hbInterval
+	}
+	if requested > max {
+		return max
+	}
+	return requested
+}
@@ -0,0 +1,114 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestClientHBInterval(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ClientHBInterval = 100 * time.Millisecond
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	// Clients can't change the interval by default.
+	if hb := s.clientHBInterval(time.Second); hb != opts.ClientHBInterval {
+		t.Fatalf("Expected interval %v, got %v", opts.ClientHBInterval, hb)
+	}
+
+	s.opts.ClientHBMaxInterval = time.Second
+	for _, c := range []struct{ requested, expected time.Duration }{
+		{0, 100 * time.Millisecond},
+		{10 * time.Millisecond, 100 * time.Millisecond},
+		{500 * time.Millisecond, 500 * time.Millisecond},
+		{time.Second, time.Second},
+		{time.Hour, time.Second},
+	} {
+		if hb := s.clientHBInterval(c.requested); hb != c.expected {
+			t.Fatalf("Expected interval %v for %v, got %v", c.expected, c.requested, hb)
+		}
+	}
+}
+
+func TestClientHBIntervalInConnectRequest(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.ClientHBInterval = 50 * time.Millisecond
+	opts.ClientHBMaxInterval = 400 * time.Millisecond
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	connSubj := fmt.Sprintf("%s.%s", s.opts.DiscoverPrefix, clusterName)
+	// connect registers a client answering its heartbeats, and returns the
+	// number of heartbeats received.
+	connect := func(clientID string, hbInterval time.Duration) (*int32, string) {
+		count := new(int32)
+		hbInbox := nats.NewInbox()
+		if _, err := nc.Subscribe(hbInbox, func(m *nats.Msg) {
+			atomic.AddInt32(count, 1)
+			nc.Publish(m.Reply, nil)
+		}); err != nil {
+			stackFatalf(t, "Unexpected error on subscribe: %v", err)
+		}
+		req := &spb.ConnectRequest{ClientID: clientID, HeartbeatInbox: hbInbox, HeartbeatInterval: int64(hbInterval)}
+		b, _ := req.Marshal()
+		resp, err := nc.Request(connSubj, b, time.Second)
+		if err != nil {
+			stackFatalf(t, "Unexpected error on publishing request: %v", err)
+		}
+		r := &spb.ConnectResponse{}
+		if err := r.Unmarshal(resp.Data); err != nil {
+			stackFatalf(t, "Unexpected response object: %v", err)
+		}
+		return count, r.Error
+	}
+
+	if _, errTxt := connect("negative", -time.Second); errTxt != ErrInvalidConnReq.Error() {
+		t.Fatalf("Expected error %q, got %q", ErrInvalidConnReq, errTxt)
+	}
+	def, _ := connect("default", 0)
+	longer, _ := connect("longer", 200*time.Millisecond)
+	capped, _ := connect("capped", time.Hour)
+
+	time.Sleep(time.Second)
+	if n := atomic.LoadInt32(def); n < 10 {
+		t.Fatalf("Expected at least 10 heartbeats at the server's interval, got %v", n)
+	}
+	if n := atomic.LoadInt32(longer); n < 3 || n > 5 {
+		t.Fatalf("Expected about 5 heartbeats at the requested interval, got %v", n)
+	}
+	if n := atomic.LoadInt32(capped); n < 1 || n > 2 {
+		t.Fatalf("Expected about 2 heartbeats at the max interval, got %v", n)
+	}
+	checkClients(t, s, 3)
+}
+
+func TestClientHBOptionsValidation(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ClientHBTimeout = -time.Second
+	if err := validateOptions(opts); err == nil {
+		t.Fatal("Expected error for negative heartbeat timeout")
+	}
+	opts = GetDefaultOptions()
+	opts.ClientHBMaxInterval = time.Second
+	if err := validateOptions(opts); err == nil {
+		t.Fatal("Expected error for a max interval lower than the interval")
+	}
+	opts.ClientHBInterval = 500 * time.Millisecond
+	if err := validateOptions(opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
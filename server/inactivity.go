@@ -0,0 +1,72 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Channels are checked for inactivity this many times per MaxInactivity.
+const inactivityChecksPerPeriod = 10
+
+// touch records that the channel was used at the given time.
+func (ss *subStore) touch(now int64) {
+	atomic.StoreInt64(&ss.activity, now)
+}
+
+// startInactivityCheck starts the go routine deleting the channels that
+// had no subscription and no new message for longer than their
+// MaxInactivity, the smallest of which is maxInactivity.
+func (s *StanServer) startInactivityCheck(maxInactivity time.Duration) {
+	interval := maxInactivity / inactivityChecksPerPeriod
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	s.Lock()
+	s.inactivityQuit = make(chan struct{})
+	quit := s.inactivityQuit
+	s.Unlock()
+	s.inactivityWG.Add(1)
+	go func() {
+		defer s.inactivityWG.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-t.C:
+				s.deleteInactiveChannels(s.clock.Now().UnixNano(), s.limits.global.MaxInactivity)
+			}
+		}
+	}()
+}
+
+// deleteInactiveChannels deletes the channels without subscriptions,
+// including offline durables, whose last activity is older than their
+// MaxInactivity, maxInactivity unless overridden for the channel. Channels
+// with subscriptions are considered in use at every check, so that
+// inactivity is counted from the removal of their last subscription.
+func (s *StanServer) deleteInactiveChannels(now int64, maxInactivity time.Duration) {
+	for name, cs := range s.store.GetChannels() {
+		ss := cs.UserData.(*subStore)
+		ss.RLock()
+		hasSubs := len(ss.acks) > 0 || len(ss.durables) > 0 || ss.hasDurableQueueShadows()
+		ss.RUnlock()
+		if hasSubs {
+			ss.touch(now)
+			continue
+		}
+		limit := s.limits.maxInactivity(name, maxInactivity)
+		if limit <= 0 || now-atomic.LoadInt64(&ss.activity) < int64(limit) {
+			continue
+		}
+		// A subscription may have been created in the meantime.
+		switch err := s.DeleteChannel(name, false); err {
+		case nil, ErrChannelHasSubs, ErrUnknownChannel:
+		default:
+			s.log.Errorf("STAN: Unable to delete inactive channel %q: %v", name, err)
+		}
+	}
+}
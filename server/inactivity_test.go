@@ -0,0 +1,105 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+func TestDeleteInactiveChannels(t *testing.T) {
+	clock := util.NewManualClock(time.Now())
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.Clock = clock
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	for _, channel := range []string{"foo", "bar", "baz"} {
+		if err := sc.Publish(channel, []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	sub, err := sc.Subscribe("bar", func(_ *stan.Msg) {})
+	if err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if _, err := sc.Subscribe("baz", func(_ *stan.Msg) {}, stan.DurableName("dur")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+
+	clock.Advance(time.Minute)
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	clock.Advance(30 * time.Second)
+	s.deleteInactiveChannels(clock.Now().UnixNano(), time.Minute)
+	for _, channel := range []string{"foo", "bar", "baz"} {
+		if s.store.LookupChannel(channel) == nil {
+			t.Fatalf("Channel %q should not have been deleted", channel)
+		}
+	}
+
+	// Inactivity is counted from the removal of the last subscription.
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatalf("Unexpected error on unsubscribe: %v", err)
+	}
+	waitForNumSubs(t, s, clientName, 1)
+	clock.Advance(45 * time.Second)
+	s.deleteInactiveChannels(clock.Now().UnixNano(), time.Minute)
+	if s.store.LookupChannel("foo") != nil {
+		t.Fatal("Channel foo should have been deleted")
+	}
+	if s.store.LookupChannel("bar") == nil {
+		t.Fatal("Channel bar should not have been deleted")
+	}
+	clock.Advance(time.Minute)
+	s.deleteInactiveChannels(clock.Now().UnixNano(), time.Minute)
+	if s.store.LookupChannel("bar") != nil {
+		t.Fatal("Channel bar should have been deleted")
+	}
+	// Offline durables keep the channel.
+	sc.Close()
+	clock.Advance(time.Hour)
+	s.deleteInactiveChannels(clock.Now().UnixNano(), time.Minute)
+	if s.store.LookupChannel("baz") == nil {
+		t.Fatal("Channel baz should not have been deleted")
+	}
+}
+
+func TestMaxInactivity(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.MaxInactivity = 100 * time.Millisecond
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for s.store.LookupChannel("foo") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Channel should have been deleted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The channel is created again on publish, from sequence 1.
+	msgs := make(chan *stan.Msg, 1)
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) { msgs <- m }); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	checkMsgSeq(t, msgs, 1)
+}
@@ -0,0 +1,138 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// Policies applied to the messages for which the DeliveryInterceptor returns
+// an error.
+const (
+	// RejectSkip acknowledges the message on behalf of the subscription,
+	// which never receives it.
+	RejectSkip = "skip"
+	// RejectDeadLetter moves the message to the dead-letter channel, when
+	// the subscription's AckWait expires.
+	RejectDeadLetter = "dead_letter"
+)
+
+// DeliveryInfo describes the subscription a message is delivered to.
+type DeliveryInfo struct {
+	ClientID    string
+	Channel     string
+	Inbox       string
+	QueueGroup  string // Empty if not a queue subscription
+	DurableName string // Empty if not a durable subscription
+}
+
+// DeliveryInterceptor is called before each delivery of a message to a
+// subscription, to annotate the message sent to that subscriber. It is
+// called with the subscription's lock held, and must therefore be fast and
+// not call the server.
+type DeliveryInterceptor interface {
+	// OnDeliver returns the message sent to the subscription, or nil to
+	// send msg unchanged. msg is a copy of the stored message whose fields
+	// can be set, but whose Data must not be modified in place. If an error
+	// is returned, the message is not sent and Options.DeliveryRejection
+	// applies.
+	OnDeliver(sub *DeliveryInfo, msg *spb.MsgProto) (*spb.MsgProto, error)
+}
+
+// DeliveryInterceptorFunc is a function used as a DeliveryInterceptor.
+type DeliveryInterceptorFunc func(sub *DeliveryInfo, msg *spb.MsgProto) (*spb.MsgProto, error)
+
+// OnDeliver calls f.
+func (f DeliveryInterceptorFunc) OnDeliver(sub *DeliveryInfo, msg *spb.MsgProto) (*spb.MsgProto, error) {
+	return f(sub, msg)
+}
+
+// validateRejectPolicy checks Options.DeliveryRejection.
+func validateRejectPolicy(policy string) error {
+	switch policy {
+	case "", RejectSkip, RejectDeadLetter:
+		return nil
+	}
+	return fmt.Errorf("invalid delivery reject policy %q", policy)
+}
+
+// intercept returns the message to send to the subscription, as annotated by
+// the DeliveryInterceptor. sub's lock held on entry.
+func (s *StanServer) intercept(sub *subState, m *spb.MsgProto) (*spb.MsgProto, error) {
+	di := s.opts.DeliveryInterceptor
+	if di == nil {
+		return m, nil
+	}
+	info := &DeliveryInfo{
+		ClientID:    sub.ClientID,
+		Channel:     sub.subject,
+		Inbox:       sub.Inbox,
+		QueueGroup:  sub.QGroup,
+		DurableName: sub.DurableName,
+	}
+	mc := *m
+	im, err := di.OnDeliver(info, &mc)
+	if err != nil {
+		return nil, err
+	}
+	if im == nil {
+		im = &mc
+	}
+	return im, nil
+}
+
+// rejectDelivery applies Options.DeliveryRejection to a message that the
+// DeliveryInterceptor failed to annotate for the subscription. It returns
+// the same values as sendMsgToSub. sub's lock held on entry.
+func (s *StanServer) rejectDelivery(sub *subState, m *spb.MsgProto, reason error) (bool, bool) {
+	if s.debug {
+		s.log.debugFields("STAN: Delivery rejected", Field{"client", sub.ClientID}, Field{"channel", m.Subject},
+			Field{"inbox", sub.Inbox}, Field{"seq", m.Sequence}, Field{"error", reason.Error()})
+	}
+	pending := sub.acksPending[m.Sequence] != nil
+	if !pending {
+		if err := sub.store.AddSeqPending(sub.ID, m.Sequence); err != nil {
+			s.log.Errorf("STAN: [Client:%s] Unable to update subscription for %s:%v (%v)",
+				sub.ClientID, m.Subject, m.Sequence, err)
+			return false, false
+		}
+		if m.Sequence > sub.LastSent {
+			sub.LastSent = m.Sequence
+		}
+	}
+	if s.opts.DeliveryRejection == RejectDeadLetter {
+		// The message is moved by the redelivery callback, which can't be
+		// done here with the subscription's lock held.
+		if sub.rejected == nil {
+			sub.rejected = make(map[uint64]struct{})
+		}
+		sub.rejected[m.Sequence] = struct{}{}
+		if !pending {
+			sub.acksPending[m.Sequence] = m
+		}
+		if sub.ackTimer == nil {
+			s.setupAckTimer(sub, sub.ackWait)
+		}
+		return true, true
+	}
+	if err := sub.store.AckSeqPending(sub.ID, m.Sequence); err != nil {
+		s.log.Errorf("STAN: [Client:%s] Unable to persist ack for %s:%v (%v)",
+			sub.ClientID, m.Subject, m.Sequence, err)
+		return false, false
+	}
+	delete(sub.acksPending, m.Sequence)
+	delete(sub.claims, m.Sequence)
+	delete(sub.rdlvs, m.Sequence)
+	return true, true
+}
+
+// isRejected returns true if the message was rejected by the
+// DeliveryInterceptor and must be moved to the dead-letter channel.
+func isRejected(sub *subState, seq uint64) bool {
+	sub.RLock()
+	defer sub.RUnlock()
+	_, ok := sub.rejected[seq]
+	return ok
+}
@@ -0,0 +1,165 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// blockingInterceptor annotates the messages with the durable name of the
+// subscription, and rejects the messages "blocked" of channel foo.
+var blockingInterceptor = DeliveryInterceptorFunc(func(sub *DeliveryInfo, m *spb.MsgProto) (*spb.MsgProto, error) {
+	if sub.Channel == "foo" && string(m.Data) == "blocked" {
+		return nil, errors.New("not entitled")
+	}
+	if sub.DurableName == "" {
+		return nil, nil
+	}
+	m.Data = append(append([]byte{}, m.Data...), "|"+sub.DurableName...)
+	return m, nil
+})
+
+func runServerWithInterceptor(rejection string) *StanServer {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.DeliveryInterceptor = blockingInterceptor
+	opts.DeliveryRejection = rejection
+	return runServerWithOpts(opts)
+}
+
+func checkDeliveries(t *testing.T, ch chan string, expected ...string) {
+	for _, e := range expected {
+		select {
+		case d := <-ch:
+			if d != e {
+				stackFatalf(t, "Expected %q, got %q", e, d)
+			}
+		case <-time.After(2 * time.Second):
+			stackFatalf(t, "Did not receive %q", e)
+		}
+	}
+	select {
+	case d := <-ch:
+		stackFatalf(t, "Unexpected delivery %q", d)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func waitForNoPending(t *testing.T, sub *subState) {
+	waitForCount(t, 0, func() (string, int) {
+		sub.RLock()
+		defer sub.RUnlock()
+		return "ack pending", len(sub.acksPending)
+	})
+}
+
+func TestDeliveryInterceptorAnnotates(t *testing.T) {
+	s := runServerWithInterceptor("")
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	ch := make(chan string, 10)
+	cb := func(m *stan.Msg) { ch <- string(m.Data) }
+	if _, err := sc.Subscribe("foo", cb, stan.DurableName("dur1")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	checkDeliveries(t, ch, "hello|dur1")
+
+	// Each subscription gets its own annotation, and the stored message
+	// is unchanged.
+	if _, err := sc.Subscribe("foo", cb, stan.DurableName("dur2"), stan.DeliverAllAvailable()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	checkDeliveries(t, ch, "hello|dur2")
+	if _, err := sc.Subscribe("foo", cb, stan.DeliverAllAvailable()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	checkDeliveries(t, ch, "hello")
+	m := s.store.LookupChannel("foo").Msgs.Lookup(1)
+	if string(m.Data) != "hello" {
+		t.Fatalf("Stored message should not be modified, got %q", m.Data)
+	}
+}
+
+func TestDeliveryInterceptorSkip(t *testing.T) {
+	s := runServerWithInterceptor(RejectSkip)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	ch := make(chan string, 10)
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) { ch <- string(m.Data) }); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	for _, d := range []string{"first", "blocked", "second"} {
+		if err := sc.Publish("foo", []byte(d)); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	checkDeliveries(t, ch, "first", "second")
+
+	subs := s.clients.GetSubs(clientName)
+	waitForNoPending(t, subs[0])
+	subs[0].RLock()
+	lastSent := subs[0].LastSent
+	subs[0].RUnlock()
+	if lastSent != 3 {
+		t.Fatalf("Expected last sent to be 3, got %v", lastSent)
+	}
+}
+
+func TestDeliveryInterceptorDeadLetter(t *testing.T) {
+	s := runServerWithInterceptor(RejectDeadLetter)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	dlq := make(chan string, 10)
+	if _, err := sc.Subscribe(DefaultDLQPrefix+".foo", func(m *stan.Msg) {
+		dlq <- string(m.Data)
+	}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	ch := make(chan string, 10)
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) { ch <- string(m.Data) }); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	subs := s.clients.GetSubs(clientName)
+	setTestAckWait(subs, 100*time.Millisecond)
+
+	for _, d := range []string{"first", "blocked", "second"} {
+		if err := sc.Publish("foo", []byte(d)); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	checkDeliveries(t, ch, "first", "second")
+	checkDeliveries(t, dlq, "blocked")
+	for _, sub := range subs {
+		waitForNoPending(t, sub)
+		sub.RLock()
+		rejected := len(sub.rejected)
+		sub.RUnlock()
+		if rejected != 0 {
+			t.Fatalf("Expected no rejected message, got %v", rejected)
+		}
+	}
+}
+
+func TestValidateDeliveryRejection(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.DeliveryRejection = "drop"
+	r := Validate(opts, nil)
+	checkValidationResult(t, r, "options", true)
+}
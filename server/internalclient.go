@@ -0,0 +1,171 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nuid"
+)
+
+// Timeout for the requests of internal clients to the server.
+const internalRequestTimeout = 2 * time.Second
+
+// internalClient is a streaming client running inside the server, such as
+// the canary. It uses the client protocol over the server's NATS connection,
+// but not the client library, which depends on the server for its tests.
+type internalClient struct {
+	sync.Mutex
+	s        *StanServer
+	clientID string
+	conn     *spb.ConnectResponse
+	subs     []*nats.Subscription
+}
+
+// newInternalClient registers a client with the given ID to this server.
+func (s *StanServer) newInternalClient(clientID string) (*internalClient, error) {
+	c := &internalClient{s: s, clientID: clientID}
+	hbInbox := nats.NewInbox()
+	sub, err := s.nc.Subscribe(hbInbox, func(m *nats.Msg) { s.nc.Publish(m.Reply, nil) })
+	if err != nil {
+		return nil, err
+	}
+	c.subs = append(c.subs, sub)
+	c.conn = &spb.ConnectResponse{}
+	s.Lock()
+	s.internalConnects[clientID] = struct{}{}
+	s.Unlock()
+	err = c.request(s.info.Discovery, &spb.ConnectRequest{ClientID: clientID, HeartbeatInbox: hbInbox}, c.conn)
+	s.Lock()
+	delete(s.internalConnects, clientID)
+	s.Unlock()
+	if err == nil && c.conn.Error != "" {
+		err = errors.New(c.conn.Error)
+	}
+	if err != nil {
+		c.unsubscribe()
+		return nil, err
+	}
+	if sc := s.clients.Lookup(clientID); sc != nil {
+		sc.Lock()
+		sc.internal = true
+		sc.Unlock()
+	}
+	return c, nil
+}
+
+// request sends the request to the server and decodes the response.
+func (c *internalClient) request(subject string, req, resp interface {
+	Marshal() ([]byte, error)
+	Unmarshal([]byte) error
+}) error {
+	b, err := req.Marshal()
+	if err != nil {
+		return err
+	}
+	reply, err := c.s.nc.Request(subject, b, internalRequestTimeout)
+	if err != nil {
+		return err
+	}
+	return resp.Unmarshal(reply.Data)
+}
+
+// subscribe creates a durable subscription starting with new messages
+// and returns its ack inbox. The callback is invoked from the NATS
+// connection's dispatch go routine.
+func (c *internalClient) subscribe(channel, durable string, maxInFlight int32, ackWait time.Duration, cb func(*spb.MsgProto)) (string, error) {
+	inbox := nats.NewInbox()
+	sub, err := c.s.nc.Subscribe(inbox, func(m *nats.Msg) {
+		msg := &spb.MsgProto{}
+		if err := msg.Unmarshal(m.Data); err == nil {
+			cb(msg)
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	c.Lock()
+	c.subs = append(c.subs, sub)
+	c.Unlock()
+	req := &spb.SubscriptionRequest{
+		ClientID:      c.clientID,
+		Subject:       channel,
+		Inbox:         inbox,
+		MaxInFlight:   maxInFlight,
+		AckWaitInSecs: int32(ackWait / time.Second),
+		DurableName:   durable,
+		StartPosition: spb.StartPosition_NewOnly,
+	}
+	resp := &spb.SubscriptionResponse{}
+	if err := c.request(c.conn.SubRequests, req, resp); err != nil {
+		return "", err
+	}
+	if resp.Error != "" {
+		return "", errors.New(resp.Error)
+	}
+	return resp.AckInbox, nil
+}
+
+// ack acknowledges the message received on the subscription with the
+// given ack inbox.
+func (c *internalClient) ack(ackInbox string, m *spb.MsgProto) error {
+	ack := &pb.Ack{Subject: m.Subject, Sequence: m.Sequence}
+	b, err := ack.Marshal()
+	if err != nil {
+		return err
+	}
+	return c.s.nc.Publish(ackInbox, b)
+}
+
+// claim delays the redelivery of the message for the given duration.
+func (c *internalClient) claim(ackInbox string, m *spb.MsgProto, wait time.Duration) error {
+	secs := int32((wait + time.Second - 1) / time.Second)
+	req := &spb.ClaimRequest{Subject: m.Subject, AckInbox: ackInbox, Sequence: m.Sequence, ClaimWaitInSecs: secs}
+	resp := &spb.ClaimResponse{}
+	if err := c.request(c.s.claimSubject(), req, resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+// publish publishes the data to the channel and waits for the server's ack.
+func (c *internalClient) publish(channel string, data []byte) error {
+	pm := &spb.PubMsg{
+		ClientID: c.clientID,
+		Guid:     nuid.Next(),
+		Subject:  channel,
+		Data:     data,
+	}
+	ack := &spb.PubAck{}
+	if err := c.request(fmt.Sprintf("%s.%s", c.conn.PubPrefix, channel), pm, ack); err != nil {
+		return err
+	}
+	if ack.Error != "" {
+		return errors.New(ack.Error)
+	}
+	return nil
+}
+
+func (c *internalClient) unsubscribe() {
+	c.Lock()
+	defer c.Unlock()
+	for _, sub := range c.subs {
+		sub.Unsubscribe()
+	}
+	c.subs = nil
+}
+
+// close unsubscribes and closes the client's connection. Durables are kept.
+func (c *internalClient) close() {
+	c.unsubscribe()
+	c.request(c.conn.CloseRequests, &pb.CloseRequest{ClientID: c.clientID}, &spb.CloseResponse{})
+}
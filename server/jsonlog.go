@@ -0,0 +1,107 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// jsonLogger writes the statements as JSON objects, one per line, with the
+// time, level and message of the statement, followed by its fields:
+//
+//	{"time":"2016-10-12T10:34:45.2Z","level":"trace","msg":"STAN: Sending msg","client":"me","channel":"foo","seq":1}
+type jsonLogger struct {
+	sync.Mutex
+	out   io.Writer
+	debug bool
+	trace bool
+}
+
+// newJSONLogger returns a logger writing to the given file, or to stderr
+// if empty.
+func newJSONLogger(filename string, debug, trace bool) *jsonLogger {
+	var out io.Writer = os.Stderr
+	if filename != "" {
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+		if err != nil {
+			log.Fatalf("error opening file: %v", err)
+		}
+		out = f
+	}
+	return &jsonLogger{out: out, debug: debug, trace: trace}
+}
+
+// write writes the statement.
+func (l *jsonLogger) write(level, msg string, fields []Field) {
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeJSONValue(&buf, time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSONValue(&buf, level)
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(&buf, msg)
+	for _, f := range fields {
+		buf.WriteByte(',')
+		writeJSONValue(&buf, f.Key)
+		buf.WriteByte(':')
+		writeJSONValue(&buf, f.Value)
+	}
+	buf.WriteString("}\n")
+
+	l.Lock()
+	l.out.Write(buf.Bytes())
+	l.Unlock()
+}
+
+// writeJSONValue writes v encoded in JSON, or as a string if it can't be.
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprintf("%v", v))
+	}
+	buf.Write(b)
+}
+
+func (l *jsonLogger) Noticef(format string, v ...interface{}) {
+	l.write("info", fmt.Sprintf(format, v...), nil)
+}
+
+func (l *jsonLogger) Errorf(format string, v ...interface{}) {
+	l.write("error", fmt.Sprintf(format, v...), nil)
+}
+
+func (l *jsonLogger) Fatalf(format string, v ...interface{}) {
+	l.write("fatal", fmt.Sprintf(format, v...), nil)
+	os.Exit(1)
+}
+
+func (l *jsonLogger) Debugf(format string, v ...interface{}) {
+	if l.debug {
+		l.write("debug", fmt.Sprintf(format, v...), nil)
+	}
+}
+
+func (l *jsonLogger) Tracef(format string, v ...interface{}) {
+	if l.trace {
+		l.write("trace", fmt.Sprintf(format, v...), nil)
+	}
+}
+
+func (l *jsonLogger) DebugFields(msg string, fields []Field) {
+	if l.debug {
+		l.write("debug", msg, fields)
+	}
+}
+
+func (l *jsonLogger) TraceFields(msg string, fields []Field) {
+	if l.trace {
+		l.write("trace", msg, fields)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+// lazySubs tracks the plain, non-durable subscriptions created on channels
+// without messages. Such subscriptions start with the first message that
+// the channel will receive, whatever their start position, so they are
+// only written to the store when a message is about to be sent to them.
+// This makes bursts of ephemeral subscriptions on idle channels cheap.
+type lazySubs struct {
+	sync.Mutex
+	subs map[*subState]*subStore
+}
+
+func (l *lazySubs) add(sub *subState, ss *subStore) {
+	l.Lock()
+	if l.subs == nil {
+		l.subs = make(map[*subState]*subStore)
+	}
+	l.subs[sub] = ss
+	atomic.AddInt32(&ss.lazyCount, 1)
+	l.Unlock()
+}
+
+func (l *lazySubs) remove(sub *subState) {
+	l.Lock()
+	if ss, ok := l.subs[sub]; ok {
+		delete(l.subs, sub)
+		atomic.AddInt32(&ss.lazyCount, -1)
+	}
+	l.Unlock()
+}
+
+// list returns the subscriptions currently tracked.
+func (l *lazySubs) list() []*subState {
+	l.Lock()
+	defer l.Unlock()
+	subs := make([]*subState, 0, len(l.subs))
+	for sub := range l.subs {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// LazySubsCount returns the number of subscriptions that have not been
+// written to the store yet, because their channel has not received any
+// message since they were created.
+func (s *StanServer) LazySubsCount() int {
+	s.lazySubs.Lock()
+	defer s.lazySubs.Unlock()
+	return len(s.lazySubs.subs)
+}
+
+// isLazySubRequest returns true if the subscription requested would start
+// with the next message of the channel, and can be created lazily.
+func isLazySubRequest(cs *stores.ChannelStore, sr *spb.SubscriptionRequest) bool {
+	if sr.DurableName != "" || sr.QGroup != "" || cs.Msgs.LastSequence() != 0 {
+		return false
+	}
+	switch sr.StartPosition {
+	case spb.StartPosition_NewOnly, spb.StartPosition_LastReceived, spb.StartPosition_First:
+		return true
+	}
+	return false
+}
+
+// hasRoomForSub returns true if the subscriptions created lazily on this
+// channel, and a new one, can be written to the store without exceeding
+// its limit.
+func (ss *subStore) hasRoomForSub(store stores.SubStore) bool {
+	return store.AvailableSubs() > int(atomic.LoadInt32(&ss.lazyCount))
+}
+
+// persistLazySub writes the lazily created subscription to the store.
+// Sub lock held on entry.
+func (s *StanServer) persistLazySub(sub *subState) error {
+	if sub.lazy == nil {
+		return nil
+	}
+	if err := sub.store.CreateSub(&sub.SubState); err != nil {
+		return err
+	}
+	sub.lazy.remove(sub)
+	sub.lazy = nil
+	return nil
+}
+
+// persistLazySubs writes all the lazily created subscriptions to the
+// store, so that they are recovered after a restart.
+func (s *StanServer) persistLazySubs() {
+	for _, sub := range s.lazySubs.list() {
+		sub.Lock()
+		if err := s.persistLazySub(sub); err != nil {
+			s.log.Errorf("STAN: [Client:%s] Unable to store subscription on %s: %v",
+				sub.ClientID, sub.subject, err)
+		}
+		sub.Unlock()
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+func TestLazySubs(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.MaxSubscriptions = 2
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	msgs := make(chan *stan.Msg, 10)
+	sub, err := sc.Subscribe("foo", func(m *stan.Msg) { msgs <- m }, stan.DeliverAllAvailable())
+	if err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if n := s.LazySubsCount(); n != 1 {
+		t.Fatalf("Expected 1 lazy sub, got %v", n)
+	}
+	cs := s.store.LookupChannel("foo")
+	if n := cs.Subs.AvailableSubs(); n != 2 {
+		t.Fatalf("Subscription should not be in the store, available subs: %v", n)
+	}
+	// Subscriptions not in the store yet count toward the limit.
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}); err == nil || err.Error() != stores.ErrTooManySubs.Error() {
+		t.Fatalf("Expected error %v, got %v", stores.ErrTooManySubs, err)
+	}
+
+	// The subscriptions are stored when the first message is sent.
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	select {
+	case m := <-msgs:
+		if m.Sequence != 1 {
+			t.Fatalf("Unexpected message: %v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Did not get our message")
+	}
+	waitForCount(t, 0, func() (string, int) {
+		return "lazy subs", s.LazySubsCount()
+	})
+	if n := cs.Subs.AvailableSubs(); n != 0 {
+		t.Fatalf("Subscriptions should be in the store, available subs: %v", n)
+	}
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatalf("Unexpected error on unsubscribe: %v", err)
+	}
+
+	// Subscriptions on channels with messages are stored right away.
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if n := s.LazySubsCount(); n != 0 {
+		t.Fatalf("Expected no lazy sub, got %v", n)
+	}
+}
+
+func TestLazySubsUnsubscribe(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	for _, start := range []stan.SubscriptionOption{stan.StartWithLastReceived(), stan.DeliverAllAvailable()} {
+		sub, err := sc.Subscribe("foo", func(_ *stan.Msg) {}, start)
+		if err != nil {
+			t.Fatalf("Unexpected error on subscribe: %v", err)
+		}
+		if n := s.LazySubsCount(); n != 1 {
+			t.Fatalf("Expected 1 lazy sub, got %v", n)
+		}
+		if err := sub.Unsubscribe(); err != nil {
+			t.Fatalf("Unexpected error on unsubscribe: %v", err)
+		}
+		if n := s.LazySubsCount(); n != 0 {
+			t.Fatalf("Expected no lazy sub, got %v", n)
+		}
+	}
+	// Durable and queue subscriptions are always stored.
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}, stan.DurableName("dur")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if _, err := sc.QueueSubscribe("foo", "group", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if n := s.LazySubsCount(); n != 0 {
+		t.Fatalf("Expected no lazy sub, got %v", n)
+	}
+}
+
+func TestLazySubsStoredOnShutdown(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.StoreType = stores.TypeFile
+	opts.FilestoreDir = defaultDataStore
+	s := runServerWithOpts(opts)
+	defer shutdownRestartedServerOnTestExit(&s)
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if n := s.LazySubsCount(); n != 1 {
+		t.Fatalf("Expected 1 lazy sub, got %v", n)
+	}
+	s.Shutdown()
+
+	s = runServerWithOpts(opts)
+	cs := s.store.LookupChannel("foo")
+	if cs == nil {
+		t.Fatal("Expected channel to be recovered")
+	}
+	ss := cs.UserData.(*subStore)
+	ss.RLock()
+	numSubs := len(ss.psubs)
+	ss.RUnlock()
+	if numSubs != 1 {
+		t.Fatalf("Expected subscription to be recovered, got %v", numSubs)
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+// LimitsOverride overrides the limits of the channels it applies to. Zero
+// values keep the limits resolved at the previous level.
+type LimitsOverride struct {
+	Channels         string        // Channels the limits apply to (a subject, possibly with wildcards for tenants and templates)
+	MaxMsgs          int           // Maximum number of messages per channel
+	MaxBytes         uint64        // Maximum number of bytes used by messages per channel
+	MaxSubscriptions int           // Maximum number of subscriptions per channel
+	MaxInactivity    time.Duration // Time without subscriptions and new messages after which a channel is deleted
+}
+
+// Tenant is a named group of channels sharing limits that override the
+// global ones.
+type Tenant struct {
+	Name string
+	LimitsOverride
+}
+
+// EffectiveLimits are the limits of a channel, returned by
+// StanServer.EffectiveLimits, with the levels that set them.
+type EffectiveLimits struct {
+	MaxMsgs          int           `json:"max_msgs"`
+	MaxBytes         uint64        `json:"max_bytes"`
+	MaxSubscriptions int           `json:"max_subscriptions"`
+	MaxInactivity    time.Duration `json:"max_inactivity"`
+	Tenant           string        `json:"tenant,omitempty"`   // Name of the tenant of the channel, if any
+	Template         string        `json:"template,omitempty"` // Channels of the template applied, if any
+	PerChannel       bool          `json:"per_channel"`        // Whether the channel has its own limits
+}
+
+// limitsResolver composes, in this order, the global limits, the overrides
+// of the first tenant and first template matching a channel, and those of
+// the channel itself.
+type limitsResolver struct {
+	global     stores.ChannelLimits
+	tenants    []*Tenant
+	templates  []*LimitsOverride
+	perChannel map[string]*LimitsOverride
+}
+
+func newLimitsResolver(opts *Options) *limitsResolver {
+	r := &limitsResolver{
+		global:     *getChannelLimits(opts),
+		tenants:    opts.Tenants,
+		templates:  opts.ChannelTemplates,
+		perChannel: make(map[string]*LimitsOverride, len(opts.PerChannelLimits)),
+	}
+	for _, o := range opts.PerChannelLimits {
+		r.perChannel[o.Channels] = o
+	}
+	return r
+}
+
+// hasOverrides returns true if some channels don't use the global limits.
+func (r *limitsResolver) hasOverrides() bool {
+	return len(r.tenants) > 0 || len(r.templates) > 0 || len(r.perChannel) > 0
+}
+
+// apply sets the limits that the override sets.
+func (o *LimitsOverride) apply(limits *EffectiveLimits) {
+	if o.MaxMsgs != 0 {
+		limits.MaxMsgs = o.MaxMsgs
+	}
+	if o.MaxBytes != 0 {
+		limits.MaxBytes = o.MaxBytes
+	}
+	if o.MaxSubscriptions != 0 {
+		limits.MaxSubscriptions = o.MaxSubscriptions
+	}
+	if o.MaxInactivity != 0 {
+		limits.MaxInactivity = o.MaxInactivity
+	}
+}
+
+// resolve returns the limits of the channel.
+func (r *limitsResolver) resolve(channel string) *EffectiveLimits {
+	return r.resolveFrom(r.global, channel)
+}
+
+// resolveFrom returns the limits of the channel, starting from the given
+// global limits.
+func (r *limitsResolver) resolveFrom(global stores.ChannelLimits, channel string) *EffectiveLimits {
+	limits := &EffectiveLimits{
+		MaxMsgs:          global.MaxNumMsgs,
+		MaxBytes:         global.MaxMsgBytes,
+		MaxSubscriptions: global.MaxSubs,
+		MaxInactivity:    global.MaxInactivity,
+	}
+	for _, t := range r.tenants {
+		if util.SubjectMatches(t.Channels, channel) {
+			t.apply(limits)
+			limits.Tenant = t.Name
+			break
+		}
+	}
+	for _, o := range r.templates {
+		if util.SubjectMatches(o.Channels, channel) {
+			o.apply(limits)
+			limits.Template = o.Channels
+			break
+		}
+	}
+	if o := r.perChannel[channel]; o != nil {
+		o.apply(limits)
+		limits.PerChannel = true
+	}
+	return limits
+}
+
+// storeLimits returns the limits of the channel enforced by the store.
+func (r *limitsResolver) storeLimits(channel string) stores.ChannelLimits {
+	limits := r.resolve(channel)
+	storeLimits := r.global
+	storeLimits.MaxNumMsgs = limits.MaxMsgs
+	storeLimits.MaxMsgBytes = limits.MaxBytes
+	storeLimits.MaxSubs = limits.MaxSubscriptions
+	storeLimits.MaxInactivity = limits.MaxInactivity
+	return storeLimits
+}
+
+// maxInactivity returns the MaxInactivity of the channel, given the global
+// one.
+func (r *limitsResolver) maxInactivity(channel string, global time.Duration) time.Duration {
+	if !r.hasOverrides() {
+		return global
+	}
+	limits := r.global
+	limits.MaxInactivity = global
+	return r.resolveFrom(limits, channel).MaxInactivity
+}
+
+// minInactivity returns the smallest MaxInactivity set at any level, 0 if
+// channels are never deleted for inactivity.
+func (r *limitsResolver) minInactivity() time.Duration {
+	min := r.global.MaxInactivity
+	check := func(o *LimitsOverride) {
+		if o.MaxInactivity > 0 && (min == 0 || o.MaxInactivity < min) {
+			min = o.MaxInactivity
+		}
+	}
+	for _, t := range r.tenants {
+		check(&t.LimitsOverride)
+	}
+	for _, o := range r.templates {
+		check(o)
+	}
+	for _, o := range r.perChannel {
+		check(o)
+	}
+	return min
+}
+
+// validateLimitsOverride checks an override for inconsistencies. Wildcards
+// are allowed only if the override applies to several channels.
+func validateLimitsOverride(what string, o *LimitsOverride, wildcards bool) error {
+	valid := util.IsValidSubjectPattern(o.Channels)
+	if !wildcards {
+		valid = valid && isValidSubject(o.Channels)
+	}
+	if !valid {
+		return fmt.Errorf("invalid %s channels %q", what, o.Channels)
+	}
+	if o.MaxMsgs < 0 || o.MaxSubscriptions < 0 || o.MaxInactivity < 0 {
+		return fmt.Errorf("%s limits of %q can't be negative", what, o.Channels)
+	}
+	return nil
+}
+
+// validateLimits checks the tenants, channel templates and per channel
+// limits for inconsistencies.
+func validateLimits(opts *Options) error {
+	names := make(map[string]struct{}, len(opts.Tenants))
+	for _, t := range opts.Tenants {
+		if t.Name == "" {
+			return fmt.Errorf("tenant of channels %q has no name", t.Channels)
+		}
+		if _, dup := names[t.Name]; dup {
+			return fmt.Errorf("duplicate tenant %q", t.Name)
+		}
+		names[t.Name] = struct{}{}
+		if err := validateLimitsOverride("tenant", &t.LimitsOverride, true); err != nil {
+			return err
+		}
+	}
+	for _, o := range opts.ChannelTemplates {
+		if err := validateLimitsOverride("channel template", o, true); err != nil {
+			return err
+		}
+	}
+	channels := make(map[string]struct{}, len(opts.PerChannelLimits))
+	for _, o := range opts.PerChannelLimits {
+		if _, dup := channels[o.Channels]; dup {
+			return fmt.Errorf("duplicate limits for channel %q", o.Channels)
+		}
+		channels[o.Channels] = struct{}{}
+		if err := validateLimitsOverride("channel", o, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EffectiveLimits returns the limits of the channel, whether it exists or
+// not, resolved from the global limits and the overrides of its tenant,
+// channel template and its own.
+func (s *StanServer) EffectiveLimits(channel string) *EffectiveLimits {
+	return s.limits.resolve(channel)
+}
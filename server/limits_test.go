@@ -0,0 +1,119 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+func TestLimitsResolution(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.MaxMsgs = 100
+	opts.MaxInactivity = time.Hour
+	opts.Tenants = []*Tenant{
+		{Name: "acme", LimitsOverride: LimitsOverride{Channels: "acme.>", MaxMsgs: 10, MaxSubscriptions: 5}},
+		{Name: "all", LimitsOverride: LimitsOverride{Channels: ">", MaxBytes: 1024}},
+	}
+	opts.ChannelTemplates = []*LimitsOverride{
+		{Channels: "*.audit", MaxMsgs: 1000},
+		{Channels: "acme.*", MaxInactivity: time.Minute},
+	}
+	opts.PerChannelLimits = []*LimitsOverride{{Channels: "acme.audit", MaxSubscriptions: 1}}
+	if err := validateLimits(opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	r := newLimitsResolver(opts)
+	global := getChannelLimits(opts)
+
+	checks := []struct {
+		channel  string
+		expected EffectiveLimits
+	}{
+		{"foo", EffectiveLimits{100, 1024, global.MaxSubs, time.Hour, "all", "", false}},
+		{"foo.audit", EffectiveLimits{1000, 1024, global.MaxSubs, time.Hour, "all", "*.audit", false}},
+		{"acme.orders", EffectiveLimits{10, global.MaxMsgBytes, 5, time.Minute, "acme", "acme.*", false}},
+		{"acme.orders.eu", EffectiveLimits{10, global.MaxMsgBytes, 5, time.Hour, "acme", "", false}},
+		// The first matching template applies.
+		{"acme.audit", EffectiveLimits{1000, global.MaxMsgBytes, 1, time.Hour, "acme", "*.audit", true}},
+	}
+	for _, c := range checks {
+		if l := r.resolve(c.channel); *l != c.expected {
+			t.Fatalf("Unexpected limits for %q: %+v", c.channel, l)
+		}
+	}
+	if l := r.storeLimits("acme.audit"); l.MaxNumMsgs != 1000 || l.MaxSubs != 1 || l.MaxChannels != global.MaxChannels {
+		t.Fatalf("Unexpected store limits: %+v", l)
+	}
+	if d := r.minInactivity(); d != time.Minute {
+		t.Fatalf("Expected min inactivity of 1m, got %v", d)
+	}
+	if d := r.maxInactivity("foo", 0); d != 0 {
+		t.Fatalf("Expected no inactivity limit, got %v", d)
+	}
+}
+
+func TestChannelLimits(t *testing.T) {
+	clock := util.NewManualClock(time.Now())
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.Clock = clock
+	opts.AdminUsers = []*AdminUser{{Name: "read", Token: util.NewSecret(adminReadToken), Role: RoleReadOnly}}
+	opts.Tenants = []*Tenant{{Name: "acme", LimitsOverride: LimitsOverride{Channels: "acme.>", MaxMsgs: 2}}}
+	opts.ChannelTemplates = []*LimitsOverride{{Channels: "tmp.*", MaxInactivity: time.Minute}}
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	for _, channel := range []string{"acme.orders", "foo", "tmp.foo"} {
+		for i := 0; i < 5; i++ {
+			if err := sc.Publish(channel, []byte("hello")); err != nil {
+				t.Fatalf("Unexpected error on publish: %v", err)
+			}
+		}
+	}
+	if n, _, _ := s.store.MsgsState("acme.orders"); n != 2 {
+		t.Fatalf("Expected 2 messages, got %v", n)
+	}
+	if n, _, _ := s.store.MsgsState("foo"); n != 5 {
+		t.Fatalf("Expected 5 messages, got %v", n)
+	}
+
+	// Only the channel with a MaxInactivity is deleted.
+	clock.Advance(time.Hour)
+	s.deleteInactiveChannels(clock.Now().UnixNano(), 0)
+	if s.store.LookupChannel("tmp.foo") != nil {
+		t.Fatal("Channel tmp.foo should have been deleted")
+	}
+	if s.store.LookupChannel("foo") == nil {
+		t.Fatal("Channel foo should not have been deleted")
+	}
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+	req := &spb.AdminRequest{Token: adminReadToken, Operation: AdminOpChannelLimits, Channel: "acme.orders"}
+	resp := sendAdminRequest(t, nc, req)
+	if resp.Error != "" {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+	limits := &EffectiveLimits{}
+	if err := json.Unmarshal(resp.Data, limits); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if *limits != *s.EffectiveLimits("acme.orders") || limits.MaxMsgs != 2 || limits.Tenant != "acme" {
+		t.Fatalf("Unexpected limits: %+v", limits)
+	}
+	req.Channel = ""
+	if resp := sendAdminRequest(t, nc, req); resp.Error != ErrInvalidAdminReq.Error() {
+		t.Fatalf("Expected error %q, got %q", ErrInvalidAdminReq, resp.Error)
+	}
+}
@@ -3,6 +3,8 @@
 package server
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/nats-io/gnatsd/logger"
 	natsd "github.com/nats-io/gnatsd/server"
 	"os"
@@ -23,19 +25,100 @@ import (
 //
 // All logging functions are fully implemented (versus calling into the NATS
 // server) in case STAN is decoupled from the NATS server.
+//
+// Each server logs with its own logger and debug/trace flags, so that
+// servers running in the same process do not change each other's. This is
+// the logger set with ConfigureLogger, unless the application embedding the
+// server plugs its own with Options.Logger. If it implements FieldLogger, the delivery and redelivery
+// statements give it the client ID, channel and sequence as fields.
+
+// Logger is the interface of the loggers set in Options.Logger. It is used
+// by STAN and the embedded NATS server.
+type Logger interface {
+	Noticef(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+	Debugf(format string, v ...interface{})
+	Tracef(format string, v ...interface{})
+}
+
+// Field is a key/value pair logged along with a statement.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// FieldLogger is implemented by structured loggers, which record the
+// fields of a statement separately from its message. With other loggers,
+// the fields are appended to the message as key=value pairs.
+type FieldLogger interface {
+	Logger
+	DebugFields(msg string, fields []Field)
+	TraceFields(msg string, fields []Field)
+}
 
-// Package globals for performance checks
-var trace int32
-var debug int32
+// pluggedLogger adapts a Logger to the NATS server, whose logger must also
+// log fatal errors.
+type pluggedLogger struct {
+	Logger
+}
 
-// The STAN logger, encapsulates a NATS logger
-var stanLog = struct {
+// Fatalf logs the error and exits.
+func (l *pluggedLogger) Fatalf(format string, v ...interface{}) {
+	l.Errorf(format, v...)
+	os.Exit(1)
+}
+
+// serverLogger is the logger of a server, or the package logger set by
+// ConfigureLogger. Debug and trace statements are only logged if the STAN
+// debug/trace flags it was created with are set.
+type serverLogger struct {
 	sync.Mutex
 	logger natsd.Logger
-}{}
+	fields FieldLogger // logger, if it records fields
+	debug  int32       // for performance checks
+	trace  int32       // for performance checks
+}
+
+// The package logger, encapsulates a NATS logger
+var stanLog = &serverLogger{}
+
+// newServerLogger returns the logger of a server: Options.Logger if set,
+// or else the logger configured by ConfigureLogger. The debug and trace
+// flags are those of the options, so that servers running in the same
+// process do not change each other's.
+func newServerLogger(sOpts *Options) *serverLogger {
+	l := &serverLogger{}
+	if sOpts.Logger != nil {
+		l.set(&pluggedLogger{sOpts.Logger})
+	} else {
+		stanLog.Lock()
+		l.logger, l.fields = stanLog.logger, stanLog.fields
+		stanLog.Unlock()
+	}
+	if sOpts.Debug {
+		l.debug = 1
+	}
+	if sOpts.Trace {
+		l.trace = 1
+	}
+	return l
+}
+
+// set sets the NATS logger, and the field logger if it records fields.
+// Lock held on entry, if needed.
+func (l *serverLogger) set(logger natsd.Logger) {
+	l.logger = logger
+	l.fields = nil
+	if pl, ok := logger.(*pluggedLogger); ok {
+		l.fields, _ = pl.Logger.(FieldLogger)
+	} else if fl, ok := logger.(FieldLogger); ok {
+		l.fields = fl
+	}
+}
 
 // ConfigureLogger configures logging for STAN and the embedded NATS server
-// based on options passed.
+// based on options passed. Servers use this logger unless Options.Logger
+// is set, see RunServerWithOpts.
 func ConfigureLogger(stanOpts *Options, natsOpts *natsd.Options) {
 
 	var s *natsd.Server
@@ -54,7 +137,11 @@ func ConfigureLogger(stanOpts *Options, natsOpts *natsd.Options) {
 	enableDebug := nOpts.Debug || sOpts.Debug
 	enableTrace := nOpts.Trace || sOpts.Trace
 
-	if nOpts.LogFile != "" {
+	if sOpts.Logger != nil {
+		newLogger = &pluggedLogger{sOpts.Logger}
+	} else if sOpts.LogJSON {
+		newLogger = newJSONLogger(nOpts.LogFile, enableDebug, enableTrace)
+	} else if nOpts.LogFile != "" {
 		newLogger = logger.NewFileLogger(nOpts.LogFile, nOpts.Logtime, enableDebug, sOpts.Trace, true)
 	} else if nOpts.RemoteSyslog != "" {
 		newLogger = logger.NewRemoteSysLogger(nOpts.RemoteSyslog, sOpts.Debug, sOpts.Trace)
@@ -71,17 +158,17 @@ func ConfigureLogger(stanOpts *Options, natsOpts *natsd.Options) {
 		newLogger = logger.NewStdLogger(nOpts.Logtime, enableDebug, enableTrace, colors, true)
 	}
 	if sOpts.Debug {
-		atomic.StoreInt32(&debug, 1)
+		atomic.StoreInt32(&stanLog.debug, 1)
 	}
 	if sOpts.Trace {
-		atomic.StoreInt32(&trace, 1)
+		atomic.StoreInt32(&stanLog.trace, 1)
 	}
 
 	// The NATS server will use the STAN logger
 	s.SetLogger(newLogger, nOpts.Debug, nOpts.Trace)
 
 	stanLog.Lock()
-	stanLog.logger = newLogger
+	stanLog.set(newLogger)
 	stanLog.Unlock()
 }
 
@@ -90,11 +177,12 @@ func ConfigureLogger(stanOpts *Options, natsOpts *natsd.Options) {
 func RemoveLogger() {
 	var s *natsd.Server
 
-	atomic.StoreInt32(&trace, 0)
-	atomic.StoreInt32(&debug, 0)
+	atomic.StoreInt32(&stanLog.trace, 0)
+	atomic.StoreInt32(&stanLog.debug, 0)
 
 	stanLog.Lock()
 	stanLog.logger = nil
+	stanLog.fields = nil
 	stanLog.Unlock()
 
 	s.SetLogger(nil, false, false)
@@ -102,48 +190,115 @@ func RemoveLogger() {
 
 // Noticef logs a notice statement
 func Noticef(format string, v ...interface{}) {
-	executeLogCall(func(log natsd.Logger, format string, v ...interface{}) {
+	stanLog.Noticef(format, v...)
+}
+
+// Errorf logs an error
+func Errorf(format string, v ...interface{}) {
+	stanLog.Errorf(format, v...)
+}
+
+// Fatalf logs a fatal error
+func Fatalf(format string, v ...interface{}) {
+	stanLog.Fatalf(format, v...)
+}
+
+// Debugf logs a debug statement
+func Debugf(format string, v ...interface{}) {
+	stanLog.Debugf(format, v...)
+}
+
+// Tracef logs a trace statement
+func Tracef(format string, v ...interface{}) {
+	stanLog.Tracef(format, v...)
+}
+
+// Noticef logs a notice statement
+func (l *serverLogger) Noticef(format string, v ...interface{}) {
+	l.executeLogCall(func(log natsd.Logger, format string, v ...interface{}) {
 		log.Noticef(format, v...)
 	}, format, v...)
 }
 
 // Errorf logs an error
-func Errorf(format string, v ...interface{}) {
-	executeLogCall(func(log natsd.Logger, format string, v ...interface{}) {
+func (l *serverLogger) Errorf(format string, v ...interface{}) {
+	l.executeLogCall(func(log natsd.Logger, format string, v ...interface{}) {
 		log.Errorf(format, v...)
 	}, format, v...)
 }
 
 // Fatalf logs a fatal error
-func Fatalf(format string, v ...interface{}) {
-	executeLogCall(func(log natsd.Logger, format string, v ...interface{}) {
+func (l *serverLogger) Fatalf(format string, v ...interface{}) {
+	l.executeLogCall(func(log natsd.Logger, format string, v ...interface{}) {
 		log.Fatalf(format, v...)
 	}, format, v...)
 }
 
 // Debugf logs a debug statement
-func Debugf(format string, v ...interface{}) {
-	if atomic.LoadInt32(&debug) != 0 {
-		executeLogCall(func(log natsd.Logger, format string, v ...interface{}) {
+func (l *serverLogger) Debugf(format string, v ...interface{}) {
+	if atomic.LoadInt32(&l.debug) != 0 {
+		l.executeLogCall(func(log natsd.Logger, format string, v ...interface{}) {
 			log.Debugf(format, v...)
 		}, format, v...)
 	}
 }
 
 // Tracef logs a trace statement
-func Tracef(format string, v ...interface{}) {
-	if atomic.LoadInt32(&trace) != 0 {
-		executeLogCall(func(logger natsd.Logger, format string, v ...interface{}) {
+func (l *serverLogger) Tracef(format string, v ...interface{}) {
+	if atomic.LoadInt32(&l.trace) != 0 {
+		l.executeLogCall(func(logger natsd.Logger, format string, v ...interface{}) {
 			logger.Tracef(format, v...)
 		}, format, v...)
 	}
 }
 
-func executeLogCall(f func(logger natsd.Logger, format string, v ...interface{}), format string, args ...interface{}) {
-	stanLog.Lock()
-	defer stanLog.Unlock()
-	if stanLog.logger == nil {
+// debugFields logs a debug statement with fields
+func (l *serverLogger) debugFields(msg string, fields ...Field) {
+	if atomic.LoadInt32(&l.debug) != 0 {
+		l.executeFieldsLogCall(func(log FieldLogger) {
+			log.DebugFields(msg, fields)
+		}, func(log natsd.Logger, msg string) {
+			log.Debugf("%s", msg)
+		}, msg, fields)
+	}
+}
+
+// traceFields logs a trace statement with fields
+func (l *serverLogger) traceFields(msg string, fields ...Field) {
+	if atomic.LoadInt32(&l.trace) != 0 {
+		l.executeFieldsLogCall(func(log FieldLogger) {
+			log.TraceFields(msg, fields)
+		}, func(log natsd.Logger, msg string) {
+			log.Tracef("%s", msg)
+		}, msg, fields)
+	}
+}
+
+// executeFieldsLogCall calls fl if the logger records fields, or f with the
+// fields appended to the message otherwise.
+func (l *serverLogger) executeFieldsLogCall(fl func(log FieldLogger), f func(log natsd.Logger, msg string), msg string, fields []Field) {
+	l.Lock()
+	defer l.Unlock()
+	if l.fields != nil {
+		fl(l.fields)
+		return
+	}
+	if l.logger == nil {
+		return
+	}
+	var buf bytes.Buffer
+	buf.WriteString(msg)
+	for _, field := range fields {
+		fmt.Fprintf(&buf, " %s=%v", field.Key, field.Value)
+	}
+	f(l.logger, buf.String())
+}
+
+func (l *serverLogger) executeLogCall(f func(logger natsd.Logger, format string, v ...interface{}), format string, args ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	if l.logger == nil {
 		return
 	}
-	f(stanLog.logger, format, args...)
+	f(l.logger, format, args...)
 }
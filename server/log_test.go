@@ -3,11 +3,16 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	natsd "github.com/nats-io/gnatsd/server"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestConfigureLogger(t *testing.T) {
@@ -15,7 +20,7 @@ func TestConfigureLogger(t *testing.T) {
 	defer RemoveLogger()
 
 	checkDebugTraceOff := func() {
-		if debug != 0 || trace != 0 {
+		if stanLog.debug != 0 || stanLog.trace != 0 {
 			t.Fatalf("Expected debug/trace to be disabled.")
 		}
 	}
@@ -43,7 +48,7 @@ func TestConfigureLogger(t *testing.T) {
 	sOpts.Debug = true
 	sOpts.Trace = true
 	ConfigureLogger(sOpts, &nOpts)
-	if debug == 0 || trace == 0 {
+	if stanLog.debug == 0 || stanLog.trace == 0 {
 		t.Fatalf("Expected debug/trace to be enabled.")
 	}
 
@@ -53,7 +58,7 @@ func TestConfigureLogger(t *testing.T) {
 	sOpts.Debug = true
 	sOpts.Trace = true
 	ConfigureLogger(sOpts, &nOpts)
-	if debug == 0 || trace == 0 {
+	if stanLog.debug == 0 || stanLog.trace == 0 {
 		t.Fatalf("Expected debug/trace to be enabled.")
 	}
 
@@ -186,3 +191,184 @@ func TestLogOutput(t *testing.T) {
 	Tracef("foo")
 	checkLogger("foo")
 }
+
+type fieldsLogger struct {
+	dummyLogger
+	fields []Field
+}
+
+func (l *fieldsLogger) DebugFields(msg string, fields []Field) {
+	l.msg = msg
+	l.fields = fields
+}
+
+func (l *fieldsLogger) TraceFields(msg string, fields []Field) {
+	l.msg = msg
+	l.fields = fields
+}
+
+func TestPluggedLogger(t *testing.T) {
+	defer RemoveLogger()
+
+	sOpts := GetDefaultOptions()
+	sOpts.Debug = true
+	sOpts.Trace = true
+
+	// Fields are appended to the message of loggers not recording them.
+	d := &dummyLogger{}
+	sOpts.Logger = d
+	l := newServerLogger(sOpts)
+	l.Noticef("foo")
+	if d.msg != "foo" {
+		t.Fatalf("Unexpected logger message: %v", d.msg)
+	}
+	l.traceFields("foo", Field{"client", "me"}, Field{"seq", 1})
+	if d.msg != "foo client=me seq=1" {
+		t.Fatalf("Unexpected logger message: %v", d.msg)
+	}
+	// The package logger and its flags are left alone.
+	Noticef("bar")
+	if d.msg != "foo client=me seq=1" {
+		t.Fatalf("Unexpected logger message: %v", d.msg)
+	}
+	if stanLog.debug != 0 || stanLog.trace != 0 {
+		t.Fatalf("Expected debug/trace to be disabled.")
+	}
+
+	fl := &fieldsLogger{}
+	sOpts.Logger = fl
+	l = newServerLogger(sOpts)
+	l.debugFields("foo", Field{"client", "me"}, Field{"seq", 1})
+	if fl.msg != "foo" || !reflect.DeepEqual(fl.fields, []Field{{"client", "me"}, {"seq", 1}}) {
+		t.Fatalf("Unexpected logger message: %v %v", fl.msg, fl.fields)
+	}
+
+	// Debug is NOT set, nothing should be logged.
+	sOpts.Debug = false
+	l = newServerLogger(sOpts)
+	fl.Reset()
+	l.debugFields("foo", Field{"seq", 1})
+	if fl.msg != "" {
+		t.Fatalf("Unexpected logger message: %v", fl.msg)
+	}
+}
+
+func TestServerLoggerFlags(t *testing.T) {
+	defer RemoveLogger()
+
+	d := &dummyLogger{}
+	sOpts := GetDefaultOptions()
+	ConfigureLogger(sOpts, nil)
+	stanLog.Lock()
+	stanLog.logger = d
+	stanLog.Unlock()
+
+	// The server logs with the package logger, with its own flags.
+	sOpts.Debug = true
+	l := newServerLogger(sOpts)
+	l.Debugf("foo")
+	if d.msg != "foo" {
+		t.Fatalf("Unexpected logger message: %v", d.msg)
+	}
+	d.Reset()
+	Debugf("foo")
+	if d.msg != "" {
+		t.Fatalf("Unexpected logger message: %v", d.msg)
+	}
+}
+
+// recordingLogger records the statements logged by a running server.
+type recordingLogger struct {
+	sync.Mutex
+	msgs []string
+}
+
+func (r *recordingLogger) record(format string, args ...interface{}) {
+	r.Lock()
+	r.msgs = append(r.msgs, fmt.Sprintf(format, args...))
+	r.Unlock()
+}
+
+func (r *recordingLogger) Noticef(format string, args ...interface{}) { r.record(format, args...) }
+func (r *recordingLogger) Errorf(format string, args ...interface{})  { r.record(format, args...) }
+func (r *recordingLogger) Debugf(format string, args ...interface{})  { r.record(format, args...) }
+func (r *recordingLogger) Tracef(format string, args ...interface{})  { r.record(format, args...) }
+
+func (r *recordingLogger) logged(msg string) bool {
+	r.Lock()
+	defer r.Unlock()
+	for _, m := range r.msgs {
+		if m == msg {
+			return true
+		}
+	}
+	return false
+}
+
+func TestServerLogger(t *testing.T) {
+	l1, l2 := &recordingLogger{}, &recordingLogger{}
+
+	sOpts := GetDefaultOptions()
+	sOpts.Logger = l1
+	sOpts.Debug = true
+	s1 := RunServerWithOpts(sOpts, nil)
+	defer s1.Shutdown()
+
+	sOpts = GetDefaultOptions()
+	sOpts.ID = "other"
+	sOpts.Logger = l2
+	s2 := RunServerWithOpts(sOpts, nil)
+	defer s2.Shutdown()
+
+	// Each server logs with its own logger and flags.
+	s1.log.Debugf("one")
+	s2.log.Debugf("two")
+	s2.log.Noticef("three")
+	if !l1.logged("one") || l1.logged("three") {
+		t.Fatalf("Unexpected statements: %q", l1.msgs)
+	}
+	if l2.logged("one") || l2.logged("two") || !l2.logged("three") {
+		t.Fatalf("Unexpected statements: %q", l2.msgs)
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	f, err := ioutil.TempFile("", "stan_json_log_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %v", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	l := newJSONLogger(f.Name(), false, true)
+	l.Noticef("Starting %s", "server")
+	l.Debugf("not logged")
+	l.TraceFields("STAN: Sending msg", []Field{{"client", "me"}, {"channel", "foo"}, {"seq", uint64(1)}})
+	l.out.(*os.File).Close()
+
+	content, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("Unable to read log file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 statements, got %q", content)
+	}
+	expected := []map[string]interface{}{
+		{"level": "info", "msg": "Starting server"},
+		{"level": "trace", "msg": "STAN: Sending msg", "client": "me", "channel": "foo", "seq": float64(1)},
+	}
+	for i, line := range lines {
+		m := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("Invalid statement %q: %v", line, err)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, m["time"].(string)); err != nil {
+			t.Fatalf("Invalid time in %q: %v", line, err)
+		}
+		delete(m, "time")
+		if !reflect.DeepEqual(m, expected[i]) {
+			t.Fatalf("Unexpected statement: %v", m)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package longrun
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+// errInjected is the error of the message store writes failed on purpose.
+var errInjected = errors.New("longrun: injected store fault")
+
+// faultStore is a Store whose message stores fail writes at random, with
+// the given rate. The server gets the same ChannelStore for a channel from
+// all the calls, as with the wrapped store.
+type faultStore struct {
+	stores.Store
+	sync.Mutex
+	rate     float64
+	rnd      *rand.Rand
+	faults   *uint64 // faults injected, updated atomically
+	channels map[*stores.ChannelStore]*stores.ChannelStore
+}
+
+// newFaultStore returns the store wrapping s.
+func newFaultStore(s stores.Store, rate float64, seed int64, faults *uint64) *faultStore {
+	return &faultStore{
+		Store:    s,
+		rate:     rate,
+		rnd:      rand.New(rand.NewSource(seed)),
+		faults:   faults,
+		channels: make(map[*stores.ChannelStore]*stores.ChannelStore),
+	}
+}
+
+// wrap returns the ChannelStore given to the server for cs.
+func (fs *faultStore) wrap(cs *stores.ChannelStore) *stores.ChannelStore {
+	if cs == nil {
+		return nil
+	}
+	fs.Lock()
+	defer fs.Unlock()
+	w := fs.channels[cs]
+	if w == nil {
+		w = &stores.ChannelStore{
+			UserData: cs.UserData,
+			Subs:     cs.Subs,
+			Msgs:     &faultMsgStore{MsgStore: cs.Msgs, fs: fs},
+		}
+		fs.channels[cs] = w
+	}
+	return w
+}
+
+// fail returns true if the next write must fail.
+func (fs *faultStore) fail() bool {
+	fs.Lock()
+	f := fs.rnd.Float64() < fs.rate
+	fs.Unlock()
+	if f {
+		atomic.AddUint64(fs.faults, 1)
+	}
+	return f
+}
+
+func (fs *faultStore) CreateChannel(channel string, userData interface{}) (*stores.ChannelStore, bool, error) {
+	cs, isNew, err := fs.Store.CreateChannel(channel, userData)
+	return fs.wrap(cs), isNew, err
+}
+
+func (fs *faultStore) LookupChannel(channel string) *stores.ChannelStore {
+	return fs.wrap(fs.Store.LookupChannel(channel))
+}
+
+func (fs *faultStore) GetChannels() map[string]*stores.ChannelStore {
+	channels := fs.Store.GetChannels()
+	for name, cs := range channels {
+		channels[name] = fs.wrap(cs)
+	}
+	return channels
+}
+
+func (fs *faultStore) DeleteChannel(channel string) error {
+	if cs := fs.Store.LookupChannel(channel); cs != nil {
+		fs.Lock()
+		delete(fs.channels, cs)
+		fs.Unlock()
+	}
+	return fs.Store.DeleteChannel(channel)
+}
+
+// faultMsgStore is a MsgStore failing writes at the rate of its store.
+type faultMsgStore struct {
+	stores.MsgStore
+	fs *faultStore
+}
+
+func (ms *faultMsgStore) Store(reply string, data []byte) (*spb.MsgProto, error) {
+	if ms.fs.fail() {
+		return nil, errInjected
+	}
+	return ms.MsgStore.Store(reply, data)
+}
+
+func (ms *faultMsgStore) StoreMsg(m *spb.MsgProto) (*spb.MsgProto, error) {
+	if ms.fs.fail() {
+		return nil, errInjected
+	}
+	return ms.MsgStore.StoreMsg(m)
+}
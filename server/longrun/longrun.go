@@ -0,0 +1,450 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package longrun
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	natsd "github.com/nats-io/gnatsd/server"
+	natsdTest "github.com/nats-io/gnatsd/test"
+	"github.com/nats-io/go-nats-streaming"
+	stand "github.com/nats-io/nats-streaming-server/server"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+const (
+	clusterID = "longrun"
+
+	// Durable name of the subscribers.
+	durableName = "longrun"
+
+	// Ack wait of the subscribers, and how long publishers wait for
+	// the acks of the server.
+	ackWait    = 2 * time.Second
+	pubAckWait = 2 * time.Second
+
+	// How long the NATS Server stays down when bounced.
+	bounceDowntime = time.Second
+
+	// Only the first violations are reported.
+	maxViolations = 100
+)
+
+// Config defines the workload and the faults of a run.
+type Config struct {
+	Duration        time.Duration                            // How long the workload runs
+	Seed            int64                                    // Seed of the random choices (0 to use the current time)
+	Dir             string                                   // Directory of the FILE store (empty for a temporary one)
+	NATSPort        int                                      // Port of the NATS Server
+	Channels        int                                      // Number of channels
+	Publishers      int                                      // Number of publishers, each publishing to random channels
+	Subscribers     int                                      // Number of durable subscribers per channel
+	PublishInterval time.Duration                            // Mean time between two messages of a publisher
+	RestartInterval time.Duration                            // Mean time between restarts of the streaming server (0 to disable)
+	BounceInterval  time.Duration                            // Mean time between restarts of the NATS Server (0 to disable)
+	StoreFaultRate  float64                                  // Probability for a message store write to fail (0 to disable)
+	SettleTimeout   time.Duration                            // Time given to subscribers, once the workload stops, to receive all messages
+	Logf            func(format string, args ...interface{}) // Progress logger (nil for none)
+}
+
+// DefaultConfig returns the configuration of the nightly runs, with all
+// the faults enabled.
+func DefaultConfig() Config {
+	return Config{
+		Duration:        time.Hour,
+		NATSPort:        4222,
+		Channels:        10,
+		Publishers:      4,
+		Subscribers:     3,
+		PublishInterval: 10 * time.Millisecond,
+		RestartInterval: time.Minute,
+		BounceInterval:  3 * time.Minute,
+		StoreFaultRate:  0.001,
+		SettleTimeout:   time.Minute,
+	}
+}
+
+// Report is the outcome of a run. The run succeeded if there is no
+// violation: every message acknowledged to its publisher was received by
+// all the subscribers of its channel, in order, and received again only
+// as a redelivery of the same message.
+type Report struct {
+	Seed        int64    // Seed of the run
+	Published   uint64   // Messages acknowledged to their publisher
+	PubErrors   uint64   // Failed publishes, whose messages may or may not be delivered
+	Received    uint64   // Messages received by the subscribers, including redeliveries
+	Redelivered uint64   // Messages received with the redelivered flag
+	Restarts    int      // Restarts of the streaming server
+	Bounces     int      // Restarts of the NATS Server
+	StoreFaults uint64   // Message store writes failed on purpose
+	Violations  []string // First violations of the invariants
+}
+
+// run is the state of a run.
+type run struct {
+	cfg    Config
+	rep    Report
+	sOpts  *stand.Options
+	nOpts  natsd.Options
+	url    string
+	faults uint64 // updated atomically
+
+	srvMu sync.Mutex
+	ss    *stand.StanServer
+	ns    *natsd.Server
+
+	sync.Mutex
+	acked      map[string]map[string]struct{} // payloads acknowledged, by channel
+	subs       []*subscriber
+	violations int
+}
+
+// subscriber is the state of a durable subscription.
+type subscriber struct {
+	name    string
+	channel string
+	sync.Mutex
+	bySeq    map[uint64]string   // payload received for each sequence
+	seqs     map[string]uint64   // sequence of each payload received
+	received map[string]struct{} // payloads received
+	lastNew  uint64              // highest sequence received without the redelivered flag
+}
+
+// Run runs the workload with the configured faults, then checks that no
+// message has been lost or duplicated beyond the at-least-once semantics.
+// An error is returned if the run can't be started.
+func Run(cfg Config) (*Report, error) {
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+	r := &run{
+		cfg:   cfg,
+		rep:   Report{Seed: cfg.Seed},
+		acked: make(map[string]map[string]struct{}),
+	}
+	dir := cfg.Dir
+	if dir == "" {
+		var err error
+		if dir, err = ioutil.TempDir("", "longrun"); err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+	}
+	r.nOpts = natsdTest.DefaultTestOptions
+	r.nOpts.Port = cfg.NATSPort
+	r.url = fmt.Sprintf("nats://%s:%d", r.nOpts.Host, r.nOpts.Port)
+	r.sOpts = stand.GetDefaultOptions()
+	r.sOpts.ID = clusterID
+	r.sOpts.StoreType = stores.TypeFile
+	r.sOpts.FilestoreDir = dir
+	r.sOpts.NATSServerURL = r.url
+	if cfg.StoreFaultRate > 0 {
+		restarts := int64(0)
+		r.sOpts.StoreWrapper = func(s stores.Store) stores.Store {
+			restarts++
+			return newFaultStore(s, cfg.StoreFaultRate, cfg.Seed+restarts, &r.faults)
+		}
+	}
+	r.logf("Starting run with seed %v", cfg.Seed)
+	r.ns = natsdTest.RunServer(&r.nOpts)
+	r.ss = r.runServer()
+	defer func() {
+		r.srvMu.Lock()
+		r.ss.Shutdown()
+		r.ns.Shutdown()
+		r.srvMu.Unlock()
+	}()
+
+	var conns []stan.Conn
+	defer func() {
+		for _, sc := range conns {
+			sc.Close()
+		}
+	}()
+	for c := 0; c < cfg.Channels; c++ {
+		channel := fmt.Sprintf("longrun.%d", c)
+		r.acked[channel] = make(map[string]struct{})
+		for i := 0; i < cfg.Subscribers; i++ {
+			sub := &subscriber{
+				name:     fmt.Sprintf("longrun-sub-%d-%d", c, i),
+				channel:  channel,
+				bySeq:    make(map[uint64]string),
+				seqs:     make(map[string]uint64),
+				received: make(map[string]struct{}),
+			}
+			sc, err := r.subscribe(sub)
+			if err != nil {
+				return nil, err
+			}
+			conns = append(conns, sc)
+			r.subs = append(r.subs, sub)
+		}
+	}
+	pubs := make([]stan.Conn, cfg.Publishers)
+	for i := range pubs {
+		sc, err := stan.Connect(clusterID, fmt.Sprintf("longrun-pub-%d", i), stan.NatsURL(r.url), stan.PubAckWait(pubAckWait))
+		if err != nil {
+			return nil, err
+		}
+		conns = append(conns, sc)
+		pubs[i] = sc
+	}
+
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, sc := range pubs {
+		wg.Add(1)
+		go r.publish(i, sc, quit, &wg)
+	}
+	wg.Add(1)
+	go r.chaos(quit, &wg)
+	r.progress(time.After(cfg.Duration))
+	close(quit)
+	wg.Wait()
+
+	r.logf("Workload stopped, waiting for subscribers to receive all messages")
+	r.settle()
+	r.Lock()
+	defer r.Unlock()
+	rep := &Report{
+		Seed:        cfg.Seed,
+		Published:   atomic.LoadUint64(&r.rep.Published),
+		PubErrors:   atomic.LoadUint64(&r.rep.PubErrors),
+		Received:    atomic.LoadUint64(&r.rep.Received),
+		Redelivered: atomic.LoadUint64(&r.rep.Redelivered),
+		Restarts:    r.rep.Restarts,
+		Bounces:     r.rep.Bounces,
+		StoreFaults: atomic.LoadUint64(&r.faults),
+		Violations:  r.rep.Violations,
+	}
+	if r.violations > maxViolations {
+		rep.Violations = append(rep.Violations, fmt.Sprintf("... and %d more violations", r.violations-maxViolations))
+	}
+	return rep, nil
+}
+
+func (r *run) logf(format string, args ...interface{}) {
+	if r.cfg.Logf != nil {
+		r.cfg.Logf(format, args...)
+	}
+}
+
+// runServer starts the streaming server.
+func (r *run) runServer() *stand.StanServer {
+	opts := *r.sOpts
+	return stand.RunServerWithOpts(&opts, nil)
+}
+
+// violation records a violation of the invariants.
+func (r *run) violation(format string, args ...interface{}) {
+	r.Lock()
+	defer r.Unlock()
+	r.violations++
+	if r.violations <= maxViolations {
+		r.rep.Violations = append(r.rep.Violations, fmt.Sprintf(format, args...))
+	}
+}
+
+// progress logs the counters every minute, until done.
+func (r *run) progress(done <-chan time.Time) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			r.srvMu.Lock()
+			restarts, bounces := r.rep.Restarts, r.rep.Bounces
+			r.srvMu.Unlock()
+			r.Lock()
+			violations := r.violations
+			r.Unlock()
+			r.logf("Published=%v PubErrors=%v Received=%v Redelivered=%v Restarts=%v Bounces=%v StoreFaults=%v Violations=%v",
+				atomic.LoadUint64(&r.rep.Published), atomic.LoadUint64(&r.rep.PubErrors),
+				atomic.LoadUint64(&r.rep.Received), atomic.LoadUint64(&r.rep.Redelivered),
+				restarts, bounces, atomic.LoadUint64(&r.faults), violations)
+		}
+	}
+}
+
+// jitter returns a random duration between half and one and a half
+// times d.
+func jitter(rnd *rand.Rand, d time.Duration) time.Duration {
+	return d/2 + time.Duration(rnd.Int63n(int64(d)+1))
+}
+
+// publish publishes messages to random channels until quit is closed.
+// The payload identifies the channel, the publisher and the message.
+func (r *run) publish(id int, sc stan.Conn, quit chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	rnd := rand.New(rand.NewSource(r.cfg.Seed + int64(id)))
+	for n := 1; ; n++ {
+		select {
+		case <-quit:
+			return
+		case <-time.After(jitter(rnd, r.cfg.PublishInterval)):
+		}
+		channel := fmt.Sprintf("longrun.%d", rnd.Intn(r.cfg.Channels))
+		payload := fmt.Sprintf("%s:%d:%d", channel, id, n)
+		if err := sc.Publish(channel, []byte(payload)); err != nil {
+			atomic.AddUint64(&r.rep.PubErrors, 1)
+			continue
+		}
+		atomic.AddUint64(&r.rep.Published, 1)
+		r.Lock()
+		r.acked[channel][payload] = struct{}{}
+		r.Unlock()
+	}
+}
+
+// subscribe connects the subscriber and creates its durable subscription.
+func (r *run) subscribe(sub *subscriber) (stan.Conn, error) {
+	sc, err := stan.Connect(clusterID, sub.name, stan.NatsURL(r.url))
+	if err != nil {
+		return nil, err
+	}
+	_, err = sc.Subscribe(sub.channel, func(m *stan.Msg) { r.processMsg(sub, m) },
+		stan.DurableName(durableName), stan.DeliverAllAvailable(), stan.AckWait(ackWait))
+	if err != nil {
+		sc.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+// processMsg checks a message received by the subscriber.
+func (r *run) processMsg(sub *subscriber, m *stan.Msg) {
+	atomic.AddUint64(&r.rep.Received, 1)
+	if m.Redelivered {
+		atomic.AddUint64(&r.rep.Redelivered, 1)
+	}
+	payload := string(m.Data)
+	if !strings.HasPrefix(payload, sub.channel+":") {
+		r.violation("%s received %q with sequence %d", sub.name, payload, m.Sequence)
+		return
+	}
+	// The violation is recorded once the subscriber is unlocked, since
+	// the run is locked first when checking for missing messages.
+	if v := sub.check(m.Sequence, payload, m.Redelivered); v != "" {
+		r.violation("%s", v)
+	}
+}
+
+// check records a message received by the subscriber and returns the
+// violation it causes, if any.
+func (sub *subscriber) check(seq uint64, payload string, redelivered bool) string {
+	sub.Lock()
+	defer sub.Unlock()
+	if prev, ok := sub.bySeq[seq]; ok {
+		if prev != payload {
+			return fmt.Sprintf("%s received %q and %q with sequence %d", sub.name, prev, payload, seq)
+		}
+		if !redelivered {
+			return fmt.Sprintf("%s received %q again with sequence %d, without the redelivered flag", sub.name, payload, seq)
+		}
+		return ""
+	}
+	sub.bySeq[seq] = payload
+	sub.received[payload] = struct{}{}
+	if prev, ok := sub.seqs[payload]; ok {
+		return fmt.Sprintf("%s received %q with sequences %d and %d", sub.name, payload, prev, seq)
+	}
+	sub.seqs[payload] = seq
+	if !redelivered {
+		if seq < sub.lastNew {
+			return fmt.Sprintf("%s received sequence %d after %d", sub.name, seq, sub.lastNew)
+		}
+		sub.lastNew = seq
+	}
+	return ""
+}
+
+// chaos restarts the streaming server and the NATS Server at random
+// times until quit is closed. Both are running when it returns.
+func (r *run) chaos(quit chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	if r.cfg.RestartInterval <= 0 && r.cfg.BounceInterval <= 0 {
+		return
+	}
+	rnd := rand.New(rand.NewSource(r.cfg.Seed))
+	var restart, bounce <-chan time.Time
+	if r.cfg.RestartInterval > 0 {
+		restart = time.After(jitter(rnd, r.cfg.RestartInterval))
+	}
+	if r.cfg.BounceInterval > 0 {
+		bounce = time.After(jitter(rnd, r.cfg.BounceInterval))
+	}
+	for {
+		select {
+		case <-quit:
+			return
+		case <-restart:
+			r.srvMu.Lock()
+			r.ss.Shutdown()
+			r.ss = r.runServer()
+			r.rep.Restarts++
+			r.srvMu.Unlock()
+			restart = time.After(jitter(rnd, r.cfg.RestartInterval))
+		case <-bounce:
+			r.srvMu.Lock()
+			r.ns.Shutdown()
+			time.Sleep(bounceDowntime)
+			r.ns = natsdTest.RunServer(&r.nOpts)
+			r.rep.Bounces++
+			r.srvMu.Unlock()
+			bounce = time.After(jitter(rnd, r.cfg.BounceInterval))
+		}
+	}
+}
+
+// settle waits for the subscribers to receive all the acknowledged
+// messages, and records the missing ones as violations.
+func (r *run) settle() {
+	deadline := time.Now().Add(r.cfg.SettleTimeout)
+	for {
+		missing := r.missing()
+		if len(missing) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			for _, m := range missing {
+				r.violation("%s", m)
+			}
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// missing describes, for each subscriber, the acknowledged messages it has
+// not received.
+func (r *run) missing() []string {
+	r.Lock()
+	defer r.Unlock()
+	var missing []string
+	for _, sub := range r.subs {
+		sub.Lock()
+		count, first := 0, ""
+		for payload := range r.acked[sub.channel] {
+			if _, ok := sub.received[payload]; !ok {
+				if count == 0 {
+					first = payload
+				}
+				count++
+			}
+		}
+		sub.Unlock()
+		if count > 0 {
+			missing = append(missing, fmt.Sprintf("%s did not receive %d messages, such as %q", sub.name, count, first))
+		}
+	}
+	return missing
+}
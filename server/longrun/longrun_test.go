@@ -0,0 +1,63 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package longrun
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+var (
+	longrunDuration = flag.Duration("longrun.duration", 0, "Duration of TestLongRun (0 to skip it)")
+	longrunSeed     = flag.Int64("longrun.seed", 0, "Seed of TestLongRun (0 for a random one)")
+)
+
+func checkReport(t *testing.T, rep *Report) {
+	t.Logf("Seed=%v Published=%v PubErrors=%v Received=%v Redelivered=%v Restarts=%v Bounces=%v StoreFaults=%v",
+		rep.Seed, rep.Published, rep.PubErrors, rep.Received, rep.Redelivered, rep.Restarts, rep.Bounces, rep.StoreFaults)
+	for _, v := range rep.Violations {
+		t.Errorf("%s", v)
+	}
+}
+
+// TestLongRun is meant for nightly runs, such as:
+//
+//	go test ./server/longrun -run TestLongRun -longrun.duration 4h -timeout 5h
+func TestLongRun(t *testing.T) {
+	if *longrunDuration == 0 {
+		t.Skip("Set -longrun.duration to run")
+	}
+	cfg := DefaultConfig()
+	cfg.Duration = *longrunDuration
+	cfg.Seed = *longrunSeed
+	cfg.Logf = t.Logf
+	rep, err := Run(cfg)
+	if err != nil {
+		t.Fatalf("Unable to run: %v", err)
+	}
+	checkReport(t, rep)
+}
+
+func TestShortRun(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+	cfg := DefaultConfig()
+	cfg.Duration = 5 * time.Second
+	cfg.Channels = 3
+	cfg.Publishers = 2
+	cfg.Subscribers = 2
+	cfg.RestartInterval = 2 * time.Second
+	cfg.BounceInterval = 3 * time.Second
+	cfg.StoreFaultRate = 0.01
+	cfg.SettleTimeout = 20 * time.Second
+	rep, err := Run(cfg)
+	if err != nil {
+		t.Fatalf("Unable to run: %v", err)
+	}
+	if rep.Published == 0 || rep.Restarts == 0 || rep.Bounces == 0 {
+		t.Fatalf("Unexpected report: %+v", rep)
+	}
+	checkReport(t, rep)
+}
@@ -0,0 +1,69 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+// capMaxInFlight returns the given MaxInFlight, capped by
+// Options.MaxInflightPerSub if set.
+func (s *StanServer) capMaxInFlight(maxInFlight int32) int32 {
+	if max := int32(s.opts.MaxInflightPerSub); max > 0 && maxInFlight > max {
+		return max
+	}
+	return maxInFlight
+}
+
+// setSubMaxInFlight changes the MaxInFlight of the subscription, capped by
+// Options.MaxInflightPerSub. The new value is persisted. If the window
+// grows, the messages that can now be sent are sent right away, otherwise
+// no message is sent until enough are acknowledged.
+func (s *StanServer) setSubMaxInFlight(sub *subState, maxInFlight int32) error {
+	if sub == nil {
+		return ErrInvalidSub
+	}
+	if maxInFlight <= 0 {
+		return ErrInvalidMaxInFlight
+	}
+	maxInFlight = s.capMaxInFlight(maxInFlight)
+	sub.Lock()
+	grows := maxInFlight > sub.MaxInFlight
+	sub.MaxInFlight = maxInFlight
+	if int32(len(sub.acksPending)) < maxInFlight {
+		sub.stalled = false
+	}
+	// Subscriptions not written to the store yet will be with the new value.
+	var err error
+	if sub.lazy == nil {
+		err = sub.store.UpdateSub(&sub.SubState)
+	}
+	subject := sub.subject
+	qs := sub.qstate
+	// The client of an offline durable is cleared.
+	online := sub.ClientID != ""
+	s.log.Debugf("STAN: [Client:%s] Subscription on %s MaxInFlight=%v", sub.ClientID, subject, maxInFlight)
+	sub.Unlock()
+	if err != nil {
+		return err
+	}
+	if !grows || !online {
+		return nil
+	}
+	if cs := s.store.LookupChannel(subject); cs != nil {
+		if qs != nil {
+			s.sendAvailableMessagesToQueue(cs, qs)
+		} else {
+			s.sendAvailableMessages(cs, sub)
+		}
+	}
+	return nil
+}
+
+// SetMaxInFlight changes the MaxInFlight of the subscription with the given
+// ack inbox on the channel.
+func (s *StanServer) SetMaxInFlight(channel, ackInbox string, maxInFlight int32) error {
+	return s.setSubMaxInFlight(s.lookupSubByAckInbox(channel, ackInbox), maxInFlight)
+}
+
+// SetDurableMaxInFlight changes the MaxInFlight of the durable, whether its
+// client is connected or not.
+func (s *StanServer) SetDurableMaxInFlight(channel, clientID, durableName string, maxInFlight int32) error {
+	return s.setSubMaxInFlight(s.lookupDurable(channel, clientID, durableName), maxInFlight)
+}
@@ -0,0 +1,142 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// checkReceived checks that exactly count messages are received.
+func checkReceived(t *testing.T, ch chan *stan.Msg, count int) {
+	for i := 0; i < count; i++ {
+		select {
+		case <-ch:
+		case <-time.After(2 * time.Second):
+			stackFatalf(t, "Expected %v messages, got %v", count, i)
+		}
+	}
+	select {
+	case m := <-ch:
+		stackFatalf(t, "Unexpected message %v", m.Sequence)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMaxInflightPerSub(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.MaxInflightPerSub = 2
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	for i := 0; i < 5; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	// The messages are never acknowledged.
+	ch := make(chan *stan.Msg, 10)
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) { ch <- m },
+		stan.DeliverAllAvailable(), stan.MaxInflight(10), stan.SetManualAckMode()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	checkReceived(t, ch, 2)
+	if states, _ := s.SubscriptionsState("foo", ""); len(states) != 1 || states[0].MaxInFlight != 2 {
+		t.Fatalf("Unexpected subscriptions: %+v", states)
+	}
+
+	// A subscription request without MaxInFlight is rejected.
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+	req := &spb.SubscriptionRequest{
+		ClientID:      clientName,
+		Subject:       "foo",
+		Inbox:         nats.NewInbox(),
+		AckWaitInSecs: 30,
+	}
+	b, _ := req.Marshal()
+	reply, err := nc.Request(s.info.Subscribe, b, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error on subscription request: %v", err)
+	}
+	resp := &spb.SubscriptionResponse{}
+	resp.Unmarshal(reply.Data)
+	if resp.Error != ErrInvalidMaxInFlight.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidMaxInFlight, resp.Error)
+	}
+}
+
+func TestAdminSetMaxInflight(t *testing.T) {
+	s := runServerWithAdminUsers()
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	for i := 0; i < 5; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	ch := make(chan *stan.Msg, 10)
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) { ch <- m },
+		stan.DeliverAllAvailable(), stan.MaxInflight(1), stan.SetManualAckMode()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	checkReceived(t, ch, 1)
+	states, _ := s.SubscriptionsState("foo", "")
+	if len(states) != 1 {
+		t.Fatalf("Expected 1 subscription, got %v", len(states))
+	}
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+	req := &spb.AdminRequest{Token: adminOperatorToken, Operation: AdminOpSetMaxInflight,
+		Channel: "foo", AckInbox: states[0].AckInbox, MaxInFlight: 3}
+	if resp := sendAdminRequest(t, nc, req); resp.Error != "" {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+	// The messages fitting in the larger window are sent right away.
+	checkReceived(t, ch, 2)
+
+	req.MaxInFlight = 0
+	if resp := sendAdminRequest(t, nc, req); resp.Error != ErrInvalidMaxInFlight.Error() {
+		t.Fatalf("Expected error %q, got %q", ErrInvalidMaxInFlight, resp.Error)
+	}
+	req.MaxInFlight, req.AckInbox = 3, "unknown"
+	if resp := sendAdminRequest(t, nc, req); resp.Error != ErrInvalidSub.Error() {
+		t.Fatalf("Expected error %q, got %q", ErrInvalidSub, resp.Error)
+	}
+	req.Token = adminReadToken
+	if resp := sendAdminRequest(t, nc, req); resp.Error != ErrAdminForbidden.Error() {
+		t.Fatalf("Expected error %q, got %q", ErrAdminForbidden, resp.Error)
+	}
+
+	// The durable of a closed client.
+	if _, err := sc.Subscribe("bar", func(_ *stan.Msg) {}, stan.DurableName("dur")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	sc.Close()
+	if err := s.SetDurableMaxInFlight("bar", clientName, "dur", 5); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sub := s.lookupDurable("bar", clientName, "dur")
+	sub.RLock()
+	maxInFlight := sub.MaxInFlight
+	sub.RUnlock()
+	if maxInFlight != 5 {
+		t.Fatalf("Expected MaxInFlight 5, got %v", maxInFlight)
+	}
+}
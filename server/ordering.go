@@ -0,0 +1,91 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"errors"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+var (
+	// ErrOrderingGroupsDisabled is returned when publishing in an ordering
+	// group while Options.MaxOrderingGroups is not set.
+	ErrOrderingGroupsDisabled = errors.New("stan: ordering groups are disabled")
+	// ErrTooManyOrderingGroups is returned when publishing in a new ordering
+	// group while Options.MaxOrderingGroups is reached.
+	ErrTooManyOrderingGroups = errors.New("stan: too many ordering groups")
+)
+
+// orderingGroups are the last group sequences assigned, keyed by ordering
+// group. They are only accessed from the store IO loop, once recovered.
+type orderingGroups map[string]uint64
+
+// recoverOrderingGroups rebuilds the last sequence of each ordering group
+// from those recorded in the store and the messages still stored, in all
+// channels, the ones of the last batch before a crash being possibly stored
+// but not recorded.
+func (s *StanServer) recoverOrderingGroups(recorded map[string]uint64) {
+	if s.opts.MaxOrderingGroups <= 0 {
+		return
+	}
+	s.groups = make(orderingGroups, len(recorded))
+	s.groupsToStore = make(orderingGroups)
+	for group, seq := range recorded {
+		s.groups[group] = seq
+	}
+	for _, cs := range s.store.GetChannels() {
+		first, last := cs.Msgs.FirstAndLastSequence()
+		if first == 0 {
+			continue
+		}
+		msgs := cs.Msgs.LookupRange(first, last)
+		for m := msgs.Next(); m != nil; m = msgs.Next() {
+			if m.OrderingGroup != "" && m.GroupSequence > s.groups[m.OrderingGroup] {
+				s.groups[m.OrderingGroup] = m.GroupSequence
+			}
+		}
+	}
+	if len(s.groups) > 0 {
+		s.log.Noticef("STAN: Recovered %d ordering groups", len(s.groups))
+	}
+}
+
+// nextGroupSequence returns the sequence to assign to the next message
+// published in the given ordering group. The sequence is recorded by
+// the caller once the message is stored.
+func (s *StanServer) nextGroupSequence(group string) (uint64, error) {
+	if s.groups == nil {
+		return 0, ErrOrderingGroupsDisabled
+	}
+	last, ok := s.groups[group]
+	if !ok && len(s.groups) >= s.opts.MaxOrderingGroups {
+		return 0, ErrTooManyOrderingGroups
+	}
+	return last + 1, nil
+}
+
+// assignAndStoreInGroup stores a message published in an ordering group,
+// with the next sequence of this group.
+func (s *StanServer) assignAndStoreInGroup(pm *spb.PubMsg) (*stores.ChannelStore, error) {
+	seq, err := s.nextGroupSequence(pm.OrderingGroup)
+	if err != nil {
+		return nil, err
+	}
+	cs, err := s.lookupOrCreateChannel(pm.Subject)
+	if err != nil {
+		return nil, err
+	}
+	m := &spb.MsgProto{Reply: pm.Reply, Data: pm.Data, Headers: pm.Headers, Guid: pm.Guid,
+		OrderingGroup: pm.OrderingGroup, GroupSequence: seq}
+	first := cs.Msgs.FirstSequence()
+	if _, err := cs.Msgs.StoreMsg(m); err != nil {
+		return nil, err
+	}
+	s.checkStoreFull(pm.Subject, cs, first)
+	s.groups[pm.OrderingGroup] = seq
+	s.groupsToStore[pm.OrderingGroup] = seq
+	cs.UserData.(*subStore).touch(s.clock.Now().UnixNano())
+	return cs, nil
+}
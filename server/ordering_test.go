@@ -0,0 +1,175 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/errcode"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nuid"
+)
+
+func publishInGroup(t *testing.T, s *StanServer, nc *nats.Conn, channel, group string) *spb.PubAck {
+	pm := &spb.PubMsg{ClientID: clientName, Guid: nuid.Next(), Subject: channel,
+		Data: []byte("hello"), OrderingGroup: group}
+	b, _ := pm.Marshal()
+	reply, err := nc.Request(s.info.Publish+"."+channel, b, 5*time.Second)
+	if err != nil {
+		stackFatalf(t, "Unexpected error on publish: %v", err)
+	}
+	pa := &spb.PubAck{}
+	if err := pa.Unmarshal(reply.Data); err != nil {
+		stackFatalf(t, "Unexpected error on unmarshal: %v", err)
+	}
+	return pa
+}
+
+func checkGroupSequences(t *testing.T, ch chan *spb.MsgProto, group string, expected ...uint64) {
+	for _, seq := range expected {
+		select {
+		case m := <-ch:
+			if m.OrderingGroup != group || m.GroupSequence != seq {
+				stackFatalf(t, "Expected group %q sequence %v, got %q %v", group, seq, m.OrderingGroup, m.GroupSequence)
+			}
+		case <-time.After(2 * time.Second):
+			stackFatalf(t, "Did not receive the message")
+		}
+	}
+}
+
+func TestOrderingGroups(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.StoreType = stores.TypeFile
+	opts.FilestoreDir = defaultDataStore
+	opts.MaxOrderingGroups = 2
+	s := runServerWithOpts(opts)
+	defer shutdownRestartedServerOnTestExit(&s)
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	foo := subscribeRawMsgs(t, nc, s, &spb.SubscriptionRequest{Subject: "foo"})
+	bar := subscribeRawMsgs(t, nc, s, &spb.SubscriptionRequest{Subject: "bar"})
+
+	// The group sequence spans both channels.
+	for _, channel := range []string{"foo", "bar", "foo", "bar"} {
+		if pa := publishInGroup(t, s, nc, channel, "g1"); pa.Error != "" {
+			t.Fatalf("Unexpected error on publish: %v", pa.Error)
+		}
+	}
+	checkGroupSequences(t, foo, "g1", 1, 3)
+	checkGroupSequences(t, bar, "g1", 2, 4)
+
+	// Messages published outside of a group have no group sequence.
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	checkGroupSequences(t, foo, "", 0)
+
+	if pa := publishInGroup(t, s, nc, "foo", "g2"); pa.Error != "" {
+		t.Fatalf("Unexpected error on publish: %v", pa.Error)
+	}
+	checkGroupSequences(t, foo, "g2", 1)
+	pa := publishInGroup(t, s, nc, "bar", "g3")
+	if pa.Error != ErrTooManyOrderingGroups.Error() {
+		t.Fatalf("Expected error %v, got %q", ErrTooManyOrderingGroups, pa.Error)
+	}
+	if errcode.Code(pa.ErrorCode) != errcode.LimitExceeded {
+		t.Fatalf("Unexpected error code: %v", errcode.Code(pa.ErrorCode))
+	}
+
+	// The group sequences are recovered on restart.
+	sc.Close()
+	s.Shutdown()
+	s = runServerWithOpts(opts)
+	sc = NewDefaultConnection(t)
+	defer sc.Close()
+
+	bar = subscribeRawMsgs(t, nc, s, &spb.SubscriptionRequest{Subject: "bar"})
+	if pa := publishInGroup(t, s, nc, "bar", "g1"); pa.Error != "" {
+		t.Fatalf("Unexpected error on publish: %v", pa.Error)
+	}
+	checkGroupSequences(t, bar, "g1", 5)
+}
+
+func TestOrderingGroupsDisabled(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	pa := publishInGroup(t, s, nc, "foo", "g1")
+	if pa.Error != ErrOrderingGroupsDisabled.Error() {
+		t.Fatalf("Expected error %v, got %q", ErrOrderingGroupsDisabled, pa.Error)
+	}
+	if errcode.Code(pa.ErrorCode) != errcode.InvalidRequest {
+		t.Fatalf("Unexpected error code: %v", errcode.Code(pa.ErrorCode))
+	}
+	if cs := s.store.LookupChannel("foo"); cs != nil {
+		t.Fatal("The channel should not have been created")
+	}
+}
+
+func TestOrderingGroupsRecordedSequence(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.StoreType = stores.TypeFile
+	opts.FilestoreDir = defaultDataStore
+	opts.MaxOrderingGroups = 1
+	opts.MaxMsgs = 1
+	s := runServerWithOpts(opts)
+	defer shutdownRestartedServerOnTestExit(&s)
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	for i := 0; i < 3; i++ {
+		if pa := publishInGroup(t, s, nc, "foo", "g1"); pa.Error != "" {
+			t.Fatalf("Unexpected error on publish: %v", pa.Error)
+		}
+	}
+	// The last message of the group is removed by the channel limits.
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+
+	// The group sequence does not go backwards after a restart.
+	sc.Close()
+	s.Shutdown()
+	s = runServerWithOpts(opts)
+	sc = NewDefaultConnection(t)
+	defer sc.Close()
+
+	foo := subscribeRawMsgs(t, nc, s, &spb.SubscriptionRequest{Subject: "foo"})
+	if pa := publishInGroup(t, s, nc, "foo", "g1"); pa.Error != "" {
+		t.Fatalf("Unexpected error on publish: %v", pa.Error)
+	}
+	checkGroupSequences(t, foo, "g1", 4)
+}
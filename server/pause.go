@@ -0,0 +1,130 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// DefaultPausePrefix is the prefix of the subject on which the server
+// receives pause requests. The cluster ID is appended to it.
+const DefaultPausePrefix = "_STAN.pause"
+
+// Errors returned to pause requests
+var (
+	ErrInvalidPauseReq = errors.New("stan: invalid pause request")
+	ErrPauseQueueSub   = errors.New("stan: queue subscriptions can't be paused")
+)
+
+// pauseSubject returns the subject the server receives pause requests on.
+func (s *StanServer) pauseSubject() string {
+	return fmt.Sprintf("%s.%s", DefaultPausePrefix, s.info.ClusterID)
+}
+
+// processPauseRequest pauses or resumes the delivery of messages to a
+// subscription or a durable.
+func (s *StanServer) processPauseRequest(m *nats.Msg) {
+	req := &spb.PauseRequest{}
+	err := req.Unmarshal(m.Data)
+	if err != nil || m.Reply == "" || !isValidSubject(req.Subject) ||
+		(req.AckInbox == "" && (req.ClientID == "" || req.DurableName == "")) {
+		s.log.Errorf("STAN: Received invalid pause request %v", req)
+		s.sendPauseResponse(m.Reply, ErrInvalidPauseReq)
+		return
+	}
+	var sub *subState
+	if req.AckInbox != "" {
+		sub = s.lookupSubByAckInbox(req.Subject, req.AckInbox)
+	} else {
+		sub = s.lookupDurable(req.Subject, req.ClientID, req.DurableName)
+	}
+	s.sendPauseResponse(m.Reply, s.setSubPaused(sub, req.Pause))
+}
+
+// sendPauseResponse sends the outcome of a pause request to the requestor.
+func (s *StanServer) sendPauseResponse(reply string, err error) {
+	resp := &spb.PauseResponse{}
+	if err != nil {
+		resp.Error = err.Error()
+		resp.ErrorCode = int32(errorCode(err))
+	}
+	if b, err := resp.Marshal(); err == nil {
+		s.nc.Publish(reply, b)
+	}
+}
+
+// setSubPaused pauses or resumes the subscription. Messages are neither
+// sent nor redelivered to a paused subscription. On resume, the messages
+// stored in the meantime are sent, and the messages pending acknowledgment
+// are redelivered when their AckWait expires, as usual.
+func (s *StanServer) setSubPaused(sub *subState, paused bool) error {
+	if sub == nil {
+		return ErrInvalidSub
+	}
+	sub.Lock()
+	if sub.qstate != nil {
+		sub.Unlock()
+		return ErrPauseQueueSub
+	}
+	wasPaused := sub.paused
+	sub.paused = paused
+	subject := sub.subject
+	// The client of an offline durable is cleared.
+	online := sub.ClientID != ""
+	s.log.Debugf("STAN: [Client:%s] Subscription on %s paused=%v", sub.ClientID, subject, paused)
+	sub.Unlock()
+	if wasPaused && !paused && online {
+		if cs := s.store.LookupChannel(subject); cs != nil {
+			s.sendAvailableMessages(cs, sub)
+		}
+	}
+	return nil
+}
+
+// PauseSubscription stops the delivery of messages to the subscription
+// with the given ack inbox on the channel, until it is resumed. Paused
+// subscriptions are not persisted, they are resumed when the server restarts.
+func (s *StanServer) PauseSubscription(channel, ackInbox string) error {
+	return s.setSubPaused(s.lookupSubByAckInbox(channel, ackInbox), true)
+}
+
+// ResumeSubscription resumes the delivery of messages to the subscription
+// with the given ack inbox on the channel.
+func (s *StanServer) ResumeSubscription(channel, ackInbox string) error {
+	return s.setSubPaused(s.lookupSubByAckInbox(channel, ackInbox), false)
+}
+
+// PauseDurable stops the delivery of messages to the durable, whether its
+// client is connected or not, until it is resumed.
+func (s *StanServer) PauseDurable(channel, clientID, durableName string) error {
+	return s.setSubPaused(s.lookupDurable(channel, clientID, durableName), true)
+}
+
+// ResumeDurable resumes the delivery of messages to the durable.
+func (s *StanServer) ResumeDurable(channel, clientID, durableName string) error {
+	return s.setSubPaused(s.lookupDurable(channel, clientID, durableName), false)
+}
+
+func (s *StanServer) lookupSubByAckInbox(channel, ackInbox string) *subState {
+	cs := s.store.LookupChannel(channel)
+	if cs == nil {
+		return nil
+	}
+	return cs.UserData.(*subStore).LookupByAckInbox(ackInbox)
+}
+
+func (s *StanServer) lookupDurable(channel, clientID, durableName string) *subState {
+	cs := s.store.LookupChannel(channel)
+	if cs == nil {
+		return nil
+	}
+	return cs.UserData.(*subStore).LookupByDurable(durableKey(&spb.SubscriptionRequest{
+		ClientID:    clientID,
+		Subject:     channel,
+		DurableName: durableName,
+	}))
+}
@@ -0,0 +1,158 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func sendPauseRequest(t *testing.T, s *StanServer, req *spb.PauseRequest) error {
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		stackFatalf(t, "Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+	b, _ := req.Marshal()
+	reply, err := nc.Request(s.pauseSubject(), b, 2*time.Second)
+	if err != nil {
+		stackFatalf(t, "Unexpected error on pause request: %v", err)
+	}
+	resp := &spb.PauseResponse{}
+	if err := resp.Unmarshal(reply.Data); err != nil {
+		stackFatalf(t, "Unexpected error on unmarshal: %v", err)
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+func checkMsgSeq(t *testing.T, msgs chan *stan.Msg, seq uint64) {
+	select {
+	case m := <-msgs:
+		if m.Sequence != seq {
+			stackFatalf(t, "Expected message %v, got %v", seq, m.Sequence)
+		}
+	case <-time.After(2 * time.Second):
+		stackFatalf(t, "Did not get message %v", seq)
+	}
+}
+
+func checkNoMsg(t *testing.T, msgs chan *stan.Msg) {
+	select {
+	case m := <-msgs:
+		stackFatalf(t, "Unexpected message: %v", m)
+	case <-time.After(250 * time.Millisecond):
+	}
+}
+
+func TestPauseSubscription(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	msgs := make(chan *stan.Msg, 10)
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) { msgs <- m }); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	subs := s.clients.GetSubs(clientName)
+	if len(subs) != 1 {
+		t.Fatalf("Expected 1 subscription, got %v", len(subs))
+	}
+	ackInbox := subs[0].AckInbox
+
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	checkMsgSeq(t, msgs, 1)
+
+	if err := sendPauseRequest(t, s, &spb.PauseRequest{Subject: "foo", AckInbox: ackInbox, Pause: true}); err != nil {
+		t.Fatalf("Unexpected error on pause: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	checkNoMsg(t, msgs)
+
+	if err := sendPauseRequest(t, s, &spb.PauseRequest{Subject: "foo", AckInbox: ackInbox}); err != nil {
+		t.Fatalf("Unexpected error on resume: %v", err)
+	}
+	checkMsgSeq(t, msgs, 2)
+	checkMsgSeq(t, msgs, 3)
+
+	// Invalid requests
+	if err := sendPauseRequest(t, s, &spb.PauseRequest{Subject: "foo", Pause: true}); err == nil || err.Error() != ErrInvalidPauseReq.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidPauseReq, err)
+	}
+	if err := sendPauseRequest(t, s, &spb.PauseRequest{Subject: "foo", AckInbox: "bar", Pause: true}); err == nil || err.Error() != ErrInvalidSub.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidSub, err)
+	}
+}
+
+func TestPauseQueueSubscription(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	if _, err := sc.QueueSubscribe("foo", "group", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	ackInbox := s.clients.GetSubs(clientName)[0].AckInbox
+	if err := s.PauseSubscription("foo", ackInbox); err != ErrPauseQueueSub {
+		t.Fatalf("Expected error %v, got %v", ErrPauseQueueSub, err)
+	}
+}
+
+func TestPauseDurable(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	msgs := make(chan *stan.Msg, 10)
+	cb := func(m *stan.Msg) { msgs <- m }
+	if _, err := sc.Subscribe("foo", cb, stan.DurableName("dur")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	checkMsgSeq(t, msgs, 1)
+
+	// Pause the durable while it is offline.
+	sc.Close()
+	if err := s.PauseDurable("foo", clientName, "dur"); err != nil {
+		t.Fatalf("Unexpected error on pause: %v", err)
+	}
+	sc = NewDefaultConnection(t)
+	defer sc.Close()
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	if _, err := sc.Subscribe("foo", cb, stan.DurableName("dur")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	checkNoMsg(t, msgs)
+
+	if err := s.ResumeDurable("foo", clientName, "dur"); err != nil {
+		t.Fatalf("Unexpected error on resume: %v", err)
+	}
+	checkMsgSeq(t, msgs, 2)
+
+	if err := s.PauseDurable("foo", clientName, "other"); err != ErrInvalidSub {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidSub, err)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// DefaultPingPrefix is the prefix of the subject on which the server
+// receives ping requests. The cluster ID is appended to it.
+const DefaultPingPrefix = "_STAN.ping"
+
+// ErrInvalidPingReq is returned to invalid ping requests.
+var ErrInvalidPingReq = errors.New("stan: invalid ping request")
+
+// ClientState is the state of a client connection, returned by
+// StanServer.ClientsState and the AdminOpClients operation.
+type ClientState struct {
+	ID            string    `json:"id"`
+	HbInbox       string    `json:"hb_inbox"`
+	Subscriptions int       `json:"subscriptions"`
+	LastActivity  time.Time `json:"last_activity,omitempty"` // Last connect, ping or heartbeat response of the client, zero if none since the server started
+}
+
+// pingSubject returns the subject the server receives ping requests on.
+func (s *StanServer) pingSubject() string {
+	return fmt.Sprintf("%s.%s", DefaultPingPrefix, s.info.ClusterID)
+}
+
+// processPingRequest answers a ping from a client. Unlike the heartbeats,
+// sent by the server, pings let clients find out quickly that the server
+// they were connected to is gone, for instance after a failover, when
+// requests time out, or that it no longer knows them, when the reply is
+// ErrUnknownClient. A ping also counts as activity of the client.
+func (s *StanServer) processPingRequest(m *nats.Msg) {
+	req := &spb.PingRequest{}
+	err := req.Unmarshal(m.Data)
+	if err != nil || m.Reply == "" || req.ClientID == "" {
+		s.log.Errorf("STAN: Received invalid ping request %v", req)
+		s.sendPingResponse(m.Reply, ErrInvalidPingReq)
+		return
+	}
+	sc := s.store.GetClient(req.ClientID)
+	if sc == nil {
+		s.sendPingResponse(m.Reply, ErrUnknownClient)
+		return
+	}
+	s.recordActivity(sc.UserData.(*client))
+	s.sendPingResponse(m.Reply, nil)
+}
+
+// sendPingResponse sends the error, if any, back to the requestor.
+func (s *StanServer) sendPingResponse(reply string, err error) {
+	resp := &spb.PingResponse{}
+	if err != nil {
+		resp.Error = err.Error()
+		resp.ErrorCode = int32(errorCode(err))
+	}
+	if b, err := resp.Marshal(); err == nil {
+		s.nc.Publish(reply, b)
+	}
+}
+
+// recordActivity sets the time of the last activity of the client to now.
+func (s *StanServer) recordActivity(c *client) {
+	atomic.StoreInt64(&c.lastActivity, s.clock.Now().UnixNano())
+}
+
+// ClientsState returns the state of the registered clients, sorted by ID.
+func (s *StanServer) ClientsState() []*ClientState {
+	states := []*ClientState{}
+	for _, sc := range s.store.GetClients() {
+		c := sc.UserData.(*client)
+		state := &ClientState{ID: sc.ID, HbInbox: sc.HbInbox}
+		c.RLock()
+		state.Subscriptions = len(c.subs)
+		c.RUnlock()
+		if last := atomic.LoadInt64(&c.lastActivity); last != 0 {
+			state.LastActivity = time.Unix(0, last)
+		}
+		states = append(states, state)
+	}
+	sort.Sort(clientsByID(states))
+	return states
+}
+
+// clientsByID sorts the states of clients by ID.
+type clientsByID []*ClientState
+
+func (c clientsByID) Len() int           { return len(c) }
+func (c clientsByID) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c clientsByID) Less(i, j int) bool { return c[i].ID < c[j].ID }
@@ -0,0 +1,75 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func sendPing(t *testing.T, nc *nats.Conn, clientID string) *spb.PingResponse {
+	b, _ := (&spb.PingRequest{ClientID: clientID}).Marshal()
+	reply, err := nc.Request(fmt.Sprintf("%s.%s", DefaultPingPrefix, clusterName), b, 2*time.Second)
+	if err != nil {
+		stackFatalf(t, "Error on ping request: %v", err)
+	}
+	resp := &spb.PingResponse{}
+	if err := resp.Unmarshal(reply.Data); err != nil {
+		stackFatalf(t, "Error unmarshaling ping response: %v", err)
+	}
+	return resp
+}
+
+func TestClientPing(t *testing.T) {
+	s := runServerWithAdminUsers()
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	states := s.ClientsState()
+	if len(states) != 1 || states[0].ID != clientName || states[0].LastActivity.IsZero() {
+		t.Fatalf("Unexpected clients: %+v", states)
+	}
+	connected := states[0].LastActivity
+
+	time.Sleep(10 * time.Millisecond)
+	if resp := sendPing(t, nc, clientName); resp.Error != "" {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+	states = s.ClientsState()
+	if !states[0].LastActivity.After(connected) {
+		t.Fatalf("Last activity should have been updated, got %v (connected at %v)", states[0].LastActivity, connected)
+	}
+
+	if resp := sendPing(t, nc, "unknown"); resp.Error != ErrUnknownClient.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrUnknownClient, resp.Error)
+	}
+	if resp := sendPing(t, nc, ""); resp.Error != ErrInvalidPingReq.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidPingReq, resp.Error)
+	}
+
+	// The clients are listed by the clients admin operation.
+	resp := sendAdminRequest(t, nc, &spb.AdminRequest{Token: adminReadToken, Operation: AdminOpClients})
+	if resp.Error != "" {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+	var clients []*ClientState
+	if err := json.Unmarshal(resp.Data, &clients); err != nil {
+		t.Fatalf("Unexpected error on unmarshal: %v", err)
+	}
+	if len(clients) != 1 || clients[0].ID != clientName || !clients[0].LastActivity.Equal(states[0].LastActivity) {
+		t.Fatalf("Unexpected clients: %+v", clients)
+	}
+}
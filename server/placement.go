@@ -0,0 +1,67 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+// ErrPlacementViolation is returned when a channel can't be created on
+// this server because the server does not have the tags required by the
+// channel placement rules.
+var ErrPlacementViolation = errors.New("stan: channel placement constraints not satisfied by this server")
+
+// requiredTags returns the tags that a server must have to own the given
+// channel. A channel must satisfy all the rules whose pattern matches
+// its name.
+func requiredTags(placement map[string][]string, channel string) []string {
+	var tags []string
+	for pattern, ptags := range placement {
+		if util.SubjectMatches(pattern, channel) {
+			tags = append(tags, ptags...)
+		}
+	}
+	return tags
+}
+
+// checkPlacement returns an error if this server is not allowed to own
+// the given channel.
+func (s *StanServer) checkPlacement(channel string) error {
+	if len(s.opts.ChannelPlacement) == 0 {
+		return nil
+	}
+	for _, tag := range requiredTags(s.opts.ChannelPlacement, channel) {
+		if !hasTag(s.opts.Tags, tag) {
+			s.log.Errorf("STAN: Channel %q requires tag %q, server has %v", channel, tag, s.opts.Tags)
+			return ErrPlacementViolation
+		}
+	}
+	return nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// validatePlacement checks that the patterns of the placement rules
+// are valid subjects.
+func validatePlacement(placement map[string][]string) error {
+	for pattern, tags := range placement {
+		if !util.IsValidSubjectPattern(pattern) {
+			return fmt.Errorf("invalid channel placement pattern %q", pattern)
+		}
+		if len(tags) == 0 {
+			return fmt.Errorf("no tag specified for channel placement pattern %q", pattern)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/nats-io/go-nats-streaming"
+)
+
+func TestValidatePlacement(t *testing.T) {
+	if err := validatePlacement(map[string][]string{"eu.>": {"eu"}, "*.us": {"us"}}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, p := range []string{"", "foo..bar", ">.foo", "foo*"} {
+		if err := validatePlacement(map[string][]string{p: {"eu"}}); err == nil {
+			t.Fatalf("Expected error for pattern %q", p)
+		}
+	}
+	if err := validatePlacement(map[string][]string{"foo": nil}); err == nil {
+		t.Fatal("Expected error for pattern without tags")
+	}
+}
+
+func TestChannelPlacement(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.Tags = []string{"US"}
+	opts.ChannelPlacement = map[string][]string{
+		"eu.>": {"eu"},
+		"us.>": {"us"},
+	}
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	// Channels not subject to placement rules or with matching tags
+	// (compared without case) can be created.
+	for _, channel := range []string{"foo", "us.foo"} {
+		if err := sc.Publish(channel, []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish to %q: %v", channel, err)
+		}
+	}
+	// Publish and subscribe to a channel that can't be placed on this
+	// server must fail.
+	if err := sc.Publish("eu.foo", []byte("hello")); err == nil || err.Error() != ErrPlacementViolation.Error() {
+		t.Fatalf("Expected error %q, got %v", ErrPlacementViolation, err)
+	}
+	if _, err := sc.Subscribe("eu.foo", func(_ *stan.Msg) {}); err == nil || err.Error() != ErrPlacementViolation.Error() {
+		t.Fatalf("Expected error %q, got %v", ErrPlacementViolation, err)
+	}
+	if s.store.LookupChannel("eu.foo") != nil {
+		t.Fatal("Channel should not have been created")
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+// latencyBuckets is the number of buckets of a LatencyHistogram. The upper
+// bound of the first bucket is 1µs, and doubles with each bucket, up to
+// about 16s. The last bucket counts the longer durations.
+const latencyBuckets = 26
+
+// LatencyHistogram counts durations in buckets of exponential size.
+type LatencyHistogram struct {
+	Buckets [latencyBuckets]uint64 // Buckets[i] counts the durations up to LatencyBucketBound(i)
+	Count   uint64                 // Number of durations
+	Sum     time.Duration          // Sum of the durations
+	Max     time.Duration          // Longest duration
+}
+
+// LatencyBucketBound returns the upper bound of the given bucket of a
+// LatencyHistogram. The last bucket has no bound and returns -1.
+func LatencyBucketBound(i int) time.Duration {
+	if i >= latencyBuckets-1 {
+		return -1
+	}
+	return time.Microsecond << uint(i)
+}
+
+// add counts the duration.
+func (h *LatencyHistogram) add(d time.Duration) {
+	i := 0
+	for ; i < latencyBuckets-1 && d > LatencyBucketBound(i); i++ {
+	}
+	h.Buckets[i]++
+	h.Count++
+	h.Sum += d
+	if d > h.Max {
+		h.Max = d
+	}
+}
+
+// Mean returns the mean of the durations.
+func (h *LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Quantile returns an upper bound of the given quantile (0.99 for the 99th
+// percentile) of the durations. It is the bound of the bucket of the
+// quantile, or the longest duration if lower.
+func (h *LatencyHistogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(h.Count) + 0.5)
+	if rank == 0 {
+		rank = 1
+	}
+	n := uint64(0)
+	for i, c := range h.Buckets {
+		n += c
+		if n >= rank {
+			if b := LatencyBucketBound(i); b >= 0 && b < h.Max {
+				return b
+			}
+			break
+		}
+	}
+	return h.Max
+}
+
+// PubLatencyStats are the latency histograms of the stages of publishes,
+// from the reception of the message by the server to the PubAck.
+type PubLatencyStats struct {
+	Validate LatencyHistogram // Decoding and validation of the message, in the NATS callback
+	Queue    LatencyHistogram // Wait in the IO channel, before the IO loop picks the message
+	Store    LatencyHistogram // Write of the message to the message store
+	Flush    LatencyHistogram // From the write to the end of the flush of the message store (which may fsync), after the rest of the batch
+	Ack      LatencyHistogram // From the flush to the PubAck, which includes the delivery of the batch to subscribers
+	Total    LatencyHistogram // From the reception of the message to the PubAck
+}
+
+// pubTimes are the times at which a message went through the stages of
+// its publish.
+type pubTimes struct {
+	received time.Time
+	queued   time.Time
+	dequeued time.Time
+	stored   time.Time
+	store    *stores.ChannelStore // store of the channel, to lookup the time of its flush
+}
+
+// pubLatency records the latency of the stages of publishes, globally and
+// per channel. Publishes are recorded by the IO loop.
+type pubLatency struct {
+	sync.Mutex
+	all      PubLatencyStats
+	channels map[string]*PubLatencyStats
+}
+
+func newPubLatency() *pubLatency {
+	return &pubLatency{channels: make(map[string]*PubLatencyStats)}
+}
+
+// record records the publish of a message on the channel, whose store was
+// flushed at flushed and whose PubAck was sent at acked.
+func (pl *pubLatency) record(channel string, t *pubTimes, flushed, acked time.Time) {
+	validate := t.queued.Sub(t.received)
+	queue := t.dequeued.Sub(t.queued)
+	store := t.stored.Sub(t.dequeued)
+	flush := flushed.Sub(t.stored)
+	ack := acked.Sub(flushed)
+	total := acked.Sub(t.received)
+
+	pl.Lock()
+	cs := pl.channels[channel]
+	if cs == nil {
+		cs = &PubLatencyStats{}
+		pl.channels[channel] = cs
+	}
+	for _, st := range []*PubLatencyStats{&pl.all, cs} {
+		st.Validate.add(validate)
+		st.Queue.add(queue)
+		st.Store.add(store)
+		st.Flush.add(flush)
+		st.Ack.add(ack)
+		st.Total.add(total)
+	}
+	pl.Unlock()
+}
+
+// remove forgets the stats of a deleted channel.
+func (pl *pubLatency) remove(channel string) {
+	pl.Lock()
+	delete(pl.channels, channel)
+	pl.Unlock()
+}
+
+// PubLatencyStats returns the latency histograms of the publishes on all
+// the channels, and false if Options.RecordPubLatency is not set.
+func (s *StanServer) PubLatencyStats() (PubLatencyStats, bool) {
+	if s.pubLatency == nil {
+		return PubLatencyStats{}, false
+	}
+	s.pubLatency.Lock()
+	defer s.pubLatency.Unlock()
+	return s.pubLatency.all, true
+}
+
+// ChannelPubLatencyStats returns the latency histograms of the publishes on
+// the channel, and false if Options.RecordPubLatency is not set or if no
+// message has been published on the channel.
+func (s *StanServer) ChannelPubLatencyStats(channel string) (PubLatencyStats, bool) {
+	if s.pubLatency == nil {
+		return PubLatencyStats{}, false
+	}
+	s.pubLatency.Lock()
+	defer s.pubLatency.Unlock()
+	cs := s.pubLatency.channels[channel]
+	if cs == nil {
+		return PubLatencyStats{}, false
+	}
+	return *cs, true
+}
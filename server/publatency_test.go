@@ -0,0 +1,114 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	h := &LatencyHistogram{}
+	if h.Mean() != 0 || h.Quantile(0.99) != 0 {
+		t.Fatalf("Unexpected empty histogram: %v %v", h.Mean(), h.Quantile(0.99))
+	}
+	for i := 0; i < 98; i++ {
+		h.add(3 * time.Microsecond)
+	}
+	h.add(time.Millisecond)
+	h.add(time.Minute)
+	if h.Count != 100 || h.Max != time.Minute {
+		t.Fatalf("Unexpected histogram: %+v", h)
+	}
+	if h.Buckets[2] != 98 || h.Buckets[10] != 1 || h.Buckets[latencyBuckets-1] != 1 {
+		t.Fatalf("Unexpected buckets: %v", h.Buckets)
+	}
+	if q := h.Quantile(0.5); q != 4*time.Microsecond {
+		t.Fatalf("Unexpected median: %v", q)
+	}
+	if q := h.Quantile(0.99); q != 1024*time.Microsecond {
+		t.Fatalf("Unexpected 99th percentile: %v", q)
+	}
+	if q := h.Quantile(1); q != time.Minute {
+		t.Fatalf("Unexpected max: %v", q)
+	}
+	// The bound of a bucket is not returned if greater than the max.
+	h = &LatencyHistogram{}
+	h.add(1500 * time.Microsecond)
+	if q := h.Quantile(0.99); q != 1500*time.Microsecond {
+		t.Fatalf("Unexpected 99th percentile: %v", q)
+	}
+	if b := LatencyBucketBound(latencyBuckets - 1); b != -1 {
+		t.Fatalf("Unexpected bound of last bucket: %v", b)
+	}
+}
+
+func TestPubLatencyStats(t *testing.T) {
+	s := RunServer(clusterName)
+	if _, ok := s.PubLatencyStats(); ok {
+		t.Fatal("Latency should not be recorded by default")
+	}
+	s.Shutdown()
+
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.RecordPubLatency = true
+	s = runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if err := sc.Publish("bar", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	// The stats are recorded right after the PubAck is sent.
+	waitForCount := func(channel string, expected uint64) PubLatencyStats {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			var st PubLatencyStats
+			var ok bool
+			if channel == "" {
+				st, ok = s.PubLatencyStats()
+			} else {
+				st, ok = s.ChannelPubLatencyStats(channel)
+			}
+			if ok && st.Total.Count == expected {
+				return st
+			}
+			if time.Now().After(deadline) {
+				stackFatalf(t, "Expected %v publishes for %q, got %v", expected, channel, st.Total.Count)
+			}
+			time.Sleep(15 * time.Millisecond)
+		}
+	}
+	all := waitForCount("", 15)
+	for _, h := range []LatencyHistogram{all.Validate, all.Queue, all.Store, all.Flush, all.Ack} {
+		if h.Count != 15 {
+			t.Fatalf("Unexpected stage count: %v", h.Count)
+		}
+		if h.Max > all.Total.Max {
+			t.Fatalf("Stage max %v greater than total max %v", h.Max, all.Total.Max)
+		}
+	}
+	waitForCount("foo", 10)
+	waitForCount("bar", 5)
+	if _, ok := s.ChannelPubLatencyStats("baz"); ok {
+		t.Fatal("Expected no stats for channel without publishes")
+	}
+
+	// The stats of a deleted channel are removed.
+	if err := s.DeleteChannel("bar", false); err != nil {
+		t.Fatalf("Unexpected error on delete: %v", err)
+	}
+	if _, ok := s.ChannelPubLatencyStats("bar"); ok {
+		t.Fatal("Expected no stats for deleted channel")
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// PurgeChannel deletes all the messages stored in the channel. Its
+// subscriptions are kept, but since the sequences of the messages stored
+// afterwards start again at 1, they are rewound: the messages they had not
+// acknowledged are dropped, and they receive the new messages from the
+// first one.
+func (s *StanServer) PurgeChannel(name string) error {
+	cs := s.store.LookupChannel(name)
+	if cs == nil {
+		return ErrUnknownChannel
+	}
+	ss := cs.UserData.(*subStore)
+	// Prevent deliveries while the channel is purged.
+	ss.Lock()
+	defer ss.Unlock()
+	if err := cs.Msgs.Purge(); err != nil {
+		return err
+	}
+	// Offline durables are only in the durables map, or the shadows of
+	// their queue group.
+	subs := make(map[*subState]struct{})
+	for _, sub := range ss.psubs {
+		subs[sub] = struct{}{}
+	}
+	for _, sub := range ss.durables {
+		subs[sub] = struct{}{}
+	}
+	for _, qs := range ss.qsubs {
+		qs.Lock()
+		qs.lastSent = 0
+		qs.stalled = false
+		qs.rdlvs = nil
+		for _, sub := range qs.subs {
+			subs[sub] = struct{}{}
+		}
+		if qs.shadow != nil {
+			subs[qs.shadow] = struct{}{}
+		}
+		qs.Unlock()
+	}
+	var err error
+	for sub := range subs {
+		if lerr := rewindSub(sub); lerr != nil && err == nil {
+			err = lerr
+		}
+	}
+	if lerr := cs.Subs.Flush(); lerr != nil && err == nil {
+		err = lerr
+	}
+	s.log.Noticef("STAN: Purged channel %q", name)
+	return err
+}
+
+// rewindSub drops the messages pending acknowledgment of the subscription
+// and moves it back to the start of its purged channel.
+func rewindSub(sub *subState) error {
+	sub.Lock()
+	defer sub.Unlock()
+	var err error
+	// A lazily created subscription is not in the store yet.
+	stored := sub.lazy == nil
+	if stored {
+		for seq := range sub.acksPending {
+			if lerr := sub.store.AckSeqPending(sub.ID, seq); lerr != nil && err == nil {
+				err = lerr
+			}
+		}
+	}
+	sub.acksPending = make(map[uint64]*spb.MsgProto)
+	sub.claims = nil
+	sub.rdlvs = nil
+	if sub.window != nil {
+		sub.window.sentTime = make(map[uint64]int64)
+	}
+	sub.clearAckTimer()
+	sub.stalled = false
+	sub.newOnHold = false
+	sub.LastSent = 0
+	if stored {
+		if lerr := sub.store.UpdateSub(&sub.SubState); lerr != nil && err == nil {
+			err = lerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,95 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestPurgeChannel(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	// Leave the messages unacknowledged.
+	msgs := make(chan *stan.Msg, 10)
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) { msgs <- m },
+		stan.SetManualAckMode(), stan.MaxInflight(2)); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	checkMsgSeq(t, msgs, 1)
+	checkMsgSeq(t, msgs, 2)
+
+	if err := s.PurgeChannel("foo"); err != nil {
+		t.Fatalf("Unexpected error on purge: %v", err)
+	}
+	cs := s.store.LookupChannel("foo")
+	if n, _, _ := cs.Msgs.State(); n != 0 {
+		t.Fatalf("Expected no message, got %v", n)
+	}
+	subs := s.clients.GetSubs(clientName)
+	if len(subs) != 1 {
+		t.Fatalf("Expected 1 subscription, got %v", len(subs))
+	}
+	subs[0].RLock()
+	pending := len(subs[0].acksPending)
+	subs[0].RUnlock()
+	if pending != 0 {
+		t.Fatalf("Expected no pending message, got %v", pending)
+	}
+
+	// The subscription gets the new messages, starting at 1.
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	checkMsgSeq(t, msgs, 1)
+	checkNoMsg(t, msgs)
+
+	if err := s.PurgeChannel("bar"); err != ErrUnknownChannel {
+		t.Fatalf("Expected error %v, got %v", ErrUnknownChannel, err)
+	}
+}
+
+func TestAdminPurgeChannel(t *testing.T) {
+	s := runServerWithAdminUsers()
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	resp := sendAdminRequest(t, nc, &spb.AdminRequest{Token: adminOperatorToken, Operation: AdminOpPurgeChannel, Channel: "foo"})
+	if resp.Error != ErrAdminForbidden.Error() {
+		t.Fatalf("Expected error %q, got %q", ErrAdminForbidden, resp.Error)
+	}
+	resp = sendAdminRequest(t, nc, &spb.AdminRequest{Token: adminDestructiveToken, Operation: AdminOpPurgeChannel, Channel: "foo"})
+	if resp.Error != "" {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+	if n, _, _ := s.store.LookupChannel("foo").Msgs.State(); n != 0 {
+		t.Fatalf("Expected no message, got %v", n)
+	}
+	resp = sendAdminRequest(t, nc, &spb.AdminRequest{Token: adminDestructiveToken, Operation: AdminOpPurgeChannel, Channel: "bar"})
+	if resp.Error != ErrUnknownChannel.Error() {
+		t.Fatalf("Expected error %q, got %q", ErrUnknownChannel, resp.Error)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// Delivery policies of queue groups, deciding which member each message
+// is sent to.
+const (
+	QueuePolicyLeastPending = "least_pending" // the member with the fewest messages pending acknowledgment
+	QueuePolicyRoundRobin   = "round_robin"   // each member in turn
+	QueuePolicyRandom       = "random"        // a member picked at random
+)
+
+// Errors returned to queue subscription requests
+var (
+	ErrInvalidQueuePolicy  = errors.New("stan: invalid queue group delivery policy")
+	ErrQueuePolicyMismatch = errors.New("stan: queue group has a different delivery policy")
+)
+
+func isValidQueuePolicy(policy string) bool {
+	switch policy {
+	case QueuePolicyLeastPending, QueuePolicyRoundRobin, QueuePolicyRandom:
+		return true
+	}
+	return false
+}
+
+// validateQueuePolicy checks the default delivery policy of queue groups.
+func validateQueuePolicy(policy string) error {
+	if policy != "" && !isValidQueuePolicy(policy) {
+		return fmt.Errorf("invalid queue policy %q", policy)
+	}
+	return nil
+}
+
+// queuePolicy returns the delivery policy of the queue group joined by the
+// subscription request. A new group gets the requested policy, or the
+// server's default. Members joining an existing group get its policy, and
+// are rejected if they request a different one.
+func (s *StanServer) queuePolicy(ss *subStore, sr *spb.SubscriptionRequest) (string, error) {
+	if sr.QueuePolicy != "" && !isValidQueuePolicy(sr.QueuePolicy) {
+		return "", ErrInvalidQueuePolicy
+	}
+	ss.RLock()
+	qs := ss.qsubs[sr.QGroup]
+	ss.RUnlock()
+	if qs != nil {
+		qs.RLock()
+		policy := qs.policy
+		qs.RUnlock()
+		if sr.QueuePolicy != "" && sr.QueuePolicy != policy {
+			return "", ErrQueuePolicyMismatch
+		}
+		return policy, nil
+	}
+	if sr.QueuePolicy != "" {
+		return sr.QueuePolicy, nil
+	}
+	if s.opts.QueuePolicy != "" {
+		return s.opts.QueuePolicy, nil
+	}
+	return QueuePolicyLeastPending, nil
+}
+
+// pickQueueSub returns the member of the queue group the next message is
+// sent to, according to the group's delivery policy.
+// Assumes qs lock held for write.
+func pickQueueSub(qs *queueState) *subState {
+	switch qs.policy {
+	case QueuePolicyRoundRobin:
+		return findNextQueueSub(qs.subs)
+	case QueuePolicyRandom:
+		return findRandomQueueSub(qs.subs)
+	}
+	return findBestQueueSub(qs.subs)
+}
+
+// queueSubRank orders the members of a queue group by their ability to
+// receive messages: 0 if they can, 1 if stalled, 2 if frozen.
+func queueSubRank(sub *subState) int {
+	sub.RLock()
+	defer sub.RUnlock()
+	switch {
+	case sub.frozen:
+		return 2
+	case sub.stalled:
+		return 1
+	}
+	return 0
+}
+
+// findNextQueueSub returns the first member, in turn, among those best able
+// to receive messages, and moves it at the end of the list.
+func findNextQueueSub(sl []*subState) *subState {
+	pick, pickRank := -1, 0
+	for i, sub := range sl {
+		if rank := queueSubRank(sub); pick == -1 || rank < pickRank {
+			pick, pickRank = i, rank
+			if rank == 0 {
+				break
+			}
+		}
+	}
+	if pick == -1 {
+		return nil
+	}
+	rsub := sl[pick]
+	copy(sl[pick:], sl[pick+1:])
+	sl[len(sl)-1] = rsub
+	return rsub
+}
+
+// findRandomQueueSub returns a member picked at random among those best
+// able to receive messages.
+func findRandomQueueSub(sl []*subState) *subState {
+	var picks []*subState
+	pickRank := 0
+	for _, sub := range sl {
+		rank := queueSubRank(sub)
+		if len(picks) == 0 || rank < pickRank {
+			picks, pickRank = append(picks[:0], sub), rank
+		} else if rank == pickRank {
+			picks = append(picks, sub)
+		}
+	}
+	if len(picks) == 0 {
+		return nil
+	}
+	return picks[rand.Intn(len(picks))]
+}
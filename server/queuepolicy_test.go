@@ -0,0 +1,139 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestFindQueueSubPolicies(t *testing.T) {
+	a, b, c := &subState{}, &subState{}, &subState{}
+	sl := []*subState{a, b, c}
+	for _, expected := range []*subState{a, b, c, a} {
+		if sub := findNextQueueSub(sl); sub != expected {
+			t.Fatalf("Unexpected member picked")
+		}
+	}
+	// Stalled and frozen members are skipped, unless all are.
+	b.stalled = true
+	c.frozen = true
+	for i := 0; i < 3; i++ {
+		if sub := findNextQueueSub(sl); sub != a {
+			t.Fatalf("Unexpected member picked")
+		}
+		if sub := findRandomQueueSub(sl); sub != a {
+			t.Fatalf("Unexpected member picked")
+		}
+	}
+	a.frozen = true
+	if sub := findNextQueueSub(sl); sub != b {
+		t.Fatalf("Unexpected member picked")
+	}
+	if sub := findRandomQueueSub(sl); sub != b {
+		t.Fatalf("Unexpected member picked")
+	}
+	if findNextQueueSub(nil) != nil || findRandomQueueSub(nil) != nil {
+		t.Fatal("Expected no member in empty group")
+	}
+}
+
+func TestQueuePolicyRoundRobin(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.QueuePolicy = QueuePolicyRoundRobin
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	// The slow member never acknowledges its messages, and still gets
+	// every other message.
+	var slow, fast int32
+	if _, err := sc.QueueSubscribe("foo", "group", func(_ *stan.Msg) { atomic.AddInt32(&slow, 1) },
+		stan.SetManualAckMode()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if _, err := sc.QueueSubscribe("foo", "group", func(_ *stan.Msg) { atomic.AddInt32(&fast, 1) }); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	waitForCount(t, 10, func() (string, int) {
+		return "messages", int(atomic.LoadInt32(&slow) + atomic.LoadInt32(&fast))
+	})
+	if slow, fast := atomic.LoadInt32(&slow), atomic.LoadInt32(&fast); slow != 5 || fast != 5 {
+		t.Fatalf("Expected 5 messages each, got %v and %v", slow, fast)
+	}
+}
+
+func TestQueuePolicyInSubscriptionRequest(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	subscribe := func(group, policy string) string {
+		req := &spb.SubscriptionRequest{
+			ClientID:      clientName,
+			Subject:       "foo",
+			QGroup:        group,
+			Inbox:         nats.NewInbox(),
+			MaxInFlight:   10,
+			AckWaitInSecs: 30,
+			QueuePolicy:   policy,
+		}
+		b, _ := req.Marshal()
+		reply, err := nc.Request(s.info.Subscribe, b, 2*time.Second)
+		if err != nil {
+			stackFatalf(t, "Unexpected error on subscription request: %v", err)
+		}
+		resp := &spb.SubscriptionResponse{}
+		resp.Unmarshal(reply.Data)
+		return resp.Error
+	}
+	groupPolicy := func(group string) string {
+		ss := s.store.LookupChannel("foo").UserData.(*subStore)
+		ss.RLock()
+		defer ss.RUnlock()
+		return ss.qsubs[group].policy
+	}
+
+	if e := subscribe("g1", QueuePolicyRandom); e != "" {
+		t.Fatalf("Unexpected error: %v", e)
+	}
+	if e := subscribe("g1", ""); e != "" {
+		t.Fatalf("Unexpected error: %v", e)
+	}
+	if e := subscribe("g1", QueuePolicyRoundRobin); e != ErrQueuePolicyMismatch.Error() {
+		t.Fatalf("Expected error %q, got %q", ErrQueuePolicyMismatch, e)
+	}
+	if p := groupPolicy("g1"); p != QueuePolicyRandom {
+		t.Fatalf("Unexpected policy: %v", p)
+	}
+	// The server's default.
+	if e := subscribe("g2", ""); e != "" {
+		t.Fatalf("Unexpected error: %v", e)
+	}
+	if p := groupPolicy("g2"); p != QueuePolicyLeastPending {
+		t.Fatalf("Unexpected policy: %v", p)
+	}
+	if e := subscribe("g3", "fastest"); e != ErrInvalidQueuePolicy.Error() {
+		t.Fatalf("Expected error %q, got %q", ErrInvalidQueuePolicy, e)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// tokenBucket is a rate limiter allowing `rate` events per second, with
+// bursts of up to `burst` events.
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket, or nil if rate is not positive.
+// If burst is not positive, it is set to the rate (rounded up).
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	b := float64(burst)
+	if burst <= 0 {
+		b = math.Ceil(rate)
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+// refill adds the tokens accumulated since the last refill.
+// Lock held on entry.
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// delay returns how long to wait for `n` tokens to be available, 0 if
+// they are available now. A request for more tokens than the burst only
+// waits for the bucket to be full, and leaves it in debt once taken.
+// Lock held on entry.
+func (b *tokenBucket) delay(n float64) time.Duration {
+	if n > b.burst {
+		n = b.burst
+	}
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// tokenRequest is a number of tokens to take from a bucket.
+type tokenRequest struct {
+	bucket *tokenBucket // ignored if nil
+	tokens float64
+}
+
+// takeTokens takes the requested tokens from all the buckets, or returns
+// the delay after which they would all be available, in which case no
+// token is taken.
+func takeTokens(reqs ...tokenRequest) time.Duration {
+	now := time.Now()
+	var wait time.Duration
+	for _, r := range reqs {
+		if r.bucket == nil {
+			continue
+		}
+		r.bucket.Lock()
+		defer r.bucket.Unlock()
+		r.bucket.refill(now)
+		if d := r.bucket.delay(r.tokens); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, r := range reqs {
+		if r.bucket != nil {
+			r.bucket.tokens -= r.tokens
+		}
+	}
+	return 0
+}
+
+// retryAfterErr returns the error with the delay after which the client
+// should retry, rounded up to the millisecond.
+func retryAfterErr(err error, wait time.Duration) error {
+	wait = (wait + time.Millisecond - 1) / time.Millisecond * time.Millisecond
+	return fmt.Errorf("%v%s%v", err, retryAfterSep, wait)
+}
+
+// checkSubRate takes a token from the client's subscription bucket and
+// from the server's one, or returns ErrSubRateExceeded, suggesting a delay
+// after which the client should retry, if any of the buckets is empty.
+// No token is taken when the request is rejected. The server's internal
+// clients are not limited.
+func (s *StanServer) checkSubRate(clientID string) error {
+	var cb *tokenBucket
+	if c := s.clients.Lookup(clientID); c != nil {
+		c.Lock()
+		internal := c.internal
+		if !internal && c.subRate == nil {
+			c.subRate = newTokenBucket(s.opts.ClientSubRate, s.opts.ClientSubBurst)
+		}
+		cb = c.subRate
+		c.Unlock()
+		if internal {
+			return nil
+		}
+	}
+	if wait := takeTokens(tokenRequest{cb, 1}, tokenRequest{s.subRate, 1}); wait > 0 {
+		return retryAfterErr(ErrSubRateExceeded, wait)
+	}
+	return nil
+}
+
+// checkPubLimits checks that the client is allowed to publish the message,
+// given its number of messages not acknowledged yet and its publish rates.
+// On success, the client is returned if its messages in flight are counted,
+// and pubDone must be called once the message is acknowledged.
+func (s *StanServer) checkPubLimits(pm *spb.PubMsg) (*client, error) {
+	opts := s.opts
+	if opts.MaxPubAcksInFlight <= 0 && opts.ClientPubRate <= 0 && opts.ClientPubBytesRate <= 0 {
+		return nil, nil
+	}
+	c := s.clients.Lookup(pm.ClientID)
+	if c == nil {
+		return nil, nil
+	}
+	c.Lock()
+	internal := c.internal
+	if !internal && c.pubRate == nil && c.pubBytesRate == nil {
+		c.pubRate = newTokenBucket(opts.ClientPubRate, opts.ClientPubBurst)
+		c.pubBytesRate = newTokenBucket(opts.ClientPubBytesRate, opts.ClientPubBytesBurst)
+	}
+	pubRate, pubBytesRate := c.pubRate, c.pubBytesRate
+	c.Unlock()
+	if internal {
+		return nil, nil
+	}
+	if opts.MaxPubAcksInFlight > 0 &&
+		atomic.AddInt32(&c.pubsInFlight, 1) > int32(opts.MaxPubAcksInFlight) {
+		atomic.AddInt32(&c.pubsInFlight, -1)
+		return nil, ErrTooManyPubsInFlight
+	}
+	if wait := takeTokens(tokenRequest{pubRate, 1}, tokenRequest{pubBytesRate, float64(len(pm.Data))}); wait > 0 {
+		if opts.MaxPubAcksInFlight > 0 {
+			atomic.AddInt32(&c.pubsInFlight, -1)
+		}
+		return nil, retryAfterErr(ErrPubRateExceeded, wait)
+	}
+	if opts.MaxPubAcksInFlight <= 0 {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// pubDone is called once a message counted by checkPubLimits is
+// acknowledged, or rejected.
+func (c *client) pubDone() {
+	if c != nil {
+		atomic.AddInt32(&c.pubsInFlight, -1)
+	}
+}
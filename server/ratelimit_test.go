@@ -0,0 +1,219 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestTokenBucket(t *testing.T) {
+	if b := newTokenBucket(0, 10); b != nil {
+		t.Fatalf("Expected no bucket for a rate of 0, got %v", b)
+	}
+	if b := newTokenBucket(2.5, 0); b.burst != 3 {
+		t.Fatalf("Expected burst to default to the rate, got %v", b.burst)
+	}
+	b := newTokenBucket(10, 2)
+	now := b.last
+	b.tokens -= 2
+	if d := b.delay(1); d != 100*time.Millisecond {
+		t.Fatalf("Expected delay of 100ms, got %v", d)
+	}
+	b.refill(now.Add(50 * time.Millisecond))
+	if d := b.delay(1); d != 50*time.Millisecond {
+		t.Fatalf("Expected delay of 50ms, got %v", d)
+	}
+	// Tokens don't accumulate beyond the burst.
+	b.refill(now.Add(time.Hour))
+	if b.tokens != 2 {
+		t.Fatalf("Expected 2 tokens, got %v", b.tokens)
+	}
+}
+
+func checkSubRateExceeded(t *testing.T, err error) {
+	if err == nil || !strings.Contains(err.Error(), ErrSubRateExceeded.Error()) {
+		stackFatalf(t, "Expected error %q, got %v", ErrSubRateExceeded, err)
+	}
+	if d, ok := RetryAfter(err.Error()); !ok || d <= 0 {
+		stackFatalf(t, "Expected a retry delay, got %v (%v)", d, ok)
+	}
+}
+
+func TestClientSubRate(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.ClientSubRate = 0.1
+	opts.ClientSubBurst = 2
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}); err != nil {
+			t.Fatalf("Unexpected error on subscribe: %v", err)
+		}
+	}
+	_, err := sc.Subscribe("foo", func(_ *stan.Msg) {})
+	checkSubRateExceeded(t, err)
+
+	// Other clients have their own limit.
+	sc2, err := stan.Connect(clusterName, "otherClient")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer sc2.Close()
+	if _, err := sc2.Subscribe("foo", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+}
+
+func TestSubRate(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.SubRate = 10
+	opts.SubBurst = 1
+	opts.ClientSubRate = 100
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	sc2, err := stan.Connect(clusterName, "otherClient")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer sc2.Close()
+
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	_, err = sc2.Subscribe("foo", func(_ *stan.Msg) {})
+	checkSubRateExceeded(t, err)
+
+	// The request is accepted after the suggested delay.
+	d, _ := RetryAfter(err.Error())
+	time.Sleep(d)
+	if _, err := sc2.Subscribe("foo", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+}
+
+func checkPubRateExceeded(t *testing.T, err error) {
+	if err == nil || !strings.Contains(err.Error(), ErrPubRateExceeded.Error()) {
+		stackFatalf(t, "Expected error %q, got %v", ErrPubRateExceeded, err)
+	}
+	if d, ok := RetryAfter(err.Error()); !ok || d <= 0 {
+		stackFatalf(t, "Expected a retry delay, got %v (%v)", d, ok)
+	}
+}
+
+func TestClientPubRate(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.ClientPubRate = 10
+	opts.ClientPubBurst = 2
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	err := sc.Publish("foo", []byte("hello"))
+	checkPubRateExceeded(t, err)
+	d, _ := RetryAfter(err.Error())
+
+	// Other clients have their own limit.
+	sc2, err := stan.Connect(clusterName, "otherClient")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer sc2.Close()
+	if err := sc2.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+
+	// The message is accepted after the suggested delay.
+	time.Sleep(d)
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+}
+
+func TestClientPubBytesRate(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.ClientPubBytesRate = 100
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	// A message larger than the burst is accepted on a full bucket...
+	if err := sc.Publish("foo", make([]byte, 150)); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	// ...but the next ones have to wait for the debt to be paid.
+	err := sc.Publish("foo", []byte("hello"))
+	checkPubRateExceeded(t, err)
+	if d, _ := RetryAfter(err.Error()); d < 400*time.Millisecond {
+		t.Fatalf("Expected a delay of at least 400ms, got %v", d)
+	}
+}
+
+func TestMaxPubAcksInFlight(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.MaxPubAcksInFlight = 2
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	pm := &spb.PubMsg{ClientID: clientName, Subject: "foo", Data: []byte("hello")}
+	var inFlight []*client
+	for i := 0; i < 2; i++ {
+		c, err := s.checkPubLimits(pm)
+		if err != nil || c == nil {
+			t.Fatalf("Unexpected result: %v %v", c, err)
+		}
+		inFlight = append(inFlight, c)
+	}
+	if _, err := s.checkPubLimits(pm); err != ErrTooManyPubsInFlight {
+		t.Fatalf("Expected error %v, got %v", ErrTooManyPubsInFlight, err)
+	}
+	inFlight[0].pubDone()
+	if _, err := s.checkPubLimits(pm); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Acknowledged messages are no longer in flight.
+	sc2, err := stan.Connect(clusterName, "otherClient")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer sc2.Close()
+	for i := 0; i < 10; i++ {
+		if err := sc2.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	c := s.clients.Lookup("otherClient")
+	if n := atomic.LoadInt32(&c.pubsInFlight); n != 0 {
+		t.Fatalf("Expected no message in flight, got %v", n)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"errors"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+// ErrInvalidReplayRate is returned when a subscription request has a
+// negative replay rate.
+var ErrInvalidReplayRate = errors.New("stan: invalid replay rate, should be >= 0")
+
+// replayLimits throttle the messages sent to a subscription, set by the
+// ReplayMsgsPerSec and ReplayBytesPerSec fields of the request creating or
+// resuming it. This prevents a subscription replaying a large channel from
+// saturating the disk and the network.
+type replayLimits struct {
+	msgs  *tokenBucket // nil if the number of messages is not limited
+	bytes *tokenBucket // nil if the payload bytes are not limited
+	timer util.Timer   // non nil while waiting to send more messages
+}
+
+// newReplayLimits returns the replay limits of the subscription request,
+// nil if it has none.
+func newReplayLimits(sr *spb.SubscriptionRequest) *replayLimits {
+	if sr.ReplayMsgsPerSec <= 0 && sr.ReplayBytesPerSec <= 0 {
+		return nil
+	}
+	return &replayLimits{
+		msgs:  newTokenBucket(float64(sr.ReplayMsgsPerSec), 0),
+		bytes: newTokenBucket(float64(sr.ReplayBytesPerSec), 0),
+	}
+}
+
+// stop cancels the pending send of messages, if any.
+func (r *replayLimits) stop() {
+	if r != nil && r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
+
+// validateReplayRates checks the replay rates of the subscription request.
+func validateReplayRates(sr *spb.SubscriptionRequest) error {
+	if sr.ReplayMsgsPerSec < 0 || sr.ReplayBytesPerSec < 0 {
+		return ErrInvalidReplayRate
+	}
+	return nil
+}
+
+// canReplay returns true if the replay limits of the subscription allow
+// `m` to be sent now, in which case the tokens are taken. Otherwise, the
+// available messages of the channel are sent again once the tokens are
+// available. Sub lock held on entry.
+func (s *StanServer) canReplay(cs *stores.ChannelStore, sub *subState, m *spb.MsgProto) bool {
+	r := sub.replay
+	if r == nil {
+		return true
+	}
+	if r.timer != nil {
+		return false
+	}
+	wait := takeTokens(tokenRequest{r.msgs, 1}, tokenRequest{r.bytes, float64(len(m.Data))})
+	if wait == 0 {
+		return true
+	}
+	r.timer = s.clock.AfterFunc(wait, func() {
+		sub.Lock()
+		// The limits may have been replaced since.
+		if sub.replay != r || r.timer == nil {
+			sub.Unlock()
+			return
+		}
+		r.timer = nil
+		online := sub.ClientID != ""
+		sub.Unlock()
+		if online {
+			s.sendAvailableMessages(cs, sub)
+		}
+	})
+	return false
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestReplayRateLimits(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := sc.Publish("foo", make([]byte, 10)); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	// Replays the channel with the given rates, and checks that the first
+	// 5 messages are sent at once, and the 5 others over about a second.
+	check := func(msgsRate int32, bytesRate int64) {
+		raw := make(chan *nats.Msg, 10)
+		inbox := nats.NewInbox()
+		if _, err := nc.ChanSubscribe(inbox, raw); err != nil {
+			stackFatalf(t, "Unexpected error on subscribe: %v", err)
+		}
+		start := time.Now()
+		resp := subscribeRaw(t, nc, s, &spb.SubscriptionRequest{
+			ClientID:          clientName,
+			Subject:           "foo",
+			Inbox:             inbox,
+			MaxInFlight:       100,
+			AckWaitInSecs:     30,
+			StartPosition:     spb.StartPosition_First,
+			ReplayMsgsPerSec:  msgsRate,
+			ReplayBytesPerSec: bytesRate,
+		})
+		if resp.Error != "" {
+			stackFatalf(t, "Unexpected error: %v", resp.Error)
+		}
+		for i := 1; i <= 10; i++ {
+			select {
+			case m := <-raw:
+				msg := &spb.MsgProto{}
+				if err := msg.Unmarshal(m.Data); err != nil || msg.Sequence != uint64(i) {
+					stackFatalf(t, "Expected message %v, got %v (%v)", i, msg, err)
+				}
+			case <-time.After(2 * time.Second):
+				stackFatalf(t, "Did not get message %v", i)
+			}
+			elapsed := time.Since(start)
+			if i == 5 && elapsed > 500*time.Millisecond {
+				stackFatalf(t, "The burst took too long: %v", elapsed)
+			}
+			if i == 10 && (elapsed < 800*time.Millisecond || elapsed > 2*time.Second) {
+				stackFatalf(t, "Unexpected replay duration: %v", elapsed)
+			}
+		}
+	}
+	check(5, 0)
+	check(0, 50)
+	check(100, 50)
+
+	// Negative rates are rejected.
+	resp := subscribeRaw(t, nc, s, &spb.SubscriptionRequest{
+		ClientID:         clientName,
+		Subject:          "foo",
+		Inbox:            nats.NewInbox(),
+		MaxInFlight:      100,
+		AckWaitInSecs:    30,
+		ReplayMsgsPerSec: -1,
+	})
+	if resp.Error != ErrInvalidReplayRate.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidReplayRate, resp.Error)
+	}
+}
@@ -3,15 +3,18 @@
 package server
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"net/url"
+	"os"
 	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/nats-io/gnatsd/auth"
 	"github.com/nats-io/gnatsd/server"
@@ -23,6 +26,7 @@ import (
 	natsd "github.com/nats-io/gnatsd/test"
 
 	stores "github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
 
 	"regexp"
 )
@@ -39,9 +43,17 @@ const (
 	DefaultPubPrefix      = "_STAN.pub"
 	DefaultSubPrefix      = "_STAN.sub"
 	DefaultUnSubPrefix    = "_STAN.unsub"
+	DefaultSubClosePrefix = "_STAN.subclose"
 	DefaultClosePrefix    = "_STAN.close"
+	DefaultFlushPrefix    = "_STAN.flush"
+	DefaultClaimPrefix    = "_STAN.claim"
+	DefaultDLQPrefix      = "_STAN.DLQ"
 	DefaultStoreType      = stores.TypeMemory
 
+	// EncryptionKeyEnv is the environment variable holding the key used to
+	// encrypt the FILE store, when not set in the options.
+	EncryptionKeyEnv = "STAN_ENCRYPTION_KEY"
+
 	// DefaultChannelLimit defines how many channels (literal subjects) we allow
 	DefaultChannelLimit = 100
 	// DefaultSubStoreLimit defines how many subscriptions per channel we allow
@@ -56,6 +68,11 @@ const (
 	DefaultClientHBTimeout     = 10 * time.Second
 	DefaultMaxFailedHeartBeats = int((5 * time.Minute) / DefaultHeartBeatInterval)
 
+	// DefaultRetryAfter is the delay suggested to clients whose connect or
+	// subscription request is rejected because the server is recovering
+	// or overloaded.
+	DefaultRetryAfter = time.Second
+
 	// Max number of outstanding go-routines handling connect requests for
 	// duplicate client IDs.
 	defaultMaxDupCIDRoutines = 100
@@ -73,36 +90,54 @@ const (
 	// DefaultIOSleepTime is the duration (in micro-seconds) the server waits for more messages
 	// before starting processing. Set to 0 (or negative) to disable the wait.
 	DefaultIOSleepTime = int64(0)
+
+	// DefaultDeliveryBurst is the maximum number of messages sent to a
+	// subscription before moving to the next one when delivering newly
+	// stored messages. 0 means no limit.
+	DefaultDeliveryBurst = 0
 )
 
 // Constant to indicate that sendMsgToSub() should check number of acks pending
 // against MaxInFlight to know if message should be sent out.
 const honorMaxInFlight = false
 
-// Allows to be overriden in tests
-var maxStalledRedeliveries = int32(defaultMaxStalledRedeliveries)
-
-// Used by tests
-func setMaxStalledRedeliveries(val int) {
-	atomic.StoreInt32(&maxStalledRedeliveries, int32(val))
+// Used by tests to override the number of stalled redeliveries
+// allowed before forcing redelivery.
+func (s *StanServer) setMaxStalledRedeliveries(val int) {
+	atomic.StoreInt32(&s.maxStalledRdlv, int32(val))
 }
 
 // Errors.
 var (
-	ErrInvalidSubject  = errors.New("stan: invalid subject")
-	ErrInvalidSequence = errors.New("stan: invalid start sequence")
-	ErrInvalidTime     = errors.New("stan: invalid start time")
-	ErrInvalidSub      = errors.New("stan: invalid subscription")
-	ErrInvalidClient   = errors.New("stan: clientID already registered")
-	ErrInvalidAckWait  = errors.New("stan: invalid ack wait time, should be >= 1s")
-	ErrInvalidConnReq  = errors.New("stan: invalid connection request")
-	ErrInvalidPubReq   = errors.New("stan: invalid publish request")
-	ErrInvalidSubReq   = errors.New("stan: invalid subscription request")
-	ErrInvalidUnsubReq = errors.New("stan: invalid unsubscribe request")
-	ErrInvalidCloseReq = errors.New("stan: invalid close request")
-	ErrDupDurable      = errors.New("stan: duplicate durable registration")
-	ErrDurableQueue    = errors.New("stan: queue subscribers can't be durable")
-	ErrUnknownClient   = errors.New("stan: unkwown clientID")
+	ErrInvalidSubject      = errors.New("stan: invalid subject")
+	ErrInvalidSequence     = errors.New("stan: invalid start sequence")
+	ErrInvalidTime         = errors.New("stan: invalid start time")
+	ErrUnknownStartGUID    = errors.New("stan: no stored message with the start GUID")
+	ErrInvalidSub          = errors.New("stan: invalid subscription")
+	ErrInvalidClient       = errors.New("stan: clientID already registered")
+	ErrInvalidAckWait      = errors.New("stan: invalid ack wait time, should be >= 1s")
+	ErrInvalidMaxInFlight  = errors.New("stan: invalid max in flight, should be >= 1")
+	ErrInvalidConnReq      = errors.New("stan: invalid connection request")
+	ErrInvalidPubReq       = errors.New("stan: invalid publish request")
+	ErrInvalidSubReq       = errors.New("stan: invalid subscription request")
+	ErrInvalidUnsubReq     = errors.New("stan: invalid unsubscribe request")
+	ErrInvalidSubClose     = errors.New("stan: invalid subscription close request")
+	ErrInvalidCloseReq     = errors.New("stan: invalid close request")
+	ErrInvalidFlushReq     = errors.New("stan: invalid flush request")
+	ErrInvalidClaimReq     = errors.New("stan: invalid claim request")
+	ErrNotPending          = errors.New("stan: message is not pending acknowledgment")
+	ErrDupDurable          = errors.New("stan: duplicate durable registration")
+	ErrUnknownClient       = errors.New("stan: unkwown clientID")
+	ErrUnknownChannel      = errors.New("stan: unknown channel")
+	ErrChannelHasSubs      = errors.New("stan: channel has active subscriptions")
+	ErrRecovering          = errors.New("stan: server is recovering")
+	ErrOverloaded          = errors.New("stan: server is overloaded")
+	ErrDraining            = errors.New("stan: server is shutting down")
+	ErrSubRateExceeded     = errors.New("stan: subscription rate exceeded")
+	ErrPubRateExceeded     = errors.New("stan: publish rate exceeded")
+	ErrTooManyPubsInFlight = errors.New("stan: too many published messages not acknowledged")
+	ErrMissingClientID     = errors.New("stan: malformed subscription request, clientID missing")
+	ErrNoEncryptionKey     = errors.New("stan: encryption requires a key, set with the " + EncryptionKeyEnv + " environment variable or the configuration file")
 )
 
 // Shared regular expression to check clientID validity.
@@ -110,6 +145,9 @@ var (
 // A Regexp is safe for concurrent use by multiple goroutines.
 var clientIDRegEx *regexp.Regexp
 
+// Regular expression to check the keys of the headers of messages.
+var headerKeyRegEx = regexp.MustCompile("^[a-zA-Z0-9_.-]+$")
+
 func init() {
 	if re, err := regexp.Compile("^[a-zA-Z0-9_-]+$"); err != nil {
 		panic("Unable to compile regular expression")
@@ -119,13 +157,26 @@ func init() {
 }
 
 type ioPendingMsg struct {
-	pm *pb.PubMsg
+	pm *spb.PubMsg
 	m  *nats.Msg
+	fr *spb.FlushRequest // Non nil if this is a flush request
+	c  *client           // Non nil if the publisher's messages in flight are limited
+	t  *pubTimes         // Non nil if publishes are timed, for their latency or the slow log
+	ct string            // Content type of the message, if counted
 }
 
 // Constant that defines the size of the channel that feeds the IO thread.
 const ioChannelSize = 64 * 1024
 
+// When the number of messages pending in the IO channel reaches this value,
+// the server is considered overloaded and rejects new connect and
+// subscription requests.
+const ioChannelHighWatermark = ioChannelSize * 9 / 10
+
+// retryAfterSep separates the error from the suggested retry delay in
+// errors returned to clients when a request is rejected.
+const retryAfterSep = ", retry after "
+
 // StanServer structure represents the STAN server
 type StanServer struct {
 	// Keep all members for which we use atomic at the beginning of the
@@ -133,18 +184,23 @@ type StanServer struct {
 	// atomic.* functions crash on 32bit machines if operand is not aligned
 	// at 64bit. See https://github.com/golang/go/issues/599
 	ioChannelStatsMaxBatchSize int64 // stats of the max number of messages than went into a single batch
+	maxStalledRdlv             int32 // number of stalled redeliveries before forcing redelivery
+	recovering                 int32 // 1 while the recovered state is being processed
+	draining                   int32 // 1 once Stop has been called
 
 	sync.RWMutex
 	shutdown   bool
 	serverID   string
+	startTime  time.Time
 	info       spb.ServerInfo // Contains cluster ID and subjects
 	natsServer *server.Server
 	opts       *Options
+	log        *serverLogger
 	nc         *nats.Conn
 	wg         sync.WaitGroup // Wait on go routines during shutdown
 
-	// For now, these will be set to the constants DefaultHeartBeatInterval, etc...
-	// but allow to override in tests.
+	// These are set from the options (or the constants DefaultHeartBeatInterval,
+	// etc...) but allow to override in tests.
 	hbInterval  time.Duration
 	hbTimeout   time.Duration
 	maxFailedHB int
@@ -157,17 +213,105 @@ type StanServer struct {
 	dupCIDTimeout     time.Duration
 	dupMaxCIDRoutines int
 
+	// IDs of the internal clients being registered, allowed by the Authorizer.
+	internalConnects map[string]struct{}
+
 	// Clients
 	clients *clientStore
 
+	// Limits the rate of subscription requests, nil if not limited.
+	subRate *tokenBucket
+
+	// Limits the clients and channels per NATS connection, nil if not limited.
+	connLimits *connLimits
+	clientTags *clientTags
+
+	// Subscriptions not written to the store yet.
+	lazySubs lazySubs
+
+	// Durables unsubscribed during the last DurableGracePeriod.
+	tombstones durableTombstones
+
+	// Last sequences of the ordering groups, nil if they are disabled, and
+	// those assigned by the current batch of the IO loop, recorded in the
+	// store once the batch is flushed.
+	groups        orderingGroups
+	groupsToStore orderingGroups
+
+	// URL of the monitoring endpoints of the embedded NATS Server, and
+	// listener serving the bootstrap info over HTTP (nil if not enabled).
+	monitoringURL string
+	infoListener  net.Listener
+
+	// Subscriptions on subjects with wildcards, added to the matching
+	// channels as they are created.
+	wildcards wildcardSubs
+
 	// Store
 	store stores.Store
 
+	// Used for timers and timestamps, can be replaced in tests.
+	clock util.Clock
+
 	// IO Channel
 	ioChannel     chan (*ioPendingMsg)
 	ioChannelQuit chan bool
 	ioChannelWG   sync.WaitGroup
 
+	// Subject, under the publish prefix, used to queue flush requests
+	// behind messages already received from publishers.
+	flushMarker string
+
+	// Latency of the stages of publishes, nil if not recorded.
+	pubLatency *pubLatency
+
+	// GUIDs of the recently stored messages, nil if duplicates are stored.
+	dedup *dedupWindow
+
+	// Content types of the stored messages, nil if not counted.
+	contentTypes *contentTypes
+
+	// Messages discarded by the limits of each channel.
+	storeFull *storeFull
+
+	// Resolves the limits of each channel.
+	limits *limitsResolver
+
+	// Logs the slow protocol requests, nil if disabled.
+	slowLog *slowLog
+
+	// Publishes probes and checks that they are all received once, in order.
+	canary *canary
+
+	// Deliver messages to HTTP endpoints.
+	webhooks *webhooks
+
+	// Move messages between channels and queues of other brokers.
+	shovels *shovels
+
+	// Deletes the channels inactive for longer than MaxInactivity.
+	inactivityQuit chan struct{}
+	inactivityWG   sync.WaitGroup
+
+	// Detects the stalled deliveries, nil if disabled.
+	watchdog *deliveryWatchdog
+
+	// Detects the slow consumers, nil if disabled.
+	slowConsumers *slowConsumers
+
+	// Fault tolerance
+	state  State
+	ftQuit chan struct{}
+	ftHBCh chan struct{} // Signaled on heartbeats of the active server
+	ftWG   sync.WaitGroup
+	ftLock *util.LockFile
+	// Failover drill, demoting the active server or checked by the
+	// promoted one.
+	ftDrill failoverDrill
+
+	// Proxy of the embedded NATS Server, nil if its socket can't be handed off.
+	natsProxy *natsProxy
+
 	// Use these flags for Debug/Trace in places where speed matters.
 	// Normally, Debugf and Tracef will check an atomic variable to
 	// figure out if the statement should be logged, however, the
@@ -181,11 +325,20 @@ type StanServer struct {
 
 // subStore holds all known state for all subscriptions
 type subStore struct {
+	activity  int64 // last time, in nanoseconds, the channel was used, updated atomically
+	lazyCount int32 // subscriptions not written to the store yet, updated atomically
 	sync.RWMutex
+	stan     *StanServer            // back link to the server
 	psubs    []*subState            // plain subscribers
 	qsubs    map[string]*queueState // queue subscribers
 	durables map[string]*subState   // durables lookup
 	acks     map[string]*subState   // ack inbox lookup
+	// A single plain subscription receives messages, see
+	// Options.ExclusiveChannels.
+	exclusive bool
+	// Workers sending the new messages, nil for none, see
+	// Options.DeliveryWorkers.
+	deliveryPool *deliveryPool
 }
 
 // Holds all queue subsribers for a subject/group and
@@ -195,6 +348,9 @@ type queueState struct {
 	lastSent uint64
 	subs     []*subState
 	stalled  bool
+	rdlvs    map[uint64]int // number of redeliveries of pending messages, if limited
+	policy   string         // delivery policy, set by the member creating the group
+	shadow   *subState      // last member of a durable queue group, kept once all members left
 }
 
 // Holds Subscription state
@@ -204,14 +360,93 @@ type subState struct {
 	subject      string
 	qstate       *queueState
 	ackWait      time.Duration // SubState.AckWaitInSecs expressed as a time.Duration
-	ackTimer     *time.Timer
+	baseAckWait  time.Duration // ackWait before the redelivery backoff, if backing off
+	ackTimer     util.Timer
 	ackTimeFloor int64
 	ackSub       *nats.Subscription
-	acksPending  map[uint64]*pb.MsgProto
-	stalledRdlv  int32 // number of times the redelivery cb ended with a stalled subscriber (due to MaxInFlight)
+	acksPending  map[uint64]*spb.MsgProto
+	claims       map[uint64]int64    // expiration of claims on pending messages, which delay their redelivery
+	rdlvs        map[uint64]int      // number of redeliveries of pending messages, if limited
+	rejected     map[uint64]struct{} // pending messages rejected by the DeliveryInterceptor, to move to the dead-letter channel
+	stalledRdlv  int32               // number of times the redelivery cb ended with a stalled subscriber (due to MaxInFlight)
 	stalled      bool
 	newOnHold    bool            // Prevents delivery of new msgs until old are redelivered (on restart)
 	store        stores.SubStore // for easy access to the store interface
+	window       *deliveryWindow // non nil if the delivery window is adaptive
+	lazy         *lazySubs       // non nil while the subscription is not in the store
+	hintCount    int             // messages sent since the last backlog hint
+	paused       bool            // no message is sent while paused
+	frozen       bool            // no message is sent nor redelivered while a takeover of the client is checked
+	standby      bool            // no message is sent while waiting to take over the consumer of an exclusive channel
+	ackLatency   *ackLatency     // non nil once a message is sent to a durable recording its ack latency
+	clamped      bool            // the start position of the last request creating or resuming the subscription was clamped
+	replay       *replayLimits   // non nil if the messages sent are throttled
+	filter       *msgFilter      // non nil if the messages sent are filtered
+	fullSince    int64           // time since which the messages pending acknowledgment are at MaxInFlight, if checked
+}
+
+// Initial size of an adaptive delivery window (capped by the subscription's
+// MaxInFlight).
+const adaptiveInitialWindow = 16
+
+// deliveryWindow is used, when Options.AdaptiveMaxInFlight is set, to adjust
+// the number of unacknowledged messages allowed for a subscription. The
+// window grows by one for each ack received within a quarter of the AckWait,
+// and is halved for each ack received after half of the AckWait, or when
+// messages are redelivered. It stays between 1 and the MaxInFlight declared
+// by the subscriber.
+type deliveryWindow struct {
+	size     int32
+	sentTime map[uint64]int64 // time at which the pending messages were sent
+}
+
+// newDeliveryWindow returns a delivery window if the adaptive mode is
+// enabled, nil otherwise.
+func (s *StanServer) newDeliveryWindow(maxInFlight int32) *deliveryWindow {
+	if !s.opts.AdaptiveMaxInFlight {
+		return nil
+	}
+	size := int32(adaptiveInitialWindow)
+	if maxInFlight < size {
+		size = maxInFlight
+	}
+	return &deliveryWindow{size: size, sentTime: make(map[uint64]int64)}
+}
+
+// onAck adjusts the window based on the latency of the ack for the given
+// sequence.
+func (w *deliveryWindow) onAck(sequence uint64, now int64, ackWait time.Duration, maxInFlight int32) {
+	sent, ok := w.sentTime[sequence]
+	if !ok {
+		return
+	}
+	delete(w.sentTime, sequence)
+	latency := time.Duration(now - sent)
+	if latency <= ackWait/4 {
+		if w.size < maxInFlight {
+			w.size++
+		}
+	} else if latency >= ackWait/2 {
+		w.shrink()
+	}
+}
+
+// shrink halves the size of the window.
+func (w *deliveryWindow) shrink() {
+	if w.size > 1 {
+		w.size /= 2
+	}
+}
+
+// maxInFlight returns the number of unacknowledged messages allowed for
+// this subscription, which is the MaxInFlight of the subscription or the
+// size of the adaptive delivery window.
+// Lock held on entry.
+func (sub *subState) maxInFlight() int32 {
+	if sub.window != nil && sub.window.size < sub.MaxInFlight {
+		return sub.window.size
+	}
+	return sub.MaxInFlight
 }
 
 // Looks up, or create a new channel if it does not exist
@@ -219,19 +454,33 @@ func (s *StanServer) lookupOrCreateChannel(channel string) (*stores.ChannelStore
 	if cs := s.store.LookupChannel(channel); cs != nil {
 		return cs, nil
 	}
+	// An archive reader serves the archived channels only.
+	if s.opts.ArchiveReader {
+		return nil, ErrUnknownChannel
+	}
+	if err := s.checkPlacement(channel); err != nil {
+		return nil, err
+	}
 	// It's possible that more than one go routine comes here at the same
 	// time. `ss` will then be simply gc'ed.
-	ss := createSubStore()
-	cs, _, err := s.store.CreateChannel(channel, ss)
+	ss := s.createSubStore()
+	ss.exclusive = isExclusiveChannel(s.opts.ExclusiveChannels, channel)
+	ss.deliveryPool = newDeliveryPool(s.deliveryWorkersFor(channel))
+	ss.touch(s.clock.Now().UnixNano())
+	cs, isNew, err := s.store.CreateChannel(channel, ss)
 	if err != nil {
 		return nil, err
 	}
+	if isNew {
+		s.addWildcardSubsTo(cs, channel)
+	}
 	return cs, nil
 }
 
 // createSubStore creates a new instance of `subStore`.
-func createSubStore() *subStore {
+func (s *StanServer) createSubStore() *subStore {
 	subs := &subStore{
+		stan:     s,
 		psubs:    make([]*subState, 0, 4),
 		qsubs:    make(map[string]*queueState),
 		durables: make(map[string]*subState),
@@ -250,11 +499,13 @@ func (ss *subStore) Store(sub *subState) error {
 	subStateProto := &sub.SubState
 	store := sub.store
 
-	// Adds to storage.
-	err := store.CreateSub(subStateProto)
-	if err != nil {
-		Errorf("Unable to store subscription [%v:%v] on [%s]: %v", sub.ClientID, sub.Inbox, sub.subject, err)
-		return err
+	// Adds to storage, unless created lazily.
+	if sub.lazy == nil {
+		err := store.CreateSub(subStateProto)
+		if err != nil {
+			ss.stan.log.Errorf("Unable to store subscription [%v:%v] on [%s]: %v", sub.ClientID, sub.Inbox, sub.subject, err)
+			return err
+		}
 	}
 
 	ss.Lock()
@@ -277,12 +528,23 @@ func (ss *subStore) updateState(sub *subState) {
 		qs := ss.qsubs[sub.QGroup]
 		if qs == nil {
 			qs = &queueState{
-				subs: make([]*subState, 0, 4),
+				subs:   make([]*subState, 0, 4),
+				policy: sub.QueuePolicy,
+			}
+			// Groups recovered from stores without policies.
+			if qs.policy == "" {
+				qs.policy = QueuePolicyLeastPending
 			}
 			ss.qsubs[sub.QGroup] = qs
 		}
 		qs.Lock()
-		qs.subs = append(qs.subs, sub)
+		if sub.isDurableQueueSub() && sub.ClientID == "" {
+			// Recovered member of a durable queue group whose members all left.
+			delete(ss.acks, sub.AckInbox)
+			ss.setDurableQueueShadow(qs, sub)
+		} else {
+			qs.subs = append(qs.subs, sub)
+		}
 		// Needed in the case of server restart, where
 		// the queue group's last sent needs to be updated
 		// based on the recovered subscriptions.
@@ -294,22 +556,36 @@ func (ss *subStore) updateState(sub *subState) {
 	} else {
 		// Plain subscriber.
 		ss.psubs = append(ss.psubs, sub)
+		ss.electExclusiveConsumer(false, 0)
 	}
 
-	// Hold onto durables in special lookup.
-	if sub.DurableName != "" {
+	// Hold onto durables in special lookup. Durable queue groups are
+	// looked up by their name.
+	if sub.DurableName != "" && sub.QGroup == "" {
 		ss.durables[sub.durableKey()] = sub
 	}
 }
 
-// Remove
-func (ss *subStore) Remove(sub *subState, force bool) {
+// Remove removes the subscription from the subStore, and from the store
+// if `force` is true or it is not durable. Returns the standby subscription
+// promoted to consumer of an exclusive channel, if any.
+func (ss *subStore) Remove(sub *subState, force bool) *subState {
 	if sub == nil {
-		return
+		return nil
 	}
 
 	sub.Lock()
 	sub.clearAckTimer()
+	sub.replay.stop()
+	// The durable key includes the clientID, get it first.
+	durableKey := ""
+	durableQueue := sub.isDurableQueueSub()
+	if sub.DurableName != "" && !durableQueue {
+		durableKey = sub.durableKey()
+	}
+	// The consumer of an exclusive channel hands over to a standby.
+	handover := ss.exclusive && sub.qstate == nil && sub.ClientID != "" && !sub.standby
+	handoverSeq := sub.exclusiveHandover()
 	// Clear the subscriptions clientID
 	sub.ClientID = ""
 	if sub.ackSub != nil {
@@ -318,15 +594,16 @@ func (ss *subStore) Remove(sub *subState, force bool) {
 	}
 	ackInbox := sub.AckInbox
 	qs := sub.qstate
-	durableKey := ""
-	if sub.DurableName != "" {
-		durableKey = sub.durableKey()
-	}
 	subid := sub.ID
 	store := sub.store
+	lazy := sub.lazy
+	sub.lazy = nil
 	sub.Unlock()
 
-	if force {
+	if lazy != nil {
+		// Never written to the store.
+		lazy.remove(sub)
+	} else if force && !durableQueue {
 		// Delete from storage
 		store.DeleteSub(subid)
 	}
@@ -341,7 +618,9 @@ func (ss *subStore) Remove(sub *subState, force bool) {
 	}
 
 	// Delete ourselves from the list
-	if qs != nil {
+	if durableQueue {
+		ss.leaveDurableQueue(sub, qs, force)
+	} else if qs != nil {
 		// For queue state, we need to lock specifically,
 		// because qs.subs can be modified by findBestQueueSub,
 		// for which we don't have substore lock held.
@@ -351,7 +630,12 @@ func (ss *subStore) Remove(sub *subState, force bool) {
 	} else {
 		ss.psubs, _ = sub.deleteFromList(ss.psubs)
 	}
+	var promoted *subState
+	if handover {
+		promoted = ss.electExclusiveConsumer(true, handoverSeq)
+	}
 	ss.Unlock()
+	return promoted
 }
 
 // Lookup by durable name.
@@ -372,35 +656,131 @@ func (ss *subStore) LookupByAckInbox(ackInbox string) *subState {
 
 // Options for STAN Server
 type Options struct {
-	ID               string
-	DiscoverPrefix   string
-	StoreType        string
-	FilestoreDir     string
-	FileStoreOpts    stores.FileStoreOptions
-	MaxChannels      int
-	MaxMsgs          int    // Maximum number of messages per channel
-	MaxBytes         uint64 // Maximum number of bytes used by messages per channel
-	MaxSubscriptions int    // Maximum number of subscriptions per channel
-	Trace            bool   // Verbose trace
-	Debug            bool   // Debug trace
-	Secure           bool   // Create a TLS enabled connection w/o server verification
-	ClientCert       string // Client Certificate for TLS
-	ClientKey        string // Client Key for TLS
-	ClientCA         string // Client CAs for TLS
-	IOBatchSize      int    // Number of messages we collect from clients before processing them.
-	IOSleepTime      int64  // Duration (in micro-seconds) the server waits for more message to fill up a batch.
-	NATSServerURL    string // URL for external NATS Server to connect to. If empty, NATS Server is embedded.
+	ID                  string
+	DiscoverPrefix      string
+	StoreType           string
+	FilestoreDir        string
+	SQLDriver           string            // Name of the database driver for SQL stores (postgres or mysql).
+	SQLSource           string            // Data source name for SQL stores.
+	HybridMaxMemBytes   uint64            // Payload bytes each channel of a HYBRID store keeps in memory before spilling to disk (0 for the default).
+	HybridCacheBytes    uint64            // Payload bytes of the messages read back from the HYBRID store spill files kept in a LRU cache (0 to disable).
+	HybridReadAhead     int               // Messages read at once from the HYBRID store spill files, into the cache, when they are replayed sequentially (0 to disable).
+	MemoryBudget        uint64            // Payload bytes of the messages of all channels of a MEMORY store, old messages being evicted beyond (0 for no limit).
+	MemoryEviction      string            // Channels whose messages are evicted when the MemoryBudget is exceeded: proportional (default) or lru.
+	StoreParams         map[string]string // Parameters of a store type registered with stores.Register.
+	FileStoreOpts       stores.FileStoreOptions
+	Encrypt             bool         // Encrypt the records of the FILE store.
+	EncryptionKey       *util.Secret // Key used to encrypt the FILE store (read from the STAN_ENCRYPTION_KEY environment variable if not set).
+	MaxChannels         int
+	MaxMsgs             int                 // Maximum number of messages per channel
+	MaxBytes            uint64              // Maximum number of bytes used by messages per channel
+	MaxSubscriptions    int                 // Maximum number of subscriptions per channel
+	MaxInactivity       time.Duration       // Time without subscriptions and new messages after which a channel is deleted (0 for no limit).
+	DurableGracePeriod  time.Duration       // Time during which an unsubscribed durable can be restored (0 to delete it immediately).
+	Trace               bool                // Verbose trace
+	Debug               bool                // Debug trace
+	LogJSON             bool                // Write the logs as JSON objects, one per line.
+	Logger              Logger              // Logger of this server, instead of the one set by ConfigureLogger, for instance to plug the application's logging library.
+	Authorizer          Authorizer          // Decides whether clients may connect, publish and subscribe (nil to allow all).
+	Secure              bool                // Create a TLS enabled connection w/o server verification
+	ClientCert          string              // Client Certificate for TLS
+	ClientKey           string              // Client Key for TLS
+	ClientCA            string              // Client CAs for TLS
+	TLSServerCert       string              // Certificate of the embedded NATS Server, unless set in its options (requires TLS).
+	TLSServerKey        string              // Private key of the embedded NATS Server certificate, unless set in its options.
+	IOBatchSize         int                 // Number of messages we collect from clients before processing them.
+	IOSleepTime         int64               // Duration (in micro-seconds) the server waits for more message to fill up a batch.
+	NATSServerURL       string              // URL for external NATS Server to connect to. If empty, NATS Server is embedded.
+	Username            string              // User of the connection to the NATS Server, instead of the NATS Server options (credentials in the URL take precedence).
+	Password            *util.Secret        // Password of the connection to the NATS Server.
+	Token               *util.Secret        // Authorization token of the connection to the NATS Server, instead of a user.
+	ValidateOnly        bool                // Validate the configuration, store and NATS connectivity, then exit.
+	DeliveryBurst       int                 // Max number of new messages sent to a subscription before moving to the next one (0 for no limit).
+	DeliveryWorkers     int                 // Go routines sending the new messages of a channel to its subscriptions in parallel (0 or 1 for none).
+	ChannelWorkers      []*ChannelWorkers   // Delivery workers of the matching channels, overriding DeliveryWorkers (the first match applies).
+	DeliveryInterceptor DeliveryInterceptor // Annotates the messages sent to each subscription (nil for none).
+	DeliveryRejection   string              // What to do with the messages the DeliveryInterceptor fails on: skip (default) or dead_letter.
+	Clock               util.Clock          // Clock used for timers and message timestamps (nil for the system clock).
+	ClientHBInterval    time.Duration       // Interval at which server sends heartbeats to a client (0 for default).
+	ClientHBTimeout     time.Duration       // How long server waits for a heartbeat response (0 for default).
+	ClientHBFailCount   int                 // Number of failed heartbeats before server closes the client connection (0 for default).
+	AdaptiveMaxInFlight bool                // Adjust the delivery window of subscriptions, up to their MaxInFlight, based on acks latency and redeliveries.
+	AdminUsers          []*AdminUser        // Users allowed to send admin requests. Admin requests are not accepted if empty.
+	Tags                []string            // Tags of this server, such as its region, used for channel placement.
+	ChannelPlacement    map[string][]string // Tags that a server must have to own channels matching the key (a subject, possibly with wildcards).
+	CanaryInterval      time.Duration       // Interval at which the canary publishes probes to check the delivery pipeline (0 to disable).
+	FTGroupName         string              // Name of the fault tolerance group, whose servers share the FILE store (empty to disable).
+	FTFailoverWindow    time.Duration       // Time without heartbeats from the active server before a standby server takes over.
+	MaxRedeliveries     int                 // Redeliveries of a message after which it is moved to the dead-letter channel, for subscriptions not requesting a limit (0 for no limit).
+	DeadLetterPrefix    string              // Prefix of the dead-letter channels, followed by the name of the message's channel.
+	Webhooks            []*Webhook          // Durable subscriptions delivering messages to HTTP endpoints.
+	Shovels             []*Shovel           // Bridges between channels and queues of other brokers, such as RabbitMQ.
+	DrainTimeout        time.Duration       // Time the server drains before shutting down on a signal (0 to shutdown immediately).
+	Handoff             bool                // Accept the NATS clients on a socket that Handoff can pass to a new process.
+	HandoffWindow       time.Duration       // Time over which the NATS clients are disconnected after the listening socket is handed off.
+	Sharding            []*ShardingPolicy   // Policies splitting channels into physical segments by time.
+	ChannelDefaults     []*ChannelDefaults  // Defaults of the subscriptions, and their redelivery policy, on the matching channels.
+	SubRate             float64             // Subscription requests accepted per second by the server (0 for no limit).
+	SubBurst            int                 // Subscription requests accepted in a burst by the server (0 to use the rate).
+	ClientSubRate       float64             // Subscription requests accepted per second from each client (0 for no limit).
+	ClientSubBurst      int                 // Subscription requests accepted in a burst from each client (0 to use the rate).
+	MaxPubAcksInFlight  int                 // Messages from each client being stored and not acknowledged yet (0 for no limit).
+	ClientPubRate       float64             // Messages accepted per second from each client (0 for no limit).
+	ClientPubBurst      int                 // Messages accepted in a burst from each client (0 to use the rate).
+	ClientPubBytesRate  float64             // Payload bytes accepted per second from each client (0 for no limit).
+	ClientPubBytesBurst int                 // Payload bytes accepted in a burst from each client (0 to use the rate).
+	MaxClientsPerConn   int                 // Clients registered through a same NATS connection, or user (0 for no limit).
+	MaxChannelsPerConn  int                 // Channels used by the clients of a same NATS connection, or user (0 for no limit).
+	MaxClients          int                 // Clients registered with the server (0 for no limit).
+	MaxSubsPerClient    int                 // Subscriptions of each client (0 for no limit).
+	BacklogHintInterval int                 // Append a hint about the backlog to every nth message sent to a subscription (0 to disable).
+	RecordPubLatency    bool                // Record the latency of the stages of publishes, returned by PubLatencyStats.
+	MaxOrderingGroups   int                 // Max number of ordering groups messages can be published in (0 to disable them).
+	InfoListen          string              // Host and port on which the bootstrap info is served over HTTP (empty to disable).
+	SlowRequestTime     time.Duration       // Processing time of protocol requests above which they are logged as slow (0 to disable).
+	SlowLogFile         string              // File the slow requests are logged to (empty to log them with the server's logger).
+	AckTimerSlack       time.Duration       // Messages expiring within this duration of an expired one are redelivered with it (0 for no coalescing).
+	FreezeOnTakeover    bool                // Halt the deliveries to the subscriptions of a client while checking if a connection with its ID replaces it.
+	DedupWindow         time.Duration       // Time during which a message published again with the same GUID is acknowledged without being stored (0 to disable).
+	MaxInflightPerSub   int                 // Max MaxInFlight of subscriptions, larger requested values are capped (0 for no limit).
+	SniffContentTypes   bool                // Detect the content type of the stored messages and count them per channel.
+	ContentPolicies     []*ContentPolicy    // Content types allowed on the matching channels, other messages are rejected.
+	QueuePolicy         string              // Delivery policy of queue groups not requesting one: least_pending (default), round_robin or random.
+	Tenants             []*Tenant           // Groups of channels whose limits override the global ones.
+	ChannelTemplates    []*LimitsOverride   // Limits overriding those of the tenant on the matching channels.
+	PerChannelLimits    []*LimitsOverride   // Limits of individual channels (no wildcards), overriding all others.
+	RecordAckLatency    bool                // Record the time between the first delivery of messages to durables and their ack.
+	ArchiveReader       bool                // Serve only replay subscriptions from a read-only store, under a cluster ID differing from the archived one.
+	ClientEvents        bool                // Publish the connections and disconnections of clients on _STAN.events.<cluster ID>.client.
+	ClientHBMaxInterval time.Duration       // Longest heartbeat interval a client can request in its connect request (0: clients can't change it).
+	ExclusiveChannels   []string            // Channels (subjects, possibly with wildcards) whose messages are sent to a single subscription at a time, the others standing by.
+	DeliveryWatchdog    time.Duration       // Time without deliveries to a subscription that can receive pending messages after which it is logged as stalled (0 to disable).
+	WatchdogHeal        bool                // Restart the deliveries the watchdog finds stalled.
+	StoreFullEvents     bool                // Publish on _STAN.events.<cluster ID>.channel.full the subscriptions that lost messages not acknowledged, discarded by the channel limits.
+	StoreFullInterval   time.Duration       // Minimum time between two checks of the subscriptions that lost messages of a same full channel (0 for the default).
+	ClampStartPosition  bool                // Start subscriptions asking for a sequence or time out of the range of the stored messages with the first or last one, instead of rejecting them.
+	SlowConsumerWait    time.Duration       // Time a subscription can stay at its MaxInFlight before being reported as a slow consumer (0 to disable).
+	SlowConsumerAction  string              // What to do with slow consumers: "notify" (default), "close_sub" or "close_client".
+
+	// Wraps the store created by the server, for instance to inject
+	// faults in tests (nil for none).
+	StoreWrapper func(stores.Store) stores.Store
 }
 
 // DefaultOptions are default options for the STAN server
 var defaultOptions = Options{
-	ID:             DefaultClusterID,
-	DiscoverPrefix: DefaultDiscoverPrefix,
-	StoreType:      DefaultStoreType,
-	FileStoreOpts:  stores.DefaultFileStoreOptions,
-	IOBatchSize:    DefaultIOBatchSize,
-	IOSleepTime:    DefaultIOSleepTime,
-	NATSServerURL:  "",
+	ID:                DefaultClusterID,
+	DiscoverPrefix:    DefaultDiscoverPrefix,
+	StoreType:         DefaultStoreType,
+	FileStoreOpts:     stores.DefaultFileStoreOptions,
+	IOBatchSize:       DefaultIOBatchSize,
+	IOSleepTime:       DefaultIOSleepTime,
+	NATSServerURL:     "",
+	DeliveryBurst:     DefaultDeliveryBurst,
+	ClientHBInterval:  DefaultHeartBeatInterval,
+	ClientHBTimeout:   DefaultClientHBTimeout,
+	ClientHBFailCount: DefaultMaxFailedHeartBeats,
+	DeadLetterPrefix:  DefaultDLQPrefix,
 }
 
 // GetDefaultOptions returns default options for the STAN server
@@ -417,22 +797,22 @@ var DefaultNatsServerOptions = server.Options{
 	NoSigs: true,
 }
 
-func stanDisconnectedHandler(nc *nats.Conn) {
+func (s *StanServer) stanDisconnectedHandler(nc *nats.Conn) {
 	if nc.LastError() != nil {
-		Errorf("STAN: connection has been disconnected: %v", nc.LastError())
+		s.log.Errorf("STAN: connection has been disconnected: %v", nc.LastError())
 	}
 }
 
-func stanReconnectedHandler(nc *nats.Conn) {
-	Noticef("STAN: reconnected to NATS Server at %q", nc.ConnectedUrl())
+func (s *StanServer) stanReconnectedHandler(nc *nats.Conn) {
+	s.log.Noticef("STAN: reconnected to NATS Server at %q", util.RedactURL(nc.ConnectedUrl()))
 }
 
-func stanClosedHandler(_ *nats.Conn) {
-	Debugf("STAN: connection has been closed")
+func (s *StanServer) stanClosedHandler(_ *nats.Conn) {
+	s.log.Debugf("STAN: connection has been closed")
 }
 
-func stanErrorHandler(_ *nats.Conn, sub *nats.Subscription, err error) {
-	Errorf("STAN: Asynchronous error on subject %s: %s", sub.Subject, err)
+func (s *StanServer) stanErrorHandler(_ *nats.Conn, sub *nats.Subscription, err error) {
+	s.log.Errorf("STAN: Asynchronous error on subject %s: %s", sub.Subject, err)
 }
 
 func (s *StanServer) buildServerURLs(sOpts *Options, opts *server.Options) ([]string, error) {
@@ -455,7 +835,7 @@ func (s *StanServer) buildServerURLs(sOpts *Options, opts *server.Options) ([]st
 		// First trim the protocol.
 		parts := strings.Split(natsURL, "://")
 		if len(parts) != 2 {
-			return nil, fmt.Errorf("malformed url: %v", natsURL)
+			return nil, fmt.Errorf("malformed url: %v", util.RedactURL(natsURL))
 		}
 		natsURL = parts[1]
 		host, port, err := net.SplitHostPort(natsURL)
@@ -469,6 +849,10 @@ func (s *StanServer) buildServerURLs(sOpts *Options, opts *server.Options) ([]st
 		// of Windows use of 0.0.0.0 or [::].
 		hostport = s.natsServer.GetListenEndpoint()
 	}
+	// The credentials of the streaming options are set on the connection.
+	if sOpts.Username != "" || (sOpts.Token != nil && sOpts.Token.IsSet()) {
+		return []string{fmt.Sprintf("nats://%s", hostport)}, nil
+	}
 	var userpart string
 	if opts.Authorization != "" {
 		userpart = opts.Authorization
@@ -481,6 +865,24 @@ func (s *StanServer) buildServerURLs(sOpts *Options, opts *server.Options) ([]st
 	return []string{fmt.Sprintf("nats://%s", hostport)}, nil
 }
 
+// redactNATSOptions returns a copy of the NATS connection options that
+// is safe to log.
+func redactNATSOptions(opts nats.Options) nats.Options {
+	opts.Url = util.RedactURL(opts.Url)
+	servers := make([]string, len(opts.Servers))
+	for i, u := range opts.Servers {
+		servers[i] = util.RedactURL(u)
+	}
+	opts.Servers = servers
+	if opts.Password != "" {
+		opts.Password = util.Redacted
+	}
+	if opts.Token != "" {
+		opts.Token = util.Redacted
+	}
+	return opts
+}
+
 // createNatsClientConn creates a connection to the NATS server, using
 // TLS if configured.  Pass in the NATS server options to derive a
 // connection url, and for other future items (e.g. auth)
@@ -494,16 +896,29 @@ func (s *StanServer) createNatsClientConn(sOpts *Options, nOpts *server.Options)
 	}
 	ncOpts.Name = fmt.Sprintf("NATS-Streaming-Server-%s", sOpts.ID)
 
-	if err = nats.ErrorHandler(stanErrorHandler)(&ncOpts); err != nil {
+	if sOpts.Username != "" {
+		var password string
+		if sOpts.Password != nil {
+			password = string(sOpts.Password.Reveal())
+		}
+		if err = nats.UserInfo(sOpts.Username, password)(&ncOpts); err != nil {
+			return nil, err
+		}
+	} else if sOpts.Token != nil && sOpts.Token.IsSet() {
+		if err = nats.Token(string(sOpts.Token.Reveal()))(&ncOpts); err != nil {
+			return nil, err
+		}
+	}
+	if err = nats.ErrorHandler(s.stanErrorHandler)(&ncOpts); err != nil {
 		return nil, err
 	}
-	if err = nats.ReconnectHandler(stanReconnectedHandler)(&ncOpts); err != nil {
+	if err = nats.ReconnectHandler(s.stanReconnectedHandler)(&ncOpts); err != nil {
 		return nil, err
 	}
-	if err = nats.ClosedHandler(stanClosedHandler)(&ncOpts); err != nil {
+	if err = nats.ClosedHandler(s.stanClosedHandler)(&ncOpts); err != nil {
 		return nil, err
 	}
-	if err = nats.DisconnectHandler(stanDisconnectedHandler)(&ncOpts); err != nil {
+	if err = nats.DisconnectHandler(s.stanDisconnectedHandler)(&ncOpts); err != nil {
 		return nil, err
 	}
 	if sOpts.Secure {
@@ -521,8 +936,21 @@ func (s *StanServer) createNatsClientConn(sOpts *Options, nOpts *server.Options)
 			return nil, err
 		}
 	}
+	// The embedded NATS Server requires TLS if its certificate is passed
+	// through these options. Without a CA to verify it, the connection to
+	// our own server is not verified.
+	if sOpts.NATSServerURL == "" && sOpts.TLSServerCert != "" && !sOpts.Secure && sOpts.ClientCA == "" {
+		if ncOpts.TLSConfig == nil {
+			ncOpts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		ncOpts.TLSConfig.InsecureSkipVerify = true
+		ncOpts.Secure = true
+	}
+	if ncOpts.TLSConfig != nil {
+		util.Crypto.ConfigureTLS(ncOpts.TLSConfig)
+	}
 
-	Tracef("STAN:  NATS conn opts: %v", ncOpts)
+	s.log.Tracef("STAN:  NATS conn opts: %v", redactNATSOptions(ncOpts))
 
 	var nc *nats.Conn
 	if nc, err = ncOpts.Connect(); err != nil {
@@ -540,6 +968,9 @@ func RunServer(ID string) *StanServer {
 }
 
 // RunServerWithOpts will startup an embedded STAN server and a nats-server to support it.
+// Without NATS options, the nats-server listens on a random port, so that
+// several servers can run in the same process: clients get the address
+// from ClientURL.
 func RunServerWithOpts(stanOpts *Options, natsOpts *server.Options) *StanServer {
 	// Run a nats server by default
 	sOpts := stanOpts
@@ -550,43 +981,121 @@ func RunServerWithOpts(stanOpts *Options, natsOpts *server.Options) *StanServer
 	}
 	if natsOpts == nil {
 		no := DefaultNatsServerOptions
+		no.Port = server.RANDOM_PORT
 		nOpts = &no
 	}
 
-	Noticef("Starting nats-streaming-server[%s] version %s", sOpts.ID, VERSION)
+	log := newServerLogger(sOpts)
+	log.Noticef("Starting nats-streaming-server[%s] version %s", sOpts.ID, VERSION)
+
+	if err := validateFT(sOpts); err != nil {
+		panic(fmt.Sprintf("%v", err))
+	}
+	if err := validateSharding(sOpts); err != nil {
+		panic(fmt.Sprintf("%v", err))
+	}
+	if err := validateConnLimits(sOpts, nOpts); err != nil {
+		panic(fmt.Sprintf("%v", err))
+	}
+	if err := validateEncryption(sOpts); err != nil {
+		panic(fmt.Sprintf("%v", err))
+	}
+	if err := validateArchiveReader(sOpts); err != nil {
+		panic(fmt.Sprintf("%v", err))
+	}
 
 	s := StanServer{
 		serverID:          nuid.Next(),
 		opts:              sOpts,
+		log:               log,
 		hbInterval:        DefaultHeartBeatInterval,
 		hbTimeout:         DefaultClientHBTimeout,
 		maxFailedHB:       DefaultMaxFailedHeartBeats,
 		dupCIDMap:         make(map[string]struct{}),
+		internalConnects:  make(map[string]struct{}),
 		dupMaxCIDRoutines: defaultMaxDupCIDRoutines,
 		dupCIDTimeout:     defaultCheckDupCIDTimeout,
 		ioChannelQuit:     make(chan bool, 1),
 		trace:             sOpts.Trace,
 		debug:             sOpts.Debug,
+		clock:             sOpts.Clock,
+		maxStalledRdlv:    defaultMaxStalledRedeliveries,
+		subRate:           newTokenBucket(sOpts.SubRate, sOpts.SubBurst),
+		connLimits:        newConnLimits(sOpts.MaxClientsPerConn, sOpts.MaxChannelsPerConn),
+		clientTags:        newClientTags(),
+		dedup:             newDedupWindow(sOpts.DedupWindow),
+		limits:            newLimitsResolver(sOpts),
+		ftDrill:           failoverDrill{demoted: make(chan struct{})},
+	}
+	if sOpts.RecordPubLatency {
+		s.pubLatency = newPubLatency()
+	}
+	if sOpts.SniffContentTypes {
+		s.contentTypes = &contentTypes{channels: make(map[string]*ContentTypeCounts)}
+	}
+	s.storeFull = &storeFull{channels: make(map[string]*channelFull)}
+	if sOpts.SlowRequestTime > 0 {
+		sl, err := newSlowLog(sOpts.SlowRequestTime, sOpts.SlowLogFile, log)
+		if err != nil {
+			panic(fmt.Sprintf("%v", err))
+		}
+		s.slowLog = sl
+	}
+	if s.clock == nil {
+		s.clock = util.RealClock
+	}
+	s.startTime = s.clock.Now()
+	if sOpts.ClientHBInterval > 0 {
+		s.hbInterval = sOpts.ClientHBInterval
+	}
+	if sOpts.ClientHBTimeout > 0 {
+		s.hbTimeout = sOpts.ClientHBTimeout
+	}
+	if sOpts.ClientHBFailCount > 0 {
+		s.maxFailedHB = sOpts.ClientHBFailCount
 	}
 
-	// Set limits
-	limits := &stores.ChannelLimits{
-		MaxChannels: DefaultChannelLimit,
-		MaxNumMsgs:  DefaultMsgStoreLimit,
-		MaxMsgBytes: DefaultMsgStoreLimit * 1024,
-		MaxSubs:     DefaultSubStoreLimit,
+	// Ensure store type option is in upper-case
+	sOpts.StoreType = strings.ToUpper(sOpts.StoreType)
+
+	// Ensure that we shutdown the server if there is a panic during startup.
+	// This will ensure that stores are closed (which otherwise would cause
+	// issues during testing) and that the NATS Server (if started) is also
+	// properly shutdown. Tod do so, we recover from the panic in order to
+	// call Shutdown, then issue the original panic.
+	defer func() {
+		if r := recover(); r != nil {
+			s.Shutdown()
+			// Issue the original panic now that the store is closed.
+			panic(r)
+		}
+	}()
+
+	// In fault tolerance mode, the store is shared with the other servers
+	// of the group, so it is recovered only when this server is activated.
+	if sOpts.FTGroupName != "" {
+		s.connectToNATS(nOpts)
+		s.ftStart(nOpts)
+		return &s
 	}
 
-	// Override with Options if needed
-	overrideLimits(limits, sOpts)
+	s.start(nOpts)
+
+	return &s
+}
+
+// start recovers or initializes the store and starts serving clients.
+// It panics on error.
+func (s *StanServer) start(nOpts *server.Options) {
+	sOpts := s.opts
+
+	// Set limits
+	limits := getChannelLimits(sOpts)
 
 	var err error
 	var recoveredState *stores.RecoveredState
 	var recoveredSubs []*subState
 
-	// Ensure store type option is in upper-case
-	sOpts.StoreType = strings.ToUpper(sOpts.StoreType)
-
 	// Create the store. So far either memory or file-based.
 	switch sOpts.StoreType {
 	case stores.TypeFile:
@@ -595,34 +1104,72 @@ func RunServerWithOpts(stanOpts *Options, natsOpts *server.Options) *StanServer
 			err = fmt.Errorf("for %v stores, root directory must be specified", stores.TypeFile)
 			break
 		}
+		var fsOpts *stores.FileStoreOptions
+		if fsOpts, err = getFileStoreOptions(sOpts); err != nil {
+			break
+		}
 		s.store, recoveredState, err = stores.NewFileStore(sOpts.FilestoreDir, limits,
-			stores.AllOptions(&sOpts.FileStoreOpts))
+			stores.AllOptions(fsOpts))
+	case stores.TypeSQL:
+		if sOpts.SQLDriver == "" || sOpts.SQLSource == "" {
+			err = fmt.Errorf("for %v stores, driver and data source must be specified", stores.TypeSQL)
+			break
+		}
+		s.store, recoveredState, err = stores.NewSQLStore(sOpts.SQLDriver, sOpts.SQLSource, limits)
+	case stores.TypeHybrid:
+		// The dir must be specified
+		if sOpts.FilestoreDir == "" {
+			err = fmt.Errorf("for %v stores, root directory must be specified", stores.TypeHybrid)
+			break
+		}
+		s.store, err = stores.NewHybridStore(sOpts.FilestoreDir, limits, stores.HybridStoreOptions{
+			MaxMemBytes:   sOpts.HybridMaxMemBytes,
+			CacheBytes:    sOpts.HybridCacheBytes,
+			ReadAheadMsgs: sOpts.HybridReadAhead,
+		})
+	case stores.TypeKV:
+		// The dir must be specified
+		if sOpts.FilestoreDir == "" {
+			err = fmt.Errorf("for %v stores, root directory must be specified", stores.TypeKV)
+			break
+		}
+		s.store, recoveredState, err = stores.NewKVStore(sOpts.FilestoreDir, limits)
 	case stores.TypeMemory:
-		s.store, err = stores.NewMemoryStore(limits)
+		s.store, err = stores.NewMemoryStore(limits, stores.MemoryBudget(sOpts.MemoryBudget, sOpts.MemoryEviction))
 	default:
-		err = fmt.Errorf("unsupported store type: %v", sOpts.StoreType)
+		factory := stores.LookupFactory(sOpts.StoreType)
+		if factory == nil {
+			err = fmt.Errorf("unsupported store type: %v", sOpts.StoreType)
+			break
+		}
+		s.store, recoveredState, err = factory(stores.StoreConfig{
+			Dir:    sOpts.FilestoreDir,
+			Limits: limits,
+			Params: sOpts.StoreParams,
+		})
 	}
 	if err != nil {
 		panic(fmt.Sprintf("%v", err))
 	}
+	if sOpts.ArchiveReader {
+		s.openArchive(limits, recoveredState)
+	}
+	if sOpts.StoreWrapper != nil {
+		s.store = sOpts.StoreWrapper(s.store)
+	}
+
+	// Messages need to be timestamped with the server's clock.
+	s.store.SetClock(s.clock)
+
+	// Channels may have their own limits.
+	if s.limits.hasOverrides() {
+		s.store.SetChannelLimitsFunc(s.limits.storeLimits)
+	}
 
 	// Create clientStore
 	s.clients = &clientStore{store: s.store}
 
-	// Ensure that we shutdown the server if there is a panic during startup.
-	// This will ensure that stores are closed (which otherwise would cause
-	// issues during testing) and that the NATS Server (if started) is also
-	// properly shutdown. Tod do so, we recover from the panic in order to
-	// call Shutdown, then issue the original panic.
-	defer func() {
-		if r := recover(); r != nil {
-			s.Shutdown()
-			// Issue the original panic now that the store is closed.
-			panic(r)
-		}
-	}()
-
-	if recoveredState != nil {
+	if recoveredState != nil && !sOpts.ArchiveReader {
 		// Copy content
 		s.info = *recoveredState.Info
 		// Check cluster IDs match
@@ -650,19 +1197,34 @@ func RunServerWithOpts(stanOpts *Options, natsOpts *server.Options) *StanServer
 		if err := s.store.Init(&s.info); err != nil {
 			panic(fmt.Errorf("Unable to initialize the store: %v", err))
 		}
+		// An archive reader serves the recovered channels under the
+		// subjects generated above.
+		if recoveredState != nil {
+			s.processRecoveredChannels(recoveredState.Subs)
+		}
 	}
 
-	// If no NATS server url is provided, it means that we embed the NATS Server
-	if sOpts.NATSServerURL == "" {
-		s.startNATSServer(nOpts)
+	if recoveredState != nil && !sOpts.ArchiveReader {
+		s.recoverOrderingGroups(recoveredState.OrderingGroups)
+	} else {
+		s.recoverOrderingGroups(nil)
 	}
 
-	if s.nc, err = s.createNatsClientConn(sOpts, nOpts); err != nil {
-		panic(fmt.Sprintf("Can't connect to NATS server: %v\n", err))
+	// In fault tolerance mode, the connection is created before the server
+	// is activated.
+	if s.nc == nil {
+		s.connectToNATS(nOpts)
 	}
+	s.monitoringURL = getMonitoringURL(s.natsServer, nOpts)
 
 	s.ensureRunningStandAlone()
 
+	// Reject connect and subscription requests until the recovered
+	// state has been fully processed.
+	if recoveredState != nil {
+		atomic.StoreInt32(&s.recovering, 1)
+	}
+
 	s.initSubscriptions()
 
 	if recoveredState != nil {
@@ -671,6 +1233,7 @@ func RunServerWithOpts(stanOpts *Options, natsOpts *server.Options) *StanServer
 		if err := s.postRecoveryProcessing(recoveredState.Clients, recoveredSubs); err != nil {
 			panic(fmt.Errorf("error during post recovery processing: %v\n", err))
 		}
+		atomic.StoreInt32(&s.recovering, 0)
 	}
 
 	// Flush to make sure all subscriptions are processed before
@@ -679,15 +1242,112 @@ func RunServerWithOpts(stanOpts *Options, natsOpts *server.Options) *StanServer
 		panic(fmt.Sprintf("Could not flush the subscriptions, %v\n", err))
 	}
 
-	Noticef("STAN: Message store is %s", s.store.Name())
-	Noticef("STAN: Maximum of %d will be stored", limits.MaxNumMsgs)
+	s.log.Noticef("STAN: Message store is %s", s.store.Name())
+	s.log.Noticef("STAN: Crypto provider is %s", util.Crypto.Name())
+	s.log.Noticef("STAN: Maximum of %d will be stored", limits.MaxNumMsgs)
+	s.logBanner()
 
 	// Execute (in a go routine) redelivery of unacknowledged messages,
 	// and release newOnHold
 	s.wg.Add(1)
 	go s.performRedeliveryOnStartup(recoveredSubs)
 
-	return &s
+	if sOpts.CanaryInterval > 0 {
+		if err := s.startCanary(); err != nil {
+			s.log.Errorf("STAN: %v", err)
+		}
+	}
+
+	if len(sOpts.Webhooks) > 0 {
+		if err := s.startWebhooks(); err != nil {
+			s.log.Errorf("STAN: %v", err)
+		}
+	}
+
+	if len(sOpts.Shovels) > 0 {
+		if err := s.startShovels(); err != nil {
+			s.log.Errorf("STAN: %v", err)
+		}
+	}
+
+	if err := s.startInfoListener(); err != nil {
+		s.log.Errorf("STAN: Unable to serve the bootstrap info: %v", err)
+	}
+
+	if maxInactivity := s.limits.minInactivity(); maxInactivity > 0 {
+		s.startInactivityCheck(maxInactivity)
+	}
+
+	if sOpts.DeliveryWatchdog > 0 {
+		s.startDeliveryWatchdog(sOpts.DeliveryWatchdog)
+	}
+
+	if sOpts.SlowConsumerWait > 0 {
+		s.startSlowConsumersCheck(sOpts.SlowConsumerWait)
+	}
+}
+
+// connectToNATS starts the embedded NATS Server, unless an external one
+// is used, and creates the server's NATS connection. It panics on error.
+func (s *StanServer) connectToNATS(nOpts *server.Options) {
+	// If no NATS server url is provided, it means that we embed the NATS Server
+	if s.opts.NATSServerURL == "" {
+		s.startNATSServer(nOpts)
+	}
+	var err error
+	if s.nc, err = s.createNatsClientConn(s.opts, nOpts); err != nil {
+		panic(fmt.Sprintf("Can't connect to NATS server: %v\n", err))
+	}
+}
+
+// validateEncryption checks that encryption is only enabled for FILE
+// stores, and that a key is provided.
+func validateEncryption(opts *Options) error {
+	if !opts.Encrypt {
+		return nil
+	}
+	if strings.ToUpper(opts.StoreType) != stores.TypeFile {
+		return fmt.Errorf("encryption is only supported by %v stores", stores.TypeFile)
+	}
+	_, err := getFileStoreOptions(opts)
+	return err
+}
+
+// getFileStoreOptions returns the FILE store options, with the encryption
+// key if encryption is enabled.
+func getFileStoreOptions(opts *Options) (*stores.FileStoreOptions, error) {
+	fsOpts := opts.FileStoreOpts
+	if len(opts.Sharding) > 0 {
+		fsOpts.SlicePeriods = append(shardingSlicePeriods(opts.Sharding), fsOpts.SlicePeriods...)
+	}
+	if !opts.Encrypt {
+		return &fsOpts, nil
+	}
+	var key []byte
+	if opts.EncryptionKey != nil {
+		key = opts.EncryptionKey.Reveal()
+	}
+	if len(key) == 0 {
+		key = []byte(os.Getenv(EncryptionKeyEnv))
+	}
+	if len(key) == 0 {
+		return nil, ErrNoEncryptionKey
+	}
+	fsOpts.EncryptionKey = key
+	return &fsOpts, nil
+}
+
+// getChannelLimits returns the store limits, based on defaults that are
+// overridden with Options if needed.
+func getChannelLimits(opts *Options) *stores.ChannelLimits {
+	limits := &stores.ChannelLimits{
+		MaxChannels: DefaultChannelLimit,
+		MaxNumMsgs:  DefaultMsgStoreLimit,
+		MaxMsgBytes: DefaultMsgStoreLimit * 1024,
+		MaxSubs:     DefaultSubStoreLimit,
+	}
+	overrideLimits(limits, opts)
+	return limits
 }
 
 func overrideLimits(limits *stores.ChannelLimits, opts *Options) {
@@ -703,13 +1363,16 @@ func overrideLimits(limits *stores.ChannelLimits, opts *Options) {
 	if opts.MaxSubscriptions != 0 {
 		limits.MaxSubs = opts.MaxSubscriptions
 	}
+	if opts.MaxInactivity != 0 {
+		limits.MaxInactivity = opts.MaxInactivity
+	}
 }
 
 // TODO:  Explore parameter passing in gnatsd.  Keep seperate for now.
 func (s *StanServer) configureClusterOpts(opts *server.Options) error {
 	if opts.ClusterListenStr == "" {
 		if opts.RoutesStr != "" {
-			Fatalf("Solicited routes require cluster capabilities, e.g. --cluster.")
+			s.log.Fatalf("Solicited routes require cluster capabilities, e.g. --cluster.")
 		}
 		return nil
 	}
@@ -744,6 +1407,20 @@ func (s *StanServer) configureClusterOpts(opts *server.Options) error {
 	return nil
 }
 
+// passServerTLSOptions sets the certificate of the embedded NATS Server
+// from the streaming server options, unless set in the NATS options.
+func passServerTLSOptions(sOpts *Options, nOpts *server.Options) {
+	if sOpts.NATSServerURL != "" {
+		return
+	}
+	if nOpts.TLSCert == "" {
+		nOpts.TLSCert = sOpts.TLSServerCert
+	}
+	if nOpts.TLSKey == "" {
+		nOpts.TLSKey = sOpts.TLSServerKey
+	}
+}
+
 // configureNATSServerTLS sets up TLS for the NATS Server.
 // Additional TLS parameters (e.g. cipher suites) will need to be placed
 // in a configuration file specified through the -config parameter.
@@ -772,7 +1449,9 @@ func (s *StanServer) configureNATSServerTLS(opts *server.Options) {
 	if tlsSet {
 		if opts.TLSConfig, err = server.GenTLSConfig(&tc); err != nil {
 			// The connection will fail later if the problem is severe enough.
-			Errorf("STAN:  Unable to setup NATS Server TLS:  %v", err)
+			s.log.Errorf("STAN:  Unable to setup NATS Server TLS:  %v", err)
+		} else {
+			util.Crypto.ConfigureTLS(opts.TLSConfig)
 		}
 	}
 }
@@ -797,47 +1476,67 @@ func (s *StanServer) configureNATSServerAuth(opts *server.Options) server.Auth {
 // NATS server.  No errors, only panics upon error conditions.
 func (s *StanServer) startNATSServer(opts *server.Options) {
 	s.configureClusterOpts(opts)
+	passServerTLSOptions(s.opts, opts)
 	s.configureNATSServerTLS(opts)
 	a := s.configureNATSServerAuth(opts)
-	s.natsServer = natsd.RunServerWithAuth(opts, a)
+	l, err := createHandoffListener(s.opts, opts)
+	if err != nil {
+		panic(fmt.Sprintf("Can't listen for NATS clients: %v\n", err))
+	}
+	if l == nil {
+		s.natsServer = natsd.RunServerWithAuth(opts, a)
+		return
+	}
+	// The NATS clients connect through the proxy, which owns the socket.
+	lOpts := *opts
+	lOpts.Host, lOpts.Port = "127.0.0.1", server.RANDOM_PORT
+	s.natsServer = natsd.RunServerWithAuth(&lOpts, a)
+	s.natsProxy = newNATSProxy(l, s.natsServer.GetListenEndpoint(), s.log)
 }
 
 // ensureRunningStandAlone prevents this streaming server from starting
 // if another is found using the same cluster ID - a possibility when
 // routing is enabled.
 func (s *StanServer) ensureRunningStandAlone() {
-	clusterID := s.ClusterID()
+	if err := checkStandAlone(s.nc, s.ClusterID(), s.info.Discovery, s.log); err != nil {
+		panic(err)
+	}
+}
+
+// checkStandAlone returns an error if another streaming server using
+// the given cluster ID responds on the discovery subject.
+func checkStandAlone(nc *nats.Conn, clusterID, discovery string, log *serverLogger) error {
 	hbInbox := nats.NewInbox()
 	timeout := time.Millisecond * 250
 
 	// We cannot use the client's API here as it will create a dependency
 	// cycle in the streaming client, so build our request and see if we
 	// get a response.
-	req := &pb.ConnectRequest{ClientID: clusterID, HeartbeatInbox: hbInbox}
+	req := &spb.ConnectRequest{ClientID: clusterID, HeartbeatInbox: hbInbox}
 	b, _ := req.Marshal()
-	reply, err := s.nc.Request(s.info.Discovery, b, timeout)
+	reply, err := nc.Request(discovery, b, timeout)
 	if err == nats.ErrTimeout {
-		Debugf("Did not detect another server instance.")
-		return
+		log.Debugf("Did not detect another server instance.")
+		return nil
 	}
 	if err != nil {
-		Errorf("Request error detecting another server instance: %v", err)
-		return
+		log.Errorf("Request error detecting another server instance: %v", err)
+		return nil
 	}
 	// See if the response is valid and can be unmarshalled.
-	cr := &pb.ConnectResponse{}
+	cr := &spb.ConnectResponse{}
 	err = cr.Unmarshal(reply.Data)
 	if err != nil {
 		// something other than a compatible streaming server responded
 		// so continue.
-		Errorf("Unmarshall error while detecting another server instance: %v", err)
-		return
+		log.Errorf("Unmarshall error while detecting another server instance: %v", err)
+		return nil
 	}
-	// Another streaming server was found, cleanup then panic.
+	// Another streaming server was found, cleanup then report.
 	clreq := &pb.CloseRequest{ClientID: clusterID}
 	b, _ = clreq.Marshal()
-	s.nc.Request(cr.CloseRequests, b, timeout)
-	panic(fmt.Errorf("discovered another streaming server with cluster ID %q", clusterID))
+	nc.Request(cr.CloseRequests, b, timeout)
+	return fmt.Errorf("discovered another streaming server with cluster ID %q", clusterID)
 }
 
 // Binds server's view of a client with stored Client objects.
@@ -862,7 +1561,11 @@ func (s *StanServer) processRecoveredChannels(subscriptions stores.RecoveredSubs
 		// Lookup the ChannelStore from the store
 		channel := s.store.LookupChannel(channelName)
 		// Create the subStore for this channel
-		ss := createSubStore()
+		ss := s.createSubStore()
+		ss.exclusive = isExclusiveChannel(s.opts.ExclusiveChannels, channelName)
+		ss.deliveryPool = newDeliveryPool(s.deliveryWorkersFor(channelName))
+		// Inactivity is counted from the restart.
+		ss.touch(s.clock.Now().UnixNano())
 		// Set it into the channel store
 		channel.UserData = ss
 		// Get the recovered subscriptions for this channel.
@@ -877,7 +1580,7 @@ func (s *StanServer) processRecoveredChannels(subscriptions stores.RecoveredSubs
 			// Ensure acksPending is not nil
 			if sub.acksPending == nil {
 				// Create an empty map
-				sub.acksPending = make(map[uint64]*pb.MsgProto)
+				sub.acksPending = make(map[uint64]*spb.MsgProto)
 			} else if len(sub.acksPending) > 0 {
 				// Prevent delivery of new messages until resent of old ones
 				sub.newOnHold = true
@@ -889,9 +1592,17 @@ func (s *StanServer) processRecoveredChannels(subscriptions stores.RecoveredSubs
 			}
 			// Copy over fields from SubState protobuf
 			sub.SubState = *recSub.Sub
+			// The server's cap may have been lowered since it was stored.
+			sub.MaxInFlight = s.capMaxInFlight(sub.MaxInFlight)
+			sub.window = s.newDeliveryWindow(sub.MaxInFlight)
 			// Add the subscription to the corresponding client
 			added := s.clients.AddSub(sub.ClientID, sub)
 			if added || sub.DurableName != "" {
+				// A member of a durable queue group whose client was not
+				// recovered is merged into the shadow of the group.
+				if !added && sub.QGroup != "" {
+					sub.ClientID = ""
+				}
 				// Add this subscription to subStore.
 				ss.updateState(sub)
 				// If this is a durable and the client was not recovered
@@ -904,6 +1615,9 @@ func (s *StanServer) processRecoveredChannels(subscriptions stores.RecoveredSubs
 				allSubs = append(allSubs, sub)
 			}
 		}
+		// The consumer may have been elected before the clients of the
+		// offline durables were cleared.
+		ss.electExclusiveConsumer(false, 0)
 	}
 	return allSubs
 }
@@ -911,12 +1625,16 @@ func (s *StanServer) processRecoveredChannels(subscriptions stores.RecoveredSubs
 // Do some final setup. Be minded of locking here since the server
 // has started communication with NATS server/clients.
 func (s *StanServer) postRecoveryProcessing(recoveredClients []*stores.Client, recoveredSubs []*subState) error {
-	var err error
+	// The subscriptions of a wildcard subscription share its ack subscription.
+	err := s.recoverWildcardSubs(recoveredSubs)
+	if err != nil {
+		return err
+	}
 	for _, sub := range recoveredSubs {
 		sub.Lock()
 		// To be on the safe side, just check that the ackSub has not
 		// been created (may happen with durables that may reconnect maybe?)
-		if sub.ackSub == nil {
+		if sub.ackSub == nil && wildcardSubject(sub.AckInbox) == "" {
 			// Subscribe to acks
 			sub.ackSub, err = s.nc.Subscribe(sub.AckInbox, s.processAckMsg)
 			if err != nil {
@@ -934,9 +1652,9 @@ func (s *StanServer) postRecoveryProcessing(recoveredClients []*stores.Client, r
 		// internal subscriptions started (and may receive client requests).
 		if !c.unregistered && c.hbt == nil {
 			// Because of the loop, we need to make copy for the closure
-			// to time.AfterFunc
+			// to AfterFunc
 			cID := sc.ID
-			c.hbt = time.AfterFunc(s.hbInterval, func() {
+			c.hbt = s.clock.AfterFunc(s.hbInterval, func() {
 				s.checkClientHealth(cID)
 			})
 		}
@@ -1001,6 +1719,7 @@ func (s *StanServer) initSubscriptions() {
 		panic(fmt.Sprintf("Could not subscribe to discover subject, %v\n", err))
 	}
 	// Receive published messages from clients.
+	s.flushMarker = fmt.Sprintf("%s.%s", s.info.Publish, nuid.Next())
 	pubSubject := fmt.Sprintf("%s.>", s.info.Publish)
 	_, err = s.nc.Subscribe(pubSubject, s.processClientPublish)
 	if err != nil {
@@ -1016,38 +1735,148 @@ func (s *StanServer) initSubscriptions() {
 	if err != nil {
 		panic(fmt.Sprintf("Could not subscribe to unsubscribe request subject, %v\n", err))
 	}
+	// Receive subscription close requests from clients.
+	_, err = s.nc.Subscribe(s.subCloseSubject(), s.processSubCloseRequest)
+	if err != nil {
+		panic(fmt.Sprintf("Could not subscribe to subscription close request subject, %v\n", err))
+	}
 	// Receive close requests from clients.
 	_, err = s.nc.Subscribe(s.info.Close, s.processCloseRequest)
 	if err != nil {
 		panic(fmt.Sprintf("Could not subscribe to close request subject, %v\n", err))
 	}
-
-	Debugf("STAN: Discover subject:    %s", s.info.Discovery)
-	Debugf("STAN: Publish subject:     %s", pubSubject)
-	Debugf("STAN: Subscribe subject:   %s", s.info.Subscribe)
-	Debugf("STAN: Unsubscribe subject: %s", s.info.Unsubscribe)
-	Debugf("STAN: Close subject:       %s", s.info.Close)
-
-}
-
-// Process a client connect request
-func (s *StanServer) connectCB(m *nats.Msg) {
-	req := &pb.ConnectRequest{}
+	// Receive flush requests from clients.
+	flushSubject := s.flushSubject()
+	_, err = s.nc.Subscribe(flushSubject, s.processFlushRequest)
+	if err != nil {
+		panic(fmt.Sprintf("Could not subscribe to flush request subject, %v\n", err))
+	}
+	// Receive requests creating several subscriptions at once.
+	_, err = s.nc.Subscribe(s.subBatchSubject(), s.processSubBatchRequest)
+	if err != nil {
+		panic(fmt.Sprintf("Could not subscribe to subscription batch request subject, %v\n", err))
+	}
+	// Receive claims on pending messages from subscribers.
+	_, err = s.nc.Subscribe(s.claimSubject(), s.processClaimRequest)
+	if err != nil {
+		panic(fmt.Sprintf("Could not subscribe to claim request subject, %v\n", err))
+	}
+	// Receive pings from clients.
+	_, err = s.nc.Subscribe(s.pingSubject(), s.processPingRequest)
+	if err != nil {
+		panic(fmt.Sprintf("Could not subscribe to ping request subject, %v\n", err))
+	}
+	// Receive requests pausing or resuming subscriptions.
+	_, err = s.nc.Subscribe(s.pauseSubject(), s.processPauseRequest)
+	if err != nil {
+		panic(fmt.Sprintf("Could not subscribe to pause request subject, %v\n", err))
+	}
+	// Answer requests for the bootstrap info.
+	_, err = s.nc.Subscribe(s.infoSubject(), s.processInfoRequest)
+	if err != nil {
+		panic(fmt.Sprintf("Could not subscribe to info request subject, %v\n", err))
+	}
+	// Receive admin requests, if admin users are configured.
+	if len(s.opts.AdminUsers) > 0 {
+		_, err = s.nc.Subscribe(s.adminSubject(), s.processAdminRequest)
+		if err != nil {
+			panic(fmt.Sprintf("Could not subscribe to admin request subject, %v\n", err))
+		}
+		s.log.Debugf("STAN: Admin subject:       %s", s.adminSubject())
+	}
+
+	s.log.Debugf("STAN: Discover subject:    %s", s.info.Discovery)
+	s.log.Debugf("STAN: Publish subject:     %s", pubSubject)
+	s.log.Debugf("STAN: Subscribe subject:   %s", s.info.Subscribe)
+	s.log.Debugf("STAN: Unsubscribe subject: %s", s.info.Unsubscribe)
+	s.log.Debugf("STAN: Sub close subject:   %s", s.subCloseSubject())
+	s.log.Debugf("STAN: Sub batch subject:   %s", s.subBatchSubject())
+	s.log.Debugf("STAN: Close subject:       %s", s.info.Close)
+	s.log.Debugf("STAN: Flush subject:       %s", flushSubject)
+	s.log.Debugf("STAN: Pause subject:       %s", s.pauseSubject())
+	s.log.Debugf("STAN: Ping subject:        %s", s.pingSubject())
+	s.log.Debugf("STAN: Info subject:        %s", s.infoSubject())
+
+}
+
+// checkAdmission returns an error, suggesting a delay after which the
+// client should retry, if the server is recovering or overloaded.
+func (s *StanServer) checkAdmission() error {
+	var err error
+	if atomic.LoadInt32(&s.recovering) == 1 {
+		err = ErrRecovering
+	} else if len(s.ioChannel) >= ioChannelHighWatermark {
+		err = ErrOverloaded
+	} else {
+		return nil
+	}
+	return fmt.Errorf("%v%s%v", err, retryAfterSep, DefaultRetryAfter)
+}
+
+// RetryAfter returns the delay suggested by the server in the error
+// returned for a rejected connect or subscription request. The boolean
+// is false if the error does not contain such delay.
+func RetryAfter(err string) (time.Duration, bool) {
+	idx := strings.LastIndex(err, retryAfterSep)
+	if idx == -1 {
+		return 0, false
+	}
+	d, perr := time.ParseDuration(err[idx+len(retryAfterSep):])
+	if perr != nil {
+		return 0, false
+	}
+	return d, true
+}
+
+// Process a client connect request
+func (s *StanServer) connectCB(m *nats.Msg) {
+	t := s.startRequest()
+	req := &spb.ConnectRequest{}
 	err := req.Unmarshal(m.Data)
-	if err != nil || !clientIDRegEx.MatchString(req.ClientID) || req.HeartbeatInbox == "" {
-		Debugf("STAN: [Client:?] Invalid conn request: ClientID=%s, Inbox=%s, err=%v",
+	if err != nil || !clientIDRegEx.MatchString(req.ClientID) || !isValidInbox(req.HeartbeatInbox) || req.HeartbeatInterval < 0 {
+		s.log.Debugf("STAN: [Client:?] Invalid conn request: ClientID=%s, Inbox=%s, err=%v",
 			req.ClientID, req.HeartbeatInbox, err)
-		s.sendConnectErr(m.Reply, ErrInvalidConnReq.Error())
+		s.sendConnectErr(m.Reply, ErrInvalidConnReq)
+		return
+	}
+	if err := s.checkAdmission(); err != nil {
+		s.log.Debugf("STAN: [Client:%s] Connect request rejected: %v", req.ClientID, err)
+		s.sendConnectErr(m.Reply, err)
 		return
 	}
+	if err := s.authorize(req.ClientID, "", OpConnect); err != nil {
+		s.sendConnectErr(m.Reply, err)
+		return
+	}
+	req.Tags, err = s.resolveClientTags(req.ClientID, req.Tags)
+	if err != nil {
+		s.log.Debugf("STAN: [Client:%s] Connect request rejected: %v", req.ClientID, err)
+		s.sendConnectErr(m.Reply, err)
+		return
+	}
+	connKey, err := s.connKey(req.ClientID, req.HeartbeatInbox)
+	if err == nil {
+		err = s.connLimits.checkConnect(connKey)
+	}
+	if err == nil {
+		err = s.checkMaxClients(req.ClientID)
+	}
+	if err != nil {
+		s.log.Debugf("STAN: [Client:%s] Connect request rejected: %v", req.ClientID, err)
+		s.sendConnectErr(m.Reply, err)
+		return
+	}
+
+	t.stage("validate")
 
 	// Try to register
 	client, isNew, err := s.clients.Register(req.ClientID, req.HeartbeatInbox)
 	if err != nil {
-		Debugf("STAN: [Client:%s] Error registering client: %v", req.ClientID, err)
-		s.sendConnectErr(m.Reply, err.Error())
+		s.log.Debugf("STAN: [Client:%s] Error registering client: %v", req.ClientID, err)
+		s.sendConnectErr(m.Reply, err)
 		return
 	}
+	t.stage("register")
 	// Handle duplicate IDs in a dedicated go-routine
 	if !isNew {
 		// Do we have a routine in progress for this client ID?
@@ -1057,8 +1886,8 @@ func (s *StanServer) connectCB(m *nats.Msg) {
 
 		// Yes, fail this request here.
 		if inProgress {
-			Debugf("STAN: [Client:%s] Connect failed; already connected", req.ClientID)
-			s.sendConnectErr(m.Reply, ErrInvalidClient.Error())
+			s.log.Debugf("STAN: [Client:%s] Connect failed; already connected", req.ClientID)
+			s.sendConnectErr(m.Reply, ErrInvalidClient)
 			return
 		}
 
@@ -1098,42 +1927,53 @@ func (s *StanServer) connectCB(m *nats.Msg) {
 		}
 		// Start a go-routine to handle this connect request
 		go func() {
-			s.processConnectRequestWithDupID(client, req, m.Reply)
+			s.processConnectRequestWithDupID(client, req, m.Reply, connKey, t)
 		}()
 		return
 	}
 
 	// Here, we accept this client's incoming connect request.
-	s.finishConnectRequest(client, req, m.Reply)
+	s.finishConnectRequest(client, req, m.Reply, connKey, t)
 }
 
-func (s *StanServer) finishConnectRequest(sc *stores.Client, req *pb.ConnectRequest, replyInbox string) {
-	cr := &pb.ConnectResponse{
-		PubPrefix:     s.info.Publish,
-		SubRequests:   s.info.Subscribe,
-		UnsubRequests: s.info.Unsubscribe,
-		CloseRequests: s.info.Close,
+func (s *StanServer) finishConnectRequest(sc *stores.Client, req *spb.ConnectRequest, replyInbox, connKey string, t *reqTimer) {
+	cr := &spb.ConnectResponse{
+		PubPrefix:        s.info.Publish,
+		SubRequests:      s.info.Subscribe,
+		UnsubRequests:    s.info.Unsubscribe,
+		CloseRequests:    s.info.Close,
+		SubCloseRequests: s.subCloseSubject(),
 	}
 	b, _ := cr.Marshal()
 	s.nc.Publish(replyInbox, b)
 
-	s.RLock()
-	hbInterval := s.hbInterval
-	s.RUnlock()
-
 	clientID := req.ClientID
 	hbInbox := req.HeartbeatInbox
 	client := sc.UserData.(*client)
 
+	hbInterval := s.clientHBInterval(time.Duration(req.HeartbeatInterval))
+	if req.HeartbeatInterval != 0 && hbInterval != time.Duration(req.HeartbeatInterval) {
+		s.log.Debugf("STAN: [Client:%s] Heartbeat interval %v in connect request changed to %v.",
+			clientID, time.Duration(req.HeartbeatInterval), hbInterval)
+	}
+
 	// Heartbeat timer.
 	client.Lock()
-	client.hbt = time.AfterFunc(hbInterval, func() { s.checkClientHealth(clientID) })
+	client.hbInterval = hbInterval
+	client.hbt = s.clock.AfterFunc(hbInterval, func() { s.checkClientHealth(clientID) })
+	client.connKey = connKey
 	client.Unlock()
-
-	Debugf("STAN: [Client:%s] Connected (Inbox=%v)", clientID, hbInbox)
+	s.recordActivity(client)
+	s.connLimits.addClient(connKey)
+	s.clientTags.addClient(clientID, req.Tags)
+
+	s.log.Debugf("STAN: [Client:%s] Connected (Inbox=%v)", clientID, hbInbox)
+	s.publishClientEvent(clientID, hbInbox, "", "")
+	t.stage("reply")
+	s.endRequest(t, slowConnect, clientID, "")
 }
 
-func (s *StanServer) processConnectRequestWithDupID(sc *stores.Client, req *pb.ConnectRequest, replyInbox string) {
+func (s *StanServer) processConnectRequestWithDupID(sc *stores.Client, req *spb.ConnectRequest, replyInbox, connKey string, t *reqTimer) {
 	sendErr := true
 
 	hbInbox := sc.HbInbox
@@ -1150,11 +1990,18 @@ func (s *StanServer) processConnectRequestWithDupID(sc *stores.Client, req *pb.C
 		s.wg.Done()
 	}()
 
+	// Stop sending to the inboxes of the old client, which may be dead,
+	// until we know if it is replaced.
+	var frozen []*subState
+	if s.opts.FreezeOnTakeover {
+		frozen = s.freezeClientSubs(sc.UserData.(*client))
+	}
+
 	// This is the HbInbox from the "old" client. See if it is up and
 	// running by sending a ping to that inbox.
 	if _, err := s.nc.Request(hbInbox, nil, s.dupCIDTimeout); err != nil {
 		// The old client didn't reply, assume it is dead, close it and continue.
-		s.closeClient(clientID)
+		s.closeClient(clientID, ClientCloseReplaced, "")
 
 		// Between the close and the new registration below, it is possible
 		// that a connection request came in (in connectCB) and since the
@@ -1167,23 +2014,25 @@ func (s *StanServer) processConnectRequestWithDupID(sc *stores.Client, req *pb.C
 		sc, isNew, err = s.clients.Register(req.ClientID, req.HeartbeatInbox)
 		if err == nil && isNew {
 			// We could register the new client.
-			Debugf("STAN: [Client:%s] Replaced old client (Inbox=%v)", req.ClientID, hbInbox)
+			s.log.Debugf("STAN: [Client:%s] Replaced old client (Inbox=%v)", req.ClientID, hbInbox)
 			sendErr = false
 		}
 	}
+	s.unfreezeSubs(frozen)
 	// The currently registered client is responding, or we failed to register,
 	// so fail the request of the incoming client connect request.
 	if sendErr {
-		Debugf("STAN: [Client:%s] Connect failed; already connected", clientID)
-		s.sendConnectErr(replyInbox, ErrInvalidClient.Error())
+		s.log.Debugf("STAN: [Client:%s] Connect failed; already connected", clientID)
+		s.sendConnectErr(replyInbox, ErrInvalidClient)
 		return
 	}
 	// We have replaced the old with the new.
-	s.finishConnectRequest(sc, req, replyInbox)
+	t.stage("replace")
+	s.finishConnectRequest(sc, req, replyInbox, connKey, t)
 }
 
-func (s *StanServer) sendConnectErr(replyInbox, err string) {
-	cr := &pb.ConnectResponse{Error: err}
+func (s *StanServer) sendConnectErr(replyInbox string, err error) {
+	cr := &spb.ConnectResponse{Error: err.Error(), ErrorCode: int32(errorCode(err))}
 	b, _ := cr.Marshal()
 	s.nc.Publish(replyInbox, b)
 }
@@ -1196,9 +2045,8 @@ func (s *StanServer) checkClientHealth(clientID string) {
 	}
 	client := sc.UserData.(*client)
 	hbInbox := sc.HbInbox
-	// Capture these under lock (as of now, there are not configurable,
-	// but we tweak them in tests and maybe they will be settable in
-	// the future)
+	// Capture these under lock (they are set from the options, but we
+	// tweak them in tests)
 	s.RLock()
 	hbInterval := s.hbInterval
 	hbTimeout := s.hbTimeout
@@ -1213,20 +2061,27 @@ func (s *StanServer) checkClientHealth(clientID string) {
 	if _, err := s.nc.Request(hbInbox, nil, hbTimeout); err != nil {
 		client.fhb++
 		if client.fhb > maxFailedHB {
-			Debugf("STAN: [Client:%s]  Timed out on hearbeats.", clientID)
+			s.log.Debugf("STAN: [Client:%s]  Timed out on hearbeats.", clientID)
 			client.Unlock()
-			s.closeClient(clientID)
+			s.closeClient(clientID, ClientCloseHBTimeout, "")
 			return
 		}
 	} else {
 		client.fhb = 0
+		s.recordActivity(client)
+	}
+	// Clients recovered from the store use the server's interval.
+	if client.hbInterval > 0 {
+		hbInterval = client.hbInterval
 	}
 	client.hbt.Reset(hbInterval)
 	client.Unlock()
 }
 
-// Close a client
-func (s *StanServer) closeClient(clientID string) bool {
+// Close a client. The reason, and the detail given by an administrator,
+// are published in the client event. Unless the client asked for the close,
+// it is also notified on its heartbeat inbox.
+func (s *StanServer) closeClient(clientID, reason, detail string) bool {
 	// Remove from our clientStore.
 	sc := s.clients.Unregister(clientID)
 	if sc == nil {
@@ -1241,63 +2096,219 @@ func (s *StanServer) closeClient(clientID string) bool {
 	if client.hbt != nil {
 		client.hbt.Stop()
 	}
+	connKey := client.connKey
 	client.Unlock()
+	s.connLimits.removeClient(connKey)
+	s.clientTags.removeClient(clientID)
 
 	// Remove all non-durable subscribers.
+	s.removeClientWildcardSubs(clientID)
 	s.removeAllNonDurableSubscribers(client)
 
-	Debugf("STAN: [Client:%s] Closed (Inbox=%v)", clientID, hbInbox)
+	s.log.Debugf("STAN: [Client:%s] Closed (Inbox=%v)", clientID, hbInbox)
+	s.publishClientEvent(clientID, hbInbox, reason, detail)
+	if reason != ClientCloseRequested {
+		s.notifyClientClosed(clientID, hbInbox, reason, detail)
+	}
 	return true
 }
 
 // processCloseRequest process inbound messages from clients.
 func (s *StanServer) processCloseRequest(m *nats.Msg) {
+	t := s.startRequest()
 	req := &pb.CloseRequest{}
 	err := req.Unmarshal(m.Data)
 	if err != nil {
-		Errorf("STAN: Received invalid close request, subject=%s.", m.Subject)
-		s.sendCloseErr(m.Reply, ErrInvalidCloseReq.Error())
+		s.log.Errorf("STAN: Received invalid close request, subject=%s.", m.Subject)
+		s.sendCloseErr(m.Reply, ErrInvalidCloseReq)
 		return
 	}
 
-	if !s.closeClient(req.ClientID) {
-		Errorf("STAN: Unknown client %q in close request", req.ClientID)
-		s.sendCloseErr(m.Reply, ErrUnknownClient.Error())
+	if !s.closeClient(req.ClientID, ClientCloseRequested, "") {
+		s.log.Errorf("STAN: Unknown client %q in close request", req.ClientID)
+		s.sendCloseErr(m.Reply, ErrUnknownClient)
 		return
 	}
+	t.stage("close")
 
-	resp := &pb.CloseResponse{}
+	resp := &spb.CloseResponse{}
 	b, _ := resp.Marshal()
 	s.nc.Publish(m.Reply, b)
+	t.stage("reply")
+	s.endRequest(t, slowClose, req.ClientID, "")
 }
 
-func (s *StanServer) sendCloseErr(subj, err string) {
-	resp := &pb.CloseResponse{Error: err}
+func (s *StanServer) sendCloseErr(subj string, err error) {
+	resp := &spb.CloseResponse{Error: err.Error(), ErrorCode: int32(errorCode(err))}
 	if b, err := resp.Marshal(); err == nil {
 		s.nc.Publish(subj, b)
 	}
 }
 
+// flushSubject returns the subject the server receives flush requests on.
+// Since the client protocol does not convey this subject, it is derived
+// from the cluster ID, similar to the discovery subject.
+func (s *StanServer) flushSubject() string {
+	return fmt.Sprintf("%s.%s", DefaultFlushPrefix, s.info.ClusterID)
+}
+
+// processFlushRequest processes a flush request from a publisher.
+// Since publish and flush requests are dispatched from different NATS
+// subscriptions, the request is republished on the flush marker subject,
+// which is handled by the publish subscription. This guarantees that the
+// request gets to the IO channel after all messages previously published
+// by this client, and so is replied to once they are stored and flushed.
+func (s *StanServer) processFlushRequest(m *nats.Msg) {
+	req := &spb.FlushRequest{}
+	err := req.Unmarshal(m.Data)
+	if err != nil || m.Reply == "" || !s.clients.IsValid(req.ClientID) || !isValidSubject(req.Subject) {
+		s.log.Errorf("STAN: Received invalid flush request %v", req)
+		s.sendFlushResponse(m.Reply, 0, ErrInvalidFlushReq)
+		return
+	}
+	if err := s.nc.PublishRequest(s.flushMarker, m.Reply, m.Data); err != nil {
+		s.log.Errorf("STAN: [Client:%s] Unable to process flush request: %v", req.ClientID, err)
+		s.sendFlushResponse(m.Reply, 0, err)
+	}
+}
+
+// sendFlushResponse sends the channel's last sequence, or the error, back
+// to the requestor.
+func (s *StanServer) sendFlushResponse(reply string, lastSeq uint64, err error) {
+	resp := &spb.FlushResponse{LastSequence: lastSeq}
+	if err != nil {
+		resp.Error = err.Error()
+		resp.ErrorCode = int32(errorCode(err))
+	}
+	if b, err := resp.Marshal(); err == nil {
+		s.nc.Publish(reply, b)
+	}
+}
+
+// claimSubject returns the subject the server receives claim requests on.
+func (s *StanServer) claimSubject() string {
+	return fmt.Sprintf("%s.%s", DefaultClaimPrefix, s.info.ClusterID)
+}
+
+// processClaimRequest processes a claim on a message pending acknowledgment.
+// This is the first phase of a two-phase ack: the message is not redelivered
+// until the claim expires, which lets subscribers process messages for longer
+// than the AckWait by renewing their claims. The second phase is a regular
+// ack. Claims are not persisted.
+func (s *StanServer) processClaimRequest(m *nats.Msg) {
+	req := &spb.ClaimRequest{}
+	err := req.Unmarshal(m.Data)
+	if err != nil || m.Reply == "" || !isValidSubject(req.Subject) || req.AckInbox == "" || req.ClaimWaitInSecs < 0 {
+		s.log.Errorf("STAN: Received invalid claim request %v", req)
+		s.sendClaimResponse(m.Reply, ErrInvalidClaimReq)
+		return
+	}
+	var sub *subState
+	if cs := s.store.LookupChannel(req.Subject); cs != nil {
+		sub = cs.UserData.(*subStore).LookupByAckInbox(req.AckInbox)
+	}
+	if sub == nil {
+		s.sendClaimResponse(m.Reply, ErrInvalidSub)
+		return
+	}
+	sub.Lock()
+	if sub.acksPending[req.Sequence] == nil {
+		sub.Unlock()
+		s.sendClaimResponse(m.Reply, ErrNotPending)
+		return
+	}
+	claimWait := sub.ackWait
+	if req.ClaimWaitInSecs > 0 {
+		claimWait = time.Duration(req.ClaimWaitInSecs) * time.Second
+	}
+	if sub.claims == nil {
+		sub.claims = make(map[uint64]int64)
+	}
+	sub.claims[req.Sequence] = s.clock.Now().Add(claimWait).UnixNano()
+	if s.trace {
+		s.log.Tracef("STAN: [Client:%s] Claimed seqno=%d of %s for %v", sub.ClientID, req.Sequence, sub.subject, claimWait)
+	}
+	sub.Unlock()
+	s.sendClaimResponse(m.Reply, nil)
+}
+
+// sendClaimResponse sends the outcome of a claim request to the requestor.
+func (s *StanServer) sendClaimResponse(reply string, err error) {
+	resp := &spb.ClaimResponse{}
+	if err != nil {
+		resp.Error = err.Error()
+		resp.ErrorCode = int32(errorCode(err))
+	}
+	if b, err := resp.Marshal(); err == nil {
+		s.nc.Publish(reply, b)
+	}
+}
+
 // processClientPublish process inbound messages from clients.
 func (s *StanServer) processClientPublish(m *nats.Msg) {
-	pm := &pb.PubMsg{}
-	pm.Unmarshal(m.Data)
-
-	// TODO (cls) error check.
+	if m.Subject == s.flushMarker {
+		// Already validated in processFlushRequest.
+		req := &spb.FlushRequest{}
+		req.Unmarshal(m.Data)
+		s.ioChannel <- &ioPendingMsg{m: m, fr: req}
+		return
+	}
+	var t *pubTimes
+	if s.pubLatency != nil || s.slowLog != nil {
+		t = &pubTimes{received: time.Now()}
+	}
+	if s.isDraining() {
+		s.sendDrainingErr(m)
+		return
+	}
+	if s.opts.ArchiveReader {
+		s.sendArchiveReadOnlyErr(m)
+		return
+	}
+	pm := &spb.PubMsg{}
+	if err := pm.Unmarshal(m.Data); err != nil {
+		s.log.Errorf("STAN: Received invalid client publish message, subject=%s: %v", m.Subject, err)
+		s.sendPublishErr(m.Reply, pm.Guid, ErrInvalidPubReq)
+		return
+	}
 
 	// Make sure we have a clientID, guid, etc.
-	if pm.Guid == "" || !s.clients.IsValid(pm.ClientID) || !isValidSubject(pm.Subject) {
-		Errorf("STAN: Received invalid client publish message %v", pm)
+	if pm.Guid == "" || !s.clients.IsValid(pm.ClientID) || !isValidSubject(pm.Subject) || !isValidHeaders(pm.Headers) {
+		s.log.Errorf("STAN: Received invalid client publish message %v", pm)
 		s.sendPublishErr(m.Reply, pm.Guid, ErrInvalidPubReq)
 		return
 	}
 
+	if err := s.authorize(pm.ClientID, pm.Subject, OpPublish); err != nil {
+		s.sendPublishErr(m.Reply, pm.Guid, err)
+		return
+	}
+	if err := s.checkChannelUse(pm.ClientID, pm.Subject); err != nil {
+		s.log.Debugf("STAN: [Client:%s] Publish rejected: %v", pm.ClientID, err)
+		s.sendPublishErr(m.Reply, pm.Guid, err)
+		return
+	}
+
+	contentType, err := s.checkContentType(pm.Subject, pm.Data)
+	if err != nil {
+		s.log.Debugf("STAN: [Client:%s] Publish on %s rejected: %v", pm.ClientID, pm.Subject, err)
+		s.sendPublishErr(m.Reply, pm.Guid, err)
+		return
+	}
+
+	c, err := s.checkPubLimits(pm)
+	if err != nil {
+		s.log.Debugf("STAN: [Client:%s] Publish rejected: %v", pm.ClientID, err)
+		s.sendPublishErr(m.Reply, pm.Guid, err)
+		return
+	}
+
 	// add the message to the IO channel for batching
-	s.addMessageToIOChannel(pm, m)
+	s.addMessageToIOChannel(pm, m, c, t, contentType)
 }
 
 func (s *StanServer) sendPublishErr(subj, guid string, err error) {
-	badMsgAck := &pb.PubAck{Guid: guid, Error: err.Error()}
+	badMsgAck := &spb.PubAck{Guid: guid, Error: err.Error(), ErrorCode: int32(errorCode(err))}
 	if b, err := badMsgAck.Marshal(); err == nil {
 		s.nc.Publish(subj, b)
 	}
@@ -1316,13 +2327,22 @@ func findBestQueueSub(sl []*subState) (rsub *subState) {
 		rsub.RLock()
 		rOut := len(rsub.acksPending)
 		rStalled := rsub.stalled
+		rFrozen := rsub.frozen
 		rsub.RUnlock()
 
 		sub.RLock()
 		sOut := len(sub.acksPending)
 		sStalled := sub.stalled
+		sFrozen := sub.frozen
 		sub.RUnlock()
 
+		// Never favor frozen subscribers, nothing can be sent to them
+		if rFrozen != sFrozen {
+			if rFrozen {
+				rsub = sub
+			}
+			continue
+		}
 		// Favor non stalled subscribers
 		if (!sStalled || rStalled) && (sOut < rOut) {
 			rsub = sub
@@ -1340,11 +2360,11 @@ func findBestQueueSub(sl []*subState) (rsub *subState) {
 
 // Send a message to the queue group
 // Assumes qs lock held for write
-func (s *StanServer) sendMsgToQueueGroup(qs *queueState, m *pb.MsgProto, force bool) (*subState, bool, bool) {
+func (s *StanServer) sendMsgToQueueGroup(qs *queueState, m *spb.MsgProto, force bool) (*subState, bool, bool) {
 	if qs == nil {
 		return nil, false, false
 	}
-	sub := findBestQueueSub(qs.subs)
+	sub := pickQueueSub(qs)
 	if sub == nil {
 		return nil, false, false
 	}
@@ -1362,32 +2382,67 @@ func (s *StanServer) sendMsgToQueueGroup(qs *queueState, m *pb.MsgProto, force b
 }
 
 // processMsg will proces a message, and possibly send to clients, etc.
-func (s *StanServer) processMsg(cs *stores.ChannelStore) {
+// At most `burst` messages are sent to each subscriber (or queue group),
+// unless `burst` is 0. Returns true if at least one subscriber reached
+// this limit, which means that it may have more messages to be sent.
+func (s *StanServer) processMsg(cs *stores.ChannelStore, burst int) bool {
 	ss := cs.UserData.(*subStore)
+	more := false
 
 	// Since we iterate through them all.
 	ss.RLock()
+	defer ss.RUnlock()
+	if ss.deliveryPool != nil && len(ss.psubs)+len(ss.qsubs) > 1 {
+		if more, ok := s.deliverInParallel(cs, ss, burst); ok {
+			return more
+		}
+	}
 	// Walk the plain subscribers and deliver to each one
 	for _, sub := range ss.psubs {
-		s.sendAvailableMessages(cs, sub)
+		if s.sendAvailableMessagesUpTo(cs, sub, burst) {
+			more = true
+		}
 	}
 
 	// Check the queue subscribers
 	for _, qs := range ss.qsubs {
-		s.sendAvailableMessagesToQueue(cs, qs)
+		if s.sendAvailableMessagesToQueueUpTo(cs, qs, burst) {
+			more = true
+		}
+	}
+	return more
+}
+
+// processMsgs delivers messages of all given channels. If the server is
+// configured with a delivery burst, deliveries are done in rounds so that
+// each subscription gets at most DeliveryBurst messages per round. This
+// prevents subscriptions on busy channels from monopolizing a client's
+// connection.
+func (s *StanServer) processMsgs(channels map[*stores.ChannelStore]struct{}) {
+	burst := s.opts.DeliveryBurst
+	for len(channels) > 0 {
+		var pending map[*stores.ChannelStore]struct{}
+		for cs := range channels {
+			if s.processMsg(cs, burst) {
+				if pending == nil {
+					pending = make(map[*stores.ChannelStore]struct{})
+				}
+				pending[cs] = struct{}{}
+			}
+		}
+		channels = pending
 	}
-	ss.RUnlock()
 }
 
 // Used for sorting by sequence
-type bySeq []*pb.MsgProto
+type bySeq []*spb.MsgProto
 
 func (a bySeq) Len() int           { return (len(a)) }
 func (a bySeq) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a bySeq) Less(i, j int) bool { return a[i].Sequence < a[j].Sequence }
 
-func makeSortedMsgs(msgs map[uint64]*pb.MsgProto) []*pb.MsgProto {
-	results := make([]*pb.MsgProto, 0, len(msgs))
+func makeSortedMsgs(msgs map[uint64]*spb.MsgProto) []*spb.MsgProto {
+	results := make([]*spb.MsgProto, 0, len(msgs))
 	for _, m := range msgs {
 		mCopy := *m // copy since we need to set redelivered flag.
 		results = append(results, &mCopy)
@@ -1406,7 +2461,8 @@ func (s *StanServer) performDurableRedelivery(sub *subState) {
 	sub.RUnlock()
 
 	if s.debug {
-		Debugf("STAN: [Client:%s] Redelivering to durable %s", clientID, durName)
+		s.log.debugFields("STAN: Redelivering to durable",
+			Field{"client", clientID}, Field{"channel", sub.subject}, Field{"durable", durName})
 	}
 
 	// If we don't find the client, we are done.
@@ -1417,7 +2473,8 @@ func (s *StanServer) performDurableRedelivery(sub *subState) {
 	// Go through all messages
 	for _, m := range sortedMsgs {
 		if s.trace {
-			Tracef("STAN: [Client:%s] Redelivery, sending seqno=%d", clientID, m.Sequence)
+			s.log.traceFields("STAN: Redelivery, sending msg",
+				Field{"client", clientID}, Field{"channel", m.Subject}, Field{"seq", m.Sequence})
 		}
 
 		// Flag as redelivered.
@@ -1442,6 +2499,14 @@ func (s *StanServer) performAckExpirationRedelivery(sub *subState) {
 	floorTimestamp := sub.ackTimeFloor
 	inbox := sub.Inbox
 	stalledRedeliveries := sub.stalledRdlv
+	frozen := sub.frozen
+	var claims map[uint64]int64
+	if len(sub.claims) > 0 {
+		claims = make(map[uint64]int64, len(sub.claims))
+		for seq, exp := range sub.claims {
+			claims[seq] = exp
+		}
+	}
 	sub.RUnlock()
 
 	// If we don't find the client, we are done.
@@ -1453,7 +2518,8 @@ func (s *StanServer) performAckExpirationRedelivery(sub *subState) {
 	client.RLock()
 	fhbs := client.fhb
 	client.RUnlock()
-	if fhbs != 0 {
+	// Same if the subscription is frozen while a takeover is checked.
+	if fhbs != 0 || frozen {
 		// Reset the timer.
 		sub.Lock()
 		if sub.ackTimer != nil {
@@ -1461,15 +2527,15 @@ func (s *StanServer) performAckExpirationRedelivery(sub *subState) {
 		}
 		sub.Unlock()
 		if s.debug {
-			Debugf("STAN: [Client:%s] Skipping redelivering on ack expiration due to client missed hearbeat, subject=%s, inbox=%s",
-				clientID, subject, inbox)
+			s.log.debugFields("STAN: Skipping redelivering on ack expiration due to client missed hearbeat",
+				Field{"client", clientID}, Field{"channel", subject}, Field{"inbox", inbox})
 		}
 		return
 	}
 
 	if s.debug {
-		Debugf("STAN: [Client:%s] Redelivering on ack expiration, subject=%s, inbox=%s",
-			clientID, subject, inbox)
+		s.log.debugFields("STAN: Redelivering on ack expiration",
+			Field{"client", clientID}, Field{"channel", subject}, Field{"inbox", inbox})
 	}
 
 	var cs *stores.ChannelStore
@@ -1479,10 +2545,14 @@ func (s *StanServer) performAckExpirationRedelivery(sub *subState) {
 		cs = s.store.LookupChannel(subject)
 	}
 
-	now := time.Now().UnixNano()
+	now := s.clock.Now().UnixNano()
+	// Messages expiring soon after those already expired are redelivered
+	// in the same pass, instead of each rearming the timer.
+	horizon := now + int64(s.opts.AckTimerSlack)
 
 	// Check if we should force redelivery, even if subscriber is stalled.
-	shouldForce := stalledRedeliveries >= atomic.LoadInt32(&maxStalledRedeliveries)
+	maxStalledRdlv := atomic.LoadInt32(&s.maxStalledRdlv)
+	shouldForce := stalledRedeliveries >= maxStalledRdlv
 	if shouldForce {
 		sub.Lock()
 		sub.stalledRdlv = 0
@@ -1492,31 +2562,85 @@ func (s *StanServer) performAckExpirationRedelivery(sub *subState) {
 	var pick *subState
 	sent := false
 	sendMore := false
+	shrunk := false
+	redelivered := false
+
+	// Claimed messages are skipped, but the timer must fire when the first
+	// claim expires. The claim expiration is expressed as the timestamp of
+	// a message that would expire at the same time.
+	firstUnclaimed := int64(0)
+	firstClaimed := int64(0)
 
 	// We will move through acksPending(sorted) and see what needs redelivery.
 	for _, m := range sortedMsgs {
-		// Ignore messages with a timestamp below our floor
-		if floorTimestamp > 0 && floorTimestamp > m.Timestamp {
+		claimExp, claimed := claims[m.Sequence]
+		if claimed {
+			if claimExp > now {
+				if ts := claimExp - expTime; firstClaimed == 0 || ts < firstClaimed {
+					firstClaimed = ts
+				}
+				continue
+			}
+			// The claim has expired, the message is redelivered as usual.
+			sub.Lock()
+			delete(sub.claims, m.Sequence)
+			sub.Unlock()
+		}
+
+		// Ignore messages with a timestamp below our floor, unless they were
+		// claimed, in which case they have not been redelivered recently.
+		if !claimed && floorTimestamp > 0 && floorTimestamp > m.Timestamp {
 			continue
 		}
+		if firstUnclaimed == 0 {
+			firstUnclaimed = m.Timestamp
+		}
 
-		if m.Timestamp+expTime > now {
+		if m.Timestamp+expTime > horizon {
 			// the messages are ordered by seq so the expiration
 			// times are ascending.  Once we've get here, we've hit an
 			// unexpired message, and we're done. Reset the sub's ack
 			// timer to fire on the next message expiration.
 			if s.trace {
-				Tracef("STAN: [Client:%s] redelivery, skipping seqno=%d.", clientID, m.Sequence)
+				s.log.traceFields("STAN: Redelivery, skipping msg",
+					Field{"client", clientID}, Field{"channel", subject}, Field{"seq", m.Sequence})
+			}
+			firstUnacked := m.Timestamp
+			if firstClaimed != 0 && firstClaimed < firstUnacked {
+				firstUnacked = firstClaimed
 			}
-			sub.adjustAckTimer(m.Timestamp)
+			sub.adjustAckTimer(firstUnacked, now, maxStalledRdlv)
 			return
 		}
 
+		// Reduce the delivery window, once per redelivery attempt.
+		if !shrunk {
+			sub.Lock()
+			if sub.window != nil {
+				sub.window.shrink()
+			}
+			sub.Unlock()
+			shrunk = true
+		}
+
+		// Messages redelivered too many times, or rejected by the
+		// DeliveryInterceptor, are moved to the dead-letter channel instead.
+		if isRejected(sub, m.Sequence) {
+			if s.deadLetter(sub, m, "rejected by the delivery interceptor") {
+				continue
+			}
+		} else if max := s.maxRedeliveries(sub); max > 0 && redeliveries(sub, qs, m.Sequence) >= max {
+			if s.deadLetter(sub, m, fmt.Sprintf("redelivered %v times", max)) {
+				continue
+			}
+		}
+
 		// Flag as redelivered.
 		m.Redelivered = true
 
 		if s.trace {
-			Tracef("STAN: [Client:%s] Redelivery, sending seqno=%d", clientID, m.Sequence)
+			s.log.traceFields("STAN: Redelivery, sending msg",
+				Field{"client", clientID}, Field{"channel", subject}, Field{"seq", m.Sequence})
 		}
 
 		// Handle QueueSubscribers differently, since we will choose best subscriber
@@ -1526,7 +2650,7 @@ func (s *StanServer) performAckExpirationRedelivery(sub *subState) {
 			pick, sent, sendMore = s.sendMsgToQueueGroup(qs, m, shouldForce)
 			qs.Unlock()
 			if pick == nil {
-				Errorf("STAN: [Client:%s] Unable to find queue subscriber", clientID)
+				s.log.Errorf("STAN: [Client:%s] Unable to find queue subscriber", clientID)
 				break
 			}
 			// If the message is redelivered to a different queue subscriber,
@@ -1541,6 +2665,12 @@ func (s *StanServer) performAckExpirationRedelivery(sub *subState) {
 			sent, sendMore = s.sendMsgToSub(sub, m, shouldForce)
 			sub.Unlock()
 		}
+		if sent {
+			redelivered = true
+			if s.maxRedeliveries(sub) > 0 {
+				incRedeliveries(sub, qs, m.Sequence)
+			}
+		}
 		// If we did not send that message or reached the maxInFlight
 		// and we should not force redelivery, then stop.
 		if !shouldForce && (!sent || !sendMore) {
@@ -1560,9 +2690,25 @@ func (s *StanServer) performAckExpirationRedelivery(sub *subState) {
 	if len(sortedMsgs) > 0 {
 		firstUnacked = sortedMsgs[0].Timestamp
 	}
+	// If there are claimed messages, the oldest message may be claimed.
+	if firstClaimed != 0 {
+		firstUnacked = firstUnclaimed
+		if firstUnacked == 0 || firstClaimed < firstUnacked {
+			firstUnacked = firstClaimed
+		}
+	}
+
+	// Back off before the next redelivery, if the channel's policy says so.
+	if redelivered {
+		if d := channelDefaultsFor(s.opts.ChannelDefaults, subject); d != nil {
+			sub.Lock()
+			d.backoff(sub)
+			sub.Unlock()
+		}
+	}
 
 	// Adjust the timer
-	sub.adjustAckTimer(firstUnacked)
+	sub.adjustAckTimer(firstUnacked, s.clock.Now().UnixNano(), maxStalledRdlv)
 }
 
 // Sends the message to the subscriber
@@ -1570,30 +2716,45 @@ func (s *StanServer) performAckExpirationRedelivery(sub *subState) {
 // of acksPending is greater or equal to the sub's MaxInFlight limit, messages
 // are not sent and subscriber is marked as stalled.
 // Sub lock should be held before calling.
-func (s *StanServer) sendMsgToSub(sub *subState, m *pb.MsgProto, force bool) (bool, bool) {
-	if sub == nil || m == nil || (sub.newOnHold && !m.Redelivered) {
+func (s *StanServer) sendMsgToSub(sub *subState, m *spb.MsgProto, force bool) (bool, bool) {
+	if sub == nil || m == nil || (sub.newOnHold && !m.Redelivered) || sub.paused || sub.frozen || sub.standby {
 		return false, false
 	}
 
 	if s.trace {
-		Tracef("STAN: [Client:%s] Sending msg subject=%s inbox=%s seqno=%d.",
-			sub.ClientID, m.Subject, sub.Inbox, m.Sequence)
+		s.log.traceFields("STAN: Sending msg", Field{"client", sub.ClientID},
+			Field{"channel", m.Subject}, Field{"inbox", sub.Inbox}, Field{"seq", m.Sequence})
 	}
 
 	// Don't send if we have too many outstanding already, unless forced to send.
 	ap := int32(len(sub.acksPending))
-	if !force && (ap >= sub.MaxInFlight) {
+	maxInFlight := sub.maxInFlight()
+	if !force && (ap >= maxInFlight) {
 		sub.stalled = true
+		s.markFull(sub)
 		if s.debug {
-			Debugf("STAN: [Client:%s] Stalled msgseq %s:%d to %s.",
-				sub.ClientID, m.Subject, m.Sequence, sub.Inbox)
+			s.log.debugFields("STAN: Stalled msg", Field{"client", sub.ClientID},
+				Field{"channel", m.Subject}, Field{"inbox", sub.Inbox}, Field{"seq", m.Sequence})
 		}
 		return false, false
 	}
 
-	b, _ := m.Marshal()
+	// A lazily created subscription must be in the store before
+	// messages are added to its pending list.
+	if err := s.persistLazySub(sub); err != nil {
+		s.log.Errorf("STAN: [Client:%s] Unable to store subscription for %s (%v)",
+			sub.ClientID, m.Subject, err)
+		return false, false
+	}
+
+	im, err := s.intercept(sub, m)
+	if err != nil {
+		return s.rejectDelivery(sub, m, err)
+	}
+	b, _ := im.Marshal()
+	b = appendBacklogHint(b, s.backlogHint(sub, m))
 	if err := s.nc.Publish(sub.Inbox, b); err != nil {
-		Errorf("STAN: [Client:%s] Failed Sending msgseq %s:%d to %s (%s).",
+		s.log.Errorf("STAN: [Client:%s] Failed Sending msgseq %s:%d to %s (%s).",
 			sub.ClientID, m.Subject, m.Sequence, sub.Inbox, err)
 		return false, false
 	}
@@ -1605,13 +2766,20 @@ func (s *StanServer) sendMsgToSub(sub *subState, m *pb.MsgProto, force bool) (bo
 		s.setupAckTimer(sub, sub.ackWait)
 	}
 
+	// Record when the message is sent to measure the ack latency.
+	if sub.window != nil {
+		sub.window.sentTime[m.Sequence] = s.clock.Now().UnixNano()
+	}
+	s.recordAckSent(sub, m)
+	s.clientTags.delivered(sub.ClientID, len(m.Data))
+
 	// If this message is already pending, nothing else to do.
 	if sub.acksPending[m.Sequence] != nil {
 		return true, true
 	}
 	// Store in storage
 	if err := sub.store.AddSeqPending(sub.ID, m.Sequence); err != nil {
-		Errorf("STAN: [Client:%s] Unable to update subscription for %s:%v (%v)",
+		s.log.Errorf("STAN: [Client:%s] Unable to update subscription for %s:%v (%v)",
 			sub.ClientID, m.Subject, m.Sequence, err)
 		return false, false
 	}
@@ -1627,11 +2795,12 @@ func (s *StanServer) sendMsgToSub(sub *subState, m *pb.MsgProto, force bool) (bo
 	// Now that we have added to acksPending, check again if we
 	// have reached the max and tell the caller that it should not
 	// be sending more at this time.
-	if !force && (ap+1 == sub.MaxInFlight) {
+	if !force && (ap+1 >= maxInFlight) {
 		sub.stalled = true
+		s.markFull(sub)
 		if s.debug {
-			Debugf("STAN: [Client:%s] Stalling after msgseq %s:%d to %s.",
-				sub.ClientID, m.Subject, m.Sequence, sub.Inbox)
+			s.log.debugFields("STAN: Stalling after msg", Field{"client", sub.ClientID},
+				Field{"channel", m.Subject}, Field{"inbox", sub.Inbox}, Field{"seq", m.Sequence})
 		}
 		return true, false
 	}
@@ -1642,7 +2811,7 @@ func (s *StanServer) sendMsgToSub(sub *subState, m *pb.MsgProto, force bool) (bo
 // Sets up the ackTimer to fire at the given duration.
 // sub's lock held on entry.
 func (s *StanServer) setupAckTimer(sub *subState, d time.Duration) {
-	sub.ackTimer = time.AfterFunc(d, func() {
+	sub.ackTimer = s.clock.AfterFunc(d, func() {
 		s.performAckExpirationRedelivery(sub)
 	})
 }
@@ -1667,16 +2836,50 @@ func (s *StanServer) storeIOLoop() {
 	// assume we are the master and assign the sequence ID here.
 	////////////////////////////////////////////////////////////////////////////
 	var storesToFlush map[*stores.ChannelStore]struct{}
+	// Time at which the stores were flushed, if publishes are timed.
+	var flushed map[*stores.ChannelStore]time.Time
 
 	var _pendingMsgs [ioChannelSize]*ioPendingMsg
 	var pendingMsgs = _pendingMsgs[:0]
+	var pendingFlushes []*ioPendingMsg
 
 	storeIOPendingMsg := func(iopm *ioPendingMsg) {
+		// Flush requests are replied to once the batch has been flushed.
+		if iopm.fr != nil {
+			pendingFlushes = append(pendingFlushes, iopm)
+			return
+		}
+		var now int64
+		if s.dedup != nil {
+			now = s.clock.Now().UnixNano()
+			if s.dedup.isDuplicate(iopm.pm.Guid, now) {
+				s.log.Debugf("STAN: [Client:%s] Duplicate message guid=%s on %s not stored", iopm.pm.ClientID, iopm.pm.Guid, iopm.pm.Subject)
+				// Acked with this batch, so after the original message
+				// is flushed if it is part of it.
+				iopm.t = nil
+				pendingMsgs = append(pendingMsgs, iopm)
+				return
+			}
+		}
+		if iopm.t != nil {
+			iopm.t.dequeued = time.Now()
+		}
 		cs, err := s.assignAndStore(iopm.pm)
+		if iopm.t != nil {
+			iopm.t.stored = time.Now()
+			iopm.t.store = cs
+		}
 		if err != nil {
-			Errorf("STAN: [Client:%s] Error processing message for subject %q: %v", iopm.pm.ClientID, iopm.m.Subject, err)
+			s.log.Errorf("STAN: [Client:%s] Error processing message for subject %q: %v", iopm.pm.ClientID, iopm.m.Subject, err)
 			s.sendPublishErr(iopm.m.Reply, iopm.pm.Guid, err)
+			iopm.c.pubDone()
 		} else {
+			if s.dedup != nil {
+				s.dedup.add(iopm.pm.Guid, now)
+			}
+			if iopm.ct != "" {
+				s.contentTypes.record(iopm.pm.Subject, iopm.ct)
+			}
 			pendingMsgs = append(pendingMsgs, iopm)
 			storesToFlush[cs] = struct{}{}
 		}
@@ -1692,6 +2895,9 @@ func (s *StanServer) storeIOLoop() {
 		case iopm := <-s.ioChannel:
 			// Create a new map (probably faster than deleting elements down below)
 			storesToFlush = make(map[*stores.ChannelStore]struct{})
+			if s.pubLatency != nil || s.slowLog != nil {
+				flushed = make(map[*stores.ChannelStore]time.Time)
+			}
 
 			// store the one we just pulled
 			storeIOPendingMsg(iopm)
@@ -1739,9 +2945,22 @@ func (s *StanServer) storeIOLoop() {
 					// TODO: Attempt recovery, notify publishers of error.
 					panic(fmt.Errorf("Unable to flush msg store: %v", err))
 				}
-				// Call this here, so messages are sent to subscribers,
-				// which means that msg seq is added to subscription file
-				s.processMsg(cs)
+				if flushed != nil {
+					flushed[cs] = time.Now()
+				}
+			}
+			// The sequences of the ordering groups are recorded once the
+			// messages carrying them are.
+			if len(s.groupsToStore) > 0 {
+				if err := s.store.SetOrderingGroups(s.groupsToStore); err != nil {
+					panic(fmt.Errorf("Unable to store ordering groups: %v", err))
+				}
+				s.groupsToStore = make(orderingGroups)
+			}
+			// Call this here, so messages are sent to subscribers,
+			// which means that msg seq is added to subscription file
+			s.processMsgs(storesToFlush)
+			for cs := range storesToFlush {
 				if err := cs.Subs.Flush(); err != nil {
 					panic(fmt.Errorf("Unable to flush sub store: %v", err))
 				}
@@ -1750,10 +2969,35 @@ func (s *StanServer) storeIOLoop() {
 			// Ack our messages back to the publisher
 			for _, iopm := range pendingMsgs {
 				s.ackPublisher(iopm.pm, iopm.m.Reply)
+				iopm.c.pubDone()
+				s.clientTags.published(iopm.pm.ClientID, len(iopm.pm.Data))
+				if iopm.t != nil {
+					acked := time.Now()
+					if s.pubLatency != nil {
+						s.pubLatency.record(iopm.pm.Subject, iopm.t, flushed[iopm.t.store], acked)
+					}
+					s.endPublish(iopm.pm.ClientID, iopm.pm.Subject, iopm.t, flushed[iopm.t.store], acked)
+				}
+			}
+			// Everything published before the flush requests is now stored.
+			// The writes the store may defer are forced, so that the
+			// messages are on disk when the requestor gets the response.
+			for i, iopm := range pendingFlushes {
+				lastSeq := uint64(0)
+				var err error
+				if cs := s.store.LookupChannel(iopm.fr.Subject); cs != nil {
+					if err = cs.Msgs.FlushNow(); err != nil {
+						s.log.Errorf("STAN: Unable to flush msg store of %q: %v", iopm.fr.Subject, err)
+					}
+					lastSeq = cs.Msgs.LastSequence()
+				}
+				s.sendFlushResponse(iopm.m.Reply, lastSeq, err)
+				pendingFlushes[i] = nil
 			}
 
 			// clear out pending messages and store map
 			pendingMsgs = pendingMsgs[:0]
+			pendingFlushes = pendingFlushes[:0]
 
 		case <-s.ioChannelQuit:
 			return
@@ -1762,32 +3006,47 @@ func (s *StanServer) storeIOLoop() {
 }
 
 // addMessageToIOChannel passes the message to the IO go routine
-func (s *StanServer) addMessageToIOChannel(publishMsg *pb.PubMsg, natsMsg *nats.Msg) {
+func (s *StanServer) addMessageToIOChannel(publishMsg *spb.PubMsg, natsMsg *nats.Msg, c *client, t *pubTimes, contentType string) {
 	// TODO:  Pool/Preallocate here?
-	iopm := ioPendingMsg{pm: publishMsg, m: natsMsg}
+	iopm := ioPendingMsg{pm: publishMsg, m: natsMsg, c: c, t: t, ct: contentType}
+	if t != nil {
+		t.queued = time.Now()
+	}
 	s.ioChannel <- &iopm
 }
 
 // assignAndStore will assign a sequence ID and then store the message.
-func (s *StanServer) assignAndStore(pm *pb.PubMsg) (*stores.ChannelStore, error) {
+func (s *StanServer) assignAndStore(pm *spb.PubMsg) (*stores.ChannelStore, error) {
+	if pm.OrderingGroup != "" {
+		return s.assignAndStoreInGroup(pm)
+	}
 	cs, err := s.lookupOrCreateChannel(pm.Subject)
 	if err != nil {
 		return nil, err
 	}
-	if _, err := cs.Msgs.Store(pm.Reply, pm.Data); err != nil {
+	first := cs.Msgs.FirstSequence()
+	// The GUID is stored so that subscriptions can start at the message.
+	_, err = cs.Msgs.StoreMsg(&spb.MsgProto{Reply: pm.Reply, Data: pm.Data, Headers: pm.Headers, Guid: pm.Guid})
+	if err != nil {
 		return nil, err
 	}
+	s.checkStoreFull(pm.Subject, cs, first)
+	cs.UserData.(*subStore).touch(s.clock.Now().UnixNano())
 	return cs, nil
 }
 
 // ackPublisher sends the ack for a message.
-func (s *StanServer) ackPublisher(pm *pb.PubMsg, reply string) {
-	msgAck := &pb.PubAck{Guid: pm.Guid}
+func (s *StanServer) ackPublisher(pm *spb.PubMsg, reply string) {
+	msgAck := &spb.PubAck{Guid: pm.Guid}
 	var buf [32]byte
 	b := buf[:]
+	// Guids longer than the ones of the clients don't fit.
+	if msgAck.Size() > len(buf) {
+		b = make([]byte, msgAck.Size())
+	}
 	n, _ := msgAck.MarshalTo(b)
 	if s.trace {
-		Tracef("STAN: [Client:%s] Acking Publisher subj=%s guid=%s", pm.ClientID, pm.Subject, pm.Guid)
+		s.log.Tracef("STAN: [Client:%s] Acking Publisher subj=%s guid=%s", pm.ClientID, pm.Subject, pm.Guid)
 	}
 	s.nc.Publish(reply, b[:n])
 }
@@ -1840,24 +3099,60 @@ func (s *StanServer) removeAllNonDurableSubscribers(client *client) {
 		// Get the subStore from the ChannelStore
 		ss := cs.UserData.(*subStore)
 		// Don't remove durables
-		ss.Remove(sub, false)
+		s.startExclusiveConsumer(cs, ss.Remove(sub, false))
 	}
 }
 
 // processUnSubscribeRequest will process a unsubscribe request.
 func (s *StanServer) processUnSubscribeRequest(m *nats.Msg) {
+	s.performUnsubOrCloseSubscription(m, false)
+}
+
+// subCloseSubject returns the subject the server receives subscription
+// close requests on. It is sent to the clients in the connect response,
+// and derived from the cluster ID, similar to the discovery subject, so
+// that clients ignoring that field can still find it.
+func (s *StanServer) subCloseSubject() string {
+	return fmt.Sprintf("%s.%s", DefaultSubClosePrefix, s.info.ClusterID)
+}
+
+// processSubCloseRequest will process a subscription close request. The
+// request is an UnsubscribeRequest. Unlike an unsubscribe, closing a
+// durable subscription keeps its state, so that it can be resumed later.
+func (s *StanServer) processSubCloseRequest(m *nats.Msg) {
+	s.performUnsubOrCloseSubscription(m, true)
+}
+
+// performUnsubOrCloseSubscription removes the subscription from the client.
+// Durables are deleted on unsubscribe, but kept on close.
+func (s *StanServer) performUnsubOrCloseSubscription(m *nats.Msg, isSubClose bool) {
+	action, reqErr := "unsub", ErrInvalidUnsubReq
+	if isSubClose {
+		action, reqErr = "sub close", ErrInvalidSubClose
+	}
 	req := &pb.UnsubscribeRequest{}
 	err := req.Unmarshal(m.Data)
 	if err != nil {
-		Errorf("STAN: Invalid unsub request from %s.", m.Subject)
-		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidUnsubReq)
+		s.log.Errorf("STAN: Invalid %s request from %s.", action, m.Subject)
+		s.sendSubscriptionResponseErr(m.Reply, reqErr)
+		return
+	}
+
+	// A wildcard subscription is removed from all its channels, closing
+	// it is the same as unsubscribing since it can't be durable.
+	if ws := s.lookupWildcardSub(req.ClientID, req.Subject, req.Inbox); ws != nil {
+		s.removeWildcardSub(ws)
+		s.log.Debugf("STAN: [Client:%s] Unsubscribing wildcard subject=%s.", req.ClientID, req.Subject)
+		resp := &spb.SubscriptionResponse{AckInbox: req.Inbox}
+		b, _ := resp.Marshal()
+		s.nc.Publish(m.Reply, b)
 		return
 	}
 
 	cs := s.store.LookupChannel(req.Subject)
 	if cs == nil {
-		Errorf("STAN: [Client:%s] unsub request missing subject %s.",
-			req.ClientID, req.Subject)
+		s.log.Errorf("STAN: [Client:%s] %s request missing subject %s.",
+			req.ClientID, action, req.Subject)
 		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSub)
 		return
 	}
@@ -1867,32 +3162,42 @@ func (s *StanServer) processUnSubscribeRequest(m *nats.Msg) {
 
 	sub := ss.LookupByAckInbox(req.Inbox)
 	if sub == nil {
-		Errorf("STAN: [Client:%s] unsub request for missing inbox %s.",
-			req.ClientID, req.Inbox)
+		s.log.Errorf("STAN: [Client:%s] %s request for missing inbox %s.",
+			req.ClientID, action, req.Inbox)
 		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSub)
 		return
 	}
 
 	// Remove from Client
 	if !s.clients.RemoveSub(req.ClientID, sub) {
-		Errorf("STAN: [Client:%s] unsub request for missing client", req.ClientID)
+		s.log.Errorf("STAN: [Client:%s] %s request for missing client", req.ClientID, action)
 		s.sendSubscriptionResponseErr(m.Reply, ErrUnknownClient)
 		return
 	}
 
-	// Remove the subscription, force removal if durable.
-	ss.Remove(sub, true)
-
-	Debugf("STAN: [Client:%s] Unsubscribing subject=%s.", req.ClientID, sub.subject)
+	if isSubClose {
+		// Remove the subscription, but keep the durable's state.
+		sub.RLock()
+		isDurable := sub.DurableName != ""
+		sub.RUnlock()
+		s.startExclusiveConsumer(cs, ss.Remove(sub, !isDurable))
+		s.log.Debugf("STAN: [Client:%s] Closing subscription subject=%s.", req.ClientID, sub.subject)
+	} else {
+		// Remove the subscription, force removal if durable. The durable
+		// can still be restored during the grace period.
+		s.addDurableTombstone(cs, sub)
+		s.startExclusiveConsumer(cs, ss.Remove(sub, true))
+		s.log.Debugf("STAN: [Client:%s] Unsubscribing subject=%s.", req.ClientID, sub.subject)
+	}
 
 	// Create a non-error response
-	resp := &pb.SubscriptionResponse{AckInbox: req.Inbox}
+	resp := &spb.SubscriptionResponse{AckInbox: req.Inbox}
 	b, _ := resp.Marshal()
 	s.nc.Publish(m.Reply, b)
 }
 
 func (s *StanServer) sendSubscriptionResponseErr(reply string, err error) {
-	resp := &pb.SubscriptionResponse{Error: err.Error()}
+	resp := &spb.SubscriptionResponse{Error: err.Error(), ErrorCode: int32(errorCode(err))}
 	b, _ := resp.Marshal()
 	s.nc.Publish(reply, b)
 }
@@ -1911,6 +3216,43 @@ func isValidSubject(subject string) bool {
 	return true
 }
 
+// Longest inbox accepted from a client. The protocol lines sent by the
+// server to publish on an inbox must stay below the control line limit of
+// the NATS Server (1024 by default), which closes the connection otherwise.
+const maxInboxLen = 256
+
+// Check that the server can publish on an inbox given by a client: it must
+// be a subject without wildcards, empty tokens, or white spaces and control
+// characters, which would corrupt the protocol of the NATS connection.
+func isValidInbox(inbox string) bool {
+	if inbox == "" || len(inbox) > maxInboxLen {
+		return false
+	}
+	for _, token := range strings.Split(inbox, ".") {
+		if token == "" || token == "*" || token == ">" {
+			return false
+		}
+	}
+	for _, r := range inbox {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check that the keys of the headers of a published message are made of
+// letters, digits, '-', '_' and '.', so that they can be used as the names
+// of HTTP headers.
+func isValidHeaders(headers map[string]string) bool {
+	for k := range headers {
+		if !headerKeyRegEx.MatchString(k) {
+			return false
+		}
+	}
+	return true
+}
+
 // Clear the ackTimer.
 // sub Lock held in entry.
 func (sub *subState) clearAckTimer() {
@@ -1927,7 +3269,7 @@ func (sub *subState) clearAckTimer() {
 // default sub.ackWait value if the given timestamp is
 // 0 or in the past. Otherwise, it is set to the remaining time
 // between the given timestamp and now.
-func (sub *subState) adjustAckTimer(firstUnackedTimestamp int64) {
+func (sub *subState) adjustAckTimer(firstUnackedTimestamp, now int64, maxStalledRdlv int32) {
 	sub.Lock()
 	defer sub.Unlock()
 
@@ -1945,7 +3287,7 @@ func (sub *subState) adjustAckTimer(firstUnackedTimestamp int64) {
 		// redelivery stalled too.
 		if sub.stalled {
 			sub.stalledRdlv++
-			if sub.stalledRdlv > atomic.LoadInt32(&maxStalledRedeliveries) {
+			if sub.stalledRdlv > maxStalledRdlv {
 				// Reset the timer to a short value
 				sub.ackTimer.Reset(time.Millisecond)
 				return
@@ -1956,9 +3298,6 @@ func (sub *subState) adjustAckTimer(firstUnackedTimestamp int64) {
 			sub.stalledRdlv = 0
 		}
 
-		// Capture time
-		now := time.Now().UnixNano()
-
 		// ackWait in int64
 		expTime := int64(sub.ackWait)
 
@@ -1984,6 +3323,32 @@ func (sub *subState) adjustAckTimer(firstUnackedTimestamp int64) {
 	}
 }
 
+// resume hands a remembered durable, or the shadow of a durable queue
+// group, over to the client of the subscription request.
+func (sub *subState) resume(sr *spb.SubscriptionRequest, ackInbox string) {
+	// FIXME(dlc) - Do we error on options? They should be ignored if the new conflicts with old.
+	sub.Lock()
+	// Set ClientID and new AckInbox but leave LastSent to the
+	// remembered value.
+	sub.AckInbox = ackInbox
+	sub.ClientID = sr.ClientID
+	sub.Inbox = sr.Inbox
+	sub.stalled = false
+	// Claims were made by the previous client.
+	sub.claims = nil
+	// The AckWait of the new request replaces the remembered one,
+	// and any redelivery backoff is reset.
+	sub.AckWaitInSecs = sr.AckWaitInSecs
+	sub.ackWait = time.Duration(sr.AckWaitInSecs) * time.Second
+	sub.baseAckWait = 0
+	// So do the redelivery limit, the replay limits and the filter.
+	sub.MaxRedeliveries = sr.MaxRedeliveries
+	sub.replay.stop()
+	sub.replay = newReplayLimits(sr)
+	sub.filter = newMsgFilter(sr)
+	sub.Unlock()
+}
+
 // Used to generate durable key. This should not be called on non-durables.
 func (sub *subState) durableKey() string {
 	if sub.DurableName == "" {
@@ -1993,7 +3358,7 @@ func (sub *subState) durableKey() string {
 }
 
 // Used to generate durable key. This should not be called on non-durables.
-func durableKey(sr *pb.SubscriptionRequest) string {
+func durableKey(sr *spb.SubscriptionRequest) string {
 	if sr.DurableName == "" {
 		return ""
 	}
@@ -2010,6 +3375,7 @@ func (s *StanServer) addSubscription(ss *subStore, sub *subState) error {
 	if err := ss.Store(sub); err != nil {
 		return err
 	}
+	ss.touch(s.clock.Now().UnixNano())
 	return nil
 }
 
@@ -2029,8 +3395,15 @@ func (s *StanServer) updateDurable(cs *stores.ChannelStore, ss *subStore, sub *s
 		return err
 	}
 	ss.Lock()
-	// Add back into plain subscribers
-	ss.psubs = append(ss.psubs, sub)
+	// Add back into its durable queue group, or plain subscribers
+	if qs := sub.qstate; qs != nil {
+		qs.Lock()
+		qs.subs = append(qs.subs, sub)
+		qs.Unlock()
+	} else {
+		ss.psubs = append(ss.psubs, sub)
+		ss.electExclusiveConsumer(false, 0)
+	}
 	// And in ackInbox lookup map.
 	ss.acks[subUpdate.AckInbox] = sub
 	ss.Unlock()
@@ -2040,104 +3413,240 @@ func (s *StanServer) updateDurable(cs *stores.ChannelStore, ss *subStore, sub *s
 
 // processSubscriptionRequest will process a subscription request.
 func (s *StanServer) processSubscriptionRequest(m *nats.Msg) {
-	sr := &pb.SubscriptionRequest{}
+	t := s.startRequest()
+	sr := &spb.SubscriptionRequest{}
 	err := sr.Unmarshal(m.Data)
 	if err != nil {
-		Errorf("STAN:  Invalid Subscription request from %s.", m.Subject)
+		s.log.Errorf("STAN:  Invalid Subscription request from %s.", m.Subject)
 		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSubReq)
 		return
 	}
+	if err := s.checkAdmission(); err != nil {
+		s.log.Debugf("STAN: [Client:%s] Subscription request rejected: %v", sr.ClientID, err)
+		s.sendSubscriptionResponseErr(m.Reply, err)
+		return
+	}
+
+	if err := s.validateSubRequest(m.Subject, sr); err != nil {
+		s.sendSubscriptionResponseErr(m.Reply, err)
+		return
+	}
+
+	if isWildcardSubject(sr.Subject) {
+		s.processWildcardSubscriptionRequest(m, sr, t)
+		return
+	}
 
+	cs, sub, err := s.createSubscription(m.Subject, sr, t)
+	if err != nil {
+		s.sendSubscriptionResponseErr(m.Reply, err)
+		return
+	}
+	s.subscribeToAcks(sub)
+
+	// Create a non-error response
+	resp := &spb.SubscriptionResponse{AckInbox: sub.AckInbox, StartAdjusted: sub.clamped}
+	b, _ := resp.Marshal()
+	s.nc.Publish(m.Reply, b)
+	t.stage("reply")
+
+	s.sendInitialMessages(cs, sub, sr)
+	t.stage("send")
+	s.endRequest(t, slowSubscribe, sr.ClientID, sr.Subject)
+}
+
+// validateSubRequest applies the defaults of the channel to the
+// subscription request, and checks it. `reqSubject` is the subject the
+// request was received on.
+func (s *StanServer) validateSubRequest(reqSubject string, sr *spb.SubscriptionRequest) error {
 	// FIXME(dlc) check for multiple errors, mis-configurations, etc.
 
+	// Apply the defaults of the channel to the options not set.
+	if d := channelDefaultsFor(s.opts.ChannelDefaults, sr.Subject); d != nil {
+		d.apply(sr)
+	}
+
 	// AckWait must be >= 1s
 	if sr.AckWaitInSecs <= 0 {
-		Debugf("STAN: [Client:%s] Invalid AckWait in subscription request from %s.",
-			sr.ClientID, m.Subject)
-		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidAckWait)
-		return
+		s.log.Debugf("STAN: [Client:%s] Invalid AckWait in subscription request from %s.",
+			sr.ClientID, reqSubject)
+		return ErrInvalidAckWait
 	}
 
-	// Make sure subject is valid
-	if !isValidSubject(sr.Subject) {
-		Debugf("STAN: [Client:%s] Invalid subject <%s> in subscription request from %s.",
-			sr.ClientID, sr.Subject, m.Subject)
-		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSubject)
-		return
+	// MaxInFlight must be >= 1, and is capped by the server.
+	if sr.MaxInFlight <= 0 {
+		s.log.Debugf("STAN: [Client:%s] Invalid MaxInFlight in subscription request from %s.",
+			sr.ClientID, reqSubject)
+		return ErrInvalidMaxInFlight
+	}
+	if maxInFlight := s.capMaxInFlight(sr.MaxInFlight); maxInFlight != sr.MaxInFlight {
+		s.log.Debugf("STAN: [Client:%s] MaxInFlight %v in subscription request capped to %v.",
+			sr.ClientID, sr.MaxInFlight, maxInFlight)
+		sr.MaxInFlight = maxInFlight
+	}
+
+	// Replay rates, if set, must be positive.
+	if err := validateReplayRates(sr); err != nil {
+		s.log.Debugf("STAN: [Client:%s] Invalid replay rate in subscription request from %s.",
+			sr.ClientID, reqSubject)
+		return err
+	}
+
+	// The filter, if any, must be valid. Queue subscriptions can't be
+	// filtered.
+	if f, err := parseFilter(sr.Filter); err != nil {
+		s.log.Debugf("STAN: [Client:%s] Invalid filter in subscription request from %s: %v",
+			sr.ClientID, reqSubject, err)
+		return ErrInvalidFilter
+	} else if f != nil && sr.QGroup != "" {
+		s.log.Debugf("STAN: [Client:%s] Filtered queue subscription request from %s.",
+			sr.ClientID, reqSubject)
+		return ErrFilteredQueueSub
+	}
+
+	// Make sure subject is valid. A subject with wildcards subscribes to
+	// all the matching channels.
+	if !isWildcardSubject(sr.Subject) && !isValidSubject(sr.Subject) {
+		s.log.Debugf("STAN: [Client:%s] Invalid subject <%s> in subscription request from %s.",
+			sr.ClientID, sr.Subject, reqSubject)
+		return ErrInvalidSubject
 	}
 
 	// ClientID must not be empty.
 	if sr.ClientID == "" {
-		Debugf("STAN: missing clientID in subscription request from %s", m.Subject)
-		s.sendSubscriptionResponseErr(m.Reply,
-			errors.New("stan: malformed subscription request, clientID missing"))
-		return
+		s.log.Debugf("STAN: missing clientID in subscription request from %s", reqSubject)
+		return ErrMissingClientID
+	}
+
+	// An archive reader only replays stored messages.
+	if s.opts.ArchiveReader && !isArchiveReplay(sr) {
+		s.log.Debugf("STAN: [Client:%s] Subscription request rejected: %v", sr.ClientID, ErrArchiveReplayOnly)
+		return ErrArchiveReplayOnly
+	}
+
+	if err := s.checkMaxSubsPerClient(sr.ClientID); err != nil {
+		s.log.Debugf("STAN: [Client:%s] Subscription request rejected: %v", sr.ClientID, err)
+		return err
+	}
+	return nil
+}
+
+// createSubscription creates the subscription, or resumes the durable, of
+// a validated request on a channel without wildcards. The subscription
+// does not receive its acks yet, see subscribeToAcks.
+func (s *StanServer) createSubscription(reqSubject string, sr *spb.SubscriptionRequest, t *reqTimer) (*stores.ChannelStore, *subState, error) {
+	// A single subscription receives the messages of an exclusive channel.
+	if sr.QGroup != "" && isExclusiveChannel(s.opts.ExclusiveChannels, sr.Subject) {
+		s.log.Debugf("STAN: [Client:%s] Subscription request rejected: %v", sr.ClientID, ErrExclusiveQueueSub)
+		return nil, nil, ErrExclusiveQueueSub
 	}
 
+	// The members of a durable queue group share the group named after
+	// the durable.
+	if sr.DurableName != "" && sr.QGroup != "" {
+		sr.QGroup = durableQueueName(sr)
+	}
+
+	if err := s.authorize(sr.ClientID, sr.Subject, OpSubscribe); err != nil {
+		return nil, nil, err
+	}
+	if err := s.checkChannelUse(sr.ClientID, sr.Subject); err != nil {
+		s.log.Debugf("STAN: [Client:%s] Subscription request rejected: %v", sr.ClientID, err)
+		return nil, nil, err
+	}
+
+	if err := s.checkSubRate(sr.ClientID); err != nil {
+		s.log.Debugf("STAN: [Client:%s] Subscription request rejected: %v", sr.ClientID, err)
+		return nil, nil, err
+	}
+
+	t.stage("validate")
+
 	// Grab channel state, create a new one if needed.
 	cs, err := s.lookupOrCreateChannel(sr.Subject)
 	if err != nil {
-		Errorf("STAN: Unable to create store for subject %s.", sr.Subject)
-		s.sendSubscriptionResponseErr(m.Reply, err)
-		return
+		s.log.Errorf("STAN: Unable to create store for subject %s.", sr.Subject)
+		return nil, nil, err
 	}
 	// Get the subStore
 	ss := cs.UserData.(*subStore)
 
+	// Queue groups deliver messages according to their policy.
+	queuePolicy := ""
+	if sr.QGroup != "" {
+		if queuePolicy, err = s.queuePolicy(ss, sr); err != nil {
+			s.log.Debugf("STAN: [Client:%s] Invalid queue policy in subscription request from %s: %v",
+				sr.ClientID, reqSubject, err)
+			return nil, nil, err
+		}
+	}
+
+	// The messages are published on the inbox.
+	if !isValidInbox(sr.Inbox) {
+		s.log.Debugf("STAN: [Client:%s] Invalid inbox <%s> in subscription request from %s.",
+			sr.ClientID, sr.Inbox, reqSubject)
+		return nil, nil, ErrInvalidSubReq
+	}
+
 	var sub *subState
 
 	ackInbox := nats.NewInbox()
 
 	// Check for DurableSubscriber status
-	if sr.DurableName != "" {
-		// Can't be durable and a queue subscriber
-		if sr.QGroup != "" {
-			Debugf("STAN: [Client:%s] Invalid subscription request; cannot be both durable and a queue subscriber.",
-				sr.ClientID)
-			s.sendSubscriptionResponseErr(m.Reply, ErrDurableQueue)
-			return
-		}
-
+	if sr.DurableName != "" && sr.QGroup == "" {
 		if sub = ss.LookupByDurable(durableKey(sr)); sub != nil {
 			sub.RLock()
 			clientID := sub.ClientID
 			sub.RUnlock()
 			if clientID != "" {
-				Debugf("STAN: [Client:%s] Invalid client id in subscription request from %s.",
-					sr.ClientID, m.Subject)
-				s.sendSubscriptionResponseErr(m.Reply, ErrDupDurable)
-				return
+				s.log.Debugf("STAN: [Client:%s] Invalid client id in subscription request from %s.",
+					sr.ClientID, reqSubject)
+				return nil, nil, ErrDupDurable
 			}
 			// ok we have a remembered subscription
-			// FIXME(dlc) - Do we error on options? They should be ignored if the new conflicts with old.
-			sub.Lock()
-			// Set ClientID and new AckInbox but leave LastSent to the
-			// remembered value.
-			sub.AckInbox = ackInbox
-			sub.ClientID = sr.ClientID
-			sub.Inbox = sr.Inbox
-			sub.stalled = false
-			sub.Unlock()
+			sub.resume(sr, ackInbox)
 		}
 	}
 
+	// Out of range start sequences and times are clamped to the stored
+	// messages if the server is configured so, and rejected otherwise.
+	startAdjusted := s.opts.ClampStartPosition && s.clampStartPosition(cs, sr)
+	if startAdjusted {
+		s.log.Debugf("STAN: [Client:%s] Start position of subscription on %s adjusted to %v, seq=%d.",
+			sr.ClientID, sr.Subject, sr.StartPosition, sr.StartSequence)
+	}
+
 	// Check SequenceStart out of range
-	if sr.StartPosition == pb.StartPosition_SequenceStart {
+	if sr.StartPosition == spb.StartPosition_SequenceStart {
 		if !s.startSequenceValid(cs, sr.Subject, sr.StartSequence) {
-			Debugf("STAN: [Client:%s] Invalid start sequence in subscription request from %s.",
-				sr.ClientID, m.Subject)
-			s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSequence)
-			return
+			s.log.Debugf("STAN: [Client:%s] Invalid start sequence in subscription request from %s.",
+				sr.ClientID, reqSubject)
+			return nil, nil, ErrInvalidSequence
 		}
 	}
 	// Check for SequenceTime out of range
-	if sr.StartPosition == pb.StartPosition_TimeDeltaStart {
-		startTime := time.Now().UnixNano() - sr.StartTimeDelta
+	if sr.StartPosition == spb.StartPosition_TimeDeltaStart {
+		startTime := s.clock.Now().UnixNano() - sr.StartTimeDelta
 		if !s.startTimeValid(cs, sr.Subject, startTime) {
-			Debugf("STAN: [Client:%s] Invalid start time in subscription request from %s.",
-				sr.ClientID, m.Subject)
-			s.sendSubscriptionResponseErr(m.Reply, ErrInvalidTime)
-			return
+			s.log.Debugf("STAN: [Client:%s] Invalid start time in subscription request from %s.",
+				sr.ClientID, reqSubject)
+			return nil, nil, ErrInvalidTime
+		}
+	}
+	// Check that the message with the start GUID is stored
+	if sr.StartPosition == spb.StartPosition_ByGUID {
+		if sr.StartGUID == "" || cs.Msgs.GetSequenceFromGUID(sr.StartGUID) == 0 {
+			s.log.Debugf("STAN: [Client:%s] Unknown start GUID in subscription request from %s.",
+				sr.ClientID, reqSubject)
+			return nil, nil, ErrUnknownStartGUID
+		}
+	}
+
+	// A member joining a durable queue group whose members all left
+	// resumes the state of the group.
+	if sr.DurableName != "" && sr.QGroup != "" {
+		if sub = ss.takeDurableQueueShadow(sr.QGroup); sub != nil {
+			sub.resume(sr, ackInbox)
 		}
 	}
 
@@ -2145,52 +3654,80 @@ func (s *StanServer) processSubscriptionRequest(m *nats.Msg) {
 	if sub == nil {
 		sub = &subState{
 			SubState: spb.SubState{
-				ClientID:      sr.ClientID,
-				QGroup:        sr.QGroup,
-				Inbox:         sr.Inbox,
-				AckInbox:      ackInbox,
-				MaxInFlight:   sr.MaxInFlight,
-				AckWaitInSecs: sr.AckWaitInSecs,
-				DurableName:   sr.DurableName,
+				ClientID:        sr.ClientID,
+				QGroup:          sr.QGroup,
+				Inbox:           sr.Inbox,
+				AckInbox:        ackInbox,
+				MaxInFlight:     sr.MaxInFlight,
+				AckWaitInSecs:   sr.AckWaitInSecs,
+				DurableName:     sr.DurableName,
+				QueuePolicy:     queuePolicy,
+				MaxRedeliveries: sr.MaxRedeliveries,
 			},
 			subject:     sr.Subject,
 			ackWait:     time.Duration(sr.AckWaitInSecs) * time.Second,
-			acksPending: make(map[uint64]*pb.MsgProto),
+			acksPending: make(map[uint64]*spb.MsgProto),
 			store:       cs.Subs,
+			window:      s.newDeliveryWindow(sr.MaxInFlight),
+			replay:      newReplayLimits(sr),
+			filter:      newMsgFilter(sr),
 		}
 
-		// set the start sequence of the subscriber.
-		s.setSubStartSequence(cs, sub, sr)
+		if !ss.hasRoomForSub(cs.Subs) {
+			// The store has room, but not for the subscriptions
+			// that have not been written to it yet.
+			err = stores.ErrTooManySubs
+		} else {
+			if isLazySubRequest(cs, sr) {
+				// The subscription starts with the channel's first message,
+				// and is written to the store when this message is sent.
+				sub.lazy = &s.lazySubs
+			} else {
+				// set the start sequence of the subscriber.
+				s.setSubStartSequence(cs, sub, sr)
+			}
 
-		// add the subscription to stan
-		err = s.addSubscription(ss, sub)
+			// add the subscription to stan
+			if err = s.addSubscription(ss, sub); err == nil && sub.lazy != nil {
+				s.lazySubs.add(sub, ss)
+			}
+		}
 	} else {
 		// Case of restarted durable subscriber
 		err = s.updateDurable(cs, ss, sub)
 	}
 	if err != nil {
-		Errorf("STAN: Unable to add subscription for %s: %v", sr.Subject, err)
-		s.sendSubscriptionResponseErr(m.Reply, err)
-		return
+		s.log.Errorf("STAN: Unable to add subscription for %s: %v", sr.Subject, err)
+		return nil, nil, err
 	}
-	Debugf("STAN: [Client:%s] Added subscription on subject=%s, inbox=%s",
+	s.log.Debugf("STAN: [Client:%s] Added subscription on subject=%s, inbox=%s",
 		sr.ClientID, sr.Subject, sr.Inbox)
+	t.stage("store")
 
+	sub.Lock()
+	sub.clamped = startAdjusted
+	sub.Unlock()
+
+	return cs, sub, nil
+}
+
+// subscribeToAcks starts receiving the acks of the subscription.
+func (s *StanServer) subscribeToAcks(sub *subState) {
 	// In case this is a durable, sub already exists so we need to protect access
 	sub.Lock()
 	// Subscribe to acks
-	sub.ackSub, err = s.nc.Subscribe(ackInbox, s.processAckMsg)
+	var err error
+	sub.ackSub, err = s.nc.Subscribe(sub.AckInbox, s.processAckMsg)
 	if err != nil {
 		sub.Unlock()
 		panic(fmt.Sprintf("Could not subscribe to ack subject, %v\n", err))
 	}
 	sub.Unlock()
+}
 
-	// Create a non-error response
-	resp := &pb.SubscriptionResponse{AckInbox: ackInbox}
-	b, _ := resp.Marshal()
-	s.nc.Publish(m.Reply, b)
-
+// sendInitialMessages sends the messages available to a subscription
+// created from the request, once it was acknowledged to the client.
+func (s *StanServer) sendInitialMessages(cs *stores.ChannelStore, sub *subState, sr *spb.SubscriptionRequest) {
 	// If we are a durable and have state
 	if sr.DurableName != "" {
 		// Redeliver any oustanding.
@@ -2207,19 +3744,31 @@ func (s *StanServer) processSubscriptionRequest(m *nats.Msg) {
 	} else {
 		s.sendAvailableMessages(cs, sub)
 	}
-
 }
 
 // processAckMsg processes inbound acks from clients for delivered messages.
 func (s *StanServer) processAckMsg(m *nats.Msg) {
+	// Once a failover drill demotes the server, acks are dropped so that
+	// the pending acks handed over are those of the store.
+	s.ftDrill.RLock()
+	defer s.ftDrill.RUnlock()
+	if s.ftDrill.demoting {
+		return
+	}
 	ack := &pb.Ack{}
 	ack.Unmarshal(m.Data)
 	cs := s.store.LookupChannel(ack.Subject)
 	if cs == nil {
-		Errorf("STAN: [Client:?] Ack received, invalid channel (%s)", ack.Subject)
+		s.log.Errorf("STAN: [Client:?] Ack received, invalid channel (%s)", ack.Subject)
 		return
 	}
-	s.processAck(cs, cs.UserData.(*subStore).LookupByAckInbox(m.Subject), ack.Sequence)
+	sub := cs.UserData.(*subStore).LookupByAckInbox(m.Subject)
+	s.processAck(cs, sub, ack.Sequence)
+	// The count of a queue group is kept when the message is moved to
+	// another member, which implicitly acks it, so clear it here.
+	if sub != nil && s.maxRedeliveries(sub) > 0 {
+		clearRedeliveries(sub, ack.Sequence)
+	}
 }
 
 // processAck processes an ack and if needed sends more messages.
@@ -2231,21 +3780,39 @@ func (s *StanServer) processAck(cs *stores.ChannelStore, sub *subState, sequence
 	sub.Lock()
 
 	if s.trace {
-		Tracef("STAN: [Client:%s] removing pending ack, subj=%s, seq=%d",
-			sub.ClientID, sub.subject, sequence)
+		s.log.traceFields("STAN: Removing pending ack", Field{"client", sub.ClientID},
+			Field{"channel", sub.subject}, Field{"seq", sequence})
 	}
 
 	if err := sub.store.AckSeqPending(sub.ID, sequence); err != nil {
-		Errorf("STAN: [Client:%s] Unable to persist ack for %s:%v (%v)",
+		s.log.Errorf("STAN: [Client:%s] Unable to persist ack for %s:%v (%v)",
 			sub.ClientID, sub.subject, sequence, err)
 		sub.Unlock()
 		return
 	}
 
 	delete(sub.acksPending, sequence)
+	delete(sub.claims, sequence)
+	delete(sub.rdlvs, sequence)
+	delete(sub.rejected, sequence)
+	// The subscriber acks messages again, end the redelivery backoff.
+	if sub.baseAckWait != 0 {
+		sub.ackWait = sub.baseAckWait
+		sub.baseAckWait = 0
+	}
+	if sub.window != nil || sub.ackLatency != nil {
+		now := s.clock.Now().UnixNano()
+		if sub.window != nil {
+			sub.window.onAck(sequence, now, sub.ackWait, sub.MaxInFlight)
+		}
+		if sub.ackLatency != nil {
+			sub.ackLatency.onAck(sequence, now)
+		}
+	}
 	stalled := sub.stalled
-	if int32(len(sub.acksPending)) < sub.MaxInFlight {
+	if int32(len(sub.acksPending)) < sub.maxInFlight() {
 		sub.stalled = false
+		sub.fullSince = 0
 	}
 
 	// Leave the reset/cancel of the ackTimer to the redelivery cb.
@@ -2273,13 +3840,25 @@ func (s *StanServer) processAck(cs *stores.ChannelStore, sub *subState, sequence
 
 // Send any messages that are ready to be sent that have been queued to the group.
 func (s *StanServer) sendAvailableMessagesToQueue(cs *stores.ChannelStore, qs *queueState) {
+	s.sendAvailableMessagesToQueueUpTo(cs, qs, 0)
+}
+
+// Send at most `max` messages (no limit if 0) that are ready to be sent to
+// the group. Returns true if the limit was reached.
+func (s *StanServer) sendAvailableMessagesToQueueUpTo(cs *stores.ChannelStore, qs *queueState, max int) bool {
 	if cs == nil || qs == nil {
-		return
+		return false
 	}
 
+	limitReached := false
 	qs.Lock()
-	for nextSeq := qs.lastSent + 1; ; nextSeq++ {
-		nextMsg := cs.Msgs.Lookup(nextSeq)
+	msgs := cs.Msgs.LookupRange(qs.lastSent+1, cs.Msgs.LastSequence())
+	for count := 0; ; count++ {
+		if max > 0 && count == max {
+			limitReached = true
+			break
+		}
+		nextMsg := msgs.Next()
 		if nextMsg == nil {
 			break
 		}
@@ -2288,21 +3867,42 @@ func (s *StanServer) sendAvailableMessagesToQueue(cs *stores.ChannelStore, qs *q
 		}
 	}
 	qs.Unlock()
+	return limitReached
 }
 
 // Send any messages that are ready to be sent that have been queued.
 func (s *StanServer) sendAvailableMessages(cs *stores.ChannelStore, sub *subState) {
+	s.sendAvailableMessagesUpTo(cs, sub, 0)
+}
+
+// Send at most `max` messages (no limit if 0) that are ready to be sent.
+// Returns true if the limit was reached.
+func (s *StanServer) sendAvailableMessagesUpTo(cs *stores.ChannelStore, sub *subState, max int) bool {
+	limitReached := false
 	sub.Lock()
-	for nextSeq := sub.LastSent + 1; ; nextSeq++ {
-		nextMsg := cs.Msgs.Lookup(nextSeq)
+	msgs := cs.Msgs.LookupRange(sub.LastSent+1, cs.Msgs.LastSequence())
+	for count := 0; ; count++ {
+		if max > 0 && count == max {
+			limitReached = true
+			break
+		}
+		nextMsg := msgs.Next()
 		if nextMsg == nil {
 			break
 		}
+		if !sub.filter.match(nextMsg) {
+			sub.skipFiltered(nextMsg)
+			continue
+		}
+		if !s.canReplay(cs, sub, nextMsg) {
+			break
+		}
 		if sent, sendMore := s.sendMsgToSub(sub, nextMsg, honorMaxInFlight); !sent || !sendMore {
 			break
 		}
 	}
 	sub.Unlock()
+	return limitReached
 }
 
 // Check if a startTime is valid.
@@ -2319,6 +3919,41 @@ func (s *StanServer) startTimeValid(cs *stores.ChannelStore, subject string, sta
 	return true
 }
 
+// clampStartPosition changes the start sequence or time of the subscription
+// request, if out of the range of the stored messages, so that the
+// subscription starts with the first or last message, or with the next one
+// if there is none. Returns true if the request was changed.
+func (s *StanServer) clampStartPosition(cs *stores.ChannelStore, sr *spb.SubscriptionRequest) bool {
+	first, last := cs.Msgs.FirstAndLastSequence()
+	start := last
+	switch sr.StartPosition {
+	case spb.StartPosition_SequenceStart:
+		if s.startSequenceValid(cs, sr.Subject, sr.StartSequence) {
+			return false
+		}
+		if sr.StartSequence < first {
+			start = first
+		}
+	case spb.StartPosition_TimeDeltaStart:
+		startTime := s.clock.Now().UnixNano() - sr.StartTimeDelta
+		if s.startTimeValid(cs, sr.Subject, startTime) {
+			return false
+		}
+		if firstMsg := cs.Msgs.FirstMsg(); firstMsg != nil && startTime < firstMsg.Timestamp {
+			start = first
+		}
+	default:
+		return false
+	}
+	if first == 0 || first > last {
+		sr.StartPosition = spb.StartPosition_NewOnly
+	} else {
+		sr.StartPosition = spb.StartPosition_SequenceStart
+		sr.StartSequence = start
+	}
+	return true
+}
+
 // Check if a startSequence is valid.
 func (s *StanServer) startSequenceValid(cs *stores.ChannelStore, subject string, seq uint64) bool {
 	first, last := cs.Msgs.FirstAndLastSequence()
@@ -2333,7 +3968,7 @@ func (s *StanServer) getSequenceFromStartTime(cs *stores.ChannelStore, startTime
 }
 
 // Setup the start position for the subscriber.
-func (s *StanServer) setSubStartSequence(cs *stores.ChannelStore, sub *subState, sr *pb.SubscriptionRequest) {
+func (s *StanServer) setSubStartSequence(cs *stores.ChannelStore, sub *subState, sr *spb.SubscriptionRequest) {
 	sub.Lock()
 
 	lastSent := uint64(0)
@@ -2342,37 +3977,45 @@ func (s *StanServer) setSubStartSequence(cs *stores.ChannelStore, sub *subState,
 	// lastSent stays at 0.
 
 	switch sr.StartPosition {
-	case pb.StartPosition_NewOnly:
+	case spb.StartPosition_NewOnly:
 		lastSent = cs.Msgs.LastSequence()
-		Debugf("STAN: [Client:%s] Sending new-only subject=%s, seq=%d.",
+		s.log.Debugf("STAN: [Client:%s] Sending new-only subject=%s, seq=%d.",
 			sub.ClientID, sub.subject, lastSent)
-	case pb.StartPosition_LastReceived:
+	case spb.StartPosition_LastReceived:
 		lastSeq := cs.Msgs.LastSequence()
 		if lastSeq > 0 {
 			lastSent = lastSeq - 1
 		}
-		Debugf("STAN: [Client:%s] Sending last message, subject=%s.",
+		s.log.Debugf("STAN: [Client:%s] Sending last message, subject=%s.",
 			sub.ClientID, sub.subject)
-	case pb.StartPosition_TimeDeltaStart:
-		startTime := time.Now().UnixNano() - sr.StartTimeDelta
+	case spb.StartPosition_TimeDeltaStart:
+		startTime := s.clock.Now().UnixNano() - sr.StartTimeDelta
 		seq := s.getSequenceFromStartTime(cs, startTime)
 		if seq > 0 {
 			lastSent = seq - 1
 		}
-		Debugf("STAN: [Client:%s] Sending from time, subject=%s time=%d seq=%d",
+		s.log.Debugf("STAN: [Client:%s] Sending from time, subject=%s time=%d seq=%d",
 			sub.ClientID, sub.subject, startTime, lastSent)
-	case pb.StartPosition_SequenceStart:
+	case spb.StartPosition_SequenceStart:
 		if sr.StartSequence > 0 {
 			lastSent = sr.StartSequence - 1
 		}
-		Debugf("STAN: [Client:%s] Sending from sequence, subject=%s seq=%d",
+		s.log.Debugf("STAN: [Client:%s] Sending from sequence, subject=%s seq=%d",
 			sub.ClientID, sub.subject, lastSent)
-	case pb.StartPosition_First:
+	case spb.StartPosition_ByGUID:
+		// If the message was removed in the meantime, start from the
+		// first message.
+		if seq := cs.Msgs.GetSequenceFromGUID(sr.StartGUID); seq > 0 {
+			lastSent = seq - 1
+		}
+		s.log.Debugf("STAN: [Client:%s] Sending from GUID, subject=%s guid=%s seq=%d",
+			sub.ClientID, sub.subject, sr.StartGUID, lastSent)
+	case spb.StartPosition_First:
 		firstSeq := cs.Msgs.FirstSequence()
 		if firstSeq > 0 {
 			lastSent = firstSeq - 1
 		}
-		Debugf("STAN: [Client:%s] Sending from beginning, subject=%s seq=%d",
+		s.log.Debugf("STAN: [Client:%s] Sending from beginning, subject=%s seq=%d",
 			sub.ClientID, sub.subject, lastSent)
 	}
 	sub.LastSent = lastSent
@@ -2384,9 +4027,24 @@ func (s *StanServer) ClusterID() string {
 	return s.info.ClusterID
 }
 
+// ClientURL returns the URL clients should use to connect to this server.
+// When the NATS Server is embedded, this is the address it listens on,
+// which is useful when it is started with a random port, or the address of
+// the proxy with Options.Handoff. Otherwise, this is the URL of the NATS
+// Server the STAN Server is connected to.
+func (s *StanServer) ClientURL() string {
+	if s.natsProxy != nil {
+		return fmt.Sprintf("nats://%s", s.natsProxy.addr())
+	}
+	if s.natsServer != nil {
+		return fmt.Sprintf("nats://%s", s.natsServer.GetListenEndpoint())
+	}
+	return s.nc.ConnectedUrl()
+}
+
 // Shutdown will close our NATS connection and shutdown any embedded NATS server.
 func (s *StanServer) Shutdown() {
-	Debugf("STAN: Shutting down.")
+	s.log.Debugf("STAN: Shutting down.")
 
 	s.Lock()
 	if s.shutdown {
@@ -2397,6 +4055,54 @@ func (s *StanServer) Shutdown() {
 	// Allows Shutdown() to be idempotent
 	s.shutdown = true
 
+	// A standby server may be activating, wait for it to be done
+	// before closing anything.
+	if s.ftQuit != nil {
+		close(s.ftQuit)
+		s.Unlock()
+		s.ftWG.Wait()
+		s.Lock()
+	}
+
+	// The canary, webhooks and shovels need the server to close their connection.
+	if c := s.canary; c != nil {
+		s.Unlock()
+		c.stop()
+		s.Lock()
+	}
+	if wh := s.webhooks; wh != nil {
+		s.Unlock()
+		wh.stop()
+		s.Lock()
+	}
+	if sh := s.shovels; sh != nil {
+		s.Unlock()
+		sh.stop()
+		s.Lock()
+	}
+
+	if s.infoListener != nil {
+		s.infoListener.Close()
+	}
+
+	// Channels must not be deleted once the store is closed.
+	if s.inactivityQuit != nil {
+		close(s.inactivityQuit)
+		s.Unlock()
+		s.inactivityWG.Wait()
+		s.Lock()
+	}
+	if wd := s.watchdog; wd != nil {
+		s.Unlock()
+		wd.stop()
+		s.Lock()
+	}
+	if sc := s.slowConsumers; sc != nil {
+		s.Unlock()
+		sc.stop()
+		s.Lock()
+	}
+
 	// We need to make sure that the storeIOLoop returns before
 	// closing the Store
 	waitForIOStoreLoop := true
@@ -2404,9 +4110,11 @@ func (s *StanServer) Shutdown() {
 	// Capture under lock
 	store := s.store
 	ns := s.natsServer
+	np := s.natsProxy
 	// Do not set s.nc to nil since it is used in many place without locking.
 	// Once closed, s.nc.xxx() calls will simply fail, but we won't panic.
 	nc := s.nc
+	ftLock := s.ftLock
 	if s.ioChannel != nil {
 		// Notify the IO channel that we are shutting down
 		s.ioChannelQuit <- true
@@ -2424,14 +4132,31 @@ func (s *StanServer) Shutdown() {
 	// directly (instead of calling RunServer() and the like), these should
 	// not be nil.
 	if store != nil {
+		for _, cs := range store.GetChannels() {
+			if p := cs.UserData.(*subStore).deliveryPool; p != nil {
+				p.stop()
+			}
+		}
+		// Subscriptions created lazily are recovered after a restart.
+		s.persistLazySubs()
 		store.Close()
 	}
+	// Release the store to the other servers of the group only once closed.
+	if ftLock != nil {
+		ftLock.Close()
+	}
 	if nc != nil {
 		nc.Close()
 	}
+	if np != nil {
+		np.close()
+	}
 	if ns != nil {
 		ns.Shutdown()
 	}
+	if s.slowLog != nil {
+		s.slowLog.close()
+	}
 
 	// Wait for go-routines to return
 	s.wg.Wait()
@@ -0,0 +1,109 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+// ServerInfo describes the build and configuration of a running server,
+// so that orchestration tooling can check it is talking to the expected
+// server. It is returned by StanServer.Info, and served as JSON over HTTP
+// on Options.InfoListen.
+type ServerInfo struct {
+	ClusterID     string           `json:"cluster_id"`
+	ServerID      string           `json:"server_id"`
+	Version       string           `json:"version"`
+	GoVersion     string           `json:"go"`
+	Capabilities  []string         `json:"capabilities"`
+	StoreType     string           `json:"store_type"`
+	StoreVersion  int              `json:"store_version,omitempty"` // Version of the files of the FILE store
+	Limits        ServerInfoLimits `json:"limits"`
+	HBInterval    string           `json:"hb_interval"`
+	HBMaxInterval string           `json:"hb_max_interval,omitempty"`
+	Start         time.Time        `json:"start"`
+	Role          string           `json:"role"` // One of STANDALONE, FT_ACTIVE or FT_STANDBY
+	FTGroup       string           `json:"ft_group,omitempty"`
+	ArchiveReader bool             `json:"archive_reader,omitempty"`
+}
+
+// ServerInfoLimits are the channel limits listed in ServerInfo.
+type ServerInfoLimits struct {
+	MaxChannels      int    `json:"max_channels"`
+	MaxMsgs          int    `json:"max_msgs"`
+	MaxBytes         uint64 `json:"max_bytes"`
+	MaxSubscriptions int    `json:"max_subscriptions"`
+	MaxInactivity    string `json:"max_inactivity,omitempty"`
+	MaxClients       int    `json:"max_clients,omitempty"`
+	MaxSubsPerClient int    `json:"max_subs_per_client,omitempty"`
+}
+
+// Info returns the description of the server's build and configuration.
+func (s *StanServer) Info() *ServerInfo {
+	opts := s.opts
+	limits := getChannelLimits(opts)
+	s.RLock()
+	clusterID := s.info.ClusterID
+	hbInterval := s.hbInterval
+	state := s.state
+	s.RUnlock()
+	// A standby server has not read the cluster ID from the store yet.
+	if clusterID == "" {
+		clusterID = opts.ID
+	}
+	info := &ServerInfo{
+		ClusterID:    clusterID,
+		ServerID:     s.serverID,
+		Version:      VERSION,
+		GoVersion:    runtime.Version(),
+		Capabilities: s.capabilities(),
+		StoreType:    strings.ToUpper(opts.StoreType),
+		Limits: ServerInfoLimits{
+			MaxChannels:      limits.MaxChannels,
+			MaxMsgs:          limits.MaxNumMsgs,
+			MaxBytes:         limits.MaxMsgBytes,
+			MaxSubscriptions: limits.MaxSubs,
+			MaxClients:       opts.MaxClients,
+			MaxSubsPerClient: opts.MaxSubsPerClient,
+		},
+		HBInterval:    hbInterval.String(),
+		Start:         s.startTime,
+		Role:          state.String(),
+		FTGroup:       opts.FTGroupName,
+		ArchiveReader: opts.ArchiveReader,
+	}
+	if info.StoreType == stores.TypeFile {
+		info.StoreVersion = stores.FileVersion
+	}
+	if limits.MaxInactivity > 0 {
+		info.Limits.MaxInactivity = limits.MaxInactivity.String()
+	}
+	if opts.ClientHBMaxInterval > 0 {
+		info.HBMaxInterval = opts.ClientHBMaxInterval.String()
+	}
+	return info
+}
+
+// logBanner logs the server info once the server is started.
+func (s *StanServer) logBanner() {
+	info := s.Info()
+	s.log.Noticef("STAN: Server ID %s, version %s (%s), protocol capabilities: %s",
+		info.ServerID, info.Version, info.GoVersion, strings.Join(info.Capabilities, ", "))
+	store := info.StoreType
+	if info.StoreVersion > 0 {
+		store = fmt.Sprintf("%s v%d", store, info.StoreVersion)
+	}
+	role := info.Role
+	if info.FTGroup != "" {
+		role = fmt.Sprintf("%s (group %q)", role, info.FTGroup)
+	}
+	if info.ArchiveReader {
+		role += ", archive reader"
+	}
+	s.log.Noticef("STAN: Store %s, role %s, started at %s", store, role, info.Start.Format(time.RFC3339))
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+
+	natsdTest "github.com/nats-io/gnatsd/test"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+func TestServerInfo(t *testing.T) {
+	before := time.Now()
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.MaxMsgs = 10
+	opts.MaxInactivity = time.Hour
+	opts.MaxRedeliveries = 3
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	info := s.Info()
+	if info.ClusterID != clusterName || info.ServerID != s.serverID {
+		t.Fatalf("Unexpected IDs: %+v", info)
+	}
+	if info.Version != VERSION || info.GoVersion != runtime.Version() {
+		t.Fatalf("Unexpected versions: %+v", info)
+	}
+	if info.StoreType != stores.TypeMemory || info.StoreVersion != 0 {
+		t.Fatalf("Unexpected store: %v %v", info.StoreType, info.StoreVersion)
+	}
+	if info.Role != Standalone.String() || info.FTGroup != "" || info.ArchiveReader {
+		t.Fatalf("Unexpected role: %+v", info)
+	}
+	if info.Start.Before(before) || info.Start.After(time.Now()) {
+		t.Fatalf("Unexpected start time: %v", info.Start)
+	}
+	if info.Limits.MaxMsgs != 10 || info.Limits.MaxInactivity != "1h0m0s" {
+		t.Fatalf("Unexpected limits: %+v", info.Limits)
+	}
+	if info.HBInterval != DefaultHeartBeatInterval.String() || info.HBMaxInterval != "" {
+		t.Fatalf("Unexpected heartbeat interval: %v - %v", info.HBInterval, info.HBMaxInterval)
+	}
+	checkCapabilities(t, &BootstrapInfo{Capabilities: info.Capabilities},
+		CapSubClose, CapFlush, CapClaim, CapPause, CapSubBatch, CapErrorCodes, CapPing, CapDeadLetter)
+}
+
+func TestServerInfoFileStoreAndFT(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	ns := natsdTest.RunServer(nil)
+	defer ns.Shutdown()
+
+	opts := getTestFTOptions()
+	opts.FTFailoverWindow = time.Hour
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	info := s.Info()
+	if info.StoreType != stores.TypeFile || info.StoreVersion != stores.FileVersion {
+		t.Fatalf("Unexpected store: %v %v", info.StoreType, info.StoreVersion)
+	}
+	if info.Role != FTStandby.String() || info.FTGroup != "ft" {
+		t.Fatalf("Unexpected role: %v %v", info.Role, info.FTGroup)
+	}
+	// The cluster ID of a standby server comes from the options.
+	if info.ClusterID != opts.ID {
+		t.Fatalf("Unexpected cluster ID: %v", info.ClusterID)
+	}
+}
+
+func TestServerInfoHTTP(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.InfoListen = "127.0.0.1:0"
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", s.infoListener.Addr(), ServerInfoPath))
+	if err != nil {
+		t.Fatalf("Unexpected error on get: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Unexpected content type: %v", ct)
+	}
+	info := &ServerInfo{}
+	if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+		t.Fatalf("Unexpected error on decode: %v", err)
+	}
+	if info.ClusterID != clusterName || info.ServerID != s.serverID || info.Role != Standalone.String() {
+		t.Fatalf("Unexpected info: %+v", info)
+	}
+	if !info.Start.Equal(s.startTime) {
+		t.Fatalf("Expected start time %v, got %v", s.startTime, info.Start)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+// Periods of the segments of sharded channels.
+const (
+	ShardDaily   = stores.SliceDaily
+	ShardWeekly  = stores.SliceWeekly
+	ShardMonthly = stores.SliceMonthly
+	ShardYearly  = stores.SliceYearly
+)
+
+// ShardingPolicy splits the matching channels into physical segments, each
+// holding the messages stored during one calendar Period (in UTC).
+// Subscribers still see a single channel, whose sequences continue from one
+// segment to the next. The segments are the message files of the FILE
+// store, which deletes a segment once the channel limits have removed all
+// of its messages.
+type ShardingPolicy struct {
+	Channels string // Channels the policy applies to (a subject, possibly with wildcards)
+	Period   string // Period covered by a segment: day, week, month or year
+}
+
+// validateSharding checks the sharding policies for inconsistencies.
+func validateSharding(opts *Options) error {
+	if len(opts.Sharding) == 0 {
+		return nil
+	}
+	if strings.ToUpper(opts.StoreType) != stores.TypeFile {
+		return fmt.Errorf("sharding is only supported by %v stores", stores.TypeFile)
+	}
+	for _, p := range opts.Sharding {
+		if !util.IsValidSubjectPattern(p.Channels) {
+			return fmt.Errorf("invalid sharding channels %q", p.Channels)
+		}
+		switch strings.ToLower(p.Period) {
+		case ShardDaily, ShardWeekly, ShardMonthly, ShardYearly:
+		default:
+			return fmt.Errorf("invalid period %q of sharding policy %q", p.Period, p.Channels)
+		}
+	}
+	return nil
+}
+
+// shardingSlicePeriods returns the FILE store options implementing the
+// sharding policies, in the same order.
+func shardingSlicePeriods(policies []*ShardingPolicy) []*stores.SlicePeriod {
+	periods := make([]*stores.SlicePeriod, 0, len(policies))
+	for _, p := range policies {
+		periods = append(periods, &stores.SlicePeriod{Channels: p.Channels, Period: p.Period})
+	}
+	return periods
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+func TestValidateSharding(t *testing.T) {
+	opts := GetDefaultOptions()
+	if err := validateSharding(opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cases := []struct {
+		policy ShardingPolicy
+		errTxt string
+	}{
+		{ShardingPolicy{Channels: "foo.>.bar", Period: ShardMonthly}, "invalid sharding channels"},
+		{ShardingPolicy{Channels: "foo.>"}, "invalid period"},
+		{ShardingPolicy{Channels: "foo.>", Period: "fortnight"}, "invalid period"},
+		{ShardingPolicy{Channels: "foo.>", Period: "Month"}, ""},
+		{ShardingPolicy{Channels: "foo.*", Period: ShardDaily}, ""},
+	}
+	opts.StoreType = stores.TypeFile
+	for _, c := range cases {
+		opts.Sharding = []*ShardingPolicy{&c.policy}
+		err := validateSharding(opts)
+		if c.errTxt == "" && err != nil {
+			t.Fatalf("Unexpected error for %v: %v", c.policy, err)
+		} else if c.errTxt != "" && (err == nil || !strings.Contains(err.Error(), c.errTxt)) {
+			t.Fatalf("Expected error containing %q for %v, got %v", c.errTxt, c.policy, err)
+		}
+	}
+	opts.StoreType = stores.TypeMemory
+	if err := validateSharding(opts); err == nil {
+		t.Fatal("Expected error with a memory store")
+	}
+}
+
+func TestSharding(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	clock := util.NewManualClock(time.Date(2016, time.January, 31, 23, 0, 0, 0, time.UTC))
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.Clock = clock
+	opts.StoreType = stores.TypeFile
+	opts.FilestoreDir = defaultDataStore
+	opts.Sharding = []*ShardingPolicy{{Channels: "events.>", Period: ShardMonthly}}
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	publish := func(channel string, count int) {
+		sc := NewDefaultConnection(t)
+		defer sc.Close()
+		for i := 0; i < count; i++ {
+			if err := sc.Publish(channel, []byte("hello")); err != nil {
+				stackFatalf(t, "Unexpected error on publish: %v", err)
+			}
+		}
+	}
+	checkSegments := func(channel string, expected int) {
+		files, _ := filepath.Glob(filepath.Join(defaultDataStore, channel, "msgs.*.dat"))
+		if len(files) != expected {
+			stackFatalf(t, "Expected %v segments for %v, got %v", expected, channel, files)
+		}
+	}
+	publish("events.a", 2)
+	publish("other", 2)
+	// The client is closed, so no heartbeat timer fires.
+	clock.Advance(2 * time.Hour)
+	publish("events.a", 1)
+	publish("other", 1)
+	checkSegments("events.a", 2)
+	checkSegments("other", 1)
+
+	// Subscribers see a single sequence space.
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	ch := make(chan uint64, 3)
+	if _, err := sc.Subscribe("events.a", func(m *stan.Msg) { ch <- m.Sequence },
+		stan.DeliverAllAvailable()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		select {
+		case seq := <-ch:
+			if seq != i {
+				t.Fatalf("Expected sequence %v, got %v", i, seq)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Did not receive message %v", i)
+		}
+	}
+}
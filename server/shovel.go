@@ -0,0 +1,277 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+const (
+	// shovelClientID is the client ID of the connection used by shovels.
+	shovelClientID = "_STAN-shovels"
+
+	// Directions of a shovel.
+	ShovelIn  = "in"  // From the broker's queue to the channel
+	ShovelOut = "out" // From the channel to the broker's queue
+)
+
+// ShovelBroker is a connection to a message broker, such as a RabbitMQ
+// server, used by shovels.
+type ShovelBroker interface {
+	// Consume invokes the handler for each message of the queue, until
+	// Close is called. A message must be acknowledged to the broker only
+	// if the handler returns no error.
+	Consume(queue string, handler func(body []byte) error) error
+	// Publish sends the message to the queue, and returns once the broker
+	// has confirmed it.
+	Publish(queue string, body []byte) error
+	// Close closes the connection.
+	Close() error
+}
+
+// ShovelDialer connects to the broker at the given URL. The broker logs
+// with the given logger, the one of the server.
+type ShovelDialer func(url string, log Logger) (ShovelBroker, error)
+
+var (
+	shovelDialersMu sync.RWMutex
+	shovelDialers   = make(map[string]ShovelDialer)
+)
+
+// RegisterShovelDialer makes a dialer available for the shovel URLs with
+// the given scheme, replacing the one registered for it, if any. The
+// "amqp" and "amqps" schemes are registered by the server.
+func RegisterShovelDialer(scheme string, d ShovelDialer) {
+	shovelDialersMu.Lock()
+	shovelDialers[scheme] = d
+	shovelDialersMu.Unlock()
+}
+
+func lookupShovelDialer(scheme string) ShovelDialer {
+	shovelDialersMu.RLock()
+	defer shovelDialersMu.RUnlock()
+	return shovelDialers[scheme]
+}
+
+// Shovel moves the messages between a channel and a queue of a broker,
+// to ease the migration of applications from AMQP. Outgoing shovels consume
+// the channel through a durable subscription, like webhooks. Incoming
+// shovels publish the messages of the queue to the channel, and let the
+// broker redeliver those that could not be published.
+type Shovel struct {
+	Name       string // Name of the shovel, used as the durable name
+	Direction  string // ShovelIn or ShovelOut
+	Channel    string // Channel of this server
+	URL        string // URL of the broker, whose scheme selects the dialer
+	Queue      string // Queue of the broker
+	MaxRetries int    // Retries after which a message is moved to the dead-letter channel, or returned to the broker (0 for no limit)
+}
+
+// shovels runs all shovels over a single connection.
+type shovels struct {
+	client     *internalClient
+	brokers    []ShovelBroker
+	forwarders map[string]*forwarder
+	inbound    map[string]*inboundShovel
+	quit       chan struct{}
+	wg         sync.WaitGroup
+}
+
+// inboundShovel publishes the messages consumed from the broker.
+type inboundShovel struct {
+	sync.Mutex
+	name       string
+	client     *internalClient
+	channel    string
+	maxRetries int
+	stats      ForwarderStats
+	quit       chan struct{}
+	log        *serverLogger
+}
+
+// validateShovels checks the shovels for inconsistencies.
+func validateShovels(list []*Shovel) error {
+	names := make(map[string]struct{}, len(list))
+	for _, sh := range list {
+		if sh.Name == "" {
+			return fmt.Errorf("shovel name must be specified")
+		}
+		if _, dup := names[sh.Name]; dup {
+			return fmt.Errorf("duplicate shovel %q", sh.Name)
+		}
+		names[sh.Name] = struct{}{}
+		if sh.Direction != ShovelIn && sh.Direction != ShovelOut {
+			return fmt.Errorf("invalid direction %q for shovel %q, must be %q or %q", sh.Direction, sh.Name, ShovelIn, ShovelOut)
+		}
+		if sh.Channel == "" || !isValidSubject(sh.Channel) {
+			return fmt.Errorf("invalid channel %q for shovel %q", sh.Channel, sh.Name)
+		}
+		if sh.Queue == "" {
+			return fmt.Errorf("queue of shovel %q must be specified", sh.Name)
+		}
+		u, err := url.Parse(sh.URL)
+		if err != nil || u.Scheme == "" {
+			return fmt.Errorf("invalid URL %q for shovel %q", sh.URL, sh.Name)
+		}
+		if lookupShovelDialer(u.Scheme) == nil {
+			return fmt.Errorf("no dialer registered for the %q scheme of shovel %q", u.Scheme, sh.Name)
+		}
+		if sh.MaxRetries < 0 {
+			return fmt.Errorf("max retries of shovel %q can't be negative", sh.Name)
+		}
+	}
+	return nil
+}
+
+// startShovels registers the shovels' client, connects to the brokers and
+// starts moving messages.
+func (s *StanServer) startShovels() error {
+	client, err := s.newInternalClient(shovelClientID)
+	if err != nil {
+		return fmt.Errorf("unable to start shovels: %v", err)
+	}
+	sh := &shovels{
+		client:     client,
+		forwarders: make(map[string]*forwarder),
+		inbound:    make(map[string]*inboundShovel),
+		quit:       make(chan struct{}),
+	}
+	for _, cfg := range s.opts.Shovels {
+		if err := sh.start(s, cfg); err != nil {
+			sh.stop()
+			return fmt.Errorf("unable to start shovel %q: %v", cfg.Name, err)
+		}
+	}
+	s.Lock()
+	s.shovels = sh
+	s.Unlock()
+	return nil
+}
+
+func (sh *shovels) start(s *StanServer, cfg *Shovel) error {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return err
+	}
+	dial := lookupShovelDialer(u.Scheme)
+	if dial == nil {
+		return fmt.Errorf("no dialer registered for %q", u.Scheme)
+	}
+	broker, err := dial(cfg.URL, s.log)
+	if err != nil {
+		return err
+	}
+	sh.brokers = append(sh.brokers, broker)
+	name := fmt.Sprintf("Shovel %q", cfg.Name)
+	if cfg.Direction == ShovelOut {
+		queue := cfg.Queue
+		f := &forwarder{
+			name:       name,
+			durable:    cfg.Name,
+			s:          s,
+			client:     sh.client,
+			channel:    cfg.Channel,
+			send:       func(m *spb.MsgProto) error { return broker.Publish(queue, m.Data) },
+			sendWait:   internalRequestTimeout,
+			maxRetries: cfg.MaxRetries,
+			quit:       sh.quit,
+		}
+		if err := f.start(&sh.wg); err != nil {
+			return err
+		}
+		sh.forwarders[cfg.Name] = f
+		return nil
+	}
+	in := &inboundShovel{
+		name:       name,
+		client:     sh.client,
+		channel:    cfg.Channel,
+		maxRetries: cfg.MaxRetries,
+		quit:       sh.quit,
+		log:        s.log,
+	}
+	sh.inbound[cfg.Name] = in
+	sh.wg.Add(1)
+	go func() {
+		defer sh.wg.Done()
+		if err := broker.Consume(cfg.Queue, in.publish); err != nil {
+			select {
+			case <-sh.quit:
+			default:
+				s.log.Errorf("STAN: %s stopped consuming %q: %v", name, cfg.Queue, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// publish publishes the message consumed from the broker to the channel,
+// retrying with a backoff. After maxRetries retries (if not 0), or if the
+// server is shutdown, the error is returned so that the broker keeps the
+// message.
+func (in *inboundShovel) publish(body []byte) error {
+	backoff := forwardMinBackoff
+	for attempt := 0; ; attempt++ {
+		err := in.client.publish(in.channel, body)
+		in.Lock()
+		if err == nil {
+			in.stats.Forwarded++
+		} else {
+			in.stats.Failures++
+		}
+		in.Unlock()
+		if err == nil {
+			return nil
+		}
+		if in.maxRetries > 0 && attempt >= in.maxRetries {
+			in.log.Errorf("STAN: %s failed to publish message to %s after %v retries: %v", in.name, in.channel, attempt, err)
+			return err
+		}
+		in.log.Errorf("STAN: %s failed to publish message to %s, retrying in %v: %v", in.name, in.channel, backoff, err)
+		select {
+		case <-in.quit:
+			return err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > forwardMaxBackoff {
+			backoff = forwardMaxBackoff
+		}
+	}
+}
+
+// ShovelStats returns the counters of the shovel with the given name, and
+// false if there is no such shovel running. The lag is only known for
+// outgoing shovels; the broker reports it for incoming ones.
+func (s *StanServer) ShovelStats(name string) (ForwarderStats, bool) {
+	s.RLock()
+	sh := s.shovels
+	s.RUnlock()
+	if sh == nil {
+		return ForwarderStats{}, false
+	}
+	if f := sh.forwarders[name]; f != nil {
+		return f.Stats(), true
+	}
+	if in := sh.inbound[name]; in != nil {
+		in.Lock()
+		defer in.Unlock()
+		return in.stats, true
+	}
+	return ForwarderStats{}, false
+}
+
+// stop stops moving messages, closes the connections to the brokers and
+// the shovels' connection.
+func (sh *shovels) stop() {
+	close(sh.quit)
+	for _, b := range sh.brokers {
+		b.Close()
+	}
+	sh.wg.Wait()
+	sh.client.close()
+}
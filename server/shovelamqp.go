@@ -0,0 +1,195 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrShovelClosed is returned by the AMQP broker of a shovel once closed.
+var ErrShovelClosed = errors.New("stan: shovel broker closed")
+
+func init() {
+	RegisterShovelDialer("amqp", dialAMQP)
+	RegisterShovelDialer("amqps", dialAMQP)
+}
+
+// amqpBroker is the ShovelBroker for the "amqp" and "amqps" URLs. The
+// connection is dialed again when lost. Messages are published with
+// publisher confirms, and consumed one at a time, so that a message is
+// acknowledged to the broker only once published to the channel.
+type amqpBroker struct {
+	sync.Mutex
+	url      string
+	conn     *amqp.Connection
+	pubCh    *amqp.Channel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	closed   bool
+	quit     chan struct{}
+	log      Logger
+}
+
+func dialAMQP(url string, log Logger) (ShovelBroker, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return &amqpBroker{url: url, conn: conn, quit: make(chan struct{}), log: log}, nil
+}
+
+// connection returns the connection to the broker, dialing it again if it
+// was lost. Assumes lock held.
+func (b *amqpBroker) connection() (*amqp.Connection, error) {
+	if b.closed {
+		return nil, ErrShovelClosed
+	}
+	if b.conn.IsClosed() {
+		conn, err := amqp.Dial(b.url)
+		if err != nil {
+			return nil, err
+		}
+		b.conn, b.pubCh = conn, nil
+	}
+	return b.conn, nil
+}
+
+// Publish implements ShovelBroker. The message is persistent and published
+// as mandatory, so that the broker returns it, instead of dropping it, if
+// the queue does not exist.
+func (b *amqpBroker) Publish(queue string, body []byte) error {
+	b.Lock()
+	defer b.Unlock()
+	if b.pubCh == nil {
+		conn, err := b.connection()
+		if err != nil {
+			return err
+		}
+		ch, err := conn.Channel()
+		if err != nil {
+			return err
+		}
+		if err := ch.Confirm(false); err != nil {
+			ch.Close()
+			return err
+		}
+		b.pubCh = ch
+		b.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+		b.returns = ch.NotifyReturn(make(chan amqp.Return, 1))
+	}
+	err := b.pubCh.Publish("", queue, true, false, amqp.Publishing{
+		DeliveryMode: amqp.Persistent,
+		Body:         body,
+	})
+	if err != nil {
+		b.resetPublishChannel()
+		return err
+	}
+	select {
+	case c, ok := <-b.confirms:
+		if !ok {
+			b.resetPublishChannel()
+			return fmt.Errorf("channel closed before the confirmation of the message to %q", queue)
+		}
+		// A returned message is received before its confirmation.
+		select {
+		case r := <-b.returns:
+			return fmt.Errorf("message returned by the broker: %s", r.ReplyText)
+		default:
+		}
+		if !c.Ack {
+			return fmt.Errorf("message to %q rejected by the broker", queue)
+		}
+		return nil
+	case <-time.After(internalRequestTimeout):
+		// The confirmation could be received on the next publish, start over.
+		b.resetPublishChannel()
+		return fmt.Errorf("no confirmation of the message to %q after %v", queue, internalRequestTimeout)
+	}
+}
+
+// resetPublishChannel closes the channel used to publish, so that a new one
+// is opened on the next publish. Assumes lock held.
+func (b *amqpBroker) resetPublishChannel() {
+	if b.pubCh != nil {
+		b.pubCh.Close()
+		b.pubCh = nil
+	}
+}
+
+// Consume implements ShovelBroker. When the connection or the channel is
+// lost, the queue is consumed again after a backoff.
+func (b *amqpBroker) Consume(queue string, handler func(body []byte) error) error {
+	backoff := forwardMinBackoff
+	for {
+		err := b.consume(queue, handler, &backoff)
+		if err == ErrShovelClosed {
+			return nil
+		}
+		if err != nil {
+			b.log.Errorf("STAN: Unable to consume %q, retrying in %v: %v", queue, backoff, err)
+		}
+		select {
+		case <-b.quit:
+			return nil
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > forwardMaxBackoff {
+			backoff = forwardMaxBackoff
+		}
+	}
+}
+
+// consume consumes the queue until the channel is closed. The backoff is
+// reset once consuming.
+func (b *amqpBroker) consume(queue string, handler func(body []byte) error, backoff *time.Duration) error {
+	b.Lock()
+	conn, err := b.connection()
+	b.Unlock()
+	if err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	if err := ch.Qos(1, 0, false); err != nil {
+		return err
+	}
+	deliveries, err := ch.Consume(queue, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	*backoff = forwardMinBackoff
+	for d := range deliveries {
+		if err := handler(d.Body); err != nil {
+			d.Nack(false, true)
+		} else {
+			d.Ack(false)
+		}
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		return ErrShovelClosed
+	}
+	return fmt.Errorf("consumer of %q closed", queue)
+}
+
+// Close implements ShovelBroker.
+func (b *amqpBroker) Close() error {
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	close(b.quit)
+	return b.conn.Close()
+}
@@ -0,0 +1,229 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+// Actions taken on slow consumers, set with Options.SlowConsumerAction.
+const (
+	// SlowConsumerNotify only logs and publishes the slow consumer events.
+	SlowConsumerNotify = "notify"
+	// SlowConsumerCloseSub also closes the subscription. Durables are kept,
+	// offline, so that they can be resumed.
+	SlowConsumerCloseSub = "close_sub"
+	// SlowConsumerCloseClient also closes the connection of the client.
+	SlowConsumerCloseClient = "close_client"
+)
+
+// Slow consumers are checked this many times per Options.SlowConsumerWait.
+const slowConsumerChecksPerPeriod = 4
+
+// SlowConsumerEvent is published, as JSON, on the
+// `_STAN.events.<cluster ID>.subscription.slow` subject when
+// Options.SlowConsumerWait is set, for each subscription whose messages
+// pending acknowledgment stayed at its MaxInFlight for that long.
+type SlowConsumerEvent struct {
+	Channel     string    `json:"channel"`
+	ClientID    string    `json:"client_id"`
+	Inbox       string    `json:"inbox"`
+	DurableName string    `json:"durable_name,omitempty"`
+	QueueGroup  string    `json:"queue_group,omitempty"`
+	Pending     int       `json:"pending"`
+	MaxInFlight int32     `json:"max_inflight"`
+	Since       time.Time `json:"since"`  // Time since which the pending messages are at MaxInFlight
+	Action      string    `json:"action"` // What the server did with the subscription
+	Time        time.Time `json:"time"`
+}
+
+// SlowConsumerStats are the slow consumers detected since the server
+// started, and how many of them were closed, or had their client closed.
+type SlowConsumerStats struct {
+	Detected uint64 `json:"detected"`
+	Evicted  uint64 `json:"evicted"`
+}
+
+// slowConsumers is the go routine checking for slow consumers.
+type slowConsumers struct {
+	detected uint64 // updated atomically
+	evicted  uint64 // updated atomically
+	quit     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// slowConsumer is a subscription found slow, to report and evict once the
+// locks of its channel's subStore and of the subscription are released.
+type slowConsumer struct {
+	cs    *stores.ChannelStore
+	sub   *subState
+	event *SlowConsumerEvent
+}
+
+// validateSlowConsumerAction checks Options.SlowConsumerAction.
+func validateSlowConsumerAction(action string) error {
+	switch action {
+	case "", SlowConsumerNotify, SlowConsumerCloseSub, SlowConsumerCloseClient:
+		return nil
+	}
+	return fmt.Errorf("invalid slow consumer action %q", action)
+}
+
+// slowConsumerSubject returns the subject slow consumer events are
+// published on.
+func (s *StanServer) slowConsumerSubject() string {
+	return fmt.Sprintf("%s.%s.subscription.slow", DefaultEventsPrefix, s.info.ClusterID)
+}
+
+// markFull records the time since which the subscription has as many
+// messages pending acknowledgment as its MaxInFlight, if not done yet.
+// Sub lock held on entry.
+func (s *StanServer) markFull(sub *subState) {
+	if s.opts.SlowConsumerWait > 0 && sub.fullSince == 0 {
+		sub.fullSince = s.clock.Now().UnixNano()
+	}
+}
+
+// startSlowConsumersCheck starts the go routine checking, every fraction
+// of `wait`, for the subscriptions at their MaxInFlight for that long.
+func (s *StanServer) startSlowConsumersCheck(wait time.Duration) {
+	interval := wait / slowConsumerChecksPerPeriod
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	sc := &slowConsumers{quit: make(chan struct{})}
+	s.Lock()
+	s.slowConsumers = sc
+	s.Unlock()
+	sc.wg.Add(1)
+	go func() {
+		defer sc.wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-sc.quit:
+				return
+			case <-t.C:
+				s.checkSlowConsumers(sc, s.clock.Now(), wait)
+			}
+		}
+	}()
+}
+
+// stop stops the check and waits for its go routine to return.
+func (sc *slowConsumers) stop() {
+	close(sc.quit)
+	sc.wg.Wait()
+}
+
+// checkSlowConsumers reports the subscriptions that have been at their
+// MaxInFlight for longer than `wait`, and applies
+// Options.SlowConsumerAction to them.
+func (s *StanServer) checkSlowConsumers(sc *slowConsumers, now time.Time, wait time.Duration) {
+	action := s.opts.SlowConsumerAction
+	if action == "" {
+		action = SlowConsumerNotify
+	}
+	var slow []slowConsumer
+	check := func(cs *stores.ChannelStore, channel string, sub *subState) {
+		sub.Lock()
+		defer sub.Unlock()
+		if sub.fullSince == 0 {
+			return
+		}
+		// The subscription may have room since, without an ack (for
+		// instance if messages were moved to the dead-letter channel).
+		if sub.ClientID == "" || sub.paused || int32(len(sub.acksPending)) < sub.maxInFlight() {
+			sub.fullSince = 0
+			return
+		}
+		if now.UnixNano()-sub.fullSince < int64(wait) {
+			return
+		}
+		slow = append(slow, slowConsumer{cs: cs, sub: sub, event: &SlowConsumerEvent{
+			Channel:     channel,
+			ClientID:    sub.ClientID,
+			Inbox:       sub.Inbox,
+			DurableName: sub.DurableName,
+			QueueGroup:  sub.QGroup,
+			Pending:     len(sub.acksPending),
+			MaxInFlight: sub.maxInFlight(),
+			Since:       time.Unix(0, sub.fullSince),
+			Action:      action,
+			Time:        now,
+		}})
+		// Report again if still slow after another period.
+		sub.fullSince = now.UnixNano()
+	}
+
+	for name, cs := range s.store.GetChannels() {
+		ss := cs.UserData.(*subStore)
+		ss.RLock()
+		for _, sub := range ss.psubs {
+			check(cs, name, sub)
+		}
+		for _, qs := range ss.qsubs {
+			qs.RLock()
+			for _, sub := range qs.subs {
+				check(cs, name, sub)
+			}
+			qs.RUnlock()
+		}
+		ss.RUnlock()
+	}
+	atomic.AddUint64(&sc.detected, uint64(len(slow)))
+
+	for _, c := range slow {
+		e := c.event
+		s.log.Noticef("STAN: [Client:%s] Slow consumer on %s: inbox=%s durable=%q queue=%q pending=%v since %v, action=%s",
+			e.ClientID, e.Channel, e.Inbox, e.DurableName, e.QueueGroup, e.Pending, e.Since, action)
+		b, _ := json.Marshal(e)
+		if err := s.nc.Publish(s.slowConsumerSubject(), b); err != nil {
+			s.log.Errorf("STAN: [Client:%s] Unable to publish slow consumer event: %v", e.ClientID, err)
+		}
+		if s.evictSlowConsumer(c, action) {
+			atomic.AddUint64(&sc.evicted, 1)
+		}
+	}
+}
+
+// evictSlowConsumer closes the slow subscription, or its client, according
+// to the action. Returns true if it did.
+func (s *StanServer) evictSlowConsumer(c slowConsumer, action string) bool {
+	e := c.event
+	switch action {
+	case SlowConsumerCloseSub:
+		if !s.clients.RemoveSub(e.ClientID, c.sub) {
+			return false
+		}
+		ss := c.cs.UserData.(*subStore)
+		s.startExclusiveConsumer(c.cs, ss.Remove(c.sub, e.DurableName == ""))
+		return true
+	case SlowConsumerCloseClient:
+		detail := fmt.Sprintf("slow consumer on %s", e.Channel)
+		return s.closeClient(e.ClientID, ClientCloseSlowSub, detail)
+	}
+	return false
+}
+
+// SlowConsumerStats returns the slow consumers detected, which are all
+// zero if Options.SlowConsumerWait is not set.
+func (s *StanServer) SlowConsumerStats() SlowConsumerStats {
+	s.RLock()
+	sc := s.slowConsumers
+	s.RUnlock()
+	if sc == nil {
+		return SlowConsumerStats{}
+	}
+	return SlowConsumerStats{
+		Detected: atomic.LoadUint64(&sc.detected),
+		Evicted:  atomic.LoadUint64(&sc.evicted),
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestSlowConsumers(t *testing.T) {
+	for _, action := range []string{"", SlowConsumerCloseSub, SlowConsumerCloseClient} {
+		func() {
+			opts := GetDefaultOptions()
+			opts.ID = clusterName
+			opts.SlowConsumerWait = 200 * time.Millisecond
+			opts.SlowConsumerAction = action
+			s := runServerWithOpts(opts)
+			defer s.Shutdown()
+
+			nc, err := nats.Connect(nats.DefaultURL)
+			if err != nil {
+				t.Fatalf("Unexpected error on connect: %v", err)
+			}
+			defer nc.Close()
+			events := make(chan *nats.Msg, 10)
+			if _, err := nc.ChanSubscribe(s.slowConsumerSubject(), events); err != nil {
+				t.Fatalf("Unexpected error on subscribe: %v", err)
+			}
+			nc.Flush()
+
+			sc := NewDefaultConnection(t)
+			defer sc.Close()
+			notif := make(chan *nats.Msg, 1)
+			if _, err := nc.ChanSubscribe(s.store.GetClient(clientName).HbInbox, notif); err != nil {
+				t.Fatalf("Unexpected error on subscribe: %v", err)
+			}
+			nc.Flush()
+
+			// A subscription acknowledging its messages is not slow.
+			if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}, stan.MaxInflight(1)); err != nil {
+				t.Fatalf("Unexpected error on subscribe: %v", err)
+			}
+			// This durable never acknowledges its message.
+			if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {},
+				stan.MaxInflight(1), stan.SetManualAckMode(), stan.DurableName("dur")); err != nil {
+				t.Fatalf("Unexpected error on subscribe: %v", err)
+			}
+			for i := 0; i < 3; i++ {
+				if err := sc.Publish("foo", []byte("hello")); err != nil {
+					t.Fatalf("Unexpected error on publish: %v", err)
+				}
+			}
+
+			select {
+			case m := <-events:
+				e := &SlowConsumerEvent{}
+				if err := json.Unmarshal(m.Data, e); err != nil {
+					t.Fatalf("Unexpected error on unmarshal: %v", err)
+				}
+				expectedAction := action
+				if expectedAction == "" {
+					expectedAction = SlowConsumerNotify
+				}
+				if e.Channel != "foo" || e.ClientID != clientName || e.DurableName != "dur" ||
+					e.Pending != 1 || e.MaxInFlight != 1 || e.Action != expectedAction {
+					t.Fatalf("Unexpected event: %+v", e)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("Slow consumer was not reported")
+			}
+
+			// The event is published before the action is taken.
+			stats := s.SlowConsumerStats()
+			for deadline := time.Now().Add(2 * time.Second); action != "" && stats.Evicted == 0 && time.Now().Before(deadline); {
+				time.Sleep(10 * time.Millisecond)
+				stats = s.SlowConsumerStats()
+			}
+			ss := s.store.LookupChannel("foo").UserData.(*subStore)
+			ss.RLock()
+			psubs, durables := len(ss.psubs), len(ss.durables)
+			ss.RUnlock()
+			switch action {
+			case "":
+				if stats.Detected == 0 || stats.Evicted != 0 {
+					t.Fatalf("Unexpected stats: %+v", stats)
+				}
+				if psubs != 2 {
+					t.Fatalf("Expected subscriptions to be kept, got %v", psubs)
+				}
+				// The slow consumer is reported again after another period.
+				select {
+				case <-events:
+				case <-time.After(2 * time.Second):
+					t.Fatal("Slow consumer was not reported again")
+				}
+			case SlowConsumerCloseSub:
+				if stats.Detected != 1 || stats.Evicted != 1 {
+					t.Fatalf("Unexpected stats: %+v", stats)
+				}
+				// The durable is kept, offline.
+				if psubs != 1 || durables != 1 {
+					t.Fatalf("Expected 1 sub and 1 durable, got %v subs and %v durables", psubs, durables)
+				}
+				if s.store.GetClient(clientName) == nil {
+					t.Fatal("Client should still be registered")
+				}
+			case SlowConsumerCloseClient:
+				if stats.Detected != 1 || stats.Evicted != 1 {
+					t.Fatalf("Unexpected stats: %+v", stats)
+				}
+				select {
+				case m := <-notif:
+					cd := &spb.ClientDisconnect{}
+					if err := cd.Unmarshal(m.Data); err != nil || cd.ClientID != clientName {
+						t.Fatalf("Unexpected notification: %v (%v)", cd, err)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatal("Client was not notified")
+				}
+				if s.store.GetClient(clientName) != nil {
+					t.Fatal("Client should have been unregistered")
+				}
+				if psubs != 0 || durables != 1 {
+					t.Fatalf("Expected only the durable to be kept, got %v subs and %v durables", psubs, durables)
+				}
+			}
+		}()
+	}
+}
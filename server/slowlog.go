@@ -0,0 +1,178 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Kinds of protocol requests timed by the slow log.
+const (
+	slowConnect   = "connect"
+	slowSubscribe = "subscribe"
+	slowPublish   = "publish"
+	slowClose     = "close"
+)
+
+// SlowRequestCounts are the numbers of protocol requests whose processing
+// took longer than Options.SlowRequestTime, by kind of request.
+type SlowRequestCounts struct {
+	Connect   uint64
+	Subscribe uint64
+	Publish   uint64 // Publishes, from the reception of the message to the PubAck
+	Close     uint64
+}
+
+// reqStage is a stage of a protocol request, and its duration.
+type reqStage struct {
+	name string
+	d    time.Duration
+}
+
+// reqTimer times the stages of a protocol request. Its methods do nothing
+// on a nil timer, returned when the slow log is disabled.
+type reqTimer struct {
+	start  time.Time
+	last   time.Time
+	stages []reqStage
+}
+
+// stage records the end of the stage with the given name, which started
+// at the end of the previous one.
+func (t *reqTimer) stage(name string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.stages = append(t.stages, reqStage{name, now.Sub(t.last)})
+	t.last = now
+}
+
+// slowLog logs the protocol requests processed in more than the threshold
+// to a dedicated file, or to the server's logger.
+type slowLog struct {
+	sync.Mutex
+	threshold time.Duration
+	out       *log.Logger // nil to use the server's logger
+	file      *os.File
+	counts    SlowRequestCounts
+	log       *serverLogger // the server's logger
+}
+
+// newSlowLog returns the slow log for the given threshold, appending to
+// the given file if not empty, or else logging with the server's logger.
+func newSlowLog(threshold time.Duration, filename string, logger *serverLogger) (*slowLog, error) {
+	sl := &slowLog{threshold: threshold, log: logger}
+	if filename != "" {
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open slow log file: %v", err)
+		}
+		sl.file = f
+		sl.out = log.New(f, "", log.LstdFlags|log.Lmicroseconds)
+	}
+	return sl, nil
+}
+
+// startRequest returns the timer of a request received now, or nil if the
+// slow log is disabled.
+func (s *StanServer) startRequest() *reqTimer {
+	if s.slowLog == nil {
+		return nil
+	}
+	now := time.Now()
+	return &reqTimer{start: now, last: now}
+}
+
+// endRequest logs and counts the request if it was slow.
+func (s *StanServer) endRequest(t *reqTimer, kind, clientID, channel string) {
+	if t == nil {
+		return
+	}
+	s.slowLog.check(kind, clientID, channel, t.last.Sub(t.start), t.stages)
+}
+
+// endPublish logs and counts the publish if it was slow, given the times of
+// its stages.
+func (s *StanServer) endPublish(clientID, channel string, t *pubTimes, flushed, acked time.Time) {
+	if s.slowLog == nil {
+		return
+	}
+	stages := []reqStage{
+		{"validate", t.queued.Sub(t.received)},
+		{"queue", t.dequeued.Sub(t.queued)},
+		{"store", t.stored.Sub(t.dequeued)},
+		{"flush", flushed.Sub(t.stored)},
+		{"ack", acked.Sub(flushed)},
+	}
+	s.slowLog.check(slowPublish, clientID, channel, acked.Sub(t.received), stages)
+}
+
+// check logs and counts the request if it took longer than the threshold,
+// naming its slowest stage.
+func (sl *slowLog) check(kind, clientID, channel string, total time.Duration, stages []reqStage) {
+	if total < sl.threshold {
+		return
+	}
+	var slowest reqStage
+	var buf bytes.Buffer
+	for _, st := range stages {
+		if st.d > slowest.d {
+			slowest = st
+		}
+		fmt.Fprintf(&buf, " %s=%v", st.name, st.d)
+	}
+	on := ""
+	if channel != "" {
+		on = fmt.Sprintf(" on %s", channel)
+	}
+	line := fmt.Sprintf("[Client:%s] Slow %s request%s: %v, slowest stage %s (%v):%s",
+		clientID, kind, on, total, slowest.name, slowest.d, buf.String())
+
+	sl.Lock()
+	switch kind {
+	case slowConnect:
+		sl.counts.Connect++
+	case slowSubscribe:
+		sl.counts.Subscribe++
+	case slowPublish:
+		sl.counts.Publish++
+	case slowClose:
+		sl.counts.Close++
+	}
+	out := sl.out
+	if out != nil {
+		out.Print(line)
+	}
+	sl.Unlock()
+	if out == nil {
+		sl.log.Noticef("STAN: %s", line)
+	}
+}
+
+// close closes the file of the slow log, if any. Requests still completing
+// are counted, but no longer logged.
+func (sl *slowLog) close() {
+	sl.Lock()
+	defer sl.Unlock()
+	if sl.file != nil {
+		sl.file.Close()
+		sl.file = nil
+	}
+}
+
+// SlowRequestCounts returns the numbers of slow protocol requests, and
+// false if Options.SlowRequestTime is not set.
+func (s *StanServer) SlowRequestCounts() (SlowRequestCounts, bool) {
+	if s.slowLog == nil {
+		return SlowRequestCounts{}, false
+	}
+	s.slowLog.Lock()
+	defer s.slowLog.Unlock()
+	return s.slowLog.counts, true
+}
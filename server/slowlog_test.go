@@ -0,0 +1,93 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+)
+
+func TestSlowRequestLog(t *testing.T) {
+	f, err := ioutil.TempFile("", "slowlog")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %v", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	// Every request is slow.
+	opts.SlowRequestTime = time.Nanosecond
+	opts.SlowLogFile = f.Name()
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	if err := sc.Close(); err != nil {
+		t.Fatalf("Unexpected error on close: %v", err)
+	}
+	// The publish is counted after the PubAck is sent.
+	waitForCount(t, 1, func() (string, int) {
+		counts, _ := s.SlowRequestCounts()
+		return "slow publishes", int(counts.Publish)
+	})
+	counts, ok := s.SlowRequestCounts()
+	if !ok {
+		t.Fatal("The slow log should be enabled")
+	}
+	if counts.Connect != 1 || counts.Subscribe != 1 || counts.Close != 1 {
+		t.Fatalf("Unexpected counts: %+v", counts)
+	}
+	s.Shutdown()
+
+	content, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("Unable to read slow log: %v", err)
+	}
+	for _, e := range []string{
+		"[Client:" + clientName + "] Slow connect request: ",
+		"[Client:" + clientName + "] Slow subscribe request on foo: ",
+		"[Client:" + clientName + "] Slow publish request on foo: ",
+		"[Client:" + clientName + "] Slow close request: ",
+		" validate=", " register=", " store=", " flush=", " send=", " close=",
+	} {
+		if !strings.Contains(string(content), e) {
+			t.Fatalf("Expected %q in slow log:\n%s", e, content)
+		}
+	}
+}
+
+func TestSlowRequestLogThreshold(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.SlowRequestTime = time.Hour
+	s := runServerWithOpts(opts)
+	defer shutdownRestartedServerOnTestExit(&s)
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	if counts, ok := s.SlowRequestCounts(); !ok || counts != (SlowRequestCounts{}) {
+		t.Fatalf("Unexpected counts: %+v", counts)
+	}
+
+	s.Shutdown()
+	s = RunServer(clusterName)
+	if _, ok := s.SlowRequestCounts(); ok {
+		t.Fatal("The slow log should be disabled")
+	}
+}
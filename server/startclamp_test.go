@@ -0,0 +1,85 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestClampStartPosition(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.MaxMsgs = 3
+	opts.ClampStartPosition = true
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	for i := 0; i < 5; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	// Subscribes with the given start position, and checks the first
+	// message received.
+	check := func(channel string, pos spb.StartPosition, value int64, adjusted bool, firstSeq uint64) {
+		raw := make(chan *nats.Msg, 10)
+		inbox := nats.NewInbox()
+		if _, err := nc.ChanSubscribe(inbox, raw); err != nil {
+			stackFatalf(t, "Unexpected error on subscribe: %v", err)
+		}
+		req := &spb.SubscriptionRequest{
+			ClientID:      clientName,
+			Subject:       channel,
+			Inbox:         inbox,
+			MaxInFlight:   10,
+			AckWaitInSecs: 30,
+			StartPosition: pos,
+		}
+		if pos == spb.StartPosition_SequenceStart {
+			req.StartSequence = uint64(value)
+		} else {
+			req.StartTimeDelta = value
+		}
+		resp := subscribeRaw(t, nc, s, req)
+		if resp.Error != "" || resp.StartAdjusted != adjusted {
+			stackFatalf(t, "Unexpected response: %v", resp)
+		}
+		select {
+		case m := <-raw:
+			msg := &spb.MsgProto{}
+			if err := msg.Unmarshal(m.Data); err != nil || msg.Sequence != firstSeq {
+				stackFatalf(t, "Expected message %v, got %v (%v)", firstSeq, msg, err)
+			}
+		case <-time.After(2 * time.Second):
+			stackFatalf(t, "Did not get our message")
+		}
+	}
+
+	// Messages 1 and 2 were removed by the limit.
+	check("foo", spb.StartPosition_SequenceStart, 4, false, 4)
+	check("foo", spb.StartPosition_SequenceStart, 1, true, 3)
+	check("foo", spb.StartPosition_SequenceStart, 100, true, 5)
+	check("foo", spb.StartPosition_TimeDeltaStart, int64(time.Hour), true, 3)
+	check("foo", spb.StartPosition_TimeDeltaStart, -int64(time.Hour), true, 5)
+
+	// Subscriptions on a channel without messages start with the next one.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		sc.Publish("bar", []byte("hello"))
+	}()
+	check("bar", spb.StartPosition_SequenceStart, 10, true, 1)
+}
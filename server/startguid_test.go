@@ -0,0 +1,131 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func subscribeRaw(t *testing.T, nc *nats.Conn, s *StanServer, req *spb.SubscriptionRequest) *spb.SubscriptionResponse {
+	b, _ := req.Marshal()
+	reply, err := nc.Request(s.info.Subscribe, b, 2*time.Second)
+	if err != nil {
+		stackFatalf(t, "Unexpected error on subscription request: %v", err)
+	}
+	resp := &spb.SubscriptionResponse{}
+	if err := resp.Unmarshal(reply.Data); err != nil {
+		stackFatalf(t, "Unexpected response: %v", err)
+	}
+	return resp
+}
+
+// subscribeRawMsgs sends the subscription request with an inbox of its own,
+// and returns the channel the messages sent to the subscription are decoded
+// to, with the fields that the client library doesn't know.
+func subscribeRawMsgs(t *testing.T, nc *nats.Conn, s *StanServer, req *spb.SubscriptionRequest) chan *spb.MsgProto {
+	ch := make(chan *spb.MsgProto, 100)
+	req.Inbox = nats.NewInbox()
+	if _, err := nc.Subscribe(req.Inbox, func(m *nats.Msg) {
+		msg := &spb.MsgProto{}
+		if err := msg.Unmarshal(m.Data); err == nil {
+			ch <- msg
+		}
+	}); err != nil {
+		stackFatalf(t, "Unexpected error on subscribe: %v", err)
+	}
+	if req.ClientID == "" {
+		req.ClientID = clientName
+	}
+	if req.MaxInFlight == 0 {
+		req.MaxInFlight = 100
+	}
+	if req.AckWaitInSecs == 0 {
+		req.AckWaitInSecs = 30
+	}
+	if resp := subscribeRaw(t, nc, s, req); resp.Error != "" {
+		stackFatalf(t, "Unexpected error on subscription request: %v", resp.Error)
+	}
+	return ch
+}
+
+func TestStartPositionByGUID(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	acks := make(chan error, 5)
+	guids := make([]string, 0, 5)
+	for i := 0; i < 5; i++ {
+		guid, err := sc.PublishAsync("foo", []byte("hello"), func(_ string, err error) { acks <- err })
+		if err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+		guids = append(guids, guid)
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case err := <-acks:
+			if err != nil {
+				t.Fatalf("Unexpected error on publish: %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Did not get our publish acks")
+		}
+	}
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+	raw := make(chan *nats.Msg, 10)
+	inbox := nats.NewInbox()
+	if _, err := nc.ChanSubscribe(inbox, raw); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	req := &spb.SubscriptionRequest{
+		ClientID:      clientName,
+		Subject:       "foo",
+		Inbox:         inbox,
+		MaxInFlight:   10,
+		AckWaitInSecs: 30,
+		StartPosition: spb.StartPosition_ByGUID,
+		StartGUID:     guids[2],
+	}
+	if resp := subscribeRaw(t, nc, s, req); resp.Error != "" {
+		t.Fatalf("Unexpected error on subscription request: %v", resp.Error)
+	}
+	for i := uint64(3); i <= 5; i++ {
+		select {
+		case m := <-raw:
+			msg := &spb.MsgProto{}
+			if err := msg.Unmarshal(m.Data); err != nil {
+				t.Fatalf("Unexpected error on unmarshal: %v", err)
+			}
+			if msg.Sequence != i || msg.Guid != guids[i-1] {
+				t.Fatalf("Unexpected message: %v", msg)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Did not get our message")
+		}
+	}
+
+	// Unknown or missing GUIDs are rejected, as are wildcard subscriptions.
+	for _, guid := range []string{"unknown", ""} {
+		req.StartGUID = guid
+		if resp := subscribeRaw(t, nc, s, req); resp.Error != ErrUnknownStartGUID.Error() {
+			t.Fatalf("Expected error %q for GUID %q, got %q", ErrUnknownStartGUID, guid, resp.Error)
+		}
+	}
+	req.Subject = "foo.*"
+	req.StartGUID = guids[0]
+	if resp := subscribeRaw(t, nc, s, req); resp.Error != ErrInvalidWildcardSub.Error() {
+		t.Fatalf("Expected error %q, got %q", ErrInvalidWildcardSub, resp.Error)
+	}
+}
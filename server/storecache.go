@@ -0,0 +1,28 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+// StoreCachePath is the HTTP path of the statistics of the store's message
+// cache, served on Options.InfoListen.
+const StoreCachePath = "/cachez"
+
+// cachingStore is implemented by the stores caching the messages they read
+// from disk, such as the HYBRID store.
+type cachingStore interface {
+	CacheStats() stores.CacheStats
+}
+
+// StoreCacheStats returns the statistics of the store's message cache. The
+// boolean is false if the store has no cache, or it is disabled.
+func (s *StanServer) StoreCacheStats() (stores.CacheStats, bool) {
+	cs, ok := s.store.(cachingStore)
+	if !ok {
+		return stores.CacheStats{}, false
+	}
+	stats := cs.CacheStats()
+	return stats, stats.MaxBytes > 0
+}
@@ -0,0 +1,62 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+func TestStoreCacheStats(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.StoreType = stores.TypeHybrid
+	opts.FilestoreDir = defaultDataStore
+	opts.HybridMaxMemBytes = 10
+	opts.HybridCacheBytes = 1024
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	for i := 0; i < 5; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	// Two subscriptions replay the spilled messages: the second one is
+	// served by the cache.
+	for i := 0; i < 2; i++ {
+		msgs := make(chan *stan.Msg, 10)
+		sub, err := sc.Subscribe("foo", func(m *stan.Msg) { msgs <- m }, stan.DeliverAllAvailable())
+		if err != nil {
+			t.Fatalf("Unexpected error on subscribe: %v", err)
+		}
+		for seq := uint64(1); seq <= 5; seq++ {
+			checkMsgSeq(t, msgs, seq)
+		}
+		sub.Unsubscribe()
+	}
+	stats, ok := s.StoreCacheStats()
+	if !ok {
+		t.Fatal("Expected cache stats")
+	}
+	if stats.Misses != 3 || stats.Hits < 3 || stats.Msgs != 3 || stats.MaxBytes != 1024 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestStoreCacheStatsWithoutCache(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	if _, ok := s.StoreCacheStats(); ok {
+		t.Fatal("Expected no cache stats with the memory store")
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+// DefaultStoreFullInterval is the minimum time between two checks of the
+// subscriptions that lost messages of a same full channel, if
+// Options.StoreFullInterval is not set.
+const DefaultStoreFullInterval = time.Second
+
+// StoreFullStats count the messages of a channel discarded by its limits to
+// store new ones, returned by StanServer.StoreFullStats.
+type StoreFullStats struct {
+	Discarded uint64 `json:"discarded"` // Messages discarded by the limits
+	Events    uint64 `json:"events"`    // Checks that found subscriptions which lost messages
+	LostSubs  uint64 `json:"lost_subs"` // Subscriptions reported by these checks
+}
+
+// StoreFullEvent is published, as JSON, on the
+// `_STAN.events.<cluster ID>.channel.full` subject when Options.StoreFullEvents
+// is set. It lists the subscriptions, and queue groups, of which messages not
+// acknowledged yet were discarded by the channel limits since the previous
+// check of the channel.
+type StoreFullEvent struct {
+	Channel       string         `json:"channel"`
+	FirstSeq      uint64         `json:"first_seq"` // First message still stored
+	Discarded     uint64         `json:"discarded"` // Messages discarded since the previous check
+	Subscriptions []*LostHistory `json:"subscriptions"`
+	Time          time.Time      `json:"time"`
+}
+
+// LostHistory is a subscription, or queue group, which lost messages it had
+// not acknowledged.
+type LostHistory struct {
+	ClientID    string `json:"client_id,omitempty"` // Empty for offline durables and queue groups
+	Inbox       string `json:"inbox,omitempty"`
+	DurableName string `json:"durable_name,omitempty"`
+	QueueGroup  string `json:"queue_group,omitempty"`
+	AckFloor    uint64 `json:"ack_floor"` // First message not acknowledged
+	Lost        uint64 `json:"lost"`      // Messages discarded since the previous check
+}
+
+// storeFull counts the messages discarded by the limits of each channel.
+// It is only updated by the go routine storing the published messages.
+type storeFull struct {
+	sync.Mutex
+	channels map[string]*channelFull
+}
+
+// channelFull is the discarded messages of a channel.
+type channelFull struct {
+	StoreFullStats
+	from    uint64 // first sequence at the last check
+	checked int64  // time of the last check
+}
+
+// remove forgets the counts of a deleted channel.
+func (sf *storeFull) remove(channel string) {
+	sf.Lock()
+	delete(sf.channels, channel)
+	sf.Unlock()
+}
+
+// storeFullSubject returns the subject store full events are published on.
+func (s *StanServer) storeFullSubject() string {
+	return fmt.Sprintf("%s.%s.channel.full", DefaultEventsPrefix, s.info.ClusterID)
+}
+
+// checkStoreFull is called once a message was stored on the channel, whose
+// first sequence was `prevFirst` before. If messages were discarded by the
+// limits, they are counted, and, at most once per Options.StoreFullInterval,
+// the subscriptions that lost messages they had not acknowledged are logged
+// and, if Options.StoreFullEvents is set, published.
+func (s *StanServer) checkStoreFull(channel string, cs *stores.ChannelStore, prevFirst uint64) {
+	first := cs.Msgs.FirstSequence()
+	if prevFirst == 0 || first <= prevFirst {
+		return
+	}
+	interval := s.opts.StoreFullInterval
+	if interval == 0 {
+		interval = DefaultStoreFullInterval
+	}
+	now := s.clock.Now()
+	sf := s.storeFull
+	sf.Lock()
+	c := sf.channels[channel]
+	if c == nil {
+		c = &channelFull{from: prevFirst}
+		sf.channels[channel] = c
+	}
+	c.Discarded += first - prevFirst
+	// The channel was purged since the last check.
+	if c.from > prevFirst {
+		c.from = prevFirst
+	}
+	if now.UnixNano()-c.checked < int64(interval) {
+		sf.Unlock()
+		return
+	}
+	from := c.from
+	c.from = first
+	c.checked = now.UnixNano()
+	sf.Unlock()
+
+	lost := lostHistory(cs.UserData.(*subStore), from, first)
+	if len(lost) == 0 {
+		return
+	}
+	sf.Lock()
+	c.Events++
+	c.LostSubs += uint64(len(lost))
+	sf.Unlock()
+	s.log.Noticef("STAN: Channel %s is full, %d subscription(s) lost messages not acknowledged, the first message is now %d",
+		channel, len(lost), first)
+	if !s.opts.StoreFullEvents {
+		return
+	}
+	b, _ := json.Marshal(&StoreFullEvent{
+		Channel:       channel,
+		FirstSeq:      first,
+		Discarded:     first - from,
+		Subscriptions: lost,
+		Time:          now,
+	})
+	if err := s.nc.Publish(s.storeFullSubject(), b); err != nil {
+		s.log.Errorf("STAN: Unable to publish store full event of channel %s: %v", channel, err)
+	}
+}
+
+// lostHistory returns the subscriptions and queue groups whose ack floor is
+// below `first`, with the number of messages from `from` they lost.
+func lostHistory(ss *subStore, from, first uint64) []*LostHistory {
+	var lost []*LostHistory
+	add := func(lh *LostHistory) {
+		if lh.AckFloor >= first {
+			return
+		}
+		if lh.AckFloor < from {
+			lh.Lost = first - from
+		} else {
+			lh.Lost = first - lh.AckFloor
+		}
+		lost = append(lost, lh)
+	}
+
+	ss.RLock()
+	defer ss.RUnlock()
+	for _, sub := range ss.psubs {
+		sub.RLock()
+		add(&LostHistory{ClientID: sub.ClientID, Inbox: sub.Inbox, DurableName: sub.DurableName,
+			AckFloor: sub.ackFloor(sub.LastSent)})
+		sub.RUnlock()
+	}
+	for _, sub := range ss.durables {
+		sub.RLock()
+		if sub.ClientID == "" {
+			add(&LostHistory{DurableName: sub.DurableName, AckFloor: sub.ackFloor(sub.LastSent)})
+		}
+		sub.RUnlock()
+	}
+	for name, qs := range ss.qsubs {
+		qs.RLock()
+		floor := qs.lastSent + 1
+		for _, sub := range qs.subs {
+			sub.RLock()
+			if f := sub.ackFloor(qs.lastSent); f < floor {
+				floor = f
+			}
+			sub.RUnlock()
+		}
+		qs.RUnlock()
+		add(&LostHistory{QueueGroup: name, AckFloor: floor})
+	}
+	return lost
+}
+
+// ackFloor returns the first message the subscription did not acknowledge,
+// `lastSent`+1 if none is pending. Sub lock held on entry.
+func (sub *subState) ackFloor(lastSent uint64) uint64 {
+	floor := lastSent + 1
+	for seq := range sub.acksPending {
+		if seq < floor {
+			floor = seq
+		}
+	}
+	return floor
+}
+
+// StoreFullStats returns the messages of the channel discarded by its
+// limits since the server started, and false if none was.
+func (s *StanServer) StoreFullStats(channel string) (StoreFullStats, bool) {
+	s.storeFull.Lock()
+	defer s.storeFull.Unlock()
+	c := s.storeFull.channels[channel]
+	if c == nil {
+		return StoreFullStats{}, false
+	}
+	return c.StoreFullStats, true
+}
@@ -0,0 +1,109 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats"
+)
+
+func TestStoreFullEvents(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.MaxMsgs = 3
+	opts.StoreFullEvents = true
+	opts.StoreFullInterval = time.Hour
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+	events := make(chan *nats.Msg, 10)
+	if _, err := nc.ChanSubscribe(s.storeFullSubject(), events); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatalf("Unexpected error on flush: %v", err)
+	}
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	// The subscription never acks the first message.
+	msgs := make(chan *stan.Msg, 10)
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) { msgs <- m },
+		stan.SetManualAckMode(), stan.MaxInflight(1), stan.DeliverAllAvailable()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	checkMsgSeq(t, msgs, 1)
+	if _, ok := s.StoreFullStats("foo"); ok {
+		t.Fatal("Expected no stats before the channel is full")
+	}
+
+	// Messages 1 and 2 are discarded, and only the first discard is
+	// checked within the interval.
+	for i := 0; i < 2; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	select {
+	case m := <-events:
+		e := &StoreFullEvent{}
+		if err := json.Unmarshal(m.Data, e); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if e.Channel != "foo" || e.FirstSeq != 2 || e.Discarded != 1 || e.Time.IsZero() || len(e.Subscriptions) != 1 {
+			t.Fatalf("Unexpected event: %+v", e)
+		}
+		if lh := e.Subscriptions[0]; lh.ClientID != clientName || lh.Inbox == "" || lh.AckFloor != 1 || lh.Lost != 1 {
+			t.Fatalf("Unexpected lost history: %+v", lh)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Did not get the store full event")
+	}
+	select {
+	case m := <-events:
+		t.Fatalf("Unexpected event: %s", m.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+	stats, ok := s.StoreFullStats("foo")
+	if !ok || stats.Discarded != 2 || stats.Events != 1 || stats.LostSubs != 1 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestStoreFullNoLostSubs(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.MaxMsgs = 1
+	opts.StoreFullEvents = true
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	// Without subscriptions, discarding messages loses nothing.
+	for i := 0; i < 3; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	stats, ok := s.StoreFullStats("foo")
+	if !ok || stats.Discarded != 2 || stats.Events != 0 || stats.LostSubs != 0 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+// DefaultSubBatchPrefix is the prefix of the subject on which the server
+// receives subscription batch requests. The cluster ID is appended to it.
+const DefaultSubBatchPrefix = "_STAN.subbatch"
+
+// Errors returned to subscription batch requests
+var (
+	ErrInvalidSubBatchReq = errors.New("stan: invalid subscription batch request")
+	ErrWildcardSubBatch   = errors.New("stan: wildcard subscriptions can't be batched")
+)
+
+// batchedSub is a subscription created by a batch request.
+type batchedSub struct {
+	cs      *stores.ChannelStore
+	sub     *subState
+	sr      *spb.SubscriptionRequest
+	existed bool // true if it resumed a durable, or joined an existing durable queue group
+}
+
+// subBatchSubject returns the subject the server receives subscription
+// batch requests on.
+func (s *StanServer) subBatchSubject() string {
+	return fmt.Sprintf("%s.%s", DefaultSubBatchPrefix, s.info.ClusterID)
+}
+
+// processSubBatchRequest creates the subscriptions of a batch request, all
+// of the same client, as if they were requested one after the other. If one
+// of them fails, those already created are removed, and the index of the
+// failed request is returned with the error. Messages are sent to the
+// subscriptions once the reply is sent.
+func (s *StanServer) processSubBatchRequest(m *nats.Msg) {
+	req := &spb.SubscriptionBatchRequest{}
+	err := req.Unmarshal(m.Data)
+	if err != nil || m.Reply == "" || len(req.Requests) == 0 {
+		s.log.Errorf("STAN: Invalid subscription batch request from %s.", m.Subject)
+		s.sendSubBatchResponse(m.Reply, nil, 0, ErrInvalidSubBatchReq)
+		return
+	}
+	srs := make([]*spb.SubscriptionRequest, len(req.Requests))
+	for i, b := range req.Requests {
+		sr := &spb.SubscriptionRequest{}
+		if err := sr.Unmarshal(b); err != nil || (i > 0 && sr.ClientID != srs[0].ClientID) {
+			s.log.Errorf("STAN: Invalid subscription batch request from %s.", m.Subject)
+			s.sendSubBatchResponse(m.Reply, nil, i, ErrInvalidSubBatchReq)
+			return
+		}
+		srs[i] = sr
+	}
+	if err := s.checkAdmission(); err != nil {
+		s.log.Debugf("STAN: [Client:%s] Subscription batch request rejected: %v", srs[0].ClientID, err)
+		s.sendSubBatchResponse(m.Reply, nil, 0, err)
+		return
+	}
+
+	created := make([]*batchedSub, 0, len(srs))
+	for i, sr := range srs {
+		bs := &batchedSub{sr: sr}
+		err := s.validateSubRequest(m.Subject, sr)
+		if err == nil && isWildcardSubject(sr.Subject) {
+			err = ErrWildcardSubBatch
+		}
+		if err == nil {
+			bs.existed = s.durableExists(sr)
+			bs.cs, bs.sub, err = s.createSubscription(m.Subject, sr, nil)
+		}
+		if err != nil {
+			s.log.Debugf("STAN: [Client:%s] Subscription batch request failed on %s: %v", sr.ClientID, sr.Subject, err)
+			s.removeBatchedSubs(created)
+			s.sendSubBatchResponse(m.Reply, nil, i, err)
+			return
+		}
+		created = append(created, bs)
+	}
+
+	ackInboxes := make([]string, len(created))
+	for i, bs := range created {
+		s.subscribeToAcks(bs.sub)
+		ackInboxes[i] = bs.sub.AckInbox
+	}
+	s.sendSubBatchResponse(m.Reply, ackInboxes, 0, nil)
+
+	for _, bs := range created {
+		s.sendInitialMessages(bs.cs, bs.sub, bs.sr)
+	}
+}
+
+// durableExists returns true if the subscription request resumes a durable
+// or joins an existing durable queue group.
+func (s *StanServer) durableExists(sr *spb.SubscriptionRequest) bool {
+	if sr.DurableName == "" {
+		return false
+	}
+	cs := s.store.LookupChannel(sr.Subject)
+	if cs == nil {
+		return false
+	}
+	ss := cs.UserData.(*subStore)
+	if sr.QGroup == "" {
+		return ss.LookupByDurable(durableKey(sr)) != nil
+	}
+	ss.RLock()
+	qs := ss.qsubs[durableQueueName(sr)]
+	ss.RUnlock()
+	return qs != nil
+}
+
+// removeBatchedSubs removes the subscriptions created by a batch request
+// that failed. Durables that existed before the request are closed, the
+// other subscriptions are deleted.
+func (s *StanServer) removeBatchedSubs(created []*batchedSub) {
+	for i := len(created) - 1; i >= 0; i-- {
+		bs := created[i]
+		s.clients.RemoveSub(bs.sr.ClientID, bs.sub)
+		ss := bs.cs.UserData.(*subStore)
+		s.startExclusiveConsumer(bs.cs, ss.Remove(bs.sub, !bs.existed))
+	}
+}
+
+// sendSubBatchResponse sends the outcome of a subscription batch request
+// to the requestor.
+func (s *StanServer) sendSubBatchResponse(reply string, ackInboxes []string, failed int, err error) {
+	resp := &spb.SubscriptionBatchResponse{AckInboxes: ackInboxes}
+	if err != nil {
+		resp.Error = err.Error()
+		resp.ErrorCode = int32(errorCode(err))
+		resp.Failed = int32(failed)
+	}
+	if b, err := resp.Marshal(); err == nil {
+		s.nc.Publish(reply, b)
+	}
+}
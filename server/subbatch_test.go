@@ -0,0 +1,148 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func subBatch(t *testing.T, nc *nats.Conn, s *StanServer, srs ...*spb.SubscriptionRequest) *spb.SubscriptionBatchResponse {
+	req := &spb.SubscriptionBatchRequest{}
+	for _, sr := range srs {
+		b, _ := sr.Marshal()
+		req.Requests = append(req.Requests, b)
+	}
+	b, _ := req.Marshal()
+	reply, err := nc.Request(s.subBatchSubject(), b, 2*time.Second)
+	if err != nil {
+		stackFatalf(t, "Unexpected error on request: %v", err)
+	}
+	resp := &spb.SubscriptionBatchResponse{}
+	if err := resp.Unmarshal(reply.Data); err != nil {
+		stackFatalf(t, "Unexpected response: %v", err)
+	}
+	return resp
+}
+
+func newBatchedSubReq(subject, inbox string) *spb.SubscriptionRequest {
+	return &spb.SubscriptionRequest{
+		ClientID:      clientName,
+		Subject:       subject,
+		Inbox:         inbox,
+		MaxInFlight:   stan.DefaultMaxInflight,
+		AckWaitInSecs: 30,
+		StartPosition: spb.StartPosition_NewOnly,
+	}
+}
+
+func checkClientSubs(t *testing.T, s *StanServer, expected int) {
+	c := s.clients.Lookup(clientName)
+	c.RLock()
+	n := len(c.subs)
+	c.RUnlock()
+	if n != expected {
+		stackFatalf(t, "Expected %v subscriptions, got %v", expected, n)
+	}
+}
+
+func TestSubBatch(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	inbox := nats.NewInbox()
+	msgs := make(chan *nats.Msg, 10)
+	if _, err := nc.ChanSubscribe(inbox, msgs); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	dur := newBatchedSubReq("bar", inbox)
+	dur.DurableName = "dur"
+	resp := subBatch(t, nc, s, newBatchedSubReq("foo", inbox), dur)
+	if resp.Error != "" || len(resp.AckInboxes) != 2 || resp.AckInboxes[0] == resp.AckInboxes[1] {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+	checkClientSubs(t, s, 2)
+	for _, channel := range []string{"foo", "bar"} {
+		if err := sc.Publish(channel, []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+		select {
+		case m := <-msgs:
+			msg := &spb.MsgProto{}
+			if err := msg.Unmarshal(m.Data); err != nil || msg.Subject != channel {
+				t.Fatalf("Unexpected message: %v (%v)", msg, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Did not get message on %v", channel)
+		}
+	}
+
+	// The durable is active, so a batch resuming it fails, and the
+	// subscription created before it is removed.
+	resp = subBatch(t, nc, s, newBatchedSubReq("baz", inbox), dur)
+	if resp.Error != ErrDupDurable.Error() || resp.Failed != 1 || len(resp.AckInboxes) != 0 {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+	checkClientSubs(t, s, 2)
+	ss := s.store.LookupChannel("baz").UserData.(*subStore)
+	ss.RLock()
+	n := len(ss.psubs)
+	ss.RUnlock()
+	if n != 0 {
+		t.Fatalf("Expected no subscription on baz, got %v", n)
+	}
+
+	// A durable created by a failed batch is deleted.
+	newDur := newBatchedSubReq("foo", inbox)
+	newDur.DurableName = "newdur"
+	invalid := newBatchedSubReq("foo", inbox)
+	invalid.AckWaitInSecs = 0
+	resp = subBatch(t, nc, s, newDur, invalid)
+	if resp.Error != ErrInvalidAckWait.Error() || resp.Failed != 1 {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+	checkClientSubs(t, s, 2)
+	if sub := s.store.LookupChannel("foo").UserData.(*subStore).LookupByDurable(durableKey(newDur)); sub != nil {
+		t.Fatal("Expected durable to be deleted")
+	}
+}
+
+func TestSubBatchInvalid(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	if resp := subBatch(t, nc, s); resp.Error != ErrInvalidSubBatchReq.Error() {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+	other := newBatchedSubReq("foo", nats.NewInbox())
+	other.ClientID = "other"
+	resp := subBatch(t, nc, s, newBatchedSubReq("foo", nats.NewInbox()), other)
+	if resp.Error != ErrInvalidSubBatchReq.Error() || resp.Failed != 1 {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+	resp = subBatch(t, nc, s, newBatchedSubReq("foo", nats.NewInbox()), newBatchedSubReq("foo.*", nats.NewInbox()))
+	if resp.Error != ErrWildcardSubBatch.Error() || resp.Failed != 1 {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+	checkClientSubs(t, s, 0)
+}
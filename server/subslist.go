@@ -0,0 +1,125 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"sort"
+)
+
+// SubscriptionState is the state of a subscription, returned by
+// StanServer.SubscriptionsState and the AdminOpSubscriptions operation.
+type SubscriptionState struct {
+	Channel       string `json:"channel"`
+	ID            uint64 `json:"id"`
+	ClientID      string `json:"client_id,omitempty"` // Empty for an offline durable
+	Inbox         string `json:"inbox"`
+	AckInbox      string `json:"ack_inbox"`
+	DurableName   string `json:"durable_name,omitempty"`
+	QueueGroup    string `json:"queue_group,omitempty"`
+	MaxInFlight   int32  `json:"max_inflight"`
+	AckWaitInSecs int32  `json:"ack_wait_secs"`
+	LastSent      uint64 `json:"last_sent"` // Last message sent to the queue group, for a queue subscription
+	PendingAcks   int    `json:"pending_acks"`
+	Paused        bool   `json:"paused,omitempty"`
+	Offline       bool   `json:"offline,omitempty"` // Durable whose client is not connected
+	Standby       bool   `json:"standby,omitempty"` // Waiting to take over the consumer of an exclusive channel
+
+	AckLatency *LatencyHistogram `json:"ack_latency,omitempty"` // Time between the first delivery of messages and their ack, for a durable with Options.RecordAckLatency
+}
+
+// SubscriptionsState returns the state of the subscriptions of the channel,
+// or of all the channels if empty, restricted to those of the client if
+// clientID is not empty. Offline durables are included, unless filtering by
+// client. ErrUnknownChannel is returned if the channel does not exist.
+func (s *StanServer) SubscriptionsState(channel, clientID string) ([]*SubscriptionState, error) {
+	var subStores []*subStore
+	if channel != "" {
+		cs := s.store.LookupChannel(channel)
+		if cs == nil {
+			return nil, ErrUnknownChannel
+		}
+		subStores = append(subStores, cs.UserData.(*subStore))
+	} else {
+		for _, cs := range s.store.GetChannels() {
+			subStores = append(subStores, cs.UserData.(*subStore))
+		}
+	}
+	states := []*SubscriptionState{}
+	for _, ss := range subStores {
+		ss.RLock()
+		for _, sub := range ss.psubs {
+			states = appendSubState(states, sub, clientID, 0, false)
+		}
+		for _, qs := range ss.qsubs {
+			qs.RLock()
+			lastSent := qs.lastSent
+			subs := qs.subs
+			shadow := qs.shadow
+			qs.RUnlock()
+			for _, sub := range subs {
+				states = appendSubState(states, sub, clientID, lastSent, true)
+			}
+			// The durable queue group whose members all left.
+			if shadow != nil && clientID == "" {
+				states = appendSubState(states, shadow, "", lastSent, true)
+			}
+		}
+		// Offline durables are only in the durables map.
+		if clientID == "" {
+			for _, sub := range ss.durables {
+				sub.RLock()
+				offline := sub.ClientID == ""
+				sub.RUnlock()
+				if offline {
+					states = appendSubState(states, sub, "", 0, false)
+				}
+			}
+		}
+		ss.RUnlock()
+	}
+	sort.Sort(bySubChannelAndID(states))
+	return states, nil
+}
+
+// appendSubState appends the state of the subscription if it belongs to the
+// client, or if clientID is empty. Queue subscriptions are given the last
+// sequence sent to their group.
+func appendSubState(states []*SubscriptionState, sub *subState, clientID string, qLastSent uint64, queue bool) []*SubscriptionState {
+	sub.RLock()
+	defer sub.RUnlock()
+	if clientID != "" && sub.ClientID != clientID {
+		return states
+	}
+	st := &SubscriptionState{
+		Channel:       sub.subject,
+		ID:            sub.ID,
+		ClientID:      sub.ClientID,
+		Inbox:         sub.Inbox,
+		AckInbox:      sub.AckInbox,
+		DurableName:   sub.DurableName,
+		QueueGroup:    sub.QGroup,
+		MaxInFlight:   sub.MaxInFlight,
+		AckWaitInSecs: sub.AckWaitInSecs,
+		LastSent:      sub.LastSent,
+		PendingAcks:   len(sub.acksPending),
+		Paused:        sub.paused,
+		Offline:       sub.ClientID == "",
+		Standby:       sub.standby,
+		AckLatency:    sub.ackLatencyHistogram(),
+	}
+	if queue {
+		st.LastSent = qLastSent
+	}
+	return append(states, st)
+}
+
+type bySubChannelAndID []*SubscriptionState
+
+func (s bySubChannelAndID) Len() int      { return len(s) }
+func (s bySubChannelAndID) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s bySubChannelAndID) Less(i, j int) bool {
+	if s[i].Channel != s[j].Channel {
+		return s[i].Channel < s[j].Channel
+	}
+	return s[i].ID < s[j].ID
+}
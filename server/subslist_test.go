@@ -0,0 +1,116 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestSubscriptionsState(t *testing.T) {
+	s := runServerWithAdminUsers()
+	defer s.Shutdown()
+
+	// A durable of another client, offline once this client is closed.
+	sc2, err := stan.Connect(clusterName, "other")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	if _, err := sc2.Subscribe("bar", func(_ *stan.Msg) {}, stan.DurableName("dur")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	sc2.Close()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	// The message is never acknowledged by the plain subscription.
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}, stan.SetManualAckMode()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if _, err := sc.QueueSubscribe("foo", "group", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	waitForCount(t, 1, func() (string, int) {
+		states, _ := s.SubscriptionsState("foo", "")
+		return "pending acks", states[0].PendingAcks + states[1].PendingAcks
+	})
+
+	states, err := s.SubscriptionsState("", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(states) != 3 {
+		t.Fatalf("Expected 3 subscriptions, got %v", len(states))
+	}
+	if st := states[0]; st.Channel != "bar" || st.DurableName != "dur" || !st.Offline || st.ClientID != "" {
+		t.Fatalf("Unexpected offline durable: %+v", st)
+	}
+	// The IDs of the subscriptions created lazily depend on the order of
+	// their first message.
+	plain, queue := states[1], states[2]
+	if plain.QueueGroup != "" {
+		plain, queue = queue, plain
+	}
+	if plain.Channel != "foo" || plain.ClientID != clientName || plain.LastSent != 1 ||
+		plain.PendingAcks != 1 || plain.Offline {
+		t.Fatalf("Unexpected plain subscription: %+v", plain)
+	}
+	if queue.Channel != "foo" || queue.QueueGroup != "group" || queue.LastSent != 1 || queue.PendingAcks != 0 {
+		t.Fatalf("Unexpected queue subscription: %+v", queue)
+	}
+
+	// Filtered by client, offline durables are not listed.
+	if states, _ := s.SubscriptionsState("", clientName); len(states) != 2 {
+		t.Fatalf("Expected 2 subscriptions, got %v", len(states))
+	}
+	if states, _ := s.SubscriptionsState("bar", ""); len(states) != 1 {
+		t.Fatalf("Expected 1 subscription, got %v", len(states))
+	}
+	if _, err := s.SubscriptionsState("baz", ""); err != ErrUnknownChannel {
+		t.Fatalf("Expected error %v, got %v", ErrUnknownChannel, err)
+	}
+}
+
+func TestAdminSubscriptions(t *testing.T) {
+	s := runServerWithAdminUsers()
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}, stan.DurableName("dur")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	req := &spb.AdminRequest{Token: adminReadToken, Operation: AdminOpSubscriptions, Channel: "foo"}
+	resp := sendAdminRequest(t, nc, req)
+	if resp.Error != "" {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+	var states []*SubscriptionState
+	if err := json.Unmarshal(resp.Data, &states); err != nil {
+		t.Fatalf("Unexpected error on unmarshal: %v", err)
+	}
+	if len(states) != 1 || states[0].ClientID != clientName || states[0].DurableName != "dur" ||
+		states[0].AckWaitInSecs != int32(stan.DefaultAckWait/time.Second) {
+		t.Fatalf("Unexpected subscriptions: %+v", states)
+	}
+
+	req.Channel = "bar"
+	if resp := sendAdminRequest(t, nc, req); resp.Error != ErrUnknownChannel.Error() {
+		t.Fatalf("Expected error %q, got %q", ErrUnknownChannel, resp.Error)
+	}
+}
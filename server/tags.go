@@ -0,0 +1,185 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// TagUsagePath is the HTTP path of the usage of the client tags, served
+	// on Options.InfoListen.
+	TagUsagePath = "/tagz"
+
+	// Maximum number of tags of a client, and length of their keys and values.
+	maxClientTags      = 16
+	maxClientTagLength = 64
+)
+
+// ErrInvalidClientTags is returned to connect requests with too many tags,
+// or tags with an empty or too long key or value.
+var ErrInvalidClientTags = errors.New("stan: invalid client tags")
+
+// ClientTagger can be implemented by an Authorizer to set the tags of the
+// clients it allows to connect, for instance from their credentials, instead
+// of trusting those in the connect requests.
+type ClientTagger interface {
+	// ClientTags returns the tags of the client, given those it requested.
+	ClientTags(clientID string, requested map[string]string) map[string]string
+}
+
+// TagUsage is what the clients with a given tag published and received
+// since the server started. The tag is formatted as `key=value`.
+type TagUsage struct {
+	Tag            string `json:"tag"`
+	Clients        int    `json:"clients"`
+	PubMsgs        uint64 `json:"pub_msgs"`
+	PubBytes       uint64 `json:"pub_bytes"`
+	DeliveredMsgs  uint64 `json:"delivered_msgs"`
+	DeliveredBytes uint64 `json:"delivered_bytes"`
+}
+
+// tagCounters are the counters of a tag, updated atomically.
+type tagCounters struct {
+	pubMsgs        uint64
+	pubBytes       uint64
+	deliveredMsgs  uint64
+	deliveredBytes uint64
+	clients        int // protected by the clientTags lock
+}
+
+// clientTags aggregates the messages published and received by the
+// connected clients by tag. The counters of a tag are kept once its last
+// client is closed.
+type clientTags struct {
+	sync.RWMutex
+	tagged  int32                     // number of tagged clients (updated atomically)
+	clients map[string][]*tagCounters // counters of the tags of each tagged client
+	tags    map[string]*tagCounters
+}
+
+func newClientTags() *clientTags {
+	return &clientTags{
+		clients: make(map[string][]*tagCounters),
+		tags:    make(map[string]*tagCounters),
+	}
+}
+
+// resolveClientTags returns the tags of a connecting client: those set by
+// the Authorizer if it is a ClientTagger, otherwise those requested.
+func (s *StanServer) resolveClientTags(clientID string, requested map[string]string) (map[string]string, error) {
+	tags := requested
+	if tagger, ok := s.opts.Authorizer.(ClientTagger); ok && !s.isInternalClient(clientID, OpConnect) {
+		tags = tagger.ClientTags(clientID, requested)
+	}
+	if len(tags) > maxClientTags {
+		return nil, ErrInvalidClientTags
+	}
+	for k, v := range tags {
+		if k == "" || v == "" || strings.Contains(k, "=") ||
+			len(k) > maxClientTagLength || len(v) > maxClientTagLength {
+			return nil, ErrInvalidClientTags
+		}
+	}
+	return tags, nil
+}
+
+// addClient starts counting the usage of the client for its tags.
+func (ct *clientTags) addClient(clientID string, tags map[string]string) {
+	if len(tags) == 0 {
+		return
+	}
+	counters := make([]*tagCounters, 0, len(tags))
+	ct.Lock()
+	for k, v := range tags {
+		tag := k + "=" + v
+		tc := ct.tags[tag]
+		if tc == nil {
+			tc = &tagCounters{}
+			ct.tags[tag] = tc
+		}
+		tc.clients++
+		counters = append(counters, tc)
+	}
+	ct.clients[clientID] = counters
+	ct.Unlock()
+	atomic.AddInt32(&ct.tagged, 1)
+}
+
+// removeClient stops counting the usage of a closed client.
+func (ct *clientTags) removeClient(clientID string) {
+	if atomic.LoadInt32(&ct.tagged) == 0 {
+		return
+	}
+	ct.Lock()
+	counters, ok := ct.clients[clientID]
+	if ok {
+		for _, tc := range counters {
+			tc.clients--
+		}
+		delete(ct.clients, clientID)
+	}
+	ct.Unlock()
+	if ok {
+		atomic.AddInt32(&ct.tagged, -1)
+	}
+}
+
+// lookup returns the counters of the tags of the client, nil if it has no
+// tags.
+func (ct *clientTags) lookup(clientID string) []*tagCounters {
+	if atomic.LoadInt32(&ct.tagged) == 0 {
+		return nil
+	}
+	ct.RLock()
+	counters := ct.clients[clientID]
+	ct.RUnlock()
+	return counters
+}
+
+// published counts a message published by the client.
+func (ct *clientTags) published(clientID string, size int) {
+	for _, tc := range ct.lookup(clientID) {
+		atomic.AddUint64(&tc.pubMsgs, 1)
+		atomic.AddUint64(&tc.pubBytes, uint64(size))
+	}
+}
+
+// delivered counts a message sent to the client.
+func (ct *clientTags) delivered(clientID string, size int) {
+	for _, tc := range ct.lookup(clientID) {
+		atomic.AddUint64(&tc.deliveredMsgs, 1)
+		atomic.AddUint64(&tc.deliveredBytes, uint64(size))
+	}
+}
+
+// TagUsage returns the usage of each client tag, sorted by tag.
+func (s *StanServer) TagUsage() []*TagUsage {
+	ct := s.clientTags
+	ct.RLock()
+	usage := make([]*TagUsage, 0, len(ct.tags))
+	for tag, tc := range ct.tags {
+		usage = append(usage, &TagUsage{
+			Tag:            tag,
+			Clients:        tc.clients,
+			PubMsgs:        atomic.LoadUint64(&tc.pubMsgs),
+			PubBytes:       atomic.LoadUint64(&tc.pubBytes),
+			DeliveredMsgs:  atomic.LoadUint64(&tc.deliveredMsgs),
+			DeliveredBytes: atomic.LoadUint64(&tc.deliveredBytes),
+		})
+	}
+	ct.RUnlock()
+	sort.Sort(byTag(usage))
+	return usage
+}
+
+// byTag sorts the usage of the client tags by tag.
+type byTag []*TagUsage
+
+func (a byTag) Len() int           { return len(a) }
+func (a byTag) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byTag) Less(i, j int) bool { return a[i].Tag < a[j].Tag }
@@ -0,0 +1,130 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// teamTagger tags the clients with the team prefixing their client ID.
+type teamTagger struct{}
+
+func (teamTagger) Authorize(clientID, channel, operation string) error { return nil }
+
+func (teamTagger) ClientTags(clientID string, requested map[string]string) map[string]string {
+	return map[string]string{"team": strings.SplitN(clientID, "-", 2)[0]}
+}
+
+func checkTagUsage(t *testing.T, s *StanServer, expected ...TagUsage) {
+	var usage []*TagUsage
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		usage = s.TagUsage()
+		ok := len(usage) == len(expected)
+		for i := 0; ok && i < len(usage); i++ {
+			ok = *usage[i] == expected[i]
+		}
+		if ok {
+			return
+		}
+		time.Sleep(15 * time.Millisecond)
+	}
+	stackFatalf(t, "Expected tag usage %+v, got %+v", expected, usage)
+}
+
+func TestClientTagsFromAuthorizer(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.Authorizer = teamTagger{}
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	pub, err := stan.Connect(clusterName, "payments-pub")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer pub.Close()
+	sub, err := stan.Connect(clusterName, "search-sub")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer sub.Close()
+
+	msgs := make(chan *stan.Msg, 10)
+	if _, err := sub.Subscribe("foo", func(m *stan.Msg) { msgs <- m }); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := pub.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	for seq := uint64(1); seq <= 3; seq++ {
+		checkMsgSeq(t, msgs, seq)
+	}
+	checkTagUsage(t, s,
+		TagUsage{Tag: "team=payments", Clients: 1, PubMsgs: 3, PubBytes: 15},
+		TagUsage{Tag: "team=search", Clients: 1, DeliveredMsgs: 3, DeliveredBytes: 15})
+
+	// The usage is kept once the clients are closed.
+	pub.Close()
+	checkTagUsage(t, s,
+		TagUsage{Tag: "team=payments", PubMsgs: 3, PubBytes: 15},
+		TagUsage{Tag: "team=search", Clients: 1, DeliveredMsgs: 3, DeliveredBytes: 15})
+}
+
+func TestClientTagsInConnectRequest(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	connSubj := fmt.Sprintf("%s.%s", s.opts.DiscoverPrefix, clusterName)
+	connect := func(clientID string, tags map[string]string) string {
+		req := &spb.ConnectRequest{ClientID: clientID, HeartbeatInbox: nats.NewInbox(), Tags: tags}
+		b, _ := req.Marshal()
+		resp, err := nc.Request(connSubj, b, time.Second)
+		if err != nil {
+			stackFatalf(t, "Unexpected error on publishing request: %v", err)
+		}
+		r := &spb.ConnectResponse{}
+		if err := r.Unmarshal(resp.Data); err != nil {
+			stackFatalf(t, "Unexpected response object: %v", err)
+		}
+		return r.Error
+	}
+
+	if errTxt := connect("me", map[string]string{"team": "payments", "env": "prod"}); errTxt != "" {
+		t.Fatalf("Unexpected error on connect: %v", errTxt)
+	}
+	if errTxt := connect("other", map[string]string{"team": "payments"}); errTxt != "" {
+		t.Fatalf("Unexpected error on connect: %v", errTxt)
+	}
+	checkTagUsage(t, s,
+		TagUsage{Tag: "env=prod", Clients: 1},
+		TagUsage{Tag: "team=payments", Clients: 2})
+
+	for _, tags := range []map[string]string{
+		{"": "payments"},
+		{"team": ""},
+		{"a=b": "c"},
+		{"team": strings.Repeat("x", maxClientTagLength+1)},
+	} {
+		if errTxt := connect("invalid", tags); errTxt != ErrInvalidClientTags.Error() {
+			t.Fatalf("Expected error %q for tags %v, got %q", ErrInvalidClientTags, tags, errTxt)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+// freezeClientSubs halts the deliveries and redeliveries to the subscriptions
+// of a client whose ID is used by an incoming connection, while the server
+// checks if this client is still alive. It returns the frozen subscriptions.
+func (s *StanServer) freezeClientSubs(sc *client) []*subState {
+	sc.RLock()
+	subs := make([]*subState, len(sc.subs))
+	copy(subs, sc.subs)
+	sc.RUnlock()
+	for _, sub := range subs {
+		sub.Lock()
+		sub.frozen = true
+		sub.Unlock()
+	}
+	return subs
+}
+
+// unfreezeSubs resumes the deliveries to the subscriptions frozen by
+// freezeClientSubs. If the client was replaced, its subscriptions are
+// removed and its durables are offline, so their pending messages wait for
+// the new connection to resubscribe. Otherwise, the messages stored in the
+// meantime are sent and the pending ones are redelivered when their AckWait
+// expires, as usual.
+func (s *StanServer) unfreezeSubs(subs []*subState) {
+	for _, sub := range subs {
+		sub.Lock()
+		sub.frozen = false
+		subject := sub.subject
+		qs := sub.qstate
+		// The client of a removed subscription is cleared.
+		online := sub.ClientID != ""
+		sub.Unlock()
+		if !online {
+			continue
+		}
+		cs := s.store.LookupChannel(subject)
+		if cs == nil {
+			continue
+		}
+		if qs != nil {
+			s.sendAvailableMessagesToQueue(cs, qs)
+		} else {
+			s.sendAvailableMessages(cs, sub)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats"
+)
+
+func TestFreezeOnTakeover(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.FreezeOnTakeover = true
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+	s.dupCIDTimeout = time.Second
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+	sc, err := stan.Connect(clusterName, clientName, stan.NatsConn(nc))
+	if err != nil {
+		t.Fatalf("Expected to connect correctly, got err %v", err)
+	}
+	defer sc.Close()
+	if _, err := sc.Subscribe("foo", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if _, err := sc.Subscribe("bar", func(_ *stan.Msg) {}, stan.DurableName("dur")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	states, _ := s.SubscriptionsState("", clientName)
+	if len(states) != 2 {
+		t.Fatalf("Expected 2 subscriptions, got %v", len(states))
+	}
+	// The old client is dead.
+	nc.Close()
+
+	// Watch the inboxes of the old client.
+	watcher, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer watcher.Close()
+	received := make(chan *nats.Msg, 10)
+	for _, st := range states {
+		if _, err := watcher.ChanSubscribe(st.Inbox, received); err != nil {
+			t.Fatalf("Unexpected error on subscribe: %v", err)
+		}
+	}
+	if err := watcher.Flush(); err != nil {
+		t.Fatalf("Unexpected error on flush: %v", err)
+	}
+
+	connected := make(chan stan.Conn, 1)
+	go func() {
+		sc2, err := stan.Connect(clusterName, clientName, stan.ConnectWait(3*s.dupCIDTimeout))
+		if err != nil {
+			t.Errorf("Expected to replace the old client, got err %v", err)
+		}
+		connected <- sc2
+	}()
+	// Wait for the server to start checking the old client.
+	waitForCount(t, 1, func() (string, int) {
+		s.dupCIDGuard.RLock()
+		defer s.dupCIDGuard.RUnlock()
+		return "takeovers in progress", len(s.dupCIDMap)
+	})
+	pubsc, err := stan.Connect(clusterName, "publisher")
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer pubsc.Close()
+	for _, channel := range []string{"foo", "bar"} {
+		if err := pubsc.Publish(channel, []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+
+	sc2 := <-connected
+	if sc2 == nil {
+		t.FailNow()
+	}
+	defer sc2.Close()
+	select {
+	case m := <-received:
+		t.Fatalf("Unexpected message sent to the old client on %s", m.Subject)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The durable gets its message once the new connection resubscribes.
+	ch := make(chan *stan.Msg, 1)
+	if _, err := sc2.Subscribe("bar", func(m *stan.Msg) { ch <- m }, stan.DurableName("dur")); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	select {
+	case m := <-ch:
+		if m.Sequence != 1 || m.Redelivered {
+			t.Fatalf("Unexpected message: %v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Did not receive the message")
+	}
+}
+
+func TestFreezeOnTakeoverClientAlive(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.FreezeOnTakeover = true
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+	s.dupCIDTimeout = time.Second
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	ch := make(chan *stan.Msg, 1)
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) { ch <- m }); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if _, err := stan.Connect(clusterName, clientName); err == nil {
+		t.Fatal("Expected the connection to fail")
+	}
+	// The old client replied, its subscription is resumed.
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	select {
+	case <-ch:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Did not receive the message")
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+// ErrNoDurableTombstone is returned when restoring a durable that was not
+// unsubscribed, or whose grace period has expired.
+var ErrNoDurableTombstone = errors.New("stan: no unsubscribed durable to restore")
+
+// durableTombstone is an unsubscribed durable, kept in memory during
+// Options.DurableGracePeriod so that it can be restored.
+type durableTombstone struct {
+	sub      *subState
+	clientID string
+	cs       *stores.ChannelStore
+	timer    util.Timer
+}
+
+// durableTombstones are the durables unsubscribed during the grace period,
+// keyed by durable key.
+type durableTombstones struct {
+	sync.Mutex
+	entries map[string]*durableTombstone
+}
+
+// addDurableTombstone keeps the durable, about to be unsubscribed, for the
+// grace period. It does nothing for non durable subscriptions or if the
+// grace period is not set.
+func (s *StanServer) addDurableTombstone(cs *stores.ChannelStore, sub *subState) {
+	grace := s.opts.DurableGracePeriod
+	if grace <= 0 {
+		return
+	}
+	sub.RLock()
+	// Durable queue groups are deleted with their last member.
+	if sub.DurableName == "" || sub.QGroup != "" {
+		sub.RUnlock()
+		return
+	}
+	key := sub.durableKey()
+	durableName, channel := sub.DurableName, sub.subject
+	t := &durableTombstone{sub: sub, clientID: sub.ClientID, cs: cs}
+	sub.RUnlock()
+
+	ts := &s.tombstones
+	ts.Lock()
+	if ts.entries == nil {
+		ts.entries = make(map[string]*durableTombstone)
+	}
+	if old := ts.entries[key]; old != nil {
+		old.timer.Stop()
+	}
+	t.timer = s.clock.AfterFunc(grace, func() {
+		ts.Lock()
+		if ts.entries[key] == t {
+			delete(ts.entries, key)
+		}
+		ts.Unlock()
+	})
+	ts.entries[key] = t
+	ts.Unlock()
+	s.log.Debugf("STAN: [Client:%s] Durable %s on %s can be restored for %v", t.clientID, durableName, channel, grace)
+}
+
+// RestoreDurable restores a durable unsubscribed less than
+// Options.DurableGracePeriod ago. The durable is restored offline, with the
+// position and the unacknowledged messages it had when it was unsubscribed,
+// and resumes from there when its client subscribes again with the same
+// durable name. ErrNoDurableTombstone is returned if there is no such
+// durable, or if its channel was deleted since, and ErrDupDurable if the
+// durable was subscribed again in the meantime.
+func (s *StanServer) RestoreDurable(clientID, channel, durableName string) error {
+	key := durableKey(&spb.SubscriptionRequest{ClientID: clientID, Subject: channel, DurableName: durableName})
+	ts := &s.tombstones
+	ts.Lock()
+	defer ts.Unlock()
+	t := ts.entries[key]
+	if t == nil {
+		return ErrNoDurableTombstone
+	}
+	cs := s.store.LookupChannel(channel)
+	if cs != t.cs {
+		// The channel was deleted, with the messages of the durable.
+		t.timer.Stop()
+		delete(ts.entries, key)
+		return ErrNoDurableTombstone
+	}
+	ss := cs.UserData.(*subStore)
+	if ss.LookupByDurable(key) != nil {
+		return ErrDupDurable
+	}
+	if !ss.hasRoomForSub(cs.Subs) {
+		return stores.ErrTooManySubs
+	}
+
+	sub := t.sub
+	sub.RLock()
+	// The subscription keeps the ID of its client in the store, so that
+	// it is recovered as a durable of this client.
+	state := sub.SubState
+	state.ClientID = t.clientID
+	pending := make([]uint64, 0, len(sub.acksPending))
+	for seq := range sub.acksPending {
+		pending = append(pending, seq)
+	}
+	sub.RUnlock()
+	if err := cs.Subs.CreateSub(&state); err != nil {
+		return err
+	}
+	for _, seq := range pending {
+		if err := cs.Subs.AddSeqPending(state.ID, seq); err != nil {
+			cs.Subs.DeleteSub(state.ID)
+			return err
+		}
+	}
+	sub.Lock()
+	sub.ID = state.ID
+	sub.Unlock()
+	ss.Lock()
+	ss.durables[key] = sub
+	ss.Unlock()
+
+	t.timer.Stop()
+	delete(ts.entries, key)
+	s.log.Noticef("STAN: [Client:%s] Restored durable %s on %s", clientID, durableName, channel)
+	return nil
+}
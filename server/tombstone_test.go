@@ -0,0 +1,211 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+func checkDurablesCount(t *testing.T, s *StanServer, channel string, expected int) {
+	ss := s.store.LookupChannel(channel).UserData.(*subStore)
+	ss.RLock()
+	n := len(ss.durables)
+	ss.RUnlock()
+	if n != expected {
+		stackFatalf(t, "Expected %v durables, got %v", expected, n)
+	}
+}
+
+func TestRestoreDurable(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.StoreType = stores.TypeFile
+	opts.FilestoreDir = defaultDataStore
+	opts.DurableGracePeriod = time.Hour
+	s := runServerWithOpts(opts)
+	defer shutdownRestartedServerOnTestExit(&s)
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	ch := make(chan *stan.Msg, 10)
+	cb := func(m *stan.Msg) { ch <- m }
+	sub, err := sc.Subscribe("foo", cb, stan.DurableName("dur"), stan.SetManualAckMode())
+	if err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case m := <-ch:
+			// Only the first message is acknowledged.
+			if m.Sequence == 1 {
+				m.Ack()
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Did not receive the messages")
+		}
+	}
+	waitForCount(t, 2, func() (string, int) {
+		subs := s.clients.GetSubs(clientName)
+		subs[0].RLock()
+		defer subs[0].RUnlock()
+		return "ack pending", len(subs[0].acksPending)
+	})
+
+	// Unsubscribing by mistake deletes the durable.
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatalf("Unexpected error on unsubscribe: %v", err)
+	}
+	checkDurablesCount(t, s, "foo", 0)
+	if err := s.RestoreDurable(clientName, "foo", "other"); err != ErrNoDurableTombstone {
+		t.Fatalf("Expected error %v, got %v", ErrNoDurableTombstone, err)
+	}
+	if err := s.RestoreDurable(clientName, "foo", "dur"); err != nil {
+		t.Fatalf("Unexpected error on restore: %v", err)
+	}
+	checkDurablesCount(t, s, "foo", 1)
+	if err := s.RestoreDurable(clientName, "foo", "dur"); err != ErrNoDurableTombstone {
+		t.Fatalf("Expected error %v, got %v", ErrNoDurableTombstone, err)
+	}
+
+	// The restored durable is written to the store.
+	sc.Close()
+	s.Shutdown()
+	s = runServerWithOpts(opts)
+	sc = NewDefaultConnection(t)
+	defer sc.Close()
+
+	// It resumes with its unacknowledged messages.
+	if _, err := sc.Subscribe("foo", cb, stan.DurableName("dur"), stan.SetManualAckMode()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	received := make(map[uint64]bool)
+	for i := 0; i < 3; i++ {
+		select {
+		case m := <-ch:
+			received[m.Sequence] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Did not receive the messages, got %v", received)
+		}
+	}
+	if !received[2] || !received[3] || !received[4] {
+		t.Fatalf("Unexpected messages: %v", received)
+	}
+}
+
+func TestRestoreDurableGracePeriod(t *testing.T) {
+	clock := util.NewManualClock(time.Now())
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.Clock = clock
+	opts.DurableGracePeriod = time.Minute
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	subscribe := func() stan.Subscription {
+		sub, err := sc.Subscribe("foo", func(_ *stan.Msg) {}, stan.DurableName("dur"))
+		if err != nil {
+			stackFatalf(t, "Unexpected error on subscribe: %v", err)
+		}
+		return sub
+	}
+	if err := subscribe().Unsubscribe(); err != nil {
+		t.Fatalf("Unexpected error on unsubscribe: %v", err)
+	}
+	clock.Advance(2 * time.Minute)
+	if err := s.RestoreDurable(clientName, "foo", "dur"); err != ErrNoDurableTombstone {
+		t.Fatalf("Expected error %v, got %v", ErrNoDurableTombstone, err)
+	}
+
+	// The durable can't be restored once subscribed again.
+	if err := subscribe().Unsubscribe(); err != nil {
+		t.Fatalf("Unexpected error on unsubscribe: %v", err)
+	}
+	subscribe()
+	if err := s.RestoreDurable(clientName, "foo", "dur"); err != ErrDupDurable {
+		t.Fatalf("Expected error %v, got %v", ErrDupDurable, err)
+	}
+}
+
+func TestRestoreDurableDisabled(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	sub, err := sc.Subscribe("foo", func(_ *stan.Msg) {}, stan.DurableName("dur"))
+	if err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatalf("Unexpected error on unsubscribe: %v", err)
+	}
+	if err := s.RestoreDurable(clientName, "foo", "dur"); err != ErrNoDurableTombstone {
+		t.Fatalf("Expected error %v, got %v", ErrNoDurableTombstone, err)
+	}
+}
+
+func TestAdminRestoreDurable(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.DurableGracePeriod = time.Hour
+	opts.AdminUsers = []*AdminUser{
+		{Name: "read", Token: util.NewSecret(adminReadToken), Role: RoleReadOnly},
+		{Name: "operator", Token: util.NewSecret(adminOperatorToken), Role: RoleOperator},
+	}
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	sub, err := sc.Subscribe("foo", func(_ *stan.Msg) {}, stan.DurableName("dur"))
+	if err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatalf("Unexpected error on unsubscribe: %v", err)
+	}
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatalf("Unexpected error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	req := &spb.AdminRequest{Token: adminReadToken, Operation: AdminOpRestoreDurable,
+		ClientID: clientName, Channel: "foo", DurableName: "dur"}
+	if resp := sendAdminRequest(t, nc, req); resp.Error != ErrAdminForbidden.Error() {
+		t.Fatalf("Expected error %q, got %q", ErrAdminForbidden, resp.Error)
+	}
+	req.Token = adminOperatorToken
+	if resp := sendAdminRequest(t, nc, req); resp.Error != "" {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+	checkDurablesCount(t, s, "foo", 1)
+	if resp := sendAdminRequest(t, nc, req); resp.Error != ErrNoDurableTombstone.Error() {
+		t.Fatalf("Expected error %q, got %q", ErrNoDurableTombstone, resp.Error)
+	}
+}
@@ -0,0 +1,412 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nats-io/gnatsd/server"
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+// ValidationCheck holds the outcome of one of the checks performed
+// by Validate.
+type ValidationCheck struct {
+	Name   string // Name of the check (options, store, nats)
+	Detail string // Information about what has been checked
+	Err    error  // Non nil if the check failed
+}
+
+// ValidationReport is the result of Validate.
+type ValidationReport struct {
+	Checks []*ValidationCheck
+}
+
+// add records the outcome of a check.
+func (r *ValidationReport) add(name, detail string, err error) {
+	r.Checks = append(r.Checks, &ValidationCheck{Name: name, Detail: detail, Err: err})
+}
+
+// OK returns true if none of the checks failed.
+func (r *ValidationReport) OK() bool {
+	for _, c := range r.Checks {
+		if c.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns a human readable version of the report.
+func (r *ValidationReport) String() string {
+	var b bytes.Buffer
+	for _, c := range r.Checks {
+		status := "OK"
+		if c.Err != nil {
+			status = "FAILED"
+		}
+		fmt.Fprintf(&b, "[%-6s] %-7s: %s", status, c.Name, c.Detail)
+		if c.Err != nil {
+			fmt.Fprintf(&b, " (%v)", c.Err)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Validate checks the given options without serving traffic. It verifies
+// the store options, recovers the store (if any) to check that its cluster
+// ID matches the one from the options, and checks that the NATS Server
+// can be reached (or that the embedded one could be started). The files
+// of a file store are only read, other stores are opened and closed, but
+// never initialized.
+func Validate(stanOpts *Options, natsOpts *server.Options) *ValidationReport {
+	sOpts := stanOpts
+	nOpts := natsOpts
+
+	if stanOpts == nil {
+		sOpts = GetDefaultOptions()
+	}
+	if natsOpts == nil {
+		no := DefaultNatsServerOptions
+		nOpts = &no
+	}
+
+	r := &ValidationReport{}
+
+	err := validateOptions(sOpts)
+	r.add("options", fmt.Sprintf("cluster ID %q, store type %s", sOpts.ID, strings.ToUpper(sOpts.StoreType)), err)
+	// No point going further if the options are invalid
+	if err != nil {
+		return r
+	}
+	detail, err := validateStore(sOpts)
+	r.add("store", detail, err)
+	detail, err = validateNATS(sOpts, nOpts)
+	r.add("nats", detail, err)
+	return r
+}
+
+// validateOptions checks the STAN options for inconsistencies.
+func validateOptions(opts *Options) error {
+	if opts.ID == "" {
+		return fmt.Errorf("cluster ID must be specified")
+	}
+	switch strings.ToUpper(opts.StoreType) {
+	case stores.TypeFile:
+		if opts.FilestoreDir == "" {
+			return fmt.Errorf("for %v stores, root directory must be specified", stores.TypeFile)
+		}
+		switch opts.FileStoreOpts.Compression {
+		case stores.CompressionNone, stores.CompressionGzip, stores.CompressionSnappy:
+		default:
+			return fmt.Errorf("unsupported compression %q", opts.FileStoreOpts.Compression)
+		}
+		if opts.FileStoreOpts.FlushInterval < 0 || opts.FileStoreOpts.FlushBytes < 0 ||
+			opts.FileStoreOpts.AckFlushInterval < 0 {
+			return fmt.Errorf("file flush interval, bytes and ack flush interval can't be negative")
+		}
+		if opts.FileStoreOpts.SliceMaxMsgs < 0 || opts.FileStoreOpts.SliceMaxBytes < 0 {
+			return fmt.Errorf("file slice max msgs and bytes can't be negative")
+		}
+		for _, subject := range opts.FileStoreOpts.RecoverChannels {
+			if !util.IsValidSubjectPattern(subject) {
+				return fmt.Errorf("invalid subject %q in file recover channels", subject)
+			}
+		}
+	case stores.TypeSQL:
+		if opts.SQLDriver == "" || opts.SQLSource == "" {
+			return fmt.Errorf("for %v stores, driver and data source must be specified", stores.TypeSQL)
+		}
+	case stores.TypeHybrid:
+		if opts.FilestoreDir == "" {
+			return fmt.Errorf("for %v stores, root directory must be specified", stores.TypeHybrid)
+		}
+	case stores.TypeKV:
+		if opts.FilestoreDir == "" {
+			return fmt.Errorf("for %v stores, root directory must be specified", stores.TypeKV)
+		}
+	case stores.TypeMemory:
+		switch opts.MemoryEviction {
+		case "", stores.EvictProportional, stores.EvictLRU:
+		default:
+			return fmt.Errorf("unsupported memory eviction policy %q", opts.MemoryEviction)
+		}
+	default:
+		if stores.LookupFactory(opts.StoreType) == nil {
+			return fmt.Errorf("unsupported store type: %v", opts.StoreType)
+		}
+	}
+	if len(opts.FileStoreOpts.RecoverChannels) > 0 && strings.ToUpper(opts.StoreType) != stores.TypeFile {
+		return fmt.Errorf("recovering selected channels is only supported by %v stores", stores.TypeFile)
+	}
+	if opts.MaxChannels < 0 || opts.MaxMsgs < 0 || opts.MaxSubscriptions < 0 || opts.MaxInactivity < 0 {
+		return fmt.Errorf("channel limits can't be negative")
+	}
+	// Zero means that the messages are processed as they come in.
+	if opts.IOBatchSize < 0 {
+		return fmt.Errorf("IO batch size can't be negative")
+	}
+	if opts.ClientHBInterval < 0 || opts.ClientHBTimeout < 0 || opts.ClientHBFailCount < 0 || opts.ClientHBMaxInterval < 0 {
+		return fmt.Errorf("heartbeat options can't be negative")
+	}
+	if hbInterval := opts.ClientHBInterval; opts.ClientHBMaxInterval > 0 {
+		if hbInterval == 0 {
+			hbInterval = DefaultHeartBeatInterval
+		}
+		if opts.ClientHBMaxInterval < hbInterval {
+			return fmt.Errorf("max heartbeat interval can't be lower than the heartbeat interval (%v)", hbInterval)
+		}
+	}
+	if opts.DurableGracePeriod < 0 {
+		return fmt.Errorf("durable grace period can't be negative")
+	}
+	if opts.SlowRequestTime < 0 {
+		return fmt.Errorf("slow request time can't be negative")
+	}
+	if opts.AckTimerSlack < 0 {
+		return fmt.Errorf("ack timer slack can't be negative")
+	}
+	if opts.DedupWindow < 0 {
+		return fmt.Errorf("deduplication window can't be negative")
+	}
+	if opts.MaxInflightPerSub < 0 {
+		return fmt.Errorf("max inflight per subscription can't be negative")
+	}
+	if opts.MaxOrderingGroups < 0 {
+		return fmt.Errorf("max ordering groups can't be negative")
+	}
+	if opts.InfoListen != "" {
+		if _, _, err := net.SplitHostPort(opts.InfoListen); err != nil {
+			return fmt.Errorf("invalid info listen address %q: %v", opts.InfoListen, err)
+		}
+	}
+	if opts.MaxRedeliveries < 0 {
+		return fmt.Errorf("max redeliveries can't be negative")
+	}
+	if opts.SubRate < 0 || opts.SubBurst < 0 || opts.ClientSubRate < 0 || opts.ClientSubBurst < 0 {
+		return fmt.Errorf("subscription rate limits can't be negative")
+	}
+	if opts.MaxPubAcksInFlight < 0 || opts.ClientPubRate < 0 || opts.ClientPubBurst < 0 ||
+		opts.ClientPubBytesRate < 0 || opts.ClientPubBytesBurst < 0 {
+		return fmt.Errorf("publish limits can't be negative")
+	}
+	if opts.MaxClientsPerConn < 0 || opts.MaxChannelsPerConn < 0 {
+		return fmt.Errorf("connection limits can't be negative")
+	}
+	if opts.MaxClients < 0 || opts.MaxSubsPerClient < 0 {
+		return fmt.Errorf("client limits can't be negative")
+	}
+	if (opts.MaxClientsPerConn > 0 || opts.MaxChannelsPerConn > 0) && opts.NATSServerURL != "" {
+		return fmt.Errorf("connection limits require the embedded NATS Server")
+	}
+	if opts.BacklogHintInterval < 0 {
+		return fmt.Errorf("backlog hint interval can't be negative")
+	}
+	if opts.StoreFullInterval < 0 {
+		return fmt.Errorf("store full interval can't be negative")
+	}
+	if err := validateDeliveryWorkers(opts); err != nil {
+		return err
+	}
+	if opts.DrainTimeout < 0 {
+		return fmt.Errorf("drain timeout can't be negative")
+	}
+	if opts.HandoffWindow < 0 {
+		return fmt.Errorf("handoff window can't be negative")
+	}
+	if opts.Handoff && opts.NATSServerURL != "" {
+		return fmt.Errorf("handoff requires the embedded NATS Server")
+	}
+	if opts.Password != nil && opts.Password.IsSet() && opts.Username == "" {
+		return fmt.Errorf("password of the NATS connection requires a user")
+	}
+	if opts.Username != "" && opts.Token != nil && opts.Token.IsSet() {
+		return fmt.Errorf("NATS connection can't use both a user and a token")
+	}
+	if opts.DeadLetterPrefix != "" && !isValidSubject(opts.DeadLetterPrefix) {
+		return fmt.Errorf("invalid dead-letter prefix %q", opts.DeadLetterPrefix)
+	}
+	if err := validatePlacement(opts.ChannelPlacement); err != nil {
+		return err
+	}
+	if err := validateWebhooks(opts.Webhooks); err != nil {
+		return err
+	}
+	if err := validateShovels(opts.Shovels); err != nil {
+		return err
+	}
+	if err := validateSharding(opts); err != nil {
+		return err
+	}
+	if err := validateChannelDefaults(opts.ChannelDefaults); err != nil {
+		return err
+	}
+	if err := validateContentPolicies(opts.ContentPolicies); err != nil {
+		return err
+	}
+	if err := validateLimits(opts); err != nil {
+		return err
+	}
+	if err := validateExclusiveChannels(opts.ExclusiveChannels); err != nil {
+		return err
+	}
+	if err := validateQueuePolicy(opts.QueuePolicy); err != nil {
+		return err
+	}
+	if err := validateRejectPolicy(opts.DeliveryRejection); err != nil {
+		return err
+	}
+	if opts.SlowConsumerWait < 0 {
+		return fmt.Errorf("slow consumer wait can't be negative: %v", opts.SlowConsumerWait)
+	}
+	if err := validateSlowConsumerAction(opts.SlowConsumerAction); err != nil {
+		return err
+	}
+	if err := validateEncryption(opts); err != nil {
+		return err
+	}
+	if err := validateFT(opts); err != nil {
+		return err
+	}
+	if err := validateArchiveReader(opts); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateStore recovers the store, if one exists, and checks that the
+// recovered cluster ID matches the one from the options, or differs from
+// it for an archive reader.
+func validateStore(opts *Options) (string, error) {
+	var (
+		store    stores.Store
+		state    *stores.RecoveredState
+		location string
+		err      error
+	)
+	switch strings.ToUpper(opts.StoreType) {
+	case stores.TypeMemory:
+		return "memory store, nothing to recover", nil
+	case stores.TypeHybrid:
+		return "hybrid store, nothing to recover", nil
+	case stores.TypeSQL:
+		// Do not print the data source, it may contain credentials.
+		location = fmt.Sprintf("%s database", opts.SQLDriver)
+		// Do not create the tables, only read them.
+		state, err = stores.ReadSQLStoreState(opts.SQLDriver, opts.SQLSource)
+	case stores.TypeFile:
+		location = fmt.Sprintf("%q", opts.FilestoreDir)
+		if _, err := os.Stat(opts.FilestoreDir); os.IsNotExist(err) {
+			return fmt.Sprintf("directory %s does not exist and will be created", location), nil
+		}
+		var fsOpts *stores.FileStoreOptions
+		if fsOpts, err = getFileStoreOptions(opts); err == nil {
+			// Do not open the store, it may be in use by a running server.
+			state, err = stores.ReadFileStoreState(opts.FilestoreDir, stores.AllOptions(fsOpts))
+		}
+	case stores.TypeKV:
+		dbFile := filepath.Join(opts.FilestoreDir, stores.KVStoreFileName)
+		location = fmt.Sprintf("%q", dbFile)
+		if _, err := os.Stat(dbFile); os.IsNotExist(err) {
+			return fmt.Sprintf("database %s does not exist and will be created", location), nil
+		}
+		// Open the database read-only, it may be in use by a running server.
+		state, err = stores.ReadKVStoreState(opts.FilestoreDir)
+	default:
+		location = fmt.Sprintf("%s store", strings.ToUpper(opts.StoreType))
+		factory := stores.LookupFactory(opts.StoreType)
+		if factory == nil {
+			return "", fmt.Errorf("unsupported store type: %v", opts.StoreType)
+		}
+		store, state, err = factory(stores.StoreConfig{
+			Dir:    opts.FilestoreDir,
+			Limits: getChannelLimits(opts),
+			Params: opts.StoreParams,
+		})
+	}
+	if err != nil {
+		return fmt.Sprintf("unable to recover store in %s", location), err
+	}
+	if store != nil {
+		defer store.Close()
+	}
+	if state == nil {
+		if opts.ArchiveReader {
+			return fmt.Sprintf("no archive to read in %s", location), fmt.Errorf("archive reader requires an existing store")
+		}
+		return fmt.Sprintf("no state to recover in %s", location), nil
+	}
+	detail := fmt.Sprintf("recovered %v client(s) and %v channel(s) from %s",
+		len(state.Clients), len(state.Subs), location)
+	if opts.ArchiveReader {
+		if state.Info.ClusterID == opts.ID {
+			return detail, fmt.Errorf("archive reader cluster ID must differ from the archived one (%q)", opts.ID)
+		}
+		return detail, nil
+	}
+	if state.Info.ClusterID != opts.ID {
+		return detail, fmt.Errorf("cluster ID %q does not match recovered value of %q",
+			opts.ID, state.Info.ClusterID)
+	}
+	return detail, nil
+}
+
+// validateNATS checks that we can connect to the external NATS Server,
+// using TLS and credentials if configured, and that no other streaming
+// server is running with the same cluster ID. When the NATS Server is
+// to be embedded, checks that its TLS configuration is valid and that
+// it would be able to listen on the configured address.
+func validateNATS(sOpts *Options, nOpts *server.Options) (string, error) {
+	if sOpts.NATSServerURL == "" {
+		no := *nOpts
+		nOpts = &no
+		passServerTLSOptions(sOpts, nOpts)
+		if nOpts.TLSCert != "" || nOpts.TLSKey != "" || nOpts.TLSCaCert != "" || nOpts.TLSVerify {
+			tc := server.TLSConfigOpts{
+				CertFile: nOpts.TLSCert,
+				KeyFile:  nOpts.TLSKey,
+				CaFile:   nOpts.TLSCaCert,
+				Verify:   nOpts.TLSVerify,
+			}
+			if _, err := server.GenTLSConfig(&tc); err != nil {
+				return "invalid TLS configuration for embedded NATS Server", err
+			}
+		}
+		// Apply the same defaults than the NATS Server would.
+		host, port := nOpts.Host, nOpts.Port
+		if host == "" {
+			host = server.DEFAULT_HOST
+		}
+		if port == 0 {
+			port = server.DEFAULT_PORT
+		} else if port == server.RANDOM_PORT {
+			return "embedded NATS Server will listen on a random port", nil
+		}
+		hostport := net.JoinHostPort(host, fmt.Sprintf("%d", port))
+		l, err := net.Listen("tcp", hostport)
+		if err != nil {
+			return fmt.Sprintf("embedded NATS Server can't listen on %q", hostport), err
+		}
+		l.Close()
+		return fmt.Sprintf("embedded NATS Server can listen on %q", hostport), nil
+	}
+	s := &StanServer{opts: sOpts, log: newServerLogger(sOpts)}
+	nc, err := s.createNatsClientConn(sOpts, nOpts)
+	if err != nil {
+		return fmt.Sprintf("unable to connect to %q", util.RedactURL(sOpts.NATSServerURL)), err
+	}
+	defer nc.Close()
+	detail := fmt.Sprintf("connected to %q", util.RedactURL(nc.ConnectedUrl()))
+	discovery := fmt.Sprintf("%s.%s", sOpts.DiscoverPrefix, sOpts.ID)
+	if err := checkStandAlone(nc, sOpts.ID, discovery, stanLog); err != nil {
+		return detail, err
+	}
+	return detail, nil
+}
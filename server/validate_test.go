@@ -0,0 +1,220 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	natsdTest "github.com/nats-io/gnatsd/test"
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+func checkValidationResult(t *testing.T, r *ValidationReport, name string, expectFailure bool) {
+	for _, c := range r.Checks {
+		if c.Name != name {
+			continue
+		}
+		if expectFailure && c.Err == nil {
+			stackFatalf(t, "Expected check %q to fail, report:\n%v", name, r)
+		} else if !expectFailure && c.Err != nil {
+			stackFatalf(t, "Unexpected failure of check %q, report:\n%v", name, r)
+		}
+		return
+	}
+	stackFatalf(t, "Check %q not found in report:\n%v", name, r)
+}
+
+func TestValidateDefaultOptions(t *testing.T) {
+	r := Validate(nil, nil)
+	if !r.OK() {
+		t.Fatalf("Unexpected failure:\n%v", r)
+	}
+	if len(r.Checks) != 3 {
+		t.Fatalf("Expected 3 checks, got %v", len(r.Checks))
+	}
+	if !strings.Contains(r.String(), "[OK") {
+		t.Fatalf("Unexpected report: %v", r)
+	}
+}
+
+func TestValidateInvalidOptions(t *testing.T) {
+	sOpts := GetDefaultOptions()
+	sOpts.StoreType = "unknown"
+	r := Validate(sOpts, nil)
+	if r.OK() {
+		t.Fatal("Validation should have failed")
+	}
+	checkValidationResult(t, r, "options", true)
+	if len(r.Checks) != 1 {
+		t.Fatalf("Expected only options to be checked, got %v", r)
+	}
+
+	sOpts = GetDefaultOptions()
+	sOpts.StoreType = stores.TypeFile
+	r = Validate(sOpts, nil)
+	checkValidationResult(t, r, "options", true)
+
+	sOpts = GetDefaultOptions()
+	sOpts.StoreType = stores.TypeFile
+	sOpts.FilestoreDir = defaultDataStore
+	sOpts.FileStoreOpts.Compression = "lz4"
+	r = Validate(sOpts, nil)
+	checkValidationResult(t, r, "options", true)
+
+	sOpts = GetDefaultOptions()
+	sOpts.StoreType = stores.TypeHybrid
+	r = Validate(sOpts, nil)
+	checkValidationResult(t, r, "options", true)
+
+	sOpts = GetDefaultOptions()
+	sOpts.StoreType = stores.TypeKV
+	r = Validate(sOpts, nil)
+	checkValidationResult(t, r, "options", true)
+
+	sOpts = GetDefaultOptions()
+	sOpts.StoreType = stores.TypeSQL
+	sOpts.SQLDriver = stores.SQLDriverPostgres
+	r = Validate(sOpts, nil)
+	checkValidationResult(t, r, "options", true)
+
+	sOpts = GetDefaultOptions()
+	sOpts.Password = util.NewSecret("pwd")
+	r = Validate(sOpts, nil)
+	checkValidationResult(t, r, "options", true)
+
+	sOpts = GetDefaultOptions()
+	sOpts.Username = "ivan"
+	sOpts.Token = util.NewSecret("s3cr3t")
+	r = Validate(sOpts, nil)
+	checkValidationResult(t, r, "options", true)
+
+	sOpts = GetDefaultOptions()
+	sOpts.MaxChannelsPerConn = -1
+	r = Validate(sOpts, nil)
+	checkValidationResult(t, r, "options", true)
+
+	sOpts = GetDefaultOptions()
+	sOpts.MaxSubsPerClient = -1
+	r = Validate(sOpts, nil)
+	checkValidationResult(t, r, "options", true)
+
+	sOpts = GetDefaultOptions()
+	sOpts.IOBatchSize = -1
+	r = Validate(sOpts, nil)
+	checkValidationResult(t, r, "options", true)
+
+	sOpts = GetDefaultOptions()
+	sOpts.MaxClientsPerConn = 10
+	sOpts.NATSServerURL = "nats://localhost:4222"
+	r = Validate(sOpts, nil)
+	checkValidationResult(t, r, "options", true)
+
+	for i, set := range []func(o *Options){
+		func(o *Options) { o.AckTimerSlack = -time.Second },
+		func(o *Options) {
+			o.StoreType, o.FilestoreDir = stores.TypeFile, defaultDataStore
+			o.FileStoreOpts.RecoverChannels = []string{"orders.>.*"}
+		},
+		func(o *Options) { o.FileStoreOpts.RecoverChannels = []string{"orders.>"} },
+		func(o *Options) { o.MemoryEviction = "random" },
+		func(o *Options) { o.InfoListen = "localhost" },
+		func(o *Options) {
+			o.ContentPolicies = []*ContentPolicy{{Channels: "foo.>.bar", Allowed: []string{ContentJSON}}}
+		},
+		func(o *Options) { o.ContentPolicies = []*ContentPolicy{{Channels: "foo"}} },
+		func(o *Options) { o.ContentPolicies = []*ContentPolicy{{Channels: "foo", Allowed: []string{"xml"}}} },
+		func(o *Options) { o.DedupWindow = -time.Second },
+		func(o *Options) { o.MaxInactivity = -time.Second },
+		func(o *Options) { o.Tenants = []*Tenant{{LimitsOverride: LimitsOverride{Channels: "foo"}}} },
+		func(o *Options) {
+			o.Tenants = []*Tenant{{Name: "a", LimitsOverride: LimitsOverride{Channels: "foo"}}, {Name: "a", LimitsOverride: LimitsOverride{Channels: "bar"}}}
+		},
+		func(o *Options) { o.ChannelTemplates = []*LimitsOverride{{Channels: "foo.>.bar"}} },
+		func(o *Options) { o.ChannelTemplates = []*LimitsOverride{{Channels: "foo", MaxMsgs: -1}} },
+		func(o *Options) { o.PerChannelLimits = []*LimitsOverride{{Channels: "foo.*"}} },
+		func(o *Options) { o.PerChannelLimits = []*LimitsOverride{{Channels: "foo"}, {Channels: "foo"}} },
+		func(o *Options) { o.MaxInflightPerSub = -1 },
+		func(o *Options) { o.MaxOrderingGroups = -1 },
+		func(o *Options) { o.QueuePolicy = "fastest" },
+		func(o *Options) { o.SlowConsumerAction = "kill" },
+		func(o *Options) { o.SlowConsumerWait = -time.Second },
+		func(o *Options) { o.SlowRequestTime = -time.Second },
+		func(o *Options) { o.DurableGracePeriod = -time.Second },
+		func(o *Options) { o.ChannelWorkers = []*ChannelWorkers{{Channels: "bar", Workers: -1}} },
+		func(o *Options) { o.ChannelWorkers = []*ChannelWorkers{{Channels: "foo..bar", Workers: 2}} },
+	} {
+		sOpts = GetDefaultOptions()
+		set(sOpts)
+		if err := validateOptions(sOpts); err == nil {
+			t.Fatalf("Expected error for options %d", i)
+		}
+	}
+}
+
+func TestValidateFileStoreClusterID(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	sOpts := GetDefaultOptions()
+	sOpts.StoreType = stores.TypeFile
+	sOpts.FilestoreDir = defaultDataStore
+
+	// Directory does not exist yet, this is ok
+	r := Validate(sOpts, nil)
+	checkValidationResult(t, r, "store", false)
+
+	s := runServerWithOpts(sOpts)
+	// The store of a running server can be checked, its files are
+	// only read.
+	stat, err := os.Stat(filepath.Join(defaultDataStore, "clients.dat"))
+	if err != nil {
+		t.Fatalf("Unable to stat file: %v", err)
+	}
+	r = Validate(sOpts, nil)
+	checkValidationResult(t, r, "store", false)
+	if s, err := os.Stat(filepath.Join(defaultDataStore, "clients.dat")); err != nil ||
+		s.Size() != stat.Size() || !s.ModTime().Equal(stat.ModTime()) {
+		t.Fatalf("File should not have been modified: %v", err)
+	}
+	s.Shutdown()
+
+	r = Validate(sOpts, nil)
+	checkValidationResult(t, r, "store", false)
+
+	sOpts.ID = "otherCluster"
+	r = Validate(sOpts, nil)
+	checkValidationResult(t, r, "store", true)
+}
+
+func TestValidateNATS(t *testing.T) {
+	// Embedded NATS Server can't listen if the port is already used.
+	s := RunServer(clusterName)
+	r := Validate(nil, nil)
+	checkValidationResult(t, r, "nats", true)
+	s.Shutdown()
+
+	sOpts := GetDefaultOptions()
+	sOpts.NATSServerURL = "nats://localhost:5223"
+	// No NATS Server running
+	r = Validate(sOpts, nil)
+	checkValidationResult(t, r, "nats", true)
+
+	nOpts := DefaultNatsServerOptions
+	nOpts.Port = 5223
+	ns := natsdTest.RunServer(&nOpts)
+	defer ns.Shutdown()
+
+	r = Validate(sOpts, nil)
+	checkValidationResult(t, r, "nats", false)
+
+	// Now run a streaming server with the same cluster ID on that NATS Server
+	s = runServerWithOpts(sOpts)
+	defer s.Shutdown()
+	r = Validate(sOpts, nil)
+	checkValidationResult(t, r, "nats", true)
+}
@@ -0,0 +1,189 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+// Deliveries are checked this many times per Options.DeliveryWatchdog.
+const watchdogChecksPerPeriod = 4
+
+// WatchdogStats are the stalled deliveries detected by the watchdog since
+// the server started, and how many of them it healed.
+type WatchdogStats struct {
+	Stalls uint64 `json:"stalls"`
+	Heals  uint64 `json:"heals"`
+}
+
+// deliveryWatchdog detects the subscriptions, and queue groups, that have
+// messages to receive and room in their MaxInFlight for them, but were sent
+// nothing for longer than Options.DeliveryWatchdog. This is not supposed to
+// happen: it is the sign of a stuck go routine, or of a lost signal such
+// as an ack that did not resume the delivery to a stalled subscription.
+type deliveryWatchdog struct {
+	stalls uint64 // updated atomically
+	heals  uint64 // updated atomically
+	quit   chan struct{}
+	wg     sync.WaitGroup
+	// Deliveries which could progress at the last check, by *subState or
+	// *queueState. Only accessed by the watchdog go routine.
+	watched map[interface{}]*watchedDelivery
+}
+
+// watchedDelivery is the progress of a subscription or queue group.
+type watchedDelivery struct {
+	lastSent uint64
+	since    int64 // time, in nanoseconds, since which lastSent has not changed
+}
+
+// stalledDelivery is a stalled subscription or queue group, to heal once
+// the lock of its channel's subStore has been released.
+type stalledDelivery struct {
+	cs  *stores.ChannelStore
+	sub *subState
+	qs  *queueState
+}
+
+// startDeliveryWatchdog starts the go routine checking, every fraction of
+// `threshold`, that the deliveries which can progress do.
+func (s *StanServer) startDeliveryWatchdog(threshold time.Duration) {
+	interval := threshold / watchdogChecksPerPeriod
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	wd := &deliveryWatchdog{
+		quit:    make(chan struct{}),
+		watched: make(map[interface{}]*watchedDelivery),
+	}
+	s.Lock()
+	s.watchdog = wd
+	s.Unlock()
+	wd.wg.Add(1)
+	go func() {
+		defer wd.wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-wd.quit:
+				return
+			case <-t.C:
+				s.checkDeliveries(wd, s.clock.Now().UnixNano(), threshold, s.opts.WatchdogHeal)
+			}
+		}
+	}()
+}
+
+// stop stops the watchdog and waits for its go routine to return.
+func (wd *deliveryWatchdog) stop() {
+	close(wd.quit)
+	wd.wg.Wait()
+}
+
+// canReceive returns true if messages can be sent to the subscription.
+// Sub lock held on entry.
+func (sub *subState) canReceive() bool {
+	return sub.ClientID != "" && !sub.newOnHold && !sub.paused && !sub.frozen && !sub.standby &&
+		int32(len(sub.acksPending)) < sub.maxInFlight()
+}
+
+// checkDeliveries logs the deliveries that did not progress for longer
+// than `threshold` while they could, and, if `heal` is true, restarts them.
+func (s *StanServer) checkDeliveries(wd *deliveryWatchdog, now int64, threshold time.Duration, heal bool) {
+	watched := make(map[interface{}]*watchedDelivery, len(wd.watched))
+	var stalled []stalledDelivery
+
+	// Returns true if the delivery to `key` did not progress for longer
+	// than the threshold.
+	check := func(key interface{}, lastSent uint64) bool {
+		w := wd.watched[key]
+		if w == nil || w.lastSent != lastSent {
+			w = &watchedDelivery{lastSent: lastSent, since: now}
+		}
+		watched[key] = w
+		if now-w.since < int64(threshold) {
+			return false
+		}
+		// Report again if still stalled after another threshold.
+		w.since = now
+		return true
+	}
+
+	for name, cs := range s.store.GetChannels() {
+		lastSeq := cs.Msgs.LastSequence()
+		ss := cs.UserData.(*subStore)
+		ss.RLock()
+		for _, sub := range ss.psubs {
+			sub.RLock()
+			ready := sub.LastSent < lastSeq && sub.canReceive()
+			if ready && check(sub, sub.LastSent) {
+				s.log.Errorf("STAN: Delivery stalled for %v: channel=%s client=%s inbox=%s durable=%q last_sent=%v last_seq=%v pending=%v max_inflight=%v stalled=%v",
+					threshold, name, sub.ClientID, sub.Inbox, sub.DurableName, sub.LastSent, lastSeq,
+					len(sub.acksPending), sub.maxInFlight(), sub.stalled)
+				stalled = append(stalled, stalledDelivery{cs: cs, sub: sub})
+			}
+			sub.RUnlock()
+		}
+		for qname, qs := range ss.qsubs {
+			qs.RLock()
+			ready := false
+			if qs.lastSent < lastSeq {
+				for _, sub := range qs.subs {
+					sub.RLock()
+					ready = sub.canReceive()
+					sub.RUnlock()
+					if ready {
+						break
+					}
+				}
+			}
+			if ready && check(qs, qs.lastSent) {
+				s.log.Errorf("STAN: Delivery stalled for %v: channel=%s queue=%s members=%v last_sent=%v last_seq=%v stalled=%v",
+					threshold, name, qname, len(qs.subs), qs.lastSent, lastSeq, qs.stalled)
+				stalled = append(stalled, stalledDelivery{cs: cs, qs: qs})
+			}
+			qs.RUnlock()
+		}
+		ss.RUnlock()
+	}
+	wd.watched = watched
+	atomic.AddUint64(&wd.stalls, uint64(len(stalled)))
+
+	if !heal {
+		return
+	}
+	for _, d := range stalled {
+		if d.qs != nil {
+			d.qs.Lock()
+			d.qs.stalled = false
+			d.qs.Unlock()
+			s.sendAvailableMessagesToQueue(d.cs, d.qs)
+		} else {
+			d.sub.Lock()
+			d.sub.stalled = false
+			d.sub.Unlock()
+			s.sendAvailableMessages(d.cs, d.sub)
+		}
+		atomic.AddUint64(&wd.heals, 1)
+	}
+}
+
+// WatchdogStats returns the stalled deliveries detected by the watchdog,
+// which are all zero if Options.DeliveryWatchdog is not set.
+func (s *StanServer) WatchdogStats() WatchdogStats {
+	s.RLock()
+	wd := s.watchdog
+	s.RUnlock()
+	if wd == nil {
+		return WatchdogStats{}
+	}
+	return WatchdogStats{
+		Stalls: atomic.LoadUint64(&wd.stalls),
+		Heals:  atomic.LoadUint64(&wd.heals),
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+)
+
+func checkWatchdogStats(t *testing.T, s *StanServer, minStalls, heals uint64) {
+	var stats WatchdogStats
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		stats = s.WatchdogStats()
+		if stats.Stalls >= minStalls && stats.Heals == heals {
+			return
+		}
+		time.Sleep(15 * time.Millisecond)
+	}
+	stackFatalf(t, "Expected at least %v stalls and %v heals, got %+v", minStalls, heals, stats)
+}
+
+func testDeliveryWatchdog(t *testing.T, heal bool) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.DeliveryWatchdog = 100 * time.Millisecond
+	opts.WatchdogHeal = heal
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	msgs := make(chan *stan.Msg, 10)
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) { msgs <- m }); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	checkMsgSeq(t, msgs, 1)
+	checkNoMsg(t, msgs)
+	if stats := s.WatchdogStats(); stats.Stalls != 0 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+
+	// Simulate a lost signal by storing a message without delivering it.
+	cs := s.store.LookupChannel("foo")
+	if _, err := cs.Msgs.Store("", []byte("lost")); err != nil {
+		t.Fatalf("Unexpected error on store: %v", err)
+	}
+	if !heal {
+		checkWatchdogStats(t, s, 1, 0)
+		checkNoMsg(t, msgs)
+		return
+	}
+	checkMsgSeq(t, msgs, 2)
+	checkWatchdogStats(t, s, 1, 1)
+}
+
+func TestDeliveryWatchdog(t *testing.T) {
+	testDeliveryWatchdog(t, false)
+}
+
+func TestDeliveryWatchdogHeal(t *testing.T) {
+	testDeliveryWatchdog(t, true)
+}
+
+func TestDeliveryWatchdogIgnoresFullSubs(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.DeliveryWatchdog = 100 * time.Millisecond
+	opts.WatchdogHeal = true
+	s := runServerWithOpts(opts)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	msgs := make(chan *stan.Msg, 10)
+	if _, err := sc.Subscribe("foo", func(m *stan.Msg) { msgs <- m },
+		stan.SetManualAckMode(), stan.MaxInflight(1)); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := sc.Publish("foo", []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	checkMsgSeq(t, msgs, 1)
+	// The subscription waits for the ack of the first message.
+	time.Sleep(300 * time.Millisecond)
+	if stats := s.WatchdogStats(); stats.Stalls != 0 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+const (
+	// webhookClientID is the client ID of the connection used by webhooks.
+	webhookClientID = "_STAN-webhooks"
+
+	// DefaultWebhookTimeout is the default timeout of webhook requests.
+	DefaultWebhookTimeout = 10 * time.Second
+)
+
+// Webhook is a durable subscription, configured on the server, which
+// delivers the messages of a channel to an HTTP endpoint. Each message is
+// POSTed with its data as the body, and is acknowledged when the endpoint
+// returns a 2xx status. Failed deliveries are retried with a backoff.
+type Webhook struct {
+	Name       string        // Name of the webhook, used as the durable name
+	Channel    string        // Channel whose messages are delivered
+	URL        string        // HTTP or HTTPS endpoint
+	Timeout    time.Duration // Timeout of each request (DefaultWebhookTimeout if 0)
+	MaxRetries int           // Retries after which a message is moved to the dead-letter channel (0 for no limit)
+}
+
+// webhooks delivers messages to all webhooks over a single connection.
+type webhooks struct {
+	client     *internalClient
+	forwarders map[string]*forwarder
+	quit       chan struct{}
+	wg         sync.WaitGroup
+}
+
+// validateWebhooks checks the webhooks for inconsistencies.
+func validateWebhooks(hooks []*Webhook) error {
+	names := make(map[string]struct{}, len(hooks))
+	for _, w := range hooks {
+		if w.Name == "" {
+			return fmt.Errorf("webhook name must be specified")
+		}
+		if _, dup := names[w.Name]; dup {
+			return fmt.Errorf("duplicate webhook %q", w.Name)
+		}
+		names[w.Name] = struct{}{}
+		if w.Channel == "" || !isValidSubject(w.Channel) {
+			return fmt.Errorf("invalid channel %q for webhook %q", w.Channel, w.Name)
+		}
+		u, err := url.Parse(w.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid URL %q for webhook %q", w.URL, w.Name)
+		}
+		if w.Timeout < 0 || w.MaxRetries < 0 {
+			return fmt.Errorf("timeout and max retries of webhook %q can't be negative", w.Name)
+		}
+	}
+	return nil
+}
+
+// startWebhooks registers the webhooks' client and creates their durable
+// subscriptions.
+func (s *StanServer) startWebhooks() error {
+	client, err := s.newInternalClient(webhookClientID)
+	if err != nil {
+		return fmt.Errorf("unable to start webhooks: %v", err)
+	}
+	wh := &webhooks{client: client, forwarders: make(map[string]*forwarder), quit: make(chan struct{})}
+	for _, hook := range s.opts.Webhooks {
+		timeout := hook.Timeout
+		if timeout == 0 {
+			timeout = DefaultWebhookTimeout
+		}
+		tlsConfig := &tls.Config{}
+		util.Crypto.ConfigureTLS(tlsConfig)
+		httpClient := &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+		}
+		url := hook.URL
+		f := &forwarder{
+			name:       fmt.Sprintf("Webhook %q", hook.Name),
+			durable:    hook.Name,
+			s:          s,
+			client:     client,
+			channel:    hook.Channel,
+			sendWait:   timeout,
+			maxRetries: hook.MaxRetries,
+			quit:       wh.quit,
+		}
+		f.send = func(m *spb.MsgProto) error { return postMsg(httpClient, url, m, wh.quit) }
+		if err := f.start(&wh.wg); err != nil {
+			wh.stop()
+			return fmt.Errorf("unable to start webhook %q: %v", hook.Name, err)
+		}
+		wh.forwarders[hook.Name] = f
+	}
+	s.Lock()
+	s.webhooks = wh
+	s.Unlock()
+	return nil
+}
+
+// WebhookStats returns the counters of the webhook with the given name,
+// and false if there is no such webhook running.
+func (s *StanServer) WebhookStats(name string) (ForwarderStats, bool) {
+	s.RLock()
+	wh := s.webhooks
+	s.RUnlock()
+	if wh == nil || wh.forwarders[name] == nil {
+		return ForwarderStats{}, false
+	}
+	return wh.forwarders[name].Stats(), true
+}
+
+// stop stops delivering messages and closes the webhooks' connection.
+// Messages not yet acknowledged are redelivered on restart.
+func (wh *webhooks) stop() {
+	close(wh.quit)
+	wh.wg.Wait()
+	wh.client.close()
+}
+
+// postMsg sends the message to the endpoint. The message metadata is
+// passed in headers.
+func postMsg(httpClient *http.Client, url string, m *spb.MsgProto, cancel chan struct{}) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(m.Data))
+	if err != nil {
+		return err
+	}
+	req.Cancel = cancel
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Stan-Channel", m.Subject)
+	req.Header.Set("Stan-Sequence", strconv.FormatUint(m.Sequence, 10))
+	req.Header.Set("Stan-Timestamp", strconv.FormatInt(m.Timestamp, 10))
+	req.Header.Set("Stan-Redelivered", strconv.FormatBool(m.Redelivered))
+	for k, v := range m.Headers {
+		req.Header.Set("Stan-Header-"+k, v)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	// Drain the body so that the connection can be reused.
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %q", strings.TrimSpace(resp.Status))
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+)
+
+// webhookEndpoint records the requests it receives, and fails the first
+// `failures` ones.
+type webhookEndpoint struct {
+	sync.Mutex
+	failures int
+	bodies   []string
+	headers  []http.Header
+	received chan string
+}
+
+func (e *webhookEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	e.Lock()
+	e.bodies = append(e.bodies, string(body))
+	e.headers = append(e.headers, r.Header)
+	fail := e.failures != 0
+	if e.failures > 0 {
+		e.failures--
+	}
+	e.Unlock()
+	if fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	e.received <- string(body)
+}
+
+func runServerWithWebhook(t *testing.T, failures, maxRetries int) (*StanServer, *webhookEndpoint, *httptest.Server) {
+	e := &webhookEndpoint{failures: failures, received: make(chan string, 10)}
+	ts := httptest.NewServer(e)
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.Webhooks = []*Webhook{{Name: "hook", Channel: "foo", URL: ts.URL, MaxRetries: maxRetries}}
+	s := runServerWithOpts(opts)
+	return s, e, ts
+}
+
+func TestValidateWebhooks(t *testing.T) {
+	valid := &Webhook{Name: "hook", Channel: "foo", URL: "https://localhost/foo"}
+	if err := validateWebhooks([]*Webhook{valid}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, hooks := range [][]*Webhook{
+		{{Channel: "foo", URL: "http://localhost"}},
+		{{Name: "hook", Channel: "foo.*", URL: "http://localhost"}},
+		{{Name: "hook", Channel: "foo", URL: "ftp://localhost"}},
+		{{Name: "hook", Channel: "foo", URL: "http://localhost", MaxRetries: -1}},
+		{valid, valid},
+	} {
+		if err := validateWebhooks(hooks); err == nil {
+			t.Fatalf("Expected error for %v", hooks)
+		}
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	s, e, ts := runServerWithWebhook(t, 0, 0)
+	defer ts.Close()
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	expected := []string{"1", "2", "3"}
+	for _, m := range expected {
+		if err := sc.Publish("foo", []byte(m)); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	var got []string
+	for range expected {
+		select {
+		case body := <-e.received:
+			got = append(got, body)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Did not get all messages, got %v", got)
+		}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+	e.Lock()
+	h := e.headers[0]
+	e.Unlock()
+	if h.Get("Stan-Channel") != "foo" || h.Get("Stan-Sequence") != "1" || h.Get("Stan-Redelivered") != "false" {
+		t.Fatalf("Unexpected headers: %v", h)
+	}
+	// Messages are acked.
+	subs := checkSubs(t, s, webhookClientID, 1)
+	waitForCount(t, 0, func() (string, int) {
+		subs[0].RLock()
+		defer subs[0].RUnlock()
+		return "pending messages", len(subs[0].acksPending)
+	})
+}
+
+func TestWebhookRetry(t *testing.T) {
+	s, e, ts := runServerWithWebhook(t, 2, 0)
+	defer ts.Close()
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	select {
+	case <-e.received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Message should have been delivered after retries")
+	}
+	// Wait a bit to make sure it is not delivered again.
+	time.Sleep(200 * time.Millisecond)
+	e.Lock()
+	attempts := len(e.bodies)
+	e.Unlock()
+	if attempts != 3 {
+		t.Fatalf("Expected 3 attempts, got %v", attempts)
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	s, e, ts := runServerWithWebhook(t, -1, 2)
+	defer ts.Close()
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	dlq := make(chan *stan.Msg, 10)
+	if _, err := sc.Subscribe(DefaultDLQPrefix+".foo", func(m *stan.Msg) {
+		dlq <- m
+	}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	select {
+	case m := <-dlq:
+		if string(m.Data) != "hello" {
+			t.Fatalf("Unexpected message in dead-letter channel: %q", m.Data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Message should have been moved to the dead-letter channel")
+	}
+	e.Lock()
+	attempts := len(e.bodies)
+	e.Unlock()
+	if attempts != 3 {
+		t.Fatalf("Expected 3 attempts, got %v", attempts)
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+// ErrInvalidWildcardSub is returned when a subscription on a subject with
+// wildcards is durable, part of a queue group or starts at a sequence or
+// a GUID.
+var ErrInvalidWildcardSub = errors.New("stan: wildcard subscriptions can't be durable, queue subscribers or start at a sequence or GUID")
+
+// wildcardAckToken separates, in the ack inbox of a wildcard subscription,
+// the inbox from the encoded subject of the subscription. This allows the
+// wildcard subscriptions to be rebuilt from the stored subscriptions.
+const wildcardAckToken = ".wildcard."
+
+// wildcardSub is a subscription on a subject with wildcards. It is made of
+// a plain subscription on each matching channel, which share the inbox and
+// ack inbox of the wildcard subscription. Each channel keeps its own
+// sequences.
+type wildcardSub struct {
+	sr       spb.SubscriptionRequest
+	ackInbox string
+	ackSub   *nats.Subscription
+	subs     map[string]*subState // by channel
+}
+
+// wildcardSubs are the wildcard subscriptions, keyed by ack inbox.
+type wildcardSubs struct {
+	sync.Mutex
+	subs map[string]*wildcardSub
+}
+
+// isWildcardSubject returns true if the subject is valid and contains
+// the `*` or `>` wildcards.
+func isWildcardSubject(subject string) bool {
+	return strings.ContainsAny(subject, "*>") && util.IsValidSubjectPattern(subject)
+}
+
+// wildcardAckInbox returns a new ack inbox for a subscription on subject.
+func wildcardAckInbox(subject string) string {
+	return nats.NewInbox() + wildcardAckToken + base64.RawURLEncoding.EncodeToString([]byte(subject))
+}
+
+// wildcardSubject returns the subject of the wildcard subscription with the
+// given ack inbox, or an empty string if it is not a wildcard subscription.
+func wildcardSubject(ackInbox string) string {
+	idx := strings.LastIndex(ackInbox, wildcardAckToken)
+	if idx == -1 {
+		return ""
+	}
+	b, err := base64.RawURLEncoding.DecodeString(ackInbox[idx+len(wildcardAckToken):])
+	if err != nil || !isWildcardSubject(string(b)) {
+		return ""
+	}
+	return string(b)
+}
+
+// processWildcardSubscriptionRequest adds a subscription on all the channels
+// matching the subject of the request, and on those created later on.
+func (s *StanServer) processWildcardSubscriptionRequest(m *nats.Msg, sr *spb.SubscriptionRequest, t *reqTimer) {
+	if sr.DurableName != "" || sr.QGroup != "" || sr.StartPosition == spb.StartPosition_SequenceStart ||
+		sr.StartPosition == spb.StartPosition_ByGUID {
+		s.log.Debugf("STAN: [Client:%s] Invalid wildcard subscription request on %s.", sr.ClientID, sr.Subject)
+		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidWildcardSub)
+		return
+	}
+	if err := s.authorize(sr.ClientID, sr.Subject, OpSubscribe); err != nil {
+		s.sendSubscriptionResponseErr(m.Reply, err)
+		return
+	}
+	if err := s.checkSubRate(sr.ClientID); err != nil {
+		s.log.Debugf("STAN: [Client:%s] Subscription request rejected: %v", sr.ClientID, err)
+		s.sendSubscriptionResponseErr(m.Reply, err)
+		return
+	}
+	if s.clients.Lookup(sr.ClientID) == nil {
+		s.sendSubscriptionResponseErr(m.Reply, ErrUnknownClient)
+		return
+	}
+	if !isValidInbox(sr.Inbox) {
+		s.log.Debugf("STAN: [Client:%s] Invalid inbox <%s> in wildcard subscription request.", sr.ClientID, sr.Inbox)
+		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSubReq)
+		return
+	}
+	t.stage("validate")
+
+	ws := &wildcardSub{
+		sr:       *sr,
+		ackInbox: wildcardAckInbox(sr.Subject),
+		subs:     make(map[string]*subState),
+	}
+	// Subscribe to acks before any message can be sent.
+	var err error
+	ws.ackSub, err = s.nc.Subscribe(ws.ackInbox, s.processAckMsg)
+	if err != nil {
+		panic(fmt.Sprintf("Could not subscribe to ack subject, %v\n", err))
+	}
+
+	// The subscriptions to send the available messages to, since channels
+	// created concurrently may add theirs to ws.
+	var subs []*subState
+	var channels []*stores.ChannelStore
+	s.wildcards.Lock()
+	for channel, cs := range s.store.GetChannels() {
+		if !util.SubjectMatches(sr.Subject, channel) {
+			continue
+		}
+		if err = s.addWildcardChannelSub(ws, cs, channel); err != nil {
+			break
+		}
+		subs = append(subs, ws.subs[channel])
+		channels = append(channels, cs)
+	}
+	if err == nil {
+		if s.wildcards.subs == nil {
+			s.wildcards.subs = make(map[string]*wildcardSub)
+		}
+		s.wildcards.subs[ws.ackInbox] = ws
+	}
+	s.wildcards.Unlock()
+	if err != nil {
+		s.log.Errorf("STAN: Unable to add subscription for %s: %v", sr.Subject, err)
+		s.removeWildcardSub(ws)
+		s.sendSubscriptionResponseErr(m.Reply, err)
+		return
+	}
+	s.log.Debugf("STAN: [Client:%s] Added wildcard subscription on subject=%s, inbox=%s, channels=%d",
+		sr.ClientID, sr.Subject, sr.Inbox, len(subs))
+	t.stage("store")
+
+	resp := &spb.SubscriptionResponse{AckInbox: ws.ackInbox}
+	b, _ := resp.Marshal()
+	s.nc.Publish(m.Reply, b)
+	t.stage("reply")
+
+	for i, sub := range subs {
+		s.sendAvailableMessages(channels[i], sub)
+	}
+	t.stage("send")
+	s.endRequest(t, slowSubscribe, sr.ClientID, sr.Subject)
+}
+
+// addWildcardChannelSub adds the subscription of the wildcard subscription
+// on the channel, starting at the position of the request.
+// Lock of the wildcard subscriptions held on entry.
+func (s *StanServer) addWildcardChannelSub(ws *wildcardSub, cs *stores.ChannelStore, channel string) error {
+	ss := cs.UserData.(*subStore)
+	if !ss.hasRoomForSub(cs.Subs) {
+		return stores.ErrTooManySubs
+	}
+	sr := &ws.sr
+	sub := &subState{
+		SubState: spb.SubState{
+			ClientID:      sr.ClientID,
+			Inbox:         sr.Inbox,
+			AckInbox:      ws.ackInbox,
+			MaxInFlight:   sr.MaxInFlight,
+			AckWaitInSecs: sr.AckWaitInSecs,
+		},
+		subject:     channel,
+		ackWait:     time.Duration(sr.AckWaitInSecs) * time.Second,
+		acksPending: make(map[uint64]*spb.MsgProto),
+		store:       cs.Subs,
+		window:      s.newDeliveryWindow(sr.MaxInFlight),
+	}
+	s.setSubStartSequence(cs, sub, sr)
+	if err := s.addSubscription(ss, sub); err != nil {
+		return err
+	}
+	ws.subs[channel] = sub
+	return nil
+}
+
+// addWildcardSubsTo adds the wildcard subscriptions matching the channel,
+// which has just been created, to this channel.
+func (s *StanServer) addWildcardSubsTo(cs *stores.ChannelStore, channel string) {
+	s.wildcards.Lock()
+	defer s.wildcards.Unlock()
+	for _, ws := range s.wildcards.subs {
+		if _, ok := ws.subs[channel]; ok || !util.SubjectMatches(ws.sr.Subject, channel) {
+			continue
+		}
+		if err := s.addWildcardChannelSub(ws, cs, channel); err != nil {
+			s.log.Errorf("STAN: [Client:%s] Unable to add subscription on %s to new channel %s: %v",
+				ws.sr.ClientID, ws.sr.Subject, channel, err)
+		}
+	}
+}
+
+// removeWildcardSub removes the subscriptions of the wildcard subscription
+// from all its channels and from its client.
+func (s *StanServer) removeWildcardSub(ws *wildcardSub) {
+	s.wildcards.Lock()
+	delete(s.wildcards.subs, ws.ackInbox)
+	if ws.ackSub != nil {
+		ws.ackSub.Unsubscribe()
+		ws.ackSub = nil
+	}
+	subs := ws.subs
+	ws.subs = make(map[string]*subState)
+	s.wildcards.Unlock()
+
+	for channel, sub := range subs {
+		s.clients.RemoveSub(ws.sr.ClientID, sub)
+		if cs := s.store.LookupChannel(channel); cs != nil {
+			s.startExclusiveConsumer(cs, cs.UserData.(*subStore).Remove(sub, true))
+		}
+	}
+}
+
+// lookupWildcardSub returns the wildcard subscription of the client with
+// the given subject and ack inbox, or nil if there is none.
+func (s *StanServer) lookupWildcardSub(clientID, subject, ackInbox string) *wildcardSub {
+	s.wildcards.Lock()
+	defer s.wildcards.Unlock()
+	ws := s.wildcards.subs[ackInbox]
+	if ws == nil || ws.sr.ClientID != clientID || ws.sr.Subject != subject {
+		return nil
+	}
+	return ws
+}
+
+// removeClientWildcardSubs forgets the wildcard subscriptions of a closed
+// client, so that they are not added to new channels. Their subscriptions
+// on each channel are removed with the other subscriptions of the client.
+func (s *StanServer) removeClientWildcardSubs(clientID string) {
+	s.wildcards.Lock()
+	defer s.wildcards.Unlock()
+	for ackInbox, ws := range s.wildcards.subs {
+		if ws.sr.ClientID != clientID {
+			continue
+		}
+		if ws.ackSub != nil {
+			ws.ackSub.Unsubscribe()
+			ws.ackSub = nil
+		}
+		delete(s.wildcards.subs, ackInbox)
+	}
+}
+
+// recoverWildcardSubs rebuilds the wildcard subscriptions from the recovered
+// subscriptions with a wildcard ack inbox, and subscribes to their acks.
+func (s *StanServer) recoverWildcardSubs(recoveredSubs []*subState) error {
+	s.wildcards.Lock()
+	defer s.wildcards.Unlock()
+	for _, sub := range recoveredSubs {
+		sub.RLock()
+		subject := wildcardSubject(sub.AckInbox)
+		ackInbox := sub.AckInbox
+		sr := spb.SubscriptionRequest{
+			ClientID:      sub.ClientID,
+			Subject:       subject,
+			Inbox:         sub.Inbox,
+			MaxInFlight:   sub.MaxInFlight,
+			AckWaitInSecs: sub.AckWaitInSecs,
+			StartPosition: spb.StartPosition_First,
+		}
+		sub.RUnlock()
+		if subject == "" {
+			continue
+		}
+		if s.wildcards.subs == nil {
+			s.wildcards.subs = make(map[string]*wildcardSub)
+		}
+		ws := s.wildcards.subs[ackInbox]
+		if ws == nil {
+			ackSub, err := s.nc.Subscribe(ackInbox, s.processAckMsg)
+			if err != nil {
+				return err
+			}
+			ws = &wildcardSub{sr: sr, ackInbox: ackInbox, ackSub: ackSub, subs: make(map[string]*subState)}
+			s.wildcards.subs[ackInbox] = ws
+		}
+		ws.subs[sub.subject] = sub
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+func TestWildcardSubscription(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	for _, channel := range []string{"foo.a", "foo.a", "bar"} {
+		if err := sc.Publish(channel, []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	ch := make(chan string, 10)
+	sub, err := sc.Subscribe("foo.*", func(m *stan.Msg) {
+		ch <- fmt.Sprintf("%s:%d", m.Subject, m.Sequence)
+		m.Ack()
+	}, stan.DeliverAllAvailable(), stan.SetManualAckMode())
+	if err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	// foo.b is created after the subscription, foo.b.c does not match.
+	for _, channel := range []string{"foo.b", "foo.b.c", "foo.a"} {
+		if err := sc.Publish(channel, []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error on publish: %v", err)
+		}
+	}
+	received := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		select {
+		case m := <-ch:
+			received[m] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Did not get all messages, got %v", received)
+		}
+	}
+	for _, e := range []string{"foo.a:1", "foo.a:2", "foo.a:3", "foo.b:1"} {
+		if !received[e] {
+			t.Fatalf("Expected message %s, got %v", e, received)
+		}
+	}
+	select {
+	case m := <-ch:
+		t.Fatalf("Unexpected message %s", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// The acks are processed by the subscription of each channel.
+	waitForCount(t, 0, func() (string, int) {
+		states, _ := s.SubscriptionsState("", clientName)
+		pending := 0
+		for _, st := range states {
+			pending += st.PendingAcks
+		}
+		return "pending acks", pending
+	})
+	if states, _ := s.SubscriptionsState("", clientName); len(states) != 2 {
+		t.Fatalf("Expected 2 subscriptions, got %v", len(states))
+	}
+
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatalf("Unexpected error on unsubscribe: %v", err)
+	}
+	if err := sc.Publish("foo.c", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	if states, _ := s.SubscriptionsState("", clientName); len(states) != 0 {
+		t.Fatalf("Expected no subscription, got %v", len(states))
+	}
+}
+
+func TestWildcardSubscriptionInvalid(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+
+	cb := func(_ *stan.Msg) {}
+	if _, err := sc.Subscribe("foo.>", cb, stan.DurableName("dur")); err == nil || err.Error() != ErrInvalidWildcardSub.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidWildcardSub, err)
+	}
+	if _, err := sc.QueueSubscribe("foo.>", "group", cb); err == nil || err.Error() != ErrInvalidWildcardSub.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidWildcardSub, err)
+	}
+	if _, err := sc.Subscribe("foo.>", cb, stan.StartAtSequence(1)); err == nil || err.Error() != ErrInvalidWildcardSub.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidWildcardSub, err)
+	}
+	if _, err := sc.Subscribe("foo.>.bar", cb); err == nil || err.Error() != ErrInvalidSubject.Error() {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidSubject, err)
+	}
+}
+
+func TestWildcardSubscriptionClientClose(t *testing.T) {
+	s := RunServer(clusterName)
+	defer s.Shutdown()
+
+	sc := NewDefaultConnection(t)
+	if _, err := sc.Subscribe("foo.*", func(_ *stan.Msg) {}); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	if err := sc.Publish("foo.a", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	sc.Close()
+
+	// Channels created once the client is closed get no subscription.
+	sc = NewDefaultConnection(t)
+	defer sc.Close()
+	if err := sc.Publish("foo.b", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	if states, _ := s.SubscriptionsState("", ""); len(states) != 0 {
+		t.Fatalf("Expected no subscription, got %v", len(states))
+	}
+}
+
+func TestWildcardSubscriptionRecovery(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	opts := GetDefaultOptions()
+	opts.ID = clusterName
+	opts.StoreType = stores.TypeFile
+	opts.FilestoreDir = defaultDataStore
+	s := runServerWithOpts(opts)
+	defer shutdownRestartedServerOnTestExit(&s)
+
+	sc := NewDefaultConnection(t)
+	defer sc.Close()
+	if err := sc.Publish("foo.a", []byte("hello")); err != nil {
+		t.Fatalf("Unexpected error on publish: %v", err)
+	}
+	if _, err := sc.Subscribe("foo.*", func(_ *stan.Msg) {}, stan.DeliverAllAvailable()); err != nil {
+		t.Fatalf("Unexpected error on subscribe: %v", err)
+	}
+	s.Shutdown()
+
+	s = runServerWithOpts(opts)
+	s.wildcards.Lock()
+	numWildcards := len(s.wildcards.subs)
+	s.wildcards.Unlock()
+	if numWildcards != 1 {
+		t.Fatalf("Expected wildcard subscription to be recovered, got %v", numWildcards)
+	}
+	// The recovered subscription is added to the channels created after
+	// the restart.
+	if _, err := s.lookupOrCreateChannel("foo.b"); err != nil {
+		t.Fatalf("Unexpected error creating channel: %v", err)
+	}
+	states, err := s.SubscriptionsState("", clientName)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(states) != 2 || states[0].Channel != "foo.a" || states[1].Channel != "foo.b" ||
+		states[0].AckInbox != states[1].AckInbox {
+		t.Fatalf("Unexpected subscriptions: %+v", states)
+	}
+}
@@ -3,7 +3,6 @@
 package stores
 
 import (
-	"github.com/nats-io/go-nats-streaming/pb"
 	"github.com/nats-io/nats-streaming-server/spb"
 	"hash/crc32"
 	"math/rand"
@@ -33,7 +32,7 @@ func benchCreateDefaultFileStore(t *testing.B) *FileStore {
 	return fs
 }
 
-func benchStoreMsg(b *testing.B, ms MsgStore, data []byte) *pb.MsgProto {
+func benchStoreMsg(b *testing.B, ms MsgStore, data []byte) *spb.MsgProto {
 	m, err := ms.Store("", data)
 	if err != nil {
 		stackFatalf(b, "Error storing message: %v", err)
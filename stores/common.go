@@ -6,8 +6,8 @@ import (
 	"sort"
 	"sync"
 
-	"github.com/nats-io/go-nats-streaming/pb"
 	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/util"
 )
 
 // format string used to report that limit is reached when storing
@@ -28,6 +28,9 @@ type genericStore struct {
 	name     string
 	channels map[string]*ChannelStore
 	clients  map[string]*Client
+	clock    util.Clock
+	// Limits of each channel, nil to use limits for all channels.
+	limitsFunc ChannelLimitsFunc
 }
 
 // genericSubStore is the generic store implementation that manages subscriptions
@@ -46,10 +49,23 @@ type genericMsgStore struct {
 	subject    string // Can't be wildcard
 	first      uint64
 	last       uint64
-	msgs       map[uint64]*pb.MsgProto
+	msgs       map[uint64]*spb.MsgProto
+	guids      map[string]uint64 // sequences of the stored messages by publish GUID
 	totalCount int
 	totalBytes uint64
-	hitLimit   bool // indicates if store had to drop messages due to limit
+	hitLimit   bool       // indicates if store had to drop messages due to limit
+	clock      util.Clock // used to timestamp messages
+}
+
+// clockSetter is implemented by message stores embedding genericMsgStore.
+type clockSetter interface {
+	setClock(clock util.Clock)
+}
+
+// limitsSetter is implemented by message and subscription stores embedding
+// genericMsgStore and genericSubStore.
+type limitsSetter interface {
+	setLimits(limits ChannelLimits)
 }
 
 ////////////////////////////////////////////////////////////////////////////
@@ -67,6 +83,19 @@ func (gs *genericStore) init(name string, limits *ChannelLimits) {
 	// Do not use limits values to create the map.
 	gs.channels = make(map[string]*ChannelStore)
 	gs.clients = make(map[string]*Client)
+	gs.clock = util.RealClock
+}
+
+// SetClock sets the clock used to timestamp messages.
+func (gs *genericStore) SetClock(clock util.Clock) {
+	gs.Lock()
+	defer gs.Unlock()
+	gs.clock = clock
+	for _, cs := range gs.channels {
+		if ms, ok := cs.Msgs.(clockSetter); ok {
+			ms.setClock(clock)
+		}
+	}
 }
 
 // Init can be used to initialize the store with server's information.
@@ -74,6 +103,12 @@ func (gs *genericStore) Init(info *spb.ServerInfo) error {
 	return nil
 }
 
+// SetOrderingGroups does nothing, since the state of the generic store is
+// not recovered.
+func (gs *genericStore) SetOrderingGroups(groups map[string]uint64) error {
+	return nil
+}
+
 // Name returns the type name of this store
 func (gs *genericStore) Name() string {
 	return gs.name
@@ -86,6 +121,32 @@ func (gs *genericStore) SetChannelLimits(limits ChannelLimits) {
 	gs.Unlock()
 }
 
+// SetChannelLimitsFunc sets the function returning the limits of each
+// channel, and updates the limits of the existing channels.
+func (gs *genericStore) SetChannelLimitsFunc(f ChannelLimitsFunc) {
+	gs.Lock()
+	defer gs.Unlock()
+	gs.limitsFunc = f
+	for name, cs := range gs.channels {
+		limits := gs.channelLimits(name)
+		if ms, ok := cs.Msgs.(limitsSetter); ok {
+			ms.setLimits(limits)
+		}
+		if ss, ok := cs.Subs.(limitsSetter); ok {
+			ss.setLimits(limits)
+		}
+	}
+}
+
+// channelLimits returns the limits of the given channel.
+// Store lock is assumed to be locked.
+func (gs *genericStore) channelLimits(channel string) ChannelLimits {
+	if gs.limitsFunc != nil {
+		return gs.limitsFunc(channel)
+	}
+	return gs.limits
+}
+
 // LookupChannel returns a ChannelStore for the given channel.
 func (gs *genericStore) LookupChannel(channel string) *ChannelStore {
 	gs.RLock()
@@ -102,6 +163,41 @@ func (gs *genericStore) HasChannel() bool {
 	return l > 0
 }
 
+// GetChannels returns a copy of the map of channels.
+func (gs *genericStore) GetChannels() map[string]*ChannelStore {
+	gs.RLock()
+	channels := make(map[string]*ChannelStore, len(gs.channels))
+	for k, v := range gs.channels {
+		channels[k] = v
+	}
+	gs.RUnlock()
+	return channels
+}
+
+// DeleteChannel closes and removes the channel from the store.
+func (gs *genericStore) DeleteChannel(channel string) error {
+	gs.Lock()
+	defer gs.Unlock()
+	_, err := gs.deleteChannel(channel)
+	return err
+}
+
+// deleteChannel removes the channel from the map and closes its stores.
+// Returns a nil ChannelStore if the channel does not exist.
+// Store lock is assumed held on entry.
+func (gs *genericStore) deleteChannel(channel string) (*ChannelStore, error) {
+	cs := gs.channels[channel]
+	if cs == nil {
+		return nil, nil
+	}
+	delete(gs.channels, channel)
+	err := cs.Subs.Close()
+	if lerr := cs.Msgs.Close(); lerr != nil && err == nil {
+		err = lerr
+	}
+	return cs, err
+}
+
 // State returns message store statistics for a given channel ('*' for all)
 func (gs *genericStore) MsgsState(channel string) (numMessages int, byteSize uint64, err error) {
 	numMessages = 0
@@ -109,11 +205,12 @@ func (gs *genericStore) MsgsState(channel string) (numMessages int, byteSize uin
 	err = nil
 
 	if channel == AllChannels {
+		// Keep the lock while iterating, the map is modified when
+		// channels are created or deleted.
 		gs.RLock()
-		cs := gs.channels
-		gs.RUnlock()
+		defer gs.RUnlock()
 
-		for _, c := range cs {
+		for _, c := range gs.channels {
 			n, b, lerr := c.Msgs.State()
 			if lerr != nil {
 				err = lerr
@@ -226,15 +323,31 @@ func (gs *genericStore) close() error {
 ////////////////////////////////////////////////////////////////////////////
 
 // init initializes this generic message store
-func (gms *genericMsgStore) init(subject string, limits ChannelLimits) {
+func (gms *genericMsgStore) init(subject string, limits ChannelLimits, clock util.Clock) {
 	gms.subject = subject
 	gms.limits = limits
+	gms.clock = clock
 	// FIXME(ik) - Long term, msgs map should probably not be part of the
 	// generic store.
 	// We could use limits.MaxNumMsgs for the size of the map, but that
 	// may be too big if there is lots of channels with only few messages.
 	// The map will grow as needed.
-	gms.msgs = make(map[uint64]*pb.MsgProto, 64)
+	gms.msgs = make(map[uint64]*spb.MsgProto, 64)
+	gms.guids = make(map[string]uint64)
+}
+
+// setClock sets the clock used to timestamp messages
+func (gms *genericMsgStore) setClock(clock util.Clock) {
+	gms.Lock()
+	gms.clock = clock
+	gms.Unlock()
+}
+
+// setLimits sets the limits of this store
+func (gms *genericMsgStore) setLimits(limits ChannelLimits) {
+	gms.Lock()
+	gms.limits = limits
+	gms.Unlock()
 }
 
 // State returns some statistics related to this store
@@ -245,6 +358,18 @@ func (gms *genericMsgStore) State() (numMessages int, byteSize uint64, err error
 	return c, b, nil
 }
 
+// purge removes all messages, so that sequences start again at 1.
+// Lock held on entry.
+func (gms *genericMsgStore) purge() {
+	gms.first = 0
+	gms.last = 0
+	gms.msgs = make(map[uint64]*spb.MsgProto, 64)
+	gms.guids = make(map[string]uint64)
+	gms.totalCount = 0
+	gms.totalBytes = 0
+	gms.hitLimit = false
+}
+
 // FirstSequence returns sequence for first message stored.
 func (gms *genericMsgStore) FirstSequence() uint64 {
 	gms.RLock()
@@ -270,15 +395,76 @@ func (gms *genericMsgStore) FirstAndLastSequence() (uint64, uint64) {
 }
 
 // Lookup returns the stored message with given sequence number.
-func (gms *genericMsgStore) Lookup(seq uint64) *pb.MsgProto {
+func (gms *genericMsgStore) Lookup(seq uint64) *spb.MsgProto {
 	gms.RLock()
 	m := gms.msgs[seq]
 	gms.RUnlock()
 	return m
 }
 
+// LookupRange returns an iterator over the stored messages with sequence
+// numbers from start to end, included.
+func (gms *genericMsgStore) LookupRange(start, end uint64) MsgIterator {
+	return &genericMsgIterator{gms: gms, next: start, end: end}
+}
+
+// Number of messages a genericMsgIterator takes from the store at once.
+const msgIteratorBatch = 64
+
+// genericMsgIterator iterates over the messages of a genericMsgStore. It
+// takes them by batches, to lock the store once per batch instead of once
+// per message.
+type genericMsgIterator struct {
+	gms   *genericMsgStore
+	next  uint64 // sequence of the first message of the next batch
+	end   uint64
+	done  bool // no batch left
+	buf   []*spb.MsgProto
+	batch []*spb.MsgProto // messages of the current batch not returned yet
+}
+
+// Next returns the next message of the range, or nil at the end of the
+// range or if the next message is not stored.
+func (it *genericMsgIterator) Next() *spb.MsgProto {
+	if len(it.batch) == 0 {
+		if it.done {
+			return nil
+		}
+		it.fetch()
+		if len(it.batch) == 0 {
+			return nil
+		}
+	}
+	m := it.batch[0]
+	it.batch = it.batch[1:]
+	return m
+}
+
+// fetch takes the next batch of messages from the store.
+func (it *genericMsgIterator) fetch() {
+	if it.buf == nil {
+		it.buf = make([]*spb.MsgProto, 0, msgIteratorBatch)
+	}
+	batch := it.buf[:0]
+	it.gms.RLock()
+	for len(batch) < msgIteratorBatch && it.next <= it.end {
+		m := it.gms.msgs[it.next]
+		if m == nil {
+			it.done = true
+			break
+		}
+		batch = append(batch, m)
+		it.next++
+	}
+	it.gms.RUnlock()
+	if it.next > it.end {
+		it.done = true
+	}
+	it.batch = batch
+}
+
 // FirstMsg returns the first message stored.
-func (gms *genericMsgStore) FirstMsg() *pb.MsgProto {
+func (gms *genericMsgStore) FirstMsg() *spb.MsgProto {
 	gms.RLock()
 	m := gms.msgs[gms.first]
 	gms.RUnlock()
@@ -286,7 +472,7 @@ func (gms *genericMsgStore) FirstMsg() *pb.MsgProto {
 }
 
 // LastMsg returns the last message stored.
-func (gms *genericMsgStore) LastMsg() *pb.MsgProto {
+func (gms *genericMsgStore) LastMsg() *spb.MsgProto {
 	gms.RLock()
 	m := gms.msgs[gms.last]
 	gms.RUnlock()
@@ -298,6 +484,11 @@ func (gms *genericMsgStore) Flush() error {
 	return nil
 }
 
+func (gms *genericMsgStore) FlushNow() error {
+	// no-op
+	return nil
+}
+
 // GetSequenceFromTimestamp returns the sequence of the first message whose
 // timestamp is greater or equal to given timestamp.
 func (gms *genericMsgStore) GetSequenceFromTimestamp(timestamp int64) uint64 {
@@ -315,6 +506,32 @@ func (gms *genericMsgStore) GetSequenceFromTimestamp(timestamp int64) uint64 {
 	return uint64(index) + gms.first
 }
 
+// GetSequenceFromGUID returns the sequence of the stored message that was
+// published with the given GUID, 0 if there is none.
+func (gms *genericMsgStore) GetSequenceFromGUID(guid string) uint64 {
+	gms.RLock()
+	seq := gms.guids[guid]
+	gms.RUnlock()
+	return seq
+}
+
+// indexGUID records the sequence of the message by its publish GUID, if it
+// has one.
+// Lock held on entry.
+func (gms *genericMsgStore) indexGUID(m *spb.MsgProto) {
+	if m.Guid != "" {
+		gms.guids[m.Guid] = m.Sequence
+	}
+}
+
+// unindexGUID forgets the GUID of a removed message.
+// Lock held on entry.
+func (gms *genericMsgStore) unindexGUID(guid string, seq uint64) {
+	if guid != "" && gms.guids[guid] == seq {
+		delete(gms.guids, guid)
+	}
+}
+
 // Close closes this store.
 func (gms *genericMsgStore) Close() error {
 	return nil
@@ -330,6 +547,13 @@ func (gss *genericSubStore) init(channel string, limits ChannelLimits) {
 	gss.limits = limits
 }
 
+// setLimits sets the limits of this store
+func (gss *genericSubStore) setLimits(limits ChannelLimits) {
+	gss.Lock()
+	gss.limits = limits
+	gss.Unlock()
+}
+
 // CreateSub records a new subscription represented by SubState. On success,
 // it records the subscription's ID in SubState.ID. This ID is to be used
 // by the other SubStore methods.
@@ -362,6 +586,14 @@ func (gss *genericSubStore) createSub(sub *spb.SubState) error {
 	return nil
 }
 
+// AvailableSubs returns the number of subscriptions that can still be
+// created before reaching the limit.
+func (gss *genericSubStore) AvailableSubs() int {
+	gss.RLock()
+	defer gss.RUnlock()
+	return gss.limits.MaxSubs - gss.subsCount
+}
+
 // DeleteSub invalidates this subscription.
 func (gss *genericSubStore) DeleteSub(subid uint64) {
 	gss.Lock()
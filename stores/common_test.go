@@ -4,11 +4,12 @@ package stores
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
-	"github.com/nats-io/go-nats-streaming/pb"
 	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/util"
 	"github.com/nats-io/nuid"
 	"runtime"
 	"strings"
@@ -50,7 +51,7 @@ func stackFatalf(t tLogger, f string, args ...interface{}) {
 	t.Fatalf("%s", strings.Join(lines, "\n"))
 }
 
-func storeMsg(t *testing.T, s Store, channel string, data []byte) *pb.MsgProto {
+func storeMsg(t *testing.T, s Store, channel string, data []byte) *spb.MsgProto {
 	cs := s.LookupChannel(channel)
 	if cs == nil {
 		var err error
@@ -283,6 +284,70 @@ func testBasicMsgStore(t *testing.T, s Store) {
 	}
 }
 
+func testLookupRange(t *testing.T, s Store) {
+	cs, _, err := s.CreateChannel("foo", nil)
+	if err != nil {
+		t.Fatalf("Failed to create channel foo: %v", err)
+	}
+	ms := cs.Msgs
+	if m := ms.LookupRange(1, 10).Next(); m != nil {
+		t.Fatalf("Unexpected message in empty store: %v", m)
+	}
+
+	// Store more messages than an iterator takes at once.
+	total := uint64(2*msgIteratorBatch + 10)
+	for i := uint64(0); i < total; i++ {
+		storeMsg(t, s, "foo", []byte("msg"))
+	}
+	checkRange := func(start, end, expectedLast uint64) {
+		it := ms.LookupRange(start, end)
+		seq := start
+		for m := it.Next(); m != nil; m = it.Next() {
+			if m.Sequence != seq {
+				stackFatalf(t, "Expected sequence %v, got %v", seq, m.Sequence)
+			}
+			if lm := ms.Lookup(seq); lm != m {
+				stackFatalf(t, "Unexpected message: %v instead of %v", m, lm)
+			}
+			seq++
+		}
+		if seq-1 != expectedLast {
+			stackFatalf(t, "Expected last sequence %v, got %v", expectedLast, seq-1)
+		}
+		if m := it.Next(); m != nil {
+			stackFatalf(t, "Unexpected message after the end: %v", m)
+		}
+	}
+	checkRange(1, total, total)
+	checkRange(5, 5, 5)
+	checkRange(10, msgIteratorBatch+20, msgIteratorBatch+20)
+	// The range stops at the last message stored.
+	checkRange(total-3, total+100, total)
+	checkRange(total+1, total+100, total)
+	checkRange(3, 2, 2)
+}
+
+func testStoreMsg(t *testing.T, s Store) {
+	cs, _, err := s.CreateChannel("foo", nil)
+	if err != nil {
+		t.Fatalf("Failed to create channel foo: %v", err)
+	}
+	storeMsg(t, s, "foo", []byte("first"))
+	m, err := cs.Msgs.StoreMsg(&spb.MsgProto{Reply: "reply", Data: []byte("hello"), OrderingGroup: "group", GroupSequence: 10,
+		Headers: map[string]string{"trace-id": "abc"}})
+	if err != nil {
+		t.Fatalf("Unexpected error on store: %v", err)
+	}
+	if m.Sequence != 2 || m.Subject != "foo" || m.Timestamp == 0 {
+		t.Fatalf("Unexpected stored message: %v", m)
+	}
+	lm := cs.Msgs.Lookup(2)
+	if lm == nil || lm.Reply != "reply" || string(lm.Data) != "hello" || lm.OrderingGroup != "group" || lm.GroupSequence != 10 ||
+		lm.Headers["trace-id"] != "abc" {
+		t.Fatalf("Unexpected message: %v", lm)
+	}
+}
+
 func testMsgsState(t *testing.T, s Store) {
 	payload := []byte("hello")
 	lenPayload := uint64(len(payload))
@@ -388,6 +453,9 @@ func testMaxSubs(t *testing.T, s Store, maxSubs int) {
 	if err != nil {
 		t.Fatalf("Unexpected error creating channel: %v", err)
 	}
+	if n := cs.Subs.AvailableSubs(); n != maxSubs {
+		t.Fatalf("Expected %v available subs, got %v", maxSubs, n)
+	}
 	sub := &spb.SubState{}
 	numSubs := 0
 	for i := 0; i < maxSubs+1; i++ {
@@ -403,6 +471,51 @@ func testMaxSubs(t *testing.T, s Store, maxSubs int) {
 	if numSubs != maxSubs {
 		t.Fatalf("Wrong number of subs: %v vs %v", numSubs, maxSubs)
 	}
+	if n := cs.Subs.AvailableSubs(); n != 0 {
+		t.Fatalf("Expected no available subs, got %v", n)
+	}
+	cs.Subs.DeleteSub(sub.ID)
+	if n := cs.Subs.AvailableSubs(); n != 1 {
+		t.Fatalf("Expected 1 available sub, got %v", n)
+	}
+}
+
+func testChannelLimitsFunc(t *testing.T, s Store) {
+	storeMsg(t, s, "foo", []byte("hello"))
+
+	s.SetChannelLimitsFunc(func(channel string) ChannelLimits {
+		limits := testDefaultChannelLimits
+		switch channel {
+		case "foo":
+			limits.MaxNumMsgs = 2
+		case "bar":
+			limits.MaxSubs = 1
+		}
+		return limits
+	})
+
+	// The new limits apply to the existing channel.
+	for i := 0; i < 3; i++ {
+		storeMsg(t, s, "foo", []byte("hello"))
+	}
+	if count, _, err := s.MsgsState("foo"); count != 2 || err != nil {
+		t.Fatalf("Expected 2 messages, got %v (err=%v)", count, err)
+	}
+	// And to the new ones.
+	cs, _, err := s.CreateChannel("bar", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error creating channel: %v", err)
+	}
+	if n := cs.Subs.AvailableSubs(); n != 1 {
+		t.Fatalf("Expected 1 available sub, got %v", n)
+	}
+	cs, _, err = s.CreateChannel("baz", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error creating channel: %v", err)
+	}
+	if n := cs.Subs.AvailableSubs(); n != testDefaultChannelLimits.MaxSubs {
+		t.Fatalf("Expected %v available subs, got %v", testDefaultChannelLimits.MaxSubs, n)
+	}
 }
 
 func testBasicSubStore(t *testing.T, s Store) {
@@ -446,13 +559,18 @@ func testBasicSubStore(t *testing.T, s Store) {
 }
 
 func testGetSeqFromStartTime(t *testing.T, s Store) {
+	clock := util.NewManualClock(time.Now())
+	s.SetClock(clock)
 	count := 100
-	msgs := make([]*pb.MsgProto, 0, count)
+	msgs := make([]*spb.MsgProto, 0, count)
 	payload := []byte("hello")
 	for i := 0; i < count; i++ {
 		m := storeMsg(t, s, "foo", payload)
+		if m.Timestamp != clock.Now().UnixNano() {
+			t.Fatalf("Message should have been timestamped with the store's clock")
+		}
 		msgs = append(msgs, m)
-		time.Sleep(1 * time.Millisecond)
+		clock.Advance(time.Millisecond)
 	}
 
 	cs := s.LookupChannel("foo")
@@ -466,6 +584,45 @@ func testGetSeqFromStartTime(t *testing.T, s Store) {
 	}
 }
 
+func testGetSeqFromGUID(t *testing.T, s Store) {
+	limits := testDefaultChannelLimits
+	limits.MaxNumMsgs = 3
+	s.SetChannelLimits(limits)
+
+	cs, _, err := s.CreateChannel("foo", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error creating channel: %v", err)
+	}
+	for i := 1; i <= 5; i++ {
+		m := &spb.MsgProto{Data: []byte("hello"), Guid: fmt.Sprintf("guid%d", i)}
+		if _, err := cs.Msgs.StoreMsg(m); err != nil {
+			t.Fatalf("Unexpected error on store: %v", err)
+		}
+	}
+	// The first two messages were removed due to the limit.
+	for i := 1; i <= 5; i++ {
+		expected := uint64(i)
+		if i <= 2 {
+			expected = 0
+		}
+		if seq := cs.Msgs.GetSequenceFromGUID(fmt.Sprintf("guid%d", i)); seq != expected {
+			t.Fatalf("Expected sequence %v for guid%d, got %v", expected, i, seq)
+		}
+	}
+	if seq := cs.Msgs.GetSequenceFromGUID("unknown"); seq != 0 {
+		t.Fatalf("Expected sequence 0 for unknown GUID, got %v", seq)
+	}
+	if seq := cs.Msgs.GetSequenceFromGUID(""); seq != 0 {
+		t.Fatalf("Expected sequence 0 for empty GUID, got %v", seq)
+	}
+	if err := cs.Msgs.Purge(); err != nil {
+		t.Fatalf("Unexpected error on purge: %v", err)
+	}
+	if seq := cs.Msgs.GetSequenceFromGUID("guid5"); seq != 0 {
+		t.Fatalf("Expected sequence 0 after purge, got %v", seq)
+	}
+}
+
 func testClientAPIs(t *testing.T, s Store) {
 	// Delete client that does not exist
 	s.DeleteClient("client1")
@@ -551,3 +708,102 @@ func testFlush(t *testing.T, s Store) {
 		t.Fatalf("Unexpected error on flush: %v", err)
 	}
 }
+
+func testDeleteChannel(t *testing.T, s Store) {
+	limits := testDefaultChannelLimits
+	limits.MaxChannels = 2
+	s.SetChannelLimits(limits)
+
+	storeMsg(t, s, "foo", []byte("hello"))
+	subID := storeSub(t, s, "foo")
+	storeSubPending(t, s, "foo", subID, 1)
+	storeMsg(t, s, "bar", []byte("hello"))
+
+	if err := s.DeleteChannel("foo"); err != nil {
+		t.Fatalf("Unexpected error on delete: %v", err)
+	}
+	if s.LookupChannel("foo") != nil {
+		t.Fatal("Channel should have been deleted")
+	}
+	if channels := s.GetChannels(); len(channels) != 1 || channels["bar"] == nil {
+		t.Fatalf("Unexpected channels: %v", channels)
+	}
+	if count, _, _ := s.MsgsState(AllChannels); count != 1 {
+		t.Fatalf("Expected 1 message left, got %v", count)
+	}
+	// Deleting an unknown channel is not an error.
+	if err := s.DeleteChannel("foo"); err != nil {
+		t.Fatalf("Unexpected error on delete: %v", err)
+	}
+	// The channel no longer counts against the limit, and is created
+	// again empty.
+	storeMsg(t, s, "baz", []byte("hello"))
+	if err := s.DeleteChannel("baz"); err != nil {
+		t.Fatalf("Unexpected error on delete: %v", err)
+	}
+	if m := storeMsg(t, s, "foo", []byte("hello")); m.Sequence != 1 {
+		t.Fatalf("Unexpected sequence: %v", m.Sequence)
+	}
+}
+
+func testPurge(t *testing.T, s Store) {
+	limits := testDefaultChannelLimits
+	limits.MaxNumMsgs = 10
+	s.SetChannelLimits(limits)
+
+	// Make the store drop messages so that the first sequence is not 1.
+	for i := 0; i < 15; i++ {
+		storeMsg(t, s, "foo", []byte("hello"))
+	}
+	storeMsg(t, s, "bar", []byte("hello"))
+
+	cs := s.LookupChannel("foo")
+	if err := cs.Msgs.Purge(); err != nil {
+		t.Fatalf("Unexpected error on purge: %v", err)
+	}
+	count, bytes, err := s.MsgsState("foo")
+	if count != 0 || bytes != 0 || err != nil {
+		t.Fatalf("Unexpected counts: count=%v bytes=%v err=%v", count, bytes, err)
+	}
+	if first, last := cs.Msgs.FirstAndLastSequence(); first != 0 || last != 0 {
+		t.Fatalf("Unexpected sequences: first=%v last=%v", first, last)
+	}
+	if cs.Msgs.FirstMsg() != nil || cs.Msgs.LastMsg() != nil || cs.Msgs.Lookup(15) != nil {
+		t.Fatal("Messages should have been removed")
+	}
+	// Other channels are not affected.
+	if count, _, _ := s.MsgsState("bar"); count != 1 {
+		t.Fatalf("Unexpected count for other channel: %v", count)
+	}
+	// Sequences start again at 1.
+	if m := storeMsg(t, s, "foo", []byte("hello")); m.Sequence != 1 {
+		t.Fatalf("Unexpected sequence: %v", m.Sequence)
+	}
+	if first, last := cs.Msgs.FirstAndLastSequence(); first != 1 || last != 1 {
+		t.Fatalf("Unexpected sequences: first=%v last=%v", first, last)
+	}
+}
+
+// testRecoverOrderingGroups records the sequences of ordering groups in the
+// store, closes it, and checks that the last ones are recovered by `reopen`.
+func testRecoverOrderingGroups(t *testing.T, s Store, reopen func() (Store, *RecoveredState)) {
+	if err := s.Init(&spb.ServerInfo{ClusterID: "id"}); err != nil {
+		t.Fatalf("Unexpected error on init: %v", err)
+	}
+	if err := s.SetOrderingGroups(map[string]uint64{"a": 1, "b": 2}); err != nil {
+		t.Fatalf("Unexpected error setting ordering groups: %v", err)
+	}
+	if err := s.SetOrderingGroups(map[string]uint64{"a": 5}); err != nil {
+		t.Fatalf("Unexpected error setting ordering groups: %v", err)
+	}
+	s.Close()
+
+	s, state := reopen()
+	defer s.Close()
+	if state == nil {
+		t.Fatal("Expected state to be recovered")
+	}
+	if expected := map[string]uint64{"a": 5, "b": 2}; !reflect.DeepEqual(state.OrderingGroups, expected) {
+		t.Fatalf("Expected ordering groups %v, got %v", expected, state.OrderingGroups)
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Compression algorithms for the payloads of messages stored by a FileStore.
+const (
+	CompressionNone   = ""
+	CompressionGzip   = "gzip"
+	CompressionSnappy = "snappy"
+)
+
+// Flags written in the header of message files, indicating how the
+// payloads of the messages in the file are compressed.
+const (
+	fileCompressedGzip   = 1 << 17
+	fileCompressedSnappy = 1 << 18
+	fileCompressionMask  = fileCompressedGzip | fileCompressedSnappy
+)
+
+var errCorruptSnappy = errors.New("corrupt snappy payload")
+
+// compressionFlags returns the file header flags for the given compression.
+func compressionFlags(compression string) (int, error) {
+	switch compression {
+	case CompressionNone:
+		return 0, nil
+	case CompressionGzip:
+		return fileCompressedGzip, nil
+	case CompressionSnappy:
+		return fileCompressedSnappy, nil
+	}
+	return 0, fmt.Errorf("unsupported compression %q (supports %q and %q)",
+		compression, CompressionGzip, CompressionSnappy)
+}
+
+// compressPayload compresses the payload according to the file flags.
+func compressPayload(data []byte, flags int) ([]byte, error) {
+	switch flags & fileCompressionMask {
+	case fileCompressedGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case fileCompressedSnappy:
+		return snappyEncode(data), nil
+	}
+	return data, nil
+}
+
+// decompressPayload decompresses a payload read from a file with the
+// given flags.
+func decompressPayload(data []byte, flags int) ([]byte, error) {
+	switch flags & fileCompressionMask {
+	case fileCompressedGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress payload: %v", err)
+		}
+		defer r.Close()
+		plain, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress payload: %v", err)
+		}
+		return plain, nil
+	case fileCompressedSnappy:
+		plain, err := snappyDecode(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress payload: %v", err)
+		}
+		return plain, nil
+	}
+	return data, nil
+}
+
+// The functions below implement the snappy block format: the uncompressed
+// length as a varint, followed by literals and back-references copies.
+// The encoder only produces literals and copies with a 2-byte offset, but
+// the decoder accepts any valid block.
+
+const (
+	snappyTagLiteral = 0x00
+	snappyTagCopy1   = 0x01
+	snappyTagCopy2   = 0x02
+	snappyTagCopy4   = 0x03
+
+	snappyMaxOffset = 1 << 15
+	snappyHashBits  = 14
+	snappyMinMatch  = 4
+)
+
+func snappyHash(u uint32) uint32 {
+	return (u * 0x1e35a7bd) >> (32 - snappyHashBits)
+}
+
+func snappyEncode(src []byte) []byte {
+	dst := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(src)+len(src)/6+32)
+	dst = dst[:binary.PutUvarint(dst, uint64(len(src)))]
+	if len(src) == 0 {
+		return dst
+	}
+	if len(src) < snappyMinMatch {
+		return snappyEmitLiteral(dst, src)
+	}
+	var table [1 << snappyHashBits]int32
+	lit := 0
+	for i := 0; i+snappyMinMatch <= len(src); {
+		u := binary.LittleEndian.Uint32(src[i:])
+		h := snappyHash(u)
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate > snappyMaxOffset ||
+			binary.LittleEndian.Uint32(src[candidate:]) != u {
+			i++
+			continue
+		}
+		if lit < i {
+			dst = snappyEmitLiteral(dst, src[lit:i])
+		}
+		length := snappyMinMatch
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		dst = snappyEmitCopy(dst, i-candidate, length)
+		i += length
+		lit = i
+	}
+	if lit < len(src) {
+		dst = snappyEmitLiteral(dst, src[lit:])
+	}
+	return dst
+}
+
+func snappyEmitLiteral(dst, lit []byte) []byte {
+	n := len(lit) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n<<2)|snappyTagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyTagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|snappyTagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+func snappyEmitCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := length
+		if n > 64 {
+			n = 64
+			// Do not leave less than the minimum copy length behind.
+			if length-n < snappyMinMatch {
+				n = length - snappyMinMatch
+			}
+		}
+		dst = append(dst, byte(n-1)<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= n
+	}
+	return dst
+}
+
+func snappyDecode(src []byte) ([]byte, error) {
+	dlen, n := binary.Uvarint(src)
+	if n <= 0 || dlen > uint64(len(src))*256 {
+		return nil, errCorruptSnappy
+	}
+	dst := make([]byte, 0, dlen)
+	for s := n; s < len(src); {
+		tag := src[s]
+		var length, offset int
+		switch tag & 0x03 {
+		case snappyTagLiteral:
+			length = int(tag >> 2)
+			s++
+			if length >= 60 {
+				extra := length - 59
+				if s+extra > len(src) {
+					return nil, errCorruptSnappy
+				}
+				length = 0
+				for i := extra - 1; i >= 0; i-- {
+					length = length<<8 | int(src[s+i])
+				}
+				s += extra
+			}
+			length++
+			if length <= 0 || s+length > len(src) {
+				return nil, errCorruptSnappy
+			}
+			dst = append(dst, src[s:s+length]...)
+			s += length
+			continue
+		case snappyTagCopy1:
+			if s+2 > len(src) {
+				return nil, errCorruptSnappy
+			}
+			length = 4 + int(tag>>2)&0x7
+			offset = int(tag&0xe0)<<3 | int(src[s+1])
+			s += 2
+		case snappyTagCopy2:
+			if s+3 > len(src) {
+				return nil, errCorruptSnappy
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[s+1:]))
+			s += 3
+		case snappyTagCopy4:
+			if s+5 > len(src) {
+				return nil, errCorruptSnappy
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[s+1:]))
+			s += 5
+		}
+		if offset <= 0 || offset > len(dst) {
+			return nil, errCorruptSnappy
+		}
+		// Copies may overlap the bytes they produce, so copy byte by byte.
+		for start := len(dst) - offset; length > 0; length-- {
+			dst = append(dst, dst[start])
+			start++
+		}
+	}
+	if uint64(len(dst)) != dlen {
+		return nil, errCorruptSnappy
+	}
+	return dst, nil
+}
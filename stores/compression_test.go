@@ -0,0 +1,49 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestCompressPayload(t *testing.T) {
+	random := make([]byte, 10000)
+	rand.Read(random)
+	payloads := [][]byte{
+		nil,
+		[]byte("a"),
+		[]byte("abcd"),
+		bytes.Repeat([]byte("a"), 1000),
+		bytes.Repeat([]byte(`{"id": 1, "name": "compressible"}`), 3000),
+		random,
+		append(random[:5000:5000], bytes.Repeat([]byte("xyz"), 5000)...),
+	}
+	for _, flags := range []int{0, fileCompressedGzip, fileCompressedSnappy} {
+		for _, p := range payloads {
+			c, err := compressPayload(p, flags)
+			if err != nil {
+				t.Fatalf("Unexpected error compressing: %v", err)
+			}
+			d, err := decompressPayload(c, flags)
+			if err != nil {
+				t.Fatalf("Unexpected error decompressing: %v", err)
+			}
+			if !bytes.Equal(d, p) {
+				t.Fatalf("Payload of %v bytes not restored with flags %v", len(p), flags)
+			}
+		}
+	}
+	// Repetitive payloads are much smaller once compressed.
+	for _, flags := range []int{fileCompressedGzip, fileCompressedSnappy} {
+		if c, _ := compressPayload(payloads[4], flags); len(c) > len(payloads[4])/10 {
+			t.Fatalf("Payload of %v bytes poorly compressed to %v bytes with flags %v", len(payloads[4]), len(c), flags)
+		}
+	}
+	for _, flags := range []int{fileCompressedGzip, fileCompressedSnappy} {
+		if _, err := decompressPayload([]byte("\xff\xff\xff\xffcorrupt"), flags); err == nil {
+			t.Fatalf("Expected error decompressing a corrupt payload with flags %v", flags)
+		}
+	}
+}
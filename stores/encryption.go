@@ -0,0 +1,76 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+// recordCipher encrypts the records of a FileStore with AES-256-GCM. Each
+// record is stored as a random nonce followed by the sealed payload, so
+// that the CRC-32 checksum covers what is written on disk. A nil
+// recordCipher leaves records unchanged.
+type recordCipher struct {
+	aead cipher.AEAD
+}
+
+// sealedRecord is an encrypted record, written as is.
+type sealedRecord []byte
+
+func (r sealedRecord) Size() int { return len(r) }
+
+func (r sealedRecord) MarshalTo(buf []byte) (int, error) {
+	return copy(buf, r), nil
+}
+
+// newRecordCipher returns a cipher, from the crypto provider, whose AES-256
+// key is the SHA-256 hash of the given key, or nil if the key is empty.
+func newRecordCipher(key []byte) (*recordCipher, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	hash := sha256.Sum256(key)
+	aead, err := util.Crypto.NewAEAD(hash[:])
+	if err != nil {
+		return nil, err
+	}
+	return &recordCipher{aead: aead}, nil
+}
+
+// seal returns the encrypted record.
+func (c *recordCipher) seal(rec record) (record, error) {
+	if c == nil {
+		return rec, nil
+	}
+	plain := make([]byte, rec.Size())
+	if _, err := rec.MarshalTo(plain); err != nil {
+		return nil, err
+	}
+	ns := c.aead.NonceSize()
+	sealed := make([]byte, ns, ns+len(plain)+c.aead.Overhead())
+	if _, err := io.ReadFull(util.Crypto.Rand(), sealed); err != nil {
+		return nil, err
+	}
+	return sealedRecord(c.aead.Seal(sealed, sealed, plain, nil)), nil
+}
+
+// open returns the decrypted content of the record read from disk.
+func (c *recordCipher) open(buf []byte) ([]byte, error) {
+	if c == nil {
+		return buf, nil
+	}
+	ns := c.aead.NonceSize()
+	if len(buf) < ns {
+		return nil, fmt.Errorf("unable to decrypt record: too short")
+	}
+	plain, err := c.aead.Open(nil, buf[:ns], buf[ns:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt record, the key may be wrong or the store not encrypted: %v", err)
+	}
+	return plain, nil
+}
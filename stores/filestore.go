@@ -9,21 +9,36 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"bufio"
 
-	"github.com/nats-io/go-nats-streaming/pb"
 	"github.com/nats-io/nats-streaming-server/spb"
 	"github.com/nats-io/nats-streaming-server/util"
 )
 
+// FileVersion is the version of the files written by the FILE store.
+const FileVersion = fileVersion
+
 const (
 	// Our file version.
 	fileVersion = 1
 
-	// Number of files for a MsgStore on a given channel.
-	numFiles = 5
+	// The file version is stored in the low 16 bits of the file header,
+	// followed by flags describing how the records are written.
+	fileVersionMask = 0xFFFF
+	fileEncrypted   = 1 << 16
+
+	// Size of the header (version and flags) at the beginning of the files.
+	fileHeaderSize = 4
+
+	// Unless set with the SliceMaxMsgs/SliceMaxBytes options, the size of
+	// the message files of a channel is its limits divided by this number.
+	numSlices = 4
 
 	// Name of the subscriptions file.
 	subsFileName = "subs.dat"
@@ -34,6 +49,13 @@ const (
 	// Name of the server file.
 	serverFileName = "server.dat"
 
+	// Name of the file with the last sequences of the ordering groups.
+	groupsFileName = "groups.dat"
+
+	// The groups file is rewritten once it has more than this number of
+	// records, and twice as many as ordering groups.
+	groupsCompactRecs = 1000
+
 	// Number of bytes required to store a CRC-32 checksum
 	crcSize = crc32.Size
 
@@ -78,6 +100,60 @@ type FileStoreOptions struct {
 
 	// DoSync indicates if `File.Sync()`` is called during a flush.
 	DoSync bool
+
+	// EncryptionKey, if set, enables the encryption of all records with
+	// AES-256-GCM. The AES key is the SHA-256 hash of this value.
+	EncryptionKey []byte
+
+	// Compression is the algorithm used to compress the payloads of the
+	// messages written to new message files (CompressionGzip or
+	// CompressionSnappy). Existing files keep the compression they were
+	// created with.
+	Compression string
+
+	// FlushInterval, if set, defers the writes of the buffered messages to
+	// disk (followed by `File.Sync()` if DoSync is set): instead of on every
+	// `Flush()` call, messages are written at most this long after the call.
+	// Messages acknowledged to publishers may then be lost on a crash.
+	FlushInterval time.Duration
+
+	// FlushBytes, if set, makes a `Flush()` call write the buffered messages
+	// to disk only once at least this many bytes are buffered. The others
+	// are written after FlushInterval (one second if not set).
+	FlushBytes int
+
+	// AckFlushInterval, if set, coalesces the acks of the subscriptions:
+	// instead of being written as they are received, they are written, and
+	// the subscriptions file synced if DoSync is set, in one batch at most
+	// this long after the first of them. Acks not written yet are lost on a
+	// crash, and the messages redelivered after the recovery.
+	AckFlushInterval time.Duration
+
+	// TruncateBadTail, if set, makes the recovery truncate the last record
+	// of a file if it is incomplete or, with DoCRC, corrupted, as can be
+	// the case after a crash. The loss is logged. Without this option,
+	// the recovery fails.
+	TruncateBadTail bool
+
+	// SliceMaxMsgs and SliceMaxBytes set the number of messages and the
+	// size of the payloads after which a channel moves to a new message
+	// file. If not set, they are derived from the channel limits. Files
+	// whose messages have all been removed by the limits are deleted.
+	SliceMaxMsgs  int
+	SliceMaxBytes int64
+
+	// SlicePeriods, if set, makes the channels matching one of them move to
+	// a new message file at the start of each calendar period (in UTC),
+	// instead of after SliceMaxMsgs and SliceMaxBytes: each file holds the
+	// messages stored during one period, whatever their number. The first
+	// matching SlicePeriod applies.
+	SlicePeriods []*SlicePeriod
+
+	// RecoverChannels, if set, restricts the recovery to the channels
+	// matching one of these subjects, which may contain the `*` and `>`
+	// wildcards. The other channels are left untouched on disk, and can't
+	// be created until the store is opened without this restriction.
+	RecoverChannels []string
 }
 
 // DefaultFileStoreOptions defines the default options for a File Store.
@@ -168,6 +244,93 @@ func DoSync(enableFileSync bool) FileStoreOption {
 	}
 }
 
+// EncryptionKey is a FileStore option that enables the encryption of the
+// records written to disk with the given key. A store must always be opened
+// with the key it was created with.
+func EncryptionKey(key []byte) FileStoreOption {
+	return func(o *FileStoreOptions) error {
+		o.EncryptionKey = key
+		return nil
+	}
+}
+
+// Compression is a FileStore option that sets the algorithm used to
+// compress the payloads of messages (CompressionGzip or CompressionSnappy).
+func Compression(compression string) FileStoreOption {
+	return func(o *FileStoreOptions) error {
+		o.Compression = compression
+		return nil
+	}
+}
+
+// FlushInterval is a FileStore option that defers the writes of messages to
+// disk, by up to the given interval, instead of writing them on every
+// `Flush()` call.
+func FlushInterval(interval time.Duration) FileStoreOption {
+	return func(o *FileStoreOptions) error {
+		o.FlushInterval = interval
+		return nil
+	}
+}
+
+// FlushBytes is a FileStore option that makes `Flush()` write messages to
+// disk only once the given number of bytes is buffered.
+func FlushBytes(size int) FileStoreOption {
+	return func(o *FileStoreOptions) error {
+		o.FlushBytes = size
+		return nil
+	}
+}
+
+// AckFlushInterval is a FileStore option that coalesces the writes of the
+// subscriptions' acks, which are written in batches at most this long
+// after they are received.
+func AckFlushInterval(interval time.Duration) FileStoreOption {
+	return func(o *FileStoreOptions) error {
+		o.AckFlushInterval = interval
+		return nil
+	}
+}
+
+// TruncateBadTail is a FileStore option that makes the recovery truncate the
+// incomplete or corrupted last record of a file, instead of failing.
+func TruncateBadTail(truncate bool) FileStoreOption {
+	return func(o *FileStoreOptions) error {
+		o.TruncateBadTail = truncate
+		return nil
+	}
+}
+
+// SliceConfig is a FileStore option that sets the number of messages and the
+// size of the payloads after which a channel moves to a new message file.
+// A value of 0 derives the size from the channel limits.
+func SliceConfig(maxMsgs int, maxBytes int64) FileStoreOption {
+	return func(o *FileStoreOptions) error {
+		o.SliceMaxMsgs = maxMsgs
+		o.SliceMaxBytes = maxBytes
+		return nil
+	}
+}
+
+// SlicePeriods is a FileStore option that makes the channels matching one
+// of the given policies move to a new message file at the start of each
+// calendar period.
+func SlicePeriods(periods ...*SlicePeriod) FileStoreOption {
+	return func(o *FileStoreOptions) error {
+		o.SlicePeriods = periods
+		return nil
+	}
+}
+
+// RecoverChannels is a FileStore option that restricts the recovery to the
+// channels matching one of the given subjects, possibly with wildcards.
+func RecoverChannels(subjects ...string) FileStoreOption {
+	return func(o *FileStoreOptions) error {
+		o.RecoverChannels = subjects
+		return nil
+	}
+}
+
 // AllOptions is a convenient option to pass all options from a FileStoreOptions
 // structure to the constructor.
 func AllOptions(opts *FileStoreOptions) FileStoreOption {
@@ -215,6 +378,9 @@ type FileStore struct {
 	rootDir       string
 	serverFile    *os.File
 	clientsFile   *os.File
+	groupsFile    *os.File
+	groups        map[string]uint64 // last sequences of the ordering groups
+	groupsRecs    int               // number of records in the groups file
 	opts          FileStoreOptions
 	compactItvl   time.Duration
 	addClientRec  spb.ClientInfo
@@ -223,6 +389,10 @@ type FileStore struct {
 	cliDeleteRecs int // Number of deleted client records
 	cliCompactTS  time.Time
 	crcTable      *crc32.Table
+	cipher        *recordCipher       // nil if records are not encrypted
+	fileFlags     int                 // flags written in the header of the files
+	msgFileFlags  int                 // flags written in the header of new message files
+	notRecovered  map[string]struct{} // channels left on disk by the RecoverChannels option
 }
 
 type subscription struct {
@@ -246,15 +416,25 @@ type FileSubStore struct {
 	delRecs     int // Number of delete (or ack) records
 	rootDir     string
 	compactTS   time.Time
-	crcTable    *crc32.Table // reference to the one from FileStore
+	crcTable    *crc32.Table  // reference to the one from FileStore
+	cipher      *recordCipher // reference to the one from FileStore
+	fileFlags   int           // copy of the one from FileStore
+
+	// Acks not written yet, by subscription ID, with AckFlushInterval.
+	acks     map[uint64][]uint64
+	ackTimer *time.Timer // pending write of the acks
+	ackErr   error       // error of the last write of the acks, returned by the next ack
 }
 
-// fileSlice represents one of the message store file (there are a number
-// of files for a MsgStore on a given channel).
+// fileSlice represents one of the message files of a MsgStore. A channel
+// writes to its last file, and moves to a new one, with the next number,
+// once it is full.
 type fileSlice struct {
 	fileName  string
-	firstMsg  *pb.MsgProto
-	lastMsg   *pb.MsgProto
+	num       int // number of the file, in its name
+	flags     int // flags read from the file header
+	firstMsg  *spb.MsgProto
+	lastMsg   *spb.MsgProto
 	msgsCount int
 	msgsSize  uint64
 }
@@ -262,20 +442,28 @@ type fileSlice struct {
 // FileMsgStore is a per channel message file store.
 type FileMsgStore struct {
 	genericMsgStore
-	tmpMsgBuf    []byte
-	file         *os.File
-	bw           *bufio.Writer
-	files        [numFiles]*fileSlice
-	currSliceIdx int
-	opts         *FileStoreOptions // points to FileStore options
-	crcTable     *crc32.Table      // reference to the one from FileStore
+	tmpMsgBuf  []byte
+	file       *os.File
+	bw         *bufio.Writer
+	channelDir string
+	files      []*fileSlice      // ordered by number, the last one is the current file
+	removeWg   sync.WaitGroup    // removals of expired files in progress
+	opts       *FileStoreOptions // points to FileStore options
+	crcTable   *crc32.Table      // reference to the one from FileStore
+	cipher     *recordCipher     // reference to the one from FileStore
+	fileFlags  int               // flags for new message files
+	period     string            // calendar period of the message files, empty if they are split by size
+	flushTimer *time.Timer       // pending write of the buffered messages, if deferred
+	flushErr   error             // error of the last deferred write, returned by the next Flush()
 }
 
 // openFile opens the file specified by `filename`.
-// If the file exists, it checks that the version is supported.
+// If the file exists, it checks that the version is supported and that
+// the file has the given flags. Otherwise, the flags are written in the
+// header of the new file.
 // If no file mode is provided, the file is created if not present,
 // opened in Read/Write and Append mode.
-func openFile(fileName string, modes ...int) (*os.File, error) {
+func openFile(fileName string, flags int, modes ...int) (*os.File, error) {
 	checkVersion := false
 
 	mode := os.O_RDWR | os.O_CREATE | os.O_APPEND
@@ -297,10 +485,10 @@ func openFile(fileName string, modes ...int) (*os.File, error) {
 	}
 
 	if checkVersion {
-		err = checkFileVersion(file)
+		err = checkFileVersion(file, flags)
 	} else {
 		// This is a new file, write our file version
-		err = util.WriteInt(file, fileVersion)
+		err = util.WriteInt(file, fileVersion|flags)
 	}
 	if err != nil {
 		file.Close()
@@ -309,15 +497,24 @@ func openFile(fileName string, modes ...int) (*os.File, error) {
 	return file, err
 }
 
-// check that the version of the file is understood by this interface
-func checkFileVersion(r io.Reader) error {
-	fv, err := util.ReadInt(r)
+// check that the version of the file is understood by this interface,
+// and that the file has the expected flags.
+func checkFileVersion(r io.Reader, flags int) error {
+	header, err := util.ReadInt(r)
 	if err != nil {
 		return fmt.Errorf("unable to verify file version: %v", err)
 	}
+	fv := header & fileVersionMask
 	if fv == 0 || fv > fileVersion {
 		return fmt.Errorf("unsupported file version: %v (supports [1..%v])", fv, fileVersion)
 	}
+	encrypted := header&fileEncrypted != 0
+	if expected := flags&fileEncrypted != 0; encrypted != expected {
+		if encrypted {
+			return fmt.Errorf("file is encrypted but no encryption key is set")
+		}
+		return fmt.Errorf("file is not encrypted but an encryption key is set")
+	}
 	return nil
 }
 
@@ -401,6 +598,10 @@ func readRecord(r io.Reader, buf []byte, recTyped bool, crcTable *crc32.Table, c
 	// Now we are going to read the payload
 	buf = util.EnsureBufBigEnough(buf, recSize)
 	if _, err := io.ReadFull(r, buf[:recSize]); err != nil {
+		// The header was read, so the record is incomplete.
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return buf, 0, recNoType, err
 	}
 	if checkCRC {
@@ -412,10 +613,129 @@ func readRecord(r io.Reader, buf []byte, recTyped bool, crcTable *crc32.Table, c
 	return buf, recSize, recType, nil
 }
 
+// truncateBadTail is invoked when the record at `offset` of `file` can't be
+// read. With the TruncateBadTail option, if the record is incomplete, or is
+// the last one of the file, the file is truncated at `offset`, the loss of
+// `what` is logged and nil is returned. Otherwise, `rerr` is returned.
+func truncateBadTail(opts *FileStoreOptions, file *os.File, br *bufio.Reader, offset int64, what string, rerr error) error {
+	if !opts.TruncateBadTail {
+		return rerr
+	}
+	if rerr != io.ErrUnexpectedEOF {
+		// A corrupted record in the middle of the file is not the
+		// result of a crash.
+		if _, err := br.Peek(1); err != io.EOF {
+			return rerr
+		}
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(offset); err != nil {
+		return err
+	}
+	Noticef("WARNING: Truncated the last %v bytes of %q (%v), %s lost", stat.Size()-offset, file.Name(), rerr, what)
+	return nil
+}
+
 ////////////////////////////////////////////////////////////////////////////
 // FileStore methods
 ////////////////////////////////////////////////////////////////////////////
 
+// initRecordCodec creates the CRC table and the cipher used to read and
+// write the records, based on the store options.
+func (fs *FileStore) initRecordCodec() error {
+	// Create the table using polynomial in options
+	if fs.opts.CRCPolynomial == int64(crc32.IEEE) {
+		fs.crcTable = crc32.IEEETable
+	} else {
+		fs.crcTable = crc32.MakeTable(uint32(fs.opts.CRCPolynomial))
+	}
+	cipher, err := newRecordCipher(fs.opts.EncryptionKey)
+	if err != nil {
+		return fmt.Errorf("unable to create the store cipher: %v", err)
+	}
+	fs.cipher = cipher
+	if cipher != nil {
+		fs.fileFlags |= fileEncrypted
+	}
+	return nil
+}
+
+// ReadFileStoreState reads the server info and the clients of the file
+// store in `rootDir` without creating, locking or modifying any file, for
+// instance to check a data directory before starting a server on it.
+// Subscriptions and messages are not read: the Subs map of the returned
+// state only has the names of the channels that NewFileStore would recover.
+// The returned state is nil if the store has not been initialized.
+func ReadFileStoreState(rootDir string, options ...FileStoreOption) (*RecoveredState, error) {
+	fs := &FileStore{
+		rootDir: rootDir,
+		opts:    DefaultFileStoreOptions,
+	}
+	fs.init(TypeFile, nil)
+	for _, opt := range options {
+		if err := opt(&fs.opts); err != nil {
+			return nil, err
+		}
+	}
+	if err := fs.initRecordCodec(); err != nil {
+		return nil, err
+	}
+	// A bad tail is reported, not truncated.
+	fs.opts.TruncateBadTail = false
+
+	openReadOnly := func(name string) (*os.File, error) {
+		file, err := os.Open(filepath.Join(rootDir, name))
+		if err != nil {
+			return nil, err
+		}
+		if err := checkFileVersion(file, fs.fileFlags); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		return file, nil
+	}
+
+	var err error
+	fs.serverFile, err = openReadOnly(serverFileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fs.serverFile.Close()
+	info, err := fs.recoverServerInfo()
+	if info == nil || err != nil {
+		return nil, err
+	}
+	fs.clientsFile, err = openReadOnly(clientsFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.clientsFile.Close()
+	clients, err := fs.recoverClients()
+	if err != nil {
+		return nil, err
+	}
+	channels, err := ioutil.ReadDir(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	state := &RecoveredState{
+		Info:    info,
+		Clients: clients,
+		Subs:    make(RecoveredSubscriptions),
+	}
+	for _, c := range channels {
+		if c.IsDir() && fs.shouldRecover(c.Name()) {
+			state.Subs[c.Name()] = nil
+		}
+	}
+	return state, nil
+}
+
 // NewFileStore returns a factory for stores backed by files, and recovers
 // any state present.
 // If not limits are provided, the store will be created with
@@ -434,18 +754,35 @@ func NewFileStore(rootDir string, limits *ChannelLimits, options ...FileStoreOpt
 	}
 	// Convert the compact interval in time.Duration
 	fs.compactItvl = time.Duration(fs.opts.CompactInterval) * time.Second
-	// Create the table using polynomial in options
-	if fs.opts.CRCPolynomial == int64(crc32.IEEE) {
-		fs.crcTable = crc32.IEEETable
-	} else {
-		fs.crcTable = crc32.MakeTable(uint32(fs.opts.CRCPolynomial))
+	if err := fs.initRecordCodec(); err != nil {
+		return nil, nil, err
+	}
+	compression, err := compressionFlags(fs.opts.Compression)
+	if err != nil {
+		return nil, nil, err
+	}
+	fs.msgFileFlags = fs.fileFlags | compression
+	if fs.opts.FlushInterval < 0 || fs.opts.FlushBytes < 0 || fs.opts.AckFlushInterval < 0 {
+		return nil, nil, fmt.Errorf("flush interval, flush bytes and ack flush interval can't be negative")
+	}
+	if fs.opts.SliceMaxMsgs < 0 || fs.opts.SliceMaxBytes < 0 {
+		return nil, nil, fmt.Errorf("slice max msgs and slice max bytes can't be negative")
+	}
+	for _, subject := range fs.opts.RecoverChannels {
+		if !util.IsValidSubjectPattern(subject) {
+			return nil, nil, fmt.Errorf("invalid subject %q in recover channels", subject)
+		}
+	}
+	for _, sp := range fs.opts.SlicePeriods {
+		if err := sp.validate(); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	if err := os.MkdirAll(rootDir, os.ModeDir+os.ModePerm); err != nil && !os.IsExist(err) {
 		return nil, nil, fmt.Errorf("unable to create the root directory [%s]: %v", rootDir, err)
 	}
 
-	var err error
 	var recoveredState *RecoveredState
 	var serverInfo *spb.ServerInfo
 	var recoveredClients []*Client
@@ -464,17 +801,25 @@ func NewFileStore(rootDir string, limits *ChannelLimits, options ...FileStoreOpt
 	// Open/Create the server file (note that this file must not be opened,
 	// in APPEND mode to allow truncate to work).
 	fileName := filepath.Join(fs.rootDir, serverFileName)
-	fs.serverFile, err = openFile(fileName, os.O_RDWR, os.O_CREATE)
+	fs.serverFile, err = openFile(fileName, fs.fileFlags, os.O_RDWR, os.O_CREATE)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// Open/Create the client file.
 	fileName = filepath.Join(fs.rootDir, clientsFileName)
-	fs.clientsFile, err = openFile(fileName)
+	fs.clientsFile, err = openFile(fileName, fs.fileFlags)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Open/Create the ordering groups file.
+	fileName = filepath.Join(fs.rootDir, groupsFileName)
+	fs.groupsFile, err = openFile(fileName, fs.fileFlags)
 	if err != nil {
 		return nil, nil, err
 	}
+	fs.groups = make(map[string]uint64)
 
 	// Recover the server file.
 	serverInfo, err = fs.recoverServerInfo()
@@ -493,6 +838,11 @@ func NewFileStore(rootDir string, limits *ChannelLimits, options ...FileStoreOpt
 		return nil, nil, err
 	}
 
+	// Recover the ordering groups file
+	if err = fs.recoverOrderingGroups(); err != nil {
+		return nil, nil, err
+	}
+
 	// Get the channels (there are subdirectories of rootDir)
 	channels, err = ioutil.ReadDir(rootDir)
 	if err != nil {
@@ -508,6 +858,14 @@ func NewFileStore(rootDir string, limits *ChannelLimits, options ...FileStoreOpt
 		channel := c.Name()
 		channelDirName := filepath.Join(rootDir, channel)
 
+		if !fs.shouldRecover(channel) {
+			if fs.notRecovered == nil {
+				fs.notRecovered = make(map[string]struct{})
+			}
+			fs.notRecovered[channel] = struct{}{}
+			continue
+		}
+
 		// Recover messages for this channel
 		msgStore, err = fs.newFileMsgStore(channelDirName, channel, true)
 		if err != nil {
@@ -559,15 +917,37 @@ func NewFileStore(rootDir string, limits *ChannelLimits, options ...FileStoreOpt
 	if err != nil {
 		return nil, nil, err
 	}
+	if len(fs.notRecovered) > 0 {
+		Noticef("STAN: Recovered %v channels, %v channels not matching %v left on disk",
+			len(fs.channels), len(fs.notRecovered), fs.opts.RecoverChannels)
+	}
 	// Create the recovered state to return
 	recoveredState = &RecoveredState{
-		Info:    serverInfo,
-		Clients: recoveredClients,
-		Subs:    recoveredSubs,
+		Info:           serverInfo,
+		Clients:        recoveredClients,
+		Subs:           recoveredSubs,
+		OrderingGroups: make(map[string]uint64, len(fs.groups)),
+	}
+	for name, seq := range fs.groups {
+		recoveredState.OrderingGroups[name] = seq
 	}
 	return fs, recoveredState, nil
 }
 
+// shouldRecover returns true if the channel matches the RecoverChannels
+// option, or if the option is not set.
+func (fs *FileStore) shouldRecover(channel string) bool {
+	if len(fs.opts.RecoverChannels) == 0 {
+		return true
+	}
+	for _, subject := range fs.opts.RecoverChannels {
+		if util.SubjectMatches(subject, channel) {
+			return true
+		}
+	}
+	return false
+}
+
 // Init is used to persist server's information after the first start
 func (fs *FileStore) Init(info *spb.ServerInfo) error {
 	fs.Lock()
@@ -582,8 +962,12 @@ func (fs *FileStore) Init(info *spb.ServerInfo) error {
 	if _, err := f.Seek(4, 0); err != nil {
 		return err
 	}
+	rec, err := fs.cipher.seal(info)
+	if err != nil {
+		return err
+	}
 	// ServerInfo record is not typed. We also don't pass a reusable buffer.
-	if _, _, err := writeRecord(f, nil, recNoType, info, fs.crcTable); err != nil {
+	if _, _, err := writeRecord(f, nil, recNoType, rec, fs.crcTable); err != nil {
 		return err
 	}
 	return nil
@@ -606,15 +990,23 @@ func (fs *FileStore) recoverClients() ([]*Client, error) {
 		if err != nil {
 			if err == io.EOF {
 				err = nil
-				break
+			} else {
+				err = truncateBadTail(&fs.opts, fs.clientsFile, br, fileHeaderSize+fs.cliFileSize, "last client update", err)
 			}
-			return nil, err
+			if err != nil {
+				return nil, err
+			}
+			break
 		}
 		fs.cliFileSize += int64(recSize + recordHeaderSize)
+		content, err := fs.cipher.open(buf[:recSize])
+		if err != nil {
+			return nil, err
+		}
 		switch recType {
 		case addClient:
 			c := &Client{}
-			if err := c.ClientInfo.Unmarshal(buf[:recSize]); err != nil {
+			if err := c.ClientInfo.Unmarshal(content); err != nil {
 				return nil, err
 			}
 			// Add to the map. Note that if one already exists, which should
@@ -622,7 +1014,7 @@ func (fs *FileStore) recoverClients() ([]*Client, error) {
 			fs.clients[c.ID] = c
 		case delClient:
 			c := spb.ClientDelete{}
-			if err := c.Unmarshal(buf[:recSize]); err != nil {
+			if err := c.Unmarshal(content); err != nil {
 				return nil, err
 			}
 			delete(fs.clients, c.ID)
@@ -641,6 +1033,112 @@ func (fs *FileStore) recoverClients() ([]*Client, error) {
 	return clients, nil
 }
 
+// recoverOrderingGroups reads the ordering groups file. A group may have
+// several records, the last one has its last sequence.
+func (fs *FileStore) recoverOrderingGroups() error {
+	_buf := [256]byte{}
+	buf := _buf[:]
+	size := int64(0)
+
+	br := bufio.NewReaderSize(fs.groupsFile, defaultBufSize)
+	for {
+		var recSize int
+		var err error
+		buf, recSize, _, err = readRecord(br, buf, false, fs.crcTable, fs.opts.DoCRC)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return truncateBadTail(&fs.opts, fs.groupsFile, br, fileHeaderSize+size, "last ordering group", err)
+		}
+		size += int64(recSize + recordHeaderSize)
+		content, err := fs.cipher.open(buf[:recSize])
+		if err != nil {
+			return err
+		}
+		g := spb.OrderingGroupState{}
+		if err := g.Unmarshal(content); err != nil {
+			return err
+		}
+		fs.groups[g.Name] = g.Sequence
+		fs.groupsRecs++
+	}
+}
+
+// SetOrderingGroups records the last sequences of the ordering groups.
+func (fs *FileStore) SetOrderingGroups(groups map[string]uint64) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	for name, seq := range groups {
+		fs.groups[name] = seq
+	}
+	if recs := fs.groupsRecs + len(groups); recs > groupsCompactRecs && recs > 2*len(fs.groups) {
+		return fs.compactOrderingGroupsFile()
+	}
+	bw := bufio.NewWriter(fs.groupsFile)
+	if err := fs.writeOrderingGroups(bw, groups); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	fs.groupsRecs += len(groups)
+	if fs.opts.DoSync {
+		return fs.groupsFile.Sync()
+	}
+	return nil
+}
+
+// writeOrderingGroups writes a record for each group. Lock held on entry.
+func (fs *FileStore) writeOrderingGroups(w io.Writer, groups map[string]uint64) error {
+	var buf []byte
+	for name, seq := range groups {
+		rec, err := fs.cipher.seal(&spb.OrderingGroupState{Name: name, Sequence: seq})
+		if err != nil {
+			return err
+		}
+		if buf, _, err = writeRecord(w, buf, recNoType, rec, fs.crcTable); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactOrderingGroupsFile rewrites the groups file with a record for
+// each group. Lock held on entry.
+func (fs *FileStore) compactOrderingGroupsFile() error {
+	tmpFile, err := getTempFile(fs.rootDir, groupsFileName, fs.fileFlags)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tmpFile != nil {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
+		}
+	}()
+	bw := bufio.NewWriterSize(tmpFile, defaultBufSize)
+	if err := fs.writeOrderingGroups(bw, fs.groups); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if fs.opts.DoSync {
+		if err := tmpFile.Sync(); err != nil {
+			return err
+		}
+	}
+	fs.groupsFile, err = swapFiles(tmpFile, fs.groupsFile, fs.fileFlags)
+	if err != nil {
+		return err
+	}
+	tmpFile = nil
+	fs.groupsRecs = len(fs.groups)
+	return nil
+}
+
 // recoverServerInfo reads the server file and returns a ServerInfo structure
 func (fs *FileStore) recoverServerInfo() (*spb.ServerInfo, error) {
 	file := fs.serverFile
@@ -666,8 +1164,12 @@ func (fs *FileStore) recoverServerInfo() (*spb.ServerInfo, error) {
 		return nil, fmt.Errorf("incorrect file size, expected %v bytes, got %v bytes",
 			expectedSize, fstat.Size())
 	}
+	content, err := fs.cipher.open(buf[:size])
+	if err != nil {
+		return nil, err
+	}
 	// Reconstruct now
-	if err := info.Unmarshal(buf[:size]); err != nil {
+	if err := info.Unmarshal(content); err != nil {
 		return nil, err
 	}
 	return info, nil
@@ -682,6 +1184,10 @@ func (fs *FileStore) CreateChannel(channel string, userData interface{}) (*Chann
 	if channelStore != nil {
 		return channelStore, false, nil
 	}
+	// The files of a channel that was not recovered must not be replaced.
+	if _, ok := fs.notRecovered[channel]; ok {
+		return nil, false, ErrChannelNotRecovered
+	}
 
 	// Check for limits
 	if err := fs.canAddChannel(); err != nil {
@@ -720,6 +1226,20 @@ func (fs *FileStore) CreateChannel(channel string, userData interface{}) (*Chann
 	return channelStore, true, nil
 }
 
+// DeleteChannel closes the channel's files and removes its directory.
+func (fs *FileStore) DeleteChannel(channel string) error {
+	fs.Lock()
+	defer fs.Unlock()
+	cs, err := fs.deleteChannel(channel)
+	if cs == nil {
+		return err
+	}
+	if lerr := os.RemoveAll(filepath.Join(fs.rootDir, channel)); lerr != nil && err == nil {
+		err = lerr
+	}
+	return err
+}
+
 // AddClient stores information about the client identified by `clientID`.
 func (fs *FileStore) AddClient(clientID, hbInbox string, userData interface{}) (*Client, bool, error) {
 	sc, isNew, err := fs.genericStore.AddClient(clientID, hbInbox, userData)
@@ -731,7 +1251,11 @@ func (fs *FileStore) AddClient(clientID, hbInbox string, userData interface{}) (
 	}
 	fs.Lock()
 	fs.addClientRec = spb.ClientInfo{ID: clientID, HbInbox: hbInbox}
-	_, size, err := writeRecord(fs.clientsFile, nil, addClient, &fs.addClientRec, fs.crcTable)
+	size := 0
+	rec, err := fs.cipher.seal(&fs.addClientRec)
+	if err == nil {
+		_, size, err = writeRecord(fs.clientsFile, nil, addClient, rec, fs.crcTable)
+	}
 	if err != nil {
 		delete(fs.clients, clientID)
 		fs.Unlock()
@@ -748,7 +1272,10 @@ func (fs *FileStore) DeleteClient(clientID string) *Client {
 	if sc != nil {
 		fs.Lock()
 		fs.delClientRec = spb.ClientDelete{ID: clientID}
-		_, size, _ := writeRecord(fs.clientsFile, nil, delClient, &fs.delClientRec, fs.crcTable)
+		size := 0
+		if rec, err := fs.cipher.seal(&fs.delClientRec); err == nil {
+			_, size, _ = writeRecord(fs.clientsFile, nil, delClient, rec, fs.crcTable)
+		}
 		fs.cliDeleteRecs++
 		fs.cliFileSize += int64(size)
 		// Check if this triggers a need for compaction
@@ -789,7 +1316,7 @@ func (fs *FileStore) shouldCompactClientFile() bool {
 // Store lock held on entry
 func (fs *FileStore) compactClientFile() error {
 	// Open a temporary file
-	tmpFile, err := getTempFile(fs.rootDir, clientsFileName)
+	tmpFile, err := getTempFile(fs.rootDir, clientsFileName, fs.fileFlags)
 	if err != nil {
 		return err
 	}
@@ -807,7 +1334,11 @@ func (fs *FileStore) compactClientFile() error {
 	// Dump the content of active clients into the temporary file.
 	for _, c := range fs.clients {
 		fs.addClientRec = spb.ClientInfo{ID: c.ID, HbInbox: c.HbInbox}
-		buf, size, err = writeRecord(bw, buf, addClient, &fs.addClientRec, fs.crcTable)
+		var rec record
+		if rec, err = fs.cipher.seal(&fs.addClientRec); err != nil {
+			return err
+		}
+		buf, size, err = writeRecord(bw, buf, addClient, rec, fs.crcTable)
 		if err != nil {
 			return err
 		}
@@ -818,7 +1349,7 @@ func (fs *FileStore) compactClientFile() error {
 		return err
 	}
 	// Switch the temporary file with the original one.
-	fs.clientsFile, err = swapFiles(tmpFile, fs.clientsFile)
+	fs.clientsFile, err = swapFiles(tmpFile, fs.clientsFile, fs.fileFlags)
 	if err != nil {
 		return err
 	}
@@ -831,13 +1362,22 @@ func (fs *FileStore) compactClientFile() error {
 	return nil
 }
 
-// Return a temporary file (including file version)
-func getTempFile(rootDir, prefix string) (*os.File, error) {
+// readFileFlags returns the flags written in the header of the file.
+func readFileFlags(file *os.File) (int, error) {
+	var header [4]byte
+	if _, err := file.ReadAt(header[:], 0); err != nil {
+		return 0, fmt.Errorf("unable to read file header: %v", err)
+	}
+	return int(util.ByteOrder.Uint32(header[:])) &^ fileVersionMask, nil
+}
+
+// Return a temporary file (including file version and flags)
+func getTempFile(rootDir, prefix string, flags int) (*os.File, error) {
 	tmpFile, err := ioutil.TempFile(rootDir, prefix)
 	if err != nil {
 		return nil, err
 	}
-	if err := util.WriteInt(tmpFile, fileVersion); err != nil {
+	if err := util.WriteInt(tmpFile, fileVersion|flags); err != nil {
 		return nil, err
 	}
 	return tmpFile, nil
@@ -846,7 +1386,7 @@ func getTempFile(rootDir, prefix string) (*os.File, error) {
 // When a store file is compacted, the content is rewritten into a
 // temporary file. When this is done, the temporary file replaces
 // the original file.
-func swapFiles(tempFile *os.File, activeFile *os.File) (*os.File, error) {
+func swapFiles(tempFile *os.File, activeFile *os.File, flags int) (*os.File, error) {
 	activeFileName := activeFile.Name()
 	tempFileName := tempFile.Name()
 
@@ -868,7 +1408,7 @@ func swapFiles(tempFile *os.File, activeFile *os.File) (*os.File, error) {
 	// Rename the tmp file to original file name
 	err := os.Rename(tempFileName, activeFileName)
 	// Need to re-open the active file anyway
-	file, lerr := openFile(activeFileName)
+	file, lerr := openFile(activeFileName, flags)
 	if lerr != nil && err == nil {
 		err = lerr
 	}
@@ -896,6 +1436,7 @@ func (fs *FileStore) Close() error {
 	err = fs.genericStore.close()
 	closeFile(fs.serverFile)
 	closeFile(fs.clientsFile)
+	closeFile(fs.groupsFile)
 	return err
 }
 
@@ -906,41 +1447,22 @@ func (fs *FileStore) Close() error {
 // newFileMsgStore returns a new instace of a file MsgStore.
 func (fs *FileStore) newFileMsgStore(channelDirName, channel string, doRecover bool) (*FileMsgStore, error) {
 	var err error
-	var file *os.File
 
 	// Create an instance and initialize
 	ms := &FileMsgStore{
-		opts:     &fs.opts,
-		crcTable: fs.crcTable,
+		opts:       &fs.opts,
+		crcTable:   fs.crcTable,
+		cipher:     fs.cipher,
+		fileFlags:  fs.msgFileFlags,
+		channelDir: channelDirName,
+		period:     slicePeriodFor(fs.opts.SlicePeriods, channel),
 	}
-	ms.init(channel, fs.limits)
-
-	// Open/create all the files
-	for i := 0; i < numFiles; i++ {
-		// Fully qualified file name.
-		fileName := filepath.Join(channelDirName, fmt.Sprintf("msgs.%d.dat", (i+1)))
-
-		// Open the file.
-		file, err = openFile(fileName)
-		if err != nil {
-			break
-		}
-		// Save slice
-		ms.files[i] = &fileSlice{fileName: fileName}
+	ms.init(channel, fs.channelLimits(channel), fs.clock)
 
-		// Should we try to recover (startup case)
-		if doRecover {
-			err = ms.recoverOneMsgFile(file, i)
-		} else if i == 0 {
-			// Otherwise, keep the first file opened...
-			ms.setFile(file)
-		} else {
-			// and close all others.
-			err = file.Close()
-		}
-		if err != nil {
-			break
-		}
+	if doRecover {
+		err = ms.recoverMsgFiles()
+	} else {
+		err = ms.addSlice()
 	}
 	// Cleanup on error
 	if err != nil {
@@ -957,6 +1479,180 @@ func (fs *FileStore) newFileMsgStore(channelDirName, channel string, doRecover b
 	return ms, nil
 }
 
+// msgFileName returns the name of the message file with the given number.
+func msgFileName(channelDirName string, num int) string {
+	return filepath.Join(channelDirName, fmt.Sprintf("msgs.%d.dat", num))
+}
+
+// listMsgFiles returns the message files of the channel directory, ordered
+// by number.
+func listMsgFiles(channelDirName string) ([]*fileSlice, error) {
+	files, err := ioutil.ReadDir(channelDirName)
+	if err != nil {
+		return nil, err
+	}
+	var slices []*fileSlice
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, "msgs.") || !strings.HasSuffix(name, ".dat") {
+			continue
+		}
+		num, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "msgs."), ".dat"))
+		if err != nil || num <= 0 {
+			continue
+		}
+		slices = append(slices, &fileSlice{fileName: filepath.Join(channelDirName, name), num: num})
+	}
+	sort.Sort(byNum(slices))
+	return slices, nil
+}
+
+type byNum []*fileSlice
+
+func (a byNum) Len() int           { return (len(a)) }
+func (a byNum) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byNum) Less(i, j int) bool { return a[i].num < a[j].num }
+
+// recoverMsgFiles recovers the messages of all the message files. Empty
+// files, such as the ones created in advance by previous versions of the
+// store, are removed, unless this is the last file, which stays the
+// current one.
+func (ms *FileMsgStore) recoverMsgFiles() error {
+	slices, err := listMsgFiles(ms.channelDir)
+	if err != nil {
+		return err
+	}
+	for i, fslice := range slices {
+		file, err := ms.openSliceFile(fslice)
+		if err != nil {
+			return err
+		}
+		if err := ms.recoverOneMsgFile(fslice, file); err != nil {
+			file.Close()
+			return err
+		}
+		// Keep the last file opened, it is the current one.
+		last := i == len(slices)-1
+		if last {
+			ms.setFile(file)
+		} else if err := file.Close(); err != nil {
+			return err
+		}
+		if fslice.msgsCount == 0 && !last {
+			if err := os.Remove(fslice.fileName); err != nil {
+				return err
+			}
+			continue
+		}
+		ms.files = append(ms.files, fslice)
+	}
+	if len(ms.files) == 0 {
+		return ms.addSlice()
+	}
+	return nil
+}
+
+// addSlice creates the message file following the last one, and makes it
+// the current file. Lock held on entry, with the previous current file
+// closed.
+func (ms *FileMsgStore) addSlice() error {
+	num := 1
+	if n := len(ms.files); n > 0 {
+		num = ms.files[n-1].num + 1
+	}
+	fslice := &fileSlice{fileName: msgFileName(ms.channelDir, num), num: num}
+	file, err := ms.openSliceFile(fslice)
+	if err != nil {
+		return err
+	}
+	ms.files = append(ms.files, fslice)
+	ms.setFile(file)
+	return nil
+}
+
+// currSlice returns the file the messages are written to.
+// Lock held on entry.
+func (ms *FileMsgStore) currSlice() *fileSlice {
+	return ms.files[len(ms.files)-1]
+}
+
+// sliceFull returns true if the given file has reached the size after which
+// messages are written to a new file or, if the files of the channel are
+// split by period, if the message stored at `now` belongs to a period
+// following the one of the file. Lock held on entry.
+func (ms *FileMsgStore) sliceFull(fslice *fileSlice, now int64) bool {
+	if ms.period != "" {
+		return periodStart(ms.period, now) != periodStart(ms.period, fslice.firstMsg.Timestamp)
+	}
+	maxMsgs := ms.opts.SliceMaxMsgs
+	if maxMsgs == 0 {
+		maxMsgs = ms.limits.MaxNumMsgs / numSlices
+	}
+	maxBytes := uint64(ms.opts.SliceMaxBytes)
+	if maxBytes == 0 {
+		maxBytes = ms.limits.MaxMsgBytes / numSlices
+	}
+	return fslice.msgsCount >= maxMsgs || fslice.msgsSize >= maxBytes
+}
+
+// removeFirstSlice removes the first file, whose messages have all been
+// removed, from the list of files and deletes it in the background.
+// Lock held on entry.
+func (ms *FileMsgStore) removeFirstSlice() {
+	fslice := ms.files[0]
+	ms.files[0] = nil
+	ms.files = ms.files[1:]
+
+	ms.removeWg.Add(1)
+	go func() {
+		defer ms.removeWg.Done()
+		if err := os.Remove(fslice.fileName); err != nil && !os.IsNotExist(err) {
+			Noticef("WARNING: Unable to remove expired message file %q: %v", fslice.fileName, err)
+		}
+	}()
+}
+
+// openSliceFile opens the file of the given slice. A file without messages
+// gets the store's flags, while a file with messages keeps the flags it was
+// created with, so that files with different compressions can coexist.
+func (ms *FileMsgStore) openSliceFile(fslice *fileSlice) (*os.File, error) {
+	file, err := openFile(fslice.fileName, ms.fileFlags)
+	if err != nil {
+		return nil, err
+	}
+	if err := ms.readSliceFlags(fslice, file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (ms *FileMsgStore) readSliceFlags(fslice *fileSlice, file *os.File) error {
+	flags, err := readFileFlags(file)
+	if err != nil {
+		return err
+	}
+	fslice.flags = flags
+	if flags == ms.fileFlags {
+		return nil
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	// Rewrite the header of a file without messages.
+	if stat.Size() == 4 {
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+		if err := util.WriteInt(file, fileVersion|ms.fileFlags); err != nil {
+			return err
+		}
+		fslice.flags = ms.fileFlags
+	}
+	return nil
+}
+
 func (ms *FileMsgStore) setFile(f *os.File) {
 	ms.bw = nil
 	ms.file = f
@@ -965,17 +1661,16 @@ func (ms *FileMsgStore) setFile(f *os.File) {
 	}
 }
 
-// recovers one of the file
-func (ms *FileMsgStore) recoverOneMsgFile(file *os.File, numFile int) error {
+// recovers the messages of one of the files
+func (ms *FileMsgStore) recoverOneMsgFile(fslice *fileSlice, file *os.File) error {
 	var err error
 
 	msgSize := 0
-	var msg *pb.MsgProto
-
-	fslice := ms.files[numFile]
+	var msg *spb.MsgProto
 
 	// Create a buffered reader to speed-up recovery
 	br := bufio.NewReaderSize(file, defaultBufSize)
+	offset := int64(fileHeaderSize)
 
 	for {
 		ms.tmpMsgBuf, msgSize, _, err = readRecord(br, ms.tmpMsgBuf, false, ms.crcTable, ms.opts.DoCRC)
@@ -983,13 +1678,30 @@ func (ms *FileMsgStore) recoverOneMsgFile(file *os.File, numFile int) error {
 			if err == io.EOF {
 				// We are done, reset err
 				err = nil
+			} else {
+				lastSeq := ms.last
+				if msg != nil {
+					lastSeq = msg.Sequence
+				}
+				what := fmt.Sprintf("messages after sequence %v of [%s]", lastSeq, ms.subject)
+				err = truncateBadTail(ms.opts, file, br, offset, what, err)
 			}
 			break
 		}
+		offset += int64(recordHeaderSize + msgSize)
 
 		// Recover this message
-		msg = &pb.MsgProto{}
-		err = msg.Unmarshal(ms.tmpMsgBuf[:msgSize])
+		var content []byte
+		content, err = ms.cipher.open(ms.tmpMsgBuf[:msgSize])
+		if err != nil {
+			break
+		}
+		msg = &spb.MsgProto{}
+		err = msg.Unmarshal(content)
+		if err != nil {
+			break
+		}
+		msg.Data, err = decompressPayload(msg.Data, fslice.flags)
 		if err != nil {
 			break
 		}
@@ -1005,80 +1717,69 @@ func (ms *FileMsgStore) recoverOneMsgFile(file *os.File, numFile int) error {
 			ms.first = msg.Sequence
 		}
 		ms.msgs[msg.Sequence] = msg
+		ms.indexGUID(msg)
 	}
 
-	// Do more accounting and bump the current slice index if we recovered
-	// at least one message on that file.
+	// Do more accounting if we recovered at least one message on that file.
 	if err == nil && fslice.msgsCount > 0 {
 		ms.last = fslice.lastMsg.Sequence
 		ms.totalCount += fslice.msgsCount
 		ms.totalBytes += fslice.msgsSize
-		ms.currSliceIdx = numFile
-
-		// Close the previous file
-		if numFile > 0 {
-			err = ms.file.Close()
-			ms.setFile(nil)
-		}
-	}
-	// Keep the file opened if this is the first or messages were recovered
-	if err == nil && (fslice.msgsCount > 0 || numFile == 0) {
-		ms.setFile(file)
-	} else {
-		// Close otherwise...
-		if lerr := file.Close(); lerr != nil {
-			if err == nil {
-				err = lerr
-			}
-		}
 	}
 	return err
 }
 
 // Store a given message.
-func (ms *FileMsgStore) Store(reply string, data []byte) (*pb.MsgProto, error) {
+func (ms *FileMsgStore) Store(reply string, data []byte) (*spb.MsgProto, error) {
+	return ms.StoreMsg(&spb.MsgProto{Reply: reply, Data: data})
+}
+
+// StoreMsg stores the given message, assigning its sequence, subject and
+// timestamp.
+func (ms *FileMsgStore) StoreMsg(m *spb.MsgProto) (*spb.MsgProto, error) {
 	ms.Lock()
 	defer ms.Unlock()
 
-	fslice := ms.files[ms.currSliceIdx]
+	fslice := ms.currSlice()
+	now := ms.clock.Now().UnixNano()
 
-	// Check if we need to move to next file slice
-	if (ms.currSliceIdx < numFiles-1) &&
-		((fslice.msgsCount >= ms.limits.MaxNumMsgs/(numFiles-1)) ||
-			(fslice.msgsSize >= ms.limits.MaxMsgBytes/(numFiles-1))) {
-
-		// Don't change store variable until success...
-		nextSlice := ms.currSliceIdx + 1
-
-		// Close the file and open the next slice
+	// Check if we need to move to a new file. An empty file is never
+	// left behind, even with limits too small to be split between files.
+	if fslice.msgsCount > 0 && ms.sliceFull(fslice, now) {
+		// Close the file and create the next one
 		if err := ms.flush(); err != nil {
 			return nil, err
 		}
 		if err := ms.file.Close(); err != nil {
 			return nil, err
 		}
-		file, err := openFile(ms.files[nextSlice].fileName)
-		if err != nil {
+		if err := ms.addSlice(); err != nil {
 			return nil, err
 		}
-		// Success, update the store's variables
-		ms.setFile(file)
-		ms.currSliceIdx = nextSlice
-
-		fslice = ms.files[ms.currSliceIdx]
+		fslice = ms.currSlice()
 	}
 
 	seq := ms.last + 1
-	m := &pb.MsgProto{
-		Sequence:  seq,
-		Subject:   ms.subject,
-		Reply:     reply,
-		Data:      data,
-		Timestamp: time.Now().UnixNano(),
+	m.Sequence = seq
+	m.Subject = ms.subject
+	m.Timestamp = now
+
+	// Only the stored copy of the message has its payload compressed.
+	stored := m
+	if fslice.flags&fileCompressionMask != 0 {
+		data, err := compressPayload(m.Data, fslice.flags)
+		if err != nil {
+			return nil, err
+		}
+		cm := *m
+		cm.Data = data
+		stored = &cm
 	}
-
-	var err error
-	ms.tmpMsgBuf, _, err = writeRecord(ms.bw, ms.tmpMsgBuf, recNoType, m, ms.crcTable)
+	rec, err := ms.cipher.seal(stored)
+	if err != nil {
+		return nil, err
+	}
+	ms.tmpMsgBuf, _, err = writeRecord(ms.bw, ms.tmpMsgBuf, recNoType, rec, ms.crcTable)
 	if err != nil {
 		return nil, err
 	}
@@ -1088,8 +1789,9 @@ func (ms *FileMsgStore) Store(reply string, data []byte) (*pb.MsgProto, error) {
 	}
 	ms.last = seq
 	ms.msgs[ms.last] = m
+	ms.indexGUID(m)
 
-	msgSize := uint64(len(data))
+	msgSize := uint64(len(m.Data))
 
 	// Total stats
 	ms.totalCount++
@@ -1105,18 +1807,14 @@ func (ms *FileMsgStore) Store(reply string, data []byte) (*pb.MsgProto, error) {
 	}
 	fslice.lastMsg = m
 
-	// Enfore limits and update file slice if needed.
-	if err := ms.enforceLimits(); err != nil {
-		return nil, err
-	}
+	// Enfore limits and update file slices if needed.
+	ms.enforceLimits()
 	return m, nil
 }
 
 // enforceLimits checks total counts with current msg store's limits,
 // removing a file slice and/or updating slices' count as necessary.
-func (ms *FileMsgStore) enforceLimits() error {
-	// We may inspect several slices, start with the first at index 0.
-	idx := 0
+func (ms *FileMsgStore) enforceLimits() {
 	// Check if we need to remove any (but leave at least the last added).
 	// Note that we may have to remove more than one msg if we are here
 	// after a restart with smaller limits than originally set.
@@ -1124,8 +1822,9 @@ func (ms *FileMsgStore) enforceLimits() error {
 		((ms.totalCount > ms.limits.MaxNumMsgs) ||
 			(ms.totalBytes > ms.limits.MaxMsgBytes)) {
 
-		// slice we are inspecting
-		slice := ms.files[idx]
+		// The first message is always in the first slice, since slices
+		// before the current one are never empty.
+		slice := ms.files[0]
 		// Size of the first message in this slice
 		firstMsgSize := uint64(len(slice.firstMsg.Data))
 		// Update slice and total counts
@@ -1139,106 +1838,51 @@ func (ms *FileMsgStore) enforceLimits() error {
 			ms.hitLimit = true
 			Noticef(droppingMsgsFmt, ms.subject, ms.totalCount, ms.limits.MaxNumMsgs, ms.totalBytes, ms.limits.MaxMsgBytes)
 		}
+		if m := ms.msgs[ms.first]; m != nil {
+			ms.unindexGUID(m.Guid, ms.first)
+		}
 		delete(ms.msgs, ms.first)
 
 		// Messages sequence is incremental with no gap on a given msgstore.
 		ms.first++
 		// Is file slice "empty"
 		if slice.msgsCount == 0 {
-			// If we are at the last file slice, remove the first.
-			if ms.currSliceIdx == numFiles-1 {
-				if err := ms.removeAndShiftFiles(); err != nil {
-					return err
-				}
-				// Decrement the current slice. It will be bumped if needed
-				// before storing the next message.
-				ms.currSliceIdx--
-				// The first slice is gone, go back to 0.
-				idx = 0
-			} else {
-				// No more message...
-				slice.firstMsg = nil
-				slice.lastMsg = nil
-
-				// We move the index to check the other slices if needed.
-				idx++
-				// This should not happen, but just in case...
-				if idx > ms.currSliceIdx {
-					break
-				}
-			}
+			// Remove it. Since the last message is kept, this is not
+			// the current slice.
+			ms.removeFirstSlice()
 		} else {
 			// This is the new first message in this slice.
 			slice.firstMsg = ms.msgs[ms.first]
 		}
 	}
-	return nil
 }
 
-// removeAndShiftFiles
-func (ms *FileMsgStore) removeAndShiftFiles() error {
-	// Close the currently opened file since it is going to be renamed.
-	if err := ms.flush(); err != nil {
-		return err
-	}
-	if err := ms.file.Close(); err != nil {
-		return err
-	}
-
-	// Rename msgs.2.dat to msgs.1.dat, refresh state, etc...
-	for i := 0; i < numFiles-1; i++ {
-		file1 := ms.files[i]
-		file2 := ms.files[i+1]
+// Purge removes all messages from the store. The message files are removed
+// and the store starts over with an empty first file, with the store's
+// current flags.
+func (ms *FileMsgStore) Purge() error {
+	ms.Lock()
+	defer ms.Unlock()
 
-		if err := os.Rename(file2.fileName, file1.fileName); err != nil {
+	// Buffered messages are dropped along with the files.
+	if ms.file != nil {
+		if err := ms.file.Close(); err != nil {
 			return err
 		}
-		// Update total stats for the first store being removed
-		if i == 0 {
-			ms.totalCount -= file1.msgsCount
-			ms.totalBytes -= file1.msgsSize
-
-			// Remove all messages from first file from our cache
-			seqStart := file1.firstMsg.Sequence
-			seqEnd := file1.lastMsg.Sequence
-			for i := seqStart; i <= seqEnd; i++ {
-				delete(ms.msgs, i)
-			}
-			// Update sequence of first available message
-			ms.first = file2.firstMsg.Sequence
-		}
-
-		// Copy over values from the next slice
-		file1.firstMsg = file2.firstMsg
-		file1.lastMsg = file2.lastMsg
-		file1.msgsCount = file2.msgsCount
-		file1.msgsSize = file2.msgsSize
-	}
-
-	var err error
-
-	// Create a new file for the last slice.
-	fslice := ms.files[numFiles-1]
-	file, err := openFile(fslice.fileName)
-	if err != nil {
-		return err
+		ms.setFile(nil)
 	}
-	if err := file.Close(); err != nil {
-		return err
+	// The first file is created again with the same name.
+	ms.removeWg.Wait()
+	for _, fslice := range ms.files {
+		if err := os.Remove(fslice.fileName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
-	// Reset the last slice's counts.
-	fslice.firstMsg = nil
-	fslice.lastMsg = nil
-	fslice.msgsCount = 0
-	fslice.msgsSize = uint64(0)
-
-	// Now re-open the file we closed at the beginning, which is the one
-	// before last.
-	file, err = openFile(ms.files[numFiles-2].fileName)
-	if err != nil {
+	ms.files = nil
+	if err := ms.addSlice(); err != nil {
 		return err
 	}
-	ms.setFile(file)
+	ms.purge()
 	return nil
 }
 
@@ -1253,6 +1897,10 @@ func (ms *FileMsgStore) Close() error {
 
 	ms.closed = true
 
+	if ms.flushTimer != nil {
+		ms.flushTimer.Stop()
+		ms.flushTimer = nil
+	}
 	var err error
 	if ms.file != nil {
 		err = ms.flush()
@@ -1260,6 +1908,8 @@ func (ms *FileMsgStore) Close() error {
 			err = lerr
 		}
 	}
+	// Wait for the expired files to be removed.
+	ms.removeWg.Wait()
 	return err
 }
 
@@ -1276,14 +1926,72 @@ func (ms *FileMsgStore) flush() error {
 	return nil
 }
 
-// Flush flushes outstanding data into the store.
+// Flush flushes outstanding data into the store. With the FlushInterval or
+// FlushBytes options, the write may be deferred.
 func (ms *FileMsgStore) Flush() error {
 	ms.Lock()
+	defer ms.Unlock()
+
+	if err := ms.flushErr; err != nil {
+		ms.flushErr = nil
+		return err
+	}
+	if !ms.deferFlush() {
+		return ms.flush()
+	}
+	if ms.flushTimer == nil {
+		interval := ms.opts.FlushInterval
+		if interval <= 0 {
+			interval = defaultFlushInterval
+		}
+		ms.flushTimer = time.AfterFunc(interval, ms.deferredFlush)
+	}
+	return nil
+}
+
+// FlushNow writes the buffered messages to disk, even if the FlushInterval
+// or FlushBytes options defer the writes.
+func (ms *FileMsgStore) FlushNow() error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if ms.flushTimer != nil {
+		ms.flushTimer.Stop()
+		ms.flushTimer = nil
+	}
 	err := ms.flush()
-	ms.Unlock()
+	if ms.flushErr != nil {
+		err, ms.flushErr = ms.flushErr, nil
+	}
 	return err
 }
 
+// Interval of the deferred writes if only FlushBytes is set.
+const defaultFlushInterval = time.Second
+
+// deferFlush returns true if the write of the buffered messages can be
+// deferred. Lock held on entry.
+func (ms *FileMsgStore) deferFlush() bool {
+	if ms.opts.FlushInterval <= 0 && ms.opts.FlushBytes <= 0 {
+		return false
+	}
+	return ms.opts.FlushBytes <= 0 || ms.bw == nil || ms.bw.Buffered() < ms.opts.FlushBytes
+}
+
+// deferredFlush writes the buffered messages when the flush timer fires.
+func (ms *FileMsgStore) deferredFlush() {
+	ms.Lock()
+	defer ms.Unlock()
+
+	ms.flushTimer = nil
+	if ms.closed {
+		return
+	}
+	if err := ms.flush(); err != nil {
+		ms.flushErr = err
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////
 // FileSubStore methods
 ////////////////////////////////////////////////////////////////////////////
@@ -1291,19 +1999,21 @@ func (ms *FileMsgStore) Flush() error {
 // newFileSubStore returns a new instace of a file SubStore.
 func (fs *FileStore) newFileSubStore(channelDirName, channel string, doRecover bool) (*FileSubStore, error) {
 	ss := &FileSubStore{
-		rootDir:  channelDirName,
-		subs:     make(map[uint64]*subscription),
-		opts:     &fs.opts,
-		crcTable: fs.crcTable,
-	}
-	ss.init(channel, fs.limits)
+		rootDir:   channelDirName,
+		subs:      make(map[uint64]*subscription),
+		opts:      &fs.opts,
+		crcTable:  fs.crcTable,
+		cipher:    fs.cipher,
+		fileFlags: fs.fileFlags,
+	}
+	ss.init(channel, fs.channelLimits(channel))
 	// Convert the CompactInterval in time.Duration
 	ss.compactItvl = time.Duration(ss.opts.CompactInterval) * time.Second
 
 	var err error
 
 	fileName := filepath.Join(channelDirName, subsFileName)
-	ss.file, err = openFile(fileName)
+	ss.file, err = openFile(fileName, ss.fileFlags)
 	if err != nil {
 		return nil, err
 	}
@@ -1330,19 +2040,26 @@ func (ss *FileSubStore) recoverSubscriptions() error {
 		ss.tmpSubBuf, recSize, recType, err = readRecord(br, ss.tmpSubBuf, true, ss.crcTable, ss.opts.DoCRC)
 		if err != nil {
 			if err == io.EOF {
-				// We are done, reset err
 				err = nil
-				break
 			} else {
+				err = truncateBadTail(ss.opts, ss.file, br, fileHeaderSize+ss.fileSize, "last subscription update", err)
+			}
+			if err != nil {
 				return err
 			}
+			// We are done
+			break
 		}
 		ss.fileSize += int64(recSize + recordHeaderSize)
+		content, err := ss.cipher.open(ss.tmpSubBuf[:recSize])
+		if err != nil {
+			return err
+		}
 		// Based on record type...
 		switch recType {
 		case subRecNew:
 			newSub := &spb.SubState{}
-			if err := newSub.Unmarshal(ss.tmpSubBuf[:recSize]); err != nil {
+			if err := newSub.Unmarshal(content); err != nil {
 				return err
 			}
 			sub := &subscription{
@@ -1360,7 +2077,7 @@ func (ss *FileSubStore) recoverSubscriptions() error {
 			break
 		case subRecUpdate:
 			modifiedSub := &spb.SubState{}
-			if err := modifiedSub.Unmarshal(ss.tmpSubBuf[:recSize]); err != nil {
+			if err := modifiedSub.Unmarshal(content); err != nil {
 				return err
 			}
 			// Search if the create has been recovered.
@@ -1384,7 +2101,7 @@ func (ss *FileSubStore) recoverSubscriptions() error {
 			break
 		case subRecDel:
 			delSub := spb.SubStateDelete{}
-			if err := delSub.Unmarshal(ss.tmpSubBuf[:recSize]); err != nil {
+			if err := delSub.Unmarshal(content); err != nil {
 				return err
 			}
 			if s, exists := ss.subs[delSub.ID]; exists {
@@ -1402,7 +2119,7 @@ func (ss *FileSubStore) recoverSubscriptions() error {
 			break
 		case subRecMsg:
 			updateSub := spb.SubStateUpdate{}
-			if err := updateSub.Unmarshal(ss.tmpSubBuf[:recSize]); err != nil {
+			if err := updateSub.Unmarshal(content); err != nil {
 				return err
 			}
 			if sub, exists := ss.subs[updateSub.ID]; exists {
@@ -1418,7 +2135,7 @@ func (ss *FileSubStore) recoverSubscriptions() error {
 			break
 		case subRecAck:
 			updateSub := spb.SubStateUpdate{}
-			if err := updateSub.Unmarshal(ss.tmpSubBuf[:recSize]); err != nil {
+			if err := updateSub.Unmarshal(content); err != nil {
 				return err
 			}
 			if sub, exists := ss.subs[updateSub.ID]; exists {
@@ -1476,9 +2193,12 @@ func (ss *FileSubStore) DeleteSub(subid uint64) {
 	ss.writeRecord(ss.bw, subRecDel, &ss.delSub)
 	if s, exists := ss.subs[subid]; exists {
 		delete(ss.subs, subid)
+		ss.subsCount--
 		// writeRecord has already accounted for the count of the
-		// delete record. We add to this the number of pending messages
-		ss.delRecs += len(s.seqnos)
+		// delete record. We add to this the number of pending messages,
+		// including the acked ones whose ack is no longer needed.
+		ss.delRecs += len(s.seqnos) + len(ss.acks[subid])
+		delete(ss.acks, subid)
 		// Check if this triggers a need for compaction
 		if ss.shouldCompact() {
 			ss.compact()
@@ -1536,6 +2256,11 @@ func (ss *FileSubStore) AddSeqPending(subid, seqno uint64) error {
 // by the given subscription.
 func (ss *FileSubStore) AckSeqPending(subid, seqno uint64) error {
 	ss.Lock()
+	if ss.opts.AckFlushInterval > 0 {
+		err := ss.deferAck(subid, seqno)
+		ss.Unlock()
+		return err
+	}
 	ss.updateSub.ID, ss.updateSub.Seqno = subid, seqno
 	if err := ss.writeRecord(ss.bw, subRecAck, &ss.updateSub); err != nil {
 		ss.Unlock()
@@ -1553,13 +2278,78 @@ func (ss *FileSubStore) AckSeqPending(subid, seqno uint64) error {
 	return nil
 }
 
+// deferAck removes the message from the pending ones of the subscription,
+// and adds its ack to the batch written at most AckFlushInterval from now.
+// The error of the previous write of the acks, if any, is returned.
+// Lock is held by caller
+func (ss *FileSubStore) deferAck(subid, seqno uint64) error {
+	if err := ss.ackErr; err != nil {
+		ss.ackErr = nil
+		return err
+	}
+	s := ss.subs[subid]
+	if s == nil {
+		return nil
+	}
+	delete(s.seqnos, seqno)
+	if ss.acks == nil {
+		ss.acks = make(map[uint64][]uint64)
+	}
+	ss.acks[subid] = append(ss.acks[subid], seqno)
+	if ss.ackTimer == nil {
+		ss.ackTimer = time.AfterFunc(ss.opts.AckFlushInterval, ss.deferredAcks)
+	}
+	return nil
+}
+
+// writeAcks writes the records of the acks not written yet. They always
+// follow the records of the messages they ack, written when they were
+// sent, so that a recovery never loses a message not acknowledged.
+// Lock is held by caller
+func (ss *FileSubStore) writeAcks() error {
+	for subid, seqnos := range ss.acks {
+		ss.updateSub.ID = subid
+		for _, seqno := range seqnos {
+			ss.updateSub.Seqno = seqno
+			if err := ss.writeRecord(ss.bw, subRecAck, &ss.updateSub); err != nil {
+				return err
+			}
+		}
+		delete(ss.acks, subid)
+	}
+	return nil
+}
+
+// deferredAcks writes, and flushes, the batch of acks when the ack timer
+// fires.
+func (ss *FileSubStore) deferredAcks() {
+	ss.Lock()
+	defer ss.Unlock()
+
+	ss.ackTimer = nil
+	if ss.closed || len(ss.acks) == 0 {
+		return
+	}
+	err := ss.writeAcks()
+	if err == nil {
+		err = ss.flush()
+	}
+	if err != nil {
+		ss.ackErr = err
+		return
+	}
+	if ss.shouldCompact() {
+		ss.compact()
+	}
+}
+
 // compact rewrites all subscriptions on a temporary file, reducing the size
 // since we get rid of deleted subscriptions and message sequences that have
 // been acknowledged. On success, the subscriptions file is replaced by this
 // temporary file.
 // Lock is held by caller
 func (ss *FileSubStore) compact() error {
-	tmpFile, err := getTempFile(ss.rootDir, "subs")
+	tmpFile, err := getTempFile(ss.rootDir, "subs", ss.fileFlags)
 	if err != nil {
 		return err
 	}
@@ -1607,12 +2397,14 @@ func (ss *FileSubStore) compact() error {
 		return err
 	}
 	// Switch the temporary file with the original one.
-	ss.file, err = swapFiles(tmpFile, ss.file)
+	ss.file, err = swapFiles(tmpFile, ss.file, ss.fileFlags)
 	if err != nil {
 		return err
 	}
 	// Prevent cleanup on success
 	tmpFile = nil
+	// The acks not written yet are reflected by the new file.
+	ss.acks = nil
 
 	ss.bw = bufio.NewWriterSize(ss.file, ss.opts.BufferSize)
 	// Update the timestamp of this last successful compact
@@ -1623,7 +2415,10 @@ func (ss *FileSubStore) compact() error {
 // writes a record in the subscriptions file.
 // store's lock is held on entry.
 func (ss *FileSubStore) writeRecord(w io.Writer, recType recordType, rec record) error {
-	var err error
+	rec, err := ss.cipher.seal(rec)
+	if err != nil {
+		return err
+	}
 	totalSize := 0
 	ss.tmpSubBuf, totalSize, err = writeRecord(w, ss.tmpSubBuf, recType, rec, ss.crcTable)
 	if err != nil {
@@ -1673,8 +2468,8 @@ func (ss *FileSubStore) Flush() error {
 
 // Close closes this store
 func (ss *FileSubStore) Close() error {
-	ss.RLock()
-	defer ss.RUnlock()
+	ss.Lock()
+	defer ss.Unlock()
 
 	if ss.closed {
 		return nil
@@ -1682,9 +2477,16 @@ func (ss *FileSubStore) Close() error {
 
 	ss.closed = true
 
+	if ss.ackTimer != nil {
+		ss.ackTimer.Stop()
+		ss.ackTimer = nil
+	}
 	var err error
 	if ss.file != nil {
-		err = ss.flush()
+		err = ss.writeAcks()
+		if ferr := ss.flush(); ferr != nil && err == nil {
+			err = ferr
+		}
 		if lerr := ss.file.Close(); lerr != nil && err == nil {
 			err = lerr
 		}
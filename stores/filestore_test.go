@@ -3,6 +3,7 @@
 package stores
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -10,7 +11,6 @@ import (
 	"strings"
 	"testing"
 
-	"github.com/nats-io/go-nats-streaming/pb"
 	"github.com/nats-io/nats-streaming-server/spb"
 	"github.com/nats-io/nats-streaming-server/util"
 	"hash/crc32"
@@ -316,6 +316,51 @@ func TestFSBasicMsgStore(t *testing.T) {
 	testBasicMsgStore(t, fs)
 }
 
+func TestFSLookupRange(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	testLookupRange(t, fs)
+}
+
+func TestFSRecoverOrderingGroups(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	reopen := func() (Store, *RecoveredState) {
+		fs, state, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits)
+		if err != nil {
+			t.Fatalf("Unable to create a FileStore instance: %v", err)
+		}
+		return fs, state
+	}
+	testRecoverOrderingGroups(t, createDefaultFileStore(t), reopen)
+
+	// The file is rewritten once it has many more records than groups.
+	s, _ := reopen()
+	fs := s.(*FileStore)
+	for i := uint64(0); i < groupsCompactRecs; i++ {
+		if err := fs.SetOrderingGroups(map[string]uint64{"a": 6 + i}); err != nil {
+			t.Fatalf("Unexpected error setting ordering groups: %v", err)
+		}
+	}
+	fs.Lock()
+	recs := fs.groupsRecs
+	fs.Unlock()
+	if recs >= groupsCompactRecs {
+		t.Fatalf("Expected the groups file to be compacted, got %v records", recs)
+	}
+	fs.Close()
+	s, state := reopen()
+	defer s.Close()
+	if expected := map[string]uint64{"a": 5 + groupsCompactRecs, "b": 2}; !reflect.DeepEqual(state.OrderingGroups, expected) {
+		t.Fatalf("Expected ordering groups %v, got %v", expected, state.OrderingGroups)
+	}
+}
+
 func TestFSBasicRecovery(t *testing.T) {
 	cleanupDatastore(t, defaultDataStore)
 	defer cleanupDatastore(t, defaultDataStore)
@@ -555,8 +600,8 @@ func TestFSRecoveryLimitsNotApplied(t *testing.T) {
 		t.Fatalf("Expected first sequence to be %v, got %v", expectedNewFirstSeq, msgStore.first)
 	}
 	// We should have moved to the second slice
-	if msgStore.currSliceIdx != 1 {
-		t.Fatalf("Expected file slice to be the second one, got %v", msgStore.currSliceIdx)
+	if n := len(msgStore.files); n != 2 {
+		t.Fatalf("Expected file slice to be the second one, got %v slices", n)
 	}
 	// Check second slice content
 	secondSlice := msgStore.files[1]
@@ -608,8 +653,398 @@ func TestFSRecoveryFileSlices(t *testing.T) {
 	msgStore := cs.Msgs.(*FileMsgStore)
 
 	// We should have moved to the second slice
-	if msgStore.currSliceIdx != 1 {
-		t.Fatalf("Expected file slice to be the second one, got %v", msgStore.currSliceIdx)
+	if n := len(msgStore.files); n != 2 {
+		t.Fatalf("Expected file slice to be the second one, got %v slices", n)
+	}
+}
+
+func TestFSFileSlicesSmallLimits(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	// Limits too small to be split between the slices.
+	limits := testDefaultChannelLimits
+	limits.MaxNumMsgs = 2
+	fs.SetChannelLimits(limits)
+	for i := 0; i < 10; i++ {
+		storeMsg(t, fs, "foo", []byte("hello"))
+	}
+	if first, last := fs.LookupChannel("foo").Msgs.FirstAndLastSequence(); first != 9 || last != 10 {
+		t.Fatalf("Unexpected sequences: %v-%v", first, last)
+	}
+
+	// The first slice is emptied by the byte limit before the last slice
+	// is used.
+	limits = testDefaultChannelLimits
+	limits.MaxMsgBytes = 1000
+	fs.SetChannelLimits(limits)
+	for _, size := range []int{300, 300, 800, 10, 10} {
+		storeMsg(t, fs, "bar", make([]byte, size))
+	}
+	cs := fs.LookupChannel("bar")
+	if first, last := cs.Msgs.FirstAndLastSequence(); first != 3 || last != 5 {
+		t.Fatalf("Unexpected sequences: %v-%v", first, last)
+	}
+	if n, b, _ := cs.Msgs.State(); n != 3 || b != 820 {
+		t.Fatalf("Unexpected state: %v msgs, %v bytes", n, b)
+	}
+}
+
+// msgFileNums returns the numbers of the message files of the channel.
+func msgFileNums(t *testing.T, channel string) []int {
+	slices, err := listMsgFiles(filepath.Join(defaultDataStore, channel))
+	if err != nil {
+		stackFatalf(t, "Unable to list message files: %v", err)
+	}
+	nums := make([]int, 0, len(slices))
+	for _, fslice := range slices {
+		nums = append(nums, fslice.num)
+	}
+	return nums
+}
+
+func TestFSExpiredSlicesRemoved(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	// Two messages per file.
+	limits := testDefaultChannelLimits
+	limits.MaxNumMsgs = 2 * numSlices
+	fs, _, err := NewFileStore(defaultDataStore, &limits)
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	info := testDefaultServerInfo
+	if err := fs.Init(&info); err != nil {
+		t.Fatalf("Unexpected error during Init: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		storeMsg(t, fs, "foo", []byte("hello"))
+	}
+	fs.Close()
+
+	// Messages 13 to 20 are in files 7 to 10, the others were removed.
+	if nums := msgFileNums(t, "foo"); !reflect.DeepEqual(nums, []int{7, 8, 9, 10}) {
+		t.Fatalf("Unexpected message files: %v", nums)
+	}
+	fs, _, err = NewFileStore(defaultDataStore, &limits)
+	if err != nil {
+		t.Fatalf("Unable to recover the FileStore: %v", err)
+	}
+	defer fs.Close()
+	cs := fs.LookupChannel("foo")
+	if first, last := cs.Msgs.FirstAndLastSequence(); first != 13 || last != 20 {
+		t.Fatalf("Unexpected sequences: %v-%v", first, last)
+	}
+	storeMsg(t, fs, "foo", []byte("hello"))
+	storeMsg(t, fs, "foo", []byte("hello"))
+	fs.Close()
+	if nums := msgFileNums(t, "foo"); !reflect.DeepEqual(nums, []int{8, 9, 10, 11}) {
+		t.Fatalf("Unexpected message files: %v", nums)
+	}
+}
+
+func TestFSRecoveryEmptySlices(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+	storeMsg(t, fs, "foo", []byte("hello"))
+	fs.Close()
+
+	// Empty files, as created in advance by previous versions.
+	for i := 2; i <= 5; i++ {
+		file, err := openFile(filepath.Join(defaultDataStore, "foo", fmt.Sprintf("msgs.%d.dat", i)), 0)
+		if err != nil {
+			t.Fatalf("Unable to create file: %v", err)
+		}
+		file.Close()
+	}
+	fs, _ = openDefaultFileStore(t)
+	defer fs.Close()
+	if nums := msgFileNums(t, "foo"); !reflect.DeepEqual(nums, []int{1, 5}) {
+		t.Fatalf("Unexpected message files: %v", nums)
+	}
+	ms := fs.LookupChannel("foo").Msgs.(*FileMsgStore)
+	ms.RLock()
+	curr := ms.currSlice().num
+	ms.RUnlock()
+	if curr != 5 {
+		t.Fatalf("Expected current file to be 5, got %v", curr)
+	}
+	if m := storeMsg(t, fs, "foo", []byte("hello")); m.Sequence != 2 {
+		t.Fatalf("Unexpected sequence: %v", m.Sequence)
+	}
+}
+
+func TestFSSliceConfig(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	if _, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, SliceConfig(-1, 0)); err == nil {
+		t.Fatal("Expected error for negative slice max msgs")
+	}
+	fs, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, SliceConfig(3, 100))
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	for i := 0; i < 7; i++ {
+		storeMsg(t, fs, "foo", []byte("hello"))
+	}
+	storeMsg(t, fs, "foo", make([]byte, 200))
+	storeMsg(t, fs, "foo", []byte("hello"))
+
+	ms := fs.LookupChannel("foo").Msgs.(*FileMsgStore)
+	ms.RLock()
+	var counts []int
+	for _, fslice := range ms.files {
+		counts = append(counts, fslice.msgsCount)
+	}
+	ms.RUnlock()
+	if !reflect.DeepEqual(counts, []int{3, 3, 2, 1}) {
+		t.Fatalf("Unexpected messages per file: %v", counts)
+	}
+
+	// Purge starts over with the first file.
+	if err := ms.Purge(); err != nil {
+		t.Fatalf("Unexpected error on purge: %v", err)
+	}
+	if nums := msgFileNums(t, "foo"); !reflect.DeepEqual(nums, []int{1}) {
+		t.Fatalf("Unexpected message files: %v", nums)
+	}
+}
+
+func TestFSRecoverChannels(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	if _, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, RecoverChannels("foo.>.bar")); err == nil {
+		t.Fatal("Expected error for invalid subject")
+	}
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+	for _, channel := range []string{"foo.a", "foo.b", "bar"} {
+		storeMsg(t, fs, channel, []byte("hello"))
+		storeSub(t, fs, channel)
+	}
+	fs.Close()
+
+	fs, state, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, RecoverChannels("foo.*"))
+	if err != nil {
+		t.Fatalf("Unable to open store: %v", err)
+	}
+	defer fs.Close()
+	if n := len(fs.GetChannels()); n != 2 || fs.LookupChannel("bar") != nil {
+		t.Fatalf("Expected channels foo.a and foo.b to be recovered, got %v", n)
+	}
+	if _, ok := state.Subs["bar"]; ok || len(state.Subs) != 2 {
+		t.Fatalf("Unexpected recovered subscriptions: %v", state.Subs)
+	}
+	// The channel left on disk can't be created, new ones can.
+	if _, _, err := fs.CreateChannel("bar", nil); err != ErrChannelNotRecovered {
+		t.Fatalf("Expected error %v, got %v", ErrChannelNotRecovered, err)
+	}
+	storeMsg(t, fs, "baz", []byte("hello"))
+	fs.Close()
+
+	fs, state = openDefaultFileStore(t)
+	defer fs.Close()
+	if n := len(fs.GetChannels()); n != 4 {
+		t.Fatalf("Expected 4 channels, got %v", n)
+	}
+	if m := fs.LookupChannel("bar").Msgs.Lookup(1); m == nil || string(m.Data) != "hello" {
+		t.Fatalf("Unexpected message on bar: %v", m)
+	}
+	if len(state.Subs["bar"]) != 1 {
+		t.Fatalf("Expected subscription on bar, got %v", state.Subs["bar"])
+	}
+}
+
+func TestFSSlicePeriods(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	for _, sp := range []*SlicePeriod{{Channels: "foo.>.bar", Period: SliceMonthly}, {Channels: "foo", Period: "fortnight"}} {
+		if _, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, SlicePeriods(sp)); err == nil {
+			t.Fatalf("Expected error for %v", sp)
+		}
+	}
+	limits := testDefaultChannelLimits
+	limits.MaxNumMsgs = 3
+	open := func() *FileStore {
+		fs, state, err := NewFileStore(defaultDataStore, &limits, SliceConfig(100, 0),
+			SlicePeriods(&SlicePeriod{Channels: "events.>", Period: "Month"}))
+		if err != nil {
+			stackFatalf(t, "Unable to open store: %v", err)
+		}
+		if state == nil {
+			info := testDefaultServerInfo
+			if err := fs.Init(&info); err != nil {
+				stackFatalf(t, "Unexpected error on init: %v", err)
+			}
+		}
+		return fs
+	}
+	checkFiles := func(fs *FileStore, channel string, expected ...int) {
+		ms := fs.LookupChannel(channel).Msgs.(*FileMsgStore)
+		ms.Lock()
+		files := ms.files
+		ms.Unlock()
+		var nums []int
+		for _, fslice := range files {
+			nums = append(nums, fslice.num)
+		}
+		if !reflect.DeepEqual(nums, expected) {
+			stackFatalf(t, "Expected files %v for %v, got %v", expected, channel, nums)
+		}
+	}
+
+	fs := open()
+	defer fs.Close()
+	clock := util.NewManualClock(time.Date(2016, time.January, 31, 23, 0, 0, 0, time.UTC))
+	fs.SetClock(clock)
+	for i := 0; i < 2; i++ {
+		storeMsg(t, fs, "events.a", []byte("jan"))
+		storeMsg(t, fs, "other", []byte("jan"))
+	}
+	clock.Advance(2 * time.Hour)
+	storeMsg(t, fs, "events.a", []byte("feb"))
+	storeMsg(t, fs, "other", []byte("feb"))
+	checkFiles(fs, "events.a", 1, 2)
+	checkFiles(fs, "other", 1)
+	fs.Close()
+
+	// The files are recovered, and messages of the same period are
+	// appended to the last one.
+	fs = open()
+	fs.SetClock(clock)
+	checkFiles(fs, "events.a", 1, 2)
+	ms := fs.LookupChannel("events.a").Msgs
+	if first, last := ms.FirstAndLastSequence(); first != 1 || last != 3 {
+		t.Fatalf("Unexpected first/last sequences: %v/%v", first, last)
+	}
+	if m := ms.Lookup(3); m == nil || string(m.Data) != "feb" {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+	storeMsg(t, fs, "events.a", []byte("feb"))
+	checkFiles(fs, "events.a", 1, 2)
+
+	// The file of a period is removed once the limits removed all of
+	// its messages.
+	storeMsg(t, fs, "events.a", []byte("feb"))
+	checkFiles(fs, "events.a", 2)
+	fms := ms.(*FileMsgStore)
+	fms.removeWg.Wait()
+	if _, err := os.Stat(msgFileName(fms.channelDir, 1)); !os.IsNotExist(err) {
+		t.Fatalf("Expected file to be removed, got %v", err)
+	}
+	if first, last := ms.FirstAndLastSequence(); first != 3 || last != 5 {
+		t.Fatalf("Unexpected first/last sequences: %v/%v", first, last)
+	}
+}
+
+func TestFSPeriodStart(t *testing.T) {
+	now := time.Date(2016, time.March, 3, 15, 4, 5, 6, time.UTC).UnixNano()
+	for _, c := range []struct {
+		period   string
+		expected time.Time
+	}{
+		{SliceDaily, time.Date(2016, time.March, 3, 0, 0, 0, 0, time.UTC)},
+		{SliceWeekly, time.Date(2016, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{SliceMonthly, time.Date(2016, time.March, 1, 0, 0, 0, 0, time.UTC)},
+		{SliceYearly, time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		if start := periodStart(c.period, now); start != c.expected.UnixNano() {
+			t.Fatalf("Expected start of %v to be %v, got %v", c.period, c.expected, time.Unix(0, start).UTC())
+		}
+	}
+	// Sundays belong to the week starting the Monday before.
+	sunday := time.Date(2016, time.March, 6, 23, 0, 0, 0, time.UTC).UnixNano()
+	if periodStart(SliceWeekly, sunday) != periodStart(SliceWeekly, now) {
+		t.Fatal("Expected Sunday to be in the same week")
+	}
+}
+
+func TestFSReadFileStoreState(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	// Nothing is created if there is no store.
+	if state, err := ReadFileStoreState(defaultDataStore); state != nil || err != nil {
+		t.Fatalf("Expected no state and no error, got %v - %v", state, err)
+	}
+	if _, err := os.Stat(defaultDataStore); !os.IsNotExist(err) {
+		t.Fatalf("Directory should not have been created: %v", err)
+	}
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+	for _, channel := range []string{"foo.a", "foo.b", "bar"} {
+		storeMsg(t, fs, channel, []byte("hello"))
+		storeSub(t, fs, channel)
+	}
+	if _, _, err := fs.AddClient("me", "hbInbox", nil); err != nil {
+		t.Fatalf("Unexpected error adding client: %v", err)
+	}
+	fs.Close()
+
+	clientsFile := filepath.Join(defaultDataStore, clientsFileName)
+	// A partial record, as left by a crash.
+	partial := make([]byte, recordHeaderSize+2)
+	util.ByteOrder.PutUint32(partial, 100)
+	appendToFile(t, clientsFile, partial)
+	stat, err := os.Stat(clientsFile)
+	if err != nil {
+		t.Fatalf("Unable to stat file: %v", err)
+	}
+	// The bad tail is reported, not truncated, even with the option.
+	if _, err := ReadFileStoreState(defaultDataStore, TruncateBadTail(true)); err == nil {
+		t.Fatal("Expected error on bad tail")
+	}
+	if s, err := os.Stat(clientsFile); err != nil || s.Size() != stat.Size() {
+		t.Fatalf("File should not have been modified: %v - %v", s.Size(), err)
+	}
+	if err := os.Truncate(clientsFile, stat.Size()-int64(len(partial))); err != nil {
+		t.Fatalf("Unable to truncate file: %v", err)
+	}
+
+	state, err := ReadFileStoreState(defaultDataStore, RecoverChannels("foo.*"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if state.Info.ClusterID != testDefaultServerInfo.ClusterID {
+		t.Fatalf("Unexpected server info: %v", state.Info)
+	}
+	if len(state.Clients) != 1 || state.Clients[0].ID != "me" {
+		t.Fatalf("Unexpected clients: %v", state.Clients)
+	}
+	if _, ok := state.Subs["bar"]; ok || len(state.Subs) != 2 {
+		t.Fatalf("Unexpected channels: %v", state.Subs)
+	}
+}
+
+func TestFSStoreMsg(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	testStoreMsg(t, fs)
+
+	// The ordering group and the headers are recovered.
+	fs.Close()
+	fs, _ = openDefaultFileStore(t)
+	defer fs.Close()
+	if m := fs.LookupChannel("foo").Msgs.Lookup(2); m == nil || m.OrderingGroup != "group" || m.GroupSequence != 10 ||
+		m.Headers["trace-id"] != "abc" {
+		t.Fatalf("Unexpected recovered message: %v", m)
 	}
 }
 
@@ -633,6 +1068,71 @@ func TestFSMaxMsgs(t *testing.T) {
 	testMaxMsgs(t, fs)
 }
 
+func TestFSChannelLimitsFunc(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	testChannelLimitsFunc(t, fs)
+}
+
+func TestFSDeleteChannel(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	testDeleteChannel(t, fs)
+	if _, err := os.Stat(filepath.Join(defaultDataStore, "baz")); !os.IsNotExist(err) {
+		t.Fatalf("Channel directory should have been removed: %v", err)
+	}
+
+	// Deleted channels are not recovered.
+	fs.Close()
+	fs, state := openDefaultFileStore(t)
+	defer fs.Close()
+	if state == nil {
+		t.Fatal("Expected state to be recovered")
+	}
+	if fs.LookupChannel("baz") != nil {
+		t.Fatal("Channel baz should not have been recovered")
+	}
+	if count, _, _ := fs.MsgsState("foo"); count != 1 {
+		t.Fatalf("Expected 1 message on foo, got %v", count)
+	}
+}
+
+func TestFSPurge(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	testPurge(t, fs)
+
+	// The purge survives a restart.
+	fs.Close()
+	fs, state := openDefaultFileStore(t)
+	defer fs.Close()
+	if state == nil {
+		t.Fatal("Expected state to be recovered")
+	}
+	cs := fs.LookupChannel("foo")
+	if cs == nil {
+		t.Fatal("Expected channel foo to be recovered")
+	}
+	if first, last := cs.Msgs.FirstAndLastSequence(); first != 1 || last != 1 {
+		t.Fatalf("Unexpected sequences: first=%v last=%v", first, last)
+	}
+	if m := storeMsg(t, fs, "foo", []byte("hello")); m.Sequence != 2 {
+		t.Fatalf("Unexpected sequence: %v", m.Sequence)
+	}
+}
+
 func TestFSMaxChannels(t *testing.T) {
 	cleanupDatastore(t, defaultDataStore)
 	defer cleanupDatastore(t, defaultDataStore)
@@ -954,6 +1454,29 @@ func TestFSGetSeqFromTimestamp(t *testing.T) {
 	testGetSeqFromStartTime(t, fs)
 }
 
+func TestFSGetSeqFromGUID(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+
+	testGetSeqFromGUID(t, fs)
+
+	// The index is rebuilt on recovery.
+	cs := fs.LookupChannel("foo")
+	if _, err := cs.Msgs.StoreMsg(&spb.MsgProto{Data: []byte("hello"), Guid: "recovered"}); err != nil {
+		t.Fatalf("Unexpected error on store: %v", err)
+	}
+	fs.Close()
+	fs, _ = openDefaultFileStore(t)
+	defer fs.Close()
+	cs = fs.LookupChannel("foo")
+	if seq := cs.Msgs.GetSequenceFromGUID("recovered"); seq != 1 {
+		t.Fatalf("Expected sequence 1, got %v", seq)
+	}
+}
+
 func TestFSBadClientFile(t *testing.T) {
 	cleanupDatastore(t, defaultDataStore)
 	defer cleanupDatastore(t, defaultDataStore)
@@ -983,7 +1506,7 @@ func TestFSBadClientFile(t *testing.T) {
 			t.Fatalf("Unexpected error removing file: %v", err)
 		}
 		// Create the file with proper file version
-		file, err := openFile(fileName)
+		file, err := openFile(fileName, 0)
 		if err != nil {
 			t.Fatalf("Error creating client file: %v", err)
 		}
@@ -1147,7 +1670,7 @@ func TestFSBadServerFile(t *testing.T) {
 			t.Fatalf("Unexpected error removing file: %v", err)
 		}
 		// Create the file with proper file version
-		file, err := openFile(fileName)
+		file, err := openFile(fileName, 0)
 		if err != nil {
 			t.Fatalf("Error creating client file: %v", err)
 		}
@@ -1283,6 +1806,104 @@ func TestFSBadServerFile(t *testing.T) {
 	expectedErrorOpeningDefaultFileStore(t)
 }
 
+// appendToFile appends the given content to the file.
+func appendToFile(t *testing.T, fileName string, content []byte) {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		stackFatalf(t, "Unable to open file: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(content); err != nil {
+		stackFatalf(t, "Unable to write to file: %v", err)
+	}
+}
+
+func TestFSTruncateBadTail(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs := createDefaultFileStore(t)
+	defer fs.Close()
+	for i := 0; i < 3; i++ {
+		storeMsg(t, fs, "foo", []byte("hello"))
+	}
+	storeSub(t, fs, "foo")
+	fs.Close()
+
+	msgsFile := filepath.Join(defaultDataStore, "foo", "msgs.1.dat")
+	stat, err := os.Stat(msgsFile)
+	if err != nil {
+		t.Fatalf("Unable to stat file: %v", err)
+	}
+	validSize := stat.Size()
+	// A record header announcing more bytes than written, as left by a
+	// crash, in each file.
+	partial := make([]byte, recordHeaderSize+2)
+	util.ByteOrder.PutUint32(partial, 100)
+	appendToFile(t, msgsFile, partial)
+	appendToFile(t, filepath.Join(defaultDataStore, "foo", subsFileName), partial)
+	appendToFile(t, filepath.Join(defaultDataStore, clientsFileName), partial)
+
+	// The recovery fails without the option...
+	expectedErrorOpeningDefaultFileStore(t)
+
+	// and truncates the files with it.
+	fs, state, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, TruncateBadTail(true))
+	if err != nil {
+		t.Fatalf("Unable to recover the FileStore: %v", err)
+	}
+	if len(state.Subs["foo"]) != 1 {
+		t.Fatalf("Expected subscription to be recovered, got %v", state.Subs)
+	}
+	if n, _, _ := fs.LookupChannel("foo").Msgs.State(); n != 3 {
+		t.Fatalf("Expected 3 messages, got %v", n)
+	}
+	if stat, err := os.Stat(msgsFile); err != nil || stat.Size() != validSize {
+		t.Fatalf("Expected file to be truncated to %v bytes: %v - %v", validSize, stat.Size(), err)
+	}
+	storeMsg(t, fs, "foo", []byte("hello"))
+	fs.Close()
+	fs, _ = openDefaultFileStore(t)
+	if n, _, _ := fs.LookupChannel("foo").Msgs.State(); n != 4 {
+		t.Fatalf("Expected 4 messages, got %v", n)
+	}
+	fs.Close()
+
+	// Flips the bits of the byte at the given offset of the messages file.
+	flip := func(offset int64) {
+		file, err := os.OpenFile(msgsFile, os.O_RDWR, 0666)
+		if err != nil {
+			t.Fatalf("Unable to open file: %v", err)
+		}
+		defer file.Close()
+		b := make([]byte, 1)
+		if _, err := file.ReadAt(b, offset); err != nil {
+			t.Fatalf("Unable to read file: %v", err)
+		}
+		b[0] ^= 0xFF
+		if _, err := file.WriteAt(b, offset); err != nil {
+			t.Fatalf("Unable to write to file: %v", err)
+		}
+	}
+	// A corrupted record in the middle of the file is not truncated.
+	flip(validSize - 1)
+	if _, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, TruncateBadTail(true)); err == nil {
+		t.Fatal("Expected recovery to fail")
+	}
+	// The last one is.
+	flip(validSize - 1)
+	stat, _ = os.Stat(msgsFile)
+	flip(stat.Size() - 1)
+	fs, _, err = NewFileStore(defaultDataStore, &testDefaultChannelLimits, TruncateBadTail(true))
+	if err != nil {
+		t.Fatalf("Unable to recover the FileStore: %v", err)
+	}
+	defer fs.Close()
+	if first, last := fs.LookupChannel("foo").Msgs.FirstAndLastSequence(); first != 1 || last != 3 {
+		t.Fatalf("Unexpected sequences: %v-%v", first, last)
+	}
+}
+
 func TestFSBadMsgFile(t *testing.T) {
 	cleanupDatastore(t, defaultDataStore)
 	defer cleanupDatastore(t, defaultDataStore)
@@ -1322,7 +1943,7 @@ func TestFSBadMsgFile(t *testing.T) {
 			t.Fatalf("Unexpected error removing file: %v", err)
 		}
 		// Create the file with proper file version
-		file, err := openFile(firstSliceFileName)
+		file, err := openFile(firstSliceFileName, 0)
 		if err != nil {
 			t.Fatalf("Error creating file: %v", err)
 		}
@@ -1350,7 +1971,7 @@ func TestFSBadMsgFile(t *testing.T) {
 	// UNMARSHALL ERROR
 	//
 	file = resetToValidFile()
-	msg := &pb.MsgProto{Sequence: 1, Data: []byte("this is a message")}
+	msg := &spb.MsgProto{Sequence: 1, Data: []byte("this is a message")}
 	b, _ := msg.Marshal()
 	// overwrite with dummy content
 	copy(b, []byte("hello"))
@@ -1412,7 +2033,7 @@ func TestFSBadSubFile(t *testing.T) {
 			t.Fatalf("Unexpected error removing file: %v", err)
 		}
 		// Create the file with proper file version
-		file, err := openFile(fileName)
+		file, err := openFile(fileName, 0)
 		if err != nil {
 			t.Fatalf("Error creating file: %v", err)
 		}
@@ -1485,17 +2106,17 @@ func TestFSSwapFiles(t *testing.T) {
 		os.Remove(activeFileName)
 
 		var err error
-		tmpFile, err = openFile(tmpFileName)
+		tmpFile, err = openFile(tmpFileName, 0)
 		if err != nil {
 			stackFatalf(t, "Unexpected error creating file: %v", tmpFile)
 		}
-		activeFile, err = openFile(activeFileName)
+		activeFile, err = openFile(activeFileName, 0)
 		if err != nil {
 			stackFatalf(t, "Unexpected error creating file: %v", activeFile)
 		}
 	}
 	doSwapWithError := func() {
-		f, err := swapFiles(tmpFile, activeFile)
+		f, err := swapFiles(tmpFile, activeFile, 0)
 		if err == nil {
 			stackFatalf(t, "Expected error swapping files, got none")
 		}
@@ -1516,7 +2137,7 @@ func TestFSSwapFiles(t *testing.T) {
 
 	resetFiles()
 	// Success test
-	activeFile, err := swapFiles(tmpFile, activeFile)
+	activeFile, err := swapFiles(tmpFile, activeFile, 0)
 	if err != nil {
 		t.Fatalf("Unexpected error on swap: %v", err)
 	}
@@ -2188,6 +2809,188 @@ func TestFSDoSync(t *testing.T) {
 	}
 }
 
+// msgFileSize returns the size on disk of the current file of the channel.
+func msgFileSize(t *testing.T, cs *ChannelStore) int64 {
+	ms := cs.Msgs.(*FileMsgStore)
+	ms.RLock()
+	fileName := ms.currSlice().fileName
+	ms.RUnlock()
+	fi, err := os.Stat(fileName)
+	if err != nil {
+		stackFatalf(t, "Unable to stat message file: %v", err)
+	}
+	return fi.Size()
+}
+
+func TestFSFlushInterval(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, FlushInterval(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+
+	cs, _, err := fs.CreateChannel("foo", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error creating channel: %v", err)
+	}
+	initial := msgFileSize(t, cs)
+	storeMsg(t, fs, "foo", []byte("hello"))
+	if err := cs.Msgs.Flush(); err != nil {
+		t.Fatalf("Unexpected error on flush: %v", err)
+	}
+	if size := msgFileSize(t, cs); size != initial {
+		t.Fatalf("Message should not have been written yet, file size went from %v to %v", initial, size)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if size := msgFileSize(t, cs); size == initial {
+		t.Fatal("Message should have been written after the flush interval")
+	}
+
+	// Messages still buffered are written on close.
+	storeMsg(t, fs, "foo", []byte("hello"))
+	cs.Msgs.Flush()
+	written := msgFileSize(t, cs)
+	fs.Close()
+	if size := msgFileSize(t, cs); size == written {
+		t.Fatal("Message should have been written on close")
+	}
+}
+
+func TestFSFlushBytes(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, FlushBytes(1500), FlushInterval(time.Hour))
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+
+	cs, _, err := fs.CreateChannel("foo", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error creating channel: %v", err)
+	}
+	initial := msgFileSize(t, cs)
+	msg := make([]byte, 1000)
+	storeMsg(t, fs, "foo", msg)
+	if err := cs.Msgs.Flush(); err != nil {
+		t.Fatalf("Unexpected error on flush: %v", err)
+	}
+	if size := msgFileSize(t, cs); size != initial {
+		t.Fatalf("Message should not have been written yet, file size went from %v to %v", initial, size)
+	}
+	storeMsg(t, fs, "foo", msg)
+	if err := cs.Msgs.Flush(); err != nil {
+		t.Fatalf("Unexpected error on flush: %v", err)
+	}
+	if size := msgFileSize(t, cs); size < initial+2000 {
+		t.Fatalf("Messages should have been written, file size went from %v to %v", initial, size)
+	}
+
+	// FlushNow writes the buffered messages whatever the options.
+	written := msgFileSize(t, cs)
+	storeMsg(t, fs, "foo", msg)
+	if err := cs.Msgs.Flush(); err != nil {
+		t.Fatalf("Unexpected error on flush: %v", err)
+	}
+	if size := msgFileSize(t, cs); size != written {
+		t.Fatalf("Message should not have been written yet, file size went from %v to %v", written, size)
+	}
+	if err := cs.Msgs.FlushNow(); err != nil {
+		t.Fatalf("Unexpected error on flush: %v", err)
+	}
+	if size := msgFileSize(t, cs); size < written+1000 {
+		t.Fatalf("Message should have been written, file size went from %v to %v", written, size)
+	}
+}
+
+func TestFSFlushOptionsInvalid(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	for _, opt := range []FileStoreOption{FlushInterval(-time.Second), FlushBytes(-1), AckFlushInterval(-time.Second)} {
+		fs, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, opt)
+		if err == nil {
+			fs.Close()
+			t.Fatal("Expected error for negative flush option")
+		}
+	}
+}
+
+func subFileSize(t *testing.T, cs *ChannelStore) int64 {
+	ss := cs.Subs.(*FileSubStore)
+	ss.RLock()
+	fileName := ss.file.Name()
+	ss.RUnlock()
+	fi, err := os.Stat(fileName)
+	if err != nil {
+		stackFatalf(t, "Unable to stat subscriptions file: %v", err)
+	}
+	return fi.Size()
+}
+
+func TestFSAckFlushInterval(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	fs, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, AckFlushInterval(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	defer fs.Close()
+	info := testDefaultServerInfo
+	if err := fs.Init(&info); err != nil {
+		t.Fatalf("Unexpected error on init: %v", err)
+	}
+
+	subID := storeSub(t, fs, "foo")
+	cs := fs.LookupChannel("foo")
+	for seq := uint64(1); seq <= 5; seq++ {
+		storeMsg(t, fs, "foo", []byte("hello"))
+		if err := cs.Subs.AddSeqPending(subID, seq); err != nil {
+			t.Fatalf("Unexpected error adding pending message: %v", err)
+		}
+	}
+	if err := cs.Subs.Flush(); err != nil {
+		t.Fatalf("Unexpected error on flush: %v", err)
+	}
+	written := subFileSize(t, cs)
+	for seq := uint64(1); seq <= 3; seq++ {
+		if err := cs.Subs.AckSeqPending(subID, seq); err != nil {
+			t.Fatalf("Unexpected error on ack: %v", err)
+		}
+	}
+	// The acks are not written by a flush, but after the interval.
+	if err := cs.Subs.Flush(); err != nil {
+		t.Fatalf("Unexpected error on flush: %v", err)
+	}
+	if size := subFileSize(t, cs); size != written {
+		t.Fatalf("Acks should not have been written yet, file size went from %v to %v", written, size)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if size := subFileSize(t, cs); size == written {
+		t.Fatal("Acks should have been written after the ack flush interval")
+	}
+
+	// The acks still deferred are written on close.
+	if err := cs.Subs.AckSeqPending(subID, 4); err != nil {
+		t.Fatalf("Unexpected error on ack: %v", err)
+	}
+	fs.Close()
+	fs, state := openDefaultFileStore(t)
+	defer fs.Close()
+	subs := state.Subs["foo"]
+	if len(subs) != 1 {
+		t.Fatalf("Expected one subscription, got %v", len(subs))
+	}
+	if pending := subs[0].Pending; len(pending) != 1 || pending[5] == nil {
+		t.Fatalf("Expected message 5 to be pending, got %v", pending)
+	}
+}
+
 type testReader struct {
 	content     []byte
 	start       int
@@ -2493,3 +3296,142 @@ func TestFSNoPartialWriteDueToBuffering(t *testing.T) {
 		t.Fatalf("Expected 1 message, got: %v", n)
 	}
 }
+
+func TestFSEncryption(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	key := EncryptionKey([]byte("secret key"))
+	fs, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, key)
+	if err != nil {
+		t.Fatalf("Unable to create a FileStore instance: %v", err)
+	}
+	info := testDefaultServerInfo
+	if err := fs.Init(&info); err != nil {
+		t.Fatalf("Unexpected error during Init: %v", err)
+	}
+	if _, _, err := fs.AddClient("sensitive-client", "hbInbox", nil); err != nil {
+		t.Fatalf("Unexpected error adding client: %v", err)
+	}
+	m := storeMsg(t, fs, "foo", []byte("sensitive-payload"))
+	sub := storeSub(t, fs, "foo")
+	storeSubPending(t, fs, "foo", sub, m.Sequence)
+	fs.Close()
+
+	// Nothing is written in clear.
+	err = filepath.Walk(defaultDataStore, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, clear := range []string{"sensitive-client", "sensitive-payload", info.ClusterID} {
+			if bytes.Contains(content, []byte(clear)) {
+				return fmt.Errorf("file %s contains %q", path, clear)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Records are decrypted on recovery.
+	fs, state, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, key)
+	if err != nil {
+		t.Fatalf("Unable to recover the FileStore: %v", err)
+	}
+	if state == nil || state.Info.ClusterID != info.ClusterID {
+		t.Fatalf("Unexpected recovered state: %v", state)
+	}
+	if len(state.Clients) != 1 || state.Clients[0].ID != "sensitive-client" {
+		t.Fatalf("Unexpected recovered clients: %v", state.Clients)
+	}
+	if len(state.Subs["foo"]) != 1 || len(state.Subs["foo"][0].Pending) != 1 {
+		t.Fatalf("Unexpected recovered subscriptions: %v", state.Subs)
+	}
+	if rm := fs.LookupChannel("foo").Msgs.Lookup(m.Sequence); rm == nil || string(rm.Data) != "sensitive-payload" {
+		t.Fatalf("Unexpected recovered message: %v", rm)
+	}
+	fs.Close()
+
+	// The store can't be opened without the key, or with another key.
+	for _, opts := range [][]FileStoreOption{nil, {EncryptionKey([]byte("other key"))}} {
+		fs, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, opts...)
+		if err == nil {
+			fs.Close()
+			t.Fatalf("Expected error opening the store with options %v", opts)
+		}
+	}
+
+	// Nor can an unencrypted store be opened with a key.
+	cleanupDatastore(t, defaultDataStore)
+	fs = createDefaultFileStore(t)
+	fs.Close()
+	if fs, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, key); err == nil {
+		fs.Close()
+		t.Fatal("Expected error opening an unencrypted store with a key")
+	}
+}
+
+func TestFSCompression(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	if _, _, err := NewFileStore(defaultDataStore, &testDefaultChannelLimits, Compression("lz4")); err == nil {
+		t.Fatal("Expected error for unsupported compression")
+	}
+
+	// Two messages per file, so that each restart below moves to a new
+	// file, created with a different compression.
+	limits := testDefaultChannelLimits
+	limits.MaxNumMsgs = 2 * numSlices
+	payload := bytes.Repeat([]byte("compressible-payload "), 100)
+	var expected [][]byte
+	for i, compression := range []string{CompressionGzip, CompressionSnappy, CompressionNone, CompressionGzip} {
+		fs, _, err := NewFileStore(defaultDataStore, &limits, Compression(compression))
+		if err != nil {
+			t.Fatalf("Unable to create a FileStore instance: %v", err)
+		}
+		if i == 0 {
+			info := testDefaultServerInfo
+			if err := fs.Init(&info); err != nil {
+				t.Fatalf("Unexpected error during Init: %v", err)
+			}
+		}
+		for j := 0; j < 2; j++ {
+			data := append([]byte(fmt.Sprintf("%d-%d ", i, j)), payload...)
+			storeMsg(t, fs, "foo", data)
+			expected = append(expected, data)
+		}
+		fs.Close()
+	}
+
+	// Only the file written without compression contains the payload in clear.
+	for i := 1; i <= 4; i++ {
+		content, err := ioutil.ReadFile(filepath.Join(defaultDataStore, "foo", fmt.Sprintf("msgs.%d.dat", i)))
+		if err != nil {
+			t.Fatalf("Unexpected error reading file: %v", err)
+		}
+		if clear := bytes.Contains(content, payload); clear != (i == 3) {
+			t.Fatalf("File %d contains payload in clear: %v", i, clear)
+		}
+	}
+
+	fs, _, err := NewFileStore(defaultDataStore, &limits)
+	if err != nil {
+		t.Fatalf("Unable to recover the FileStore: %v", err)
+	}
+	defer fs.Close()
+	ms := fs.LookupChannel("foo").Msgs
+	for i, data := range expected {
+		if m := ms.Lookup(uint64(i + 1)); m == nil || !bytes.Equal(m.Data, data) {
+			t.Fatalf("Unexpected recovered message %d: %v", i+1, m)
+		}
+	}
+	if _, bytes, _ := ms.State(); bytes != uint64(len(expected)*len(expected[0])) {
+		t.Fatalf("Unexpected size of recovered messages: %v", bytes)
+	}
+}
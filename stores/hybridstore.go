@@ -0,0 +1,487 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// TypeHybrid is the store type name for hybrid stores
+const TypeHybrid = "HYBRID"
+
+// DefaultHybridMaxMemBytes is the default number of payload bytes that a
+// channel of a hybrid store keeps in memory.
+const DefaultHybridMaxMemBytes = 64 * 1024 * 1024
+
+// Suffix of the files holding the messages spilled to disk.
+const spillFileSuffix = ".spill"
+
+// Number of readers of the spilled messages of a channel whose sequential
+// reads are detected, for instance subscriptions replaying the channel.
+const maxSequentialReaders = 16
+
+// HybridStoreOptions are the options of a HybridStore.
+type HybridStoreOptions struct {
+	// MaxMemBytes is the number of bytes of message payloads each channel
+	// keeps in memory, DefaultHybridMaxMemBytes if 0.
+	MaxMemBytes uint64
+
+	// CacheBytes is the size of the payloads of the messages read back from
+	// the spill files that are cached, in a LRU cache shared by all
+	// channels. No message is cached if 0.
+	CacheBytes uint64
+
+	// ReadAheadMsgs is the number of spilled messages read at once, and
+	// added to the cache, when the spilled messages of a channel are read
+	// sequentially, as when a subscription replays them. It requires
+	// CacheBytes, which should leave room for the messages read ahead for
+	// concurrent replays. No read-ahead if 0.
+	ReadAheadMsgs int
+}
+
+// HybridStore is a factory for message stores keeping the most recent
+// messages of each channel in memory, and moving the older ones to a file
+// once the channel holds more than a given amount of bytes in memory.
+// Like the memory store, nothing is recovered on restart: the spill files
+// are removed when the channels are closed.
+type HybridStore struct {
+	genericStore
+	rootDir     string
+	maxMemBytes uint64
+	cache       *msgCache
+	readAhead   int
+}
+
+// HybridMsgStore is a per channel message store in memory, that spills
+// its older messages to a file.
+type HybridMsgStore struct {
+	genericMsgStore
+	fileName    string
+	file        *os.File
+	fileSize    int64
+	spilled     map[uint64]spilledMsg // messages moved to the file
+	memFirst    uint64                // sequence of the first message in memory
+	memBytes    uint64                // payload bytes of the messages in memory
+	maxMemBytes uint64
+	cache       *msgCache // reference to the one from HybridStore
+	tmpBuf      []byte
+	readAhead   int        // spilled messages read at once on sequential reads
+	seqMu       sync.Mutex // protects seqReads, updated by concurrent readers
+	seqReads    []uint64   // sequences following the last reads of the spill file
+}
+
+// spilledMsg is the location of a message in the spill file.
+type spilledMsg struct {
+	offset int64
+	size   int    // size of the record
+	bytes  uint64 // size of the payload
+	guid   string // publish GUID, to remove it from the index
+}
+
+////////////////////////////////////////////////////////////////////////////
+// HybridStore methods
+////////////////////////////////////////////////////////////////////////////
+
+// NewHybridStore returns a factory for hybrid stores, spilling messages
+// to files in `rootDir`.
+// If not limits are provided, the store will be created with
+// DefaultChannelLimits.
+func NewHybridStore(rootDir string, limits *ChannelLimits, opts HybridStoreOptions) (*HybridStore, error) {
+	if rootDir == "" {
+		return nil, fmt.Errorf("a directory is required to spill messages")
+	}
+	if err := os.MkdirAll(rootDir, os.ModeDir+os.ModePerm); err != nil {
+		return nil, err
+	}
+	maxMemBytes := opts.MaxMemBytes
+	if maxMemBytes == 0 {
+		maxMemBytes = DefaultHybridMaxMemBytes
+	}
+	hs := &HybridStore{
+		rootDir:     rootDir,
+		maxMemBytes: maxMemBytes,
+		cache:       newMsgCache(opts.CacheBytes),
+	}
+	// Messages read ahead are only kept in the cache.
+	if hs.cache != nil && opts.ReadAheadMsgs > 1 {
+		hs.readAhead = opts.ReadAheadMsgs
+	}
+	hs.init(TypeHybrid, limits)
+	return hs, nil
+}
+
+// CreateChannel creates a ChannelStore for the given channel, and returns
+// `true` to indicate that the channel is new, false if it already exists.
+func (hs *HybridStore) CreateChannel(channel string, userData interface{}) (*ChannelStore, bool, error) {
+	hs.Lock()
+	defer hs.Unlock()
+	channelStore := hs.channels[channel]
+	if channelStore != nil {
+		return channelStore, false, nil
+	}
+
+	if err := hs.canAddChannel(); err != nil {
+		return nil, false, err
+	}
+
+	fileName := filepath.Join(hs.rootDir, channel+spillFileSuffix)
+	// Truncate what could be left by a previous run.
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR|os.O_TRUNC|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, false, err
+	}
+
+	msgStore := &HybridMsgStore{
+		fileName:    fileName,
+		file:        file,
+		spilled:     make(map[uint64]spilledMsg),
+		maxMemBytes: hs.maxMemBytes,
+		cache:       hs.cache,
+		readAhead:   hs.readAhead,
+	}
+	msgStore.init(channel, hs.channelLimits(channel), hs.clock)
+
+	subStore := &MemorySubStore{}
+	subStore.init(channel, hs.channelLimits(channel))
+
+	channelStore = &ChannelStore{
+		Subs:     subStore,
+		Msgs:     msgStore,
+		UserData: userData,
+	}
+
+	hs.channels[channel] = channelStore
+
+	return channelStore, true, nil
+}
+
+// CacheStats returns the statistics of the cache of the messages read back
+// from the spill files.
+func (hs *HybridStore) CacheStats() CacheStats {
+	return hs.cache.getStats()
+}
+
+////////////////////////////////////////////////////////////////////////////
+// HybridMsgStore methods
+////////////////////////////////////////////////////////////////////////////
+
+// Store a given message.
+func (ms *HybridMsgStore) Store(reply string, data []byte) (*spb.MsgProto, error) {
+	return ms.StoreMsg(&spb.MsgProto{Reply: reply, Data: data})
+}
+
+// StoreMsg stores the given message, assigning its sequence, subject and
+// timestamp. The oldest messages are moved to the spill file when the
+// messages in memory use more than the maximum number of bytes.
+func (ms *HybridMsgStore) StoreMsg(m *spb.MsgProto) (*spb.MsgProto, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if ms.closed {
+		return nil, fmt.Errorf("message store for %q is closed", ms.subject)
+	}
+	if ms.first == 0 {
+		ms.first = 1
+	}
+	ms.last++
+	m.Sequence = ms.last
+	m.Subject = ms.subject
+	m.Timestamp = ms.clock.Now().UnixNano()
+	ms.msgs[ms.last] = m
+	ms.indexGUID(m)
+	if ms.memFirst == 0 {
+		ms.memFirst = ms.last
+	}
+	size := uint64(len(m.Data))
+	ms.memBytes += size
+	ms.totalCount++
+	ms.totalBytes += size
+
+	// Check if we need to remove any (but leave at least the last added)
+	for ms.totalCount > ms.limits.MaxNumMsgs ||
+		((ms.totalCount > 1) && (ms.totalBytes > ms.limits.MaxMsgBytes)) {
+		if !ms.hitLimit {
+			ms.hitLimit = true
+			Noticef(droppingMsgsFmt, ms.subject, ms.totalCount, ms.limits.MaxNumMsgs, ms.totalBytes, ms.limits.MaxMsgBytes)
+		}
+		if err := ms.removeFirst(); err != nil {
+			return nil, err
+		}
+	}
+	// Move the oldest messages to the file, keeping at least the last one.
+	for ms.memBytes > ms.maxMemBytes && ms.memFirst < ms.last {
+		if err := ms.spill(); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// removeFirst removes the first message, from memory or the spill file.
+// Lock held on entry.
+func (ms *HybridMsgStore) removeFirst() error {
+	seq := ms.first
+	var size uint64
+	if sm, ok := ms.spilled[seq]; ok {
+		size = sm.bytes
+		ms.unindexGUID(sm.guid, seq)
+		delete(ms.spilled, seq)
+		ms.cache.remove(ms, seq)
+		// Reclaim the space once no message is left in the file.
+		if len(ms.spilled) == 0 {
+			if err := ms.truncate(); err != nil {
+				return err
+			}
+		}
+	} else {
+		m := ms.msgs[seq]
+		size = uint64(len(m.Data))
+		ms.unindexGUID(m.Guid, seq)
+		delete(ms.msgs, seq)
+		ms.memBytes -= size
+		ms.memFirst = seq + 1
+	}
+	ms.totalBytes -= size
+	ms.totalCount--
+	ms.first++
+	return nil
+}
+
+// spill moves the first message in memory to the spill file.
+// Lock held on entry.
+func (ms *HybridMsgStore) spill() error {
+	seq := ms.memFirst
+	m := ms.msgs[seq]
+	var size int
+	var err error
+	ms.tmpBuf, size, err = writeRecord(ms.file, ms.tmpBuf, recNoType, m, crc32.IEEETable)
+	if err != nil {
+		return fmt.Errorf("unable to spill message %v of %q: %v", seq, ms.subject, err)
+	}
+	bytes := uint64(len(m.Data))
+	ms.spilled[seq] = spilledMsg{offset: ms.fileSize, size: size, bytes: bytes, guid: m.Guid}
+	ms.fileSize += int64(size)
+	delete(ms.msgs, seq)
+	ms.memBytes -= bytes
+	ms.memFirst++
+	return nil
+}
+
+// truncate empties the spill file.
+// Lock held on entry.
+func (ms *HybridMsgStore) truncate() error {
+	if err := ms.file.Truncate(0); err != nil {
+		return err
+	}
+	ms.fileSize = 0
+	return nil
+}
+
+// lookup returns the message with the given sequence, reading it from the
+// spill file if needed.
+// Lock held on entry.
+func (ms *HybridMsgStore) lookup(seq uint64) *spb.MsgProto {
+	if m := ms.msgs[seq]; m != nil {
+		return m
+	}
+	sm, ok := ms.spilled[seq]
+	if !ok {
+		return nil
+	}
+	if m := ms.cache.get(ms, seq); m != nil {
+		return m
+	}
+	if ms.readAhead == 0 {
+		m, _ := ms.readSpilled(seq, sm, 1)
+		return m
+	}
+	n := 1
+	if ms.isSequentialRead(seq) {
+		n = ms.readAhead
+	}
+	m, read := ms.readSpilled(seq, sm, n)
+	if m != nil {
+		ms.expectRead(seq + uint64(read))
+	}
+	return m
+}
+
+// readSpilled reads the spilled message `seq`, along with the spilled
+// messages following it, up to `n` messages, in a single read of the spill
+// file. The messages are added to the cache. Returns the first one, and the
+// number of messages read.
+// Lock held on entry (read lock at least).
+func (ms *HybridMsgStore) readSpilled(seq uint64, first spilledMsg, n int) (*spb.MsgProto, int) {
+	size := int64(first.size)
+	count := 1
+	for ; count < n; count++ {
+		sm, ok := ms.spilled[seq+uint64(count)]
+		if !ok || sm.offset != first.offset+size {
+			break
+		}
+		size += int64(sm.size)
+	}
+	// Concurrent readers may hold the read lock, so don't use ms.tmpBuf.
+	block := make([]byte, size)
+	if _, err := ms.file.ReadAt(block, first.offset); err != nil {
+		Noticef("WARNING: Unable to read message %v of %q from %q: %v", seq, ms.subject, ms.fileName, err)
+		return nil, 0
+	}
+	var (
+		r       = bytes.NewReader(block)
+		buf     []byte
+		recSize int
+		err     error
+		res     *spb.MsgProto
+		read    int
+	)
+	for ; read < count; read++ {
+		buf, recSize, _, err = readRecord(r, buf, false, crc32.IEEETable, true)
+		if err != nil {
+			Noticef("WARNING: Unable to read message %v of %q from %q: %v", seq+uint64(read), ms.subject, ms.fileName, err)
+			break
+		}
+		m := &spb.MsgProto{}
+		if err := m.Unmarshal(buf[:recSize]); err != nil {
+			Noticef("WARNING: Unable to decode message %v of %q: %v", seq+uint64(read), ms.subject, err)
+			break
+		}
+		ms.cache.add(ms, m)
+		if read == 0 {
+			res = m
+		}
+	}
+	return res, read
+}
+
+// isSequentialRead returns true if the spilled message `seq` is the one
+// following the messages last read by a reader of the spill file.
+func (ms *HybridMsgStore) isSequentialRead(seq uint64) bool {
+	ms.seqMu.Lock()
+	defer ms.seqMu.Unlock()
+	for i, next := range ms.seqReads {
+		if next == seq {
+			ms.seqReads = append(ms.seqReads[:i], ms.seqReads[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// expectRead records the sequence that a reader reading the spilled
+// messages sequentially would read next, forgetting the oldest one if
+// there are too many readers.
+func (ms *HybridMsgStore) expectRead(seq uint64) {
+	ms.seqMu.Lock()
+	if len(ms.seqReads) == maxSequentialReaders {
+		copy(ms.seqReads, ms.seqReads[1:])
+		ms.seqReads = ms.seqReads[:len(ms.seqReads)-1]
+	}
+	ms.seqReads = append(ms.seqReads, seq)
+	ms.seqMu.Unlock()
+}
+
+// Lookup returns the stored message with given sequence number.
+func (ms *HybridMsgStore) Lookup(seq uint64) *spb.MsgProto {
+	ms.RLock()
+	m := ms.lookup(seq)
+	ms.RUnlock()
+	return m
+}
+
+// LookupRange returns an iterator over the stored messages with sequence
+// numbers from start to end, included.
+func (ms *HybridMsgStore) LookupRange(start, end uint64) MsgIterator {
+	return &hybridMsgIterator{ms: ms, next: start, end: end}
+}
+
+// hybridMsgIterator iterates over the messages of a HybridMsgStore, reading
+// back the spilled messages as they are reached.
+type hybridMsgIterator struct {
+	ms   *HybridMsgStore
+	next uint64
+	end  uint64
+}
+
+// Next returns the next message of the range, or nil at the end of the
+// range or if the next message is not stored.
+func (it *hybridMsgIterator) Next() *spb.MsgProto {
+	if it.next > it.end {
+		return nil
+	}
+	m := it.ms.Lookup(it.next)
+	if m == nil {
+		it.next = it.end + 1
+		return nil
+	}
+	it.next++
+	return m
+}
+
+// FirstMsg returns the first message stored.
+func (ms *HybridMsgStore) FirstMsg() *spb.MsgProto {
+	ms.RLock()
+	m := ms.lookup(ms.first)
+	ms.RUnlock()
+	return m
+}
+
+// GetSequenceFromTimestamp returns the sequence of the first message whose
+// timestamp is greater or equal to given timestamp.
+func (ms *HybridMsgStore) GetSequenceFromTimestamp(timestamp int64) uint64 {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	index := sort.Search(ms.totalCount, func(i int) bool {
+		m := ms.lookup(uint64(i) + ms.first)
+		return m == nil || m.Timestamp >= timestamp
+	})
+
+	return uint64(index) + ms.first
+}
+
+// Purge removes all messages from the store.
+func (ms *HybridMsgStore) Purge() error {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.purge()
+	ms.cache.removeAll(ms)
+	ms.spilled = make(map[uint64]spilledMsg)
+	ms.memFirst = 0
+	ms.memBytes = 0
+	return ms.truncate()
+}
+
+// Close closes this store and removes its spill file.
+func (ms *HybridMsgStore) Close() error {
+	ms.Lock()
+	defer ms.Unlock()
+	if ms.closed {
+		return nil
+	}
+	ms.closed = true
+	ms.cache.removeAll(ms)
+	err := ms.file.Close()
+	if rerr := os.Remove(ms.fileName); rerr != nil && err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// SpilledState returns the number of messages of this store that are in
+// the spill file, and the size of that file.
+func (ms *HybridMsgStore) SpilledState() (numMessages int, fileSize int64) {
+	ms.RLock()
+	numMessages, fileSize = len(ms.spilled), ms.fileSize
+	ms.RUnlock()
+	return
+}
@@ -0,0 +1,228 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// Small enough for the common tests to spill most of their messages.
+const testHybridMaxMemBytes = 10
+
+func createDefaultHybridStore(t *testing.T) *HybridStore {
+	hs, err := NewHybridStore(defaultDataStore, &testDefaultChannelLimits, HybridStoreOptions{MaxMemBytes: testHybridMaxMemBytes})
+	if err != nil {
+		stackFatalf(t, "Unexpected error: %v", err)
+	}
+	return hs
+}
+
+func TestHSBasicCreate(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	hs := createDefaultHybridStore(t)
+	defer hs.Close()
+
+	testBasicCreate(t, hs, TypeHybrid)
+}
+
+func TestHSRequiresDir(t *testing.T) {
+	if _, err := NewHybridStore("", nil, HybridStoreOptions{}); err == nil {
+		t.Fatal("Expected error without a directory")
+	}
+}
+
+func TestHSBasicMsgStore(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	hs := createDefaultHybridStore(t)
+	defer hs.Close()
+
+	testBasicMsgStore(t, hs)
+}
+
+func TestHSMaxMsgs(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	hs := createDefaultHybridStore(t)
+	defer hs.Close()
+
+	testMaxMsgs(t, hs)
+}
+
+func TestHSGetSeqFromTimestamp(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	hs := createDefaultHybridStore(t)
+	defer hs.Close()
+
+	testGetSeqFromStartTime(t, hs)
+}
+
+func TestHSGetSeqFromGUID(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	hs := createDefaultHybridStore(t)
+	defer hs.Close()
+
+	testGetSeqFromGUID(t, hs)
+}
+
+func TestHSDeleteChannel(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	hs := createDefaultHybridStore(t)
+	defer hs.Close()
+
+	testDeleteChannel(t, hs)
+}
+
+func TestHSPurge(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	hs := createDefaultHybridStore(t)
+	defer hs.Close()
+
+	testPurge(t, hs)
+}
+
+func TestHSSpillAndReadBack(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	limits := testDefaultChannelLimits
+	limits.MaxNumMsgs = 8
+	hs, err := NewHybridStore(defaultDataStore, &limits, HybridStoreOptions{MaxMemBytes: 16})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer hs.Close()
+
+	for i := 1; i <= 6; i++ {
+		storeMsg(t, hs, "foo", []byte(fmt.Sprintf("msg%d", i)))
+	}
+	cs := hs.LookupChannel("foo")
+	ms := cs.Msgs.(*HybridMsgStore)
+	// 4 bytes per message, so 4 messages are kept in memory.
+	if n, size := ms.SpilledState(); n != 2 || size == 0 {
+		t.Fatalf("Expected 2 spilled messages, got %v (file size %v)", n, size)
+	}
+	if n, b, _ := ms.State(); n != 6 || b != 24 {
+		t.Fatalf("Unexpected state: msgs=%v bytes=%v", n, b)
+	}
+	if m := ms.FirstMsg(); m == nil || m.Sequence != 1 || string(m.Data) != "msg1" {
+		t.Fatalf("Unexpected first message: %v", m)
+	}
+	it := ms.LookupRange(1, 6)
+	for seq := uint64(1); seq <= 6; seq++ {
+		m := it.Next()
+		if m == nil || m.Sequence != seq || string(m.Data) != fmt.Sprintf("msg%d", seq) {
+			t.Fatalf("Unexpected message %v: %v", seq, m)
+		}
+	}
+	if m := it.Next(); m != nil {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+
+	// The limits apply to spilled messages too.
+	for i := 7; i <= 10; i++ {
+		storeMsg(t, hs, "foo", []byte(fmt.Sprintf("msg%d", i)))
+	}
+	if first, last := ms.FirstAndLastSequence(); first != 3 || last != 10 {
+		t.Fatalf("Unexpected sequences: first=%v last=%v", first, last)
+	}
+	storeMsg(t, hs, "foo", []byte("msg11"))
+	storeMsg(t, hs, "foo", []byte("msg12"))
+	if m := ms.Lookup(5); m == nil || string(m.Data) != "msg5" {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+
+	// The spill file is removed when the channel is deleted.
+	fileName := ms.fileName
+	if _, err := os.Stat(fileName); err != nil {
+		t.Fatalf("Expected spill file to exist: %v", err)
+	}
+	if err := hs.DeleteChannel("foo"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		t.Fatalf("Expected spill file to be removed, got %v", err)
+	}
+}
+
+func TestHSCache(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	hs, err := NewHybridStore(defaultDataStore, &testDefaultChannelLimits,
+		HybridStoreOptions{MaxMemBytes: 4, CacheBytes: 8})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer hs.Close()
+
+	for i := 1; i <= 4; i++ {
+		storeMsg(t, hs, "foo", []byte(fmt.Sprintf("msg%d", i)))
+	}
+	ms := hs.LookupChannel("foo").Msgs
+	for i := 0; i < 2; i++ {
+		if m := ms.Lookup(1); m == nil || string(m.Data) != "msg1" {
+			t.Fatalf("Unexpected message: %v", m)
+		}
+	}
+	// Messages in memory do not go through the cache.
+	ms.Lookup(4)
+	if stats := hs.CacheStats(); stats.Hits != 1 || stats.Misses != 1 || stats.Msgs != 1 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+	if err := ms.Purge(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stats := hs.CacheStats(); stats.Msgs != 0 || stats.Bytes != 0 {
+		t.Fatalf("Expected cache to be emptied, got %+v", stats)
+	}
+}
+
+func TestHSReadAhead(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	hs, err := NewHybridStore(defaultDataStore, &testDefaultChannelLimits,
+		HybridStoreOptions{MaxMemBytes: 4, CacheBytes: 1024, ReadAheadMsgs: 5})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer hs.Close()
+
+	for i := 1; i <= 20; i++ {
+		storeMsg(t, hs, "foo", []byte(fmt.Sprintf("msg%d", i)))
+	}
+	ms := hs.LookupChannel("foo").Msgs
+	// Random reads are not followed by a read-ahead.
+	ms.Lookup(10)
+	ms.Lookup(5)
+	if stats := hs.CacheStats(); stats.Misses != 2 || stats.Msgs != 2 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+	// Messages 1 to 19 are spilled, 20 is in memory. Once the reads are
+	// sequential, messages are read 5 at a time.
+	it := ms.LookupRange(1, 20)
+	for i := 1; i <= 20; i++ {
+		if m := it.Next(); m == nil || string(m.Data) != fmt.Sprintf("msg%d", i) {
+			t.Fatalf("Unexpected message %v: %v", i, m)
+		}
+	}
+	// Misses for 1, 2, 7, 12 and 17.
+	if stats := hs.CacheStats(); stats.Misses != 7 || stats.Hits != 14 || stats.Msgs != 19 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
@@ -0,0 +1,698 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+	bolt "go.etcd.io/bbolt"
+)
+
+// TypeKV is the store type name for stores backed by an embedded
+// key-value database
+const TypeKV = "KV"
+
+// KVStoreFileName is the name of the database file created by the KV
+// store in its root directory.
+const KVStoreFileName = "streaming.db"
+
+// How long to wait for the lock of the database file, held by another
+// process using the same directory.
+const kvOpenTimeout = time.Second
+
+// Buckets of the KV store database. Each channel has a bucket, in the
+// channels bucket, holding the buckets of its messages, keyed by sequence,
+// subscriptions, keyed by ID, and pending messages, keyed by subscription
+// ID and sequence. The pending bucket also has, keyed by subscription ID
+// alone, the sequence of the last message sent to the subscription.
+// Messages and subscriptions are stored as protobufs. The groups bucket has
+// the last sequence of each ordering group, keyed by name.
+var (
+	kvServerBucket   = []byte("server")
+	kvClientsBucket  = []byte("clients")
+	kvChannelsBucket = []byte("channels")
+	kvGroupsBucket   = []byte("groups")
+	kvMsgsBucket     = []byte("msgs")
+	kvSubsBucket     = []byte("subs")
+	kvPendingBucket  = []byte("pending")
+	kvServerInfoKey  = []byte("info")
+)
+
+// KVStore is a factory for message and subscription stores backed by
+// a single database file. Messages are kept in memory too, so that lookups
+// do not hit the database, and every change is written through to the
+// database in a transaction.
+type KVStore struct {
+	genericStore
+	rootDir string
+	db      *bolt.DB
+}
+
+// KVSubStore is a subscription store backed by the KV store database.
+type KVSubStore struct {
+	genericSubStore
+	db *bolt.DB
+}
+
+// KVMsgStore is a per channel message store backed by the KV store
+// database.
+type KVMsgStore struct {
+	genericMsgStore
+	db *bolt.DB
+}
+
+// kvKey returns the big endian encoding of the given numbers, so that keys
+// are sorted by value.
+func kvKey(ids ...uint64) []byte {
+	b := make([]byte, 8*len(ids))
+	for i, id := range ids {
+		binary.BigEndian.PutUint64(b[8*i:], id)
+	}
+	return b
+}
+
+// kvChannelBucket returns the bucket `name` of the channel, nil if the
+// channel has no bucket.
+func kvChannelBucket(tx *bolt.Tx, channel string, name []byte) *bolt.Bucket {
+	cb := tx.Bucket(kvChannelsBucket).Bucket([]byte(channel))
+	if cb == nil {
+		return nil
+	}
+	return cb.Bucket(name)
+}
+
+////////////////////////////////////////////////////////////////////////////
+// KVStore methods
+////////////////////////////////////////////////////////////////////////////
+
+// NewKVStore returns a factory for stores backed by the database file
+// KVStoreFileName in `rootDir`, and recovers any state present. The
+// directory and the database are created if they don't exist.
+// If not limits are provided, the store will be created with
+// DefaultChannelLimits.
+func NewKVStore(rootDir string, limits *ChannelLimits) (*KVStore, *RecoveredState, error) {
+	if rootDir == "" {
+		return nil, nil, fmt.Errorf("a directory is required for the database file")
+	}
+	if err := os.MkdirAll(rootDir, os.ModeDir+os.ModePerm); err != nil {
+		return nil, nil, err
+	}
+	db, err := bolt.Open(filepath.Join(rootDir, KVStoreFileName), 0666, &bolt.Options{Timeout: kvOpenTimeout})
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open database: %v", err)
+	}
+	ks := &KVStore{rootDir: rootDir, db: db}
+	ks.init(TypeKV, limits)
+
+	var (
+		serverInfo    *spb.ServerInfo
+		recoveredSubs = make(RecoveredSubscriptions)
+		clients       []*Client
+		groups        map[string]uint64
+	)
+	// Ensure store is closed in case of return with error
+	defer func() {
+		if err != nil {
+			ks.Close()
+		}
+	}()
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{kvServerBucket, kvClientsBucket, kvChannelsBucket, kvGroupsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create buckets: %v", err)
+	}
+	// Recover everything from a single read transaction, so that the state
+	// is consistent.
+	err = db.View(func(tx *bolt.Tx) error {
+		var err error
+		serverInfo, err = ks.recoverServerInfo(tx)
+		// If there is no server info, then we are done
+		if err != nil || serverInfo == nil {
+			return err
+		}
+		if clients, err = ks.recoverClients(tx); err != nil {
+			return err
+		}
+		if groups, err = ks.recoverOrderingGroups(tx); err != nil {
+			return err
+		}
+		return ks.recoverChannels(tx, recoveredSubs)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if serverInfo == nil {
+		return ks, nil, nil
+	}
+	return ks, &RecoveredState{Info: serverInfo, Clients: clients, Subs: recoveredSubs, OrderingGroups: groups}, nil
+}
+
+// ReadKVStoreState reads the server info and the clients of the KV store
+// in `rootDir` from a read-only transaction, without creating the database
+// or any bucket, for instance to check a data directory before starting a
+// server on it. The database is opened in read-only mode, which fails if
+// a running server holds it. Subscriptions and messages are not read: the
+// Subs map of the returned state only has the names of the channels.
+// The returned state is nil if the store has not been initialized.
+func ReadKVStoreState(rootDir string) (*RecoveredState, error) {
+	dbFile := filepath.Join(rootDir, KVStoreFileName)
+	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
+		return nil, nil
+	}
+	db, err := bolt.Open(dbFile, 0666, &bolt.Options{Timeout: kvOpenTimeout, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open database: %v", err)
+	}
+	defer db.Close()
+	var state *RecoveredState
+	err = db.View(func(tx *bolt.Tx) error {
+		sb := tx.Bucket(kvServerBucket)
+		if sb == nil {
+			return nil
+		}
+		data := sb.Get(kvServerInfoKey)
+		if data == nil {
+			return nil
+		}
+		info := &spb.ServerInfo{}
+		if err := info.Unmarshal(data); err != nil {
+			return err
+		}
+		state = &RecoveredState{Info: info, Subs: make(RecoveredSubscriptions)}
+		if cb := tx.Bucket(kvClientsBucket); cb != nil {
+			cb.ForEach(func(k, v []byte) error {
+				state.Clients = append(state.Clients, &Client{ID: string(k), HbInbox: string(v)})
+				return nil
+			})
+		}
+		if cb := tx.Bucket(kvChannelsBucket); cb != nil {
+			cb.ForEach(func(k, _ []byte) error {
+				state.Subs[string(k)] = nil
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// recoverOrderingGroups returns the last sequences of the ordering groups.
+func (ks *KVStore) recoverOrderingGroups(tx *bolt.Tx) (map[string]uint64, error) {
+	groups := make(map[string]uint64)
+	err := tx.Bucket(kvGroupsBucket).ForEach(func(k, v []byte) error {
+		if len(v) != 8 {
+			return fmt.Errorf("invalid sequence of ordering group %q", k)
+		}
+		groups[string(k)] = binary.BigEndian.Uint64(v)
+		return nil
+	})
+	return groups, err
+}
+
+// SetOrderingGroups records the last sequences of the ordering groups.
+func (ks *KVStore) SetOrderingGroups(groups map[string]uint64) error {
+	return ks.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(kvGroupsBucket)
+		for name, seq := range groups {
+			if err := b.Put([]byte(name), kvKey(seq)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// recoverServerInfo returns the stored server info, nil if none.
+func (ks *KVStore) recoverServerInfo(tx *bolt.Tx) (*spb.ServerInfo, error) {
+	data := tx.Bucket(kvServerBucket).Get(kvServerInfoKey)
+	if data == nil {
+		return nil, nil
+	}
+	info := &spb.ServerInfo{}
+	if err := info.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// recoverClients returns the stored clients.
+func (ks *KVStore) recoverClients(tx *bolt.Tx) ([]*Client, error) {
+	var clients []*Client
+	err := tx.Bucket(kvClientsBucket).ForEach(func(k, v []byte) error {
+		c := &Client{ID: string(k), HbInbox: string(v)}
+		ks.clients[c.ID] = c
+		clients = append(clients, c)
+		return nil
+	})
+	return clients, err
+}
+
+// recoverChannels recreates the channels with their messages and
+// subscriptions.
+func (ks *KVStore) recoverChannels(tx *bolt.Tx, recoveredSubs RecoveredSubscriptions) error {
+	return tx.Bucket(kvChannelsBucket).ForEach(func(k, _ []byte) error {
+		channel := string(k)
+		msgStore := ks.newKVMsgStore(channel)
+		if err := msgStore.recover(tx); err != nil {
+			return err
+		}
+		subStore := ks.newKVSubStore(channel)
+		rssArray, err := subStore.recover(tx, msgStore)
+		if err != nil {
+			return err
+		}
+		recoveredSubs[channel] = rssArray
+		ks.channels[channel] = &ChannelStore{
+			Subs: subStore,
+			Msgs: msgStore,
+		}
+		return nil
+	})
+}
+
+// Init is used to persist server's information after the first start
+func (ks *KVStore) Init(info *spb.ServerInfo) error {
+	data, err := info.Marshal()
+	if err != nil {
+		return err
+	}
+	ks.Lock()
+	defer ks.Unlock()
+	return ks.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(kvServerBucket).Put(kvServerInfoKey, data)
+	})
+}
+
+// CreateChannel creates a ChannelStore for the given channel, and returns
+// `true` to indicate that the channel is new, false if it already exists.
+func (ks *KVStore) CreateChannel(channel string, userData interface{}) (*ChannelStore, bool, error) {
+	ks.Lock()
+	defer ks.Unlock()
+	channelStore := ks.channels[channel]
+	if channelStore != nil {
+		return channelStore, false, nil
+	}
+
+	// Check for limits
+	if err := ks.canAddChannel(); err != nil {
+		return nil, false, err
+	}
+
+	err := ks.db.Update(func(tx *bolt.Tx) error {
+		cb, err := tx.Bucket(kvChannelsBucket).CreateBucketIfNotExists([]byte(channel))
+		if err != nil {
+			return err
+		}
+		for _, name := range [][]byte{kvMsgsBucket, kvSubsBucket, kvPendingBucket} {
+			if _, err := cb.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	channelStore = &ChannelStore{
+		Subs:     ks.newKVSubStore(channel),
+		Msgs:     ks.newKVMsgStore(channel),
+		UserData: userData,
+	}
+
+	ks.channels[channel] = channelStore
+
+	return channelStore, true, nil
+}
+
+// DeleteChannel closes the channel and deletes its bucket from the database.
+func (ks *KVStore) DeleteChannel(channel string) error {
+	ks.Lock()
+	defer ks.Unlock()
+	cs, err := ks.deleteChannel(channel)
+	if cs == nil {
+		return err
+	}
+	lerr := ks.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(kvChannelsBucket).DeleteBucket([]byte(channel))
+	})
+	if lerr != nil {
+		return lerr
+	}
+	return err
+}
+
+// AddClient stores information about the client identified by `clientID`.
+func (ks *KVStore) AddClient(clientID, hbInbox string, userData interface{}) (*Client, bool, error) {
+	sc, isNew, err := ks.genericStore.AddClient(clientID, hbInbox, userData)
+	if err != nil {
+		return nil, false, err
+	}
+	if !isNew {
+		return sc, false, nil
+	}
+	err = ks.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(kvClientsBucket).Put([]byte(clientID), []byte(hbInbox))
+	})
+	if err != nil {
+		ks.genericStore.DeleteClient(clientID)
+		return nil, false, err
+	}
+	return sc, true, nil
+}
+
+// DeleteClient invalidates the client identified by `clientID`.
+func (ks *KVStore) DeleteClient(clientID string) *Client {
+	sc := ks.genericStore.DeleteClient(clientID)
+	if sc != nil {
+		err := ks.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(kvClientsBucket).Delete([]byte(clientID))
+		})
+		if err != nil {
+			Noticef("WARNING: Unable to delete client %q from the database: %v", clientID, err)
+		}
+	}
+	return sc
+}
+
+// Close closes all stores and the database.
+func (ks *KVStore) Close() error {
+	ks.Lock()
+	defer ks.Unlock()
+	if ks.closed {
+		return nil
+	}
+	ks.closed = true
+	err := ks.close()
+	if lerr := ks.db.Close(); lerr != nil && err == nil {
+		err = lerr
+	}
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////
+// KVMsgStore methods
+////////////////////////////////////////////////////////////////////////////
+
+// newKVMsgStore returns a message store for the given channel.
+// Store lock is held on entry.
+func (ks *KVStore) newKVMsgStore(channel string) *KVMsgStore {
+	ms := &KVMsgStore{db: ks.db}
+	ms.init(channel, ks.channelLimits(channel), ks.clock)
+	return ms
+}
+
+// recover loads the channel's messages from the database.
+func (ms *KVMsgStore) recover(tx *bolt.Tx) error {
+	b := kvChannelBucket(tx, ms.subject, kvMsgsBucket)
+	if b == nil {
+		return fmt.Errorf("no messages bucket for channel %q", ms.subject)
+	}
+	return b.ForEach(func(_, data []byte) error {
+		m := &spb.MsgProto{}
+		// The data is only valid during the transaction, Unmarshal copies it.
+		if err := m.Unmarshal(data); err != nil {
+			return err
+		}
+		if ms.first == 0 {
+			ms.first = m.Sequence
+		}
+		ms.last = m.Sequence
+		ms.msgs[m.Sequence] = m
+		ms.indexGUID(m)
+		ms.totalCount++
+		ms.totalBytes += uint64(len(m.Data))
+		return nil
+	})
+}
+
+// Store a given message.
+func (ms *KVMsgStore) Store(reply string, data []byte) (*spb.MsgProto, error) {
+	return ms.StoreMsg(&spb.MsgProto{Reply: reply, Data: data})
+}
+
+// StoreMsg stores the given message, assigning its sequence, subject and
+// timestamp. The removal of the messages exceeding the limits is part of
+// the same transaction.
+func (ms *KVMsgStore) StoreMsg(m *spb.MsgProto) (*spb.MsgProto, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	seq := ms.last + 1
+	m.Sequence = seq
+	m.Subject = ms.subject
+	m.Timestamp = ms.clock.Now().UnixNano()
+	data, err := m.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the messages to remove (but leave at least the last added)
+	first := ms.first
+	if first == 0 {
+		first = 1
+	}
+	count := ms.totalCount + 1
+	bytes := ms.totalBytes + uint64(len(m.Data))
+	for count > ms.limits.MaxNumMsgs || ((count > 1) && (bytes > ms.limits.MaxMsgBytes)) {
+		bytes -= uint64(len(ms.msgs[first].Data))
+		count--
+		first++
+	}
+
+	err = ms.db.Update(func(tx *bolt.Tx) error {
+		b := kvChannelBucket(tx, ms.subject, kvMsgsBucket)
+		if b == nil {
+			return fmt.Errorf("no messages bucket for channel %q", ms.subject)
+		}
+		if err := b.Put(kvKey(seq), data); err != nil {
+			return err
+		}
+		for s := ms.first; s != 0 && s < first; s++ {
+			if err := b.Delete(kvKey(s)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if ms.first != 0 && ms.first != first && !ms.hitLimit {
+		ms.hitLimit = true
+		Noticef(droppingMsgsFmt, ms.subject, count, ms.limits.MaxNumMsgs, bytes, ms.limits.MaxMsgBytes)
+	}
+	for s := ms.first; s != 0 && s < first; s++ {
+		ms.unindexGUID(ms.msgs[s].Guid, s)
+		delete(ms.msgs, s)
+	}
+	ms.first = first
+	ms.last = seq
+	ms.msgs[seq] = m
+	ms.indexGUID(m)
+	ms.totalCount = count
+	ms.totalBytes = bytes
+
+	return m, nil
+}
+
+// Purge removes all messages from the store and the database.
+func (ms *KVMsgStore) Purge() error {
+	ms.Lock()
+	defer ms.Unlock()
+	err := ms.db.Update(func(tx *bolt.Tx) error {
+		cb := tx.Bucket(kvChannelsBucket).Bucket([]byte(ms.subject))
+		if cb == nil {
+			return fmt.Errorf("no bucket for channel %q", ms.subject)
+		}
+		if err := cb.DeleteBucket(kvMsgsBucket); err != nil {
+			return err
+		}
+		_, err := cb.CreateBucket(kvMsgsBucket)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	ms.purge()
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////
+// KVSubStore methods
+////////////////////////////////////////////////////////////////////////////
+
+// newKVSubStore returns a subscription store for the given channel.
+// Store lock is held on entry.
+func (ks *KVStore) newKVSubStore(channel string) *KVSubStore {
+	subStore := &KVSubStore{db: ks.db}
+	subStore.init(channel, ks.channelLimits(channel))
+	return subStore
+}
+
+// recover loads the channel's subscriptions, and their pending messages,
+// from the database.
+func (ss *KVSubStore) recover(tx *bolt.Tx, msgStore *KVMsgStore) ([]*RecoveredSubState, error) {
+	b := kvChannelBucket(tx, ss.subject, kvSubsBucket)
+	pending := kvChannelBucket(tx, ss.subject, kvPendingBucket)
+	if b == nil || pending == nil {
+		return nil, fmt.Errorf("no subscriptions buckets for channel %q", ss.subject)
+	}
+	subs := make(map[uint64]*RecoveredSubState)
+	err := b.ForEach(func(k, data []byte) error {
+		sub := &spb.SubState{}
+		if err := sub.Unmarshal(data); err != nil {
+			return err
+		}
+		subid := binary.BigEndian.Uint64(k)
+		subs[subid] = &RecoveredSubState{Sub: sub, Pending: make(PendingAcks)}
+		if subid > ss.maxSubID {
+			ss.maxSubID = subid
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ss.subsCount = len(subs)
+
+	err = pending.ForEach(func(k, v []byte) error {
+		rss := subs[binary.BigEndian.Uint64(k)]
+		switch {
+		case rss == nil:
+		case len(k) == 8 && len(v) == 8:
+			if lastSent := binary.BigEndian.Uint64(v); lastSent > rss.Sub.LastSent {
+				rss.Sub.LastSent = lastSent
+			}
+		case len(k) == 16:
+			seq := binary.BigEndian.Uint64(k[8:])
+			if m := msgStore.msgs[seq]; m != nil {
+				rss.Pending[seq] = m
+			}
+		default:
+			return fmt.Errorf("invalid pending key for channel %q", ss.subject)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	rssArray := make([]*RecoveredSubState, 0, len(subs))
+	for _, rss := range subs {
+		rssArray = append(rssArray, rss)
+	}
+	return rssArray, nil
+}
+
+// update runs `fn` with the given bucket of the channel, in a read-write
+// transaction.
+func (ss *KVSubStore) update(name []byte, fn func(b *bolt.Bucket) error) error {
+	return ss.db.Update(func(tx *bolt.Tx) error {
+		b := kvChannelBucket(tx, ss.subject, name)
+		if b == nil {
+			return fmt.Errorf("no %s bucket for channel %q", name, ss.subject)
+		}
+		return fn(b)
+	})
+}
+
+// CreateSub records a new subscription represented by SubState. On success,
+// it returns an id that is used by the other methods.
+func (ss *KVSubStore) CreateSub(sub *spb.SubState) error {
+	ss.Lock()
+	defer ss.Unlock()
+	if err := ss.createSub(sub); err != nil {
+		return err
+	}
+	data, err := sub.Marshal()
+	if err == nil {
+		err = ss.update(kvSubsBucket, func(b *bolt.Bucket) error {
+			return b.Put(kvKey(sub.ID), data)
+		})
+	}
+	if err != nil {
+		ss.subsCount--
+		return err
+	}
+	return nil
+}
+
+// UpdateSub updates a given subscription represented by SubState.
+func (ss *KVSubStore) UpdateSub(sub *spb.SubState) error {
+	data, err := sub.Marshal()
+	if err != nil {
+		return err
+	}
+	ss.Lock()
+	defer ss.Unlock()
+	return ss.update(kvSubsBucket, func(b *bolt.Bucket) error {
+		return b.Put(kvKey(sub.ID), data)
+	})
+}
+
+// DeleteSub invalidates this subscription. Its pending messages, and last
+// sent sequence, are deleted in the same transaction.
+func (ss *KVSubStore) DeleteSub(subid uint64) {
+	ss.Lock()
+	defer ss.Unlock()
+	ss.subsCount--
+	err := ss.db.Update(func(tx *bolt.Tx) error {
+		b := kvChannelBucket(tx, ss.subject, kvSubsBucket)
+		pending := kvChannelBucket(tx, ss.subject, kvPendingBucket)
+		if b == nil || pending == nil {
+			return fmt.Errorf("no subscriptions buckets for channel %q", ss.subject)
+		}
+		if err := b.Delete(kvKey(subid)); err != nil {
+			return err
+		}
+		prefix := kvKey(subid)
+		c := pending.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		Noticef("WARNING: Unable to delete subscription %v on %q from the database: %v", subid, ss.subject, err)
+	}
+}
+
+// AddSeqPending adds the given message seqno to the given subscription,
+// and records it as the last sent if it is above the current one.
+func (ss *KVSubStore) AddSeqPending(subid, seqno uint64) error {
+	return ss.update(kvPendingBucket, func(b *bolt.Bucket) error {
+		if err := b.Put(kvKey(subid, seqno), []byte{}); err != nil {
+			return err
+		}
+		if v := b.Get(kvKey(subid)); len(v) == 8 && binary.BigEndian.Uint64(v) >= seqno {
+			return nil
+		}
+		return b.Put(kvKey(subid), kvKey(seqno))
+	})
+}
+
+// AckSeqPending records that the given message seqno has been acknowledged
+// by the given subscription.
+func (ss *KVSubStore) AckSeqPending(subid, seqno uint64) error {
+	return ss.update(kvPendingBucket, func(b *bolt.Bucket) error {
+		return b.Delete(kvKey(subid, seqno))
+	})
+}
@@ -0,0 +1,242 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func createDefaultKVStore(t *testing.T) *KVStore {
+	ks, state, err := NewKVStore(defaultDataStore, &testDefaultChannelLimits)
+	if err != nil {
+		stackFatalf(t, "Unable to create a KVStore instance: %v", err)
+	}
+	if state != nil {
+		stackFatalf(t, "Expected no recovered state, got %v", state)
+	}
+	return ks
+}
+
+func TestKVBasicCreate(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	ks := createDefaultKVStore(t)
+	defer ks.Close()
+
+	testBasicCreate(t, ks, TypeKV)
+}
+
+func TestKVRequiresDir(t *testing.T) {
+	if _, _, err := NewKVStore("", nil); err == nil {
+		t.Fatal("Expected error without a directory")
+	}
+}
+
+func TestKVStoreAPIs(t *testing.T) {
+	tests := []func(t *testing.T, s Store){
+		testNewChannel,
+		testCloseIdempotent,
+		testBasicMsgStore,
+		testLookupRange,
+		testStoreMsg,
+		testMsgsState,
+		testMaxMsgs,
+		testBasicSubStore,
+		testGetSeqFromStartTime,
+		testGetSeqFromGUID,
+		testClientAPIs,
+		testFlush,
+		testPurge,
+		testDeleteChannel,
+	}
+	for _, f := range tests {
+		cleanupDatastore(t, defaultDataStore)
+		ks := createDefaultKVStore(t)
+		f(t, ks)
+		ks.Close()
+	}
+	cleanupDatastore(t, defaultDataStore)
+}
+
+func TestKVMaxChannelsAndSubs(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	ks := createDefaultKVStore(t)
+	defer func() { ks.Close() }()
+
+	limits := testDefaultChannelLimits
+	limits.MaxChannels = 10
+	limits.MaxSubs = 10
+	ks.SetChannelLimits(limits)
+
+	testMaxChannels(t, ks, limits.MaxChannels)
+
+	ks.Close()
+	cleanupDatastore(t, defaultDataStore)
+	ks = createDefaultKVStore(t)
+	ks.SetChannelLimits(limits)
+	testMaxSubs(t, ks, limits.MaxSubs)
+}
+
+func TestKVFileLocked(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	ks := createDefaultKVStore(t)
+	defer ks.Close()
+
+	// The database file can't be used by two stores.
+	if ks2, _, err := NewKVStore(defaultDataStore, nil); err == nil {
+		ks2.Close()
+		t.Fatal("Expected error opening the database a second time")
+	}
+}
+
+func TestKVReadKVStoreState(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	// Nothing is created if there is no store.
+	if state, err := ReadKVStoreState(defaultDataStore); state != nil || err != nil {
+		t.Fatalf("Expected no state and no error, got %v - %v", state, err)
+	}
+	if _, err := os.Stat(defaultDataStore); !os.IsNotExist(err) {
+		t.Fatalf("Directory should not have been created: %v", err)
+	}
+
+	ks := createDefaultKVStore(t)
+	defer ks.Close()
+	if state, err := ReadKVStoreState(defaultDataStore); state != nil || err == nil {
+		t.Fatalf("Expected error while the database is in use, got %v - %v", state, err)
+	}
+	info := &spb.ServerInfo{ClusterID: "id", Discovery: "discovery"}
+	if err := ks.Init(info); err != nil {
+		t.Fatalf("Unexpected error on init: %v", err)
+	}
+	if _, _, err := ks.AddClient("me", "hbInbox", nil); err != nil {
+		t.Fatalf("Unexpected error adding client: %v", err)
+	}
+	storeMsg(t, ks, "foo", []byte("hello"))
+	storeMsg(t, ks, "bar", []byte("hello"))
+	ks.Close()
+
+	state, err := ReadKVStoreState(defaultDataStore)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if state.Info.ClusterID != "id" {
+		t.Fatalf("Unexpected server info: %v", state.Info)
+	}
+	if len(state.Clients) != 1 || state.Clients[0].ID != "me" || state.Clients[0].HbInbox != "hbInbox" {
+		t.Fatalf("Unexpected clients: %v", state.Clients)
+	}
+	if _, ok := state.Subs["foo"]; !ok || len(state.Subs) != 2 {
+		t.Fatalf("Unexpected channels: %v", state.Subs)
+	}
+}
+
+func TestKVRecoverOrderingGroups(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	testRecoverOrderingGroups(t, createDefaultKVStore(t), func() (Store, *RecoveredState) {
+		ks, state, err := NewKVStore(defaultDataStore, &testDefaultChannelLimits)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return ks, state
+	})
+}
+
+func TestKVRecovery(t *testing.T) {
+	cleanupDatastore(t, defaultDataStore)
+	defer cleanupDatastore(t, defaultDataStore)
+
+	limits := testDefaultChannelLimits
+	limits.MaxNumMsgs = 3
+	ks, _, err := NewKVStore(defaultDataStore, &limits)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	info := &spb.ServerInfo{ClusterID: "id", Discovery: "discovery"}
+	if err := ks.Init(info); err != nil {
+		t.Fatalf("Unexpected error on init: %v", err)
+	}
+	if _, _, err := ks.AddClient("me", "hbInbox", nil); err != nil {
+		t.Fatalf("Unexpected error adding client: %v", err)
+	}
+	if _, _, err := ks.AddClient("deleted", "hbInbox", nil); err != nil {
+		t.Fatalf("Unexpected error adding client: %v", err)
+	}
+	ks.DeleteClient("deleted")
+	for i := 0; i < 5; i++ {
+		storeMsg(t, ks, "foo", []byte(fmt.Sprintf("msg%d", i)))
+	}
+	storeMsg(t, ks, "bar", []byte("hello"))
+	storeMsg(t, ks, "baz", []byte("hello"))
+	sub1 := storeSub(t, ks, "foo")
+	sub2 := storeSub(t, ks, "foo")
+	storeSubPending(t, ks, "foo", sub1, 3, 4, 5)
+	storeSubAck(t, ks, "foo", sub1, 4)
+	storeSubPending(t, ks, "foo", sub2, 5)
+	storeSubDelete(t, ks, "foo", sub2)
+	if err := ks.DeleteChannel("baz"); err != nil {
+		t.Fatalf("Unexpected error on delete: %v", err)
+	}
+	ks.Close()
+
+	ks, state, err := NewKVStore(defaultDataStore, &limits)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer ks.Close()
+	if state == nil {
+		t.Fatal("Expected state to be recovered")
+	}
+	if !reflect.DeepEqual(state.Info, info) {
+		t.Fatalf("Expected server info %v, got %v", info, state.Info)
+	}
+	if len(state.Clients) != 1 || state.Clients[0].ID != "me" || state.Clients[0].HbInbox != "hbInbox" {
+		t.Fatalf("Unexpected recovered clients: %v", state.Clients)
+	}
+	cs := ks.LookupChannel("foo")
+	if cs == nil {
+		t.Fatal("Channel foo should have been recovered")
+	}
+	if first, last := cs.Msgs.FirstAndLastSequence(); first != 3 || last != 5 {
+		t.Fatalf("Unexpected first/last sequences: %v/%v", first, last)
+	}
+	if m := cs.Msgs.Lookup(5); m == nil || string(m.Data) != "msg4" {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+	if n, _, _ := ks.MsgsState("bar"); n != 1 {
+		t.Fatalf("Expected 1 message in bar, got %v", n)
+	}
+	if ks.LookupChannel("baz") != nil {
+		t.Fatal("Channel baz should not have been recovered")
+	}
+	subs := state.Subs["foo"]
+	if len(subs) != 1 || subs[0].Sub.ID != sub1 {
+		t.Fatalf("Unexpected recovered subscriptions: %v", subs)
+	}
+	if subs[0].Sub.LastSent != 5 {
+		t.Fatalf("Expected last sent to be 5, got %v", subs[0].Sub.LastSent)
+	}
+	if len(subs[0].Pending) != 2 || subs[0].Pending[3] == nil || subs[0].Pending[5] == nil {
+		t.Fatalf("Unexpected pending messages: %v", subs[0].Pending)
+	}
+	// New messages and subscriptions must not reuse IDs in use
+	if m := storeMsg(t, ks, "foo", []byte("new")); m.Sequence != 6 {
+		t.Fatalf("Expected sequence 6, got %v", m.Sequence)
+	}
+	if subID := storeSub(t, ks, "foo"); subID <= sub1 {
+		t.Fatalf("Expected subscription ID above %v, got %v", sub1, subID)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Policies choosing the channels whose messages are evicted when the memory
+// budget of a MemoryStore is exceeded.
+const (
+	// EvictProportional evicts the oldest messages of the channel holding the
+	// most bytes, so that each channel keeps at least its share of the budget.
+	EvictProportional = "proportional"
+	// EvictLRU evicts the oldest messages of the channel on which a message
+	// was stored the longest time ago.
+	EvictLRU = "lru"
+)
+
+var budgetExceededFmt = "WARNING: Reached memory budget of %v bytes, evicting old messages " +
+	"of the channels (%s policy) to make room for new ones."
+
+// MemoryStoreOption is a function on the options for a Memory Store
+type MemoryStoreOption func(*MemoryStoreOptions) error
+
+// MemoryStoreOptions can be used to customize a Memory Store
+type MemoryStoreOptions struct {
+	// MaxBytes, if set, is the budget of message payload bytes shared by
+	// all channels, enforced in addition to the channel limits. When it is
+	// exceeded, old messages are evicted from the channels chosen by the
+	// EvictionPolicy. Each channel keeps at least its last message.
+	MaxBytes uint64
+
+	// EvictionPolicy is EvictProportional (the default) or EvictLRU.
+	EvictionPolicy string
+}
+
+// MemoryBudget is a MemoryStore option that sets the budget of message
+// payload bytes of all channels (0 for no budget), and the policy choosing
+// the channels messages are evicted from (EvictProportional if empty).
+func MemoryBudget(maxBytes uint64, policy string) MemoryStoreOption {
+	return func(o *MemoryStoreOptions) error {
+		switch policy {
+		case "":
+			policy = EvictProportional
+		case EvictProportional, EvictLRU:
+		default:
+			return fmt.Errorf("unsupported eviction policy %q", policy)
+		}
+		o.MaxBytes = maxBytes
+		o.EvictionPolicy = policy
+		return nil
+	}
+}
+
+// memBudget is the budget of payload bytes shared by the channels of a
+// MemoryStore.
+type memBudget struct {
+	bytes  int64  // payload bytes of all channels, updated atomically
+	stores uint64 // messages stored on all channels, updated atomically
+	sync.Mutex
+	maxBytes uint64
+	policy   string
+	channels map[*MemoryMsgStore]struct{}
+	hit      bool
+}
+
+func newMemBudget(opts MemoryStoreOptions) *memBudget {
+	if opts.MaxBytes == 0 {
+		return nil
+	}
+	return &memBudget{
+		maxBytes: opts.MaxBytes,
+		policy:   opts.EvictionPolicy,
+		channels: make(map[*MemoryMsgStore]struct{}),
+	}
+}
+
+// add registers the message store of a new channel.
+func (b *memBudget) add(ms *MemoryMsgStore) {
+	b.Lock()
+	b.channels[ms] = struct{}{}
+	b.Unlock()
+}
+
+// remove unregisters the message store of a closed channel, releasing
+// the bytes it held.
+func (b *memBudget) remove(ms *MemoryMsgStore, bytes uint64) {
+	b.Lock()
+	if _, ok := b.channels[ms]; ok {
+		delete(b.channels, ms)
+		atomic.AddInt64(&b.bytes, -int64(bytes))
+	}
+	b.Unlock()
+}
+
+// stored accounts for a message stored on a channel, and returns the
+// order of this store among those of all channels.
+func (b *memBudget) stored(bytes uint64) uint64 {
+	atomic.AddInt64(&b.bytes, int64(bytes))
+	return atomic.AddUint64(&b.stores, 1)
+}
+
+// exceeded returns true if the channels hold more bytes than the budget.
+func (b *memBudget) exceeded() bool {
+	return uint64(atomic.LoadInt64(&b.bytes)) > b.maxBytes
+}
+
+// enforce evicts messages until the budget is no longer exceeded, or all
+// channels hold a single message. It must be called without the lock of
+// any message store held, since these are locked one at a time.
+func (b *memBudget) enforce() {
+	if !b.exceeded() {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	if !b.hit && b.exceeded() {
+		b.hit = true
+		Noticef(budgetExceededFmt, b.maxBytes, b.policy)
+	}
+	for b.exceeded() {
+		victim := b.victim()
+		if victim == nil {
+			return
+		}
+		victim.evictFirst()
+	}
+}
+
+// victim returns the channel to evict a message from, nil if none has more
+// than one message. Budget lock held on entry.
+func (b *memBudget) victim() *MemoryMsgStore {
+	var (
+		victim  *MemoryMsgStore
+		maxSize uint64
+		oldest  uint64
+	)
+	for ms := range b.channels {
+		ms.RLock()
+		count, size, stored := ms.totalCount, ms.totalBytes, ms.lastStored
+		ms.RUnlock()
+		if count <= 1 {
+			continue
+		}
+		switch b.policy {
+		case EvictLRU:
+			if victim == nil || stored < oldest {
+				victim, oldest = ms, stored
+			}
+		default:
+			if victim == nil || size > maxSize {
+				victim, maxSize = ms, size
+			}
+		}
+	}
+	return victim
+}
@@ -0,0 +1,107 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"testing"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func createBudgetedMemStore(t *testing.T, maxBytes uint64, policy string) *MemoryStore {
+	ms, err := NewMemoryStore(&testDefaultChannelLimits, MemoryBudget(maxBytes, policy))
+	if err != nil {
+		stackFatalf(t, "Unexpected error: %v", err)
+	}
+	return ms
+}
+
+func storeMsgs(t *testing.T, s Store, channel string, count, size int) {
+	for i := 0; i < count; i++ {
+		storeMsg(t, s, channel, make([]byte, size))
+	}
+}
+
+func checkChannelMsgs(t *testing.T, s Store, channel string, first, last uint64) {
+	cs := s.LookupChannel(channel)
+	if f, l := cs.Msgs.FirstAndLastSequence(); f != first || l != last {
+		stackFatalf(t, "Expected %v first/last sequences %v/%v, got %v/%v", channel, first, last, f, l)
+	}
+}
+
+func TestMSBudgetProportional(t *testing.T) {
+	ms := createBudgetedMemStore(t, 100, "")
+	defer ms.Close()
+
+	storeMsgs(t, ms, "foo", 8, 10)
+	storeMsgs(t, ms, "bar", 3, 10)
+	// The busiest channel makes room for the new messages.
+	checkChannelMsgs(t, ms, "foo", 2, 8)
+	checkChannelMsgs(t, ms, "bar", 1, 3)
+	// Once it holds more bytes than the other, bar evicts its own messages.
+	storeMsgs(t, ms, "bar", 3, 10)
+	checkChannelMsgs(t, ms, "foo", 4, 8)
+	checkChannelMsgs(t, ms, "bar", 2, 6)
+	if _, bytes, _ := ms.MsgsState(AllChannels); bytes != 100 {
+		t.Fatalf("Expected 100 bytes, got %v", bytes)
+	}
+}
+
+func TestMSBudgetLRU(t *testing.T) {
+	ms := createBudgetedMemStore(t, 100, EvictLRU)
+	defer ms.Close()
+
+	storeMsgs(t, ms, "foo", 5, 10)
+	storeMsgs(t, ms, "bar", 6, 10)
+	// The channel least recently stored to makes room for the new messages.
+	checkChannelMsgs(t, ms, "foo", 2, 5)
+	checkChannelMsgs(t, ms, "bar", 1, 6)
+	storeMsgs(t, ms, "bar", 4, 10)
+	// All channels keep at least their last message.
+	checkChannelMsgs(t, ms, "foo", 5, 5)
+	checkChannelMsgs(t, ms, "bar", 2, 10)
+}
+
+func TestMSBudgetKeepsLastMsg(t *testing.T) {
+	ms := createBudgetedMemStore(t, 10, "")
+	defer ms.Close()
+
+	storeMsgs(t, ms, "foo", 1, 20)
+	storeMsgs(t, ms, "bar", 1, 20)
+	checkChannelMsgs(t, ms, "foo", 1, 1)
+	checkChannelMsgs(t, ms, "bar", 1, 1)
+	if n, bytes, _ := ms.MsgsState(AllChannels); n != 2 || bytes != 40 {
+		t.Fatalf("Unexpected state: msgs=%v bytes=%v", n, bytes)
+	}
+}
+
+func TestMSBudgetReleased(t *testing.T) {
+	ms := createBudgetedMemStore(t, 100, "")
+	defer ms.Close()
+
+	storeMsgs(t, ms, "foo", 5, 10)
+	storeMsgs(t, ms, "bar", 3, 10)
+	storeMsgs(t, ms, "baz", 2, 10)
+	// Purged and deleted channels release their bytes.
+	if err := ms.LookupChannel("foo").Msgs.Purge(); err != nil {
+		t.Fatalf("Unexpected error on purge: %v", err)
+	}
+	if err := ms.DeleteChannel("bar"); err != nil {
+		t.Fatalf("Unexpected error on delete: %v", err)
+	}
+	storeMsgs(t, ms, "baz", 8, 10)
+	checkChannelMsgs(t, ms, "baz", 1, 10)
+
+	// Messages stored with StoreMsg are accounted for too.
+	cs := ms.LookupChannel("baz")
+	if _, err := cs.Msgs.StoreMsg(&spb.MsgProto{Data: make([]byte, 10)}); err != nil {
+		t.Fatalf("Unexpected error on store: %v", err)
+	}
+	checkChannelMsgs(t, ms, "baz", 2, 11)
+}
+
+func TestMSBudgetInvalidPolicy(t *testing.T) {
+	if _, err := NewMemoryStore(nil, MemoryBudget(100, "random")); err == nil {
+		t.Fatal("Expected error for an unsupported eviction policy")
+	}
+}
@@ -3,14 +3,15 @@
 package stores
 
 import (
-	"time"
+	"sync/atomic"
 
-	"github.com/nats-io/go-nats-streaming/pb"
+	"github.com/nats-io/nats-streaming-server/spb"
 )
 
 // MemoryStore is a factory for message and subscription stores.
 type MemoryStore struct {
 	genericStore
+	budget *memBudget // nil if the channels only have their limits
 }
 
 // MemorySubStore is a subscription store in memory
@@ -21,6 +22,8 @@ type MemorySubStore struct {
 // MemoryMsgStore is a per channel message store in memory
 type MemoryMsgStore struct {
 	genericMsgStore
+	budget     *memBudget // reference to the one from MemoryStore
+	lastStored uint64     // order of the last message stored among all channels, if budgeted
 }
 
 ////////////////////////////////////////////////////////////////////////////
@@ -30,8 +33,14 @@ type MemoryMsgStore struct {
 // NewMemoryStore returns a factory for stores held in memory.
 // If not limits are provided, the store will be created with
 // DefaultChannelLimits.
-func NewMemoryStore(limits *ChannelLimits) (*MemoryStore, error) {
-	ms := &MemoryStore{}
+func NewMemoryStore(limits *ChannelLimits, options ...MemoryStoreOption) (*MemoryStore, error) {
+	opts := MemoryStoreOptions{}
+	for _, opt := range options {
+		if err := opt(&opts); err != nil {
+			return nil, err
+		}
+	}
+	ms := &MemoryStore{budget: newMemBudget(opts)}
 	ms.init(TypeMemory, limits)
 	return ms, nil
 }
@@ -50,11 +59,14 @@ func (ms *MemoryStore) CreateChannel(channel string, userData interface{}) (*Cha
 		return nil, false, err
 	}
 
-	msgStore := &MemoryMsgStore{}
-	msgStore.init(channel, ms.limits)
+	msgStore := &MemoryMsgStore{budget: ms.budget}
+	msgStore.init(channel, ms.channelLimits(channel), ms.clock)
+	if ms.budget != nil {
+		ms.budget.add(msgStore)
+	}
 
 	subStore := &MemorySubStore{}
-	subStore.init(channel, ms.limits)
+	subStore.init(channel, ms.channelLimits(channel))
 
 	channelStore = &ChannelStore{
 		Subs:     subStore,
@@ -72,42 +84,94 @@ func (ms *MemoryStore) CreateChannel(channel string, userData interface{}) (*Cha
 ////////////////////////////////////////////////////////////////////////////
 
 // Store a given message.
-func (ms *MemoryMsgStore) Store(reply string, data []byte) (*pb.MsgProto, error) {
-	ms.Lock()
-	defer ms.Unlock()
+func (ms *MemoryMsgStore) Store(reply string, data []byte) (*spb.MsgProto, error) {
+	return ms.StoreMsg(&spb.MsgProto{Reply: reply, Data: data})
+}
 
+// StoreMsg stores the given message, assigning its sequence, subject and
+// timestamp.
+func (ms *MemoryMsgStore) StoreMsg(m *spb.MsgProto) (*spb.MsgProto, error) {
+	ms.Lock()
 	if ms.first == 0 {
 		ms.first = 1
 	}
 	ms.last++
-	m := &pb.MsgProto{
-		Sequence:  ms.last,
-		Subject:   ms.subject,
-		Reply:     reply,
-		Data:      data,
-		Timestamp: time.Now().UnixNano(),
-	}
+	m.Sequence = ms.last
+	m.Subject = ms.subject
+	m.Timestamp = ms.clock.Now().UnixNano()
 	ms.msgs[ms.last] = m
+	ms.indexGUID(m)
 	ms.totalCount++
-	ms.totalBytes += uint64(len(data))
+	ms.totalBytes += uint64(len(m.Data))
+	if ms.budget != nil {
+		ms.lastStored = ms.budget.stored(uint64(len(m.Data)))
+	}
 
 	// Check if we need to remove any (but leave at least the last added)
 	for ms.totalCount > ms.limits.MaxNumMsgs ||
 		((ms.totalCount > 1) && (ms.totalBytes > ms.limits.MaxMsgBytes)) {
-		firstMsg := ms.msgs[ms.first]
-		ms.totalBytes -= uint64(len(firstMsg.Data))
-		ms.totalCount--
 		if !ms.hitLimit {
 			ms.hitLimit = true
-			Noticef(droppingMsgsFmt, ms.subject, ms.totalCount, ms.limits.MaxNumMsgs, ms.totalBytes, ms.limits.MaxMsgBytes)
+			Noticef(droppingMsgsFmt, ms.subject, ms.totalCount-1, ms.limits.MaxNumMsgs,
+				ms.totalBytes-uint64(len(ms.msgs[ms.first].Data)), ms.limits.MaxMsgBytes)
 		}
-		delete(ms.msgs, ms.first)
-		ms.first++
+		ms.removeFirst()
 	}
+	ms.Unlock()
 
+	// The budget is enforced once the lock is released, since messages
+	// may be evicted from other channels.
+	if ms.budget != nil {
+		ms.budget.enforce()
+	}
 	return m, nil
 }
 
+// removeFirst removes the first message. Lock held on entry.
+func (ms *MemoryMsgStore) removeFirst() {
+	firstMsg := ms.msgs[ms.first]
+	ms.totalBytes -= uint64(len(firstMsg.Data))
+	ms.totalCount--
+	if ms.budget != nil {
+		atomic.AddInt64(&ms.budget.bytes, -int64(len(firstMsg.Data)))
+	}
+	ms.unindexGUID(firstMsg.Guid, ms.first)
+	delete(ms.msgs, ms.first)
+	ms.first++
+}
+
+// evictFirst removes the first message, if it is not the last one, to
+// enforce the memory budget.
+func (ms *MemoryMsgStore) evictFirst() {
+	ms.Lock()
+	if ms.totalCount > 1 {
+		ms.removeFirst()
+	}
+	ms.Unlock()
+}
+
+// Purge removes all messages from the store.
+func (ms *MemoryMsgStore) Purge() error {
+	ms.Lock()
+	if ms.budget != nil {
+		atomic.AddInt64(&ms.budget.bytes, -int64(ms.totalBytes))
+	}
+	ms.purge()
+	ms.Unlock()
+	return nil
+}
+
+// Close closes the store, releasing its part of the memory budget.
+func (ms *MemoryMsgStore) Close() error {
+	if ms.budget != nil {
+		ms.RLock()
+		bytes := ms.totalBytes
+		ms.RUnlock()
+		ms.budget.remove(ms, bytes)
+	}
+	return nil
+}
+
 ////////////////////////////////////////////////////////////////////////////
 // MemorySubStore methods
 ////////////////////////////////////////////////////////////////////////////
@@ -85,6 +85,20 @@ func TestMSBasicMsgStore(t *testing.T) {
 	testBasicMsgStore(t, ms)
 }
 
+func TestMSLookupRange(t *testing.T) {
+	ms := createDefaultMemStore(t)
+	defer ms.Close()
+
+	testLookupRange(t, ms)
+}
+
+func TestMSStoreMsg(t *testing.T) {
+	ms := createDefaultMemStore(t)
+	defer ms.Close()
+
+	testStoreMsg(t, ms)
+}
+
 func TestMSMsgsState(t *testing.T) {
 	ms := createDefaultMemStore(t)
 	defer ms.Close()
@@ -127,6 +141,13 @@ func TestMSMaxSubs(t *testing.T) {
 	testMaxSubs(t, ms, limitCount)
 }
 
+func TestMSChannelLimitsFunc(t *testing.T) {
+	ms := createDefaultMemStore(t)
+	defer ms.Close()
+
+	testChannelLimitsFunc(t, ms)
+}
+
 func TestMSBasicSubStore(t *testing.T) {
 	ms := createDefaultMemStore(t)
 	defer ms.Close()
@@ -141,6 +162,13 @@ func TestMSGetSeqFromTimestamp(t *testing.T) {
 	testGetSeqFromStartTime(t, ms)
 }
 
+func TestMSGetSeqFromGUID(t *testing.T) {
+	ms := createDefaultMemStore(t)
+	defer ms.Close()
+
+	testGetSeqFromGUID(t, ms)
+}
+
 func TestMSClientAPIs(t *testing.T) {
 	ms := createDefaultMemStore(t)
 	defer ms.Close()
@@ -154,3 +182,17 @@ func TestMSFlush(t *testing.T) {
 
 	testFlush(t, ms)
 }
+
+func TestMSDeleteChannel(t *testing.T) {
+	ms := createDefaultMemStore(t)
+	defer ms.Close()
+
+	testDeleteChannel(t, ms)
+}
+
+func TestMSPurge(t *testing.T) {
+	ms := createDefaultMemStore(t)
+	defer ms.Close()
+
+	testPurge(t, ms)
+}
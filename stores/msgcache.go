@@ -0,0 +1,147 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// CacheStats are the statistics of a message cache.
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Msgs      int    `json:"msgs"`
+	Bytes     uint64 `json:"bytes"`
+	MaxBytes  uint64 `json:"max_bytes"`
+}
+
+// msgCacheKey identifies a message in a msgCache.
+type msgCacheKey struct {
+	owner interface{} // the message store
+	seq   uint64
+}
+
+// msgCacheEntry is an element of the LRU list of a msgCache.
+type msgCacheEntry struct {
+	key msgCacheKey
+	msg *spb.MsgProto
+}
+
+// msgCache is a LRU cache of messages read from disk, shared by the message
+// stores of a store. Its size is the total size of the payloads it holds.
+type msgCache struct {
+	sync.Mutex
+	maxBytes uint64
+	lru      *list.List // most recently used at the front
+	entries  map[msgCacheKey]*list.Element
+	stats    CacheStats
+}
+
+// newMsgCache returns a cache holding up to `maxBytes` bytes of payloads,
+// or nil if maxBytes is 0. A nil cache caches nothing.
+func newMsgCache(maxBytes uint64) *msgCache {
+	if maxBytes == 0 {
+		return nil
+	}
+	return &msgCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[msgCacheKey]*list.Element),
+	}
+}
+
+// get returns the cached message, nil if not cached, and counts the hit or
+// miss.
+func (c *msgCache) get(owner interface{}, seq uint64) *spb.MsgProto {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	e := c.entries[msgCacheKey{owner, seq}]
+	if e == nil {
+		c.stats.Misses++
+		return nil
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*msgCacheEntry).msg
+}
+
+// add caches the message, evicting the least recently used ones to make
+// room for it. Messages bigger than the cache are not cached.
+func (c *msgCache) add(owner interface{}, m *spb.MsgProto) {
+	if c == nil {
+		return
+	}
+	size := uint64(len(m.Data))
+	if size > c.maxBytes {
+		return
+	}
+	key := msgCacheKey{owner, m.Sequence}
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	for c.stats.Bytes+size > c.maxBytes {
+		c.removeElement(c.lru.Back())
+		c.stats.Evictions++
+	}
+	c.entries[key] = c.lru.PushFront(&msgCacheEntry{key: key, msg: m})
+	c.stats.Msgs++
+	c.stats.Bytes += size
+}
+
+// remove removes the message from the cache, if present.
+func (c *msgCache) remove(owner interface{}, seq uint64) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	if e := c.entries[msgCacheKey{owner, seq}]; e != nil {
+		c.removeElement(e)
+	}
+	c.Unlock()
+}
+
+// removeAll removes all the messages of the message store from the cache.
+func (c *msgCache) removeAll(owner interface{}) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*msgCacheEntry).key.owner == owner {
+			c.removeElement(e)
+		}
+		e = next
+	}
+	c.Unlock()
+}
+
+// removeElement removes an element of the LRU list.
+// Lock held on entry.
+func (c *msgCache) removeElement(e *list.Element) {
+	entry := c.lru.Remove(e).(*msgCacheEntry)
+	delete(c.entries, entry.key)
+	c.stats.Msgs--
+	c.stats.Bytes -= uint64(len(entry.msg.Data))
+}
+
+// getStats returns the statistics of the cache.
+func (c *msgCache) getStats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.Lock()
+	stats := c.stats
+	c.Unlock()
+	stats.MaxBytes = c.maxBytes
+	return stats
+}
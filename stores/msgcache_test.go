@@ -0,0 +1,56 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"testing"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+func TestMsgCacheLRU(t *testing.T) {
+	owner := &struct{}{}
+	c := newMsgCache(10)
+	for seq := uint64(1); seq <= 3; seq++ {
+		c.add(owner, &spb.MsgProto{Sequence: seq, Data: []byte("abcd")})
+	}
+	// The first message was evicted to make room for the third one.
+	if m := c.get(owner, 1); m != nil {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+	if m := c.get(owner, 2); m == nil || m.Sequence != 2 {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+	// 2 is now the most recently used, so 3 is evicted.
+	c.add(owner, &spb.MsgProto{Sequence: 4, Data: []byte("abcd")})
+	if m := c.get(owner, 3); m != nil {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+	// Messages bigger than the cache are not cached.
+	c.add(owner, &spb.MsgProto{Sequence: 5, Data: make([]byte, 11)})
+	if m := c.get(owner, 5); m != nil {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+	expected := CacheStats{Hits: 1, Misses: 3, Evictions: 2, Msgs: 2, Bytes: 8, MaxBytes: 10}
+	if stats := c.getStats(); stats != expected {
+		t.Fatalf("Expected stats %+v, got %+v", expected, stats)
+	}
+
+	other := &struct{ a int }{}
+	c.add(other, &spb.MsgProto{Sequence: 2, Data: []byte("a")})
+	c.removeAll(owner)
+	if stats := c.getStats(); stats.Msgs != 1 || stats.Bytes != 1 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+	c.remove(other, 2)
+	if m := c.get(other, 2); m != nil {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+
+	// A nil cache caches nothing.
+	c = newMsgCache(0)
+	c.add(owner, &spb.MsgProto{Sequence: 1})
+	if m := c.get(owner, 1); m != nil {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+}
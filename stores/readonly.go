@@ -0,0 +1,89 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"errors"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// ErrReadOnly is returned by a ReadOnlyStore when asked to store messages,
+// or to create, purge or delete channels.
+var ErrReadOnly = errors.New("store is read-only")
+
+// ReadOnlyStore serves the channels and messages of another store, for
+// instance opened on a backup, without modifying them. Clients and
+// subscriptions are only kept in memory.
+type ReadOnlyStore struct {
+	genericStore
+	store Store
+}
+
+// readOnlyMsgStore is a message store on which writes fail.
+type readOnlyMsgStore struct {
+	MsgStore
+}
+
+// NewReadOnlyStore returns a read-only store serving the channels that the
+// given store has. Subscriptions are limited by the given limits, or by
+// DefaultChannelLimits if nil. Closing the returned store closes the given
+// one.
+func NewReadOnlyStore(s Store, limits *ChannelLimits) *ReadOnlyStore {
+	rs := &ReadOnlyStore{store: s}
+	rs.init(s.Name()+" (read-only)", limits)
+	for name, cs := range s.GetChannels() {
+		subStore := &MemorySubStore{}
+		subStore.init(name, rs.channelLimits(name))
+		rs.channels[name] = &ChannelStore{
+			Subs:     subStore,
+			Msgs:     &readOnlyMsgStore{cs.Msgs},
+			UserData: cs.UserData,
+		}
+	}
+	return rs
+}
+
+// CreateChannel returns the ChannelStore of an existing channel, and
+// ErrReadOnly for others.
+func (rs *ReadOnlyStore) CreateChannel(channel string, userData interface{}) (*ChannelStore, bool, error) {
+	if cs := rs.LookupChannel(channel); cs != nil {
+		return cs, false, nil
+	}
+	return nil, false, ErrReadOnly
+}
+
+// DeleteChannel returns ErrReadOnly.
+func (rs *ReadOnlyStore) DeleteChannel(channel string) error {
+	return ErrReadOnly
+}
+
+// Close closes the store it reads from.
+func (rs *ReadOnlyStore) Close() error {
+	err := rs.genericStore.Close()
+	if lerr := rs.store.Close(); lerr != nil && err == nil {
+		err = lerr
+	}
+	return err
+}
+
+// Store returns ErrReadOnly.
+func (ms *readOnlyMsgStore) Store(reply string, data []byte) (*spb.MsgProto, error) {
+	return nil, ErrReadOnly
+}
+
+// StoreMsg returns ErrReadOnly.
+func (ms *readOnlyMsgStore) StoreMsg(m *spb.MsgProto) (*spb.MsgProto, error) {
+	return nil, ErrReadOnly
+}
+
+// Purge returns ErrReadOnly.
+func (ms *readOnlyMsgStore) Purge() error {
+	return ErrReadOnly
+}
+
+// Close does nothing, the message store is closed with the store it
+// belongs to.
+func (ms *readOnlyMsgStore) Close() error {
+	return nil
+}
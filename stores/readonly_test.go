@@ -0,0 +1,63 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"testing"
+)
+
+func TestReadOnlyStore(t *testing.T) {
+	ms := createDefaultMemStore(t)
+	storeMsg(t, ms, "foo", []byte("hello"))
+	storeMsg(t, ms, "foo", []byte("world"))
+
+	rs := NewReadOnlyStore(ms, &testDefaultChannelLimits)
+	defer rs.Close()
+	if name := rs.Name(); name != TypeMemory+" (read-only)" {
+		t.Fatalf("Unexpected name: %v", name)
+	}
+
+	cs := rs.LookupChannel("foo")
+	if cs == nil {
+		t.Fatal("Channel foo should exist")
+	}
+	if m := cs.Msgs.Lookup(2); m == nil || string(m.Data) != "world" {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+	if n, _, _ := rs.MsgsState(AllChannels); n != 2 {
+		t.Fatalf("Expected 2 messages, got %v", n)
+	}
+	if ecs, isNew, err := rs.CreateChannel("foo", nil); ecs != cs || isNew || err != nil {
+		t.Fatalf("Unexpected result: %v %v %v", ecs, isNew, err)
+	}
+
+	// Nothing can be written.
+	if _, err := cs.Msgs.Store("", []byte("new")); err != ErrReadOnly {
+		t.Fatalf("Expected error %v, got %v", ErrReadOnly, err)
+	}
+	if err := cs.Msgs.Purge(); err != ErrReadOnly {
+		t.Fatalf("Expected error %v, got %v", ErrReadOnly, err)
+	}
+	if _, _, err := rs.CreateChannel("bar", nil); err != ErrReadOnly {
+		t.Fatalf("Expected error %v, got %v", ErrReadOnly, err)
+	}
+	if err := rs.DeleteChannel("foo"); err != ErrReadOnly {
+		t.Fatalf("Expected error %v, got %v", ErrReadOnly, err)
+	}
+
+	// Subscriptions and clients are kept in memory only.
+	storeSub(t, rs, "foo")
+	if ms.LookupChannel("foo").Subs.(*MemorySubStore).subsCount != 0 {
+		t.Fatal("Subscription should not be added to the store read from")
+	}
+	testClientAPIs(t, rs)
+	if ms.GetClientsCount() != 0 {
+		t.Fatal("Clients should not be added to the store read from")
+	}
+
+	// Closing the read-only store closes the other.
+	rs.Close()
+	if !ms.closed {
+		t.Fatal("Store read from should be closed")
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// StoreConfig is what a StoreFactory gets to create a store.
+type StoreConfig struct {
+	// Dir is the root directory of the store, if the server was given one.
+	Dir string
+
+	// Limits are the channel limits. If nil, DefaultChannelLimits are used.
+	Limits *ChannelLimits
+
+	// Params are the store specific parameters, such as the address of a
+	// database or the name of a bucket.
+	Params map[string]string
+}
+
+// StoreFactory creates a store of a registered type. As for the FILE store,
+// the returned state is nil when there was nothing to recover.
+type StoreFactory func(config StoreConfig) (Store, *RecoveredState, error)
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[string]StoreFactory)
+)
+
+// builtinTypes are the types of the stores of this package, that can't be
+// registered.
+var builtinTypes = []string{TypeMemory, TypeFile, TypeSQL, TypeHybrid, TypeKV}
+
+// Register makes a store type available to servers, which select it with
+// Options.StoreType. The name is not case sensitive. Like database/sql
+// drivers, stores are meant to be registered from the init function of
+// their package, so Register panics if the name is empty, is the name of
+// a built-in store or is already registered, or if the factory is nil.
+func Register(name string, factory StoreFactory) {
+	name = strings.ToUpper(name)
+	if name == "" || factory == nil {
+		panic("stores: Register with an empty name or a nil factory")
+	}
+	for _, t := range builtinTypes {
+		if name == t {
+			panic(fmt.Sprintf("stores: can't register built-in store type %v", name))
+		}
+	}
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, dup := registry[name]; dup {
+		panic(fmt.Sprintf("stores: Register called twice for store type %v", name))
+	}
+	registry[name] = factory
+}
+
+// LookupFactory returns the factory registered for the store type, or nil
+// if there is none.
+func LookupFactory(name string) StoreFactory {
+	registryLock.RLock()
+	f := registry[strings.ToUpper(name)]
+	registryLock.RUnlock()
+	return f
+}
+
+// RegisteredTypes returns the sorted names of the registered store types.
+func RegisteredTypes() []string {
+	registryLock.RLock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	registryLock.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// unregister removes a registered store type. Used by tests.
+func unregister(name string) {
+	registryLock.Lock()
+	delete(registry, strings.ToUpper(name))
+	registryLock.Unlock()
+}
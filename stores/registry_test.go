@@ -0,0 +1,46 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"reflect"
+	"testing"
+)
+
+func memoryStoreFactory(config StoreConfig) (Store, *RecoveredState, error) {
+	ms, err := NewMemoryStore(config.Limits)
+	return ms, nil, err
+}
+
+func TestRegister(t *testing.T) {
+	Register("test_mem", memoryStoreFactory)
+	defer unregister("test_mem")
+
+	if f := LookupFactory("TEST_MEM"); f == nil {
+		t.Fatal("Expected registered factory")
+	}
+	if f := LookupFactory("unknown"); f != nil {
+		t.Fatal("Unexpected factory")
+	}
+	if types := RegisteredTypes(); !reflect.DeepEqual(types, []string{"TEST_MEM"}) {
+		t.Fatalf("Unexpected registered types: %v", types)
+	}
+	s, _, err := LookupFactory("test_mem")(StoreConfig{Limits: &testDefaultChannelLimits})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	s.Close()
+
+	checkPanic := func(name string, factory StoreFactory) {
+		defer func() {
+			if r := recover(); r == nil {
+				stackFatalf(t, "Expected Register(%q) to panic", name)
+			}
+		}()
+		Register(name, factory)
+	}
+	checkPanic("Test_Mem", memoryStoreFactory)
+	checkPanic("file", memoryStoreFactory)
+	checkPanic("", memoryStoreFactory)
+	checkPanic("other", nil)
+}
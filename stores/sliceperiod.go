@@ -0,0 +1,69 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/util"
+)
+
+// Calendar periods after which the channels of a SlicePeriod move to a new
+// message file.
+const (
+	SliceDaily   = "day"
+	SliceWeekly  = "week"
+	SliceMonthly = "month"
+	SliceYearly  = "year"
+)
+
+// SlicePeriod splits the message files of the matching channels by calendar
+// period (in UTC), so that a channel keeping years of messages is stored in
+// one file per period. The channel still has a single sequence space, and
+// the files whose messages have all been removed by the limits are deleted.
+type SlicePeriod struct {
+	Channels string // Channels the period applies to (a subject, possibly with wildcards)
+	Period   string // Period covered by a message file: day, week, month or year
+}
+
+// validate checks that the channels and the period are valid.
+func (sp *SlicePeriod) validate() error {
+	if !util.IsValidSubjectPattern(sp.Channels) {
+		return fmt.Errorf("invalid slice period channels %q", sp.Channels)
+	}
+	switch strings.ToLower(sp.Period) {
+	case SliceDaily, SliceWeekly, SliceMonthly, SliceYearly:
+	default:
+		return fmt.Errorf("invalid slice period %q for channels %q", sp.Period, sp.Channels)
+	}
+	return nil
+}
+
+// slicePeriodFor returns the period of the first SlicePeriod matching the
+// channel, or the empty string if none does.
+func slicePeriodFor(periods []*SlicePeriod, channel string) string {
+	for _, sp := range periods {
+		if util.SubjectMatches(sp.Channels, channel) {
+			return strings.ToLower(sp.Period)
+		}
+	}
+	return ""
+}
+
+// periodStart returns the start, in UTC, of the period containing the
+// given time, expressed in nanoseconds. Weeks start on Mondays.
+func periodStart(period string, nanos int64) int64 {
+	t := time.Unix(0, nanos).UTC()
+	y, m, d := t.Date()
+	switch period {
+	case SliceWeekly:
+		d -= (int(t.Weekday()) + 6) % 7
+	case SliceMonthly:
+		d = 1
+	case SliceYearly:
+		m, d = time.January, 1
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC).UnixNano()
+}
@@ -0,0 +1,781 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// Known SQL drivers. The driver itself is not imported by this package,
+// the application must import it so that it registers with database/sql
+// (the nats-streaming-server command imports both).
+// Drivers other than Postgres are expected to use `?` placeholders.
+const (
+	SQLDriverPostgres = "postgres"
+	SQLDriverMySQL    = "mysql"
+)
+
+// SQLMaxClientIDLen is the maximum length of the client IDs that the SQL
+// store accepts. The ID is the primary key of the clients table, and must
+// fit in the 3072 bytes of an InnoDB key with 4 bytes characters.
+const SQLMaxClientIDLen = 512
+
+// Tables used by the SQL store. Messages and subscriptions are stored as
+// protobufs, keyed by the channel's ID. The BLOB type is replaced with the
+// one of the driver that can hold the largest messages. The ordering groups,
+// whose number is bounded by the server, are not indexed so that their names
+// have no length limit.
+var sqlCreateTables = []string{
+	"CREATE TABLE IF NOT EXISTS ServerInfo (uniquerow INTEGER PRIMARY KEY, id VARCHAR(1024), proto BLOB)",
+	fmt.Sprintf("CREATE TABLE IF NOT EXISTS Clients (id VARCHAR(%d) PRIMARY KEY, hbinbox TEXT)", SQLMaxClientIDLen),
+	"CREATE TABLE IF NOT EXISTS Channels (id INTEGER PRIMARY KEY, name VARCHAR(1024))",
+	"CREATE TABLE IF NOT EXISTS Messages (id INTEGER, seq BIGINT, proto BLOB, PRIMARY KEY (id, seq))",
+	"CREATE TABLE IF NOT EXISTS Subscriptions (id INTEGER, subid BIGINT, proto BLOB, PRIMARY KEY (id, subid))",
+	"CREATE TABLE IF NOT EXISTS SubsPending (id INTEGER, subid BIGINT, seq BIGINT, PRIMARY KEY (id, subid, seq))",
+	"CREATE TABLE IF NOT EXISTS OrderingGroups (name TEXT, seq BIGINT)",
+}
+
+// Indexes of the statements used by the SQL store.
+const (
+	sqlDeleteServerInfo = iota
+	sqlAddServerInfo
+	sqlGetServerInfo
+	sqlAddClient
+	sqlDeleteClient
+	sqlGetClients
+	sqlAddChannel
+	sqlGetChannels
+	sqlStoreMsg
+	sqlDeleteMsgsBefore
+	sqlGetMsgs
+	sqlCreateSub
+	sqlUpdateSub
+	sqlDeleteSub
+	sqlDeleteSubPending
+	sqlAddSubPending
+	sqlAckSubPending
+	sqlGetSubs
+	sqlGetSubsPending
+	sqlDeleteChannel
+	sqlDeleteChannelMsgs
+	sqlDeleteChannelSubs
+	sqlDeleteChannelSubsPending
+	sqlDeleteOrderingGroup
+	sqlAddOrderingGroup
+	sqlGetOrderingGroups
+)
+
+var sqlStmts = []string{
+	"DELETE FROM ServerInfo",
+	"INSERT INTO ServerInfo (uniquerow, id, proto) VALUES (1, ?, ?)",
+	"SELECT proto FROM ServerInfo WHERE uniquerow = 1",
+	"INSERT INTO Clients (id, hbinbox) VALUES (?, ?)",
+	"DELETE FROM Clients WHERE id = ?",
+	"SELECT id, hbinbox FROM Clients",
+	"INSERT INTO Channels (id, name) VALUES (?, ?)",
+	"SELECT id, name FROM Channels",
+	"INSERT INTO Messages (id, seq, proto) VALUES (?, ?, ?)",
+	"DELETE FROM Messages WHERE id = ? AND seq < ?",
+	"SELECT proto FROM Messages WHERE id = ? ORDER BY seq",
+	"INSERT INTO Subscriptions (id, subid, proto) VALUES (?, ?, ?)",
+	"UPDATE Subscriptions SET proto = ? WHERE id = ? AND subid = ?",
+	"DELETE FROM Subscriptions WHERE id = ? AND subid = ?",
+	"DELETE FROM SubsPending WHERE id = ? AND subid = ?",
+	"INSERT INTO SubsPending (id, subid, seq) VALUES (?, ?, ?)",
+	"DELETE FROM SubsPending WHERE id = ? AND subid = ? AND seq = ?",
+	"SELECT subid, proto FROM Subscriptions WHERE id = ?",
+	"SELECT subid, seq FROM SubsPending WHERE id = ?",
+	"DELETE FROM Channels WHERE id = ?",
+	"DELETE FROM Messages WHERE id = ?",
+	"DELETE FROM Subscriptions WHERE id = ?",
+	"DELETE FROM SubsPending WHERE id = ?",
+	"DELETE FROM OrderingGroups WHERE name = ?",
+	"INSERT INTO OrderingGroups (name, seq) VALUES (?, ?)",
+	"SELECT name, seq FROM OrderingGroups",
+}
+
+// SQLStore is a factory for message and subscription stores backed by
+// a SQL database. Messages are kept in memory too, so that lookups do not
+// hit the database, and every change is written through to the database.
+type SQLStore struct {
+	genericStore
+	db           *sql.DB
+	stmts        []*sql.Stmt
+	maxChannelID int64
+}
+
+// SQLSubStore is a subscription store backed by a SQL database.
+type SQLSubStore struct {
+	genericSubStore
+	channelID int64
+	stmts     []*sql.Stmt
+}
+
+// SQLMsgStore is a per channel message store backed by a SQL database.
+type SQLMsgStore struct {
+	genericMsgStore
+	channelID int64
+	stmts     []*sql.Stmt
+}
+
+////////////////////////////////////////////////////////////////////////////
+// SQLStore methods
+////////////////////////////////////////////////////////////////////////////
+
+// sqlDialect adapts a statement to the given driver: MySQL uses LONGBLOB
+// instead of BLOB, which is limited to 64KB, and Postgres uses numbered
+// placeholders and BYTEA instead of BLOB.
+func sqlDialect(driver, stmt string) string {
+	switch driver {
+	case SQLDriverMySQL:
+		return strings.Replace(stmt, "BLOB", "LONGBLOB", -1)
+	case SQLDriverPostgres:
+		stmt = strings.Replace(stmt, "BLOB", "BYTEA", -1)
+	default:
+		return stmt
+	}
+	var b []byte
+	n := 0
+	for i := 0; i < len(stmt); i++ {
+		if stmt[i] == '?' {
+			n++
+			b = append(b, fmt.Sprintf("$%d", n)...)
+		} else {
+			b = append(b, stmt[i])
+		}
+	}
+	return string(b)
+}
+
+// NewSQLStore returns a factory for stores backed by the SQL database
+// identified by the driver name and data source, and recovers any state
+// present. The tables are created if they don't exist.
+// If not limits are provided, the store will be created with
+// DefaultChannelLimits.
+func NewSQLStore(driver, source string, limits *ChannelLimits) (*SQLStore, *RecoveredState, error) {
+	db, err := sql.Open(driver, source)
+	if err != nil {
+		return nil, nil, err
+	}
+	ss := &SQLStore{db: db}
+	ss.init(TypeSQL, limits)
+
+	var (
+		serverInfo    *spb.ServerInfo
+		recoveredSubs = make(RecoveredSubscriptions)
+		clients       []*Client
+		groups        map[string]uint64
+	)
+	// Ensure store is closed in case of return with error
+	defer func() {
+		if err != nil {
+			ss.Close()
+		}
+	}()
+	if err = db.Ping(); err != nil {
+		return nil, nil, err
+	}
+	for _, stmt := range sqlCreateTables {
+		if _, err = db.Exec(sqlDialect(driver, stmt)); err != nil {
+			return nil, nil, fmt.Errorf("unable to create table: %v", err)
+		}
+	}
+	ss.stmts = make([]*sql.Stmt, len(sqlStmts))
+	for i, stmt := range sqlStmts {
+		if ss.stmts[i], err = db.Prepare(sqlDialect(driver, stmt)); err != nil {
+			return nil, nil, fmt.Errorf("unable to prepare statement %q: %v", stmt, err)
+		}
+	}
+	serverInfo, err = ss.recoverServerInfo()
+	if err != nil {
+		return nil, nil, err
+	}
+	// If there is no server info, then we are done
+	if serverInfo == nil {
+		return ss, nil, nil
+	}
+	if clients, err = ss.recoverClients(); err != nil {
+		return nil, nil, err
+	}
+	if groups, err = ss.recoverOrderingGroups(); err != nil {
+		return nil, nil, err
+	}
+	if err = ss.recoverChannels(recoveredSubs); err != nil {
+		return nil, nil, err
+	}
+	return ss, &RecoveredState{Info: serverInfo, Clients: clients, Subs: recoveredSubs, OrderingGroups: groups}, nil
+}
+
+// sqlTablesQuery returns the query counting the ServerInfo tables of the
+// current database for the drivers with an information schema, an empty
+// string for the others.
+func sqlTablesQuery(driver string) string {
+	var schema string
+	switch driver {
+	case SQLDriverPostgres:
+		schema = "current_schema()"
+	case SQLDriverMySQL:
+		schema = "DATABASE()"
+	default:
+		return ""
+	}
+	return fmt.Sprintf("SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = %s AND LOWER(table_name) = 'serverinfo'", schema)
+}
+
+// ReadSQLStoreState reads the server info and the clients of the SQL store
+// in the database identified by the driver name and data source, with plain
+// queries that neither create tables nor modify rows, for instance to check
+// a database before starting a server on it. With drivers other than
+// Postgres and MySQL, the tables are expected to exist. Subscriptions and
+// messages are not read: the Subs map of the returned state only has the
+// names of the channels.
+// The returned state is nil if the store has not been initialized.
+func ReadSQLStoreState(driver, source string) (*RecoveredState, error) {
+	db, err := sql.Open(driver, source)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+	if query := sqlTablesQuery(driver); query != "" {
+		var tables int
+		if err := db.QueryRow(query).Scan(&tables); err != nil {
+			return nil, err
+		}
+		if tables == 0 {
+			return nil, nil
+		}
+	}
+	var data []byte
+	err = db.QueryRow(sqlDialect(driver, sqlStmts[sqlGetServerInfo])).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	info := &spb.ServerInfo{}
+	if err := info.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	state := &RecoveredState{Info: info, Subs: make(RecoveredSubscriptions)}
+	rows, err := db.Query(sqlDialect(driver, sqlStmts[sqlGetClients]))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		c := &Client{}
+		if err := rows.Scan(&c.ID, &c.HbInbox); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		state.Clients = append(state.Clients, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows, err = db.Query(sqlDialect(driver, sqlStmts[sqlGetChannels]))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id   int64
+			name string
+		)
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		state.Subs[name] = nil
+	}
+	return state, rows.Err()
+}
+
+// recoverServerInfo returns the stored server info, nil if none.
+func (ss *SQLStore) recoverServerInfo() (*spb.ServerInfo, error) {
+	var data []byte
+	err := ss.stmts[sqlGetServerInfo].QueryRow().Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	info := &spb.ServerInfo{}
+	if err := info.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// recoverClients returns the stored clients.
+func (ss *SQLStore) recoverClients() ([]*Client, error) {
+	rows, err := ss.stmts[sqlGetClients].Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var clients []*Client
+	for rows.Next() {
+		c := &Client{}
+		if err := rows.Scan(&c.ID, &c.HbInbox); err != nil {
+			return nil, err
+		}
+		ss.clients[c.ID] = c
+		clients = append(clients, c)
+	}
+	return clients, rows.Err()
+}
+
+// recoverOrderingGroups returns the last sequences of the ordering groups.
+func (ss *SQLStore) recoverOrderingGroups() (map[string]uint64, error) {
+	rows, err := ss.stmts[sqlGetOrderingGroups].Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	groups := make(map[string]uint64)
+	for rows.Next() {
+		var name string
+		var seq uint64
+		if err := rows.Scan(&name, &seq); err != nil {
+			return nil, err
+		}
+		groups[name] = seq
+	}
+	return groups, rows.Err()
+}
+
+// recoverChannels recreates the channels with their messages and
+// subscriptions.
+func (ss *SQLStore) recoverChannels(recoveredSubs RecoveredSubscriptions) error {
+	rows, err := ss.stmts[sqlGetChannels].Query()
+	if err != nil {
+		return err
+	}
+	type channel struct {
+		id   int64
+		name string
+	}
+	var channels []channel
+	for rows.Next() {
+		c := channel{}
+		if err := rows.Scan(&c.id, &c.name); err != nil {
+			rows.Close()
+			return err
+		}
+		channels = append(channels, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, c := range channels {
+		if c.id > ss.maxChannelID {
+			ss.maxChannelID = c.id
+		}
+		msgStore := ss.newSQLMsgStore(c.id, c.name)
+		if err := msgStore.recover(); err != nil {
+			return err
+		}
+		subStore := ss.newSQLSubStore(c.id, c.name)
+		rssArray, err := subStore.recover(msgStore)
+		if err != nil {
+			return err
+		}
+		recoveredSubs[c.name] = rssArray
+		ss.channels[c.name] = &ChannelStore{
+			Subs: subStore,
+			Msgs: msgStore,
+		}
+	}
+	return nil
+}
+
+// Init is used to persist server's information after the first start
+func (ss *SQLStore) Init(info *spb.ServerInfo) error {
+	data, err := info.Marshal()
+	if err != nil {
+		return err
+	}
+	ss.Lock()
+	defer ss.Unlock()
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(ss.stmts[sqlDeleteServerInfo]).Exec(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Stmt(ss.stmts[sqlAddServerInfo]).Exec(info.ClusterID, data); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetOrderingGroups records the last sequences of the ordering groups.
+func (ss *SQLStore) SetOrderingGroups(groups map[string]uint64) error {
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return err
+	}
+	for name, seq := range groups {
+		if _, err := tx.Stmt(ss.stmts[sqlDeleteOrderingGroup]).Exec(name); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Stmt(ss.stmts[sqlAddOrderingGroup]).Exec(name, seq); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// CreateChannel creates a ChannelStore for the given channel, and returns
+// `true` to indicate that the channel is new, false if it already exists.
+func (ss *SQLStore) CreateChannel(channel string, userData interface{}) (*ChannelStore, bool, error) {
+	ss.Lock()
+	defer ss.Unlock()
+	channelStore := ss.channels[channel]
+	if channelStore != nil {
+		return channelStore, false, nil
+	}
+
+	// Check for limits
+	if err := ss.canAddChannel(); err != nil {
+		return nil, false, err
+	}
+
+	channelID := ss.maxChannelID + 1
+	if _, err := ss.stmts[sqlAddChannel].Exec(channelID, channel); err != nil {
+		return nil, false, err
+	}
+	ss.maxChannelID = channelID
+
+	channelStore = &ChannelStore{
+		Subs:     ss.newSQLSubStore(channelID, channel),
+		Msgs:     ss.newSQLMsgStore(channelID, channel),
+		UserData: userData,
+	}
+
+	ss.channels[channel] = channelStore
+
+	return channelStore, true, nil
+}
+
+// DeleteChannel closes the channel and deletes its rows from the database.
+func (ss *SQLStore) DeleteChannel(channel string) error {
+	ss.Lock()
+	defer ss.Unlock()
+	cs, err := ss.deleteChannel(channel)
+	if cs == nil {
+		return err
+	}
+	channelID := cs.Msgs.(*SQLMsgStore).channelID
+	tx, lerr := ss.db.Begin()
+	if lerr != nil {
+		return lerr
+	}
+	for _, stmt := range []int{sqlDeleteChannel, sqlDeleteChannelMsgs, sqlDeleteChannelSubs, sqlDeleteChannelSubsPending} {
+		if _, lerr := tx.Stmt(ss.stmts[stmt]).Exec(channelID); lerr != nil {
+			tx.Rollback()
+			return lerr
+		}
+	}
+	if lerr := tx.Commit(); lerr != nil {
+		return lerr
+	}
+	return err
+}
+
+// AddClient stores information about the client identified by `clientID`.
+func (ss *SQLStore) AddClient(clientID, hbInbox string, userData interface{}) (*Client, bool, error) {
+	if len(clientID) > SQLMaxClientIDLen {
+		return nil, false, fmt.Errorf("client ID can't be longer than %v characters", SQLMaxClientIDLen)
+	}
+	sc, isNew, err := ss.genericStore.AddClient(clientID, hbInbox, userData)
+	if err != nil {
+		return nil, false, err
+	}
+	if !isNew {
+		return sc, false, nil
+	}
+	if _, err := ss.stmts[sqlAddClient].Exec(clientID, hbInbox); err != nil {
+		ss.genericStore.DeleteClient(clientID)
+		return nil, false, err
+	}
+	return sc, true, nil
+}
+
+// DeleteClient invalidates the client identified by `clientID`.
+func (ss *SQLStore) DeleteClient(clientID string) *Client {
+	sc := ss.genericStore.DeleteClient(clientID)
+	if sc != nil {
+		if _, err := ss.stmts[sqlDeleteClient].Exec(clientID); err != nil {
+			Noticef("WARNING: Unable to delete client %q from the database: %v", clientID, err)
+		}
+	}
+	return sc
+}
+
+// Close closes all stores and the connection to the database.
+func (ss *SQLStore) Close() error {
+	ss.Lock()
+	defer ss.Unlock()
+	if ss.closed {
+		return nil
+	}
+	ss.closed = true
+	err := ss.close()
+	for _, stmt := range ss.stmts {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	if lerr := ss.db.Close(); lerr != nil && err == nil {
+		err = lerr
+	}
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////
+// SQLMsgStore methods
+////////////////////////////////////////////////////////////////////////////
+
+// newSQLMsgStore returns a message store for the given channel.
+// Store lock is held on entry.
+func (ss *SQLStore) newSQLMsgStore(channelID int64, channel string) *SQLMsgStore {
+	ms := &SQLMsgStore{channelID: channelID, stmts: ss.stmts}
+	ms.init(channel, ss.channelLimits(channel), ss.clock)
+	return ms
+}
+
+// recover loads the channel's messages from the database.
+func (ms *SQLMsgStore) recover() error {
+	rows, err := ms.stmts[sqlGetMsgs].Query(ms.channelID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+		m := &spb.MsgProto{}
+		if err := m.Unmarshal(data); err != nil {
+			return err
+		}
+		if ms.first == 0 {
+			ms.first = m.Sequence
+		}
+		ms.last = m.Sequence
+		ms.msgs[m.Sequence] = m
+		ms.indexGUID(m)
+		ms.totalCount++
+		ms.totalBytes += uint64(len(m.Data))
+	}
+	return rows.Err()
+}
+
+// Store a given message.
+func (ms *SQLMsgStore) Store(reply string, data []byte) (*spb.MsgProto, error) {
+	return ms.StoreMsg(&spb.MsgProto{Reply: reply, Data: data})
+}
+
+// StoreMsg stores the given message, assigning its sequence, subject and
+// timestamp.
+func (ms *SQLMsgStore) StoreMsg(m *spb.MsgProto) (*spb.MsgProto, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	seq := ms.last + 1
+	m.Sequence = seq
+	m.Subject = ms.subject
+	m.Timestamp = ms.clock.Now().UnixNano()
+	b, err := m.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ms.stmts[sqlStoreMsg].Exec(ms.channelID, seq, b); err != nil {
+		return nil, err
+	}
+	if ms.first == 0 {
+		ms.first = 1
+	}
+	ms.last = seq
+	ms.msgs[seq] = m
+	ms.indexGUID(m)
+	ms.totalCount++
+	ms.totalBytes += uint64(len(m.Data))
+
+	// Check if we need to remove any (but leave at least the last added)
+	first := ms.first
+	for ms.totalCount > ms.limits.MaxNumMsgs ||
+		((ms.totalCount > 1) && (ms.totalBytes > ms.limits.MaxMsgBytes)) {
+		firstMsg := ms.msgs[ms.first]
+		ms.totalBytes -= uint64(len(firstMsg.Data))
+		ms.totalCount--
+		if !ms.hitLimit {
+			ms.hitLimit = true
+			Noticef(droppingMsgsFmt, ms.subject, ms.totalCount, ms.limits.MaxNumMsgs, ms.totalBytes, ms.limits.MaxMsgBytes)
+		}
+		ms.unindexGUID(firstMsg.Guid, ms.first)
+		delete(ms.msgs, ms.first)
+		ms.first++
+	}
+	if ms.first != first {
+		if _, err := ms.stmts[sqlDeleteMsgsBefore].Exec(ms.channelID, ms.first); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// Purge removes all messages from the store and the database.
+func (ms *SQLMsgStore) Purge() error {
+	ms.Lock()
+	defer ms.Unlock()
+	if _, err := ms.stmts[sqlDeleteMsgsBefore].Exec(ms.channelID, ms.last+1); err != nil {
+		return err
+	}
+	ms.purge()
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////
+// SQLSubStore methods
+////////////////////////////////////////////////////////////////////////////
+
+// newSQLSubStore returns a subscription store for the given channel.
+// Store lock is held on entry.
+func (ss *SQLStore) newSQLSubStore(channelID int64, channel string) *SQLSubStore {
+	subStore := &SQLSubStore{channelID: channelID, stmts: ss.stmts}
+	subStore.init(channel, ss.channelLimits(channel))
+	return subStore
+}
+
+// recover loads the channel's subscriptions, and their pending messages,
+// from the database.
+func (ss *SQLSubStore) recover(msgStore *SQLMsgStore) ([]*RecoveredSubState, error) {
+	rows, err := ss.stmts[sqlGetSubs].Query(ss.channelID)
+	if err != nil {
+		return nil, err
+	}
+	subs := make(map[uint64]*RecoveredSubState)
+	for rows.Next() {
+		var (
+			subid uint64
+			data  []byte
+		)
+		if err := rows.Scan(&subid, &data); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		sub := &spb.SubState{}
+		if err := sub.Unmarshal(data); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		subs[subid] = &RecoveredSubState{Sub: sub, Pending: make(PendingAcks)}
+		if subid > ss.maxSubID {
+			ss.maxSubID = subid
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	ss.subsCount = len(subs)
+
+	rows, err = ss.stmts[sqlGetSubsPending].Query(ss.channelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var subid, seq uint64
+		if err := rows.Scan(&subid, &seq); err != nil {
+			return nil, err
+		}
+		if rss := subs[subid]; rss != nil {
+			if m := msgStore.msgs[seq]; m != nil {
+				rss.Pending[seq] = m
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rssArray := make([]*RecoveredSubState, 0, len(subs))
+	for _, rss := range subs {
+		rssArray = append(rssArray, rss)
+	}
+	return rssArray, nil
+}
+
+// CreateSub records a new subscription represented by SubState. On success,
+// it returns an id that is used by the other methods.
+func (ss *SQLSubStore) CreateSub(sub *spb.SubState) error {
+	ss.Lock()
+	defer ss.Unlock()
+	if err := ss.createSub(sub); err != nil {
+		return err
+	}
+	data, err := sub.Marshal()
+	if err == nil {
+		_, err = ss.stmts[sqlCreateSub].Exec(ss.channelID, sub.ID, data)
+	}
+	if err != nil {
+		ss.subsCount--
+		return err
+	}
+	return nil
+}
+
+// UpdateSub updates a given subscription represented by SubState.
+func (ss *SQLSubStore) UpdateSub(sub *spb.SubState) error {
+	data, err := sub.Marshal()
+	if err != nil {
+		return err
+	}
+	ss.Lock()
+	defer ss.Unlock()
+	_, err = ss.stmts[sqlUpdateSub].Exec(data, ss.channelID, sub.ID)
+	return err
+}
+
+// DeleteSub invalidates this subscription.
+func (ss *SQLSubStore) DeleteSub(subid uint64) {
+	ss.Lock()
+	defer ss.Unlock()
+	ss.subsCount--
+	if _, err := ss.stmts[sqlDeleteSub].Exec(ss.channelID, subid); err != nil {
+		Noticef("WARNING: Unable to delete subscription %v on %q from the database: %v", subid, ss.subject, err)
+		return
+	}
+	ss.stmts[sqlDeleteSubPending].Exec(ss.channelID, subid)
+}
+
+// AddSeqPending adds the given message seqno to the given subscription.
+func (ss *SQLSubStore) AddSeqPending(subid, seqno uint64) error {
+	_, err := ss.stmts[sqlAddSubPending].Exec(ss.channelID, subid, seqno)
+	return err
+}
+
+// AckSeqPending records that the given message seqno has been acknowledged
+// by the given subscription.
+func (ss *SQLSubStore) AckSeqPending(subid, seqno uint64) error {
+	_, err := ss.stmts[sqlAckSubPending].Exec(ss.channelID, subid, seqno)
+	return err
+}
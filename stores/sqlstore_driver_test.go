@@ -0,0 +1,102 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"bytes"
+	"database/sql"
+	"os"
+	"strings"
+	"testing"
+)
+
+// The SQL store is also tested against a real database, if one is given
+// with the STAN_SQL_DRIVER and STAN_SQL_SOURCE environment variables. The
+// driver is imported by the test files built with the `mysql` or `postgres`
+// tag, for instance:
+//
+//   STAN_SQL_DRIVER=mysql STAN_SQL_SOURCE="stan:pwd@/stan_test" go test -tags mysql -run TestSQLDriver ./stores
+//
+// The tables of the store are dropped before each test, so the database
+// must be dedicated to the tests.
+
+// sqlTestDriver returns the driver and data source of the test database,
+// and skips the test if there is none.
+func sqlTestDriver(t *testing.T) (string, string) {
+	driver, source := os.Getenv("STAN_SQL_DRIVER"), os.Getenv("STAN_SQL_SOURCE")
+	if driver == "" || source == "" {
+		t.Skip("STAN_SQL_DRIVER and STAN_SQL_SOURCE not set")
+	}
+	return driver, source
+}
+
+// newSQLTestDriverStore drops the tables of the test database and returns
+// a store created on it.
+func newSQLTestDriverStore(t *testing.T, driver, source string, limits *ChannelLimits) *SQLStore {
+	db, err := sql.Open(driver, source)
+	if err != nil {
+		stackFatalf(t, "Unable to open the database: %v", err)
+	}
+	defer db.Close()
+	for _, table := range []string{"ServerInfo", "Clients", "Channels", "Messages", "Subscriptions", "SubsPending"} {
+		if _, err := db.Exec("DROP TABLE IF EXISTS " + table); err != nil {
+			stackFatalf(t, "Unable to drop table %v: %v", table, err)
+		}
+	}
+	ss, state, err := NewSQLStore(driver, source, limits)
+	if err != nil {
+		stackFatalf(t, "Unable to create a SQLStore instance: %v", err)
+	}
+	if state != nil {
+		stackFatalf(t, "Expected no recovered state, got %v", state)
+	}
+	return ss
+}
+
+func TestSQLDriverStoreAPIs(t *testing.T) {
+	driver, source := sqlTestDriver(t)
+	for _, f := range sqlStoreAPITests {
+		ss := newSQLTestDriverStore(t, driver, source, &testDefaultChannelLimits)
+		f(t, ss)
+		ss.Close()
+	}
+}
+
+func TestSQLDriverRecovery(t *testing.T) {
+	driver, source := sqlTestDriver(t)
+	ss := newSQLTestDriverStore(t, driver, source, &testDefaultChannelLimits)
+	defer ss.Close()
+	if err := ss.Init(&testDefaultServerInfo); err != nil {
+		t.Fatalf("Unexpected error on init: %v", err)
+	}
+	// The longest client ID must fit in the primary key.
+	clientID := strings.Repeat("c", SQLMaxClientIDLen)
+	if _, _, err := ss.AddClient(clientID, "hbInbox", nil); err != nil {
+		t.Fatalf("Unexpected error adding client: %v", err)
+	}
+	// Messages larger than a MySQL BLOB must be stored.
+	large := bytes.Repeat([]byte("x"), 1024*1024)
+	storeMsg(t, ss, "foo", large)
+	subID := storeSub(t, ss, "foo")
+	storeSubPending(t, ss, "foo", subID, 1)
+	ss.Close()
+
+	ss, state, err := NewSQLStore(driver, source, &testDefaultChannelLimits)
+	if err != nil {
+		t.Fatalf("Unable to open the SQLStore: %v", err)
+	}
+	defer ss.Close()
+	if state == nil || state.Info.ClusterID != testDefaultServerInfo.ClusterID {
+		t.Fatalf("Unexpected recovered state: %v", state)
+	}
+	if len(state.Clients) != 1 || state.Clients[0].ID != clientID {
+		t.Fatalf("Unexpected recovered clients: %v", state.Clients)
+	}
+	if m := ss.LookupChannel("foo").Msgs.Lookup(1); m == nil || !bytes.Equal(m.Data, large) {
+		t.Fatal("Large message was not recovered")
+	}
+	subs := state.Subs["foo"]
+	if len(subs) != 1 || subs[0].Sub.ID != subID || subs[0].Pending[1] == nil {
+		t.Fatalf("Unexpected recovered subscriptions: %v", subs)
+	}
+}
@@ -0,0 +1,9 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+//go:build mysql
+// +build mysql
+
+package stores
+
+// Registers the MySQL driver for the tests run against a real database.
+import _ "github.com/go-sql-driver/mysql"
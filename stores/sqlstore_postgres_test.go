@@ -0,0 +1,9 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+//go:build postgres
+// +build postgres
+
+package stores
+
+// Registers the Postgres driver for the tests run against a real database.
+import _ "github.com/lib/pq"
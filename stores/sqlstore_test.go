@@ -0,0 +1,490 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// The SQL store is tested against a fake driver that keeps the tables
+// in memory and only understands the statements used by the store.
+const testSQLDriver = "stan_sqltest"
+
+func init() {
+	sql.Register(testSQLDriver, &testSQLDrv{dbs: make(map[string]*testSQLDB)})
+}
+
+type testSQLDrv struct {
+	sync.Mutex
+	dbs map[string]*testSQLDB
+}
+
+// testSQLDB holds the content of the tables of a fake database.
+type testSQLDB struct {
+	sync.Mutex
+	serverInfo []byte
+	clients    map[string]string
+	channels   map[int64]string
+	msgs       map[int64]map[int64][]byte
+	subs       map[int64]map[int64][]byte
+	pending    map[int64]map[[2]int64]struct{}
+	groups     map[string]int64
+}
+
+type testSQLConn struct {
+	db *testSQLDB
+}
+
+type testSQLStmt struct {
+	db    *testSQLDB
+	query int // index in sqlStmts, -1 for create table statements
+}
+
+type testSQLRows struct {
+	cols []string
+	rows [][]driver.Value
+}
+
+func (d *testSQLDrv) Open(source string) (driver.Conn, error) {
+	d.Lock()
+	defer d.Unlock()
+	db := d.dbs[source]
+	if db == nil {
+		db = &testSQLDB{
+			clients:  make(map[string]string),
+			channels: make(map[int64]string),
+			msgs:     make(map[int64]map[int64][]byte),
+			subs:     make(map[int64]map[int64][]byte),
+			pending:  make(map[int64]map[[2]int64]struct{}),
+			groups:   make(map[string]int64),
+		}
+		d.dbs[source] = db
+	}
+	return &testSQLConn{db: db}, nil
+}
+
+func (c *testSQLConn) Prepare(query string) (driver.Stmt, error) {
+	if strings.HasPrefix(query, "CREATE TABLE") {
+		return &testSQLStmt{db: c.db, query: -1}, nil
+	}
+	for i, q := range sqlStmts {
+		if q == query {
+			return &testSQLStmt{db: c.db, query: i}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected statement %q", query)
+}
+
+func (c *testSQLConn) Close() error              { return nil }
+func (c *testSQLConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *testSQLConn) Commit() error             { return nil }
+func (c *testSQLConn) Rollback() error           { return nil }
+
+func (s *testSQLStmt) Close() error  { return nil }
+func (s *testSQLStmt) NumInput() int { return -1 }
+
+func (s *testSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := s.db
+	db.Lock()
+	defer db.Unlock()
+	i64 := func(i int) int64 { return args[i].(int64) }
+	switch s.query {
+	case -1:
+	case sqlDeleteServerInfo:
+		db.serverInfo = nil
+	case sqlAddServerInfo:
+		db.serverInfo = args[1].([]byte)
+	case sqlAddClient:
+		db.clients[args[0].(string)] = args[1].(string)
+	case sqlDeleteClient:
+		delete(db.clients, args[0].(string))
+	case sqlAddChannel:
+		db.channels[i64(0)] = args[1].(string)
+		db.msgs[i64(0)] = make(map[int64][]byte)
+		db.subs[i64(0)] = make(map[int64][]byte)
+		db.pending[i64(0)] = make(map[[2]int64]struct{})
+	case sqlStoreMsg:
+		db.msgs[i64(0)][i64(1)] = args[2].([]byte)
+	case sqlDeleteMsgsBefore:
+		for seq := range db.msgs[i64(0)] {
+			if seq < i64(1) {
+				delete(db.msgs[i64(0)], seq)
+			}
+		}
+	case sqlCreateSub:
+		db.subs[i64(0)][i64(1)] = args[2].([]byte)
+	case sqlUpdateSub:
+		if _, ok := db.subs[i64(1)][i64(2)]; ok {
+			db.subs[i64(1)][i64(2)] = args[0].([]byte)
+		}
+	case sqlDeleteSub:
+		delete(db.subs[i64(0)], i64(1))
+	case sqlDeleteSubPending:
+		for k := range db.pending[i64(0)] {
+			if k[0] == i64(1) {
+				delete(db.pending[i64(0)], k)
+			}
+		}
+	case sqlAddSubPending:
+		db.pending[i64(0)][[2]int64{i64(1), i64(2)}] = struct{}{}
+	case sqlAckSubPending:
+		delete(db.pending[i64(0)], [2]int64{i64(1), i64(2)})
+	case sqlDeleteChannel:
+		delete(db.channels, i64(0))
+	case sqlDeleteChannelMsgs:
+		delete(db.msgs, i64(0))
+	case sqlDeleteChannelSubs:
+		delete(db.subs, i64(0))
+	case sqlDeleteChannelSubsPending:
+		delete(db.pending, i64(0))
+	case sqlDeleteOrderingGroup:
+		delete(db.groups, args[0].(string))
+	case sqlAddOrderingGroup:
+		db.groups[args[0].(string)] = i64(1)
+	default:
+		return nil, fmt.Errorf("unexpected exec of %q", sqlStmts[s.query])
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *testSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := s.db
+	db.Lock()
+	defer db.Unlock()
+	r := &testSQLRows{}
+	switch s.query {
+	case sqlGetServerInfo:
+		r.cols = []string{"proto"}
+		if db.serverInfo != nil {
+			r.rows = append(r.rows, []driver.Value{db.serverInfo})
+		}
+	case sqlGetClients:
+		r.cols = []string{"id", "hbinbox"}
+		for id, inbox := range db.clients {
+			r.rows = append(r.rows, []driver.Value{id, inbox})
+		}
+	case sqlGetChannels:
+		r.cols = []string{"id", "name"}
+		for id, name := range db.channels {
+			r.rows = append(r.rows, []driver.Value{id, name})
+		}
+	case sqlGetMsgs:
+		r.cols = []string{"proto"}
+		msgs := db.msgs[args[0].(int64)]
+		seqs := make([]int, 0, len(msgs))
+		for seq := range msgs {
+			seqs = append(seqs, int(seq))
+		}
+		sort.Ints(seqs)
+		for _, seq := range seqs {
+			r.rows = append(r.rows, []driver.Value{msgs[int64(seq)]})
+		}
+	case sqlGetSubs:
+		r.cols = []string{"subid", "proto"}
+		for subid, data := range db.subs[args[0].(int64)] {
+			r.rows = append(r.rows, []driver.Value{subid, data})
+		}
+	case sqlGetSubsPending:
+		r.cols = []string{"subid", "seq"}
+		for k := range db.pending[args[0].(int64)] {
+			r.rows = append(r.rows, []driver.Value{k[0], k[1]})
+		}
+	case sqlGetOrderingGroups:
+		r.cols = []string{"name", "seq"}
+		for name, seq := range db.groups {
+			r.rows = append(r.rows, []driver.Value{name, seq})
+		}
+	default:
+		return nil, fmt.Errorf("unexpected query of %q", sqlStmts[s.query])
+	}
+	return r, nil
+}
+
+func (r *testSQLRows) Columns() []string { return r.cols }
+func (r *testSQLRows) Close() error      { return nil }
+
+func (r *testSQLRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// createDefaultSQLStore returns a SQL store backed by a new fake database.
+func createDefaultSQLStore(t *testing.T) *SQLStore {
+	ss, state, err := NewSQLStore(testSQLDriver, nuidGen.Next(), &testDefaultChannelLimits)
+	if err != nil {
+		stackFatalf(t, "Unable to create a SQLStore instance: %v", err)
+	}
+	if state != nil {
+		stackFatalf(t, "Expected no recovered state, got %v", state)
+	}
+	return ss
+}
+
+func TestSQLBasicCreate(t *testing.T) {
+	ss := createDefaultSQLStore(t)
+	defer ss.Close()
+
+	testBasicCreate(t, ss, TypeSQL)
+}
+
+// sqlStoreAPITests are run against the fake driver, and against a real
+// database when one is configured (see sqlstore_driver_test.go).
+var sqlStoreAPITests = []func(t *testing.T, s Store){
+	testNewChannel,
+	testCloseIdempotent,
+	testBasicMsgStore,
+	testLookupRange,
+	testStoreMsg,
+	testMsgsState,
+	testMaxMsgs,
+	testBasicSubStore,
+	testGetSeqFromStartTime,
+	testGetSeqFromGUID,
+	testClientAPIs,
+	testFlush,
+	testPurge,
+	testDeleteChannel,
+}
+
+func TestSQLStoreAPIs(t *testing.T) {
+	for _, f := range sqlStoreAPITests {
+		ss := createDefaultSQLStore(t)
+		f(t, ss)
+		ss.Close()
+	}
+}
+
+func TestSQLDeleteChannel(t *testing.T) {
+	source := nuidGen.Next()
+	ss, _, err := NewSQLStore(testSQLDriver, source, &testDefaultChannelLimits)
+	if err != nil {
+		t.Fatalf("Unable to create a SQLStore instance: %v", err)
+	}
+	defer ss.Close()
+	if err := ss.Init(&testDefaultServerInfo); err != nil {
+		t.Fatalf("Unexpected error on init: %v", err)
+	}
+	storeMsg(t, ss, "foo", []byte("hello"))
+	subID := storeSub(t, ss, "foo")
+	storeSubPending(t, ss, "foo", subID, 1)
+	storeMsg(t, ss, "bar", []byte("hello"))
+	if err := ss.DeleteChannel("foo"); err != nil {
+		t.Fatalf("Unexpected error on delete: %v", err)
+	}
+	ss.Close()
+
+	// The channel is not recovered.
+	ss, state, err := NewSQLStore(testSQLDriver, source, &testDefaultChannelLimits)
+	if err != nil {
+		t.Fatalf("Unable to open the SQLStore: %v", err)
+	}
+	defer ss.Close()
+	if state == nil {
+		t.Fatal("Expected state to be recovered")
+	}
+	if ss.LookupChannel("foo") != nil {
+		t.Fatal("Channel foo should not have been recovered")
+	}
+	if count, _, _ := ss.MsgsState("bar"); count != 1 {
+		t.Fatalf("Expected 1 message on bar, got %v", count)
+	}
+}
+
+func TestSQLMaxChannelsAndSubs(t *testing.T) {
+	ss := createDefaultSQLStore(t)
+	defer func() { ss.Close() }()
+
+	limits := testDefaultChannelLimits
+	limits.MaxChannels = 10
+	limits.MaxSubs = 10
+	ss.SetChannelLimits(limits)
+
+	testMaxChannels(t, ss, limits.MaxChannels)
+
+	ss.Close()
+	ss = createDefaultSQLStore(t)
+	ss.SetChannelLimits(limits)
+	testMaxSubs(t, ss, limits.MaxSubs)
+}
+
+func TestSQLDialect(t *testing.T) {
+	stmt := "INSERT INTO Messages (id, seq, proto) VALUES (?, ?, ?)"
+	if s := sqlDialect(SQLDriverMySQL, stmt); s != stmt {
+		t.Fatalf("Statement should not have been changed, got %q", s)
+	}
+	expected := "INSERT INTO Messages (id, seq, proto) VALUES ($1, $2, $3)"
+	if s := sqlDialect(SQLDriverPostgres, stmt); s != expected {
+		t.Fatalf("Expected %q, got %q", expected, s)
+	}
+	if s := sqlDialect(SQLDriverPostgres, sqlCreateTables[0]); strings.Contains(s, "BLOB") || !strings.Contains(s, "BYTEA") {
+		t.Fatalf("Expected BLOB to be replaced with BYTEA, got %q", s)
+	}
+	if s := sqlDialect(SQLDriverMySQL, sqlCreateTables[0]); !strings.Contains(s, "LONGBLOB") {
+		t.Fatalf("Expected BLOB to be replaced with LONGBLOB, got %q", s)
+	}
+	if s := sqlDialect("sqlite3", sqlCreateTables[0]); s != sqlCreateTables[0] {
+		t.Fatalf("Statement should not have been changed, got %q", s)
+	}
+}
+
+func TestSQLClientIDLength(t *testing.T) {
+	ss := createDefaultSQLStore(t)
+	defer ss.Close()
+
+	if _, _, err := ss.AddClient(strings.Repeat("a", SQLMaxClientIDLen), "hbInbox", nil); err != nil {
+		t.Fatalf("Unexpected error adding client: %v", err)
+	}
+	if _, _, err := ss.AddClient(strings.Repeat("a", SQLMaxClientIDLen+1), "hbInbox", nil); err == nil {
+		t.Fatal("Expected error for client ID too long")
+	}
+	if n := len(ss.GetClients()); n != 1 {
+		t.Fatalf("Expected 1 client, got %v", n)
+	}
+}
+
+func TestSQLRecoverOrderingGroups(t *testing.T) {
+	source := nuidGen.Next()
+	ss, _, err := NewSQLStore(testSQLDriver, source, &testDefaultChannelLimits)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	testRecoverOrderingGroups(t, ss, func() (Store, *RecoveredState) {
+		ss, state, err := NewSQLStore(testSQLDriver, source, &testDefaultChannelLimits)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return ss, state
+	})
+}
+
+func TestSQLRecovery(t *testing.T) {
+	source := nuidGen.Next()
+	limits := testDefaultChannelLimits
+	limits.MaxNumMsgs = 3
+	ss, _, err := NewSQLStore(testSQLDriver, source, &limits)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	info := &spb.ServerInfo{ClusterID: "id", Discovery: "discovery"}
+	if err := ss.Init(info); err != nil {
+		t.Fatalf("Unexpected error on init: %v", err)
+	}
+	if _, _, err := ss.AddClient("me", "hbInbox", nil); err != nil {
+		t.Fatalf("Unexpected error adding client: %v", err)
+	}
+	if _, _, err := ss.AddClient("deleted", "hbInbox", nil); err != nil {
+		t.Fatalf("Unexpected error adding client: %v", err)
+	}
+	ss.DeleteClient("deleted")
+	for i := 0; i < 5; i++ {
+		storeMsg(t, ss, "foo", []byte(fmt.Sprintf("msg%d", i)))
+	}
+	storeMsg(t, ss, "bar", []byte("hello"))
+	sub1 := storeSub(t, ss, "foo")
+	sub2 := storeSub(t, ss, "foo")
+	storeSubPending(t, ss, "foo", sub1, 3, 4, 5)
+	storeSubAck(t, ss, "foo", sub1, 4)
+	storeSubDelete(t, ss, "foo", sub2)
+	ss.Close()
+
+	ss, state, err := NewSQLStore(testSQLDriver, source, &limits)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer ss.Close()
+	if state == nil {
+		t.Fatal("Expected state to be recovered")
+	}
+	if !reflect.DeepEqual(state.Info, info) {
+		t.Fatalf("Expected server info %v, got %v", info, state.Info)
+	}
+	if len(state.Clients) != 1 || state.Clients[0].ID != "me" || state.Clients[0].HbInbox != "hbInbox" {
+		t.Fatalf("Unexpected recovered clients: %v", state.Clients)
+	}
+	cs := ss.LookupChannel("foo")
+	if cs == nil {
+		t.Fatal("Channel foo should have been recovered")
+	}
+	if first, last := cs.Msgs.FirstAndLastSequence(); first != 3 || last != 5 {
+		t.Fatalf("Unexpected first/last sequences: %v/%v", first, last)
+	}
+	if m := cs.Msgs.Lookup(5); m == nil || string(m.Data) != "msg4" {
+		t.Fatalf("Unexpected message: %v", m)
+	}
+	if n, _, _ := ss.MsgsState("bar"); n != 1 {
+		t.Fatalf("Expected 1 message in bar, got %v", n)
+	}
+	subs := state.Subs["foo"]
+	if len(subs) != 1 || subs[0].Sub.ID != sub1 {
+		t.Fatalf("Unexpected recovered subscriptions: %v", subs)
+	}
+	if len(subs[0].Pending) != 2 || subs[0].Pending[3] == nil || subs[0].Pending[5] == nil {
+		t.Fatalf("Unexpected pending messages: %v", subs[0].Pending)
+	}
+	// New messages, subscriptions and channels must not reuse IDs in use
+	if m := storeMsg(t, ss, "foo", []byte("new")); m.Sequence != 6 {
+		t.Fatalf("Expected sequence 6, got %v", m.Sequence)
+	}
+	if subID := storeSub(t, ss, "foo"); subID <= sub1 {
+		t.Fatalf("Expected subscription ID above %v, got %v", sub1, subID)
+	}
+	storeMsg(t, ss, "baz", []byte("hello"))
+	if ss.maxChannelID != 3 {
+		t.Fatalf("Expected max channel ID to be 3, got %v", ss.maxChannelID)
+	}
+}
+
+func TestSQLReadSQLStoreState(t *testing.T) {
+	source := nuidGen.Next()
+	if state, err := ReadSQLStoreState(testSQLDriver, source); state != nil || err != nil {
+		t.Fatalf("Expected no state and no error, got %v - %v", state, err)
+	}
+	ss, _, err := NewSQLStore(testSQLDriver, source, &testDefaultChannelLimits)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer ss.Close()
+	info := &spb.ServerInfo{ClusterID: "id", Discovery: "discovery"}
+	if err := ss.Init(info); err != nil {
+		t.Fatalf("Unexpected error on init: %v", err)
+	}
+	if _, _, err := ss.AddClient("me", "hbInbox", nil); err != nil {
+		t.Fatalf("Unexpected error adding client: %v", err)
+	}
+	storeMsg(t, ss, "foo", []byte("hello"))
+	storeMsg(t, ss, "bar", []byte("hello"))
+
+	state, err := ReadSQLStoreState(testSQLDriver, source)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if state.Info.ClusterID != "id" {
+		t.Fatalf("Unexpected server info: %v", state.Info)
+	}
+	if len(state.Clients) != 1 || state.Clients[0].ID != "me" || state.Clients[0].HbInbox != "hbInbox" {
+		t.Fatalf("Unexpected clients: %v", state.Clients)
+	}
+	if _, ok := state.Subs["foo"]; !ok || len(state.Subs) != 2 {
+		t.Fatalf("Unexpected channels: %v", state.Subs)
+	}
+	if q := sqlTablesQuery(testSQLDriver); q != "" {
+		t.Fatalf("Unexpected tables query: %v", q)
+	}
+	if q := sqlTablesQuery(SQLDriverMySQL); !strings.Contains(q, "DATABASE()") {
+		t.Fatalf("Unexpected tables query: %v", q)
+	}
+}
@@ -7,8 +7,8 @@ import (
 	"time"
 
 	"github.com/nats-io/gnatsd/server"
-	"github.com/nats-io/go-nats-streaming/pb"
 	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/util"
 )
 
 const (
@@ -16,6 +16,8 @@ const (
 	TypeMemory = "MEMORY"
 	// TypeFile is the store type name for file based stores
 	TypeFile = "FILE"
+	// TypeSQL is the store type name for SQL based stores
+	TypeSQL = "SQL"
 )
 
 const (
@@ -25,8 +27,9 @@ const (
 
 // Errors.
 var (
-	ErrTooManyChannels = errors.New("too many channels")
-	ErrTooManySubs     = errors.New("too many subscriptions per channel")
+	ErrTooManyChannels     = errors.New("too many channels")
+	ErrTooManySubs         = errors.New("too many subscriptions per channel")
+	ErrChannelNotRecovered = errors.New("channel not recovered")
 )
 
 // Noticef logs a notice statement
@@ -46,6 +49,10 @@ type ChannelLimits struct {
 	MaxMsgAge time.Duration
 	// How many subscriptions per channel are allowed.
 	MaxSubs int
+	// How long a channel can go without subscriptions and new messages
+	// before being deleted (0 for no limit). This limit is enforced by the
+	// server, not the store.
+	MaxInactivity time.Duration
 }
 
 // DefaultChannelLimits are the channel limits that a Store must
@@ -58,11 +65,16 @@ var DefaultChannelLimits = ChannelLimits{
 	MaxSubs:     1000,
 }
 
+// ChannelLimitsFunc returns the limits of the given channel. MaxChannels is
+// ignored, the number of channels is limited by the store's limits.
+type ChannelLimitsFunc func(channel string) ChannelLimits
+
 // RecoveredState allows the server to reconstruct its state after a restart.
 type RecoveredState struct {
-	Info    *spb.ServerInfo
-	Clients []*Client
-	Subs    RecoveredSubscriptions
+	Info           *spb.ServerInfo
+	Clients        []*Client
+	Subs           RecoveredSubscriptions
+	OrderingGroups map[string]uint64 // Last sequences recorded with Store.SetOrderingGroups
 }
 
 // Client represents a client with ID, Heartbeat Inbox and user data sets
@@ -77,7 +89,7 @@ type RecoveredSubscriptions map[string][]*RecoveredSubState
 
 // PendingAcks is a map of messages waiting to be acknowledged, keyed by
 // message sequence number.
-type PendingAcks map[uint64]*pb.MsgProto
+type PendingAcks map[uint64]*spb.MsgProto
 
 // RecoveredSubState represents a recovered Subscription with a map
 // of pending messages.
@@ -113,6 +125,16 @@ type Store interface {
 	// to be retroactive.
 	SetChannelLimits(limits ChannelLimits)
 
+	// SetChannelLimitsFunc sets the function returning the limits of each
+	// channel, used instead of the limits set with SetChannelLimits. It
+	// applies to existing and future channels, the new limits of existing
+	// channels being enforced when messages or subscriptions are next added.
+	SetChannelLimitsFunc(f ChannelLimitsFunc)
+
+	// SetClock sets the clock used to timestamp messages. It applies to
+	// existing and future channels.
+	SetClock(clock util.Clock)
+
 	// CreateChannel creates a ChannelStore for the given channel, and returns
 	// `true` to indicate that the channel is new, false if it already exists.
 	CreateChannel(channel string, userData interface{}) (*ChannelStore, bool, error)
@@ -124,6 +146,17 @@ type Store interface {
 	// HasChannel returns true if this store has any channel.
 	HasChannel() bool
 
+	// GetChannels returns a map of all ChannelStore objects, keyed by channel
+	// names. The returned map is a copy of the state maintained by the store
+	// so that it is safe for the caller to walk through the map while
+	// channels may be created/deleted.
+	GetChannels() map[string]*ChannelStore
+
+	// DeleteChannel closes the ChannelStore of the given channel and removes
+	// it, with its messages and subscriptions, from the store. It does
+	// nothing if the channel does not exist.
+	DeleteChannel(channel string) error
+
 	// MsgsState returns message store statistics for a given channel, or all
 	// if 'channel' is AllChannels.
 	MsgsState(channel string) (numMessages int, byteSize uint64, err error)
@@ -150,6 +183,12 @@ type Store interface {
 	// and returns it to the caller.
 	DeleteClient(clientID string) *Client
 
+	// SetOrderingGroups records the last sequences assigned in the given
+	// ordering groups. Stores recovering their state return them in the
+	// RecoveredState, so that the sequence of a group does not go back once
+	// the messages carrying it have been removed.
+	SetOrderingGroups(groups map[string]uint64) error
+
 	// Close closes all stores.
 	Close() error
 }
@@ -171,6 +210,10 @@ type SubStore interface {
 	// DeleteSub invalidates the subscription 'subid'.
 	DeleteSub(subid uint64)
 
+	// AvailableSubs returns the number of subscriptions that can still be
+	// created before reaching the limit.
+	AvailableSubs() int
+
 	// AddSeqPending adds the given message 'seqno' to the subscription 'subid'.
 	AddSeqPending(subid, seqno uint64) error
 
@@ -185,16 +228,33 @@ type SubStore interface {
 	Close() error
 }
 
+// MsgIterator iterates over a range of stored messages.
+type MsgIterator interface {
+	// Next returns the next message of the range, or nil at the end of the
+	// range or if the next message is not stored.
+	Next() *spb.MsgProto
+}
+
 // MsgStore is the interface for storage of Messages on a given channel.
 type MsgStore interface {
 	// State returns some statistics related to this store.
 	State() (numMessages int, byteSize uint64, err error)
 
 	// Store stores a message.
-	Store(reply string, data []byte) (*pb.MsgProto, error)
+	Store(reply string, data []byte) (*spb.MsgProto, error)
+
+	// StoreMsg stores the given message, with its reply, data, ordering
+	// group and GUID fields. The store assigns its sequence, subject and
+	// timestamp, and returns it.
+	StoreMsg(m *spb.MsgProto) (*spb.MsgProto, error)
 
 	// Lookup returns the stored message with given sequence number.
-	Lookup(seq uint64) *pb.MsgProto
+	Lookup(seq uint64) *spb.MsgProto
+
+	// LookupRange returns an iterator over the stored messages with sequence
+	// numbers from start to end, included. It is cheaper than calling
+	// Lookup for each message when replaying a backlog.
+	LookupRange(start, end uint64) MsgIterator
 
 	// FirstSequence returns sequence for first message stored, 0 if no
 	// message is stored.
@@ -212,15 +272,27 @@ type MsgStore interface {
 	// timestamp is greater or equal to given timestamp.
 	GetSequenceFromTimestamp(timestamp int64) uint64
 
+	// GetSequenceFromGUID returns the sequence of the stored message that
+	// was published with the given GUID, 0 if there is none.
+	GetSequenceFromGUID(guid string) uint64
+
 	// FirstMsg returns the first message stored.
-	FirstMsg() *pb.MsgProto
+	FirstMsg() *spb.MsgProto
 
 	// LastMsg returns the last message stored.
-	LastMsg() *pb.MsgProto
+	LastMsg() *spb.MsgProto
+
+	// Purge removes all messages from the store. Sequences of the messages
+	// stored afterwards start again at 1.
+	Purge() error
 
 	// Flush is for stores that may buffer operations and need them to be persisted.
 	Flush() error
 
+	// FlushNow is like Flush, but persists the buffered operations even if
+	// the store defers its writes.
+	FlushNow() error
+
 	// Close closes the store.
 	Close() error
 }
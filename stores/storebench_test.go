@@ -0,0 +1,148 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"testing"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+)
+
+// benchStore is a store type compared by the store benchmarks.
+type benchStore struct {
+	name   string
+	create func(b *testing.B) Store
+}
+
+// benchStores returns the built-in stores that don't need an external
+// service, and the registered ones.
+func benchStores() []benchStore {
+	list := []benchStore{
+		{TypeMemory, func(b *testing.B) Store {
+			s, err := NewMemoryStore(&testDefaultChannelLimits)
+			if err != nil {
+				stackFatalf(b, "Unable to create store: %v", err)
+			}
+			return s
+		}},
+		{TypeFile, func(b *testing.B) Store { return benchCreateDefaultFileStore(b) }},
+		{TypeHybrid, func(b *testing.B) Store {
+			s, err := NewHybridStore(defaultDataStore, &testDefaultChannelLimits,
+				HybridStoreOptions{MaxMemBytes: 1024 * 1024})
+			if err != nil {
+				stackFatalf(b, "Unable to create store: %v", err)
+			}
+			return s
+		}},
+		{TypeKV, func(b *testing.B) Store {
+			s, _, err := NewKVStore(defaultDataStore, &testDefaultChannelLimits)
+			if err != nil {
+				stackFatalf(b, "Unable to create store: %v", err)
+			}
+			return s
+		}},
+	}
+	for _, name := range RegisteredTypes() {
+		factory := LookupFactory(name)
+		list = append(list, benchStore{name, func(b *testing.B) Store {
+			s, state, err := factory(StoreConfig{Dir: defaultDataStore, Limits: &testDefaultChannelLimits})
+			if err != nil {
+				stackFatalf(b, "Unable to create store: %v", err)
+			}
+			if state == nil {
+				info := testDefaultServerInfo
+				if err := s.Init(&info); err != nil {
+					stackFatalf(b, "Unexpected error during Init: %v", err)
+				}
+			}
+			return s
+		}})
+	}
+	return list
+}
+
+// runStoreBench runs the benchmark for each store, with a fresh store and
+// the channel "foo".
+func runStoreBench(b *testing.B, bench func(b *testing.B, s Store, cs *ChannelStore)) {
+	for _, bs := range benchStores() {
+		b.Run(bs.name, func(b *testing.B) {
+			benchCleanupDatastore(b, defaultDataStore)
+			defer benchCleanupDatastore(b, defaultDataStore)
+			s := bs.create(b)
+			defer s.Close()
+			cs, _, err := s.CreateChannel("foo", nil)
+			if err != nil {
+				stackFatalf(b, "Error creating channel foo: %v", err)
+			}
+			b.ResetTimer()
+			bench(b, s, cs)
+		})
+	}
+}
+
+func benchStoreMsgs(b *testing.B, size int) {
+	data := make([]byte, size)
+	runStoreBench(b, func(b *testing.B, s Store, cs *ChannelStore) {
+		b.SetBytes(int64(size))
+		for i := 0; i < b.N; i++ {
+			benchStoreMsg(b, cs.Msgs, data)
+			// The server flushes after each batch of messages.
+			if i%100 == 99 {
+				if err := cs.Msgs.Flush(); err != nil {
+					stackFatalf(b, "Error flushing: %v", err)
+				}
+			}
+		}
+		if err := cs.Msgs.Flush(); err != nil {
+			stackFatalf(b, "Error flushing: %v", err)
+		}
+	})
+}
+
+func BenchmarkStoreMsgs_128(b *testing.B) {
+	benchStoreMsgs(b, 128)
+}
+
+func BenchmarkStoreMsgs_4096(b *testing.B) {
+	benchStoreMsgs(b, 4096)
+}
+
+func BenchmarkStoreLookupRange(b *testing.B) {
+	runStoreBench(b, func(b *testing.B, s Store, cs *ChannelStore) {
+		b.StopTimer()
+		count := 10000
+		data := make([]byte, 512)
+		for i := 0; i < count; i++ {
+			benchStoreMsg(b, cs.Msgs, data)
+		}
+		cs.Msgs.Flush()
+		b.StartTimer()
+		for i := 0; i < b.N; i++ {
+			start := uint64(i%count) + 1
+			it := cs.Msgs.LookupRange(start, start+99)
+			for m := it.Next(); m != nil; m = it.Next() {
+			}
+		}
+	})
+}
+
+func BenchmarkStoreSubPending(b *testing.B) {
+	runStoreBench(b, func(b *testing.B, s Store, cs *ChannelStore) {
+		sub := &spb.SubState{ClientID: "me", Inbox: "inbox", AckInbox: "ackInbox"}
+		if err := cs.Subs.CreateSub(sub); err != nil {
+			stackFatalf(b, "Error creating subscription: %v", err)
+		}
+		for i := 0; i < b.N; i++ {
+			seq := uint64(i + 1)
+			if err := cs.Subs.AddSeqPending(sub.ID, seq); err != nil {
+				stackFatalf(b, "Error adding pending: %v", err)
+			}
+			if err := cs.Subs.AckSeqPending(sub.ID, seq); err != nil {
+				stackFatalf(b, "Error acking: %v", err)
+			}
+		}
+		if err := cs.Subs.Flush(); err != nil {
+			stackFatalf(b, "Error flushing: %v", err)
+		}
+	})
+}
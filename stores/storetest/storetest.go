@@ -0,0 +1,659 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+// Package storetest drives a stores.Store with random concurrent operations
+// and cross-checks its state against a model of the expected behavior. A new
+// Store implementation should pass Run before being used by the server.
+package storetest
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+const (
+	// Subscriptions created per channel, at most.
+	maxSubsPerChannel = 5
+
+	// Clients added per channel, at most.
+	maxClientsPerChannel = 5
+
+	// Only the first violations are reported.
+	maxViolations = 100
+)
+
+// Opener opens the store under test with the given limits. It is called
+// once, then after each close of the store when Config.Recover is set.
+type Opener func(limits *stores.ChannelLimits) (stores.Store, *stores.RecoveredState, error)
+
+// Config defines the workload of a run.
+type Config struct {
+	Seed     int64                                    // Seed of the random choices (0 to use the current time)
+	Channels int                                      // Number of channels, each updated by its own goroutine
+	Readers  int                                      // Number of goroutines reading random channels concurrently
+	Ops      int                                      // Operations per channel between two reopens of the store
+	Reopens  int                                      // Number of times the store is closed and opened again
+	Recover  bool                                     // Check the recovered state after each reopen (for persistent stores)
+	Logf     func(format string, args ...interface{}) // Progress logger (nil for none)
+}
+
+// DefaultConfig returns a configuration running in a few seconds with the
+// stores of this repository.
+func DefaultConfig() Config {
+	return Config{
+		Channels: 4,
+		Readers:  2,
+		Ops:      2000,
+		Reopens:  2,
+	}
+}
+
+// Report is the outcome of a run. The run succeeded if there is no
+// violation: the store always returned the messages, sequences, sizes,
+// subscriptions and clients of the model, and readers running concurrently
+// only saw messages in order and matching their sequence and channel.
+type Report struct {
+	Seed       int64    // Seed of the run
+	Ops        uint64   // Operations applied to the store
+	Reads      uint64   // Messages read by the concurrent readers
+	Reopens    int      // Times the store was opened again
+	Violations []string // First violations of the invariants
+}
+
+// modelChannel is the expected state of a channel. It is only accessed by
+// the goroutine updating the channel, except the lock which keeps the
+// readers out while the channel is deleted and created again.
+type modelChannel struct {
+	mu      sync.RWMutex
+	name    string
+	limits  stores.ChannelLimits
+	first   uint64
+	last    uint64
+	bytes   uint64
+	msgs    map[uint64][]byte          // payload of the stored messages
+	dropped map[uint64][]byte          // payload of the messages dropped by the limits
+	subs    map[uint64]map[uint64]bool // pending sequences, by subscription ID
+	clients map[string]string          // heartbeat inbox of the clients added by the worker
+}
+
+// run is the state of a run.
+type run struct {
+	cfg      Config
+	open     Opener
+	s        stores.Store
+	channels []*modelChannel
+	ops      uint64 // updated atomically
+	reads    uint64 // updated atomically
+
+	// Serializes the changes of the store limits with the creation of
+	// channels, so that the model knows the limits applied to a channel.
+	limitsMu sync.Mutex
+
+	sync.Mutex
+	violations []string
+	count      int
+}
+
+// Run applies the configured workload to the store returned by open, and
+// checks it against the model. An error is returned if the store can't be
+// opened.
+func Run(cfg Config, open Opener) (*Report, error) {
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+	r := &run{cfg: cfg, open: open}
+	r.logf("Starting run with seed %v", cfg.Seed)
+
+	limits := r.storeLimits()
+	s, state, err := open(&limits)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		if err := s.Init(&spb.ServerInfo{ClusterID: "storetest", Discovery: "storetest.discover"}); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	r.s = s
+	rnd := rand.New(rand.NewSource(cfg.Seed))
+	for i := 0; i < cfg.Channels; i++ {
+		mc := &modelChannel{name: fmt.Sprintf("storetest.%d", i)}
+		if err := r.createChannel(rnd, mc); err != nil {
+			s.Close()
+			return nil, err
+		}
+		r.channels = append(r.channels, mc)
+	}
+
+	reopens := 0
+	for phase := 0; ; phase++ {
+		r.runPhase(phase)
+		if phase == cfg.Reopens || !cfg.Recover {
+			break
+		}
+		if err := r.reopen(); err != nil {
+			return nil, err
+		}
+		reopens++
+	}
+	r.s.Close()
+
+	r.Lock()
+	defer r.Unlock()
+	rep := &Report{
+		Seed:       cfg.Seed,
+		Ops:        atomic.LoadUint64(&r.ops),
+		Reads:      atomic.LoadUint64(&r.reads),
+		Reopens:    reopens,
+		Violations: r.violations,
+	}
+	if r.count > maxViolations {
+		rep.Violations = append(rep.Violations, fmt.Sprintf("... and %d more violations", r.count-maxViolations))
+	}
+	return rep, nil
+}
+
+func (r *run) logf(format string, args ...interface{}) {
+	if r.cfg.Logf != nil {
+		r.cfg.Logf(format, args...)
+	}
+}
+
+// violation records a violation of the invariants.
+func (r *run) violation(format string, args ...interface{}) {
+	r.Lock()
+	defer r.Unlock()
+	r.count++
+	if r.count <= maxViolations {
+		r.violations = append(r.violations, fmt.Sprintf(format, args...))
+	}
+}
+
+// storeLimits returns the limits the store is opened with.
+func (r *run) storeLimits() stores.ChannelLimits {
+	return stores.ChannelLimits{
+		MaxChannels: r.cfg.Channels,
+		MaxNumMsgs:  100,
+		MaxMsgBytes: 10 * 1024,
+		MaxSubs:     maxSubsPerChannel,
+	}
+}
+
+// createChannel (re)creates the channel with random limits, and resets
+// its model.
+func (r *run) createChannel(rnd *rand.Rand, mc *modelChannel) error {
+	r.limitsMu.Lock()
+	defer r.limitsMu.Unlock()
+	limits := r.storeLimits()
+	limits.MaxNumMsgs = 5 + rnd.Intn(200)
+	limits.MaxMsgBytes = uint64(500 + rnd.Intn(20*1024))
+	r.s.SetChannelLimits(limits)
+	if _, _, err := r.s.CreateChannel(mc.name, nil); err != nil {
+		return err
+	}
+	mc.limits = limits
+	mc.first, mc.last, mc.bytes = 0, 0, 0
+	mc.msgs = make(map[uint64][]byte)
+	mc.dropped = make(map[uint64][]byte)
+	mc.subs = make(map[uint64]map[uint64]bool)
+	if mc.clients == nil {
+		mc.clients = make(map[string]string)
+	}
+	return nil
+}
+
+// reopen closes the store, opens it again and checks the recovered state
+// against the model.
+func (r *run) reopen() error {
+	if err := r.s.Close(); err != nil {
+		r.violation("Error closing store: %v", err)
+	}
+	limits := r.storeLimits()
+	s, state, err := r.open(&limits)
+	if err != nil {
+		return err
+	}
+	r.s = s
+	r.logf("Store reopened, checking recovered state")
+	if state == nil {
+		r.violation("No state recovered")
+		return nil
+	}
+	clients := make(map[string]string)
+	for _, mc := range r.channels {
+		// Recovered channels use the limits of the store.
+		mc.limits = limits
+		for id, hb := range mc.clients {
+			clients[id] = hb
+		}
+		r.recoverDropped(mc)
+		r.checkMsgs(mc)
+		r.checkRecoveredSubs(mc, state.Subs[mc.name])
+	}
+	if len(state.Clients) != len(clients) {
+		r.violation("Recovered %v clients, expected %v", len(state.Clients), len(clients))
+	}
+	for _, c := range state.Clients {
+		if hb, ok := clients[c.ID]; !ok || hb != c.HbInbox {
+			r.violation("Unexpected recovered client %q with inbox %q", c.ID, c.HbInbox)
+		}
+	}
+	return nil
+}
+
+// recoverDropped adds back to the model the messages dropped by the limits
+// that the store recovered. The limits don't apply to the recovered state,
+// so a store may recover messages it dropped, but only the latest ones.
+func (r *run) recoverDropped(mc *modelChannel) {
+	cs := r.s.LookupChannel(mc.name)
+	if cs == nil {
+		return
+	}
+	first := cs.Msgs.FirstSequence()
+	if first == 0 || first >= mc.first {
+		return
+	}
+	for seq := first; seq < mc.first; seq++ {
+		data := mc.dropped[seq]
+		if data == nil {
+			r.violation("Channel %q: recovered messages from %v, expected from %v", mc.name, first, mc.first)
+			return
+		}
+		mc.msgs[seq] = data
+		mc.bytes += uint64(len(data))
+	}
+	mc.first = first
+}
+
+// checkRecoveredSubs checks the recovered subscriptions of the channel.
+// Pending sequences are recovered only if their message still exists.
+func (r *run) checkRecoveredSubs(mc *modelChannel, rss []*stores.RecoveredSubState) {
+	if len(rss) != len(mc.subs) {
+		r.violation("Channel %q: recovered %v subscriptions, expected %v", mc.name, len(rss), len(mc.subs))
+		return
+	}
+	for _, rs := range rss {
+		pending, ok := mc.subs[rs.Sub.ID]
+		if !ok {
+			r.violation("Channel %q: unexpected recovered subscription %v", mc.name, rs.Sub.ID)
+			continue
+		}
+		expected := 0
+		for seq := range pending {
+			if mc.msgs[seq] == nil {
+				continue
+			}
+			expected++
+			if m := rs.Pending[seq]; m == nil || m.Sequence != seq {
+				r.violation("Channel %q: subscription %v did not recover pending %v", mc.name, rs.Sub.ID, seq)
+			}
+		}
+		if len(rs.Pending) != expected {
+			r.violation("Channel %q: subscription %v recovered %v pending, expected %v",
+				mc.name, rs.Sub.ID, len(rs.Pending), expected)
+		}
+	}
+}
+
+// runPhase runs the workers of the channels and the readers, until the
+// workers have applied Config.Ops operations.
+func (r *run) runPhase(phase int) {
+	quit := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < r.cfg.Readers; i++ {
+		readers.Add(1)
+		go r.read(rand.New(rand.NewSource(r.cfg.Seed+int64(phase*1000+i))), quit, &readers)
+	}
+	var workers sync.WaitGroup
+	for i, mc := range r.channels {
+		workers.Add(1)
+		rnd := rand.New(rand.NewSource(r.cfg.Seed + int64((phase+1)*1000000+i)))
+		go r.work(rnd, mc, &workers)
+	}
+	workers.Wait()
+	close(quit)
+	readers.Wait()
+	r.logf("Phase %v done, ops=%v reads=%v", phase, atomic.LoadUint64(&r.ops), atomic.LoadUint64(&r.reads))
+}
+
+// payload returns the data of the message seq of the channel, of a
+// random size.
+func payload(rnd *rand.Rand, channel string, seq uint64) []byte {
+	return []byte(fmt.Sprintf("%s:%d:%s", channel, seq, strings.Repeat("x", rnd.Intn(300))))
+}
+
+// payloadSeq returns the channel and sequence encoded in the payload.
+func payloadSeq(data []byte) (string, uint64) {
+	f := strings.SplitN(string(data), ":", 3)
+	if len(f) != 3 {
+		return "", 0
+	}
+	seq, _ := strconv.ParseUint(f[1], 10, 64)
+	return f[0], seq
+}
+
+// work applies random operations to the channel, checking each result
+// against the model. It stops at the first violation, after which the
+// model no longer applies.
+func (r *run) work(rnd *rand.Rand, mc *modelChannel, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for i := 0; i < r.cfg.Ops; i++ {
+		atomic.AddUint64(&r.ops, 1)
+		cs := r.s.LookupChannel(mc.name)
+		if cs == nil {
+			r.violation("Channel %q not found", mc.name)
+			return
+		}
+		var ok bool
+		switch n := rnd.Intn(100); {
+		case n < 50:
+			ok = r.storeMsg(rnd, mc, cs)
+		case n < 60:
+			ok = r.lookup(rnd, mc, cs)
+		case n < 65:
+			ok = r.checkMsgs(mc)
+		case n < 70:
+			ok = r.createSub(mc, cs)
+		case n < 80:
+			ok = r.addPending(rnd, mc, cs)
+		case n < 88:
+			ok = r.ackPending(rnd, mc, cs)
+		case n < 90:
+			ok = r.deleteSub(rnd, mc, cs)
+		case n < 96:
+			ok = r.updateClients(rnd, mc)
+		case n < 98:
+			ok = r.purge(mc, cs)
+		default:
+			ok = r.recreate(rnd, mc)
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// storeMsg stores a message and applies the channel limits to the model.
+func (r *run) storeMsg(rnd *rand.Rand, mc *modelChannel, cs *stores.ChannelStore) bool {
+	seq := mc.last + 1
+	data := payload(rnd, mc.name, seq)
+	m, err := cs.Msgs.Store("", data)
+	if err != nil {
+		r.violation("Channel %q: error storing message %v: %v", mc.name, seq, err)
+		return false
+	}
+	if m.Sequence != seq {
+		r.violation("Channel %q: stored message got sequence %v, expected %v", mc.name, m.Sequence, seq)
+		return false
+	}
+	if mc.first == 0 {
+		mc.first = 1
+	}
+	mc.last = seq
+	mc.msgs[seq] = data
+	mc.bytes += uint64(len(data))
+	// The oldest messages are dropped, but the last one is always kept.
+	for len(mc.msgs) > mc.limits.MaxNumMsgs || (len(mc.msgs) > 1 && mc.bytes > mc.limits.MaxMsgBytes) {
+		mc.bytes -= uint64(len(mc.msgs[mc.first]))
+		mc.dropped[mc.first] = mc.msgs[mc.first]
+		delete(mc.msgs, mc.first)
+		mc.first++
+	}
+	return true
+}
+
+// lookup looks up a random sequence around the stored ones.
+func (r *run) lookup(rnd *rand.Rand, mc *modelChannel, cs *stores.ChannelStore) bool {
+	seq := mc.first + uint64(rnd.Intn(int(mc.last-mc.first)+3))
+	if seq > 0 {
+		seq--
+	}
+	m := cs.Msgs.Lookup(seq)
+	expected := mc.msgs[seq]
+	switch {
+	case expected == nil && m != nil:
+		r.violation("Channel %q: lookup of %v returned a message, expected none", mc.name, seq)
+		return false
+	case expected != nil && (m == nil || m.Sequence != seq || string(m.Data) != string(expected)):
+		r.violation("Channel %q: lookup of %v returned %v, expected %q", mc.name, seq, m, expected)
+		return false
+	}
+	return true
+}
+
+// checkMsgs checks the sequences, the state and all the messages of the
+// channel.
+func (r *run) checkMsgs(mc *modelChannel) bool {
+	cs := r.s.LookupChannel(mc.name)
+	if cs == nil {
+		r.violation("Channel %q not found", mc.name)
+		return false
+	}
+	if first, last := cs.Msgs.FirstAndLastSequence(); first != mc.first || last != mc.last {
+		r.violation("Channel %q: sequences are %v-%v, expected %v-%v", mc.name, first, last, mc.first, mc.last)
+		return false
+	}
+	count, bytes, err := cs.Msgs.State()
+	if err != nil || count != len(mc.msgs) || bytes != mc.bytes {
+		r.violation("Channel %q: state is %v msgs, %v bytes (err=%v), expected %v msgs, %v bytes",
+			mc.name, count, bytes, err, len(mc.msgs), mc.bytes)
+		return false
+	}
+	if len(mc.msgs) == 0 {
+		return true
+	}
+	it := cs.Msgs.LookupRange(mc.first, mc.last)
+	for seq := mc.first; seq <= mc.last; seq++ {
+		m := it.Next()
+		if m == nil || m.Sequence != seq || string(m.Data) != string(mc.msgs[seq]) {
+			r.violation("Channel %q: range lookup returned %v, expected message %v", mc.name, m, seq)
+			return false
+		}
+	}
+	if m := it.Next(); m != nil {
+		r.violation("Channel %q: range lookup returned %v past the last message", mc.name, m.Sequence)
+		return false
+	}
+	return true
+}
+
+// createSub creates a subscription, unless the channel has enough.
+func (r *run) createSub(mc *modelChannel, cs *stores.ChannelStore) bool {
+	if len(mc.subs) == maxSubsPerChannel {
+		return true
+	}
+	sub := &spb.SubState{
+		ClientID:      "storetest",
+		Inbox:         mc.name + ".inbox",
+		AckInbox:      mc.name + ".ack",
+		AckWaitInSecs: 30,
+	}
+	if err := cs.Subs.CreateSub(sub); err != nil {
+		r.violation("Channel %q: error creating subscription: %v", mc.name, err)
+		return false
+	}
+	if _, ok := mc.subs[sub.ID]; ok {
+		r.violation("Channel %q: subscription ID %v reused", mc.name, sub.ID)
+		return false
+	}
+	mc.subs[sub.ID] = make(map[uint64]bool)
+	return true
+}
+
+// randomSub returns the ID of a random subscription, or 0 if there is none.
+func randomSub(rnd *rand.Rand, mc *modelChannel) uint64 {
+	if len(mc.subs) == 0 {
+		return 0
+	}
+	n := rnd.Intn(len(mc.subs))
+	for id := range mc.subs {
+		if n == 0 {
+			return id
+		}
+		n--
+	}
+	return 0
+}
+
+// addPending marks a random stored message as pending for a random
+// subscription.
+func (r *run) addPending(rnd *rand.Rand, mc *modelChannel, cs *stores.ChannelStore) bool {
+	id := randomSub(rnd, mc)
+	if id == 0 || len(mc.msgs) == 0 {
+		return true
+	}
+	seq := mc.first + uint64(rnd.Intn(int(mc.last-mc.first+1)))
+	if err := cs.Subs.AddSeqPending(id, seq); err != nil {
+		r.violation("Channel %q: error adding pending %v to subscription %v: %v", mc.name, seq, id, err)
+		return false
+	}
+	mc.subs[id][seq] = true
+	return true
+}
+
+// ackPending acknowledges a random pending message of a random
+// subscription.
+func (r *run) ackPending(rnd *rand.Rand, mc *modelChannel, cs *stores.ChannelStore) bool {
+	id := randomSub(rnd, mc)
+	if id == 0 || len(mc.subs[id]) == 0 {
+		return true
+	}
+	n := rnd.Intn(len(mc.subs[id]))
+	for seq := range mc.subs[id] {
+		if n > 0 {
+			n--
+			continue
+		}
+		if err := cs.Subs.AckSeqPending(id, seq); err != nil {
+			r.violation("Channel %q: error acking %v for subscription %v: %v", mc.name, seq, id, err)
+			return false
+		}
+		delete(mc.subs[id], seq)
+		break
+	}
+	return true
+}
+
+// deleteSub deletes a random subscription.
+func (r *run) deleteSub(rnd *rand.Rand, mc *modelChannel, cs *stores.ChannelStore) bool {
+	if id := randomSub(rnd, mc); id != 0 {
+		cs.Subs.DeleteSub(id)
+		delete(mc.subs, id)
+	}
+	return true
+}
+
+// updateClients adds or deletes a client owned by the channel's worker,
+// and checks the clients of the worker.
+func (r *run) updateClients(rnd *rand.Rand, mc *modelChannel) bool {
+	id := fmt.Sprintf("%s.client.%d", mc.name, rnd.Intn(maxClientsPerChannel))
+	if _, ok := mc.clients[id]; ok {
+		if c := r.s.DeleteClient(id); c == nil {
+			r.violation("Client %q not deleted", id)
+			return false
+		}
+		delete(mc.clients, id)
+	} else {
+		hb := fmt.Sprintf("%s.hb.%d", id, rnd.Int63())
+		c, isNew, err := r.s.AddClient(id, hb, nil)
+		if err != nil || !isNew || c == nil || c.HbInbox != hb {
+			r.violation("Client %q: unexpected result adding it: %v, %v, %v", id, c, isNew, err)
+			return false
+		}
+		mc.clients[id] = hb
+	}
+	for i := 0; i < maxClientsPerChannel; i++ {
+		id := fmt.Sprintf("%s.client.%d", mc.name, i)
+		c := r.s.GetClient(id)
+		hb, ok := mc.clients[id]
+		if ok != (c != nil) || (c != nil && c.HbInbox != hb) {
+			r.violation("Client %q: got %v, expected inbox %q", id, c, hb)
+			return false
+		}
+	}
+	return true
+}
+
+// purge removes all the messages of the channel. Sequences start again
+// at 1, and the pending sequences of the subscriptions are kept.
+func (r *run) purge(mc *modelChannel, cs *stores.ChannelStore) bool {
+	if err := cs.Msgs.Purge(); err != nil {
+		r.violation("Channel %q: error purging: %v", mc.name, err)
+		return false
+	}
+	mc.first, mc.last, mc.bytes = 0, 0, 0
+	mc.msgs = make(map[uint64][]byte)
+	mc.dropped = make(map[uint64][]byte)
+	return r.checkMsgs(mc)
+}
+
+// recreate deletes the channel and creates it again with new limits.
+func (r *run) recreate(rnd *rand.Rand, mc *modelChannel) bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if err := r.s.DeleteChannel(mc.name); err != nil {
+		r.violation("Channel %q: error deleting: %v", mc.name, err)
+		return false
+	}
+	if err := r.createChannel(rnd, mc); err != nil {
+		r.violation("Channel %q: error creating it again: %v", mc.name, err)
+		return false
+	}
+	return r.checkMsgs(mc)
+}
+
+// read reads random channels until quit is closed, checking that the
+// messages are returned in order and match their channel and sequence.
+func (r *run) read(rnd *rand.Rand, quit chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case <-quit:
+			return
+		default:
+		}
+		mc := r.channels[rnd.Intn(len(r.channels))]
+		mc.mu.RLock()
+		r.readChannel(mc)
+		mc.mu.RUnlock()
+		if _, _, err := r.s.MsgsState(stores.AllChannels); err != nil {
+			r.violation("Error getting the state of all channels: %v", err)
+		}
+	}
+}
+
+func (r *run) readChannel(mc *modelChannel) {
+	cs := r.s.LookupChannel(mc.name)
+	if cs == nil {
+		r.violation("Channel %q not found", mc.name)
+		return
+	}
+	first, last := cs.Msgs.FirstAndLastSequence()
+	if first > last+1 {
+		r.violation("Channel %q: first sequence %v after last %v", mc.name, first, last)
+		return
+	}
+	if first == 0 {
+		return
+	}
+	prev := uint64(0)
+	it := cs.Msgs.LookupRange(first, last)
+	for m := it.Next(); m != nil; m = it.Next() {
+		atomic.AddUint64(&r.reads, 1)
+		channel, seq := payloadSeq(m.Data)
+		if m.Sequence <= prev || m.Sequence > last || channel != mc.name || seq != m.Sequence || m.Subject != mc.name {
+			r.violation("Channel %q: read message %v (%q) after %v, in range %v-%v",
+				mc.name, m.Sequence, m.Data, prev, first, last)
+			return
+		}
+		prev = m.Sequence
+	}
+}
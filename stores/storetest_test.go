@@ -0,0 +1,73 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/nats-io/nats-streaming-server/stores"
+	"github.com/nats-io/nats-streaming-server/stores/storetest"
+	"github.com/nats-io/nuid"
+)
+
+func runStoreTest(t *testing.T, cfg storetest.Config, open storetest.Opener) {
+	cfg.Logf = t.Logf
+	if testing.Short() {
+		cfg.Ops /= 10
+	}
+	rep, err := storetest.Run(cfg, open)
+	if err != nil {
+		t.Fatalf("Unable to run: %v", err)
+	}
+	t.Logf("Seed=%v Ops=%v Reads=%v Reopens=%v", rep.Seed, rep.Ops, rep.Reads, rep.Reopens)
+	for _, v := range rep.Violations {
+		t.Errorf("%s", v)
+	}
+}
+
+func TestMSConsistency(t *testing.T) {
+	runStoreTest(t, storetest.DefaultConfig(), func(limits *stores.ChannelLimits) (stores.Store, *stores.RecoveredState, error) {
+		ms, err := stores.NewMemoryStore(limits)
+		return ms, nil, err
+	})
+}
+
+func TestFSConsistency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storetest")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := storetest.DefaultConfig()
+	cfg.Recover = true
+	runStoreTest(t, cfg, func(limits *stores.ChannelLimits) (stores.Store, *stores.RecoveredState, error) {
+		return stores.NewFileStore(dir, limits)
+	})
+}
+
+func TestSQLConsistency(t *testing.T) {
+	source := nuid.Next()
+	cfg := storetest.DefaultConfig()
+	cfg.Recover = true
+	runStoreTest(t, cfg, func(limits *stores.ChannelLimits) (stores.Store, *stores.RecoveredState, error) {
+		// The driver registered by the SQL store tests of this package.
+		return stores.NewSQLStore("stan_sqltest", source, limits)
+	})
+}
+
+func TestKVConsistency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storetest")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := storetest.DefaultConfig()
+	cfg.Recover = true
+	runStoreTest(t, cfg, func(limits *stores.ChannelLimits) (stores.Store, *stores.RecoveredState, error) {
+		return stores.NewKVStore(dir, limits)
+	})
+}
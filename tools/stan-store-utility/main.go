@@ -0,0 +1,236 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+// Command stan-store-utility dumps the content of a FILE store directory,
+// for instance to debug recovery issues offline.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	stand "github.com/nats-io/nats-streaming-server/server"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+var usageStr = `
+Usage: stan-store-utility [options] <command> [arguments]
+
+Commands:
+    channels                         List the channels, with their message counts and sequence ranges
+    clients                          List the clients
+    subs [channel]                   List the subscriptions, of all channels or of the given one
+    msgs <channel> <seq> [last seq]  Print the message with the given sequence, or a range of messages
+
+Options:
+    --dir <directory>                Root directory of the FILE store
+    --encrypt                        The files are encrypted (key in STAN_ENCRYPTION_KEY)
+
+The store is opened as the server does on restart: it must not be used
+by a running server.
+`
+
+func usage() {
+	fmt.Printf("%s\n", usageStr)
+	os.Exit(0)
+}
+
+// errUsage is returned for invalid command lines.
+var errUsage = errors.New("invalid command line")
+
+// unlimited are the limits the store is opened with, so that recovered
+// messages and subscriptions are never removed.
+var unlimited = stores.ChannelLimits{
+	MaxChannels: math.MaxInt32,
+	MaxNumMsgs:  math.MaxInt32,
+	MaxMsgBytes: math.MaxUint64,
+	MaxSubs:     math.MaxInt32,
+}
+
+func main() {
+	var dir string
+	var encrypt bool
+	flag.StringVar(&dir, "dir", "", "Root directory of the FILE store")
+	flag.BoolVar(&encrypt, "encrypt", false, "The files are encrypted (key in STAN_ENCRYPTION_KEY)")
+	flag.Usage = usage
+	flag.Parse()
+
+	if dir == "" || flag.NArg() == 0 {
+		usage()
+	}
+	// Don't create the directory of a mistyped path.
+	if _, err := os.Stat(dir); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	var opts []stores.FileStoreOption
+	if encrypt {
+		key := os.Getenv(stand.EncryptionKeyEnv)
+		if key == "" {
+			fmt.Fprintf(os.Stderr, "%v\n", stand.ErrNoEncryptionKey)
+			os.Exit(1)
+		}
+		opts = append(opts, stores.EncryptionKey([]byte(key)))
+	}
+	limits := unlimited
+	fs, state, err := stores.NewFileStore(dir, &limits, opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open the store: %v\n", err)
+		os.Exit(1)
+	}
+	defer fs.Close()
+
+	if err := run(os.Stdout, fs, state, flag.Args()); err != nil {
+		if err == errUsage {
+			usage()
+		}
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		fs.Close()
+		os.Exit(1)
+	}
+}
+
+// run executes the command given by args on the opened store.
+func run(w io.Writer, fs *stores.FileStore, state *stores.RecoveredState, args []string) error {
+	if state == nil {
+		return errors.New("the store is empty")
+	}
+	switch cmd, args := args[0], args[1:]; {
+	case cmd == "channels" && len(args) == 0:
+		return listChannels(w, fs, state)
+	case cmd == "clients" && len(args) == 0:
+		return listClients(w, state)
+	case cmd == "subs" && len(args) <= 1:
+		channel := ""
+		if len(args) == 1 {
+			channel = args[0]
+		}
+		return listSubs(w, state, channel)
+	case cmd == "msgs" && (len(args) == 2 || len(args) == 3):
+		start, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid sequence %q", args[1])
+		}
+		end := start
+		if len(args) == 3 {
+			if end, err = strconv.ParseUint(args[2], 10, 64); err != nil || end < start {
+				return fmt.Errorf("invalid last sequence %q", args[2])
+			}
+		}
+		return printMsgs(w, fs, args[0], start, end)
+	default:
+		return errUsage
+	}
+}
+
+// sortedChannels returns the names of the channels of the store, sorted.
+func sortedChannels(fs *stores.FileStore) []string {
+	channels := fs.GetChannels()
+	names := make([]string, 0, len(channels))
+	for name := range channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// listChannels prints the message counts and sequence ranges of the
+// channels, and their number of subscriptions.
+func listChannels(w io.Writer, fs *stores.FileStore, state *stores.RecoveredState) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "CHANNEL\tMSGS\tBYTES\tFIRST\tLAST\tSUBS\n")
+	for _, name := range sortedChannels(fs) {
+		cs := fs.LookupChannel(name)
+		count, bytes, err := cs.Msgs.State()
+		if err != nil {
+			return fmt.Errorf("unable to get the state of channel %q: %v", name, err)
+		}
+		first, last := cs.Msgs.FirstAndLastSequence()
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\n", name, count, bytes, first, last, len(state.Subs[name]))
+	}
+	return tw.Flush()
+}
+
+// listClients prints the recovered clients.
+func listClients(w io.Writer, state *stores.RecoveredState) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "CLIENT\tHEARTBEAT INBOX\n")
+	clients := make([]*stores.Client, len(state.Clients))
+	copy(clients, state.Clients)
+	sort.Sort(byClientID(clients))
+	for _, c := range clients {
+		fmt.Fprintf(tw, "%s\t%s\n", c.ID, c.HbInbox)
+	}
+	return tw.Flush()
+}
+
+type byClientID []*stores.Client
+
+func (c byClientID) Len() int           { return len(c) }
+func (c byClientID) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byClientID) Less(i, j int) bool { return c[i].ID < c[j].ID }
+
+// listSubs prints the recovered subscriptions, with the last message sent
+// to each of them and the number of messages they did not acknowledge.
+func listSubs(w io.Writer, state *stores.RecoveredState, channel string) error {
+	var channels []string
+	if channel != "" {
+		if _, ok := state.Subs[channel]; !ok {
+			return fmt.Errorf("no channel %q", channel)
+		}
+		channels = []string{channel}
+	} else {
+		for name := range state.Subs {
+			channels = append(channels, name)
+		}
+		sort.Strings(channels)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "CHANNEL\tID\tCLIENT\tDURABLE\tQUEUE\tLAST SENT\tPENDING\n")
+	for _, name := range channels {
+		for _, rs := range state.Subs[name] {
+			sub := rs.Sub
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%d\t%d\n", name, sub.ID, sub.ClientID,
+				sub.DurableName, sub.QGroup, sub.LastSent, len(rs.Pending))
+		}
+	}
+	return tw.Flush()
+}
+
+// printMsgs prints the messages of the channel with sequences from start
+// to end, included.
+func printMsgs(w io.Writer, fs *stores.FileStore, channel string, start, end uint64) error {
+	cs := fs.LookupChannel(channel)
+	if cs == nil {
+		return fmt.Errorf("no channel %q", channel)
+	}
+	found := false
+	for seq := start; seq <= end; seq++ {
+		m := cs.Msgs.Lookup(seq)
+		if m == nil {
+			continue
+		}
+		found = true
+		fmt.Fprintf(w, "Sequence:  %d\n", m.Sequence)
+		fmt.Fprintf(w, "Timestamp: %s\n", time.Unix(0, m.Timestamp).UTC().Format(time.RFC3339Nano))
+		if m.Reply != "" {
+			fmt.Fprintf(w, "Reply:     %s\n", m.Reply)
+		}
+		if m.OrderingGroup != "" {
+			fmt.Fprintf(w, "Group:     %s (sequence %d)\n", m.OrderingGroup, m.GroupSequence)
+		}
+		fmt.Fprintf(w, "Size:      %d\n", len(m.Data))
+		fmt.Fprintf(w, "Data:      %q\n\n", m.Data)
+	}
+	if !found {
+		return fmt.Errorf("no message stored with sequence %d to %d on channel %q", start, end, channel)
+	}
+	return nil
+}
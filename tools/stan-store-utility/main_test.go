@@ -0,0 +1,129 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats-streaming-server/spb"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+func createStore(t *testing.T, dir string) {
+	limits := stores.DefaultChannelLimits
+	fs, _, err := stores.NewFileStore(dir, &limits)
+	if err != nil {
+		t.Fatalf("Unable to create store: %v", err)
+	}
+	defer fs.Close()
+	if err := fs.Init(&spb.ServerInfo{ClusterID: "test-cluster"}); err != nil {
+		t.Fatalf("Unable to init store: %v", err)
+	}
+	if _, _, err := fs.AddClient("me", "hbInbox", nil); err != nil {
+		t.Fatalf("Unable to add client: %v", err)
+	}
+	cs, _, err := fs.CreateChannel("foo", nil)
+	if err != nil {
+		t.Fatalf("Unable to create channel: %v", err)
+	}
+	for _, d := range []string{"first", "second", "third"} {
+		if _, err := cs.Msgs.Store("", []byte(d)); err != nil {
+			t.Fatalf("Unable to store message: %v", err)
+		}
+	}
+	sub := &spb.SubState{ClientID: "me", Inbox: "inbox", AckInbox: "ackInbox",
+		DurableName: "dur", MaxInFlight: 10, AckWaitInSecs: 30, LastSent: 2}
+	if err := cs.Subs.CreateSub(sub); err != nil {
+		t.Fatalf("Unable to create sub: %v", err)
+	}
+	if err := cs.Subs.AddSeqPending(sub.ID, 2); err != nil {
+		t.Fatalf("Unable to add pending: %v", err)
+	}
+	if _, _, err := fs.CreateChannel("bar", nil); err != nil {
+		t.Fatalf("Unable to create channel: %v", err)
+	}
+}
+
+func runCommand(t *testing.T, dir string, args ...string) (string, error) {
+	limits := unlimited
+	fs, state, err := stores.NewFileStore(dir, &limits)
+	if err != nil {
+		t.Fatalf("Unable to open store: %v", err)
+	}
+	defer fs.Close()
+	var buf bytes.Buffer
+	err = run(&buf, fs, state, args)
+	return buf.String(), err
+}
+
+func checkLines(t *testing.T, out string, expected ...string) {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %v lines, got:\n%s", len(expected), out)
+	}
+	for i, e := range expected {
+		if strings.Join(strings.Fields(lines[i]), " ") != e {
+			t.Fatalf("Expected line %q, got %q", e, lines[i])
+		}
+	}
+}
+
+func TestStoreUtility(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stan-store-utility")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	createStore(t, dir)
+
+	out, err := runCommand(t, dir, "channels")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkLines(t, out,
+		"CHANNEL MSGS BYTES FIRST LAST SUBS",
+		"bar 0 0 0 0 0",
+		"foo 3 16 1 3 1")
+
+	out, err = runCommand(t, dir, "clients")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkLines(t, out, "CLIENT HEARTBEAT INBOX", "me hbInbox")
+
+	out, err = runCommand(t, dir, "subs", "foo")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkLines(t, out, "CHANNEL ID CLIENT DURABLE QUEUE LAST SENT PENDING", "foo 1 me dur 2 1")
+	out, err = runCommand(t, dir, "subs", "bar")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkLines(t, out, "CHANNEL ID CLIENT DURABLE QUEUE LAST SENT PENDING")
+	if _, err := runCommand(t, dir, "subs", "baz"); err == nil {
+		t.Fatal("Expected an error for an unknown channel")
+	}
+
+	out, err = runCommand(t, dir, "msgs", "foo", "2", "5")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(out, `Data:      "second"`) || !strings.Contains(out, `Data:      "third"`) ||
+		strings.Contains(out, "first") {
+		t.Fatalf("Unexpected messages:\n%s", out)
+	}
+	if _, err := runCommand(t, dir, "msgs", "foo", "4"); err == nil {
+		t.Fatal("Expected an error for a sequence not stored")
+	}
+	if _, err := runCommand(t, dir, "msgs", "baz", "1"); err == nil {
+		t.Fatal("Expected an error for an unknown channel")
+	}
+	if _, err := runCommand(t, dir, "msgs", "foo"); err != errUsage {
+		t.Fatalf("Expected error %v, got %v", errUsage, err)
+	}
+}
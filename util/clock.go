@@ -0,0 +1,135 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is used to get the current time and to create timers. The server
+// and stores use it instead of the time package so that time can be
+// controlled in tests.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// AfterFunc waits for the duration to elapse and then calls f.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is the interface of timers created by a Clock. The semantic of
+// Reset and Stop is the same as the time.Timer's ones.
+type Timer interface {
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+// RealClock is the Clock backed by the time package.
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// ManualClock is a Clock whose time only moves when Advance or Set is
+// called. Timers that expire as a result are fired, in expiration order,
+// from the go routine calling Advance or Set, so that when the call
+// returns, all callbacks have completed.
+type ManualClock struct {
+	sync.Mutex
+	now    time.Time
+	timers map[*manualTimer]struct{}
+}
+
+type manualTimer struct {
+	clock  *ManualClock
+	when   time.Time
+	f      func()
+	active bool
+}
+
+// NewManualClock returns a ManualClock set to the given time.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now, timers: make(map[*manualTimer]struct{})}
+}
+
+// Now returns the clock's current time.
+func (c *ManualClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// AfterFunc creates a timer that will call f once the clock has been
+// advanced by at least the given duration.
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) Timer {
+	t := &manualTimer{clock: c, f: f}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by the given duration, firing
+// the timers that expire.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set sets the clock's time, firing the timers that expire. Timers
+// (re)armed by the callbacks are fired too if they expire by then.
+func (c *ManualClock) Set(now time.Time) {
+	for {
+		c.Lock()
+		// Find the first timer to expire
+		var t *manualTimer
+		for mt := range c.timers {
+			if !mt.when.After(now) && (t == nil || mt.when.Before(t.when)) {
+				t = mt
+			}
+		}
+		if t == nil {
+			c.now = now
+			c.Unlock()
+			return
+		}
+		// Move time up to the timer's expiration so that the callback
+		// observes the time at which it was supposed to fire.
+		if t.when.After(c.now) {
+			c.now = t.when
+		}
+		t.active = false
+		delete(c.timers, t)
+		f := t.f
+		c.Unlock()
+		f()
+	}
+}
+
+// Reset changes the timer to expire after the duration, measured from
+// the clock's current time.
+func (t *manualTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.Lock()
+	defer c.Unlock()
+	wasActive := t.active
+	t.when = c.now.Add(d)
+	t.active = true
+	c.timers[t] = struct{}{}
+	return wasActive
+}
+
+// Stop prevents the timer from firing.
+func (t *manualTimer) Stop() bool {
+	c := t.clock
+	c.Lock()
+	defer c.Unlock()
+	wasActive := t.active
+	t.active = false
+	delete(c.timers, t)
+	return wasActive
+}
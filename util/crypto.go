@@ -0,0 +1,42 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/tls"
+	"io"
+)
+
+// CryptoProvider is the source of the cryptographic primitives used for the
+// encryption of the stores and for the TLS connections of the server. The
+// implementation is selected at compile time: the default one relies on the
+// Go standard library, the one built with the `fips` tag requires a Go
+// toolchain using a FIPS 140-2 validated module (GOEXPERIMENT=boringcrypto)
+// and restricts TLS to the FIPS approved settings.
+type CryptoProvider interface {
+	// Name identifies the provider in the logs.
+	Name() string
+	// NewAEAD returns an AES-GCM cipher using the given 32 bytes key.
+	NewAEAD(key []byte) (cipher.AEAD, error)
+	// Rand returns the source of random bytes, used for nonces.
+	Rand() io.Reader
+	// ConfigureTLS restricts the versions, cipher suites and curves of the
+	// TLS configuration to those allowed by the provider.
+	ConfigureTLS(config *tls.Config)
+}
+
+// Crypto is the provider selected at compile time.
+var Crypto CryptoProvider = cryptoProvider{}
+
+// newAESGCM returns an AES-GCM cipher using the given key, with the
+// primitives of the crypto package, which are backed by the validated
+// module in FIPS builds.
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,48 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+//go:build fips
+// +build fips
+
+package util
+
+import (
+	"crypto/boring"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/tls"
+	// Restricts all TLS configurations to the FIPS approved settings. This
+	// package only exists in toolchains built with a validated module, so
+	// that a FIPS build can't be produced without one.
+	_ "crypto/tls/fipsonly"
+	"io"
+)
+
+// cryptoProvider uses the FIPS 140-2 validated module of the toolchain.
+type cryptoProvider struct{}
+
+func init() {
+	if !boring.Enabled() {
+		panic("FIPS build without a validated crypto module")
+	}
+}
+
+func (cryptoProvider) Name() string { return "FIPS 140-2 validated module" }
+
+func (cryptoProvider) NewAEAD(key []byte) (cipher.AEAD, error) { return newAESGCM(key) }
+
+func (cryptoProvider) Rand() io.Reader { return rand.Reader }
+
+// fipsCipherSuites are the FIPS approved TLS 1.2 cipher suites.
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+func (cryptoProvider) ConfigureTLS(config *tls.Config) {
+	config.MinVersion = tls.VersionTLS12
+	config.MaxVersion = tls.VersionTLS12
+	config.CipherSuites = fipsCipherSuites
+	config.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+}
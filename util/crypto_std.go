@@ -0,0 +1,28 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+//go:build !fips
+// +build !fips
+
+package util
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+)
+
+// cryptoProvider uses the Go standard library.
+type cryptoProvider struct{}
+
+func (cryptoProvider) Name() string { return "Go standard library" }
+
+func (cryptoProvider) NewAEAD(key []byte) (cipher.AEAD, error) { return newAESGCM(key) }
+
+func (cryptoProvider) Rand() io.Reader { return rand.Reader }
+
+func (cryptoProvider) ConfigureTLS(config *tls.Config) {
+	if config.MinVersion < tls.VersionTLS12 {
+		config.MinVersion = tls.VersionTLS12
+	}
+}
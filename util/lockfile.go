@@ -0,0 +1,36 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+//go:build !windows
+// +build !windows
+
+package util
+
+import (
+	"os"
+	"syscall"
+)
+
+// LockFile is an exclusive lock on a file, held until closed.
+type LockFile struct {
+	f *os.File
+}
+
+// CreateLockFile creates, if needed, the file with the given name and
+// takes an exclusive lock on it. An error is returned without waiting
+// if the lock is already held, by this or another process.
+func CreateLockFile(name string) (*LockFile, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &LockFile{f: f}, nil
+}
+
+// Close releases the lock.
+func (l *LockFile) Close() error {
+	return l.f.Close()
+}
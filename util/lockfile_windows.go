@@ -0,0 +1,20 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package util
+
+import (
+	"errors"
+)
+
+// LockFile is an exclusive lock on a file, held until closed.
+type LockFile struct{}
+
+// CreateLockFile is not supported on Windows.
+func CreateLockFile(name string) (*LockFile, error) {
+	return nil, errors.New("file locking not supported on windows")
+}
+
+// Close releases the lock.
+func (l *LockFile) Close() error {
+	return nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Redacted is what is printed instead of a secret value.
+const Redacted = "[REDACTED]"
+
+// Secret holds a sensitive value, such as a token, a password or an
+// encryption key. Its value is never printed, is compared in constant time,
+// and can be rotated, either directly or by reloading it from the file it
+// was created from.
+type Secret struct {
+	sync.RWMutex
+	value []byte
+	file  string
+}
+
+// NewSecret returns a Secret holding the given value.
+func NewSecret(value string) *Secret {
+	return &Secret{value: []byte(value)}
+}
+
+// NewSecretFromFile returns a Secret whose value is the content of the
+// given file, without leading and trailing white spaces.
+func NewSecretFromFile(file string) (*Secret, error) {
+	s := &Secret{file: file}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// IsSet returns true if the secret has a non empty value.
+func (s *Secret) IsSet() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.value) > 0
+}
+
+// Equal compares, in constant time, the given value with the secret.
+// The comparison is done on hashes so that the secret's length is not
+// leaked either. An empty secret never matches.
+func (s *Secret) Equal(candidate string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	if len(s.value) == 0 {
+		return false
+	}
+	expected := sha256.Sum256(s.value)
+	actual := sha256.Sum256([]byte(candidate))
+	return subtle.ConstantTimeCompare(expected[:], actual[:]) == 1
+}
+
+// Reveal returns a copy of the secret's value. It should only be used
+// to pass the value to the component that needs it, never to print it.
+func (s *Secret) Reveal() []byte {
+	s.RLock()
+	defer s.RUnlock()
+	v := make([]byte, len(s.value))
+	copy(v, s.value)
+	return v
+}
+
+// Set replaces the secret's value.
+func (s *Secret) Set(value string) {
+	s.Lock()
+	s.value = []byte(value)
+	s.Unlock()
+}
+
+// Reload reads again the secret's value from the file it was created from.
+// This is a no-op for secrets not created from a file. On error, the
+// current value is left unchanged.
+func (s *Secret) Reload() error {
+	s.RLock()
+	file := s.file
+	s.RUnlock()
+	if file == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	s.value = bytes.TrimSpace(content)
+	s.Unlock()
+	return nil
+}
+
+// String implements fmt.Stringer so that the value is never printed.
+func (s *Secret) String() string {
+	return Redacted
+}
+
+// GoString implements fmt.GoStringer so that the value is not printed
+// with the %#v verb either.
+func (s *Secret) GoString() string {
+	return Redacted
+}
+
+// RedactURL returns the given URL with the password, or the user if
+// there is no password (token authentication), replaced with Redacted.
+// Comma separated lists of URLs are supported. Strings that can't be
+// parsed as URLs are returned unchanged.
+func RedactURL(urls string) string {
+	list := strings.Split(urls, ",")
+	for i, s := range list {
+		trimmed := strings.TrimSpace(s)
+		u, err := url.Parse(trimmed)
+		if err != nil || u.User == nil {
+			continue
+		}
+		if _, hasPwd := u.User.Password(); hasPwd {
+			u.User = url.UserPassword(u.User.Username(), Redacted)
+		} else {
+			u.User = url.User(Redacted)
+		}
+		// Do not use u.String() which would escape the redacted marker.
+		list[i] = redactUserInfo(trimmed, u.User)
+	}
+	return strings.Join(list, ",")
+}
+
+// redactUserInfo replaces the user info of the URL with the given one.
+func redactUserInfo(rawurl string, user *url.Userinfo) string {
+	at := strings.LastIndex(rawurl, "@")
+	sep := strings.Index(rawurl, "://")
+	if at == -1 || sep == -1 || at < sep {
+		return rawurl
+	}
+	userInfo := user.Username()
+	if pwd, ok := user.Password(); ok {
+		userInfo += ":" + pwd
+	}
+	return rawurl[:sep+3] + userInfo + rawurl[at:]
+}
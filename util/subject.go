@@ -0,0 +1,36 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package util
+
+import (
+	"strings"
+)
+
+// SubjectMatches returns true if the literal subject matches the pattern,
+// which may contain the `*` and `>` wildcards.
+func SubjectMatches(pattern, subject string) bool {
+	ptoks := strings.Split(pattern, ".")
+	stoks := strings.Split(subject, ".")
+	for i, pt := range ptoks {
+		if pt == ">" {
+			return len(stoks) > i
+		}
+		if i >= len(stoks) || (pt != "*" && pt != stoks[i]) {
+			return false
+		}
+	}
+	return len(ptoks) == len(stoks)
+}
+
+// IsValidSubjectPattern returns true if the pattern is a subject, possibly
+// with the `*` and `>` wildcards.
+func IsValidSubjectPattern(pattern string) bool {
+	toks := strings.Split(pattern, ".")
+	for i, tok := range toks {
+		if tok == "" || (tok == ">" && i != len(toks)-1) ||
+			(tok != "*" && tok != ">" && strings.ContainsAny(tok, "*>")) {
+			return false
+		}
+	}
+	return true
+}